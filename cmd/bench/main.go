@@ -0,0 +1,106 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// node-cache-bench runs sequential and random read and write benchmarks on a
+// cache volume. It is in the driver image, so it can be run on a node's cache
+// with, for example,
+//
+//	kubectl exec -n node-cache DRIVER_POD -c csi -- /bench --dir=/local/lssd
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+
+	"k8s.io/apimachinery/pkg/api/resource"
+
+	"github.com/GoogleCloudPlatform/csi-node-cache/pkg/bench"
+)
+
+var (
+	dir           = flag.String("dir", "", "The directory on the cache volume to benchmark.")
+	size          = flag.String("size", "1Gi", "The file size for each job. This should be large compared with any device cache.")
+	seqBlockSize  = flag.String("seq-block-size", "1Mi", "The I/O size of sequential workloads.")
+	randBlockSize = flag.String("rand-block-size", "4Ki", "The I/O size of random workloads.")
+	jobs          = flag.Int("jobs", 4, "The number of concurrent jobs. Use enough to keep every RAID member busy.")
+	direct        = flag.Bool("direct", true, "Bypass the page cache with O_DIRECT. Must be false for tmpfs caches.")
+	workloads     = flag.String("workloads", strings.Join(bench.Workloads, ","), "A comma-separated list of the workloads to run, in order.")
+	output        = flag.String("o", "", "Output format: empty for a table, or json.")
+)
+
+func main() {
+	flag.Parse()
+
+	if *dir == "" {
+		fatal("missing --dir")
+	}
+	opts := bench.Options{
+		Dir:           *dir,
+		FileSize:      parseSize("size", *size),
+		SeqBlockSize:  int(parseSize("seq-block-size", *seqBlockSize)),
+		RandBlockSize: int(parseSize("rand-block-size", *randBlockSize)),
+		Jobs:          *jobs,
+		Direct:        *direct,
+		Workloads:     strings.Split(*workloads, ","),
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	results, err := bench.Run(ctx, opts)
+	if err != nil {
+		fatal("%v", err)
+	}
+
+	switch *output {
+	case "json":
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(results); err != nil {
+			fatal("%v", err)
+		}
+	case "":
+		printTable(results)
+	default:
+		fatal("unknown output format %q", *output)
+	}
+}
+
+func printTable(results []bench.Result) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "WORKLOAD\tMB/S\tIOPS\tSECONDS")
+	for _, r := range results {
+		fmt.Fprintf(w, "%s\t%.1f\t%.0f\t%.2f\n", r.Workload, r.MBps, r.IOPS, r.Seconds)
+	}
+	w.Flush()
+}
+
+func parseSize(flagName, value string) int64 {
+	q, err := resource.ParseQuantity(value)
+	if err != nil {
+		fatal("bad --%s: %v", flagName, err)
+	}
+	return q.Value()
+}
+
+func fatal(format string, args ...any) {
+	fmt.Fprintf(os.Stderr, "node-cache-bench: "+format+"\n", args...)
+	os.Exit(1)
+}
@@ -18,17 +18,48 @@ import (
 	"context"
 	"flag"
 	"os"
+	"strings"
+	"time"
 
+	"k8s.io/apimachinery/pkg/labels"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/log/zap"
 
 	"github.com/GoogleCloudPlatform/csi-node-cache/pkg/csi"
+	"github.com/GoogleCloudPlatform/csi-node-cache/pkg/deploygen"
+	"github.com/GoogleCloudPlatform/csi-node-cache/pkg/fault"
 )
 
 var (
+	describeFlags  = flag.Bool(deploygen.DescribeFlag, false, "Print the flags of the controller as JSON and exit, for generating deployment manifests")
 	namespace      = flag.String("namespace", "", "Namespace for worker pods")
 	volumeTypeMap  = flag.String("volume-type-map", "", "The name of the volume type config map, found in --namespace")
 	pdStorageClass = flag.String("pd-storage-class", "", "The storage class to use for the PD cache type. If empty, PD caches cannot be used")
+	provisionerSC  = flag.String("provisioner-storage-class", "", "If set, a PV with this storage class is created for each cache node so that the cache can be used through a PVC")
+	driverName     = flag.String("driver-name", "", "The driver name as specified in the CSIDriver object. Required if --provisioner-storage-class is used")
+	nodeSelector   = flag.String("node-selector", "", "An additional label selector for cache nodes. Only nodes with the volume type label are considered in any case")
+	webhookPort    = flag.Int("webhook-port", 0, "If positive, serve a validating webhook for pods using the driver on this port. Requires --driver-name")
+	webhookCertDir = flag.String("webhook-cert-dir", "/tmp/k8s-webhook-server/serving-certs", "The directory with the tls.crt and tls.key of the webhook")
+	injectFaults   = flag.String("inject-faults", os.Getenv(fault.EnvVar), "For testing only: attach, optionally with =count, to fail PD attaches as if they timed out. Defaults to $"+fault.EnvVar)
+	mappingWindow  = flag.Duration("mapping-write-window", time.Second, "Changes to the volume type map made within this window are batched into a single write")
+	peerSeeding    = flag.Bool("peer-seeding", false, "If set, choose a node with a warm cache of the same type for each new cache to be seeded from, when drivers run with --peer-address")
+	scopedNodes    = flag.Bool("scoped-node-cache", false, "If set, only nodes with the volume type label matching --node-selector are cached by the controller, rather than every node. Other nodes are read from the API server when needed. This saves memory in large clusters")
+	driverDS       = flag.String("driver-daemonset", "", "If set, the name of the driver DaemonSet in --namespace, whose required node affinity is kept matching the cache nodes, including --node-selector")
+	exportCluster  = flag.String("export-cluster", "", "The name of this cluster in fleet reports. Required with --export-url or --export-configmap")
+	exportInterval = flag.Duration("export-interval", 5*time.Minute, "How often the fleet report is exported")
+	exportURL      = flag.String("export-url", "", "If set, a gs://bucket/prefix location the fleet report of the cache nodes is written to, as <cluster>.json")
+	exportCM       = flag.String("export-configmap", "", "If set, the namespace/name of a ConfigMap the fleet report is written to, keyed by --export-cluster")
+	exportConfig   = flag.String("export-kubeconfig", "", "The kubeconfig of the fleet cluster holding --export-configmap. Defaults to this cluster")
+	adminAddress   = flag.String("admin-address", "", "If set, an address such as :9443 to serve the admin API on, over TLS. Requests are authorized with RBAC on the /node-cache/v1/ non-resource URLs")
+	adminCertDir   = flag.String("admin-cert-dir", "/tmp/k8s-admin-server/serving-certs", "The directory with the tls.crt and tls.key of the admin API")
+	removedPDs     = flag.String("removed-pd-policy", csi.RemovedPDDelete, "What happens to the PD of a pd or mirrored cache when the node-cache.gke.io label is removed from its node, once the driver has released the cache and the PD is detached: Delete, or Retain to keep it for when the node is labeled again. Existing disks are never deleted")
+	attachTimeout  = flag.Duration("attach-timeout", 2*time.Minute, "How long a PD attach operation is waited for before it is retried")
+	detachTimeout  = flag.Duration("detach-timeout", 2*time.Minute, "How long a PD detach operation is waited for before it is retried")
+	attachPoll     = flag.Duration("attach-poll-interval", 5*time.Second, "The pause before waiting again for a PD attach or detach operation that the compute API returned unfinished")
+	gceProject     = flag.String("project", "", "The project of the cluster's instances, for attaching PD caches. Defaults to the project in the metadata server")
+	zoneLabels     = flag.String("zone-labels", strings.Join(csi.DefaultZoneLabels, ","), "A comma-separated list of the node labels the zone of a node is read from, in order. The zone in the provider ID of GCE nodes is used if none is set")
+	healthProbes   = flag.String("health-probe-address", "", "If set, an address such as :8081 to serve the /healthz and /readyz probes on. The controller is ready once the volume type map can be read and the compute API can be reached")
+	rebuildMapping = flag.Bool("rebuild-mapping", false, "Instead of running the controller, regenerate the volume type map from the cache nodes, replace the stored map and exit")
 
 	setupLog = ctrl.Log.WithName("setup")
 )
@@ -39,6 +70,14 @@ func main() {
 	ctrl.SetLogger(zap.New(zap.UseFlagOptions(&zapOpts)))
 	flag.Parse()
 
+	if *describeFlags {
+		if err := deploygen.WriteOptions(os.Stdout, flag.CommandLine); err != nil {
+			setupLog.Error(err, "describing flags")
+			os.Exit(1)
+		}
+		return
+	}
+
 	ctx := context.Background()
 
 	problem := false
@@ -52,6 +91,34 @@ func main() {
 		problem = true
 	}
 
+	if *provisionerSC != "" && *driverName == "" {
+		setupLog.Error(nil, "missing --driver-name, required for --provisioner-storage-class")
+		problem = true
+	}
+
+	if *webhookPort > 0 && *driverName == "" {
+		setupLog.Error(nil, "missing --driver-name, required for --webhook-port")
+		problem = true
+	}
+
+	if (*exportURL != "" || *exportCM != "") && *exportCluster == "" {
+		setupLog.Error(nil, "missing --export-cluster, required for --export-url and --export-configmap")
+		problem = true
+	}
+
+	selector, err := labels.Parse(*nodeSelector)
+	if err != nil {
+		setupLog.Error(err, "bad --node-selector")
+		problem = true
+	}
+
+	if err := fault.Set(*injectFaults); err != nil {
+		setupLog.Error(err, "bad --inject-faults")
+		problem = true
+	} else if active := fault.Active(); len(active) > 0 {
+		setupLog.Info("injecting faults", "points", active)
+	}
+
 	if problem {
 		os.Exit(1)
 	}
@@ -60,17 +127,68 @@ func main() {
 
 	cfg := ctrl.GetConfigOrDie()
 
+	if *rebuildMapping {
+		nodes, err := csi.RebuildMapping(ctx, cfg, csi.ManagerOptions{
+			Namespace:           *namespace,
+			VolumeTypeConfigMap: *volumeTypeMap,
+			NodeSelector:        selector,
+		})
+		if err != nil {
+			setupLog.Error(err, "rebuilding mapping")
+			os.Exit(1)
+		}
+		setupLog.Info("rebuilt mapping", "nodes", nodes)
+		return
+	}
+
+	var zones []string
+	if *zoneLabels != "" {
+		zones = strings.Split(*zoneLabels, ",")
+	}
+
 	var attacher csi.Attacher
 	if *pdStorageClass != "" {
 		var err error
-		attacher, err = csi.NewAttacher(ctx, cfg)
+		attacher, err = csi.NewAttacher(ctx, cfg, csi.AttachOptions{
+			AttachTimeout: *attachTimeout,
+			DetachTimeout: *detachTimeout,
+			PollInterval:  *attachPoll,
+			Project:       *gceProject,
+			ZoneLabels:    zones,
+		})
 		if err != nil {
 			setupLog.Error(err, "getting attacher")
 			os.Exit(1)
 		}
 	}
 
-	mgr, err := csi.NewManager(cfg, *namespace, *volumeTypeMap, attacher, *pdStorageClass)
+	mgr, err := csi.NewManager(cfg, csi.ManagerOptions{
+		Namespace:               *namespace,
+		VolumeTypeConfigMap:     *volumeTypeMap,
+		Attacher:                attacher,
+		PdStorageClass:          *pdStorageClass,
+		ProvisionerStorageClass: *provisionerSC,
+		DriverName:              *driverName,
+		MappingWriteWindow:      *mappingWindow,
+		NodeSelector:            selector,
+		ScopedNodeCache:         *scopedNodes,
+		WebhookPort:             *webhookPort,
+		WebhookCertDir:          *webhookCertDir,
+		PeerSeeding:             *peerSeeding,
+		DriverDaemonSet:         *driverDS,
+		AdminAddress:            *adminAddress,
+		AdminCertDir:            *adminCertDir,
+		HealthProbeAddress:      *healthProbes,
+		ZoneLabels:              zones,
+		RemovedPDPolicy:         *removedPDs,
+		Export: csi.ExportOptions{
+			Cluster:    *exportCluster,
+			Interval:   *exportInterval,
+			URL:        *exportURL,
+			Kubeconfig: *exportConfig,
+			ConfigMap:  *exportCM,
+		},
+	})
 	if err != nil {
 		setupLog.Error(err, "new manager creation")
 		os.Exit(1)
@@ -0,0 +1,88 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// deploygen writes a Helm chart for the driver and controller from the flags
+// they describe with --describe-flags and the kustomize manifests. It is run
+// by `make chart`.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/GoogleCloudPlatform/csi-node-cache/pkg/deploygen"
+)
+
+var (
+	driverFlags     = flag.String("driver-flags", "", "The output of the driver with --describe-flags.")
+	controllerFlags = flag.String("controller-flags", "", "The output of the controller with --describe-flags.")
+	deployDir       = flag.String("deploy-dir", "deploy", "The directory of the kustomize manifests.")
+	out             = flag.String("out", "bin/chart", "The directory the chart is written to.")
+	name            = flag.String("name", "node-cache", "The name of the chart.")
+	version         = flag.String("version", "v0.0.0", "The version of the chart, usually the image tag.")
+)
+
+func main() {
+	flag.Parse()
+	if *driverFlags == "" || *controllerFlags == "" {
+		fatal("--driver-flags and --controller-flags are required")
+	}
+
+	components := []deploygen.Component{
+		{Name: "driver", Manifest: readFile(*deployDir, "driver.yaml"), Container: "csi", Options: readOptions(*driverFlags)},
+		{Name: "controller", Manifest: readFile(*deployDir, "controller.yaml"), Container: "controller", Options: readOptions(*controllerFlags)},
+	}
+	files, err := deploygen.Chart(*name, *version, components, readFile(*deployDir, "cluster.yaml"))
+	if err != nil {
+		fatal("%v", err)
+	}
+	for path, data := range files {
+		file := filepath.Join(*out, path)
+		if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+			fatal("%v", err)
+		}
+		if err := os.WriteFile(file, data, 0644); err != nil {
+			fatal("%v", err)
+		}
+	}
+	fmt.Printf("Wrote chart %s to %s\n", *name, *out)
+}
+
+func readFile(dir, name string) []byte {
+	data, err := os.ReadFile(filepath.Join(dir, name))
+	if err != nil {
+		fatal("%v", err)
+	}
+	return data
+}
+
+func readOptions(file string) []deploygen.Option {
+	f, err := os.Open(file)
+	if err != nil {
+		fatal("%v", err)
+	}
+	defer f.Close()
+	options, err := deploygen.ReadOptions(f)
+	if err != nil {
+		fatal("could not read options from %s: %v", file, err)
+	}
+	return options
+}
+
+func fatal(format string, args ...any) {
+	fmt.Fprintf(os.Stderr, "deploygen: "+format+"\n", args...)
+	os.Exit(1)
+}
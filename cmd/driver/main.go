@@ -15,24 +15,97 @@
 package main
 
 import (
+	"context"
 	"flag"
+	"os"
+	"strings"
+	"time"
 
 	"k8s.io/klog/v2"
 
 	"github.com/GoogleCloudPlatform/csi-node-cache/pkg/csi"
+	"github.com/GoogleCloudPlatform/csi-node-cache/pkg/deploygen"
+	"github.com/GoogleCloudPlatform/csi-node-cache/pkg/fault"
+	"github.com/GoogleCloudPlatform/csi-node-cache/pkg/helper"
+	"github.com/GoogleCloudPlatform/csi-node-cache/pkg/prewarm"
+	"github.com/GoogleCloudPlatform/csi-node-cache/pkg/raid"
+	"github.com/GoogleCloudPlatform/csi-node-cache/pkg/util"
+	"k8s.io/apimachinery/pkg/api/resource"
 	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/client-go/kubernetes"
 	ctrl "sigs.k8s.io/controller-runtime"
 )
 
 var (
-	driverVersion string // Set during build
+	// Set during build.
+	driverVersion string
+	gitCommit     string
+	buildDate     string
 
+	describeFlags = flag.Bool(deploygen.DescribeFlag, false, "Print the flags of the driver as JSON and exit, for generating deployment manifests.")
 	endpoint      = flag.String("endpoint", "unix:/tmp/csi.sock", "CSI endpoint")
 	nodeName      = flag.String("node-name", "", "The node name, probably pod spec.NodeName.")
 	namespace     = flag.String("namespace", "", "The namespace of the driver & the volume type map.")
 	volumeTypeMap = flag.String("volume-type-map", "", "The name of the volume type config map used by the controller")
+	mappingGrace  = flag.Duration("missing-mapping-grace", 30*time.Second, "How long a new cache waits for the controller to add the node to the volume type map before the pods waiting for it are told what is missing.")
 	driverName    = flag.String("driver-name", "", "The driver name as specified in the CSIDriver object.")
+	aliasName     = flag.String("alias-driver-name", "", "If set, a second CSIDriver name to serve on --alias-endpoint, such as the old name during a driver rename. Volumes using either name share the cache.")
+	aliasEndpoint = flag.String("alias-endpoint", "", "The CSI endpoint for --alias-driver-name, registered with its own node-driver-registrar.")
+
+	topology          = flag.Bool("topology", true, "If set, the node reports its cache type and size as CSI topology, which kubelet copies to topology.node-cache.gke.io node labels.")
+	maxInflightMounts = flag.Int("max-inflight-mounts", 0, "The maximum number of concurrent mount or format operations; others are queued. 0 means no limit.")
+	debugAddress      = flag.String("debug-address", "", "If set, the loopback address (eg localhost:9092) to serve the unauthenticated debugging endpoints on, such as "+csi.DebugPublishesPath+" listing the published volumes and the state of their mounts.")
+	metricsAddress    = flag.String("metrics-address", "", "If set, the address (eg :9090) to serve prometheus metrics on.")
+	raidSyncSpeedMin  = flag.Int("raid-sync-speed-min", 0, "If set, the dev.raid.speed_limit_min sysctl in KiB/s, the resync rate kept even when there is other I/O.")
+	raidSyncSpeedMax  = flag.Int("raid-sync-speed-max", 0, "If set, the dev.raid.speed_limit_max sysctl in KiB/s, limiting how much bandwidth array resync and rebuild may use.")
+	usageInterval     = flag.Duration("usage-report-interval", time.Minute, "How often cache usage is reported in the node-cache.gke.io/usage node annotation. 0 disables reports.")
+	allowedNamespaces = flag.String("allowed-namespaces", "", "If set, a comma-separated list of namespaces whose pods may mount the cache. With --allowed-service-accounts, pods matching either list are allowed; if neither is set, all pods are.")
+	allowedSAs        = flag.String("allowed-service-accounts", "", "If set, a comma-separated list of namespace/name service accounts whose pods may mount the cache.")
+	reportConsumers   = flag.Bool("report-consumers", false, "If set, an audit log of the pods that have mounted the cache is reported in the node-cache.gke.io/consumers node annotation with usage reports. Publishes are always logged.")
+	reportScore       = flag.Bool("report-score", false, "If set, the cache utilization of the node is reported as a score from 0 to 100 in the node-cache.gke.io/cache-score node annotation with usage reports, for the descheduler or other controllers to rebalance workloads on.")
+	scaleDownUtil     = flag.Float64("scale-down-protect-utilization", 0, "If positive, disable cluster autoscaler scale down of the node while the cache is at least this fraction full. Requires usage reports.")
+	scaleDownActivity = flag.Duration("scale-down-protect-activity", 0, "If positive, disable cluster autoscaler scale down of the node for this long after a pod last used the cache. Requires usage reports.")
+	flushURL          = flag.String("flush-url", "", "If set, a gs://bucket/prefix location that the cache is uploaded to when the node-cache.gke.io/flush=requested annotation is set on the node.")
+	flushPaths        = flag.String("flush-paths", "", "A comma-separated list of directories in the cache to flush. If empty, the whole cache is flushed.")
+	prewarmURL        = flag.String("prewarm-url", "", "If set, a gs://bucket/prefix location downloaded into each new cache in the background. Progress is reported in the node-cache.gke.io/prewarm-state node annotation.")
+	prewarmStreams    = flag.Int("prewarm-concurrency", prewarm.DefaultConcurrency, "The number of parallel ranged reads used to prewarm the cache.")
+	prewarmChunkMiB   = flag.Int("prewarm-chunk-mib", prewarm.DefaultChunkSize>>20, "The size of each ranged read used to prewarm the cache, in MiB.")
+	peerAddress       = flag.String("peer-address", "", "If set, a host:port on the pod network, such as $(POD_IP):9096, to serve the cache to other nodes on. New caches are seeded from the donor chosen by a controller running with --peer-seeding, before any prewarm.")
+	peerTokenFile     = flag.String("peer-token-file", "/var/run/secrets/node-cache/transfer-token", "With --peer-address, a service account token with the node-cache.gke.io/transfer audience, such as a projected volume, sent to peers when seeding.")
+	peerSA            = flag.String("peer-service-account", "node-cache-driver", "With --peer-address, the service account in --namespace whose tokens are accepted from peers.")
+	peerCertDir       = flag.String("peer-cert-dir", "/var/run/secrets/node-cache-peer-tls", "With --peer-address, a directory with the tls.crt and tls.key that peers are served with, issued for the name node-cache-transfer, and the ca.crt of the CA that issued the certificates of peers.")
+	peerRateMiB       = flag.Int("peer-rate-mib", 0, "If positive, the rate in MiB/s the cache is served to peers at, over all peers.")
+	backgroundRateMiB = flag.Int("background-rate-mib", 0, "If positive, the rate in MiB/s that prewarms, peer seeding and flushes may read or write at, together. The driver's cgroup is also limited to it on the cache device.")
+	backgroundIOPS    = flag.Int("background-iops", 0, "If positive, the operations per second that prewarms, peer seeding and flushes may make, together. The driver's cgroup is also limited to it on the cache device.")
+	backgroundLatency = flag.Duration("background-max-latency", 0, "If positive, background work is paused while the mean I/O latency of the cache device is above this, eg 20ms, and resumed once it is below half of it.")
+	latencyInterval   = flag.Duration("background-latency-interval", 5*time.Second, "How often the cache device latency is sampled, with --background-max-latency.")
+	publishSLO        = flag.Duration("publish-latency-slo", 0, "If positive, a warning event is made on the node when the p99 latency of volume publishes over --publish-latency-window is above this, eg 30s.")
+	sandboxHandlers   = flag.String("sandbox-runtime-handlers", "runsc", "A comma-separated list of RuntimeClass handlers of sandboxed runtimes such as gVisor. Publishes to their pods are checked to be visible from the sandbox. Empty disables the runtime class lookup.")
+	lifecycleModes    = flag.String("volume-lifecycle-modes", "Ephemeral,Persistent", "A comma-separated list of the volume lifecycle modes that may be published, matching the volumeLifecycleModes of the CSIDriver. Persistent volumes must be those provisioned by the controller.")
+	publishWindow     = flag.Duration("publish-latency-window", 10*time.Minute, "The window publish latency is measured over, with --publish-latency-slo. At most one event is made per window.")
+	flushOnDrain      = flag.Bool("flush-on-drain", false, "If set, also flush the cache when the node is cordoned for a drain.")
+	cacheRoot         = flag.String("cache-root", csi.DefaultCacheRoot, "The directory caches are mounted under. When using --helper-socket, this must be a host path mounted at the same path in the driver container, with HostToContainer mount propagation.")
+	helperSocket      = flag.String("helper-socket", "", "If set, the unix socket of a node-cache-helper on the host, which runs mount, mkfs, mdadm and similar commands so that the driver container need not be privileged.")
+	checkpointFile    = flag.String("checkpoint-file", "", "If set, published targets are recorded in this file, normally in the plugin directory, so that stale mounts can be cleaned up after a restart.")
+	stateDir          = flag.String("state-dir", "", "If set, a directory only the driver can read, where credentials from publish secrets, such as gcsfuse keys, are written while they are used. Defaults to a private directory under the system temporary directory.")
+	labelsRefresh     = flag.Duration("node-labels-refresh", 0, "If positive, how often the node's cache type label is re-read. When it changes, the old cache is released once unused and the new one is built, and tmpfs caches are resized in place. 0 means type and size changes need a driver restart.")
+	injectFaults      = flag.String("inject-faults", os.Getenv(fault.EnvVar), "For testing only: a comma-separated list of mkfs or mdadm, optionally with =count, to fail. Defaults to $"+fault.EnvVar+".")
+	mkfsOptions       = flag.String("mkfs-options", "", "Extra mkfs.ext4 arguments, separated by spaces, used when lssd, pd and mirrored caches are formatted. For example \"-E lazy_itable_init=0,lazy_journal_init=0\" does all initialization at format time rather than in the background after mounting.")
+	prepareInterval   = flag.Duration("prepare-cache-interval", 0, "If positive, the cache is created in the background as soon as its devices are available, retrying at this interval, so that the first publish doesn't wait for formatting. 0 creates the cache on the first publish.")
+	configFile        = flag.String("config-file", "", "If set, a YAML file, such as a mounted ConfigMap, whose settings override the corresponding flags. It is reloaded when it changes or on SIGHUP.")
+	manifestInterval  = flag.Duration("manifest-interval", 0, "If positive, how often to write a manifest of the cache contents to .node-cache-manifest.json at the cache root. 0 disables the manifest.")
+	trimInterval      = flag.Duration("trim-interval", 0, "If positive, how often to fstrim local SSD caches, eg 24h. 0 disables periodic trims.")
+	lssdDiscard       = flag.Bool("lssd-discard", false, "If set, mount local SSD caches with the discard option, as an alternative to --trim-interval. Existing mounts are unchanged until the cache is next mounted.")
+	mirrorSpares      = flag.String("mirror-spare-devices", "", "A comma-separated list of hot-spare devices for mirrored caches, such as /dev/disk/by-id/google-local-ssd-block3. A failed mirror member is rebuilt onto a spare automatically. Local SSDs listed here are not used in the local SSD array.")
+	pressureShrink    = flag.Float64("memory-pressure-shrink", 0, "If positive, the fraction of its size a tmpfs cache is shrunk to while the node has the MemoryPressure condition, evicting the least recently used files to fit. The size is restored when the pressure clears.")
+	pressureInterval  = flag.Duration("memory-pressure-interval", 30*time.Second, "How often the node's MemoryPressure condition is checked, with --memory-pressure-shrink.")
+	priorityReserve   = flag.Float64("high-priority-reserve", 0, "If positive, the fraction of the cache reserved for high priority consumers. Data published to volumes with the low priority attribute is limited to the rest, and the least recently used of it is evicted when it is over.")
+	priorityInterval  = flag.Duration("priority-quota-interval", time.Minute, "How often low priority data is accounted, with --high-priority-reserve.")
+	cacheEvents       = flag.Int("cache-event-watches", 0, "If positive, cache file events are watched with inotify and exported as metrics of files created and removed and of the busiest directories, watching up to this many directories. Each watch takes kernel memory, and counts against fs.inotify.max_user_watches.")
+	tmpfsMinFree      = flag.String("tmpfs-min-free-memory", "", "If set, a quantity such as 4Gi of the node's allocatable memory that tmpfs caches are capped to leave free.")
+	imageCachePath    = flag.String("image-cache-path", "", "If set, a host path where the container image store of lssd caches with the node-cache.gke.io/image-cache-size annotation is mounted, such as the root of containerd's snapshotter. It must be mounted in the driver container with Bidirectional mount propagation.")
+	bootDiskPath      = flag.String("boot-disk-path", "", "If set, a host path on the node's boot disk where the files of bootdisk and loop caches are kept. It must be mounted in the driver container.")
+	mirroredDegraded  = flag.Bool("mirrored-degraded-start", false, "If set, mirrored caches start from local SSD only when the PD is not yet attached, and the PD is added once it is. Any previous PD contents are discarded in that case.")
 )
 
 func init() {
@@ -48,6 +121,13 @@ func init() {
 func main() {
 	flag.Parse()
 
+	if *describeFlags {
+		if err := deploygen.WriteOptions(os.Stdout, flag.CommandLine); err != nil {
+			klog.Fatalf("Could not describe flags: %v", err)
+		}
+		return
+	}
+
 	if *nodeName == "" {
 		klog.Fatalf("Missing --node-name")
 	}
@@ -61,17 +141,170 @@ func main() {
 		klog.Fatalf("Missing --driver-name")
 	}
 
+	if err := fault.Set(*injectFaults); err != nil {
+		klog.Fatalf("Bad --inject-faults: %v", err)
+	}
+	if active := fault.Active(); len(active) > 0 {
+		klog.Warningf("Injecting faults at %v", active)
+	}
+
+	if *helperSocket != "" {
+		klog.V(2).Infof("Running privileged commands with the helper at %s", *helperSocket)
+		util.SetCommandRunner(helper.NewClient(*helperSocket))
+	}
+
+	if *raidSyncSpeedMin != 0 || *raidSyncSpeedMax != 0 {
+		if err := raid.SetGlobalSyncSpeedLimits(raid.SyncSpeedLimits{MinKBps: *raidSyncSpeedMin, MaxKBps: *raidSyncSpeedMax}); err != nil {
+			klog.Fatalf("Could not set raid sync speed limits: %v", err)
+		}
+	}
+
 	client, err := kubernetes.NewForConfig(ctrl.GetConfigOrDie())
 	if err != nil {
 		klog.Fatalf("could not create kubeclient: %v", err)
 	}
 
 	klog.V(4).Infof("Creating driver on %s", *nodeName)
-	driver, err := csi.NewDriver(client, *endpoint, *nodeName, types.NamespacedName{Namespace: *namespace, Name: *volumeTypeMap}, *driverName, driverVersion)
+	var paths []string
+	if *flushPaths != "" {
+		paths = strings.Split(*flushPaths, ",")
+	}
+	var spares []string
+	if *mirrorSpares != "" {
+		spares = strings.Split(*mirrorSpares, ",")
+	}
+	var namespaces, serviceAccounts []string
+	if *allowedNamespaces != "" {
+		namespaces = strings.Split(*allowedNamespaces, ",")
+	}
+	if *allowedSAs != "" {
+		serviceAccounts = strings.Split(*allowedSAs, ",")
+	}
+	var modes []string
+	if *lifecycleModes != "" {
+		modes = strings.Split(*lifecycleModes, ",")
+	}
+	var handlers []string
+	if *sandboxHandlers != "" {
+		handlers = strings.Split(*sandboxHandlers, ",")
+	}
+	var minFree resource.Quantity
+	if *tmpfsMinFree != "" {
+		if minFree, err = resource.ParseQuantity(*tmpfsMinFree); err != nil {
+			klog.Fatalf("Bad --tmpfs-min-free-memory: %v", err)
+		}
+	}
+
+	driver, err := csi.NewDriver(client, csi.DriverOptions{
+		Endpoint:            *endpoint,
+		NodeId:              *nodeName,
+		VolumeTypeMap:       types.NamespacedName{Namespace: *namespace, Name: *volumeTypeMap},
+		MissingMappingGrace: *mappingGrace,
+		DriverName:          *driverName,
+		DriverVersion:       driverVersion,
+		GitCommit:           gitCommit,
+		BuildDate:           buildDate,
+		AliasDriverName:     *aliasName,
+		AliasEndpoint:       *aliasEndpoint,
+		MaxInflightMounts:   *maxInflightMounts,
+		DisableTopology:     !*topology,
+
+		MirroredDegradedStart: *mirroredDegraded,
+		MirrorSpareDevices:    spares,
+		LocalSSDDiscard:       *lssdDiscard,
+		ImageCachePath:        *imageCachePath,
+		BootDiskPath:          *bootDiskPath,
+		MkfsOptions:           strings.Fields(*mkfsOptions),
+		ScaleDownUtilization:  *scaleDownUtil,
+		ScaleDownActivity:     *scaleDownActivity,
+		FlushURL:              *flushURL,
+		FlushPaths:            paths,
+		FlushOnDrain:          *flushOnDrain,
+		PrewarmURL:            *prewarmURL,
+		PrewarmConcurrency:    *prewarmStreams,
+		PrewarmChunkSize:      int64(*prewarmChunkMiB) << 20,
+		PeerAddress:           *peerAddress,
+		PeerTokenFile:         *peerTokenFile,
+		PeerServiceAccount:    *peerSA,
+		PeerCertDir:           *peerCertDir,
+		PeerBytesPerSecond:    int64(*peerRateMiB) << 20,
+		ReportConsumers:       *reportConsumers,
+		ReportScore:           *reportScore,
+		CacheRoot:             *cacheRoot,
+		CheckpointFile:        *checkpointFile,
+		StateDir:              *stateDir,
+		ConfigFile:            *configFile,
+		MemoryPressureShrink:  *pressureShrink,
+		HighPriorityReserve:   *priorityReserve,
+		TmpfsMinFreeMemory:    minFree,
+
+		BackgroundBytesPerSecond: int64(*backgroundRateMiB) << 20,
+		BackgroundIOPS:           int64(*backgroundIOPS),
+		BackgroundMaxLatency:     *backgroundLatency,
+
+		PublishLatencySLO:    *publishSLO,
+		PublishLatencyWindow: *publishWindow,
+
+		AllowedNamespaces:      namespaces,
+		AllowedServiceAccounts: serviceAccounts,
+		SandboxRuntimeHandlers: handlers,
+		VolumeLifecycleModes:   modes,
+	})
 	if err != nil {
 		klog.Fatalf("Cannot create driver: %v", err)
 	}
 
+	if *metricsAddress != "" {
+		go func() {
+			err := csi.ServeMetrics(*metricsAddress)
+			klog.Errorf("Metrics server exited: %v", err)
+		}()
+	}
+
+	if *debugAddress != "" {
+		go func() {
+			err := driver.ServeDebug(*debugAddress)
+			klog.Errorf("Debug server exited: %v", err)
+		}()
+	}
+
+	if *peerAddress != "" {
+		go func() {
+			err := driver.ServePeer(context.Background())
+			klog.Errorf("Peer server exited: %v", err)
+		}()
+	}
+
+	go driver.RunMaintenanceWatch(context.Background())
+	go driver.RunConfigWatch(context.Background())
+	if *labelsRefresh > 0 {
+		go driver.RunTypeChangeWatch(context.Background(), *labelsRefresh)
+	}
+	if *pressureShrink > 0 {
+		go driver.RunMemoryPressureWatch(context.Background(), *pressureInterval)
+	}
+	if *cacheEvents > 0 {
+		go driver.RunCacheEventWatch(context.Background(), *cacheEvents)
+	}
+	if *priorityReserve > 0 {
+		go driver.RunPriorityQuota(context.Background(), *priorityInterval)
+	}
+	if *backgroundLatency > 0 {
+		go driver.RunBackgroundScheduler(context.Background(), *latencyInterval)
+	}
+	if *prepareInterval > 0 {
+		go driver.RunCachePreparation(context.Background(), *prepareInterval)
+	}
+	if *trimInterval > 0 {
+		go driver.RunTrimLoop(context.Background(), *trimInterval)
+	}
+	if *usageInterval > 0 {
+		go driver.RunUsageReporter(context.Background(), *usageInterval)
+	}
+	if *manifestInterval > 0 {
+		go driver.RunManifestWriter(context.Background(), *manifestInterval)
+	}
+
 	err = driver.Run()
 	klog.Fatalf("Driver or server unexpectedly exited, with error %v", err)
 }
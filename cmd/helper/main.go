@@ -0,0 +1,50 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// node-cache-helper runs mount, mkfs, mdadm and similar commands on the host
+// for a driver running with --helper-socket.
+package main
+
+import (
+	"context"
+	"flag"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"k8s.io/klog/v2"
+
+	"github.com/GoogleCloudPlatform/csi-node-cache/pkg/helper"
+)
+
+var (
+	socket   = flag.String("socket", "/run/node-cache/helper.sock", "The unix socket to serve on. It is only accessible by root.")
+	commands = flag.String("commands", strings.Join(helper.DefaultCommands, ","), "A comma-separated list of the commands the driver may run.")
+)
+
+func init() {
+	klog.InitFlags(nil)
+	flag.Set("logtostderr", "true")
+}
+
+func main() {
+	flag.Parse()
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	if err := helper.NewServer(strings.Split(*commands, ",")).Serve(ctx, *socket); err != nil {
+		klog.Fatalf("Helper failed: %v", err)
+	}
+}
@@ -0,0 +1,100 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// kubectl-node_cache is a kubectl plugin, run as `kubectl node-cache`, that
+// shows the state of the node cache on each node.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+	ctrl "sigs.k8s.io/controller-runtime"
+
+	"github.com/GoogleCloudPlatform/csi-node-cache/pkg/csi"
+)
+
+var (
+	namespace     = flag.String("namespace", "node-cache", "The namespace of the node cache deployment.")
+	volumeTypeMap = flag.String("volume-type-map", "volume-type-map", "The name of the volume type config map in --namespace.")
+	output        = flag.String("o", "", "Output format: empty for a table, or json.")
+)
+
+func main() {
+	flag.Parse()
+
+	cfg, err := ctrl.GetConfig()
+	if err != nil {
+		fatal("could not get kubeconfig: %v", err)
+	}
+	client, err := kubernetes.NewForConfig(cfg)
+	if err != nil {
+		fatal("could not create client: %v", err)
+	}
+	statuses, err := csi.InspectNodeCaches(context.Background(), client, types.NamespacedName{Namespace: *namespace, Name: *volumeTypeMap})
+	if err != nil {
+		fatal("%v", err)
+	}
+
+	switch *output {
+	case "json":
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(statuses); err != nil {
+			fatal("%v", err)
+		}
+	case "":
+		printTable(statuses)
+	default:
+		fatal("unknown output format %q", *output)
+	}
+}
+
+func printTable(statuses []csi.NodeCacheStatus) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "NODE\tTYPE\tSIZE\tUSED\tDISK\tCLAIM\tMAINTENANCE\tPROBLEMS")
+	for _, s := range statuses {
+		used := "-"
+		if s.Usage != nil && s.Usage.BytesTotal > 0 {
+			used = fmt.Sprintf("%s/%s (%d%%)", quantity(s.Usage.BytesUsed), quantity(s.Usage.BytesTotal), 100*s.Usage.BytesUsed/s.Usage.BytesTotal)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+			dash(s.Node), dash(s.VolumeType), dash(s.Size), used, dash(s.Disk), dash(s.ClaimPhase), dash(s.MaintenanceState), dash(strings.Join(s.Problems, "; ")))
+	}
+	w.Flush()
+}
+
+func quantity(bytes int64) string {
+	return resource.NewQuantity(bytes, resource.BinarySI).String()
+}
+
+func dash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+func fatal(format string, args ...any) {
+	fmt.Fprintf(os.Stderr, "kubectl-node_cache: "+format+"\n", args...)
+	os.Exit(1)
+}
@@ -0,0 +1,62 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package e2e
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestLoopSetup(t *testing.T) {
+	skipUnlessLabeled(t, "loop")
+	ctx := context.Background()
+	defer testNamespaceSetup(ctx, t)()
+
+	pod := startCachePod(ctx, t, "mark", "loop")
+	node := pod.Spec.NodeName
+	if _, err := runOnPod(ctx, t, pod, "touch", "/cache/mark"); err != nil {
+		t.Fatalf("Could not touch cache: %v", err)
+	}
+	deletePod(ctx, t, pod)
+	pod = startCachePodOnNode(ctx, t, "check", node)
+	if out, err := runOnPod(ctx, t, pod, "ls", "/cache/mark"); err != nil || !strings.Contains(out, "/cache/mark") {
+		t.Fatalf("Could not verify mark: %s / %v", out, err)
+	}
+	deletePod(ctx, t, pod)
+}
+
+func TestLoopDriverRestart(t *testing.T) {
+	skipUnlessLabeled(t, "loop")
+	ctx := context.Background()
+	defer testNamespaceSetup(ctx, t)()
+
+	p1 := startCachePod(ctx, t, "p1", "loop")
+	node := p1.Spec.NodeName
+	if _, err := runOnPod(ctx, t, p1, "touch", "/cache/m1"); err != nil {
+		t.Fatalf("Could not touch 1: %v", err)
+	}
+
+	// Unlike tmpfs, the existing mount of the loop device is found after a
+	// restart.
+	restartDriver(ctx, t)
+
+	p2 := startCachePodOnNode(ctx, t, "p2", node)
+	if out, err := runOnPod(ctx, t, p2, "ls", "/cache/m1"); err != nil || !strings.Contains(out, "/cache/m1") {
+		t.Fatalf("Mark 1 not found after restart: %s / %v", out, err)
+	}
+	deletePod(ctx, t, p1)
+	deletePod(ctx, t, p2)
+}
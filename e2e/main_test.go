@@ -46,6 +46,10 @@ import (
 
 const (
 	nodeCacheNamespace = "node-cache"
+
+	// commandTimeout bounds commands run on pods and nodes, so that a hung
+	// mdadm or ssh fails the test rather than wedging it.
+	commandTimeout = 5 * time.Minute
 )
 
 var (
@@ -55,6 +59,8 @@ var (
 		}
 		return flag.String("kubeconfig-path", "", "absolute path to the kubeconfig file")
 	}()
+	detachTimeout = flag.Duration("detach-timeout", 2*time.Minute, "How long the detach of a leftover PV is waited for during cleanup.")
+	detachPoll    = flag.Duration("detach-poll-interval", 5*time.Second, "The pause before waiting again for a detach that the compute API returned unfinished during cleanup.")
 
 	K8sClient       *kubernetes.Clientset
 	NodeCacheLabels map[string]bool
@@ -119,14 +125,14 @@ func restartDriver(ctx context.Context, t *testing.T) {
 
 func runOnPod(ctx context.Context, t *testing.T, pod *corev1.Pod, cmd string, args ...string) (string, error) {
 	t.Helper()
-	output, err := util.RunCommand("kubectl", slices.Concat([]string{
+	result, err := util.RunCommandContext(ctx, util.CommandOptions{Timeout: commandTimeout}, "kubectl", slices.Concat([]string{
 		"exec",
 		fmt.Sprintf("--namespace=%s", testNamespace),
 		pod.GetName(),
 		"--",
 		cmd,
 	}, args)...)
-	return string(output), err
+	return string(result.Stdout) + string(result.Stderr), err
 }
 
 func runOnNode(ctx context.Context, t *testing.T, node, cmd string, args ...string) (string, error) {
@@ -136,10 +142,10 @@ func runOnNode(ctx context.Context, t *testing.T, node, cmd string, args ...stri
 	var cmdOutput string
 	// gcloud compute ssh can be flaky if a proxy is used, so we retry a couple of times.
 	err := wait.PollUntilContextTimeout(ctx, time.Second, time.Minute, true, func(ctx context.Context) (bool, error) {
-		output, err := util.RunCommand("gcloud", "compute", "ssh", "--zone", zone, node, cmd)
-		cmdOutput = string(output)
-		t.Logf("on %s ran %s %s: %s", node, cmd, strings.Join(args, " "), string(output))
-		if err != nil && strings.HasPrefix(cmdOutput, "RPC AclTests failed") {
+		result, err := util.RunCommandContext(ctx, util.CommandOptions{Timeout: commandTimeout}, "gcloud", "compute", "ssh", "--zone", zone, node, cmd)
+		cmdOutput = string(result.Stdout) + string(result.Stderr)
+		t.Logf("on %s ran %s %s: %s", node, cmd, strings.Join(args, " "), cmdOutput)
+		if err != nil && strings.HasPrefix(string(result.Stderr), "RPC AclTests failed") {
 			t.Logf("proxy error, retrying")
 			return false, nil
 		}
@@ -383,8 +389,8 @@ func cleanUpPds(ctx context.Context) error {
 				klog.Warningf("error detaching %s from %s, retrying: %v", pv, node, err)
 				continue
 			}
-			err = wait.PollUntilContextTimeout(ctx, 5*time.Second, 2*time.Minute, true, func(ctx context.Context) (bool, error) {
-				pollOp, err := computeSvc.ZoneOperations.Get(project, zone, op.Name).Context(ctx).Do()
+			err = wait.PollUntilContextTimeout(ctx, *detachPoll, *detachTimeout, true, func(ctx context.Context) (bool, error) {
+				pollOp, err := computeSvc.ZoneOperations.Wait(project, zone, op.Name).Context(ctx).Do()
 				if err != nil {
 					return false, err
 				}
@@ -16,6 +16,7 @@ package e2e
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"strings"
 	"testing"
@@ -41,7 +42,7 @@ func waitForPdCreation(ctx context.Context, t *testing.T) {
 		} else if err != nil {
 			return false, err
 		}
-		return strings.Contains(cm.Data["volume-types"], "disk="), nil
+		return strings.Contains(cm.Data["volume-types"], `"disk":`), nil
 	})
 	assert.NilError(t, err)
 }
@@ -147,21 +148,16 @@ func TestPdNodeDeletion(t *testing.T) {
 
 	cm, err := K8sClient.CoreV1().ConfigMaps(nodeCacheNamespace).Get(ctx, "volume-type-map", metav1.GetOptions{})
 	assert.NilError(t, err)
-	infos := strings.Split(cm.Data["volume-types"], "\n")
-	assert.Assert(t, len(infos) > 0)
-	items := strings.Split(infos[0], ",")
-	assert.Assert(t, len(items) > 0)
-	nodeName := strings.TrimSpace(items[0])
-
-	var pv string
-	for _, i := range items {
-		if !strings.Contains(i, "disk=") {
-			continue
+	var infos map[string]struct {
+		Disk string `json:"disk"`
+	}
+	assert.NilError(t, json.Unmarshal([]byte(cm.Data["volume-types"]), &infos))
+	var nodeName, pv string
+	for node, info := range infos {
+		if info.Disk != "" {
+			nodeName, pv = node, info.Disk
+			break
 		}
-		parts := strings.Split(i, "=")
-		assert.Assert(t, len(parts) == 2)
-		pv = strings.TrimSpace(parts[1])
-		break
 	}
 	assert.Assert(t, pv != "")
 
@@ -0,0 +1,127 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package e2e
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+var upgradeFromImage = flag.String("upgrade-from-image", "", "If set, the driver image of the previous release, used to test upgrading from it to the current image.")
+
+// setDriverImage rolls the driver DaemonSet out with image, returning the
+// image it had before.
+func setDriverImage(ctx context.Context, t *testing.T, image string) string {
+	t.Helper()
+	daemonSets := K8sClient.AppsV1().DaemonSets(nodeCacheNamespace)
+	ds, err := daemonSets.Get(ctx, "driver", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("could not get driver daemonset: %v", err)
+	}
+	var previous string
+	for i, c := range ds.Spec.Template.Spec.Containers {
+		if c.Name == "csi" {
+			previous = c.Image
+			ds.Spec.Template.Spec.Containers[i].Image = image
+		}
+	}
+	if previous == "" {
+		t.Fatalf("no csi container in driver daemonset")
+	}
+	if ds, err = daemonSets.Update(ctx, ds, metav1.UpdateOptions{}); err != nil {
+		t.Fatalf("could not update driver image to %s: %v", image, err)
+	}
+	generation := ds.GetGeneration()
+
+	t.Logf("%v: rolling driver out with %s", time.Now(), image)
+	if err := wait.PollUntilContextTimeout(ctx, 2*time.Second, 5*time.Minute, true, func(ctx context.Context) (bool, error) {
+		ds, err := daemonSets.Get(ctx, "driver", metav1.GetOptions{})
+		if err != nil {
+			t.Logf("waiting for driver rollout: %v", err)
+			return false, nil // retry
+		}
+		status := ds.Status
+		return status.ObservedGeneration >= generation &&
+			status.UpdatedNumberScheduled == status.DesiredNumberScheduled &&
+			status.NumberAvailable == status.DesiredNumberScheduled, nil
+	}); err != nil {
+		t.Fatalf("driver rollout of %s did not finish: %v", image, err)
+	}
+	t.Logf("%v: driver rolled out with %s", time.Now(), image)
+	return previous
+}
+
+func checkMark(ctx context.Context, t *testing.T, pod *corev1.Pod, mark string) {
+	t.Helper()
+	if out, err := runOnPod(ctx, t, pod, "ls", mark); err != nil || !strings.Contains(out, mark) {
+		t.Fatalf("%s not found on pod/%s: %s / %v", mark, pod.GetName(), out, err)
+	}
+}
+
+// TestDriverUpgrade starts cache pods with the previous driver release,
+// upgrades to the current one, and checks that the existing mounts are
+// adopted and new ones work.
+func TestDriverUpgrade(t *testing.T) {
+	if *upgradeFromImage == "" {
+		t.Skip("Skipping upgrade test as --upgrade-from-image is not set")
+	}
+	skipUnlessLabeled(t, "lssd")
+	ctx := context.Background()
+	defer testNamespaceSetup(ctx, t)()
+
+	current := setDriverImage(ctx, t, *upgradeFromImage)
+	defer func() {
+		if t.Failed() {
+			// Leave the current driver deployed for the other tests.
+			setDriverImage(ctx, t, current)
+		}
+	}()
+
+	p1 := startCachePod(ctx, t, "p1", "lssd")
+	node := p1.Spec.NodeName
+	if _, err := runOnPod(ctx, t, p1, "touch", "/cache/before"); err != nil {
+		t.Fatalf("Could not touch cache before upgrade: %v", err)
+	}
+
+	setDriverImage(ctx, t, current)
+
+	// The mount from before the upgrade must still be live and writable.
+	checkMark(ctx, t, p1, "/cache/before")
+	if _, err := runOnPod(ctx, t, p1, "touch", "/cache/after"); err != nil {
+		t.Fatalf("Could not write to cache mounted before upgrade: %v", err)
+	}
+
+	// A new publish must see the same cache.
+	p2 := startCachePodOnNode(ctx, t, "p2", node)
+	checkMark(ctx, t, p2, "/cache/before")
+	checkMark(ctx, t, p2, "/cache/after")
+
+	// Unpublishing a volume mounted by the old driver must work too.
+	deletePod(ctx, t, p1)
+	if out, err := runOnNode(ctx, t, node, "findmnt", "-n", "-o", "TARGET"); err != nil {
+		t.Fatalf("Could not list mounts on %s: %v", node, err)
+	} else if strings.Contains(out, fmt.Sprintf("pods/%s/", p1.GetUID())) {
+		t.Fatalf("Mount of deleted pod %s still on %s: %s", p1.GetName(), node, out)
+	}
+	deletePod(ctx, t, p2)
+}
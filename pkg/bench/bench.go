@@ -0,0 +1,232 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package bench measures a cache volume with fio-style sequential and random
+// read and write workloads, so that the throughput of a node shape, RAID
+// layout and mount options can be checked against expectations.
+package bench
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// The workloads. Sequential workloads read or write each file in order, and
+// random workloads do as many block-sized operations at random aligned
+// offsets.
+const (
+	SeqWrite  = "seqwrite"
+	SeqRead   = "seqread"
+	RandWrite = "randwrite"
+	RandRead  = "randread"
+)
+
+// Workloads are all the workloads, in the order they are normally run.
+var Workloads = []string{SeqWrite, SeqRead, RandWrite, RandRead}
+
+// directAlignment is the alignment of offsets and buffers for O_DIRECT.
+const directAlignment = 4096
+
+// Options configures Run.
+type Options struct {
+	// Dir is the directory on the volume to benchmark. Files are created in a
+	// temporary directory within it and removed afterwards.
+	Dir string
+	// FileSize is the size of the file used by each job.
+	FileSize int64
+	// SeqBlockSize and RandBlockSize are the I/O sizes of the sequential and
+	// random workloads.
+	SeqBlockSize  int
+	RandBlockSize int
+	// Jobs is the number of concurrent jobs, each with its own file.
+	Jobs int
+	// Direct bypasses the page cache with O_DIRECT. Not all filesystems,
+	// such as tmpfs, support it.
+	Direct bool
+	// Workloads to run, in order. If empty, all Workloads are run.
+	Workloads []string
+}
+
+// Result is the measurement of one workload.
+type Result struct {
+	Workload string  `json:"workload"`
+	Bytes    int64   `json:"bytes"`
+	Ops      int64   `json:"ops"`
+	Seconds  float64 `json:"seconds"`
+	MBps     float64 `json:"mbps"`
+	IOPS     float64 `json:"iops"`
+}
+
+// Run runs the workloads in opts.
+func Run(ctx context.Context, opts Options) ([]Result, error) {
+	if len(opts.Workloads) == 0 {
+		opts.Workloads = Workloads
+	}
+	if err := opts.validate(); err != nil {
+		return nil, err
+	}
+
+	dir, err := os.MkdirTemp(opts.Dir, "node-cache-bench-")
+	if err != nil {
+		return nil, fmt.Errorf("cannot create benchmark directory: %w", err)
+	}
+	defer os.RemoveAll(dir)
+	files := make([]string, opts.Jobs)
+	for i := range files {
+		files[i] = filepath.Join(dir, fmt.Sprintf("job-%d", i))
+	}
+
+	// Reads and random writes need the files to exist already.
+	if opts.Workloads[0] != SeqWrite {
+		if _, err := opts.run(ctx, SeqWrite, files); err != nil {
+			return nil, fmt.Errorf("cannot lay out benchmark files: %w", err)
+		}
+	}
+
+	var results []Result
+	for _, workload := range opts.Workloads {
+		result, err := opts.run(ctx, workload, files)
+		if err != nil {
+			return results, fmt.Errorf("%s: %w", workload, err)
+		}
+		results = append(results, result)
+	}
+	return results, nil
+}
+
+func (o Options) validate() error {
+	if o.Dir == "" {
+		return errors.New("no benchmark directory")
+	}
+	if o.Jobs < 1 {
+		return fmt.Errorf("bad job count %d", o.Jobs)
+	}
+	for _, bs := range []int{o.SeqBlockSize, o.RandBlockSize} {
+		if bs <= 0 || o.FileSize < int64(bs) || o.FileSize%int64(bs) != 0 {
+			return fmt.Errorf("block size %d must divide the file size %d", bs, o.FileSize)
+		}
+		if o.Direct && bs%directAlignment != 0 {
+			return fmt.Errorf("block size %d must be a multiple of %d for direct I/O", bs, directAlignment)
+		}
+	}
+	for _, w := range o.Workloads {
+		if !slices.Contains(Workloads, w) {
+			return fmt.Errorf("unknown workload %q", w)
+		}
+	}
+	return nil
+}
+
+// run runs a workload with a job per file.
+func (o Options) run(ctx context.Context, workload string, files []string) (Result, error) {
+	blockSize := o.SeqBlockSize
+	if workload == RandRead || workload == RandWrite {
+		blockSize = o.RandBlockSize
+	}
+	ops := o.FileSize / int64(blockSize)
+
+	var wg sync.WaitGroup
+	errs := make([]error, len(files))
+	start := time.Now()
+	for i, file := range files {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = o.job(ctx, workload, file, blockSize, ops, int64(i))
+		}()
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+	if err := errors.Join(errs...); err != nil {
+		return Result{}, err
+	}
+
+	totalOps := ops * int64(len(files))
+	result := Result{
+		Workload: workload,
+		Bytes:    totalOps * int64(blockSize),
+		Ops:      totalOps,
+		Seconds:  elapsed.Seconds(),
+	}
+	if result.Seconds > 0 {
+		result.MBps = float64(result.Bytes) / (1 << 20) / result.Seconds
+		result.IOPS = float64(result.Ops) / result.Seconds
+	}
+	return result, nil
+}
+
+// job does ops block-sized operations on file. Writes are synced before the
+// job finishes, so that they are included in the timing.
+func (o Options) job(ctx context.Context, workload, file string, blockSize int, ops, seed int64) error {
+	write := workload == SeqWrite || workload == RandWrite
+	flags := os.O_RDONLY
+	if write {
+		flags = os.O_RDWR | os.O_CREATE
+	}
+	if o.Direct {
+		flags |= unix.O_DIRECT
+	}
+	f, err := os.OpenFile(file, flags, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	// An anonymous mapping is page aligned, as O_DIRECT requires.
+	buf, err := unix.Mmap(-1, 0, blockSize, unix.PROT_READ|unix.PROT_WRITE, unix.MAP_ANON|unix.MAP_PRIVATE)
+	if err != nil {
+		return fmt.Errorf("cannot allocate buffer: %w", err)
+	}
+	defer unix.Munmap(buf)
+	rng := rand.New(rand.NewSource(seed))
+	if write {
+		rng.Read(buf)
+	}
+
+	random := workload == RandRead || workload == RandWrite
+	for op := int64(0); op < ops; op++ {
+		if op%64 == 0 {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+		}
+		offset := op * int64(blockSize)
+		if random {
+			offset = rng.Int63n(ops) * int64(blockSize)
+		}
+		if write {
+			_, err = f.WriteAt(buf, offset)
+		} else {
+			_, err = f.ReadAt(buf, offset)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if write {
+		if err := f.Sync(); err != nil {
+			return err
+		}
+	}
+	return f.Close()
+}
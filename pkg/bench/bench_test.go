@@ -0,0 +1,71 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bench
+
+import (
+	"context"
+	"os"
+	"testing"
+)
+
+func TestRun(t *testing.T) {
+	dir := t.TempDir()
+	for _, workloads := range [][]string{nil, {RandRead}} {
+		results, err := Run(context.Background(), Options{
+			Dir:           dir,
+			FileSize:      1 << 20,
+			SeqBlockSize:  64 << 10,
+			RandBlockSize: 4 << 10,
+			Jobs:          2,
+			Workloads:     workloads,
+		})
+		if err != nil {
+			t.Fatalf("%v: unexpected error: %v", workloads, err)
+		}
+		expected := workloads
+		if expected == nil {
+			expected = Workloads
+		}
+		if len(results) != len(expected) {
+			t.Fatalf("%v: unexpected results %+v", workloads, results)
+		}
+		for i, r := range results {
+			if r.Workload != expected[i] || r.Bytes != 2<<20 || r.Ops == 0 || r.MBps <= 0 {
+				t.Errorf("bad result %+v", r)
+			}
+		}
+	}
+	if entries, err := os.ReadDir(dir); err != nil || len(entries) != 0 {
+		t.Errorf("benchmark files left behind: %v, %v", entries, err)
+	}
+}
+
+func TestBadOptions(t *testing.T) {
+	good := Options{Dir: t.TempDir(), FileSize: 1 << 20, SeqBlockSize: 1 << 16, RandBlockSize: 1 << 12, Jobs: 1}
+	for name, modify := range map[string]func(o *Options){
+		"no dir":         func(o *Options) { o.Dir = "" },
+		"no jobs":        func(o *Options) { o.Jobs = 0 },
+		"uneven blocks":  func(o *Options) { o.SeqBlockSize = 3000 },
+		"big blocks":     func(o *Options) { o.RandBlockSize = 2 << 20 },
+		"direct aligned": func(o *Options) { o.Direct = true; o.RandBlockSize = 512 },
+		"workload":       func(o *Options) { o.Workloads = []string{"seqfoo"} },
+	} {
+		o := good
+		modify(&o)
+		if _, err := Run(context.Background(), o); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+}
@@ -0,0 +1,159 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package budget limits the I/O of the driver's background work, such as
+// prewarms, peer seeding and flushes, so that it doesn't compete with the
+// workloads using the cache. A Budget is shared by all background work and
+// limits its rate in bytes and operations per second. It can also be paused,
+// for example while the cache device is slow, which holds background work
+// until it is resumed.
+package budget
+
+import (
+	"context"
+	"io"
+	"sync"
+
+	"golang.org/x/time/rate"
+)
+
+// burstBytes is the most bytes taken from the budget at once.
+const burstBytes = 1 << 20
+
+// Budget is a shared rate limit. A nil Budget is unlimited and never paused.
+type Budget struct {
+	bytes *rate.Limiter
+	ops   *rate.Limiter
+
+	mutex sync.Mutex
+	// resumed is closed when the budget is resumed, and is nil while it is
+	// not paused.
+	resumed chan struct{}
+}
+
+// New creates a budget of bytesPerSecond and opsPerSecond. Zero rates are
+// unlimited.
+func New(bytesPerSecond, opsPerSecond int64) *Budget {
+	limit := func(r int64) rate.Limit {
+		if r <= 0 {
+			return rate.Inf
+		}
+		return rate.Limit(r)
+	}
+	return &Budget{
+		bytes: rate.NewLimiter(limit(bytesPerSecond), burstBytes),
+		ops:   rate.NewLimiter(limit(opsPerSecond), 1),
+	}
+}
+
+// Wait blocks until an operation of n bytes fits in the budget, and the budget
+// is not paused.
+func (b *Budget) Wait(ctx context.Context, n int64) error {
+	return b.wait(ctx, 1, n)
+}
+
+func (b *Budget) wait(ctx context.Context, ops int, n int64) error {
+	if b == nil {
+		return nil
+	}
+	if err := b.waitResumed(ctx); err != nil {
+		return err
+	}
+	if ops > 0 {
+		if err := b.ops.WaitN(ctx, ops); err != nil {
+			return err
+		}
+	}
+	for n > 0 {
+		chunk := min(n, burstBytes)
+		if err := b.bytes.WaitN(ctx, int(chunk)); err != nil {
+			return err
+		}
+		n -= chunk
+	}
+	return nil
+}
+
+func (b *Budget) waitResumed(ctx context.Context) error {
+	b.mutex.Lock()
+	resumed := b.resumed
+	b.mutex.Unlock()
+	if resumed == nil {
+		return nil
+	}
+	select {
+	case <-resumed:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Pause holds background work until Resume is called. Operations already
+// admitted continue.
+func (b *Budget) Pause() {
+	if b == nil {
+		return
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.resumed == nil {
+		b.resumed = make(chan struct{})
+	}
+}
+
+// Resume releases background work held by Pause.
+func (b *Budget) Resume() {
+	if b == nil {
+		return
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.resumed != nil {
+		close(b.resumed)
+		b.resumed = nil
+	}
+}
+
+// Paused returns true if the budget is paused.
+func (b *Budget) Paused() bool {
+	if b == nil {
+		return false
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.resumed != nil
+}
+
+// Reader returns a reader whose reads are taken from the byte budget. Reads
+// are not counted as operations.
+func (b *Budget) Reader(ctx context.Context, r io.Reader) io.Reader {
+	if b == nil {
+		return r
+	}
+	return &reader{ctx: ctx, budget: b, r: r}
+}
+
+type reader struct {
+	ctx    context.Context
+	budget *Budget
+	r      io.Reader
+}
+
+func (r *reader) Read(p []byte) (int, error) {
+	if err := r.budget.wait(r.ctx, 0, int64(len(p))); err != nil {
+		return 0, err
+	}
+	return r.r.Read(p)
+}
@@ -0,0 +1,171 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package budget
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNilBudget(t *testing.T) {
+	var b *Budget
+	if err := b.Wait(context.Background(), 1<<40); err != nil {
+		t.Errorf("nil budget wait: %v", err)
+	}
+	b.Pause()
+	if b.Paused() {
+		t.Errorf("nil budget paused")
+	}
+	r := strings.NewReader("data")
+	if b.Reader(context.Background(), r) != r {
+		t.Errorf("nil budget wrapped reader")
+	}
+}
+
+func TestPause(t *testing.T) {
+	b := New(0, 0)
+	b.Pause()
+	if !b.Paused() {
+		t.Fatalf("budget not paused")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := b.Wait(ctx, 1); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("paused wait got %v, expected deadline exceeded", err)
+	}
+
+	done := make(chan error)
+	go func() { done <- b.Wait(context.Background(), 1) }()
+	select {
+	case err := <-done:
+		t.Fatalf("paused wait returned %v", err)
+	case <-time.After(20 * time.Millisecond):
+	}
+	b.Resume()
+	if err := <-done; err != nil {
+		t.Errorf("resumed wait: %v", err)
+	}
+	if b.Paused() {
+		t.Errorf("budget still paused")
+	}
+}
+
+func TestRate(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+
+	// The first burst is free, the rest takes a second per burst.
+	b := New(burstBytes, 0)
+	if err := b.Wait(ctx, burstBytes); err != nil {
+		t.Errorf("first burst: %v", err)
+	}
+	if err := b.Wait(ctx, burstBytes); err == nil {
+		t.Errorf("second burst was not limited")
+	}
+
+	b = New(0, 1)
+	if err := b.Wait(ctx, 0); err != nil {
+		t.Errorf("first op: %v", err)
+	}
+	if err := b.Wait(ctx, 0); err == nil {
+		t.Errorf("second op was not limited")
+	}
+
+	b = New(10, 0)
+	data, err := io.ReadAll(b.Reader(ctx, strings.NewReader(strings.Repeat("x", 2*burstBytes))))
+	if err == nil {
+		t.Errorf("read of %d bytes was not limited", len(data))
+	}
+}
+
+func TestLimitCgroup(t *testing.T) {
+	dir := t.TempDir()
+	procSelfCgroup = filepath.Join(dir, "cgroup")
+	cgroupRoot = filepath.Join(dir, "fs")
+	defer func() {
+		procSelfCgroup = "/proc/self/cgroup"
+		cgroupRoot = "/sys/fs/cgroup"
+	}()
+	if err := os.WriteFile(procSelfCgroup, []byte("0::/kubepods/pod1/driver\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	group := filepath.Join(cgroupRoot, "kubepods", "pod1", "driver")
+	if err := os.MkdirAll(group, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := LimitCgroup(Device{Major: 9, Minor: 0}, 100<<20, 0); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(filepath.Join(group, "io.max"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "9:0 rbps=104857600 wbps=104857600 riops=max wiops=max"; string(data) != want {
+		t.Errorf("io.max = %q, want %q", data, want)
+	}
+
+	if err := os.WriteFile(procSelfCgroup, []byte("1:cpu:/\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := LimitCgroup(Device{Major: 9, Minor: 0}, 1, 1); err == nil {
+		t.Errorf("cgroup v1 was accepted")
+	}
+}
+
+func TestSampleDevice(t *testing.T) {
+	sysDevBlock = t.TempDir()
+	defer func() { sysDevBlock = "/sys/dev/block" }()
+	dev := Device{Major: 259, Minor: 1}
+	if err := os.MkdirAll(filepath.Join(sysDevBlock, "259:1"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	write := func(stat string) {
+		if err := os.WriteFile(filepath.Join(sysDevBlock, "259:1", "stat"), []byte(stat), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	write("     100        0     800      50      100        0      800      150        0      0      0\n")
+	prev, err := SampleDevice(dev)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if prev != (Sample{IOs: 200, Ticks: 200}) {
+		t.Errorf("sample = %+v", prev)
+	}
+	write("     150        0     800     150      150        0      800      550        0      0      0\n")
+	cur, err := SampleDevice(dev)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if latency := Latency(prev, cur); latency != 5*time.Millisecond {
+		t.Errorf("latency = %v, expected 5ms", latency)
+	}
+	if latency := Latency(cur, cur); latency != 0 {
+		t.Errorf("latency without I/O = %v", latency)
+	}
+
+	write("1 2 3\n")
+	if _, err := SampleDevice(dev); err == nil {
+		t.Errorf("short stat was accepted")
+	}
+}
@@ -0,0 +1,136 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package budget
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// Variables for testing.
+var (
+	procSelfCgroup = "/proc/self/cgroup"
+	cgroupRoot     = "/sys/fs/cgroup"
+	sysDevBlock    = "/sys/dev/block"
+)
+
+// ErrNoDevice is returned for a path that is not on a block device, such as
+// a tmpfs.
+var ErrNoDevice = errors.New("not on a block device")
+
+// Device is the major:minor number of a block device.
+type Device struct {
+	Major, Minor uint32
+}
+
+func (d Device) String() string {
+	return fmt.Sprintf("%d:%d", d.Major, d.Minor)
+}
+
+// DeviceOf returns the block device holding the filesystem of path.
+func DeviceOf(path string) (Device, error) {
+	var st unix.Stat_t
+	if err := unix.Stat(path, &st); err != nil {
+		return Device{}, fmt.Errorf("could not stat %s: %w", path, err)
+	}
+	dev := Device{Major: unix.Major(st.Dev), Minor: unix.Minor(st.Dev)}
+	if dev.Major == 0 {
+		// Anonymous devices, used by tmpfs, overlay, nfs and fuse.
+		return Device{}, ErrNoDevice
+	}
+	return dev, nil
+}
+
+// LimitCgroup limits the I/O of the calling process's cgroup on dev with the
+// cgroup v2 io.max controller. This bounds all I/O of the driver to the
+// cache, including what the kernel writes back on its behalf, which a Budget
+// can't see. Zero rates are unlimited.
+func LimitCgroup(dev Device, bytesPerSecond, opsPerSecond int64) error {
+	cgroup, err := ownCgroup()
+	if err != nil {
+		return err
+	}
+	limit := func(r int64) string {
+		if r <= 0 {
+			return "max"
+		}
+		return strconv.FormatInt(r, 10)
+	}
+	line := fmt.Sprintf("%s rbps=%s wbps=%s riops=%s wiops=%s", dev, limit(bytesPerSecond), limit(bytesPerSecond), limit(opsPerSecond), limit(opsPerSecond))
+	file := filepath.Join(cgroup, "io.max")
+	if err := os.WriteFile(file, []byte(line), 0644); err != nil {
+		return fmt.Errorf("could not set %s: %w", file, err)
+	}
+	return nil
+}
+
+// ownCgroup returns the directory of the cgroup v2 group of this process.
+func ownCgroup() (string, error) {
+	data, err := os.ReadFile(procSelfCgroup)
+	if err != nil {
+		return "", err
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if path, found := strings.CutPrefix(line, "0::"); found {
+			return filepath.Join(cgroupRoot, path), nil
+		}
+	}
+	return "", errors.New("not in a cgroup v2 hierarchy")
+}
+
+// Sample is a reading of the cumulative I/O statistics of a device.
+type Sample struct {
+	// IOs is the number of completed reads and writes.
+	IOs uint64
+	// Ticks is the total time in milliseconds reads and writes took.
+	Ticks uint64
+}
+
+// SampleDevice reads the statistics of dev from sysfs.
+func SampleDevice(dev Device) (Sample, error) {
+	data, err := os.ReadFile(filepath.Join(sysDevBlock, dev.String(), "stat"))
+	if err != nil {
+		return Sample{}, err
+	}
+	// The fields are documented in Documentation/block/stat.rst. Reads are
+	// fields 1 and 4, writes 5 and 8, counting from 1.
+	fields := strings.Fields(string(data))
+	if len(fields) < 8 {
+		return Sample{}, fmt.Errorf("short stat for %s: %q", dev, data)
+	}
+	var values [8]uint64
+	for i := range values {
+		if values[i], err = strconv.ParseUint(fields[i], 10, 64); err != nil {
+			return Sample{}, fmt.Errorf("bad stat for %s: %w", dev, err)
+		}
+	}
+	return Sample{IOs: values[0] + values[4], Ticks: values[3] + values[7]}, nil
+}
+
+// Latency returns the mean latency of the I/Os completed between two samples,
+// or zero if there were none.
+func Latency(prev, cur Sample) time.Duration {
+	if cur.IOs <= prev.IOs || cur.Ticks < prev.Ticks {
+		return 0
+	}
+	return time.Duration(cur.Ticks-prev.Ticks) * time.Millisecond / time.Duration(cur.IOs-prev.IOs)
+}
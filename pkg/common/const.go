@@ -17,6 +17,220 @@ package common
 const (
 	VolumeTypeLabel = "node-cache.gke.io"
 	SizeLabel       = "node-cache-size.gke.io"
+
+	// VolumeTypeAttribute is a volume attribute requiring a cache type.
+	// Publishing fails on a node with a different type.
+	VolumeTypeAttribute = "type"
+	// PathAttribute is a volume attribute giving a directory in the cache,
+	// such as models/llm, to mount instead of the whole cache. It is created
+	// if it doesn't exist.
+	PathAttribute = "path"
+	// CloneAttribute is a volume attribute giving a directory in the cache,
+	// like PathAttribute, of which each pod gets a private, writable copy.
+	// The copy is made with reflinks, so it is cheap, and removed when the
+	// pod's volume is unpublished. The cache must have ReflinkAnnotation.
+	CloneAttribute = "clone"
+	// SandboxAttribute is a volume attribute saying whether pods using the
+	// volume run in a sandboxed runtime, SandboxGVisor or SandboxNone. If not
+	// set, the driver looks up the runtime class of the pod.
+	SandboxAttribute = "sandbox"
+	SandboxGVisor    = "gvisor"
+	SandboxNone      = "none"
+	// PriorityAttribute is a volume attribute giving the priority tier of the
+	// volume's consumers, PriorityHigh or PriorityLow. Low priority volumes
+	// must have a PathAttribute, and the data under it is limited to the
+	// part of the cache not reserved for high priority consumers. The default
+	// is PriorityHigh.
+	PriorityAttribute = "priority"
+	PriorityHigh      = "high"
+	PriorityLow       = "low"
+	// PrewarmAttribute is a volume attribute saying when the volume may be
+	// published on a node whose cache is still being filled by a prewarm or
+	// from a peer: PrewarmEager publishes straight away, with files appearing
+	// as they are copied, and PrewarmStrict waits until the cache is filled.
+	// The default is PrewarmEager.
+	PrewarmAttribute = "prewarm"
+	PrewarmEager     = "eager"
+	PrewarmStrict    = "strict"
+	// KubeletAttributePrefix is the prefix of volume attributes added by
+	// kubelet rather than the volume spec.
+	KubeletAttributePrefix = "csi.storage.k8s.io/"
+
+	// NQNs aren't valid label values, so the NVMe-oF target is given by annotations.
+	NVMeoFAddressAnnotation = "node-cache.gke.io/nvmeof-address"
+	NVMeoFNQNAnnotation     = "node-cache.gke.io/nvmeof-nqn"
+
+	// ISCSIPortalAnnotation may list several portals separated by ';', if multipath is used.
+	ISCSIPortalAnnotation     = "node-cache.gke.io/iscsi-portal"
+	ISCSIIQNAnnotation        = "node-cache.gke.io/iscsi-iqn"
+	ISCSILUNAnnotation        = "node-cache.gke.io/iscsi-lun"
+	ISCSIChapSecretAnnotation = "node-cache.gke.io/iscsi-chap-secret"
+	ISCSIMultipathAnnotation  = "node-cache.gke.io/iscsi-multipath"
+
+	// NFSMountOptionsAnnotation is a ';'-separated list of nfs mount options.
+	NFSServerAnnotation       = "node-cache.gke.io/nfs-server"
+	NFSExportAnnotation       = "node-cache.gke.io/nfs-export"
+	NFSMountOptionsAnnotation = "node-cache.gke.io/nfs-mount-options"
+
+	GCSFuseBucketAnnotation = "node-cache.gke.io/gcsfuse-bucket"
+
+	// HugepageSizeAnnotation is the page size of a hugetlbfs cache, a
+	// quantity such as 2Mi or 1Gi; the default is 2Mi. The node must have a
+	// pool of pages of this size.
+	HugepageSizeAnnotation = "node-cache.gke.io/hugepage-size"
+
+	// DedupAnnotation enables deduplication for lssd and pd caches. The only
+	// supported value is DedupVDO. DedupRatioAnnotation optionally gives the
+	// logical size of the deduplicated device as a multiple of its physical
+	// size; the default is 1.
+	DedupAnnotation      = "node-cache.gke.io/dedup"
+	DedupRatioAnnotation = "node-cache.gke.io/dedup-ratio"
+
+	DedupVDO = "vdo"
+
+	// CompressionAnnotation enables transparent compression for pd caches,
+	// which are then formatted with btrfs. The value is a btrfs compress
+	// option: zstd, lzo or zlib, optionally with a level as in zstd:3.
+	CompressionAnnotation = "node-cache.gke.io/compression"
+
+	// ReflinkAnnotation, set to "true", formats lssd and pd caches with xfs
+	// with reflinks, which clone publishes need. See CloneAttribute. It only
+	// applies when the cache is formatted.
+	ReflinkAnnotation = "node-cache.gke.io/reflink"
+
+	// ImageCacheSizeAnnotation dedicates part of an lssd cache to a container
+	// image store, as a quantity smaller than the cache size. The driver
+	// mounts the store at its image cache path, for containerd's snapshotter
+	// to use. It only applies when the cache is created.
+	ImageCacheSizeAnnotation = "node-cache.gke.io/image-cache-size"
+
+	// RaidChunkSizeAnnotation overrides the chunk size of the local SSD array
+	// of lssd, mirrored and gcsfuse caches, which is otherwise chosen from the
+	// machine type and number of local SSDs. It is a quantity such as 256Ki,
+	// and only applies when the array is created.
+	RaidChunkSizeAnnotation = "node-cache.gke.io/raid-chunk-size"
+
+	// ExistingDiskAnnotation names an existing GCE disk to use for a pd or
+	// mirrored cache instead of provisioning one, as a volume handle of the
+	// form projects/<project>/zones/<zone>/disks/<name>, or
+	// projects/<project>/regions/<region>/disks/<name> for a regional disk.
+	// The full URL of the disk is also accepted.
+	ExistingDiskAnnotation = "node-cache.gke.io/existing-disk"
+
+	// StorageClassAnnotation overrides the controller's --pd-storage-class for
+	// the PD of a pd or mirrored cache on the node, so that nodes may use
+	// different disk types such as pd-ssd and hyperdisk-balanced. The class
+	// must use the PD CSI driver. It only applies when the PD is created.
+	StorageClassAnnotation = "node-cache.gke.io/storage-class"
+
+	// ShardGroupAnnotation puts a node in a group of nodes that each prewarm a
+	// different shard of the prewarm location, rather than all of it. The
+	// controller assigns the shards by consistent hashing.
+	ShardGroupAnnotation = "node-cache.gke.io/shard-group"
+
+	// The driver reports the cache type and size as topology segments, which
+	// the kubelet copies to node labels for use in node affinity.
+	TopologyTypeKey = "topology.node-cache.gke.io/type"
+	TopologySizeKey = "topology.node-cache.gke.io/size"
+
+	// CapacityAnnotation is set by the driver to a JSON report of the
+	// hardware of its node: the number of local SSDs and the maximum size of
+	// each cache type they and the node's memory allow. The controller
+	// refuses size labels larger than this.
+	CapacityAnnotation = "node-cache.gke.io/capacity"
+
+	// UsageAnnotation is set by the driver to a JSON report of the cache usage
+	// on its node.
+	UsageAnnotation = "node-cache.gke.io/usage"
+
+	// CacheScoreAnnotation is set by the driver, if enabled, to how saturated
+	// the cache on its node is, from 0 to 100, for the descheduler or other
+	// controllers to rebalance cache-heavy workloads on.
+	CacheScoreAnnotation = "node-cache.gke.io/cache-score"
+
+	// ConsumersAnnotation is set by the driver, if enabled, to a JSON audit log
+	// of the pods that have mounted the cache on its node.
+	ConsumersAnnotation = "node-cache.gke.io/consumers"
+
+	// ScaleDownProtectedAnnotation marks a node where the driver has disabled
+	// cluster autoscaler scale down, so that it only removes its own setting.
+	ScaleDownProtectedAnnotation = "node-cache.gke.io/scale-down-protected"
+
+	// RemovingLabel is set by the controller on a node whose VolumeTypeLabel
+	// has been removed while it has a cache. It keeps the driver on the node,
+	// which releases the cache as for maintenance once it is unused. The
+	// controller then cleans up any PD and the volume type map entry, and
+	// removes the label.
+	RemovingLabel = "node-cache.gke.io/removing"
+
+	// MaintenanceAnnotation is set to MaintenanceRequested by an administrator
+	// to release the cache on a node. Progress is reported in
+	// MaintenanceStateAnnotation.
+	MaintenanceAnnotation      = "node-cache.gke.io/maintenance"
+	MaintenanceStateAnnotation = "node-cache.gke.io/maintenance-state"
+
+	MaintenanceRequested = "requested"
+	// MaintenanceDraining means new publishes are refused, and the driver is
+	// waiting for existing consumers to unpublish.
+	MaintenanceDraining = "draining"
+	// MaintenanceReleased means the cache is unmounted and any arrays stopped.
+	MaintenanceReleased = "released"
+	// MaintenanceDetached means a PD cache has also been detached. This is
+	// only reached for cache types that use a PD.
+	MaintenanceDetached = "detached"
+
+	// FlushAnnotation is set to FlushRequested to upload the cache to GCS, if
+	// the driver has a flush location. Progress is reported in
+	// FlushStateAnnotation.
+	FlushAnnotation      = "node-cache.gke.io/flush"
+	FlushStateAnnotation = "node-cache.gke.io/flush-state"
+
+	FlushRequested = "requested"
+	FlushRunning   = "flushing"
+	FlushDone      = "flushed"
+	FlushFailed    = "failed"
+
+	// PrewarmStateAnnotation is set by the driver to the progress of filling
+	// a new cache from its prewarm location, if it has one.
+	PrewarmStateAnnotation = "node-cache.gke.io/prewarm-state"
+
+	PrewarmRunning = "prewarming"
+	// PrewarmSeeding means the cache is being copied from a peer node.
+	PrewarmSeeding = "seeding"
+	PrewarmDone    = "prewarmed"
+	PrewarmFailed  = "failed"
+
+	// PeerAddressAnnotation is set by a driver serving its cache to peers to
+	// its host:port on the pod network.
+	PeerAddressAnnotation = "node-cache.gke.io/peer-address"
+	// SeedDonorAnnotation is set by the controller, with peer seeding, on a
+	// node with a new cache to the name of a node with a warm cache of the same
+	// type to seed it from. It is removed once the cache has been filled.
+	SeedDonorAnnotation = "node-cache.gke.io/seed-donor"
+
+	// AttachStateAnnotation is set by the controller on PD cache PVCs to the
+	// progress of attaching the disk to its node. AttachErrorAnnotation holds
+	// the last error, and is removed once the step succeeds.
+	AttachStateAnnotation = "node-cache.gke.io/attach-state"
+	AttachErrorAnnotation = "node-cache.gke.io/attach-error"
+
+	// AttachWaitingForMapping means the volume type map does not yet include
+	// the node of the PVC.
+	AttachWaitingForMapping = "waiting-for-mapping"
+	// AttachWaitingForBind means the PVC has not yet been bound to a PV.
+	AttachWaitingForBind = "waiting-for-bind"
+	AttachAttaching      = "attaching"
+	AttachAttached       = "attached"
+	// AttachTimedOut means the attach operation did not finish within the
+	// attach timeout of the controller. It is retried, as the operation may
+	// still complete.
+	AttachTimedOut = "timed-out"
+	// AttachZoneMismatch means the disk was provisioned in a different zone
+	// than the node and can't be attached. This is not retried.
+	AttachZoneMismatch = "zone-mismatch"
+	// AttachDeferred means the node is in maintenance, which detaches and
+	// reattaches the disk itself.
+	AttachDeferred = "deferred"
 )
 
 type VolumePendingError struct{ error }
@@ -24,3 +238,8 @@ type VolumePendingError struct{ error }
 func NewVolumePendingError(err error) error {
 	return &VolumePendingError{err}
 }
+
+// Unwrap returns the reason the volume is pending.
+func (e *VolumePendingError) Unwrap() error {
+	return e.error
+}
@@ -0,0 +1,262 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package csi
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	authenticationv1 "k8s.io/api/authentication/v1"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+// AdminPathPrefix is the prefix of the admin API paths. Access is granted by
+// RBAC rules for these non-resource URLs, eg nonResourceURLs:
+// ["/node-cache/*"] with the get verb.
+const AdminPathPrefix = "/node-cache/v1/"
+
+// ReconcileError is the last error reconciling a node.
+type ReconcileError struct {
+	Error string      `json:"error"`
+	Time  metav1.Time `json:"time"`
+}
+
+// AdminNodeStatus is the state of a node's cache served by the admin API.
+type AdminNodeStatus struct {
+	NodeCacheStatus
+	// LastReconcileError is set if the last reconcile of the node failed.
+	LastReconcileError *ReconcileError `json:"lastReconcileError,omitempty"`
+}
+
+// reconcileErrors tracks the last reconcile error of each node. A successful
+// reconcile clears it.
+type reconcileErrors struct {
+	mutex  sync.Mutex
+	errors map[string]ReconcileError
+}
+
+func newReconcileErrors() *reconcileErrors {
+	return &reconcileErrors{errors: map[string]ReconcileError{}}
+}
+
+func (e *reconcileErrors) record(node string, err error, now time.Time) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	if err == nil {
+		delete(e.errors, node)
+	} else {
+		e.errors[node] = ReconcileError{Error: err.Error(), Time: metav1.NewTime(now)}
+	}
+}
+
+func (e *reconcileErrors) get(node string) *ReconcileError {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	if err, found := e.errors[node]; found {
+		return &err
+	}
+	return nil
+}
+
+// Errors of admin API authorization, for requests without a valid token or
+// whose user may not access the path.
+var (
+	errUnauthenticated = errors.New("unauthenticated")
+	errForbidden       = errors.New("forbidden")
+)
+
+// adminServer serves the admin API. Each request is authenticated by its
+// bearer token with a TokenReview, and authorized for its path with a
+// SubjectAccessReview, so that access is managed with RBAC.
+type adminServer struct {
+	address string
+	certDir string
+	errors  *reconcileErrors
+	// inspect and mapping read the state of the cluster.
+	inspect func(ctx context.Context) ([]NodeCacheStatus, error)
+	mapping func(ctx context.Context) (map[string]volumeTypeInfo, error)
+	// authorize checks that the holder of token may get path, returning
+	// errUnauthenticated or errForbidden if not.
+	authorize func(ctx context.Context, token, path string) error
+}
+
+func newAdminServer(client kubernetes.Interface, volumeTypeMap types.NamespacedName, address, certDir string, reconcileErrs *reconcileErrors) *adminServer {
+	return &adminServer{
+		address: address,
+		certDir: certDir,
+		errors:  reconcileErrs,
+		inspect: func(ctx context.Context) ([]NodeCacheStatus, error) {
+			return InspectNodeCaches(ctx, client, volumeTypeMap)
+		},
+		mapping: func(ctx context.Context) (map[string]volumeTypeInfo, error) {
+			configMap, err := client.CoreV1().ConfigMaps(volumeTypeMap.Namespace).Get(ctx, volumeTypeMap.Name, metav1.GetOptions{})
+			if apierrors.IsNotFound(err) {
+				return map[string]volumeTypeInfo{}, nil
+			} else if err != nil {
+				return nil, err
+			}
+			return getVolumeTypeMapping(configMap.Data)
+		},
+		authorize: func(ctx context.Context, token, path string) error {
+			return authorizeAdmin(ctx, client, token, path)
+		},
+	}
+}
+
+// authorizeAdmin checks that the user of token may get path.
+func authorizeAdmin(ctx context.Context, client kubernetes.Interface, token, path string) error {
+	review, err := client.AuthenticationV1().TokenReviews().Create(ctx, &authenticationv1.TokenReview{
+		Spec: authenticationv1.TokenReviewSpec{Token: token},
+	}, metav1.CreateOptions{})
+	if err != nil {
+		return fmt.Errorf("token review failed: %w", err)
+	}
+	if !review.Status.Authenticated {
+		return errUnauthenticated
+	}
+	user := review.Status.User
+	extra := map[string]authorizationv1.ExtraValue{}
+	for key, value := range user.Extra {
+		extra[key] = authorizationv1.ExtraValue(value)
+	}
+	access, err := client.AuthorizationV1().SubjectAccessReviews().Create(ctx, &authorizationv1.SubjectAccessReview{
+		Spec: authorizationv1.SubjectAccessReviewSpec{
+			User:                  user.Username,
+			Groups:                user.Groups,
+			UID:                   user.UID,
+			Extra:                 extra,
+			NonResourceAttributes: &authorizationv1.NonResourceAttributes{Path: path, Verb: "get"},
+		},
+	}, metav1.CreateOptions{})
+	if err != nil {
+		return fmt.Errorf("access review failed: %w", err)
+	}
+	if !access.Status.Allowed {
+		return fmt.Errorf("%w: %s may not get %s", errForbidden, user.Username, path)
+	}
+	return nil
+}
+
+func (s *adminServer) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET "+AdminPathPrefix+"nodes", func(w http.ResponseWriter, r *http.Request) {
+		statuses, err := s.nodeStatuses(r.Context())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, statuses)
+	})
+	mux.HandleFunc("GET "+AdminPathPrefix+"nodes/{node}", func(w http.ResponseWriter, r *http.Request) {
+		statuses, err := s.nodeStatuses(r.Context())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		for _, status := range statuses {
+			if status.Node == r.PathValue("node") {
+				writeJSON(w, status)
+				return
+			}
+		}
+		http.Error(w, "no cache on node "+r.PathValue("node"), http.StatusNotFound)
+	})
+	mux.HandleFunc("GET "+AdminPathPrefix+"mapping", func(w http.ResponseWriter, r *http.Request) {
+		mapping, err := s.mapping(r.Context())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, mapping)
+	})
+	return s.authenticated(mux)
+}
+
+// authenticated passes authorized requests to next.
+func (s *adminServer) authenticated(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !found || token == "" {
+			http.Error(w, "a bearer token is required", http.StatusUnauthorized)
+			return
+		}
+		err := s.authorize(r.Context(), token, r.URL.Path)
+		switch {
+		case errors.Is(err, errUnauthenticated):
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		case errors.Is(err, errForbidden):
+			log.FromContext(r.Context()).Info("admin request refused", "path", r.URL.Path, "error", err)
+			http.Error(w, errForbidden.Error(), http.StatusForbidden)
+			return
+		case err != nil:
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// nodeStatuses returns the state of every cache node with its last reconcile
+// error.
+func (s *adminServer) nodeStatuses(ctx context.Context) ([]AdminNodeStatus, error) {
+	nodes, err := s.inspect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	statuses := make([]AdminNodeStatus, 0, len(nodes))
+	for _, node := range nodes {
+		statuses = append(statuses, AdminNodeStatus{NodeCacheStatus: node, LastReconcileError: s.errors.get(node.Node)})
+	}
+	return statuses, nil
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(v)
+}
+
+// Start implements manager.Runnable, serving the API over TLS until ctx is
+// done. As reconcile errors are only known to the leader, only it serves.
+func (s *adminServer) Start(ctx context.Context) error {
+	server := &http.Server{
+		Addr:              s.address,
+		Handler:           s.handler(),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go func() {
+		<-ctx.Done()
+		server.Close()
+	}()
+	err := server.ListenAndServeTLS(filepath.Join(s.certDir, "tls.crt"), filepath.Join(s.certDir, "tls.key"))
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+	return err
+}
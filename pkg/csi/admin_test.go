@@ -0,0 +1,96 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package csi
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"gotest.tools/v3/assert"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+func TestAdminServer(t *testing.T) {
+	reconcileErrs := newReconcileErrors()
+	s := &adminServer{
+		errors: reconcileErrs,
+		inspect: func(ctx context.Context) ([]NodeCacheStatus, error) {
+			return []NodeCacheStatus{
+				{Node: "node-1", VolumeType: "lssd"},
+				{Node: "node-2", VolumeType: "pd", ClaimPhase: "Bound", AttachState: "attaching"},
+			}, nil
+		},
+		mapping: func(ctx context.Context) (map[string]volumeTypeInfo, error) {
+			return map[string]volumeTypeInfo{"node-1": {VolumeType: "lssd", Size: resource.MustParse("375Gi")}}, nil
+		},
+		authorize: func(ctx context.Context, token, path string) error {
+			switch token {
+			case "admin":
+				return nil
+			case "viewer":
+				return errForbidden
+			case "broken":
+				return errors.New("token review failed")
+			}
+			return errUnauthenticated
+		},
+	}
+	reconcileErrs.record("node-2", errors.New("attach failed"), time.Now())
+	reconcileErrs.record("node-1", errors.New("transient"), time.Now())
+	reconcileErrs.record("node-1", nil, time.Now())
+
+	server := httptest.NewServer(s.handler())
+	defer server.Close()
+	get := func(path, token string, v any) int {
+		req, err := http.NewRequest(http.MethodGet, server.URL+path, nil)
+		assert.NilError(t, err)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		assert.NilError(t, err)
+		defer resp.Body.Close()
+		if v != nil && resp.StatusCode == http.StatusOK {
+			assert.NilError(t, json.NewDecoder(resp.Body).Decode(v))
+		}
+		return resp.StatusCode
+	}
+
+	var statuses []AdminNodeStatus
+	assert.Equal(t, get("/node-cache/v1/nodes", "admin", &statuses), http.StatusOK)
+	assert.Equal(t, len(statuses), 2)
+	assert.Assert(t, statuses[0].LastReconcileError == nil)
+	assert.Equal(t, statuses[1].LastReconcileError.Error, "attach failed")
+	assert.Equal(t, statuses[1].AttachState, "attaching")
+
+	var status AdminNodeStatus
+	assert.Equal(t, get("/node-cache/v1/nodes/node-2", "admin", &status), http.StatusOK)
+	assert.Equal(t, status.VolumeType, "pd")
+	assert.Equal(t, get("/node-cache/v1/nodes/node-3", "admin", nil), http.StatusNotFound)
+
+	var mapping map[string]volumeTypeInfo
+	assert.Equal(t, get("/node-cache/v1/mapping", "admin", &mapping), http.StatusOK)
+	assert.Equal(t, mapping["node-1"].VolumeType, "lssd")
+
+	assert.Equal(t, get("/node-cache/v1/nodes", "", nil), http.StatusUnauthorized)
+	assert.Equal(t, get("/node-cache/v1/nodes", "forged", nil), http.StatusUnauthorized)
+	assert.Equal(t, get("/node-cache/v1/nodes", "viewer", nil), http.StatusForbidden)
+	assert.Equal(t, get("/node-cache/v1/nodes", "broken", nil), http.StatusServiceUnavailable)
+}
@@ -0,0 +1,130 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package csi
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/GoogleCloudPlatform/csi-node-cache/pkg/common"
+)
+
+// validateVolumeAttributes checks the attributes of a volume spec. If
+// available is not nil, a requested type must be one of its keys.
+func validateVolumeAttributes(attributes map[string]string, available map[string]bool) error {
+	for key, value := range attributes {
+		switch {
+		case key == common.VolumeTypeAttribute:
+			if !isKnownVolumeType(value) {
+				return fmt.Errorf("unknown cache type %q", value)
+			}
+			if available != nil && !available[value] {
+				return fmt.Errorf("no node has a %s cache", value)
+			}
+		case key == common.PathAttribute:
+			if err := validateSubPath(value); err != nil {
+				return err
+			}
+		case key == common.CloneAttribute:
+			if err := validateCloneAttributes(attributes); err != nil {
+				return err
+			}
+		case key == common.SandboxAttribute:
+			if value != common.SandboxGVisor && value != common.SandboxNone {
+				return fmt.Errorf("sandbox must be %s or %s, got %q", common.SandboxGVisor, common.SandboxNone, value)
+			}
+		case key == common.PriorityAttribute:
+			if err := validatePriority(attributes); err != nil {
+				return err
+			}
+		case key == common.PrewarmAttribute:
+			if value != common.PrewarmEager && value != common.PrewarmStrict {
+				return fmt.Errorf("prewarm must be %s or %s, got %q", common.PrewarmEager, common.PrewarmStrict, value)
+			}
+		case strings.HasPrefix(key, common.KubeletAttributePrefix):
+			// Set by kubelet.
+		default:
+			return fmt.Errorf("unknown volume attribute %q", key)
+		}
+	}
+	return nil
+}
+
+// validateSubPath checks a path attribute, which must be a relative path that
+// stays within the cache.
+func validateSubPath(subPath string) error {
+	if subPath == "" {
+		return fmt.Errorf("empty cache path")
+	}
+	if filepath.IsAbs(subPath) {
+		return fmt.Errorf("cache path %q must be relative", subPath)
+	}
+	for _, part := range strings.Split(subPath, "/") {
+		if part == ".." {
+			return fmt.Errorf("cache path %q must not contain ..", subPath)
+		}
+	}
+	if isPrivatePath(subPath) {
+		return fmt.Errorf("cache path %q is private to the driver", subPath)
+	}
+	return nil
+}
+
+// validateCloneAttributes checks the clone attribute, if any, which is a
+// cache path like the path attribute and can't be used with it.
+func validateCloneAttributes(attributes map[string]string) error {
+	clone, found := attributes[common.CloneAttribute]
+	if !found {
+		return nil
+	}
+	if _, found := attributes[common.PathAttribute]; found {
+		return fmt.Errorf("the %s and %s attributes can't both be set", common.PathAttribute, common.CloneAttribute)
+	}
+	return validateSubPath(clone)
+}
+
+// validatePriority checks the priority attribute, if any. Low priority data is
+// accounted by its directory, so a low priority volume needs a path.
+func validatePriority(attributes map[string]string) error {
+	priority, found := attributes[common.PriorityAttribute]
+	if !found {
+		return nil
+	}
+	switch priority {
+	case common.PriorityHigh:
+		return nil
+	case common.PriorityLow:
+		subPath, found := attributes[common.PathAttribute]
+		if !found {
+			return fmt.Errorf("%s priority volumes need the %s attribute", common.PriorityLow, common.PathAttribute)
+		}
+		// Otherwise all of the cache would become low priority.
+		if filepath.Clean(subPath) == "." {
+			return fmt.Errorf("%s priority volumes can't use the root of the cache", common.PriorityLow)
+		}
+		return nil
+	}
+	return fmt.Errorf("priority must be %s or %s, got %q", common.PriorityHigh, common.PriorityLow, priority)
+}
+
+// isKnownVolumeType returns true for the cache types supported by the driver.
+func isKnownVolumeType(volumeType string) bool {
+	switch volumeType {
+	case "tmpfs", "lssd", pdVolumeType, mirroredVolumeType, nvmeofVolumeType, iscsiVolumeType, nfsVolumeType, gcsfuseVolumeType, hugetlbfsVolumeType, bootdiskVolumeType, loopVolumeType:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,129 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package csi
+
+import (
+	"context"
+	"encoding/json"
+	"slices"
+	"sync"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/klog/v2"
+
+	"github.com/GoogleCloudPlatform/csi-node-cache/pkg/common"
+)
+
+const (
+	// maxConsumerRecords bounds the audit log, keeping it well under the
+	// annotation size limit. The oldest records are dropped first.
+	maxConsumerRecords = 100
+
+	// Pod information added to the volume context by kubelet, as the
+	// CSIDriver has podInfoOnMount.
+	podNameKey           = common.KubeletAttributePrefix + "pod.name"
+	podNamespaceKey      = common.KubeletAttributePrefix + "pod.namespace"
+	podUIDKey            = common.KubeletAttributePrefix + "pod.uid"
+	podServiceAccountKey = common.KubeletAttributePrefix + "serviceAccount.name"
+)
+
+// ConsumerRecord is an entry in the audit log of pods that have mounted the
+// cache, reported as JSON in the common.ConsumersAnnotation annotation.
+type ConsumerRecord struct {
+	Pod            string    `json:"pod"`
+	Namespace      string    `json:"namespace"`
+	UID            types.UID `json:"uid,omitempty"`
+	ServiceAccount string    `json:"serviceAccount,omitempty"`
+	// Path is the directory of the cache that was mounted, if not the whole
+	// cache.
+	Path      string      `json:"path,omitempty"`
+	ReadOnly  bool        `json:"readOnly,omitempty"`
+	Published metav1.Time `json:"published"`
+	// Unpublished is set once the pod has unmounted the cache.
+	Unpublished *metav1.Time `json:"unpublished,omitempty"`
+
+	target string
+}
+
+// consumerLog is the audit log of cache consumers, most recent last.
+type consumerLog struct {
+	mutex   sync.Mutex
+	records []ConsumerRecord
+}
+
+// published records a publish to target with the given volume context.
+func (l *consumerLog) published(target string, volumeContext map[string]string, readOnly bool, now time.Time) {
+	record := ConsumerRecord{
+		Pod:            volumeContext[podNameKey],
+		Namespace:      volumeContext[podNamespaceKey],
+		UID:            types.UID(volumeContext[podUIDKey]),
+		ServiceAccount: volumeContext[podServiceAccountKey],
+		Path:           volumeContext[common.PathAttribute],
+		ReadOnly:       readOnly,
+		Published:      metav1.NewTime(now),
+		target:         target,
+	}
+	if record.UID == "" {
+		record.UID = targetPodUID(target)
+	}
+	klog.InfoS("audit: cache published", "pod", klog.KRef(record.Namespace, record.Pod), "uid", record.UID, "serviceAccount", record.ServiceAccount, "path", record.Path, "readOnly", readOnly, "target", target)
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.records = append(l.records, record)
+	if len(l.records) > maxConsumerRecords {
+		l.records = slices.Delete(l.records, 0, len(l.records)-maxConsumerRecords)
+	}
+}
+
+// unpublished marks the most recent publish to target as unpublished.
+func (l *consumerLog) unpublished(target string, now time.Time) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	for i := len(l.records) - 1; i >= 0; i-- {
+		record := &l.records[i]
+		if record.target == target && record.Unpublished == nil {
+			record.Unpublished = &metav1.Time{Time: now}
+			klog.InfoS("audit: cache unpublished", "pod", klog.KRef(record.Namespace, record.Pod), "uid", record.UID, "target", target)
+			return
+		}
+	}
+}
+
+// snapshot returns a copy of the records.
+func (l *consumerLog) snapshot() []ConsumerRecord {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return slices.Clone(l.records)
+}
+
+// reportConsumers writes the audit log to the common.ConsumersAnnotation
+// annotation on the node.
+func (d *Driver) reportConsumers(ctx context.Context) {
+	records := d.consumers.snapshot()
+	if len(records) == 0 {
+		return
+	}
+	value, err := json.Marshal(records)
+	if err != nil {
+		klog.Errorf("Could not encode consumers: %v", err)
+		return
+	}
+	if err := d.setNodeAnnotation(ctx, common.ConsumersAnnotation, string(value)); err != nil {
+		klog.Errorf("Could not report consumers: %v", err)
+	}
+}
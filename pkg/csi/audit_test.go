@@ -0,0 +1,60 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package csi
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"gotest.tools/v3/assert"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+func TestConsumerLog(t *testing.T) {
+	var log consumerLog
+	now := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	target := "/var/lib/kubelet/pods/1234/volumes/kubernetes.io~csi/cache/mount"
+
+	log.published(target, map[string]string{
+		"csi.storage.k8s.io/pod.name":            "trainer",
+		"csi.storage.k8s.io/pod.namespace":       "ml",
+		"csi.storage.k8s.io/serviceAccount.name": "default",
+		"path":                                   "models/llm",
+	}, true, now)
+	records := log.snapshot()
+	assert.Equal(t, len(records), 1)
+	assert.Equal(t, records[0].Pod, "trainer")
+	assert.Equal(t, records[0].Namespace, "ml")
+	assert.Equal(t, records[0].UID, types.UID("1234"), "uid from the target path")
+	assert.Equal(t, records[0].ServiceAccount, "default")
+	assert.Equal(t, records[0].Path, "models/llm")
+	assert.Assert(t, records[0].ReadOnly)
+	assert.Assert(t, records[0].Unpublished == nil)
+
+	log.unpublished(target, now.Add(time.Minute))
+	records = log.snapshot()
+	assert.Equal(t, records[0].Unpublished.Time, now.Add(time.Minute))
+
+	// Unknown targets are ignored.
+	log.unpublished("/somewhere/else", now)
+
+	for i := range maxConsumerRecords + 5 {
+		log.published(fmt.Sprintf("/target/%d", i), nil, false, now)
+	}
+	records = log.snapshot()
+	assert.Equal(t, len(records), maxConsumerRecords)
+	assert.Equal(t, records[len(records)-1].target, fmt.Sprintf("/target/%d", maxConsumerRecords+4))
+}
@@ -0,0 +1,108 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package csi
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/klog/v2"
+
+	"github.com/GoogleCloudPlatform/csi-node-cache/pkg/budget"
+	"github.com/GoogleCloudPlatform/csi-node-cache/pkg/localvolume"
+)
+
+// limitBackgroundIO limits the driver's I/O to the cache device with its
+// cgroup, if background rates are set. The budget only sees the work the
+// driver does itself, not the page cache writeback it causes. volMutex must
+// be held.
+func (d *Driver) limitBackgroundIO(vol localvolume.LocalVolume) {
+	if d.backgroundBytesPerSecond <= 0 && d.backgroundIOPS <= 0 {
+		return
+	}
+	dev, err := budget.DeviceOf(vol.Path())
+	if errors.Is(err, budget.ErrNoDevice) {
+		return
+	} else if err != nil {
+		klog.Warningf("Could not find the cache device to limit background I/O: %v", err)
+		return
+	}
+	if err := budget.LimitCgroup(dev, d.backgroundBytesPerSecond, d.backgroundIOPS); err != nil {
+		klog.Warningf("Could not limit driver I/O on %s with its cgroup, only prewarms and flushes are limited: %v", dev, err)
+		return
+	}
+	klog.V(2).Infof("Limited driver I/O on %s to %d bytes/s and %d IOPS", dev, d.backgroundBytesPerSecond, d.backgroundIOPS)
+}
+
+// RunBackgroundScheduler samples the latency of the cache device every
+// interval until ctx is done, pausing background work while it is above the
+// maximum.
+func (d *Driver) RunBackgroundScheduler(ctx context.Context, interval time.Duration) {
+	var prev budget.Sample
+	var prevDev budget.Device
+	wait.UntilWithContext(ctx, func(ctx context.Context) {
+		dev, err := d.cacheDevice()
+		if err != nil {
+			if !errors.Is(err, budget.ErrNoDevice) {
+				klog.V(4).Infof("Not checking cache latency: %v", err)
+			}
+			prevDev = budget.Device{}
+			d.scheduleBackground(0)
+			return
+		}
+		sample, err := budget.SampleDevice(dev)
+		if err != nil {
+			klog.Warningf("Could not read I/O statistics of %s: %v", dev, err)
+			return
+		}
+		if dev != prevDev {
+			prev, prevDev = sample, dev
+			return
+		}
+		latency := budget.Latency(prev, sample)
+		prev = sample
+		d.scheduleBackground(latency)
+	}, interval)
+}
+
+// cacheDevice returns the block device of the cache.
+func (d *Driver) cacheDevice() (budget.Device, error) {
+	d.volMutex.Lock()
+	vol := d.vol
+	d.volMutex.Unlock()
+	if vol == nil {
+		return budget.Device{}, budget.ErrNoDevice
+	}
+	return budget.DeviceOf(vol.Path())
+}
+
+// scheduleBackground pauses background work when latency is above the
+// maximum, and resumes it once latency is below half of it, so that it
+// doesn't resume as soon as its own I/O stops.
+func (d *Driver) scheduleBackground(latency time.Duration) {
+	paused := d.background.Paused()
+	switch {
+	case !paused && latency > d.backgroundMaxLatency:
+		klog.Infof("Pausing background cache work, cache latency is %v", latency)
+		d.background.Pause()
+		backgroundPaused.Set(1)
+	case paused && latency <= d.backgroundMaxLatency/2:
+		klog.Infof("Resuming background cache work, cache latency is %v", latency)
+		d.background.Resume()
+		backgroundPaused.Set(0)
+	}
+}
@@ -0,0 +1,48 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package csi
+
+import (
+	"testing"
+	"time"
+
+	"gotest.tools/v3/assert"
+
+	"github.com/GoogleCloudPlatform/csi-node-cache/pkg/budget"
+)
+
+func TestScheduleBackground(t *testing.T) {
+	d := &Driver{background: budget.New(0, 0), backgroundMaxLatency: 20 * time.Millisecond}
+
+	steps := []struct {
+		latency time.Duration
+		paused  bool
+	}{
+		{5 * time.Millisecond, false},
+		{25 * time.Millisecond, true},
+		// Background work stays paused until latency falls well below the
+		// maximum.
+		{15 * time.Millisecond, true},
+		{10 * time.Millisecond, false},
+		{15 * time.Millisecond, false},
+		{21 * time.Millisecond, true},
+		// No I/O at all.
+		{0, false},
+	}
+	for i, step := range steps {
+		d.scheduleBackground(step.latency)
+		assert.Equal(t, d.background.Paused(), step.paused, "step %d, latency %v", i, step.latency)
+	}
+}
@@ -16,138 +16,542 @@ package csi
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
-	"slices"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
 	"strings"
 	"time"
 
+	"cloud.google.com/go/compute/metadata"
 	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/validation"
 	"k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/klog/v2"
 
 	"github.com/GoogleCloudPlatform/csi-node-cache/pkg/common"
+	"github.com/GoogleCloudPlatform/csi-node-cache/pkg/iscsi"
 	"github.com/GoogleCloudPlatform/csi-node-cache/pkg/localvolume"
+	"github.com/GoogleCloudPlatform/csi-node-cache/pkg/raid"
 )
 
 const (
-	tmpfsPath  = "/local/tmpfs"
-	lssdDevice = "/dev/md/lssd"
-	lssdPath   = "/local/lssd"
-	pdPath     = "/local/pd"
+	// DefaultCacheRoot is where caches are mounted, unless configured otherwise.
+	DefaultCacheRoot = "/local"
 
-	volumeTypeInfoKey = "volume-types"
-	pdVolumeType      = "pd"
+	// Cache mount points are relative to the cache root.
+	tmpfsPath     = "tmpfs"
+	hugetlbfsPath = "hugetlbfs"
+	lssdDevice    = "/dev/md/lssd"
+	lssdPath      = "lssd"
+	pdPath        = "pd"
+	mirrorDevice  = "/dev/md/mirrored"
+	mirrorPath    = "mirrored"
+	nvmeofPath    = "nvmeof"
+	iscsiPath     = "iscsi"
+	nfsPath       = "nfs"
+	gcsfusePath   = "gcsfuse"
+	bootdiskPath  = "bootdisk"
+	loopPath      = "loop"
+	// gcsfuseCacheDir is relative to the local SSD volume.
+	gcsfuseCacheDir = "gcsfuse-cache"
+
+	// dedupVolumeGroup is the prefix of the LVM volume group of a dedup cache.
+	dedupVolumeGroup = "node-cache-"
+
+	// createRetryInterval is how long a failed cache creation is returned to
+	// publishes before it is tried again.
+	createRetryInterval = 10 * time.Second
+
+	volumeTypeInfoKey   = "volume-types"
+	pdVolumeType        = "pd"
+	mirroredVolumeType  = "mirrored"
+	nvmeofVolumeType    = "nvmeof"
+	iscsiVolumeType     = "iscsi"
+	nfsVolumeType       = "filestore"
+	gcsfuseVolumeType   = "gcsfuse"
+	hugetlbfsVolumeType = "hugetlbfs"
+	bootdiskVolumeType  = "bootdisk"
+	loopVolumeType      = "loop"
+
+	// bootdiskFile holds the filesystem of a bootdisk cache, and loopFile
+	// backs the loop device of a loop cache, under the boot disk path.
+	bootdiskFile = "bootdisk.img"
+	loopFile     = "loop.img"
+
+	// volumeTypeVersionKey holds the schema version of the volume type map.
+	volumeTypeVersionKey = "schema-version"
+
+	chapUsernameKey = "username"
+	chapPasswordKey = "password"
 )
 
+// defaultHugepageSize is the page size of hugetlbfs caches without the
+// common.HugepageSizeAnnotation.
+var defaultHugepageSize = resource.MustParse("2Mi")
+
+// volumeTypeInfo is the entry of a node in the volume type map. The JSON names
+// are those of the map; see schema.go.
 type volumeTypeInfo struct {
-	VolumeType string
-	Size       resource.Quantity
-	Disk       string
+	VolumeType string            `json:"type"`
+	Size       resource.Quantity `json:"size"`
+	// SizePercent, if set instead of Size, sizes a tmpfs cache as a
+	// percentage of the node's allocatable memory.
+	SizePercent int    `json:"size-percent,omitempty"`
+	Disk        string `json:"disk,omitempty"`
+	Address     string `json:"address,omitempty"`
+	NQN         string `json:"nqn,omitempty"`
+	// Portal is a ';'-separated list of iSCSI portals.
+	Portal     string `json:"portal,omitempty"`
+	IQN        string `json:"iqn,omitempty"`
+	LUN        int    `json:"lun,omitempty"`
+	ChapSecret string `json:"chap-secret,omitempty"`
+	Multipath  bool   `json:"multipath,omitempty"`
+	Server     string `json:"server,omitempty"`
+	Export     string `json:"export,omitempty"`
+	// MountOptions is a ';'-separated list of mount options.
+	MountOptions string `json:"mount-options,omitempty"`
+	Bucket       string `json:"bucket,omitempty"`
+	// Dedup is the deduplication scheme for block device caches, if any.
+	Dedup      string  `json:"dedup,omitempty"`
+	DedupRatio float64 `json:"dedup-ratio,omitempty"`
+	// Compression is the btrfs compress option for pd caches, if any.
+	Compression string `json:"compression,omitempty"`
+	// Reflink formats lssd and pd caches with xfs with reflinks.
+	Reflink bool `json:"reflink,omitempty"`
+	// ImageCacheSize is the part of an lssd cache dedicated to the container
+	// image store, if any.
+	ImageCacheSize *resource.Quantity `json:"image-cache-size,omitempty"`
+	// RaidChunkKiB overrides the chunk size of local SSD arrays, if set.
+	RaidChunkKiB int `json:"raid-chunk-kib,omitempty"`
+	// HugepageKiB is the page size of hugetlbfs caches.
+	HugepageKiB int `json:"hugepage-kib,omitempty"`
+	// ShardGroup is the group of nodes sharing the prewarm location, if any.
+	// Shard is the part of it this node prewarms, assigned by the controller;
+	// see prewarm.Shard.
+	ShardGroup string `json:"shard-group,omitempty"`
+	Shard      string `json:"shard,omitempty"`
+	// StorageClass is the storage class of the PD of pd and mirrored caches
+	// provisioned by the controller.
+	StorageClass string `json:"storage-class,omitempty"`
+	// MaxSize is the largest cache of this type the node's hardware allows,
+	// if the driver has reported it. See common.CapacityAnnotation.
+	MaxSize *resource.Quantity `json:"max-size,omitempty"`
+	// Invalid, if set, is why the controller refused the entry, such as a
+	// size larger than the node can hold. No cache is created for it.
+	Invalid string `json:"invalid,omitempty"`
 }
 
-// createCacheVolume creates a volume by looking for the node in the volume type
-// map and returning the appropriate local volume.
-func createCacheVolume(ctx context.Context, client *kubernetes.Clientset, nodeName string, volumeTypeMapName types.NamespacedName) (localvolume.LocalVolume, error) {
-	var volumeTypeMap *corev1.ConfigMap
-	if err := wait.PollUntilContextTimeout(ctx, 500*time.Millisecond, 1*time.Minute, true, func(ctx context.Context) (bool, error) {
-		var err error
-		volumeTypeMap, err = client.CoreV1().ConfigMaps(volumeTypeMapName.Namespace).Get(ctx, volumeTypeMapName.Name, metav1.GetOptions{})
+// MarshalJSON omits a zero size, which omitempty doesn't do for a struct.
+func (i volumeTypeInfo) MarshalJSON() ([]byte, error) {
+	type plain volumeTypeInfo
+	out := struct {
+		plain
+		Size *resource.Quantity `json:"size,omitempty"`
+	}{plain: plain(i)}
+	if !i.Size.IsZero() {
+		out.Size = &i.Size
+	}
+	return json.Marshal(out)
+}
+
+// fetchVolumeTypeInfo looks for the node in the volume type map. A node
+// missing from the map is waited for up to grace, as the controller may not
+// yet have added it. The map itself is waited for up to a minute. If either is
+// still missing, the error is a pending *missingMappingError.
+func fetchVolumeTypeInfo(ctx context.Context, client *kubernetes.Clientset, nodeName string, volumeTypeMapName types.NamespacedName, grace time.Duration) (volumeTypeInfo, error) {
+	start := time.Now()
+	var info volumeTypeInfo
+	var mapErr, badMapErr error
+	found := false
+	err := wait.PollUntilContextTimeout(ctx, 500*time.Millisecond, max(time.Minute, grace), true, func(ctx context.Context) (bool, error) {
+		volumeTypeMap, err := client.CoreV1().ConfigMaps(volumeTypeMapName.Namespace).Get(ctx, volumeTypeMapName.Name, metav1.GetOptions{})
 		if err != nil {
 			klog.Errorf("Failed to get volume type map, retrying: %v", err)
+			mapErr = err
 			return false, nil // retry
 		}
-		return true, nil
-	}); err != nil {
-		return nil, common.NewVolumePendingError(fmt.Errorf("no node cache volume type found: %w", err))
+		mapErr = nil
+		types, err := getVolumeTypeMapping(volumeTypeMap.Data)
+		if err != nil {
+			// An error means a badly formed configmap, which is terminal (not a NewVolumePendingError).
+			badMapErr = err
+			return true, nil
+		}
+		info, found = types[nodeName]
+		// The node is only waited for within the grace period.
+		return found || time.Since(start) >= grace, nil
+	})
+	if badMapErr != nil {
+		return volumeTypeInfo{}, badMapErr
+	}
+	if err != nil && mapErr != nil {
+		return volumeTypeInfo{}, common.NewVolumePendingError(&missingMappingError{
+			volumeTypeMap: volumeTypeMapName,
+			err:           fmt.Errorf("no node cache volume type found: %w", mapErr),
+		})
+	}
+	if err != nil && ctx.Err() != nil {
+		return volumeTypeInfo{}, common.NewVolumePendingError(err)
+	}
+	if !found {
+		return volumeTypeInfo{}, common.NewVolumePendingError(&missingMappingError{
+			volumeTypeMap: volumeTypeMapName,
+			node:          nodeName,
+			waited:        time.Since(start),
+		})
+	}
+	if info.Invalid != "" {
+		// Pending, as the entry is fixed by changing the node labels.
+		return volumeTypeInfo{}, common.NewVolumePendingError(fmt.Errorf("the volume type information for %s is invalid: %s", nodeName, info.Invalid))
+	}
+	return info, nil
+}
+
+// cacheVolume returns the cache volume, creating it if necessary. volMutex
+// must be held, so that concurrent publishes only create the volume once.
+//
+// A failed creation is not retried until createRetryInterval has passed, so
+// that a burst of publishes doesn't repeat a failing mkfs or mdadm. Pending
+// errors, such as a disk that is not yet attached, and cancellations are
+// retried immediately.
+func (d *Driver) cacheVolume(ctx context.Context) (localvolume.LocalVolume, error) {
+	return d.publishCacheVolume(ctx, nil)
+}
+
+// publishCacheVolume is cacheVolume for a publish with secrets. The secrets
+// are checked against the cache type before they are used to create the
+// volume, and are only kept for later creations once they are valid.
+func (d *Driver) publishCacheVolume(ctx context.Context, secrets map[string]string) (localvolume.LocalVolume, error) {
+	if d.vol != nil {
+		if err := validateSecrets(d.volType, secrets); err != nil {
+			return nil, fmt.Errorf("%w: %v", errInvalidSecrets, err)
+		}
+		if len(secrets) > 0 {
+			d.publishSecrets = secrets
+		}
+		return d.vol, nil
+	}
+	if d.createErr != nil {
+		if since := time.Since(d.createErrTime); since < createRetryInterval {
+			return nil, fmt.Errorf("cache creation failed %v ago, retrying after %v: %w", since.Round(time.Second), createRetryInterval, d.createErr)
+		}
 	}
-	types, err := getVolumeTypeMapping(volumeTypeMap.Data)
+	if len(secrets) == 0 {
+		secrets = d.publishSecrets
+	}
+	vol, err := d.createCacheVolume(ctx, secrets)
 	if err != nil {
-		// An error means a badly formed configmap, which is terminal (not a NewVolumePendingError).
+		var pending *common.VolumePendingError
+		switch {
+		case errors.Is(err, errInvalidSecrets):
+			// The secrets of one publish don't hold up the others.
+		case errors.As(err, &pending) || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded):
+			d.createErr = nil
+		default:
+			d.createErr = err
+			d.createErrTime = time.Now()
+		}
 		return nil, err
 	}
+	d.createErr = nil
+	d.publishSecrets = secrets
+	d.vol = vol
+	d.warnStaleTargets(vol)
+	d.limitBackgroundIO(vol)
+	d.startPrewarm(vol)
+	return vol, nil
+}
 
-	info, found := types[nodeName]
-	if !found {
-		// An unknown type is terminal.
-		return nil, common.NewVolumePendingError(fmt.Errorf("No volume type information for %s found in %s/%s", nodeName, volumeTypeMapName.Namespace, volumeTypeMapName.Name))
+// hugetlbfsPages returns the page size and number of pages of a hugetlbfs
+// cache. Entries written before hugepage-kib was added, or by hand without it,
+// use the default page size.
+func hugetlbfsPages(info volumeTypeInfo) (int64, int64, error) {
+	pageSize := defaultHugepageSize.Value()
+	if info.HugepageKiB > 0 {
+		pageSize = int64(info.HugepageKiB) * 1024
+	}
+	if info.Size.Value() <= 0 || info.Size.Value()%pageSize != 0 {
+		return 0, 0, fmt.Errorf("the size %s of the hugetlbfs cache is not a multiple of its %d KiB page size", info.Size.String(), pageSize/1024)
+	}
+	return pageSize, info.Size.Value() / pageSize, nil
+}
+
+// createCacheVolume creates a volume by looking for the node in the volume type
+// map and returning the appropriate local volume, using secrets for the cache
+// types needing credentials. volMutex must be held.
+func (d *Driver) createCacheVolume(ctx context.Context, secrets map[string]string) (localvolume.LocalVolume, error) {
+	client := d.client
+	volumeTypeMapName := d.volumeTypeMap
+	info, err := fetchVolumeTypeInfo(ctx, client, d.nodeId, volumeTypeMapName, d.missingMappingGrace)
+	if err != nil {
+		var missing *missingMappingError
+		if errors.As(err, &missing) {
+			d.missingMappingEvent(ctx, d.nodeRef(), missing)
+		}
+		return nil, err
+	}
+	if err := validateSecrets(info.VolumeType, secrets); err != nil {
+		return nil, fmt.Errorf("%w: %v", errInvalidSecrets, err)
 	}
 
 	var vol localvolume.LocalVolume
 	switch info.VolumeType {
 	case "tmpfs":
-		vol, err = localvolume.NewTmpfsVolume(ctx, tmpfsPath, info.Size)
+		var size resource.Quantity
+		size, err = d.tmpfsSize(ctx, info)
+		if err == nil {
+			vol, err = localvolume.NewTmpfsVolume(ctx, d.cachePath(tmpfsPath), size)
+		}
 	case "lssd":
-		vol, err = localvolume.NewLocalSSDVolume(lssdDevice, lssdPath)
+		vol, err = localvolume.NewLocalSSDVolume(ctx, lssdDevice, d.cachePath(lssdPath), append(d.deviceOptions(info), d.localSSDOptions(info)...)...)
+		if err == nil && info.ImageCacheSize != nil {
+			err = d.setupImageCache(ctx, vol, *info.ImageCacheSize)
+		}
 	case "pd":
-		vol, err = localvolume.NewPDVolume(info.Disk, pdPath)
+		vol, err = localvolume.NewPDVolume(ctx, info.Disk, d.cachePath(pdPath), d.deviceOptions(info)...)
+	case mirroredVolumeType:
+		vol, err = localvolume.NewMirroredVolume(ctx, d.mirroredPDDevice(info), lssdDevice, mirrorDevice, d.cachePath(mirrorPath), d.mirroredDegradedStart, append(d.formatOptions(), d.localSSDOptions(info)...)...)
+	case nvmeofVolumeType:
+		vol, err = localvolume.NewNVMeoFVolume(ctx, info.Address, info.NQN, d.cachePath(nvmeofPath))
+	case iscsiVolumeType:
+		var target iscsi.Target
+		target, err = iscsiTarget(ctx, client, volumeTypeMapName.Namespace, info, secrets)
+		if err == nil {
+			vol, err = localvolume.NewISCSIVolume(ctx, target, d.cachePath(iscsiPath))
+		}
+	case hugetlbfsVolumeType:
+		var pageSize, pages int64
+		pageSize, pages, err = hugetlbfsPages(info)
+		if err == nil {
+			vol, err = localvolume.NewHugetlbfsVolume(ctx, d.cachePath(hugetlbfsPath), pageSize, pages)
+		}
+	case bootdiskVolumeType:
+		if d.bootDiskPath == "" {
+			err = fmt.Errorf("bootdisk caches require the driver to have a boot disk path")
+		} else {
+			vol, err = localvolume.NewLoopFileVolume(ctx, filepath.Join(d.bootDiskPath, bootdiskFile), d.cachePath(bootdiskPath), info.Size)
+		}
+	case loopVolumeType:
+		if d.bootDiskPath == "" {
+			err = fmt.Errorf("loop caches require the driver to have a boot disk path")
+		} else {
+			vol, err = localvolume.NewLoopVolume(ctx, filepath.Join(d.bootDiskPath, loopFile), d.cachePath(loopPath), info.Size, d.deviceOptions(info)...)
+		}
+	case nfsVolumeType:
+		vol, err = localvolume.NewNFSVolume(info.Server, info.Export, d.cachePath(nfsPath), splitOptions(info.MountOptions))
+	case gcsfuseVolumeType:
+		var lssd localvolume.LocalVolume
+		lssd, err = localvolume.NewLocalSSDVolume(ctx, lssdDevice, d.cachePath(lssdPath), append(d.formatOptions(), d.localSSDOptions(info)...)...)
+		var keyFile string
+		if err == nil {
+			keyFile, err = d.writeKeyFile(secrets)
+		}
+		if err == nil {
+			vol, err = localvolume.NewGCSFuseVolume(ctx, info.Bucket, d.cachePath(gcsfusePath), filepath.Join(lssd.Path(), gcsfuseCacheDir), info.Size, keyFile)
+		}
+		if keyFile != "" {
+			// gcsfuse reads the key once, when it mounts the bucket, so
+			// it isn't left on disk after the mount.
+			os.Remove(keyFile)
+		}
 	default:
 		err = fmt.Errorf("Unknown volume type from type info %v", info)
 	}
+	if err == nil {
+		d.volType = info.VolumeType
+		d.prewarmShard = info.Shard
+		d.shrunkFrom = resource.Quantity{}
+		if r, ok := vol.(localvolume.Resizer); ok {
+			size := r.Size()
+			cacheSizeBytes.Set(size.AsApproximateFloat64())
+		} else {
+			cacheSizeBytes.Set(info.Size.AsApproximateFloat64())
+		}
+		d.checkpointVolumeType(info.VolumeType)
+	}
 	return vol, err
 }
 
+// cachePath returns the mount point of a cache under the cache root.
+func (d *Driver) cachePath(name string) string {
+	return filepath.Join(d.cacheRoot, name)
+}
+
+// mirroredPDDevice returns a function giving the PD device for a mirrored
+// cache. The disk may not yet have been provisioned when the cache is created,
+// in which case the volume type map is read again to find it.
+func (d *Driver) mirroredPDDevice(info volumeTypeInfo) func() (string, error) {
+	return func() (string, error) {
+		disk := info.Disk
+		if disk == "" {
+			// This may be called after the publish that created the volume has returned, so its context can't be used.
+			current, err := fetchVolumeTypeInfo(context.Background(), d.client, d.nodeId, d.volumeTypeMap, 0)
+			if err != nil {
+				return "", err
+			}
+			disk = current.Disk
+		}
+		return localvolume.AttachedPDDevice(disk)
+	}
+}
+
+// deviceOptions returns the local volume options for a block device cache.
+func (d *Driver) deviceOptions(info volumeTypeInfo) []localvolume.Option {
+	opts := d.formatOptions()
+	if info.Dedup == common.DedupVDO {
+		opts = append(opts, localvolume.WithDedup(dedupVolumeGroup+info.VolumeType, info.DedupRatio))
+	}
+	if info.Compression != "" {
+		opts = append(opts, localvolume.WithCompression(info.Compression))
+	}
+	if info.Reflink {
+		opts = append(opts, localvolume.WithReflink())
+	}
+	return opts
+}
+
+// localSSDOptions are the options for the local SSD array of a cache.
+func (d *Driver) localSSDOptions(info volumeTypeInfo) []localvolume.Option {
+	opts := []localvolume.Option{
+		localvolume.WithMachineType(d.machineType()),
+		localvolume.WithRaidChunkSize(info.RaidChunkKiB),
+	}
+	if d.localSSDDiscard {
+		opts = append(opts, localvolume.WithDiscard())
+	}
+	if len(d.mirrorSpares) > 0 {
+		opts = append(opts, localvolume.WithMirrorSpares(d.mirrorSpares))
+	}
+	return opts
+}
+
+// formatOptions are the options for formatting the filesystem of a cache.
+// They are combined with those for any stripe by localvolume.
+func (d *Driver) formatOptions() []localvolume.Option {
+	if mkfsOptions := d.settings().mkfsOptions; len(mkfsOptions) > 0 {
+		return []localvolume.Option{localvolume.WithFormatOptions(mkfsOptions)}
+	}
+	return nil
+}
+
+// machineType returns the GCE machine type of the node, such as
+// c3-standard-8-lssd, or "" if it is unknown.
+func (d *Driver) machineType() string {
+	d.machineTypeOnce.Do(func() {
+		if !metadata.OnGCE() {
+			return
+		}
+		mt, err := metadata.Get("instance/machine-type")
+		if err != nil {
+			klog.Warningf("Could not get machine type, using default raid chunk sizes: %v", err)
+			return
+		}
+		// The metadata server gives projects/<number>/machineTypes/<type>.
+		d.cachedMachineType = path.Base(mt)
+	})
+	return d.cachedMachineType
+}
+
+// validCompression returns true for a btrfs compress option, an algorithm
+// with an optional numeric level.
+func validCompression(compression string) bool {
+	alg, level, hasLevel := strings.Cut(compression, ":")
+	if alg != "zstd" && alg != "lzo" && alg != "zlib" {
+		return false
+	}
+	if hasLevel {
+		if _, err := strconv.Atoi(level); err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// usesPD returns true if the volume type is backed by a PD provisioned by the controller.
+func usesPD(volumeType string) bool {
+	return volumeType == pdVolumeType || volumeType == mirroredVolumeType
+}
+
+// iscsiTarget builds the target from type info. CHAP credentials are taken
+// from publish secrets if given, and otherwise read from any secret named in
+// the type info in namespace.
+func iscsiTarget(ctx context.Context, client *kubernetes.Clientset, namespace string, info volumeTypeInfo, secrets map[string]string) (iscsi.Target, error) {
+	target, err := iscsi.NewTarget(strings.Split(info.Portal, ";"), info.IQN, info.LUN)
+	if err != nil {
+		return iscsi.Target{}, common.NewVolumePendingError(err)
+	}
+	target.Multipath = info.Multipath
+	if username, found := secrets[chapUsernameKey]; found {
+		target.Chap = &iscsi.ChapCredentials{Username: username, Password: secrets[chapPasswordKey]}
+	} else if info.ChapSecret != "" {
+		secret, err := client.CoreV1().Secrets(namespace).Get(ctx, info.ChapSecret, metav1.GetOptions{})
+		if err != nil {
+			return iscsi.Target{}, common.NewVolumePendingError(fmt.Errorf("could not get chap secret %s/%s: %w", namespace, info.ChapSecret, err))
+		}
+		username, uFound := secret.Data[chapUsernameKey]
+		password, pFound := secret.Data[chapPasswordKey]
+		if !uFound || !pFound {
+			return iscsi.Target{}, fmt.Errorf("chap secret %s/%s must have %s and %s keys", namespace, info.ChapSecret, chapUsernameKey, chapPasswordKey)
+		}
+		target.Chap = &iscsi.ChapCredentials{Username: string(username), Password: string(password)}
+	}
+	return target, nil
+}
+
+// splitOptions splits a ';'-separated option list, dropping empty items.
+func splitOptions(opts string) []string {
+	var items []string
+	for _, o := range strings.Split(opts, ";") {
+		if o = strings.TrimSpace(o); o != "" {
+			items = append(items, o)
+		}
+	}
+	return items
+}
+
 func getVolumeTypeMapping(configMapData map[string]string) (map[string]volumeTypeInfo, error) {
 	nodes, found := configMapData[volumeTypeInfoKey]
 	if !found {
 		return nil, fmt.Errorf("%s not found in volume type config map", volumeTypeInfoKey)
 	}
-	typeMap := map[string]volumeTypeInfo{}
-	for _, line := range strings.Split(nodes, "\n") {
-		line = strings.TrimSpace(line)
-		if line == "" {
-			continue
-		}
-		items := strings.Split(line, ",")
-		if len(items) < 2 {
-			return nil, fmt.Errorf("Bad line in volume type config map: %s", line)
-		}
-		node := strings.TrimSpace(items[0])
-		if _, found := typeMap[node]; found {
-			return nil, fmt.Errorf("node %s duplicated in volume type config map: %s", node, line)
-		}
-		var info volumeTypeInfo
-		for _, item := range items[1:] {
-			parts := strings.SplitN(item, "=", 2)
-			trimmed := strings.TrimSpace(parts[0])
-			switch trimmed {
-			case "type":
-				info.VolumeType = strings.TrimSpace(parts[1])
-			case "size":
-				szStr := strings.TrimSpace(parts[1])
-				q, err := resource.ParseQuantity(szStr)
-				if err != nil {
-					return nil, fmt.Errorf("bad size in volume type config map: %s", line)
-				}
-				info.Size = q
-			case "disk":
-				info.Disk = strings.TrimSpace(parts[1])
-			default:
-				return nil, fmt.Errorf("bad key %s in volume type config map: %s", trimmed, line)
-			}
-		}
-		typeMap[node] = info
+	version, err := mappingVersion(configMapData)
+	if err != nil {
+		return nil, err
+	}
+	var typeMap map[string]volumeTypeInfo
+	if version < jsonMappingVersion {
+		typeMap, err = parseLegacyMapping(nodes)
+	} else {
+		typeMap, err = parseMapping(nodes, version)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := migrateMapping(typeMap, version); err != nil {
+		return nil, err
 	}
 	return typeMap, nil
 }
 
 func writeVolumeTypeMapping(configMapData map[string]string, typeMap map[string]volumeTypeInfo) error {
-	lines := make([]string, 0, len(typeMap))
-	for node, info := range typeMap {
-		line := fmt.Sprintf("%s,type=%s", node, info.VolumeType)
-		if !info.Size.IsZero() {
-			line += fmt.Sprintf(",size=%s", info.Size.String())
-		}
-		if info.Disk != "" {
-			line += fmt.Sprintf(",disk=%s", info.Disk)
-		}
-		lines = append(lines, line)
+	if typeMap == nil {
+		typeMap = map[string]volumeTypeInfo{}
+	}
+	// Map keys are sorted, so the encoding only changes with the mapping.
+	data, err := json.MarshalIndent(typeMap, "", "  ")
+	if err != nil {
+		return err
 	}
-	slices.Sort(lines)
-	configMapData[volumeTypeInfoKey] = strings.Join(lines, "\n")
+	configMapData[volumeTypeInfoKey] = string(data)
+	configMapData[volumeTypeVersionKey] = strconv.Itoa(mappingSchemaVersion)
 	return nil
 }
 
@@ -159,12 +563,175 @@ func getVolumeTypeFromNode(node *corev1.Node) (volumeTypeInfo, error) {
 	}
 	vti := volumeTypeInfo{VolumeType: volumeType}
 	szStr, found := labels[common.SizeLabel]
-	if found {
+	if pct, isPercent := strings.CutSuffix(szStr, sizePercentSuffix); found && isPercent {
+		p, err := strconv.Atoi(pct)
+		if err != nil || p <= 0 || p > 100 {
+			return volumeTypeInfo{}, fmt.Errorf("bad size label %s=%s on %s, expected a percentage such as 30%s", common.SizeLabel, szStr, node.GetName(), sizePercentSuffix)
+		}
+		if volumeType != "tmpfs" {
+			return volumeTypeInfo{}, fmt.Errorf("percentage size label %s=%s is only supported for tmpfs caches on %s", common.SizeLabel, szStr, node.GetName())
+		}
+		vti.SizePercent = p
+	} else if found {
 		q, err := resource.ParseQuantity(szStr)
 		if err != nil {
 			return volumeTypeInfo{}, fmt.Errorf("bad size label %s=%s on %s", common.SizeLabel, szStr, node.GetName())
 		}
 		vti.Size = q
 	}
+	if (volumeType == bootdiskVolumeType || volumeType == loopVolumeType) && vti.Size.Value() <= 0 {
+		return volumeTypeInfo{}, fmt.Errorf("a positive %s label is required for %s caches on %s", common.SizeLabel, volumeType, node.GetName())
+	}
+	if maxSize, found, err := maxCacheSize(node, volumeType); err != nil {
+		return volumeTypeInfo{}, err
+	} else if found {
+		vti.MaxSize = &maxSize
+	}
+	if volumeType == nvmeofVolumeType {
+		annotations := node.GetAnnotations()
+		vti.Address = annotations[common.NVMeoFAddressAnnotation]
+		vti.NQN = annotations[common.NVMeoFNQNAnnotation]
+		if vti.Address == "" || vti.NQN == "" {
+			return volumeTypeInfo{}, fmt.Errorf("%s and %s annotations are required for nvmeof caches on %s", common.NVMeoFAddressAnnotation, common.NVMeoFNQNAnnotation, node.GetName())
+		}
+	}
+	if volumeType == iscsiVolumeType {
+		annotations := node.GetAnnotations()
+		vti.Portal = annotations[common.ISCSIPortalAnnotation]
+		vti.IQN = annotations[common.ISCSIIQNAnnotation]
+		vti.ChapSecret = annotations[common.ISCSIChapSecretAnnotation]
+		if vti.Portal == "" || vti.IQN == "" {
+			return volumeTypeInfo{}, fmt.Errorf("%s and %s annotations are required for iscsi caches on %s", common.ISCSIPortalAnnotation, common.ISCSIIQNAnnotation, node.GetName())
+		}
+		if lunStr, found := annotations[common.ISCSILUNAnnotation]; found {
+			lun, err := strconv.Atoi(lunStr)
+			if err != nil {
+				return volumeTypeInfo{}, fmt.Errorf("bad lun annotation %s=%s on %s", common.ISCSILUNAnnotation, lunStr, node.GetName())
+			}
+			vti.LUN = lun
+		}
+		if mpStr, found := annotations[common.ISCSIMultipathAnnotation]; found {
+			mp, err := strconv.ParseBool(mpStr)
+			if err != nil {
+				return volumeTypeInfo{}, fmt.Errorf("bad multipath annotation %s=%s on %s", common.ISCSIMultipathAnnotation, mpStr, node.GetName())
+			}
+			vti.Multipath = mp
+		}
+	}
+	if volumeType == nfsVolumeType {
+		annotations := node.GetAnnotations()
+		vti.Server = annotations[common.NFSServerAnnotation]
+		vti.Export = annotations[common.NFSExportAnnotation]
+		vti.MountOptions = annotations[common.NFSMountOptionsAnnotation]
+		if vti.Server == "" || vti.Export == "" {
+			return volumeTypeInfo{}, fmt.Errorf("%s and %s annotations are required for filestore caches on %s", common.NFSServerAnnotation, common.NFSExportAnnotation, node.GetName())
+		}
+		if strings.Contains(vti.MountOptions, ",") {
+			return volumeTypeInfo{}, fmt.Errorf("%s must be separated by ';' on %s", common.NFSMountOptionsAnnotation, node.GetName())
+		}
+	}
+	if dedup, found := node.GetAnnotations()[common.DedupAnnotation]; found {
+		if volumeType != "lssd" && volumeType != pdVolumeType {
+			return volumeTypeInfo{}, fmt.Errorf("%s is only supported for lssd and pd caches on %s", common.DedupAnnotation, node.GetName())
+		}
+		if dedup != common.DedupVDO {
+			return volumeTypeInfo{}, fmt.Errorf("unknown dedup %s=%s on %s", common.DedupAnnotation, dedup, node.GetName())
+		}
+		vti.Dedup = dedup
+		if ratioStr, found := node.GetAnnotations()[common.DedupRatioAnnotation]; found {
+			ratio, err := strconv.ParseFloat(ratioStr, 64)
+			if err != nil || ratio < 1 {
+				return volumeTypeInfo{}, fmt.Errorf("bad dedup ratio %s=%s on %s, must be at least 1", common.DedupRatioAnnotation, ratioStr, node.GetName())
+			}
+			vti.DedupRatio = ratio
+		}
+	}
+	if compression, found := node.GetAnnotations()[common.CompressionAnnotation]; found {
+		if volumeType != pdVolumeType {
+			return volumeTypeInfo{}, fmt.Errorf("%s is only supported for pd caches on %s", common.CompressionAnnotation, node.GetName())
+		}
+		if !validCompression(compression) {
+			return volumeTypeInfo{}, fmt.Errorf("unknown compression %s=%s on %s", common.CompressionAnnotation, compression, node.GetName())
+		}
+		vti.Compression = compression
+	}
+	if reflinkStr, found := node.GetAnnotations()[common.ReflinkAnnotation]; found {
+		reflink, err := strconv.ParseBool(reflinkStr)
+		if err != nil {
+			return volumeTypeInfo{}, fmt.Errorf("bad reflink annotation %s=%s on %s", common.ReflinkAnnotation, reflinkStr, node.GetName())
+		}
+		if reflink && volumeType != "lssd" && volumeType != pdVolumeType {
+			return volumeTypeInfo{}, fmt.Errorf("%s is only supported for lssd and pd caches on %s", common.ReflinkAnnotation, node.GetName())
+		}
+		if reflink && vti.Compression != "" {
+			return volumeTypeInfo{}, fmt.Errorf("%s and %s can't both be used on %s", common.ReflinkAnnotation, common.CompressionAnnotation, node.GetName())
+		}
+		vti.Reflink = reflink
+	}
+	if class, found := node.GetAnnotations()[common.StorageClassAnnotation]; found {
+		if !usesPD(volumeType) {
+			return volumeTypeInfo{}, fmt.Errorf("%s is only supported for pd and mirrored caches on %s", common.StorageClassAnnotation, node.GetName())
+		}
+		if _, found := node.GetAnnotations()[common.ExistingDiskAnnotation]; found {
+			return volumeTypeInfo{}, fmt.Errorf("%s and %s can't both be used on %s", common.StorageClassAnnotation, common.ExistingDiskAnnotation, node.GetName())
+		}
+		if class == "" {
+			return volumeTypeInfo{}, fmt.Errorf("empty %s on %s", common.StorageClassAnnotation, node.GetName())
+		}
+		vti.StorageClass = class
+	}
+	if imageStr, found := node.GetAnnotations()[common.ImageCacheSizeAnnotation]; found {
+		if volumeType != "lssd" {
+			return volumeTypeInfo{}, fmt.Errorf("%s is only supported for lssd caches on %s", common.ImageCacheSizeAnnotation, node.GetName())
+		}
+		q, err := resource.ParseQuantity(imageStr)
+		if err != nil || q.Sign() <= 0 {
+			return volumeTypeInfo{}, fmt.Errorf("bad image cache size %s=%s on %s", common.ImageCacheSizeAnnotation, imageStr, node.GetName())
+		}
+		if q.Cmp(vti.Size) >= 0 {
+			return volumeTypeInfo{}, fmt.Errorf("image cache size %s=%s must be smaller than the cache size %s on %s", common.ImageCacheSizeAnnotation, imageStr, vti.Size.String(), node.GetName())
+		}
+		vti.ImageCacheSize = &q
+	}
+	if chunkStr, found := node.GetAnnotations()[common.RaidChunkSizeAnnotation]; found {
+		if volumeType != "lssd" && volumeType != mirroredVolumeType && volumeType != gcsfuseVolumeType {
+			return volumeTypeInfo{}, fmt.Errorf("%s is only supported for local SSD caches on %s", common.RaidChunkSizeAnnotation, node.GetName())
+		}
+		q, err := resource.ParseQuantity(chunkStr)
+		if err != nil || q.Value()%1024 != 0 || !raid.ValidChunkKiB(int(q.Value()/1024)) {
+			return volumeTypeInfo{}, fmt.Errorf("bad raid chunk size %s=%s on %s, must be a power of two of at least 4Ki", common.RaidChunkSizeAnnotation, chunkStr, node.GetName())
+		}
+		vti.RaidChunkKiB = int(q.Value() / 1024)
+	}
+	if group, found := node.GetAnnotations()[common.ShardGroupAnnotation]; found {
+		if errs := validation.IsValidLabelValue(group); group == "" || len(errs) > 0 {
+			return volumeTypeInfo{}, fmt.Errorf("bad shard group %s=%s on %s, must be a label value", common.ShardGroupAnnotation, group, node.GetName())
+		}
+		vti.ShardGroup = group
+	}
+	pageSizeStr, found := node.GetAnnotations()[common.HugepageSizeAnnotation]
+	if found && volumeType != hugetlbfsVolumeType {
+		return volumeTypeInfo{}, fmt.Errorf("%s is only supported for hugetlbfs caches on %s", common.HugepageSizeAnnotation, node.GetName())
+	}
+	if volumeType == hugetlbfsVolumeType {
+		pageSize := defaultHugepageSize
+		if found {
+			q, err := resource.ParseQuantity(pageSizeStr)
+			if err != nil || q.Value() < 4096 || q.Value()&(q.Value()-1) != 0 {
+				return volumeTypeInfo{}, fmt.Errorf("bad hugepage size %s=%s on %s, must be a power of two such as 2Mi", common.HugepageSizeAnnotation, pageSizeStr, node.GetName())
+			}
+			pageSize = q
+		}
+		if vti.Size.IsZero() || vti.Size.Value()%pageSize.Value() != 0 {
+			return volumeTypeInfo{}, fmt.Errorf("the size of a hugetlbfs cache must be a multiple of the %s page size on %s", pageSize.String(), node.GetName())
+		}
+		vti.HugepageKiB = int(pageSize.Value() / 1024)
+	}
+	if volumeType == gcsfuseVolumeType {
+		vti.Bucket = node.GetAnnotations()[common.GCSFuseBucketAnnotation]
+		if vti.Bucket == "" {
+			return volumeTypeInfo{}, fmt.Errorf("%s annotation is required for gcsfuse caches on %s", common.GCSFuseBucketAnnotation, node.GetName())
+		}
+	}
 	return vti, nil
 }
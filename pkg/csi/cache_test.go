@@ -15,11 +15,19 @@
 package csi
 
 import (
+	"context"
+	"errors"
+	"strconv"
 	"testing"
+	"time"
 
 	"gotest.tools/v3/assert"
 	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/utils/ptr"
+
+	"github.com/GoogleCloudPlatform/csi-node-cache/pkg/common"
+	"github.com/GoogleCloudPlatform/csi-node-cache/pkg/localvolume"
 )
 
 func TestGetVolumeTypeMapping(t *testing.T) {
@@ -81,6 +89,59 @@ func TestGetVolumeTypeMapping(t *testing.T) {
 				},
 			},
 		},
+		{
+			name:  "nvmeof",
+			input: "node, type=nvmeof, address=10.0.0.1:4420, nqn=nqn.2024-01.io.example:cache",
+			expected: map[string]volumeTypeInfo{
+				"node": {
+					VolumeType: "nvmeof",
+					Address:    "10.0.0.1:4420",
+					NQN:        "nqn.2024-01.io.example:cache",
+				},
+			},
+		},
+		{
+			name:  "iscsi",
+			input: "node, type=iscsi, portal=10.0.0.1;10.0.0.2:3261, iqn=iqn.x:y, lun=2, chap-secret=chap, multipath=true",
+			expected: map[string]volumeTypeInfo{
+				"node": {
+					VolumeType: "iscsi",
+					Portal:     "10.0.0.1;10.0.0.2:3261",
+					IQN:        "iqn.x:y",
+					LUN:        2,
+					ChapSecret: "chap",
+					Multipath:  true,
+				},
+			},
+		},
+		{
+			name:          "iscsi, bad lun",
+			input:         "node, type=iscsi, portal=10.0.0.1, iqn=iqn.x:y, lun=two",
+			expectedError: true,
+		},
+		{
+			name:  "filestore",
+			input: "node, type=filestore, server=10.0.0.3, export=/share, mount-options=vers=3;nolock",
+			expected: map[string]volumeTypeInfo{
+				"node": {
+					VolumeType:   "filestore",
+					Server:       "10.0.0.3",
+					Export:       "/share",
+					MountOptions: "vers=3;nolock",
+				},
+			},
+		},
+		{
+			name:  "gcsfuse",
+			input: "node, type=gcsfuse, size=100Gi, bucket=my-bucket",
+			expected: map[string]volumeTypeInfo{
+				"node": {
+					VolumeType: "gcsfuse",
+					Size:       resource.MustParse("100Gi"),
+					Bucket:     "my-bucket",
+				},
+			},
+		},
 		{
 			name:          "one item, bad param",
 			input:         "node, type=foo, unknown=yes",
@@ -135,21 +196,41 @@ func TestGetVolumeTypeMapping(t *testing.T) {
 	}
 }
 
+func TestSplitOptions(t *testing.T) {
+	assert.DeepEqual(t, splitOptions(""), []string(nil))
+	assert.DeepEqual(t, splitOptions("vers=3; nolock;"), []string{"vers=3", "nolock"})
+}
+
 func TestWriteVolumeTypeMapping(t *testing.T) {
 	output := map[string]string{}
 	err := writeVolumeTypeMapping(output, map[string]volumeTypeInfo{
 		"a": {VolumeType: "foo"},
 		"b": {VolumeType: "bar", Size: resource.MustParse("10Mi")},
 		"c": {VolumeType: "pd", Size: resource.MustParse("10Gi"), Disk: "foobar"},
+		"d": {VolumeType: "nvmeof", Address: "10.0.0.1", NQN: "nqn.x"},
+		"e": {VolumeType: "iscsi", Portal: "10.0.0.1", IQN: "iqn.x", LUN: 1, Multipath: true},
+		"f": {VolumeType: "lssd", Dedup: "vdo", DedupRatio: 2.5},
+		"g": {VolumeType: "pd", Size: resource.MustParse("10Gi"), Compression: "zstd:3"},
+		"h": {VolumeType: "lssd", RaidChunkKiB: 128},
 	})
 	assert.NilError(t, err)
-	assert.Equal(t, output[volumeTypeInfoKey], "a,type=foo\nb,type=bar,size=10Mi\nc,type=pd,size=10Gi,disk=foobar")
+	assert.Equal(t, output[volumeTypeVersionKey], strconv.Itoa(mappingSchemaVersion))
+
+	mapping, err := getVolumeTypeMapping(output)
+	assert.NilError(t, err)
+	assert.Equal(t, len(mapping), 8)
+	assert.DeepEqual(t, mapping["b"], volumeTypeInfo{VolumeType: "bar", Size: resource.MustParse("10Mi")})
+	assert.DeepEqual(t, mapping["e"], volumeTypeInfo{VolumeType: "iscsi", Portal: "10.0.0.1", IQN: "iqn.x", LUN: 1, Multipath: true})
+	assert.DeepEqual(t, mapping["f"], volumeTypeInfo{VolumeType: "lssd", Dedup: "vdo", DedupRatio: 2.5})
+	assert.Equal(t, mapping["g"].Compression, "zstd:3")
+	assert.Equal(t, mapping["h"].RaidChunkKiB, 128)
 }
 
 func TestGetVolumeTypeFromNode(t *testing.T) {
 	for _, testCase := range []struct {
 		name          string
 		labels        map[string]string
+		annotations   map[string]string
 		expected      volumeTypeInfo
 		expectedError string
 	}{
@@ -183,6 +264,65 @@ func TestGetVolumeTypeFromNode(t *testing.T) {
 			},
 			expectedError: "bad size label",
 		},
+		{
+			name: "percent size",
+			labels: map[string]string{
+				"node-cache.gke.io":      "tmpfs",
+				"node-cache-size.gke.io": "30pct",
+			},
+			expected: volumeTypeInfo{VolumeType: "tmpfs", SizePercent: 30},
+		},
+		{
+			name: "bad percent size",
+			labels: map[string]string{
+				"node-cache.gke.io":      "tmpfs",
+				"node-cache-size.gke.io": "130pct",
+			},
+			expectedError: "expected a percentage",
+		},
+		{
+			name: "hugetlbfs",
+			labels: map[string]string{
+				"node-cache.gke.io":      "hugetlbfs",
+				"node-cache-size.gke.io": "2Gi",
+			},
+			expected: volumeTypeInfo{VolumeType: "hugetlbfs", Size: resource.MustParse("2Gi"), HugepageKiB: 2048},
+		},
+		{
+			name: "hugetlbfs page size",
+			labels: map[string]string{
+				"node-cache.gke.io":      "hugetlbfs",
+				"node-cache-size.gke.io": "2Gi",
+			},
+			annotations: map[string]string{common.HugepageSizeAnnotation: "1Gi"},
+			expected:    volumeTypeInfo{VolumeType: "hugetlbfs", Size: resource.MustParse("2Gi"), HugepageKiB: 1 << 20},
+		},
+		{
+			name: "hugetlbfs partial page",
+			labels: map[string]string{
+				"node-cache.gke.io":      "hugetlbfs",
+				"node-cache-size.gke.io": "3Gi",
+			},
+			annotations:   map[string]string{common.HugepageSizeAnnotation: "2Gi"},
+			expectedError: "multiple of the 2Gi page size",
+		},
+		{
+			name: "hugepage size not hugetlbfs",
+			labels: map[string]string{
+				"node-cache.gke.io":      "tmpfs",
+				"node-cache-size.gke.io": "2Gi",
+			},
+			annotations:   map[string]string{common.HugepageSizeAnnotation: "2Mi"},
+			expectedError: "only supported for hugetlbfs",
+		},
+		{
+			name: "percent size not tmpfs",
+			labels: map[string]string{
+				"node-cache.gke.io":      "lssd",
+				"node-cache-size.gke.io": "30pct",
+			},
+			expectedError: "only supported for tmpfs",
+		},
 		{
 			name: "only size",
 			labels: map[string]string{
@@ -190,10 +330,266 @@ func TestGetVolumeTypeFromNode(t *testing.T) {
 			},
 			expectedError: "not found",
 		},
+		{
+			name:   "nvmeof",
+			labels: map[string]string{"node-cache.gke.io": "nvmeof"},
+			annotations: map[string]string{
+				"node-cache.gke.io/nvmeof-address": "10.0.0.1",
+				"node-cache.gke.io/nvmeof-nqn":     "nqn.x",
+			},
+			expected: volumeTypeInfo{VolumeType: "nvmeof", Address: "10.0.0.1", NQN: "nqn.x"},
+		},
+		{
+			name:   "iscsi",
+			labels: map[string]string{"node-cache.gke.io": "iscsi"},
+			annotations: map[string]string{
+				"node-cache.gke.io/iscsi-portal":      "10.0.0.1;10.0.0.2",
+				"node-cache.gke.io/iscsi-iqn":         "iqn.x",
+				"node-cache.gke.io/iscsi-lun":         "3",
+				"node-cache.gke.io/iscsi-chap-secret": "chap",
+				"node-cache.gke.io/iscsi-multipath":   "true",
+			},
+			expected: volumeTypeInfo{VolumeType: "iscsi", Portal: "10.0.0.1;10.0.0.2", IQN: "iqn.x", LUN: 3, ChapSecret: "chap", Multipath: true},
+		},
+		{
+			name:          "iscsi, missing iqn",
+			labels:        map[string]string{"node-cache.gke.io": "iscsi"},
+			annotations:   map[string]string{"node-cache.gke.io/iscsi-portal": "10.0.0.1"},
+			expectedError: "annotations are required",
+		},
+		{
+			name:   "filestore",
+			labels: map[string]string{"node-cache.gke.io": "filestore"},
+			annotations: map[string]string{
+				"node-cache.gke.io/nfs-server":        "10.0.0.3",
+				"node-cache.gke.io/nfs-export":        "/share",
+				"node-cache.gke.io/nfs-mount-options": "vers=3;nolock",
+			},
+			expected: volumeTypeInfo{VolumeType: "filestore", Server: "10.0.0.3", Export: "/share", MountOptions: "vers=3;nolock"},
+		},
+		{
+			name:   "filestore, bad options",
+			labels: map[string]string{"node-cache.gke.io": "filestore"},
+			annotations: map[string]string{
+				"node-cache.gke.io/nfs-server":        "10.0.0.3",
+				"node-cache.gke.io/nfs-export":        "/share",
+				"node-cache.gke.io/nfs-mount-options": "vers=3,nolock",
+			},
+			expectedError: "must be separated by ';'",
+		},
+		{
+			name:        "gcsfuse",
+			labels:      map[string]string{"node-cache.gke.io": "gcsfuse"},
+			annotations: map[string]string{"node-cache.gke.io/gcsfuse-bucket": "my-bucket"},
+			expected:    volumeTypeInfo{VolumeType: "gcsfuse", Bucket: "my-bucket"},
+		},
+		{
+			name:          "gcsfuse, no bucket",
+			labels:        map[string]string{"node-cache.gke.io": "gcsfuse"},
+			expectedError: "annotation is required",
+		},
+		{
+			name:   "dedup",
+			labels: map[string]string{"node-cache.gke.io": "lssd"},
+			annotations: map[string]string{
+				"node-cache.gke.io/dedup":       "vdo",
+				"node-cache.gke.io/dedup-ratio": "3",
+			},
+			expected: volumeTypeInfo{VolumeType: "lssd", Dedup: "vdo", DedupRatio: 3},
+		},
+		{
+			name:          "dedup, bad type",
+			labels:        map[string]string{"node-cache.gke.io": "tmpfs"},
+			annotations:   map[string]string{"node-cache.gke.io/dedup": "vdo"},
+			expectedError: "only supported for lssd and pd",
+		},
+		{
+			name:   "dedup, bad ratio",
+			labels: map[string]string{"node-cache.gke.io": "pd"},
+			annotations: map[string]string{
+				"node-cache.gke.io/dedup":       "vdo",
+				"node-cache.gke.io/dedup-ratio": "0.5",
+			},
+			expectedError: "bad dedup ratio",
+		},
+		{
+			name:   "compression",
+			labels: map[string]string{"node-cache.gke.io": "pd"},
+			annotations: map[string]string{
+				"node-cache.gke.io/compression": "zstd:3",
+			},
+			expected: volumeTypeInfo{VolumeType: "pd", Compression: "zstd:3"},
+		},
+		{
+			name:          "compression, bad type",
+			labels:        map[string]string{"node-cache.gke.io": "lssd"},
+			annotations:   map[string]string{"node-cache.gke.io/compression": "zstd"},
+			expectedError: "only supported for pd",
+		},
+		{
+			name:   "compression, unknown",
+			labels: map[string]string{"node-cache.gke.io": "pd"},
+			annotations: map[string]string{
+				"node-cache.gke.io/compression": "zstd:fast",
+			},
+			expectedError: "unknown compression",
+		},
+		{
+			name:     "bootdisk",
+			labels:   map[string]string{"node-cache.gke.io": "bootdisk", "node-cache-size.gke.io": "20Gi"},
+			expected: volumeTypeInfo{VolumeType: "bootdisk", Size: resource.MustParse("20Gi")},
+		},
+		{
+			name:          "bootdisk, no size",
+			labels:        map[string]string{"node-cache.gke.io": "bootdisk"},
+			expectedError: "required for bootdisk",
+		},
+		{
+			name:     "loop",
+			labels:   map[string]string{"node-cache.gke.io": "loop", "node-cache-size.gke.io": "1Gi"},
+			expected: volumeTypeInfo{VolumeType: "loop", Size: resource.MustParse("1Gi")},
+		},
+		{
+			name:        "reflink",
+			labels:      map[string]string{"node-cache.gke.io": "lssd"},
+			annotations: map[string]string{"node-cache.gke.io/reflink": "true"},
+			expected:    volumeTypeInfo{VolumeType: "lssd", Reflink: true},
+		},
+		{
+			name:          "reflink, bad type",
+			labels:        map[string]string{"node-cache.gke.io": "tmpfs"},
+			annotations:   map[string]string{"node-cache.gke.io/reflink": "true"},
+			expectedError: "only supported for lssd and pd",
+		},
+		{
+			name:   "reflink and compression",
+			labels: map[string]string{"node-cache.gke.io": "pd"},
+			annotations: map[string]string{
+				"node-cache.gke.io/reflink":     "true",
+				"node-cache.gke.io/compression": "zstd",
+			},
+			expectedError: "can't both be used",
+		},
+		{
+			name:        "storage class",
+			labels:      map[string]string{"node-cache.gke.io": "mirrored"},
+			annotations: map[string]string{"node-cache.gke.io/storage-class": "hyperdisk-balanced"},
+			expected:    volumeTypeInfo{VolumeType: "mirrored", StorageClass: "hyperdisk-balanced"},
+		},
+		{
+			name:          "storage class, bad type",
+			labels:        map[string]string{"node-cache.gke.io": "lssd"},
+			annotations:   map[string]string{"node-cache.gke.io/storage-class": "hyperdisk-balanced"},
+			expectedError: "only supported for pd and mirrored",
+		},
+		{
+			name:   "storage class and existing disk",
+			labels: map[string]string{"node-cache.gke.io": "pd"},
+			annotations: map[string]string{
+				"node-cache.gke.io/storage-class": "hyperdisk-balanced",
+				"node-cache.gke.io/existing-disk": "projects/p/zones/z/disks/d",
+			},
+			expectedError: "can't both be used",
+		},
+		{
+			name: "image cache size",
+			labels: map[string]string{
+				"node-cache.gke.io":      "lssd",
+				"node-cache-size.gke.io": "375Gi",
+			},
+			annotations: map[string]string{"node-cache.gke.io/image-cache-size": "100Gi"},
+			expected:    volumeTypeInfo{VolumeType: "lssd", Size: resource.MustParse("375Gi"), ImageCacheSize: ptr.To(resource.MustParse("100Gi"))},
+		},
+		{
+			name: "image cache size, bad type",
+			labels: map[string]string{
+				"node-cache.gke.io":      "pd",
+				"node-cache-size.gke.io": "375Gi",
+			},
+			annotations:   map[string]string{"node-cache.gke.io/image-cache-size": "100Gi"},
+			expectedError: "only supported for lssd",
+		},
+		{
+			name: "image cache size, not smaller than cache",
+			labels: map[string]string{
+				"node-cache.gke.io":      "lssd",
+				"node-cache-size.gke.io": "100Gi",
+			},
+			annotations:   map[string]string{"node-cache.gke.io/image-cache-size": "100Gi"},
+			expectedError: "must be smaller than the cache size",
+		},
+		{
+			name:        "raid chunk size",
+			labels:      map[string]string{"node-cache.gke.io": "mirrored"},
+			annotations: map[string]string{"node-cache.gke.io/raid-chunk-size": "256Ki"},
+			expected:    volumeTypeInfo{VolumeType: "mirrored", RaidChunkKiB: 256},
+		},
+		{
+			name:          "raid chunk size, bad type",
+			labels:        map[string]string{"node-cache.gke.io": "pd"},
+			annotations:   map[string]string{"node-cache.gke.io/raid-chunk-size": "256Ki"},
+			expectedError: "only supported for local SSD",
+		},
+		{
+			name:          "raid chunk size, not a power of two",
+			labels:        map[string]string{"node-cache.gke.io": "lssd"},
+			annotations:   map[string]string{"node-cache.gke.io/raid-chunk-size": "96Ki"},
+			expectedError: "bad raid chunk size",
+		},
+		{
+			name:        "shard group",
+			labels:      map[string]string{"node-cache.gke.io": "lssd"},
+			annotations: map[string]string{"node-cache.gke.io/shard-group": "train"},
+			expected:    volumeTypeInfo{VolumeType: "lssd", ShardGroup: "train"},
+		},
+		{
+			name:          "bad shard group",
+			labels:        map[string]string{"node-cache.gke.io": "lssd"},
+			annotations:   map[string]string{"node-cache.gke.io/shard-group": "a,b"},
+			expectedError: "bad shard group",
+		},
+		{
+			name: "within capacity",
+			labels: map[string]string{
+				"node-cache.gke.io":      "lssd",
+				"node-cache-size.gke.io": "375Gi",
+			},
+			annotations: map[string]string{"node-cache.gke.io/capacity": `{"localSSDs":1,"memoryBytes":0,"maxSizes":{"lssd":"375Gi"}}`},
+			expected:    volumeTypeInfo{VolumeType: "lssd", Size: resource.MustParse("375Gi"), MaxSize: ptr.To(resource.MustParse("375Gi"))},
+		},
+		{
+			name: "exceeds capacity",
+			labels: map[string]string{
+				"node-cache.gke.io":      "lssd",
+				"node-cache-size.gke.io": "1Ti",
+			},
+			annotations: map[string]string{"node-cache.gke.io/capacity": `{"localSSDs":1,"memoryBytes":0,"maxSizes":{"lssd":"375Gi"}}`},
+			// Checked by validateCapacity, so that the entry is marked invalid.
+			expected: volumeTypeInfo{VolumeType: "lssd", Size: resource.MustParse("1Ti"), MaxSize: ptr.To(resource.MustParse("375Gi"))},
+		},
+		{
+			name:        "type not limited by capacity",
+			labels:      map[string]string{"node-cache.gke.io": "pd", "node-cache-size.gke.io": "1Ti"},
+			annotations: map[string]string{"node-cache.gke.io/capacity": `{"localSSDs":1,"memoryBytes":0,"maxSizes":{"lssd":"375Gi"}}`},
+			expected:    volumeTypeInfo{VolumeType: "pd", Size: resource.MustParse("1Ti")},
+		},
+		{
+			name:          "bad capacity",
+			labels:        map[string]string{"node-cache.gke.io": "lssd"},
+			annotations:   map[string]string{"node-cache.gke.io/capacity": "lots"},
+			expectedError: "bad capacity annotation",
+		},
+		{
+			name:          "nvmeof, missing nqn",
+			labels:        map[string]string{"node-cache.gke.io": "nvmeof"},
+			annotations:   map[string]string{"node-cache.gke.io/nvmeof-address": "10.0.0.1"},
+			expectedError: "annotations are required",
+		},
 	} {
 		t.Run(testCase.name, func(t *testing.T) {
 			var node corev1.Node
 			node.SetLabels(testCase.labels)
+			node.SetAnnotations(testCase.annotations)
 			info, err := getVolumeTypeFromNode(&node)
 			if testCase.expectedError != "" {
 				assert.ErrorContains(t, err, testCase.expectedError)
@@ -204,3 +600,73 @@ func TestGetVolumeTypeFromNode(t *testing.T) {
 		})
 	}
 }
+
+func TestTopologySegments(t *testing.T) {
+	segments := topologySegments(volumeTypeInfo{VolumeType: "tmpfs", Size: resource.MustParse("1536Mi")})
+	assert.DeepEqual(t, segments, map[string]string{
+		common.TopologyTypeKey: "tmpfs",
+		common.TopologySizeKey: "1536Mi",
+	})
+
+	segments = topologySegments(volumeTypeInfo{VolumeType: "lssd"})
+	assert.DeepEqual(t, segments, map[string]string{
+		common.TopologyTypeKey: "lssd",
+	})
+}
+
+func TestHugetlbfsPages(t *testing.T) {
+	// A hand-written entry has no page size.
+	mapping, err := getVolumeTypeMapping(map[string]string{volumeTypeInfoKey: "node, type=hugetlbfs, size=4Mi"})
+	assert.NilError(t, err)
+	pageSize, pages, err := hugetlbfsPages(mapping["node"])
+	assert.NilError(t, err)
+	assert.Equal(t, pageSize, int64(2<<20))
+	assert.Equal(t, pages, int64(2))
+
+	pageSize, pages, err = hugetlbfsPages(volumeTypeInfo{VolumeType: "hugetlbfs", Size: resource.MustParse("2Gi"), HugepageKiB: 1 << 20})
+	assert.NilError(t, err)
+	assert.Equal(t, pageSize, int64(1<<30))
+	assert.Equal(t, pages, int64(2))
+
+	_, _, err = hugetlbfsPages(volumeTypeInfo{VolumeType: "hugetlbfs", Size: resource.MustParse("3Mi")})
+	assert.ErrorContains(t, err, "not a multiple")
+	_, _, err = hugetlbfsPages(volumeTypeInfo{VolumeType: "hugetlbfs"})
+	assert.ErrorContains(t, err, "not a multiple")
+}
+
+func TestCacheVolumeRetry(t *testing.T) {
+	d := &Driver{}
+	failure := errors.New("mdadm failed")
+	d.createErr = failure
+	d.createErrTime = time.Now()
+	// The failure is returned without creating the volume again, which would
+	// need a client.
+	_, err := d.cacheVolume(context.Background())
+	assert.ErrorIs(t, err, failure)
+	assert.ErrorContains(t, err, "retrying after")
+
+	vol, err := localvolume.NewFromPath(t.TempDir())
+	assert.NilError(t, err)
+	d.vol = vol
+	got, err := d.cacheVolume(context.Background())
+	assert.NilError(t, err)
+	assert.Equal(t, got, vol)
+}
+
+func TestPublishCacheVolumeSecrets(t *testing.T) {
+	vol, err := localvolume.NewFromPath(t.TempDir())
+	assert.NilError(t, err)
+	valid := map[string]string{chapUsernameKey: "u", chapPasswordKey: "p"}
+	d := &Driver{vol: vol, volType: iscsiVolumeType, publishSecrets: valid}
+
+	// Bad secrets are refused without replacing the valid ones.
+	_, err = d.publishCacheVolume(context.Background(), map[string]string{chapUsernameKey: "u"})
+	assert.ErrorIs(t, err, errInvalidSecrets)
+	assert.DeepEqual(t, d.publishSecrets, valid)
+
+	updated := map[string]string{chapUsernameKey: "u", chapPasswordKey: "q"}
+	got, err := d.publishCacheVolume(context.Background(), updated)
+	assert.NilError(t, err)
+	assert.Equal(t, got, vol)
+	assert.DeepEqual(t, d.publishSecrets, updated)
+}
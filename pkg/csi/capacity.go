@@ -0,0 +1,110 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package csi
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/klog/v2"
+
+	"github.com/GoogleCloudPlatform/csi-node-cache/pkg/common"
+	"github.com/GoogleCloudPlatform/csi-node-cache/pkg/localvolume"
+)
+
+// NodeCapacity is the hardware of a node, reported by the driver as JSON in
+// the common.CapacityAnnotation annotation.
+type NodeCapacity struct {
+	LocalSSDs   int   `json:"localSSDs"`
+	MemoryBytes int64 `json:"memoryBytes"`
+	// MaxSizes is the largest cache of each type the hardware allows. Types
+	// that aren't limited by the node, such as pd, are not included.
+	MaxSizes map[string]resource.Quantity `json:"maxSizes"`
+}
+
+// newNodeCapacity derives the maximum cache sizes from the hardware. Memory
+// caches are limited by the node's memory, and local SSD caches by the total
+// size of the SSDs. A mirrored cache is no larger than its local SSD half.
+func newNodeCapacity(localSSDs int, ssdBytes, memoryBytes int64) NodeCapacity {
+	c := NodeCapacity{LocalSSDs: localSSDs, MemoryBytes: memoryBytes, MaxSizes: map[string]resource.Quantity{}}
+	if memoryBytes > 0 {
+		memory := *resource.NewQuantity(memoryBytes, resource.BinarySI)
+		c.MaxSizes["tmpfs"] = memory
+		c.MaxSizes[hugetlbfsVolumeType] = memory
+	}
+	if localSSDs > 0 && ssdBytes > 0 {
+		ssd := *resource.NewQuantity(ssdBytes, resource.BinarySI)
+		c.MaxSizes["lssd"] = ssd
+		c.MaxSizes[mirroredVolumeType] = ssd
+		c.MaxSizes[gcsfuseVolumeType] = ssd
+	}
+	return c
+}
+
+// reportCapacity detects the local SSDs and memory of the node and reports
+// them to the node, so that the controller can check size labels before a
+// cache is created. Failures are logged, as size labels are then only checked
+// when the cache is created.
+func (d *Driver) reportCapacity(ctx context.Context) {
+	localSSDs, ssdBytes, err := localvolume.LocalSSDCapacity()
+	if err != nil {
+		klog.Warningf("Could not find local SSDs for capacity report: %v", err)
+	}
+	memory, err := memTotal(procMeminfo)
+	if err != nil {
+		klog.Warningf("Could not find memory for capacity report: %v", err)
+	}
+	value, err := json.Marshal(newNodeCapacity(localSSDs, ssdBytes, memory))
+	if err != nil {
+		klog.Errorf("Could not encode capacity: %v", err)
+		return
+	}
+	if err := d.setNodeAnnotation(ctx, common.CapacityAnnotation, string(value)); err != nil {
+		klog.Errorf("Could not report capacity: %v", err)
+	}
+}
+
+// validateCapacity checks that the size of the cache in info fits on the
+// node. A tmpfs cache must fit in the node's allocatable memory, and other
+// caches within the maximum size reported by the driver, if any.
+func validateCapacity(node *corev1.Node, info volumeTypeInfo) error {
+	if info.VolumeType == "tmpfs" && !info.Size.IsZero() {
+		if allocatable, found := node.Status.Allocatable[corev1.ResourceMemory]; found && !allocatable.IsZero() && info.Size.Cmp(allocatable) > 0 {
+			return fmt.Errorf("size label %s=%s is larger than the %s of allocatable memory of %s", common.SizeLabel, info.Size.String(), allocatable.String(), node.GetName())
+		}
+	}
+	if info.MaxSize != nil && info.Size.Cmp(*info.MaxSize) > 0 {
+		return fmt.Errorf("size label %s=%s is larger than the %s of %s caches %s can hold", common.SizeLabel, info.Size.String(), info.MaxSize.String(), info.VolumeType, node.GetName())
+	}
+	return nil
+}
+
+// maxCacheSize returns the largest cache of volumeType the node can hold, if
+// its driver has reported its capacity.
+func maxCacheSize(node *corev1.Node, volumeType string) (resource.Quantity, bool, error) {
+	report, found := node.GetAnnotations()[common.CapacityAnnotation]
+	if !found {
+		return resource.Quantity{}, false, nil
+	}
+	var capacity NodeCapacity
+	if err := json.Unmarshal([]byte(report), &capacity); err != nil {
+		return resource.Quantity{}, false, fmt.Errorf("bad capacity annotation %s on %s: %w", common.CapacityAnnotation, node.GetName(), err)
+	}
+	maxSize, found := capacity.MaxSizes[volumeType]
+	return maxSize, found, nil
+}
@@ -0,0 +1,91 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package csi
+
+import (
+	"encoding/json"
+	"testing"
+
+	"gotest.tools/v3/assert"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/utils/ptr"
+
+	"github.com/GoogleCloudPlatform/csi-node-cache/pkg/common"
+)
+
+func TestNewNodeCapacity(t *testing.T) {
+	c := newNodeCapacity(4, 4*375<<30, 64<<30)
+	assert.Assert(t, c.MaxSizes["tmpfs"].Equal(resource.MustParse("64Gi")))
+	assert.Assert(t, c.MaxSizes[hugetlbfsVolumeType].Equal(resource.MustParse("64Gi")))
+	assert.Assert(t, c.MaxSizes["lssd"].Equal(resource.MustParse("1500Gi")))
+	assert.Assert(t, c.MaxSizes[mirroredVolumeType].Equal(resource.MustParse("1500Gi")))
+	_, found := c.MaxSizes[pdVolumeType]
+	assert.Assert(t, !found)
+
+	c = newNodeCapacity(0, 0, 64<<30)
+	_, found = c.MaxSizes["lssd"]
+	assert.Assert(t, !found, "no local SSDs")
+}
+
+func TestMaxCacheSize(t *testing.T) {
+	report, err := json.Marshal(newNodeCapacity(1, 375<<30, 16<<30))
+	assert.NilError(t, err)
+	var node corev1.Node
+	node.SetName("node-1")
+
+	_, found, err := maxCacheSize(&node, "lssd")
+	assert.NilError(t, err)
+	assert.Assert(t, !found, "no report")
+
+	node.SetAnnotations(map[string]string{common.CapacityAnnotation: string(report)})
+	maxSize, found, err := maxCacheSize(&node, "lssd")
+	assert.NilError(t, err)
+	assert.Assert(t, found)
+	assert.Assert(t, maxSize.Equal(resource.MustParse("375Gi")))
+
+	_, found, err = maxCacheSize(&node, pdVolumeType)
+	assert.NilError(t, err)
+	assert.Assert(t, !found)
+}
+
+func TestValidateCapacity(t *testing.T) {
+	node := corev1.Node{
+		Status: corev1.NodeStatus{Allocatable: corev1.ResourceList{corev1.ResourceMemory: resource.MustParse("16Gi")}},
+	}
+	node.SetName("node-1")
+	tests := []struct {
+		name          string
+		info          volumeTypeInfo
+		expectedError string
+	}{
+		{name: "tmpfs fits", info: volumeTypeInfo{VolumeType: "tmpfs", Size: resource.MustParse("8Gi")}},
+		{name: "tmpfs too large", info: volumeTypeInfo{VolumeType: "tmpfs", Size: resource.MustParse("32Gi")}, expectedError: "larger than the 16Gi of allocatable memory"},
+		{name: "tmpfs percent", info: volumeTypeInfo{VolumeType: "tmpfs", SizePercent: 50}},
+		{name: "lssd fits", info: volumeTypeInfo{VolumeType: "lssd", Size: resource.MustParse("375Gi"), MaxSize: ptr.To(resource.MustParse("375Gi"))}},
+		{name: "lssd too large", info: volumeTypeInfo{VolumeType: "lssd", Size: resource.MustParse("1Ti"), MaxSize: ptr.To(resource.MustParse("375Gi"))}, expectedError: "larger than the 375Gi of lssd caches"},
+		{name: "no capacity report", info: volumeTypeInfo{VolumeType: "lssd", Size: resource.MustParse("1Ti")}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			err := validateCapacity(&node, tc.info)
+			if tc.expectedError != "" {
+				assert.ErrorContains(t, err, tc.expectedError)
+			} else {
+				assert.NilError(t, err)
+			}
+		})
+	}
+}
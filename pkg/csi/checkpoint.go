@@ -0,0 +1,239 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package csi
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/klog/v2"
+	"k8s.io/mount-utils"
+
+	"github.com/GoogleCloudPlatform/csi-node-cache/pkg/util"
+)
+
+// checkpoint is the driver state that must survive a restart. It is written
+// as JSON to the checkpoint file after every change.
+type checkpoint struct {
+	// VolumeType is the type of the cache when it was last created.
+	VolumeType string `json:"volumeType,omitempty"`
+	// Targets are the published target paths.
+	Targets map[string]publishedTarget `json:"targets,omitempty"`
+	// LowPriority are the directories of the cache, relative to its root,
+	// that have been published to low priority consumers, sorted.
+	LowPriority []string `json:"lowPriority,omitempty"`
+}
+
+type publishedTarget struct {
+	VolumeID string `json:"volumeID"`
+	ReadOnly bool   `json:"readOnly,omitempty"`
+}
+
+// readCheckpoint reads a checkpoint file. A missing file is an empty checkpoint.
+func readCheckpoint(path string) (checkpoint, error) {
+	cp := checkpoint{Targets: map[string]publishedTarget{}}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return cp, nil
+	}
+	if err != nil {
+		return cp, fmt.Errorf("Could not read checkpoint %s: %w", path, err)
+	}
+	if err := json.Unmarshal(data, &cp); err != nil {
+		return checkpoint{Targets: map[string]publishedTarget{}}, fmt.Errorf("Bad checkpoint %s: %w", path, err)
+	}
+	if cp.Targets == nil {
+		cp.Targets = map[string]publishedTarget{}
+	}
+	return cp, nil
+}
+
+// writeCheckpoint replaces the checkpoint file atomically, so that a crash
+// leaves either the old or the new checkpoint.
+func writeCheckpoint(path string, cp checkpoint) error {
+	data, err := json.Marshal(cp)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return fmt.Errorf("Could not write checkpoint: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("Could not write checkpoint: %w", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("Could not sync checkpoint: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("Could not write checkpoint: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("Could not replace checkpoint %s: %w", path, err)
+	}
+	return nil
+}
+
+// updateCheckpoint applies update to the checkpoint and writes it, if
+// checkpointing is enabled. The checkpoint is kept in memory either way, for
+// debugging. Failures are logged, as the mounts themselves have succeeded.
+func (d *Driver) updateCheckpoint(update func(cp *checkpoint)) {
+	d.checkpointMutex.Lock()
+	defer d.checkpointMutex.Unlock()
+	update(&d.checkpoint)
+	if d.checkpointFile == "" {
+		return
+	}
+	if err := writeCheckpoint(d.checkpointFile, d.checkpoint); err != nil {
+		klog.Errorf("Checkpoint not updated: %v", err)
+	}
+}
+
+func (d *Driver) checkpointPublish(targetPath, volumeID string, readOnly bool) {
+	d.updateCheckpoint(func(cp *checkpoint) {
+		cp.Targets[targetPath] = publishedTarget{VolumeID: volumeID, ReadOnly: readOnly}
+	})
+}
+
+func (d *Driver) checkpointUnpublish(targetPath string) {
+	d.updateCheckpoint(func(cp *checkpoint) {
+		delete(cp.Targets, targetPath)
+	})
+}
+
+// checkpointLowPriority records that dir, a path in the cache, holds low
+// priority data.
+func (d *Driver) checkpointLowPriority(dir string) {
+	dir = filepath.Clean(dir)
+	d.updateCheckpoint(func(cp *checkpoint) {
+		if i, found := slices.BinarySearch(cp.LowPriority, dir); !found {
+			cp.LowPriority = slices.Insert(cp.LowPriority, i, dir)
+		}
+	})
+}
+
+// lowPriorityDirs returns the directories recorded as holding low priority
+// data.
+func (d *Driver) lowPriorityDirs() []string {
+	d.checkpointMutex.Lock()
+	defer d.checkpointMutex.Unlock()
+	return slices.Clone(d.checkpoint.LowPriority)
+}
+
+// checkpointVolumeType records the type of a newly created cache.
+func (d *Driver) checkpointVolumeType(volumeType string) {
+	d.updateCheckpoint(func(cp *checkpoint) {
+		if cp.VolumeType != "" && cp.VolumeType != volumeType {
+			klog.Warningf("Cache type changed from %s to %s since it was last created; %d targets remain published from before", cp.VolumeType, volumeType, len(cp.Targets))
+		}
+		cp.VolumeType = volumeType
+	})
+}
+
+// restoreCheckpoint loads the checkpoint after a restart and reconciles it
+// with the actual mounts. Targets that are no longer mounted are forgotten,
+// and stale bind mounts, either corrupted or belonging to pods not in pods,
+// are unmounted. If pods is nil only corrupted mounts are stale.
+func (d *Driver) restoreCheckpoint(pods map[types.UID]bool) {
+	cp, err := readCheckpoint(d.checkpointFile)
+	if err != nil {
+		// Start afresh rather than failing; the mounts are checked by kubelet anyway.
+		klog.Errorf("Ignoring checkpoint: %v", err)
+	}
+
+	reconcileCheckpoint(cp, pods, util.Mounter())
+	klog.Infof("Restored %d published targets from checkpoint, last cache type %q", len(cp.Targets), cp.VolumeType)
+
+	d.checkpointMutex.Lock()
+	defer d.checkpointMutex.Unlock()
+	d.checkpoint = cp
+	if err := writeCheckpoint(d.checkpointFile, cp); err != nil {
+		klog.Errorf("Checkpoint not updated: %v", err)
+	}
+}
+
+// reconcileCheckpoint removes targets from cp that are no longer mounted,
+// cleaning up stale ones. If pods is not nil, targets of pods not in it are
+// stale.
+func reconcileCheckpoint(cp checkpoint, pods map[types.UID]bool, mounter mount.Interface) {
+	for target, published := range cp.Targets {
+		uid := targetPodUID(target)
+		notMnt, err := mounter.IsLikelyNotMountPoint(target)
+		switch {
+		case os.IsNotExist(err) || (err == nil && notMnt):
+			klog.Infof("Checkpointed target %s for %s is no longer mounted", target, published.VolumeID)
+			delete(cp.Targets, target)
+		case mount.IsCorruptedMnt(err):
+			if cleanupStaleTarget(mounter, target, "corrupted") {
+				delete(cp.Targets, target)
+			}
+		case err != nil:
+			klog.Errorf("Could not check checkpointed target %s, keeping it: %v", target, err)
+		case pods != nil && uid != "" && !pods[uid]:
+			if cleanupStaleTarget(mounter, target, "pod no longer on node") {
+				delete(cp.Targets, target)
+			}
+		}
+	}
+}
+
+// cleanupStaleTarget unmounts and removes a stale target, returning true if
+// it is gone.
+func cleanupStaleTarget(mounter mount.Interface, target, reason string) bool {
+	if err := unmountTarget(context.Background(), mounter, target); err != nil {
+		klog.Errorf("Could not clean up stale target %s (%s), will retry after the next restart: %v", target, reason, err)
+		return false
+	}
+	klog.Infof("Cleaned up stale target %s (%s)", target, reason)
+	return true
+}
+
+// podsOnNode returns the UIDs of the pods scheduled to the driver's node.
+func (d *Driver) podsOnNode(ctx context.Context) (map[types.UID]bool, error) {
+	pods, err := d.client.CoreV1().Pods("").List(ctx, metav1.ListOptions{
+		FieldSelector: fields.OneTermEqualSelector("spec.nodeName", d.nodeId).String(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	uids := map[types.UID]bool{}
+	for _, pod := range pods.Items {
+		uids[pod.GetUID()] = true
+	}
+	return uids, nil
+}
+
+// targetPodUID extracts the pod UID from a kubelet target path of the form
+// .../pods/<uid>/volumes/..., or returns "" if the path isn't of that form.
+func targetPodUID(target string) types.UID {
+	parts := strings.Split(filepath.Clean(target), string(filepath.Separator))
+	for i := 0; i+2 < len(parts); i++ {
+		if parts[i] == "pods" && parts[i+2] == "volumes" {
+			return types.UID(parts[i+1])
+		}
+	}
+	return ""
+}
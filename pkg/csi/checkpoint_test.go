@@ -0,0 +1,83 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package csi
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"gotest.tools/v3/assert"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/mount-utils"
+)
+
+func TestCheckpointRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "checkpoint.json")
+
+	cp, err := readCheckpoint(path)
+	assert.NilError(t, err)
+	assert.Equal(t, len(cp.Targets), 0)
+
+	cp.VolumeType = "lssd"
+	cp.Targets["/target"] = publishedTarget{VolumeID: "vol", ReadOnly: true}
+	cp.LowPriority = []string{"batch"}
+	assert.NilError(t, writeCheckpoint(path, cp))
+
+	read, err := readCheckpoint(path)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, read, cp)
+
+	assert.NilError(t, os.WriteFile(path, []byte("{bad"), 0644))
+	_, err = readCheckpoint(path)
+	assert.ErrorContains(t, err, "Bad checkpoint")
+}
+
+func TestTargetPodUID(t *testing.T) {
+	assert.Equal(t, targetPodUID("/var/lib/kubelet/pods/1234-abcd/volumes/kubernetes.io~csi/cache/mount"), types.UID("1234-abcd"))
+	assert.Equal(t, targetPodUID("/some/other/path"), types.UID(""))
+}
+
+func TestReconcileCheckpoint(t *testing.T) {
+	dir := t.TempDir()
+	target := func(uid string) string {
+		path := filepath.Join(dir, "pods", uid, "volumes", "kubernetes.io~csi", "cache", "mount")
+		assert.NilError(t, os.MkdirAll(path, 0750))
+		return path
+	}
+	running := target("running")
+	deleted := target("deleted")
+	unmounted := target("unmounted")
+	missing := filepath.Join(dir, "pods", "missing", "volumes", "kubernetes.io~csi", "cache", "mount")
+
+	mounter := mount.NewFakeMounter([]mount.MountPoint{
+		{Device: "/local/lssd", Path: running},
+		{Device: "/local/lssd", Path: deleted},
+	})
+	cp := checkpoint{Targets: map[string]publishedTarget{
+		running:   {VolumeID: "a"},
+		deleted:   {VolumeID: "b"},
+		unmounted: {VolumeID: "c"},
+		missing:   {VolumeID: "d"},
+	}}
+	reconcileCheckpoint(cp, map[types.UID]bool{"running": true, "unmounted": true}, mounter)
+
+	assert.DeepEqual(t, cp.Targets, map[string]publishedTarget{running: {VolumeID: "a"}})
+	mounts, err := mounter.List()
+	assert.NilError(t, err)
+	assert.DeepEqual(t, mounts, []mount.MountPoint{{Device: "/local/lssd", Path: running}})
+	_, err = os.Stat(deleted)
+	assert.Assert(t, os.IsNotExist(err))
+}
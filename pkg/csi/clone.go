@@ -0,0 +1,131 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package csi
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// clonesDir holds the copies made for clone publishes, in the private
+// directory of the cache so that pods only reach their own clone.
+const clonesDir = "clones"
+
+// clonePath returns the directory of the clone published to targetPath.
+func clonePath(cachePath, targetPath string) string {
+	sum := sha256.Sum256([]byte(targetPath))
+	return privatePath(cachePath, clonesDir, hex.EncodeToString(sum[:8]))
+}
+
+// cloneSource makes a reflinked copy of golden, a directory in the cache at
+// cachePath, for the publish to targetPath, and returns it. Any copy left by
+// an earlier failed publish is replaced.
+func cloneSource(cachePath, golden, targetPath string) (string, error) {
+	source, err := publishSource(cachePath, golden)
+	if err != nil {
+		return "", err
+	}
+	clone := clonePath(cachePath, targetPath)
+	if err := os.RemoveAll(clone); err != nil {
+		return "", fmt.Errorf("could not remove old clone %s: %w", clone, err)
+	}
+	if err := makePrivateDir(cachePath, clonesDir); err != nil {
+		return "", err
+	}
+	if err := reflinkTree(source, clone); err != nil {
+		os.RemoveAll(clone)
+		return "", fmt.Errorf("could not clone %s: %w", golden, err)
+	}
+	return clone, nil
+}
+
+// removeClone removes the clone published to targetPath, if any. The space
+// it used is reclaimed as only its changes took any.
+func removeClone(cachePath, targetPath string) error {
+	return os.RemoveAll(clonePath(cachePath, targetPath))
+}
+
+// reflinkTree copies the directory tree at src to dst, which must not exist,
+// cloning regular files with reflinks. Ownership and permissions are kept.
+// Special files such as sockets are not copied, nor is the private directory
+// if src is the whole cache.
+func reflinkTree(src, dst string) error {
+	return filepath.WalkDir(src, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if entry.IsDir() && isPrivateDir(src, path) {
+			return filepath.SkipDir
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		switch {
+		case entry.IsDir():
+			if err := os.Mkdir(target, info.Mode().Perm()); err != nil {
+				return err
+			}
+		case entry.Type()&fs.ModeSymlink != 0:
+			link, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			if err := os.Symlink(link, target); err != nil {
+				return err
+			}
+		case entry.Type().IsRegular():
+			if err := reflinkFile(path, target, info.Mode().Perm()); err != nil {
+				return err
+			}
+		default:
+			return nil
+		}
+		if st, ok := info.Sys().(*syscall.Stat_t); ok {
+			return os.Lchown(target, int(st.Uid), int(st.Gid))
+		}
+		return nil
+	})
+}
+
+// reflinkFile clones src to a new file dst, sharing its data.
+func reflinkFile(src, dst string, perm fs.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+	if err != nil {
+		return err
+	}
+	if err := unix.IoctlFileClone(int(out.Fd()), int(in.Fd())); err != nil {
+		out.Close()
+		return fmt.Errorf("could not reflink %s: %w", src, err)
+	}
+	return out.Close()
+}
@@ -0,0 +1,63 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package csi
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/sys/unix"
+	"gotest.tools/v3/assert"
+)
+
+func TestClonePath(t *testing.T) {
+	a := clonePath("/cache", "/var/lib/kubelet/pods/a/volumes/cache")
+	b := clonePath("/cache", "/var/lib/kubelet/pods/b/volumes/cache")
+	assert.Equal(t, filepath.Dir(a), "/cache/.node-cache-private/clones")
+	assert.Assert(t, a != b)
+	assert.Equal(t, a, clonePath("/cache", "/var/lib/kubelet/pods/a/volumes/cache"))
+}
+
+func TestCloneSource(t *testing.T) {
+	cache := t.TempDir()
+	golden := filepath.Join(cache, "golden")
+	assert.NilError(t, os.MkdirAll(filepath.Join(golden, "models"), 0750))
+	assert.NilError(t, os.WriteFile(filepath.Join(golden, "models", "weights"), []byte("weights"), 0640))
+	assert.NilError(t, os.Symlink("models/weights", filepath.Join(golden, "latest")))
+
+	clone, err := cloneSource(cache, "golden", "/target")
+	if errors.Is(err, unix.EOPNOTSUPP) || errors.Is(err, unix.EINVAL) || errors.Is(err, unix.ENOTTY) || errors.Is(err, unix.EXDEV) {
+		_, statErr := os.Stat(clonePath(cache, "/target"))
+		assert.Assert(t, os.IsNotExist(statErr), "a failed clone is removed")
+		t.Skipf("%s does not support reflinks: %v", cache, err)
+	}
+	assert.NilError(t, err)
+	assert.Equal(t, clone, clonePath(cache, "/target"))
+	data, err := os.ReadFile(filepath.Join(clone, "latest"))
+	assert.NilError(t, err)
+	assert.Equal(t, string(data), "weights")
+
+	// The clone is private.
+	assert.NilError(t, os.WriteFile(filepath.Join(clone, "models", "weights"), []byte("changed"), 0640))
+	data, err = os.ReadFile(filepath.Join(golden, "models", "weights"))
+	assert.NilError(t, err)
+	assert.Equal(t, string(data), "weights")
+
+	assert.NilError(t, removeClone(cache, "/target"))
+	_, err = os.Stat(clone)
+	assert.Assert(t, os.IsNotExist(err))
+}
@@ -0,0 +1,137 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package csi
+
+import (
+	"context"
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	"github.com/GoogleCloudPlatform/csi-node-cache/pkg/common"
+)
+
+const (
+	// NodeCacheReady is the node condition giving the state of the cache.
+	NodeCacheReady corev1.NodeConditionType = "NodeCacheReady"
+
+	// Reasons for the NodeCacheReady condition. Warm and Cold caches are ready.
+	cacheWarm        = "Warm"
+	cacheCold        = "Cold"
+	cacheDiskPending = "DiskPending"
+	cacheMaintenance = "Maintenance"
+	cacheUnhealthy   = "Unhealthy"
+)
+
+// cacheState is what is known about the cache on a node when computing its
+// condition.
+type cacheState struct {
+	info volumeTypeInfo
+	// diskAttached is only meaningful for caches using a PD.
+	diskAttached     bool
+	maintenanceState string
+	// usage is nil if the driver has not reported.
+	usage *CacheUsage
+}
+
+// cacheCondition computes the NodeCacheReady condition. A cold cache is one
+// that can be used but has not yet been set up by the driver, which happens
+// on first use.
+func cacheCondition(state cacheState) corev1.NodeCondition {
+	cond := func(status corev1.ConditionStatus, reason, message string) corev1.NodeCondition {
+		return corev1.NodeCondition{Type: NodeCacheReady, Status: status, Reason: reason, Message: message}
+	}
+	if state.maintenanceState != "" {
+		return cond(corev1.ConditionFalse, cacheMaintenance, fmt.Sprintf("cache maintenance is %s", state.maintenanceState))
+	}
+	if usesPD(state.info.VolumeType) {
+		if state.info.Disk == "" {
+			return cond(corev1.ConditionFalse, cacheDiskPending, "waiting for the cache disk to be provisioned")
+		}
+		if !state.diskAttached {
+			return cond(corev1.ConditionFalse, cacheDiskPending, fmt.Sprintf("waiting for %s to be attached", state.info.Disk))
+		}
+	}
+	if state.usage == nil {
+		return cond(corev1.ConditionTrue, cacheCold, "the cache will be set up on first use")
+	}
+	if state.usage.HealthError != "" {
+		return cond(corev1.ConditionFalse, cacheUnhealthy, state.usage.HealthError)
+	}
+	if !state.usage.Mounted {
+		if state.usage.LastError != "" {
+			return cond(corev1.ConditionFalse, cacheUnhealthy, state.usage.LastError)
+		}
+		return cond(corev1.ConditionTrue, cacheCold, "the cache will be set up on first use")
+	}
+	return cond(corev1.ConditionTrue, cacheWarm, fmt.Sprintf("%s cache is mounted", state.info.VolumeType))
+}
+
+// setCondition replaces or adds cond in conditions, returning true if it was
+// changed. The transition time is only updated when the status changes.
+func setCondition(conditions []corev1.NodeCondition, cond corev1.NodeCondition, now metav1.Time) ([]corev1.NodeCondition, bool) {
+	for i, c := range conditions {
+		if c.Type != cond.Type {
+			continue
+		}
+		if c.Status == cond.Status && c.Reason == cond.Reason && c.Message == cond.Message {
+			return conditions, false
+		}
+		cond.LastHeartbeatTime = now
+		cond.LastTransitionTime = c.LastTransitionTime
+		if c.Status != cond.Status {
+			cond.LastTransitionTime = now
+		}
+		conditions[i] = cond
+		return conditions, true
+	}
+	cond.LastHeartbeatTime = now
+	cond.LastTransitionTime = now
+	return append(conditions, cond), true
+}
+
+// updateCacheCondition sets the NodeCacheReady condition on node.
+func (r *reconciler) updateCacheCondition(ctx context.Context, node *corev1.Node, info volumeTypeInfo) error {
+	state := cacheState{
+		info:             info,
+		maintenanceState: node.GetAnnotations()[common.MaintenanceStateAnnotation],
+		usage:            nodeUsage(node),
+	}
+	if usesPD(info.VolumeType) && info.Disk != "" && r.attacher != nil {
+		volume, err := r.pdVolumeHandle(ctx, node, info.Disk)
+		if err != nil {
+			return err
+		}
+		if state.diskAttached, err = r.attacher.diskIsAttached(ctx, volume, node.GetName()); err != nil {
+			return fmt.Errorf("Could not check attachment of %s: %w", info.Disk, err)
+		}
+	}
+
+	cond := cacheCondition(state)
+	patch := client.StrategicMergeFrom(node.DeepCopy())
+	conditions, changed := setCondition(node.Status.Conditions, cond, metav1.Now())
+	if !changed {
+		return nil
+	}
+	node.Status.Conditions = conditions
+	if err := r.Status().Patch(ctx, node, patch); err != nil {
+		return fmt.Errorf("Could not set cache condition on %s: %w", node.GetName(), err)
+	}
+	log.FromContext(ctx).Info("cache condition", "node", node.GetName(), "status", cond.Status, "reason", cond.Reason)
+	return nil
+}
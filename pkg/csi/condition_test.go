@@ -0,0 +1,137 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package csi
+
+import (
+	"testing"
+	"time"
+
+	"gotest.tools/v3/assert"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestCacheCondition(t *testing.T) {
+	tests := []struct {
+		name   string
+		state  cacheState
+		status corev1.ConditionStatus
+		reason string
+	}{
+		{
+			name:   "unreported",
+			state:  cacheState{info: volumeTypeInfo{VolumeType: "tmpfs"}},
+			status: corev1.ConditionTrue,
+			reason: cacheCold,
+		},
+		{
+			name: "warm",
+			state: cacheState{
+				info:  volumeTypeInfo{VolumeType: "tmpfs"},
+				usage: &CacheUsage{Mounted: true},
+			},
+			status: corev1.ConditionTrue,
+			reason: cacheWarm,
+		},
+		{
+			name: "unhealthy",
+			state: cacheState{
+				info:  volumeTypeInfo{VolumeType: "lssd"},
+				usage: &CacheUsage{Mounted: true, HealthError: "degraded"},
+			},
+			status: corev1.ConditionFalse,
+			reason: cacheUnhealthy,
+		},
+		{
+			name: "publish error",
+			state: cacheState{
+				info:  volumeTypeInfo{VolumeType: "lssd"},
+				usage: &CacheUsage{LastError: "no devices"},
+			},
+			status: corev1.ConditionFalse,
+			reason: cacheUnhealthy,
+		},
+		{
+			name:   "unprovisioned",
+			state:  cacheState{info: volumeTypeInfo{VolumeType: pdVolumeType}},
+			status: corev1.ConditionFalse,
+			reason: cacheDiskPending,
+		},
+		{
+			name:   "unattached",
+			state:  cacheState{info: volumeTypeInfo{VolumeType: pdVolumeType, Disk: "pv"}},
+			status: corev1.ConditionFalse,
+			reason: cacheDiskPending,
+		},
+		{
+			name: "attached",
+			state: cacheState{
+				info:         volumeTypeInfo{VolumeType: pdVolumeType, Disk: "pv"},
+				diskAttached: true,
+			},
+			status: corev1.ConditionTrue,
+			reason: cacheCold,
+		},
+		{
+			name: "maintenance",
+			state: cacheState{
+				info:             volumeTypeInfo{VolumeType: pdVolumeType, Disk: "pv"},
+				diskAttached:     true,
+				maintenanceState: "draining",
+				usage:            &CacheUsage{Mounted: true},
+			},
+			status: corev1.ConditionFalse,
+			reason: cacheMaintenance,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cond := cacheCondition(test.state)
+			assert.Equal(t, cond.Type, NodeCacheReady)
+			assert.Equal(t, cond.Status, test.status)
+			assert.Equal(t, cond.Reason, test.reason)
+		})
+	}
+}
+
+func TestSetCondition(t *testing.T) {
+	then := metav1.NewTime(time.Unix(1000, 0))
+	now := metav1.NewTime(time.Unix(2000, 0))
+	ready := corev1.NodeCondition{Type: corev1.NodeReady, Status: corev1.ConditionTrue}
+	cold := corev1.NodeCondition{Type: NodeCacheReady, Status: corev1.ConditionTrue, Reason: cacheCold}
+	warm := corev1.NodeCondition{Type: NodeCacheReady, Status: corev1.ConditionTrue, Reason: cacheWarm}
+	pending := corev1.NodeCondition{Type: NodeCacheReady, Status: corev1.ConditionFalse, Reason: cacheDiskPending}
+
+	conditions, changed := setCondition([]corev1.NodeCondition{ready}, cold, then)
+	assert.Assert(t, changed)
+	assert.Equal(t, len(conditions), 2)
+	assert.Equal(t, conditions[1].LastTransitionTime, then)
+
+	conditions, changed = setCondition(conditions, cold, now)
+	assert.Assert(t, !changed)
+	assert.Equal(t, conditions[1].LastHeartbeatTime, then)
+
+	conditions, changed = setCondition(conditions, warm, now)
+	assert.Assert(t, changed)
+	assert.Equal(t, conditions[1].Reason, cacheWarm)
+	assert.Equal(t, conditions[1].LastTransitionTime, then)
+	assert.Equal(t, conditions[1].LastHeartbeatTime, now)
+
+	conditions, changed = setCondition(conditions, pending, now)
+	assert.Assert(t, changed)
+	assert.Equal(t, len(conditions), 2)
+	assert.Equal(t, conditions[1].LastTransitionTime, now)
+	assert.Equal(t, conditions[0].Type, corev1.NodeReady)
+}
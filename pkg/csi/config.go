@@ -0,0 +1,182 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package csi
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/klog/v2"
+	"sigs.k8s.io/yaml"
+
+	"github.com/GoogleCloudPlatform/csi-node-cache/pkg/prewarm"
+)
+
+// Config holds the driver settings that can be changed without a restart,
+// read from a YAML file such as a mounted ConfigMap. Settings left out of the
+// file keep their value from flags.
+type Config struct {
+	AllowedNamespaces      *[]string        `json:"allowedNamespaces,omitempty"`
+	AllowedServiceAccounts *[]string        `json:"allowedServiceAccounts,omitempty"`
+	MkfsOptions            *[]string        `json:"mkfsOptions,omitempty"`
+	ScaleDownUtilization   *float64         `json:"scaleDownUtilization,omitempty"`
+	ScaleDownActivity      *metav1.Duration `json:"scaleDownActivity,omitempty"`
+	ReportConsumers        *bool            `json:"reportConsumers,omitempty"`
+	ReportScore            *bool            `json:"reportScore,omitempty"`
+	PrewarmConcurrency     *int             `json:"prewarmConcurrency,omitempty"`
+}
+
+// settings are the driver options that may be reloaded from the config file.
+// A new settings is made on each reload rather than changing one in place.
+type settings struct {
+	policy               consumerPolicy
+	mkfsOptions          []string
+	scaleDownUtilization float64
+	scaleDownActivity    time.Duration
+	auditAnnotation      bool
+	scoreAnnotation      bool
+	prewarmOptions       prewarm.Options
+}
+
+func newSettings(opts DriverOptions) (*settings, error) {
+	policy, err := newConsumerPolicy(opts.AllowedNamespaces, opts.AllowedServiceAccounts)
+	if err != nil {
+		return nil, err
+	}
+	return &settings{
+		policy:               policy,
+		mkfsOptions:          opts.MkfsOptions,
+		scaleDownUtilization: opts.ScaleDownUtilization,
+		scaleDownActivity:    opts.ScaleDownActivity,
+		auditAnnotation:      opts.ReportConsumers,
+		scoreAnnotation:      opts.ReportScore,
+		prewarmOptions: prewarm.Options{
+			Concurrency: opts.PrewarmConcurrency,
+			ChunkSize:   opts.PrewarmChunkSize,
+		},
+	}, nil
+}
+
+// loadConfig reads a config file. Unknown settings are an error, so that a
+// typo isn't silently ignored.
+func loadConfig(file string) (Config, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return Config{}, err
+	}
+	var cfg Config
+	if err := yaml.UnmarshalStrict(data, &cfg); err != nil {
+		return Config{}, fmt.Errorf("bad config in %s: %w", file, err)
+	}
+	return cfg, nil
+}
+
+// apply returns opts with the settings in the config.
+func (c Config) apply(opts DriverOptions) DriverOptions {
+	if c.AllowedNamespaces != nil {
+		opts.AllowedNamespaces = *c.AllowedNamespaces
+	}
+	if c.AllowedServiceAccounts != nil {
+		opts.AllowedServiceAccounts = *c.AllowedServiceAccounts
+	}
+	if c.MkfsOptions != nil {
+		opts.MkfsOptions = *c.MkfsOptions
+	}
+	if c.ScaleDownUtilization != nil {
+		opts.ScaleDownUtilization = *c.ScaleDownUtilization
+	}
+	if c.ScaleDownActivity != nil {
+		opts.ScaleDownActivity = c.ScaleDownActivity.Duration
+	}
+	if c.ReportConsumers != nil {
+		opts.ReportConsumers = *c.ReportConsumers
+	}
+	if c.ReportScore != nil {
+		opts.ReportScore = *c.ReportScore
+	}
+	if c.PrewarmConcurrency != nil {
+		opts.PrewarmConcurrency = *c.PrewarmConcurrency
+	}
+	return opts
+}
+
+// settings returns the current settings.
+func (d *Driver) settings() *settings {
+	return d.current.Load()
+}
+
+// reloadConfig applies the config file over the options from flags. If the
+// file is bad, the current settings are kept.
+func (d *Driver) reloadConfig() error {
+	cfg, err := loadConfig(d.opts.ConfigFile)
+	if err != nil {
+		return err
+	}
+	s, err := newSettings(cfg.apply(d.opts))
+	if err != nil {
+		return fmt.Errorf("bad config in %s: %w", d.opts.ConfigFile, err)
+	}
+	d.current.Store(s)
+	return nil
+}
+
+// RunConfigWatch reloads the config file when it changes, or on SIGHUP, until
+// ctx is done. The directory of the file is watched, as a mounted ConfigMap
+// is updated by replacing a symlink.
+func (d *Driver) RunConfigWatch(ctx context.Context) {
+	if d.opts.ConfigFile == "" {
+		return
+	}
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	var events chan fsnotify.Event
+	watcher, err := fsnotify.NewWatcher()
+	if err == nil {
+		err = watcher.Add(filepath.Dir(d.opts.ConfigFile))
+	}
+	if err != nil {
+		klog.Errorf("Could not watch %s, the config will only be reloaded on SIGHUP: %v", d.opts.ConfigFile, err)
+	} else {
+		defer watcher.Close()
+		events = watcher.Events
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+		case _, ok := <-events:
+			if !ok {
+				events = nil
+				continue
+			}
+		}
+		if err := d.reloadConfig(); err != nil {
+			klog.Errorf("Could not reload config, keeping the current settings: %v", err)
+		} else {
+			klog.Infof("Reloaded config from %s", d.opts.ConfigFile)
+		}
+	}
+}
@@ -0,0 +1,59 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package csi
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"gotest.tools/v3/assert"
+)
+
+func TestReloadConfig(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "config.yaml")
+	d := &Driver{opts: DriverOptions{
+		ConfigFile:           file,
+		ScaleDownUtilization: 0.5,
+		MkfsOptions:          []string{"-E", "lazy_itable_init=1"},
+	}}
+
+	assert.NilError(t, os.WriteFile(file, []byte("scaleDownActivity: 1h\nallowedNamespaces: [ml]\nreportConsumers: true\n"), 0644))
+	assert.NilError(t, d.reloadConfig())
+	s := d.settings()
+	assert.Equal(t, s.scaleDownActivity, time.Hour)
+	assert.Equal(t, s.auditAnnotation, true)
+	// Settings not in the file keep their flag values.
+	assert.Equal(t, s.scaleDownUtilization, 0.5)
+	assert.DeepEqual(t, s.mkfsOptions, []string{"-E", "lazy_itable_init=1"})
+	assert.Assert(t, s.policy.check(map[string]string{podNamespaceKey: "web"}) != nil)
+	assert.NilError(t, s.policy.check(map[string]string{podNamespaceKey: "ml"}))
+
+	// Removing a setting returns it to the flag value.
+	assert.NilError(t, os.WriteFile(file, []byte("scaleDownUtilization: 0.8\n"), 0644))
+	assert.NilError(t, d.reloadConfig())
+	s = d.settings()
+	assert.Equal(t, s.scaleDownUtilization, 0.8)
+	assert.Equal(t, s.scaleDownActivity, time.Duration(0))
+	assert.NilError(t, s.policy.check(map[string]string{podNamespaceKey: "web"}))
+
+	// A bad config keeps the current settings.
+	for _, bad := range []string{"scaleDownUtilisation: 0.1\n", "allowedServiceAccounts: [no-namespace]\n"} {
+		assert.NilError(t, os.WriteFile(file, []byte(bad), 0644))
+		assert.Assert(t, d.reloadConfig() != nil, bad)
+		assert.Equal(t, d.settings(), s)
+	}
+}
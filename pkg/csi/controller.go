@@ -16,15 +16,21 @@ package csi
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"slices"
 	"strings"
 	"time"
 
+	"cloud.google.com/go/compute/metadata"
 	"google.golang.org/api/compute/v1"
+	appsv1 "k8s.io/api/apps/v1"
 	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/types"
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
@@ -32,53 +38,245 @@ import (
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/kubernetes/scheme"
 	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/util/workqueue"
 	"k8s.io/utils/ptr"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
 	"sigs.k8s.io/controller-runtime/pkg/cache"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/event"
 	"sigs.k8s.io/controller-runtime/pkg/handler"
 	"sigs.k8s.io/controller-runtime/pkg/healthz"
 	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/webhook"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+
+	"github.com/GoogleCloudPlatform/csi-node-cache/pkg/common"
+	"github.com/GoogleCloudPlatform/csi-node-cache/pkg/fault"
 )
 
 const (
 	finalizerLabel = "node-cache.gke.io/in-use"
 	zoneLabel      = "topology.gke.io/zone"
+
+	// gceProviderPrefix starts the provider IDs of GCE nodes, which are
+	// gce://<project>/<zone>/<instance>.
+	gceProviderPrefix = "gce://"
+
+	// capacityExceededReason is the reason of events about size labels
+	// larger than the node can hold.
+	capacityExceededReason = "CacheSizeExceedsCapacity"
+	// invalidStorageClassReason is the reason of events about storage class
+	// annotations that can't be used for a PD cache.
+	invalidStorageClassReason = "InvalidStorageClass"
+
+	// pdProvisioner is the provisioner of storage classes for PD caches, as
+	// the disks are attached to nodes with the compute API.
+	pdProvisioner = "pd.csi.storage.gke.io"
+
+	// PD cache PVCs are labeled as managed by the controller, so that other
+	// PVCs in the namespace are ignored.
+	managedByLabel = "app.kubernetes.io/managed-by"
+	managedByValue = "node-cache-controller"
+	// cacheNodeLabel links a PD cache PVC to its node. The PVC is also owned
+	// by the node, so that it is garbage collected with the node.
+	cacheNodeLabel = "node-cache.gke.io/cache-node"
+	// selectedNodeAnnotation is set by the scheduler for delayed binding, and
+	// is used by external provisioners to choose the volume topology.
+	selectedNodeAnnotation = "volume.kubernetes.io/selected-node"
 )
 
+// volumeHandle is a GCE disk. Zonal disks have a zone, and regional disks a
+// region.
 type volumeHandle struct {
 	project string
 	zone    string
+	region  string
 	name    string
 }
 
+// ManagerOptions configures the controller manager created by NewManager.
+type ManagerOptions struct {
+	// Namespace holds the volume type map and any PD cache PVCs.
+	Namespace string
+	// VolumeTypeConfigMap is the name of the volume type map in Namespace.
+	VolumeTypeConfigMap string
+	// Attacher is used to attach PD caches. If nil, PD caches cannot be used.
+	Attacher Attacher
+	// PdStorageClass is the storage class used to provision PD caches.
+	PdStorageClass string
+	// ProvisionerStorageClass, if set, causes a node-affine PV to be created for
+	// each cache node so that the cache can be referenced through a PVC.
+	ProvisionerStorageClass string
+	// DriverName is the name of the CSI driver, used in provisioned PVs.
+	DriverName string
+	// MappingWriteWindow is how long changes to the volume type map are
+	// batched before being written.
+	MappingWriteWindow time.Duration
+	// NodeSelector, if set, further restricts the nodes with the volume type
+	// label that are treated as cache nodes.
+	NodeSelector labels.Selector
+	// WebhookPort, if positive, serves a validating webhook for pods using
+	// DriverName at PodValidationPath on this port.
+	WebhookPort int
+	// WebhookCertDir holds the tls.crt and tls.key of the webhook.
+	WebhookCertDir string
+	// PeerSeeding chooses a donor node for each new cache to be seeded from
+	// by the driver. See common.SeedDonorAnnotation.
+	PeerSeeding bool
+	// DriverDaemonSet, if set, is the name of the driver DaemonSet in
+	// Namespace. Its required node affinity is kept matching the cache nodes,
+	// including NodeSelector.
+	DriverDaemonSet string
+	// Export, if it has a destination, periodically exports a report of the
+	// caches in the cluster for fleet dashboards.
+	Export ExportOptions
+	// AdminAddress, if set, serves the admin API on this address, with the
+	// tls.crt and tls.key in AdminCertDir. See AdminPathPrefix.
+	AdminAddress string
+	AdminCertDir string
+	// ZoneLabels are the node labels the zone of a node is read from, in
+	// order. If empty, DefaultZoneLabels are used.
+	ZoneLabels []string
+	// HealthProbeAddress, if set, serves /healthz and /readyz on this address.
+	// The controller is ready once the volume type map can be read and the
+	// Attacher can reach the compute API.
+	HealthProbeAddress string
+	// ScopedNodeCache only caches cache nodes, rather than every node in the
+	// cluster, reading others from the API server when needed. This saves
+	// memory in large clusters where few nodes have caches.
+	ScopedNodeCache bool
+	// RemovedPDPolicy is RemovedPDDelete or RemovedPDRetain, what happens to
+	// the PD of a cache whose node label is removed. If empty, it is deleted.
+	RemovedPDPolicy string
+}
+
 type reconciler struct {
 	client.Client
-	Scheme              *runtime.Scheme
-	k8sClient           *kubernetes.Clientset
-	namespace           string
-	volumeTypeConfigMap string
-	pdStorageClass      string
-	attacher            Attacher
+	Scheme                  *runtime.Scheme
+	k8sClient               *kubernetes.Clientset
+	namespace               string
+	volumeTypeConfigMap     string
+	pdStorageClass          string
+	provisionerStorageClass string
+	driverName              string
+	attacher                Attacher
+	mappings                *mappingWriter
+	peerSeeding             bool
+	removedPDPolicy         string
+	zoneLabels              []string
+	// apiReader reads objects that are not cached, such as the PVs of PD
+	// caches and, if scopedNodes, nodes that aren't cache nodes.
+	apiReader   client.Reader
+	scopedNodes bool
+	// errors is the last reconcile error of each node.
+	errors *reconcileErrors
+	// recorder, if set, reports problems with nodes as events.
+	recorder record.EventRecorder
 }
 
+// Bounds of the backoff used when a PD cache PVC cannot yet be attached.
+const (
+	pvcRetryBaseDelay = time.Second
+	pvcRetryMaxDelay  = 5 * time.Minute
+)
+
 type pvcReconciler struct {
 	*reconciler
+	// backoff tracks consecutive transient failures per PVC.
+	backoff workqueue.RateLimiter
 }
 
 type Attacher interface {
+	// checkAccess makes a read-only compute API call, to check that the
+	// credentials of the attacher work.
+	checkAccess(ctx context.Context) error
+	// verifyDisk checks that an existing disk can be used by nodeName.
+	verifyDisk(ctx context.Context, volume, nodeName string) error
 	diskIsAttached(ctx context.Context, volume, nodeName string) (bool, error)
 	attachDisk(ctx context.Context, volume, nodeName string) error
+	detachDisk(ctx context.Context, volume, nodeName string) error
+	// listAttachedCacheDisks returns the volume handles of the disks attached
+	// to nodeName that may be caches: persistent disks other than the boot
+	// disk, attached under their own name as attachDisk does. Disks attached
+	// the same way by others, such as the PD CSI driver, are included, so a
+	// disk must be checked to be a cache before it is detached.
+	listAttachedCacheDisks(ctx context.Context, nodeName string) ([]string, error)
+}
+
+const (
+	defaultAttachTimeout = 2 * time.Minute
+	defaultDetachTimeout = 2 * time.Minute
+	defaultPollInterval  = 5 * time.Second
+)
+
+// DefaultZoneLabels are the labels the zone of a node is read from, when no
+// others are configured. The GKE label is set on GKE nodes, and the well-known
+// one by most other cloud providers.
+var DefaultZoneLabels = []string{zoneLabel, corev1.LabelTopologyZone}
+
+var (
+	// ErrAttachTimeout and ErrDetachTimeout are wrapped by the errors of
+	// attaches and detaches whose GCE operation did not finish within its
+	// timeout. The operation may still complete, so the attachment should be
+	// checked again rather than the disk recreated.
+	ErrAttachTimeout = errors.New("timed out waiting for attach")
+	ErrDetachTimeout = errors.New("timed out waiting for detach")
+)
+
+// AttachOptions are the timeouts of the GCE operations of an attacher. Zero
+// values are replaced by defaults.
+type AttachOptions struct {
+	// AttachTimeout and DetachTimeout are how long an attach or detach
+	// operation is waited for.
+	AttachTimeout time.Duration
+	DetachTimeout time.Duration
+	// PollInterval is the pause before waiting again for an operation that
+	// the wait API returned before it was done.
+	PollInterval time.Duration
+	// Project is the project of the cluster's instances. If empty, it is read
+	// from the metadata server, and failing that the project of each disk is
+	// used.
+	Project string
+	// ZoneLabels are as in ManagerOptions.
+	ZoneLabels []string
 }
 
 type attacher struct {
 	k8sClient  client.Client
 	computeSvc *compute.Service
+	opts       AttachOptions
 }
 
 var _ Attacher = &attacher{}
 
-func NewAttacher(ctx context.Context, cfg *rest.Config) (Attacher, error) {
+func NewAttacher(ctx context.Context, cfg *rest.Config, opts AttachOptions) (Attacher, error) {
+	if opts.AttachTimeout < 0 || opts.DetachTimeout < 0 || opts.PollInterval < 0 {
+		return nil, fmt.Errorf("Bad attach options %+v, durations must not be negative", opts)
+	}
+	if opts.AttachTimeout == 0 {
+		opts.AttachTimeout = defaultAttachTimeout
+	}
+	if opts.DetachTimeout == 0 {
+		opts.DetachTimeout = defaultDetachTimeout
+	}
+	if opts.PollInterval == 0 {
+		opts.PollInterval = defaultPollInterval
+	}
+	if len(opts.ZoneLabels) == 0 {
+		opts.ZoneLabels = DefaultZoneLabels
+	}
+	if opts.Project == "" && metadata.OnGCE() {
+		project, err := metadata.ProjectIDWithContext(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("Could not get project from metadata: %w", err)
+		}
+		opts.Project = project
+	}
 	k8sClient, err := client.New(cfg, client.Options{Scheme: scheme.Scheme})
 	if err != nil {
 		return nil, err
@@ -87,7 +285,7 @@ func NewAttacher(ctx context.Context, cfg *rest.Config) (Attacher, error) {
 	if err != nil {
 		return nil, err
 	}
-	return &attacher{k8sClient: k8sClient, computeSvc: svc}, nil
+	return &attacher{k8sClient: k8sClient, computeSvc: svc, opts: opts}, nil
 }
 
 func ControllerInit() {
@@ -95,14 +293,46 @@ func ControllerInit() {
 	utilruntime.Must(scheme.AddToScheme(scheme.Scheme))
 }
 
-func NewManager(cfg *rest.Config, namespace, volumeTypeConfigMap string, attach Attacher, pdStorageClass string) (ctrl.Manager, error) {
+func NewManager(cfg *rest.Config, opts ManagerOptions) (ctrl.Manager, error) {
+	if opts.ProvisionerStorageClass != "" && opts.DriverName == "" {
+		return nil, fmt.Errorf("a driver name is required when a provisioner storage class is used")
+	}
+	if opts.RemovedPDPolicy == "" {
+		opts.RemovedPDPolicy = RemovedPDDelete
+	} else if opts.RemovedPDPolicy != RemovedPDDelete && opts.RemovedPDPolicy != RemovedPDRetain {
+		return nil, fmt.Errorf("unknown removed PD policy %q, expected %s or %s", opts.RemovedPDPolicy, RemovedPDDelete, RemovedPDRetain)
+	}
+	if len(opts.ZoneLabels) == 0 {
+		opts.ZoneLabels = DefaultZoneLabels
+	}
+	if opts.WebhookPort > 0 && opts.DriverName == "" {
+		return nil, fmt.Errorf("a driver name is required for the webhook")
+	}
+	nodeCache, err := nodeCacheOptions(opts.NodeSelector, opts.ScopedNodeCache)
+	if err != nil {
+		return nil, err
+	}
+	pvcCache, pvCache, err := volumeCacheOptions()
+	if err != nil {
+		return nil, err
+	}
 	mgr, err := ctrl.NewManager(cfg, ctrl.Options{
-		Scheme: scheme.Scheme,
+		Scheme:                 scheme.Scheme,
+		HealthProbeBindAddress: opts.HealthProbeAddress,
 		Cache: cache.Options{
 			DefaultNamespaces: map[string]cache.Config{
-				namespace: {},
+				opts.Namespace: {},
+			},
+			ByObject: map[client.Object]cache.ByObject{
+				&corev1.Node{}:                  nodeCache,
+				&corev1.PersistentVolumeClaim{}: pvcCache,
+				&corev1.PersistentVolume{}:      pvCache,
 			},
 		},
+		WebhookServer: webhook.NewServer(webhook.Options{
+			Port:    opts.WebhookPort,
+			CertDir: opts.WebhookCertDir,
+		}),
 	})
 	if err != nil {
 		return nil, fmt.Errorf("unable to create manager: %w", err)
@@ -112,26 +342,83 @@ func NewManager(cfg *rest.Config, namespace, volumeTypeConfigMap string, attach
 		return nil, fmt.Errorf("unable to create k8s client: %w", err)
 	}
 	rec := &reconciler{
-		Client:              mgr.GetClient(),
-		k8sClient:           k8sClient,
-		Scheme:              mgr.GetScheme(),
-		namespace:           namespace,
-		volumeTypeConfigMap: volumeTypeConfigMap,
-		pdStorageClass:      pdStorageClass,
-		attacher:            attach,
+		Client:                  mgr.GetClient(),
+		k8sClient:               k8sClient,
+		Scheme:                  mgr.GetScheme(),
+		namespace:               opts.Namespace,
+		volumeTypeConfigMap:     opts.VolumeTypeConfigMap,
+		pdStorageClass:          opts.PdStorageClass,
+		provisionerStorageClass: opts.ProvisionerStorageClass,
+		driverName:              opts.DriverName,
+		attacher:                opts.Attacher,
+		peerSeeding:             opts.PeerSeeding,
+		removedPDPolicy:         opts.RemovedPDPolicy,
+		zoneLabels:              opts.ZoneLabels,
+		apiReader:               mgr.GetAPIReader(),
+		scopedNodes:             opts.ScopedNodeCache,
+		errors:                  newReconcileErrors(),
+		recorder:                mgr.GetEventRecorderFor("node-cache-controller"),
+		mappings:                newMappingWriter(mgr.GetClient(), types.NamespacedName{Namespace: opts.Namespace, Name: opts.VolumeTypeConfigMap}, opts.MappingWriteWindow),
+	}
+	if err := mgr.Add(rec.mappings); err != nil {
+		return nil, err
+	}
+	if opts.AdminAddress != "" {
+		volumeTypeMap := types.NamespacedName{Namespace: opts.Namespace, Name: opts.VolumeTypeConfigMap}
+		if err := mgr.Add(newAdminServer(k8sClient, volumeTypeMap, opts.AdminAddress, opts.AdminCertDir, rec.errors)); err != nil {
+			return nil, err
+		}
+	}
+	if opts.Export.enabled() {
+		exporter, err := newFleetExporter(context.Background(), k8sClient, types.NamespacedName{Namespace: opts.Namespace, Name: opts.VolumeTypeConfigMap}, opts.Export)
+		if err != nil {
+			return nil, err
+		}
+		if err := mgr.Add(exporter); err != nil {
+			return nil, err
+		}
+	}
+	if opts.WebhookPort > 0 {
+		mgr.GetWebhookServer().Register(PodValidationPath, &webhook.Admission{Handler: &podValidator{
+			client:     mgr.GetClient(),
+			decoder:    admission.NewDecoder(mgr.GetScheme()),
+			driverName: opts.DriverName,
+		}})
 	}
 
-	if err := ctrl.NewControllerManagedBy(mgr).
+	nodeBuilder := ctrl.NewControllerManagedBy(mgr).
 		Named("node").
-		Watches(&corev1.Node{}, &handler.EnqueueRequestForObject{}).
-		Complete(rec); err != nil {
+		Watches(&corev1.Node{}, &handler.EnqueueRequestForObject{}, builder.WithPredicates(cacheNodePredicate(opts.NodeSelector)))
+	if rec.provisionerStorageClass != "" {
+		// Provisioned PVs are reconciled with their node, so that released volumes are made available again.
+		nodeBuilder = nodeBuilder.Watches(&corev1.PersistentVolume{}, handler.EnqueueRequestsFromMapFunc(provisionedPVToNode))
+	}
+	if err := nodeBuilder.Complete(rec); err != nil {
 		return nil, err
 	}
 	if rec.attacher != nil {
 		if err := ctrl.NewControllerManagedBy(mgr).
 			Named("pvc").
-			Watches(&corev1.PersistentVolumeClaim{}, &handler.EnqueueRequestForObject{}).
-			Complete(&pvcReconciler{rec}); err != nil {
+			Watches(&corev1.PersistentVolumeClaim{}, &handler.EnqueueRequestForObject{}, builder.WithPredicates(managedPVCPredicate())).
+			Complete(&pvcReconciler{
+				reconciler: rec,
+				backoff:    workqueue.NewItemExponentialFailureRateLimiter(pvcRetryBaseDelay, pvcRetryMaxDelay),
+			}); err != nil {
+			return nil, err
+		}
+	}
+
+	if opts.DriverDaemonSet != "" {
+		affinity, err := cacheNodeAffinity(opts.NodeSelector)
+		if err != nil {
+			return nil, err
+		}
+		if err := ctrl.NewControllerManagedBy(mgr).
+			Named("daemonset").
+			Watches(&appsv1.DaemonSet{}, &handler.EnqueueRequestForObject{}, builder.WithPredicates(predicate.NewPredicateFuncs(func(obj client.Object) bool {
+				return obj.GetNamespace() == opts.Namespace && obj.GetName() == opts.DriverDaemonSet
+			}))).
+			Complete(&daemonSetReconciler{Client: mgr.GetClient(), affinity: affinity}); err != nil {
 			return nil, err
 		}
 	}
@@ -139,107 +426,204 @@ func NewManager(cfg *rest.Config, namespace, volumeTypeConfigMap string, attach
 	if err := mgr.AddHealthzCheck("healthz", healthz.Ping); err != nil {
 		return nil, fmt.Errorf("Unable to set up health check: %w", err)
 	}
-	if err := mgr.AddReadyzCheck("readyz", healthz.Ping); err != nil {
+	ready := &readinessChecker{
+		client:        k8sClient,
+		volumeTypeMap: types.NamespacedName{Namespace: opts.Namespace, Name: opts.VolumeTypeConfigMap},
+		attacher:      opts.Attacher,
+	}
+	if err := mgr.AddReadyzCheck("readyz", ready.check); err != nil {
 		return nil, fmt.Errorf("Unable to set up ready check: %w", err)
 	}
 	return mgr, nil
 }
 
-func (r *reconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+// cacheNodePredicate passes events for nodes with the volume type label that
+// match selector. An update passes if either the old or new node is a cache
+// node, so that a node leaving the cache is still reconciled.
+func cacheNodePredicate(selector labels.Selector) predicate.Funcs {
+	if selector == nil {
+		selector = labels.Everything()
+	}
+	isCacheNode := func(obj client.Object) bool {
+		if obj == nil {
+			return false
+		}
+		nodeLabels := labels.Set(obj.GetLabels())
+		return (nodeLabels.Has(common.VolumeTypeLabel) || nodeLabels.Has(common.RemovingLabel)) && selector.Matches(nodeLabels)
+	}
+	return predicate.Funcs{
+		CreateFunc: func(e event.CreateEvent) bool {
+			return isCacheNode(e.Object)
+		},
+		UpdateFunc: func(e event.UpdateEvent) bool {
+			return isCacheNode(e.ObjectOld) || isCacheNode(e.ObjectNew)
+		},
+		DeleteFunc: func(e event.DeleteEvent) bool {
+			return isCacheNode(e.Object)
+		},
+		GenericFunc: func(e event.GenericEvent) bool {
+			return isCacheNode(e.Object)
+		},
+	}
+}
+
+func (r *reconciler) Reconcile(ctx context.Context, req ctrl.Request) (_ ctrl.Result, err error) {
 	log := log.FromContext(ctx)
+	defer func() {
+		r.errors.record(req.Name, err, time.Now())
+	}()
 
 	var node corev1.Node
-	if err := r.Get(ctx, req.NamespacedName, &node); err != nil {
+	if err := r.getNode(ctx, req.NamespacedName.Name, &node); err != nil {
 		log.Error(err, "get node for reconcile", "node", req.NamespacedName.Name)
 		r.deleteOrphanedPDs(ctx)
+		if apierrors.IsNotFound(err) {
+			if err := r.deleteProvisionedPV(ctx, req.NamespacedName.Name); err != nil {
+				return ctrl.Result{}, err
+			}
+		}
 		return ctrl.Result{}, nil
 	}
 
 	if node.DeletionTimestamp != nil {
 		r.deleteOrphanedPDs(ctx)
 		// TODO: clean up old mappings?
-		return ctrl.Result{}, nil
-	}
-
-	mustCreateMapping := false
-	var mapping map[string]volumeTypeInfo
-	var configMap corev1.ConfigMap
-	err := r.Get(ctx, types.NamespacedName{Namespace: r.namespace, Name: r.volumeTypeConfigMap}, &configMap)
-	if apierrors.IsNotFound(err) {
-		mustCreateMapping = true
-		configMap.SetNamespace(r.namespace)
-		configMap.SetName(r.volumeTypeConfigMap)
-		mapping = map[string]volumeTypeInfo{}
-	} else if err == nil {
-		if mapping, err = getVolumeTypeMapping(configMap.Data); err != nil {
-			log.Error(err, "bad mapping (ignored, mapping recreated)")
-			mapping = map[string]volumeTypeInfo{}
-		}
-	} else {
-		log.Error(err, "get mapping", "mapping", fmt.Sprintf("%s/%s", r.namespace, r.volumeTypeConfigMap))
-		return ctrl.Result{}, nil
-	}
-
-	if configMap.Data == nil {
-		configMap.Data = map[string]string{}
+		return ctrl.Result{}, r.deleteProvisionedPV(ctx, node.GetName())
 	}
 
 	info, err := getVolumeTypeFromNode(&node)
 	if err != nil && strings.Contains(err.Error(), "label not found on node") {
-		log.Info("skipping non-cache node", "node", node.GetName())
-		return ctrl.Result{}, nil
+		return r.reconcileRemoval(ctx, &node)
 	} else if err != nil {
 		return ctrl.Result{}, err
 	}
+	if _, removing := node.GetLabels()[common.RemovingLabel]; removing {
+		// The label was restored before the removal finished. The cache is
+		// recreated as after maintenance.
+		log.Info("cache label restored, cancelling removal", "node", node.GetName())
+		if err := r.setRemoving(ctx, &node, false); err != nil {
+			return ctrl.Result{}, err
+		}
+	}
+
+	if err := validateCapacity(&node, info); err != nil {
+		// The entry is written as invalid, so that the driver fails
+		// publishes with the reason rather than creating a cache that
+		// doesn't fit.
+		r.setInvalid(ctx, &node, info, capacityExceededReason, err)
+		return ctrl.Result{}, nil
+	}
 
-	if info.VolumeType == pdVolumeType {
+	if usesPD(info.VolumeType) {
 		if r.pdStorageClass == "" {
 			return ctrl.Result{}, fmt.Errorf("No PD storage class has been defined, PD volumes can't be used")
 		}
-		if err := r.updatePdVolumeType(ctx, node.GetName(), &info); err != nil {
+		if err := r.validateStorageClass(ctx, info.StorageClass); errors.Is(err, errInvalidStorageClass) {
+			r.setInvalid(ctx, &node, info, invalidStorageClassReason, err)
+			return ctrl.Result{}, nil
+		} else if err != nil {
+			return ctrl.Result{}, err
+		}
+		if err := r.updatePdVolumeType(ctx, &node, &info); err != nil {
 			return ctrl.Result{}, err
 		}
 	}
 
-	mapping[node.GetName()] = info
-	if err := writeVolumeTypeMapping(configMap.Data, mapping); err != nil {
-		log.Error(err, "write mapping", "node", node.GetName())
+	r.mappings.setNode(node.GetName(), info)
+	log.Info("update", "node", node.GetName(), "info", info)
+
+	if err := r.ensureProvisionedPV(ctx, node.GetName(), info); err != nil {
+		log.Error(err, "provisioned pv", "node", node.GetName())
 		return ctrl.Result{}, err
+	}
 
+	if err := r.reconcileMaintenance(ctx, &node, info); err != nil {
+		log.Error(err, "maintenance", "node", node.GetName())
+		return ctrl.Result{}, err
 	}
-	if mustCreateMapping {
-		if err := r.Create(ctx, &configMap); err != nil {
-			log.Error(err, "create configmap")
-			return ctrl.Result{}, err // requeue
-		}
-	} else {
-		if err := r.Update(ctx, &configMap); err != nil {
-			log.Error(err, "update configmap")
-			return ctrl.Result{}, err // requeue
+
+	if r.peerSeeding {
+		if err := r.reconcileSeedDonor(ctx, &node, info); err != nil {
+			log.Error(err, "seed donor", "node", node.GetName())
+			return ctrl.Result{}, err
 		}
 	}
-	log.Info("update", "node", node.GetName(), "info", info)
+
+	if err := r.updateCacheCondition(ctx, &node, info); err != nil {
+		log.Error(err, "cache condition", "node", node.GetName())
+		return ctrl.Result{}, err
+	}
 
 	return ctrl.Result{}, nil
 }
 
-func (r *reconciler) updatePdVolumeType(ctx context.Context, node string, info *volumeTypeInfo) error {
-	if info.VolumeType != pdVolumeType {
+// setInvalid writes the entry of node as invalid because of err, and reports
+// it as a warning event with reason.
+func (r *reconciler) setInvalid(ctx context.Context, node *corev1.Node, info volumeTypeInfo, reason string, err error) {
+	info.Invalid = err.Error()
+	r.mappings.setNode(node.GetName(), info)
+	log.FromContext(ctx).Info("invalid cache", "node", node.GetName(), "reason", reason, "error", err)
+	if r.recorder != nil {
+		r.recorder.Event(node, corev1.EventTypeWarning, reason, err.Error())
+	}
+}
+
+// errInvalidStorageClass is wrapped by errors of storage classes that can't
+// be used for PD caches.
+var errInvalidStorageClass = errors.New("invalid storage class")
+
+// validateStorageClass checks that the storage class of a node's annotation
+// exists and provisions PDs. The default class is not checked.
+func (r *reconciler) validateStorageClass(ctx context.Context, className string) error {
+	if className == "" {
 		return nil
 	}
+	class, err := r.k8sClient.StorageV1().StorageClasses().Get(ctx, className, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return fmt.Errorf("%w: %s not found", errInvalidStorageClass, className)
+	} else if err != nil {
+		return fmt.Errorf("Could not get storage class %s: %w", className, err)
+	}
+	if class.Provisioner != pdProvisioner {
+		return fmt.Errorf("%w: %s has provisioner %s, not %s", errInvalidStorageClass, className, class.Provisioner, pdProvisioner)
+	}
+	return nil
+}
+
+func (r *reconciler) updatePdVolumeType(ctx context.Context, node *corev1.Node, info *volumeTypeInfo) error {
+	if !usesPD(info.VolumeType) {
+		return nil
+	}
+
+	if _, found := node.GetAnnotations()[common.ExistingDiskAnnotation]; found {
+		return r.useExistingDisk(ctx, node, info)
+	}
 
 	if info.Size.IsZero() {
-		return fmt.Errorf("no size given for PD cache on node %s", node)
+		return fmt.Errorf("no size given for PD cache on node %s", node.GetName())
+	}
+
+	if info.StorageClass == "" {
+		info.StorageClass = r.pdStorageClass
 	}
 
 	var pvc corev1.PersistentVolumeClaim
 	needCreate := false
-	err := r.Get(ctx, types.NamespacedName{Namespace: r.namespace, Name: node}, &pvc)
+	err := r.getPVC(ctx, node.GetName(), &pvc)
+	if err == nil && pvc.Spec.StorageClassName != nil && *pvc.Spec.StorageClassName != info.StorageClass {
+		// The class of a PVC can't be changed. The existing PD is kept until
+		// the PVC is deleted, such as by changing the cache type.
+		log.FromContext(ctx).Info("storage class changed, keeping existing PD", "node", node.GetName(), "pvc", *pvc.Spec.StorageClassName, "class", info.StorageClass)
+		info.StorageClass = *pvc.Spec.StorageClassName
+	}
 	if apierrors.IsNotFound(err) {
 		needCreate = true
-		pvc.SetName(node)
+		pvc.SetName(node.GetName())
 		pvc.SetNamespace(r.namespace)
-		pvc.Spec.StorageClassName = ptr.To(r.pdStorageClass)
+		// Provisioners place the volume in the topology of the selected node,
+		// even with immediate binding, so the PD is always in the node's zone.
+		pvc.SetAnnotations(map[string]string{selectedNodeAnnotation: node.GetName()})
+		pvc.Spec.StorageClassName = ptr.To(info.StorageClass)
 		pvc.Spec.VolumeMode = ptr.To(corev1.PersistentVolumeBlock)
 		pvc.Spec.AccessModes = []corev1.PersistentVolumeAccessMode{corev1.ReadWriteOnce}
 		pvc.Spec.Resources.Requests = map[corev1.ResourceName]resource.Quantity{
@@ -249,10 +633,42 @@ func (r *reconciler) updatePdVolumeType(ctx context.Context, node string, info *
 		info.Disk = pvc.Spec.VolumeName
 	}
 
-	return r.updatePVCForLifecycle(ctx, &pvc, needCreate)
+	return r.updatePVCForLifecycle(ctx, node, &pvc, needCreate)
+}
+
+// useExistingDisk verifies and attaches the disk given by the existing disk
+// annotation on node. No PVC is created, and the disk is never deleted.
+func (r *reconciler) useExistingDisk(ctx context.Context, node *corev1.Node, info *volumeTypeInfo) error {
+	if r.attacher == nil {
+		return fmt.Errorf("No attacher, existing disks can't be used")
+	}
+	volume := node.GetAnnotations()[common.ExistingDiskAnnotation]
+	vol, err := parseVolumeHandle(volume)
+	if err != nil {
+		return fmt.Errorf("Bad existing disk on node %s: %w", node.GetName(), err)
+	}
+	if err := r.attacher.verifyDisk(ctx, volume, node.GetName()); err != nil {
+		return fmt.Errorf("Existing disk %s can't be used by %s: %w", volume, node.GetName(), err)
+	}
+	info.Disk = vol.name
+	if inMaintenance(node) {
+		// The disk is detached and reattached by reconcileMaintenance.
+		return nil
+	}
+	attached, err := r.attacher.diskIsAttached(ctx, volume, node.GetName())
+	if err != nil {
+		return fmt.Errorf("Could not check attachment of %s: %w", volume, err)
+	}
+	if !attached {
+		if err := r.attacher.attachDisk(ctx, volume, node.GetName()); err != nil {
+			return err
+		}
+		log.FromContext(ctx).Info("attached existing disk", "node", node.GetName(), "disk", volume)
+	}
+	return nil
 }
 
-func (r *reconciler) updatePVCForLifecycle(ctx context.Context, pvc *corev1.PersistentVolumeClaim, needCreate bool) error {
+func (r *reconciler) updatePVCForLifecycle(ctx context.Context, node *corev1.Node, pvc *corev1.PersistentVolumeClaim, needCreate bool) error {
 	found := false
 	for _, finalizer := range pvc.Finalizers {
 		if finalizer == finalizerLabel {
@@ -267,6 +683,27 @@ func (r *reconciler) updatePVCForLifecycle(ctx context.Context, pvc *corev1.Pers
 		changed = true
 		pvc.Finalizers = append(pvc.Finalizers, finalizerLabel)
 	}
+	// PVCs created before the label was introduced are labeled here.
+	if !isManagedPVC(pvc) {
+		changed = true
+		if pvc.Labels == nil {
+			pvc.Labels = map[string]string{}
+		}
+		pvc.Labels[managedByLabel] = managedByValue
+	}
+	if pvc.Labels[cacheNodeLabel] != node.GetName() {
+		changed = true
+		if pvc.Labels == nil {
+			pvc.Labels = map[string]string{}
+		}
+		pvc.Labels[cacheNodeLabel] = node.GetName()
+	}
+	if !slices.ContainsFunc(pvc.OwnerReferences, func(ref metav1.OwnerReference) bool { return ref.UID == node.GetUID() }) {
+		changed = true
+		if err := controllerutil.SetOwnerReference(node, pvc, r.Scheme); err != nil {
+			return err
+		}
+	}
 	if needCreate {
 		if err := r.Create(ctx, pvc); err != nil {
 			return err
@@ -282,31 +719,44 @@ func (r *reconciler) updatePVCForLifecycle(ctx context.Context, pvc *corev1.Pers
 func (r *pvcReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
 	log := log.FromContext(ctx)
 
-	pvcName := req.NamespacedName.Name
+	var pvc corev1.PersistentVolumeClaim
+	if err := r.Get(ctx, req.NamespacedName, &pvc); apierrors.IsNotFound(err) {
+		r.backoff.Forget(req)
+		return ctrl.Result{}, nil
+	} else if err != nil {
+		return ctrl.Result{}, fmt.Errorf("reconciling %s: %w", req.NamespacedName, err)
+	}
+	nodeName := pvcNode(&pvc)
+
+	// retry records a transient failure on the PVC and requeues it with an
+	// exponential backoff, so that a missing map or a failing attach does not
+	// spin.
+	retry := func(state string, err error) (ctrl.Result, error) {
+		delay := r.backoff.When(req)
+		log.Info("PVC reconcile will be retried", "pvc", pvc.GetName(), "node", nodeName, "state", state, "after", delay, "error", err)
+		if err := r.setAttachStatus(ctx, &pvc, state, err); err != nil {
+			log.Error(err, "can't record attach status", "pvc", pvc.GetName())
+		}
+		return ctrl.Result{RequeueAfter: delay}, nil
+	}
 
 	var configMap corev1.ConfigMap
 	err := r.Get(ctx, types.NamespacedName{Namespace: r.namespace, Name: r.volumeTypeConfigMap}, &configMap)
 	if err != nil {
-		log.Info("PVC reconcile before mapping available", "pvc", pvcName, "error", err)
-		return ctrl.Result{Requeue: true}, nil
+		return retry(common.AttachWaitingForMapping, fmt.Errorf("volume type map not available: %w", err))
 	}
 	mapping, err := getVolumeTypeMapping(configMap.Data)
 	if err != nil {
 		return ctrl.Result{}, err
 	}
 
-	info, found := mapping[pvcName]
+	info, found := mapping[nodeName]
 	if !found {
-		return ctrl.Result{}, fmt.Errorf("Unknown node or pvc %s", pvcName)
-	}
-
-	var pvc corev1.PersistentVolumeClaim
-	if err := r.Get(ctx, req.NamespacedName, &pvc); err != nil {
-		return ctrl.Result{}, fmt.Errorf("reconciling %s: %w", req.NamespacedName, err)
+		return retry(common.AttachWaitingForMapping, fmt.Errorf("Unknown node or pvc %s", nodeName))
 	}
 
 	var node corev1.Node
-	if err := r.Get(ctx, types.NamespacedName{Name: pvcName}, &node); err != nil {
+	if err := r.getNode(ctx, nodeName, &node); err != nil {
 		if apierrors.IsNotFound(err) {
 			node.DeletionTimestamp = &metav1.Time{Time: time.Now()}
 		} else {
@@ -315,48 +765,248 @@ func (r *pvcReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.R
 	}
 	if node.DeletionTimestamp != nil {
 		// The node doesn't exist, the PVC should be deleted.
+		r.backoff.Forget(req)
 		return ctrl.Result{}, r.deletePVC(ctx, &pvc)
 	}
 
-	mustRequeue := false
-
 	// Update the mapping with the PV name, if known.
 	if pvc.Status.Phase == corev1.ClaimBound && info.Disk != pvc.Spec.VolumeName {
 		if info.Disk != "" && info.Disk != pvc.Spec.VolumeName {
 			log.Error(nil, "pv mapping mismatch, will update", "old-disk", info.Disk, "curr-diisk", pvc.Spec.VolumeName)
 		}
-		info.Disk = pvc.Spec.VolumeName
-		mapping[pvcName] = info
-		if err := writeVolumeTypeMapping(configMap.Data, mapping); err != nil {
-			return ctrl.Result{}, err
-		}
-		if err := r.Update(ctx, &configMap); err != nil {
-			log.Error(err, "mapping update, will requeue")
-			mustRequeue = true
-		}
+		r.mappings.setDisk(nodeName, pvc.Spec.VolumeName)
 	}
 
-	// If the PVC is bound but not attached, attach it.
-	if pvc.Status.Phase == corev1.ClaimBound {
+	// If the PVC is bound but not attached, attach it. During maintenance the
+	// node reconciler detaches and reattaches the PD instead.
+	state := common.AttachWaitingForBind
+	if pvc.Status.Phase == corev1.ClaimBound && inMaintenance(&node) {
+		state = common.AttachDeferred
+	} else if pvc.Status.Phase == corev1.ClaimBound {
 		var pv corev1.PersistentVolume
-		if err := r.Get(ctx, types.NamespacedName{Name: pvc.Spec.VolumeName}, &pv); err != nil {
-			return ctrl.Result{}, fmt.Errorf("Can't get volume for pvc %s: %w", pvc.GetName(), err)
+		if err := r.getPV(ctx, pvc.Spec.VolumeName, &pv); err != nil {
+			return retry(common.AttachAttaching, fmt.Errorf("Can't get volume for pvc %s: %w", pvc.GetName(), err))
+		}
+		// A disk in the wrong zone can never be attached, so fail now rather
+		// than waiting for the attach operation to time out.
+		if err := checkPVZone(&pv, nodeZone(&node, r.zoneLabels)); err != nil {
+			r.backoff.Forget(req)
+			if err := r.setAttachStatus(ctx, &pvc, common.AttachZoneMismatch, err); err != nil {
+				log.Error(err, "can't record attach status", "pvc", pvc.GetName())
+			}
+			return ctrl.Result{}, reconcile.TerminalError(fmt.Errorf("pv %s can't be attached to node %s: %w", pv.GetName(), nodeName, err))
 		}
 		attached, err := r.attacher.diskIsAttached(ctx, pv.Spec.CSI.VolumeHandle, node.GetName())
 		if err != nil {
-			return ctrl.Result{}, fmt.Errorf("Could not check attachment for pvc %s, pv %s: %w", pvc.GetName(), pv.GetName(), err)
+			return retry(common.AttachAttaching, fmt.Errorf("Could not check attachment for pvc %s, pv %s: %w", pvc.GetName(), pv.GetName(), err))
 		}
 		if !attached {
 			if err := r.attacher.attachDisk(ctx, pv.Spec.CSI.VolumeHandle, node.GetName()); err != nil {
-				return ctrl.Result{}, fmt.Errorf("Could not attach pv %s to node %s: %w", pv.GetName(), pvc.GetName(), err)
+				state := common.AttachAttaching
+				if errors.Is(err, ErrAttachTimeout) {
+					state = common.AttachTimedOut
+				}
+				return retry(state, fmt.Errorf("Could not attach pv %s to node %s: %w", pv.GetName(), pvc.GetName(), err))
 			}
 			log.Info("attach", "pvc", pvc.GetName())
 		}
+		if err := r.detachStaleDisks(ctx, &pvc, node.GetName(), pv.Spec.CSI.VolumeHandle); err != nil {
+			return retry(common.AttachAttached, fmt.Errorf("Could not detach stale disks from node %s: %w", nodeName, err))
+		}
+		state = common.AttachAttached
+	}
+	r.backoff.Forget(req)
+	if err := r.setAttachStatus(ctx, &pvc, state, nil); err != nil {
+		return ctrl.Result{}, err
 	}
 
 	// Otherwise everything looks good.
-	log.Info("reconciled, looks good", "pvc", req.NamespacedName)
-	return ctrl.Result{Requeue: mustRequeue}, nil
+	log.Info("reconciled, looks good", "pvc", req.NamespacedName, "state", state)
+	return ctrl.Result{}, nil
+}
+
+// detachStaleDisks detaches the disks of earlier claims of pvc that are still
+// attached to its node, such as the PD of a cache whose PVC was deleted and
+// recreated. current is the disk of pvc, which is kept.
+func (r *pvcReconciler) detachStaleDisks(ctx context.Context, pvc *corev1.PersistentVolumeClaim, nodeName, current string) error {
+	attached, err := r.attacher.listAttachedCacheDisks(ctx, nodeName)
+	if err != nil {
+		return err
+	}
+	var pvs corev1.PersistentVolumeList
+	if err := r.List(ctx, &pvs); err != nil {
+		return err
+	}
+	for _, volume := range staleCacheDisks(pvc, attached, pvs.Items) {
+		if volume == current {
+			continue
+		}
+		if err := r.attacher.detachDisk(ctx, volume, nodeName); err != nil {
+			return err
+		}
+		log.FromContext(ctx).Info("detached stale disk", "pvc", pvc.GetName(), "node", nodeName, "volume", volume)
+	}
+	return nil
+}
+
+// staleCacheDisks returns the volumes in attached whose PVs were claimed by an
+// earlier PVC of the same name as pvc. Other disks, such as those attached by
+// the PD CSI driver, are never returned.
+func staleCacheDisks(pvc *corev1.PersistentVolumeClaim, attached []string, pvs []corev1.PersistentVolume) []string {
+	var stale []string
+	for _, pv := range pvs {
+		ref := pv.Spec.ClaimRef
+		if pv.Spec.CSI == nil || ref == nil || ref.Namespace != pvc.GetNamespace() || ref.Name != pvc.GetName() || ref.UID == pvc.GetUID() {
+			continue
+		}
+		if slices.Contains(attached, pv.Spec.CSI.VolumeHandle) {
+			stale = append(stale, pv.Spec.CSI.VolumeHandle)
+		}
+	}
+	return stale
+}
+
+// setAttachStatus records the attach state and last error on pvc, if they
+// have changed.
+func (r *pvcReconciler) setAttachStatus(ctx context.Context, pvc *corev1.PersistentVolumeClaim, state string, attachErr error) error {
+	patch := client.MergeFrom(pvc.DeepCopy())
+	if !updateAttachAnnotations(pvc, state, attachErr) {
+		return nil
+	}
+	if err := r.Patch(ctx, pvc, patch); err != nil {
+		return fmt.Errorf("Could not set attach state of pvc %s to %q: %w", pvc.GetName(), state, err)
+	}
+	return nil
+}
+
+// updateAttachAnnotations sets the attach annotations of pvc, returning true
+// if they were changed.
+func updateAttachAnnotations(pvc *corev1.PersistentVolumeClaim, state string, attachErr error) bool {
+	annotations := pvc.GetAnnotations()
+	if annotations == nil {
+		annotations = map[string]string{}
+	}
+	changed := false
+	if annotations[common.AttachStateAnnotation] != state {
+		annotations[common.AttachStateAnnotation] = state
+		changed = true
+	}
+	if attachErr == nil {
+		if _, found := annotations[common.AttachErrorAnnotation]; found {
+			delete(annotations, common.AttachErrorAnnotation)
+			changed = true
+		}
+	} else if annotations[common.AttachErrorAnnotation] != attachErr.Error() {
+		annotations[common.AttachErrorAnnotation] = attachErr.Error()
+		changed = true
+	}
+	pvc.SetAnnotations(annotations)
+	return changed
+}
+
+// managedPVCPredicate passes events for the PVCs created by the controller,
+// except for updates that only change the attach annotations. Those are made
+// by the PVC reconciler itself, and reconciling them would skip the backoff of
+// a retried attach.
+func managedPVCPredicate() predicate.Funcs {
+	pred := predicate.NewPredicateFuncs(isManagedPVC)
+	pred.UpdateFunc = func(e event.UpdateEvent) bool {
+		if e.ObjectOld == nil || e.ObjectNew == nil || !isManagedPVC(e.ObjectNew) {
+			return false
+		}
+		return !onlyAttachAnnotationsChanged(e.ObjectOld, e.ObjectNew)
+	}
+	return pred
+}
+
+// onlyAttachAnnotationsChanged returns true if the only differences between
+// oldObj and newObj, other than their resource versions and managed fields, are in
+// the attach annotations.
+func onlyAttachAnnotationsChanged(oldObj, newObj client.Object) bool {
+	strip := func(obj client.Object) client.Object {
+		obj = obj.DeepCopyObject().(client.Object)
+		obj.SetResourceVersion("")
+		obj.SetManagedFields(nil)
+		annotations := obj.GetAnnotations()
+		delete(annotations, common.AttachStateAnnotation)
+		delete(annotations, common.AttachErrorAnnotation)
+		if len(annotations) == 0 {
+			annotations = nil
+		}
+		obj.SetAnnotations(annotations)
+		return obj
+	}
+	return equality.Semantic.DeepEqual(strip(oldObj), strip(newObj))
+}
+
+// isManagedPVC returns true if obj is a PVC created by the controller.
+func isManagedPVC(obj client.Object) bool {
+	return obj.GetLabels()[managedByLabel] == managedByValue
+}
+
+// pvcNode returns the node of a PD cache PVC. PVCs are named after their node,
+// which is used if the link label hasn't been set yet.
+func pvcNode(pvc *corev1.PersistentVolumeClaim) string {
+	if node, found := pvc.GetLabels()[cacheNodeLabel]; found {
+		return node
+	}
+	return pvc.GetName()
+}
+
+// nodeZone returns the zone of node from the first of zoneLabels it has, or
+// from its provider ID on GCE. It is empty if the zone is not known.
+func nodeZone(node *corev1.Node, zoneLabels []string) string {
+	for _, label := range zoneLabels {
+		if zone := node.GetLabels()[label]; zone != "" {
+			return zone
+		}
+	}
+	_, zone, _ := parseProviderID(node.Spec.ProviderID)
+	return zone
+}
+
+// parseProviderID returns the project and zone of a GCE node from its provider
+// ID. found is false for other providers.
+func parseProviderID(id string) (project, zone string, found bool) {
+	id, found = strings.CutPrefix(id, gceProviderPrefix)
+	if !found {
+		return "", "", false
+	}
+	parts := strings.Split(id, "/")
+	if len(parts) != 3 {
+		return "", "", false
+	}
+	return parts[0], parts[1], true
+}
+
+// checkPVZone returns an error if the PD of pv is not in nodeZone. The zone of
+// the PV is taken from its node affinity, or from the volume handle if there
+// is none. No check is made if the node zone is not known.
+func checkPVZone(pv *corev1.PersistentVolume, nodeZone string) error {
+	if nodeZone == "" {
+		return nil
+	}
+	zones := []string{}
+	if pv.Spec.NodeAffinity != nil && pv.Spec.NodeAffinity.Required != nil {
+		for _, term := range pv.Spec.NodeAffinity.Required.NodeSelectorTerms {
+			for _, req := range term.MatchExpressions {
+				if (req.Key == zoneLabel || req.Key == corev1.LabelTopologyZone) && req.Operator == corev1.NodeSelectorOpIn {
+					zones = append(zones, req.Values...)
+				}
+			}
+		}
+	}
+	if len(zones) == 0 && pv.Spec.CSI != nil {
+		// Regional disks have no zone in their handle, and are only checked
+		// by their node affinity.
+		if vol, err := parseVolumeHandle(pv.Spec.CSI.VolumeHandle); err == nil && vol.zone != "" {
+			zones = append(zones, vol.zone)
+		}
+	}
+	if len(zones) == 0 || slices.Contains(zones, nodeZone) {
+		return nil
+	}
+	return fmt.Errorf("disk is in zone %s but node is in %s", strings.Join(zones, ","), nodeZone)
 }
 
 func (r *reconciler) deletePVC(ctx context.Context, pvc *corev1.PersistentVolumeClaim) error {
@@ -395,7 +1045,21 @@ func (r *reconciler) deleteOrphanedPDs(ctx context.Context) error {
 		}
 	}
 	for _, pvc := range pvcs.Items {
-		if _, found := knownNodes[pvc.GetName()]; !found {
+		// Unlabeled PVCs with the finalizer predate the managed-by label.
+		if !isManagedPVC(&pvc) && !slices.Contains(pvc.Finalizers, finalizerLabel) {
+			continue
+		}
+		if _, found := knownNodes[pvcNode(&pvc)]; !found {
+			if r.scopedNodes {
+				// The node may be missing from a scoped cache while its
+				// cache is being removed.
+				var node corev1.Node
+				if err := r.apiReader.Get(ctx, types.NamespacedName{Name: pvcNode(&pvc)}, &node); err == nil && node.DeletionTimestamp == nil {
+					continue
+				} else if err != nil && !apierrors.IsNotFound(err) {
+					return err
+				}
+			}
 			if err := r.deletePVC(ctx, &pvc); err != nil {
 				return err
 			}
@@ -404,6 +1068,89 @@ func (r *reconciler) deleteOrphanedPDs(ctx context.Context) error {
 	return nil
 }
 
+// instanceProject returns the project of the instances vol is attached to.
+func (a *attacher) instanceProject(vol volumeHandle) string {
+	if a.opts.Project != "" {
+		return a.opts.Project
+	}
+	return vol.project
+}
+
+// checkAccess lists a disk in the project of the instances, which needs the
+// same permissions as attaching one.
+func (a *attacher) checkAccess(ctx context.Context) error {
+	if a.opts.Project == "" {
+		return fmt.Errorf("No project configured or found in metadata")
+	}
+	if _, err := a.computeSvc.Disks.AggregatedList(a.opts.Project).MaxResults(1).Context(ctx).Do(); err != nil {
+		return fmt.Errorf("Could not list disks in %s: %w", a.opts.Project, err)
+	}
+	return nil
+}
+
+func (a *attacher) verifyDisk(ctx context.Context, volume, nodeName string) error {
+	vol, err := parseVolumeHandle(volume)
+	if err != nil {
+		return err
+	}
+
+	var node corev1.Node
+	if err := a.k8sClient.Get(ctx, types.NamespacedName{Name: nodeName}, &node); err != nil {
+		return err
+	}
+	zone := nodeZone(&node, a.opts.ZoneLabels)
+
+	var users []string
+	if vol.region != "" {
+		disk, err := a.computeSvc.RegionDisks.Get(vol.project, vol.region, vol.name).Context(ctx).Do()
+		if err != nil {
+			return err
+		}
+		replicas := []string{}
+		for _, replica := range disk.ReplicaZones {
+			replicas = append(replicas, lastPathElement(replica))
+		}
+		if !slices.Contains(replicas, zone) {
+			return fmt.Errorf("disk is replicated in zones %s but node is in %q", strings.Join(replicas, ","), zone)
+		}
+		users = disk.Users
+	} else {
+		if zone != vol.zone {
+			return fmt.Errorf("disk is in zone %s but node is in %q", vol.zone, zone)
+		}
+		disk, err := a.computeSvc.Disks.Get(vol.project, vol.zone, vol.name).Context(ctx).Do()
+		if err != nil {
+			return err
+		}
+		users = disk.Users
+	}
+	for _, user := range users {
+		// Users are instance URLs, ending with the instance name.
+		if instance := lastPathElement(user); instance != nodeName {
+			return fmt.Errorf("disk is in use by %s", instance)
+		}
+	}
+	return nil
+}
+
+// instanceZone returns the zone of the instance of nodeName, to attach vol to.
+// This is the zone of a zonal disk, and the zone of the node for a regional
+// one.
+func (a *attacher) instanceZone(ctx context.Context, vol volumeHandle, nodeName string) (string, error) {
+	if vol.zone != "" {
+		return vol.zone, nil
+	}
+	var node corev1.Node
+	if err := a.k8sClient.Get(ctx, types.NamespacedName{Name: nodeName}, &node); err != nil {
+		return "", err
+	}
+	zone := nodeZone(&node, a.opts.ZoneLabels)
+	if zone == "" {
+		return "", fmt.Errorf("No zone found for node %s in labels %v or provider ID", nodeName, a.opts.ZoneLabels)
+	}
+	return zone, nil
+}
+
 func (a *attacher) diskIsAttached(ctx context.Context, volume, nodeName string) (bool, error) {
 	vol, err := parseVolumeHandle(volume)
 	if err != nil {
@@ -414,12 +1161,12 @@ func (a *attacher) diskIsAttached(ctx context.Context, volume, nodeName string)
 	if err := a.k8sClient.Get(ctx, types.NamespacedName{Name: nodeName}, &node); err != nil {
 		return false, err
 	}
-	zone, found := node.GetLabels()[zoneLabel]
-	if !found {
-		return false, fmt.Errorf("No zone found for node %s", nodeName)
+	zone := nodeZone(&node, a.opts.ZoneLabels)
+	if zone == "" {
+		return false, fmt.Errorf("No zone found for node %s in labels %v or provider ID", nodeName, a.opts.ZoneLabels)
 	}
 
-	instance, err := a.computeSvc.Instances.Get(vol.project, zone, nodeName).Context(ctx).Do()
+	instance, err := a.computeSvc.Instances.Get(a.instanceProject(vol), zone, nodeName).Context(ctx).Do()
 	if err != nil {
 		return false, err
 	}
@@ -431,24 +1178,104 @@ func (a *attacher) diskIsAttached(ctx context.Context, volume, nodeName string)
 	return false, nil
 }
 
+func (a *attacher) listAttachedCacheDisks(ctx context.Context, nodeName string) ([]string, error) {
+	var node corev1.Node
+	if err := a.k8sClient.Get(ctx, types.NamespacedName{Name: nodeName}, &node); err != nil {
+		return nil, err
+	}
+	zone := nodeZone(&node, a.opts.ZoneLabels)
+	if zone == "" {
+		return nil, fmt.Errorf("No zone found for node %s in labels %v or provider ID", nodeName, a.opts.ZoneLabels)
+	}
+	project := a.opts.Project
+	if project == "" {
+		if project, _, _ = parseProviderID(node.Spec.ProviderID); project == "" {
+			return nil, fmt.Errorf("No project configured or found in the provider ID of node %s", nodeName)
+		}
+	}
+
+	instance, err := a.computeSvc.Instances.Get(project, zone, nodeName).Context(ctx).Do()
+	if err != nil {
+		return nil, err
+	}
+	return cacheDisks(instance), nil
+}
+
+// cacheDisks returns the volume handles of the disks of instance that may be
+// caches, as in listAttachedCacheDisks.
+func cacheDisks(instance *compute.Instance) []string {
+	var volumes []string
+	for _, disk := range instance.Disks {
+		if disk.Boot || disk.Type != "PERSISTENT" {
+			continue
+		}
+		vol, err := parseVolumeHandle(disk.Source)
+		if err != nil || vol.name != disk.DeviceName {
+			continue
+		}
+		volumes = append(volumes, vol.String())
+	}
+	return volumes
+}
+
 func (a *attacher) attachDisk(ctx context.Context, volume, nodeName string) error {
 	vol, err := parseVolumeHandle(volume)
 	if err != nil {
 		return err
 	}
 
+	if err := fault.Check(fault.Attach); err != nil {
+		return fmt.Errorf("could not attach %s to %s: %w (%w)", volume, nodeName, ErrAttachTimeout, err)
+	}
+
+	zone, err := a.instanceZone(ctx, vol, nodeName)
+	if err != nil {
+		return err
+	}
 	attach := &compute.AttachedDisk{
 		DeviceName: vol.name,
-		Source:     sourceFromVolumeHandle(volume),
+		Source:     vol.sourceURL(),
 		Mode:       "READ_WRITE",
 		Type:       "PERSISTENT",
 	}
-	op, err := a.computeSvc.Instances.AttachDisk(vol.project, vol.zone, nodeName, attach).Context(ctx).Do()
+	project := a.instanceProject(vol)
+	op, err := a.computeSvc.Instances.AttachDisk(project, zone, nodeName, attach).Context(ctx).Do()
+	if err != nil {
+		return err
+	}
+	if err := a.waitForOperation(ctx, project, zone, op, a.opts.AttachTimeout, ErrAttachTimeout); err != nil {
+		return fmt.Errorf("could not attach %s to %s: %w", volume, nodeName, err)
+	}
+	return nil
+}
+
+func (a *attacher) detachDisk(ctx context.Context, volume, nodeName string) error {
+	vol, err := parseVolumeHandle(volume)
+	if err != nil {
+		return err
+	}
+	zone, err := a.instanceZone(ctx, vol, nodeName)
+	if err != nil {
+		return err
+	}
+	project := a.instanceProject(vol)
+	op, err := a.computeSvc.Instances.DetachDisk(project, zone, nodeName, vol.name).Context(ctx).Do()
 	if err != nil {
 		return err
 	}
-	err = wait.PollUntilContextTimeout(ctx, 5*time.Second, 2*time.Minute, true, func(ctx context.Context) (bool, error) {
-		pollOp, err := a.computeSvc.ZoneOperations.Get(vol.project, vol.zone, op.Name).Context(ctx).Do()
+	if err := a.waitForOperation(ctx, project, zone, op, a.opts.DetachTimeout, ErrDetachTimeout); err != nil {
+		return fmt.Errorf("could not detach %s from %s: %w", volume, nodeName, err)
+	}
+	return nil
+}
+
+// waitForOperation waits for a zonal operation to be done. If it is not
+// done within timeout, the error wraps timeoutErr. The wait API returns as soon
+// as the operation is done, but may also return before then, in which case it
+// is called again after the poll interval.
+func (a *attacher) waitForOperation(ctx context.Context, project, zone string, op *compute.Operation, timeout time.Duration, timeoutErr error) error {
+	err := wait.PollUntilContextTimeout(ctx, a.opts.PollInterval, timeout, true, func(ctx context.Context) (bool, error) {
+		pollOp, err := a.computeSvc.ZoneOperations.Wait(project, zone, op.Name).Context(ctx).Do()
 		if err != nil {
 			return false, err
 		}
@@ -458,31 +1285,68 @@ func (a *attacher) attachDisk(ctx context.Context, volume, nodeName string) erro
 		if pollOp.Error != nil {
 			errs := []string{}
 			for _, e := range pollOp.Error.Errors {
-				errs = append(errs, fmt.Sprintf("%v", e))
+				errs = append(errs, fmt.Sprintf("%s: %s", e.Code, e.Message))
 			}
-			return false, fmt.Errorf("error waiting for attach to %s: %v", nodeName, errs)
+			return false, fmt.Errorf("operation failed: %v", errs)
 		}
 		return true, nil
 	})
-	if err != nil {
-		return fmt.Errorf("could not attach %s to %s: %w", volume, nodeName, err)
+	if err == nil {
+		return nil
 	}
-	return nil
+	// The operation name is logged rather than put in the error, which is
+	// recorded on PVCs and should be the same for each retry of a failure.
+	log.FromContext(ctx).Info("operation not completed", "operation", op.Name, "project", project, "zone", zone, "error", err)
+	if errors.Is(err, context.DeadlineExceeded) && ctx.Err() == nil {
+		return fmt.Errorf("operation not done after %v: %w (%w)", timeout, timeoutErr, err)
+	}
+	return err
 }
 
+// parseVolumeHandle parses a disk given as a volume handle, either zonal as
+// projects/<project>/zones/<zone>/disks/<name> or regional as
+// projects/<project>/regions/<region>/disks/<name>, or as the full URL of a
+// disk such as https://www.googleapis.com/compute/v1/projects/....
 func parseVolumeHandle(volume string) (volumeHandle, error) {
 	// example handle: projects/mattcary-gke-dev3/zones/us-central1-b/disks/pvc-eeb37e7c-faa6-4287-9114-4ee7ca9f5d0a
-	parts := strings.Split(volume, "/")
-	if len(parts) != 6 {
+	handle := volume
+	if strings.Contains(handle, "://") {
+		i := strings.Index(handle, "/projects/")
+		if i < 0 {
+			return volumeHandle{}, fmt.Errorf("bad volume handle %s", volume)
+		}
+		handle = handle[i+1:]
+	}
+	parts := strings.Split(handle, "/")
+	if len(parts) != 6 || parts[0] != "projects" || parts[4] != "disks" || parts[1] == "" || parts[3] == "" || parts[5] == "" {
 		return volumeHandle{}, fmt.Errorf("bad volume handle %s", volume)
 	}
-	return volumeHandle{
-		project: parts[1],
-		zone:    parts[3],
-		name:    parts[5],
-	}, nil
+	vol := volumeHandle{project: parts[1], name: parts[5]}
+	switch parts[2] {
+	case "zones":
+		vol.zone = parts[3]
+	case "regions":
+		vol.region = parts[3]
+	default:
+		return volumeHandle{}, fmt.Errorf("bad volume handle %s, expected zones or regions", volume)
+	}
+	return vol, nil
+}
+
+// String returns the volume handle of v, in the relative form.
+func (v volumeHandle) String() string {
+	if v.region != "" {
+		return fmt.Sprintf("projects/%s/regions/%s/disks/%s", v.project, v.region, v.name)
+	}
+	return fmt.Sprintf("projects/%s/zones/%s/disks/%s", v.project, v.zone, v.name)
+}
+
+// sourceURL returns the URL of the disk of v, as used to attach it.
+func (v volumeHandle) sourceURL() string {
+	return "https://www.googleapis.com/compute/v1/" + v.String()
 }
 
-func sourceFromVolumeHandle(volume string) string {
-	return "https://www.googleapis.com/compute/v1/" + volume
+// lastPathElement returns the name at the end of a resource URL.
+func lastPathElement(url string) string {
+	return url[strings.LastIndex(url, "/")+1:]
 }
@@ -16,25 +16,36 @@ package csi
 
 import (
 	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"gotest.tools/v3/assert"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 
+	"google.golang.org/api/compute/v1"
+	"google.golang.org/api/option"
 	corev1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/kubernetes/scheme"
 	"k8s.io/client-go/rest"
 	"k8s.io/utils/ptr"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/envtest"
+	"sigs.k8s.io/controller-runtime/pkg/event"
 	"sigs.k8s.io/controller-runtime/pkg/log"
 	"sigs.k8s.io/controller-runtime/pkg/log/zap"
 
@@ -64,6 +75,24 @@ type fakeAttacher struct {
 	k8sClient client.Client
 }
 
+func (a *fakeAttacher) checkAccess(ctx context.Context) error {
+	return nil
+}
+
+// deniedAttacher is a fakeAttacher without access to the compute API.
+type deniedAttacher struct {
+	fakeAttacher
+}
+
+func (a *deniedAttacher) checkAccess(ctx context.Context) error {
+	return errors.New("permission denied")
+}
+
+func (a *fakeAttacher) verifyDisk(ctx context.Context, volume, nodeName string) error {
+	_, err := parseVolumeHandle(volume)
+	return err
+}
+
 func (a *fakeAttacher) diskIsAttached(ctx context.Context, volume, nodename string) (bool, error) {
 	vol, err := parseVolumeHandle(volume)
 	if err != nil {
@@ -95,6 +124,35 @@ func (a *fakeAttacher) attachDisk(ctx context.Context, volume, nodeName string)
 	return a.k8sClient.Update(ctx, &pv)
 }
 
+func (a *fakeAttacher) listAttachedCacheDisks(ctx context.Context, nodeName string) ([]string, error) {
+	var pvs corev1.PersistentVolumeList
+	if err := a.k8sClient.List(ctx, &pvs, client.MatchingLabels{attachLabel: nodeName}); err != nil {
+		return nil, err
+	}
+	volumes := []string{}
+	for _, pv := range pvs.Items {
+		if pv.Spec.CSI != nil {
+			volumes = append(volumes, pv.Spec.CSI.VolumeHandle)
+		}
+	}
+	return volumes, nil
+}
+
+func (a *fakeAttacher) detachDisk(ctx context.Context, volume, nodeName string) error {
+	vol, err := parseVolumeHandle(volume)
+	if err != nil {
+		return err
+	}
+	var pv corev1.PersistentVolume
+	if err := a.k8sClient.Get(ctx, types.NamespacedName{Name: vol.name}, &pv); err != nil {
+		return err
+	}
+	labels := pv.GetLabels()
+	delete(labels, attachLabel)
+	pv.SetLabels(labels)
+	return a.k8sClient.Update(ctx, &pv)
+}
+
 func setupEnviron(ctx context.Context) {
 	log := log.FromContext(ctx)
 	kubeRoot := os.Getenv("KUBE_ROOT")
@@ -140,7 +198,12 @@ func mustSetupCluster() (context.Context, func(ctx context.Context)) {
 		os.Exit(1)
 	}
 
-	manager, err := NewManager(testCfg, controllerNamespace, mappingConfigMap, &fakeAttacher{k8sClient}, pdStorageClass)
+	manager, err := NewManager(testCfg, ManagerOptions{
+		Namespace:           controllerNamespace,
+		VolumeTypeConfigMap: mappingConfigMap,
+		Attacher:            &fakeAttacher{k8sClient},
+		PdStorageClass:      pdStorageClass,
+	})
 	if err != nil {
 		log.Error(err, "cannot setup manager")
 		os.Exit(1)
@@ -242,6 +305,28 @@ func TestSomeNodes(t *testing.T) {
 	cleanup(ctx)
 }
 
+func TestOversizedNode(t *testing.T) {
+	if skipControllerTests {
+		t.Skip("Skipping controller test")
+	}
+
+	ctx, cleanup := mustSetupCluster()
+
+	node := corev1.Node{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "oversized",
+			Labels:      map[string]string{common.VolumeTypeLabel: "lssd", common.SizeLabel: "1Ti"},
+			Annotations: map[string]string{common.CapacityAnnotation: `{"localSSDs":1,"memoryBytes":0,"maxSizes":{"lssd":"375Gi"}}`},
+		},
+	}
+	assert.NilError(t, k8sClient.Create(ctx, &node))
+
+	info := waitForNodeMapping(ctx, t, "oversized")
+	assert.Assert(t, strings.Contains(info.Invalid, "larger than the 375Gi of lssd caches"), info.Invalid)
+
+	cleanup(ctx)
+}
+
 func TestPdNode(t *testing.T) {
 	if skipControllerTests {
 		t.Skip("Skipping controller test")
@@ -261,6 +346,15 @@ func TestPdNode(t *testing.T) {
 		if pvc.Spec.StorageClassName == nil || *pvc.Spec.StorageClassName != pdStorageClass {
 			return false, fmt.Errorf("Unexpected storageclass %v", pvc.Spec.StorageClassName)
 		}
+		if !isManagedPVC(&pvc) {
+			return false, fmt.Errorf("Missing managed-by label on pvc: %v", pvc.GetLabels())
+		}
+		if pvc.GetAnnotations()[selectedNodeAnnotation] != "a" {
+			return false, fmt.Errorf("Missing selected node on pvc: %v", pvc.GetAnnotations())
+		}
+		if pvcNode(&pvc) != "a" || len(pvc.OwnerReferences) != 1 || pvc.OwnerReferences[0].Name != "a" {
+			return false, fmt.Errorf("Missing node link on pvc: %v %v", pvc.GetLabels(), pvc.OwnerReferences)
+		}
 		if pvc.Status.Phase != corev1.ClaimBound {
 			pvName := "pv-for-" + pvc.GetName()
 			pv := corev1.PersistentVolume{
@@ -273,7 +367,7 @@ func TestPdNode(t *testing.T) {
 					PersistentVolumeSource: corev1.PersistentVolumeSource{
 						CSI: &corev1.CSIPersistentVolumeSource{
 							Driver:       "dont-care",
-							VolumeHandle: fmt.Sprintf("project/unknown/zones/unknown/disks/%s", pvName),
+							VolumeHandle: fmt.Sprintf("projects/unknown/zones/unknown/disks/%s", pvName),
 						},
 					},
 				},
@@ -308,5 +402,476 @@ func TestPdNode(t *testing.T) {
 
 	assert.NilError(t, err, "volume not created & attached to node a")
 
+	attached, err := (&fakeAttacher{k8sClient}).listAttachedCacheDisks(ctx, "a")
+	assert.NilError(t, err)
+	assert.DeepEqual(t, attached, []string{"projects/unknown/zones/unknown/disks/pv-for-a"})
+
+	cleanup(ctx)
+}
+
+func TestRemovedNode(t *testing.T) {
+	if skipControllerTests {
+		t.Skip("Skipping controller test")
+	}
+
+	ctx, cleanup := mustSetupCluster()
+
+	createNode(ctx, t, "a", map[string]string{common.VolumeTypeLabel: "lssd"})
+	waitForNodeMapping(ctx, t, "a")
+
+	var node corev1.Node
+	assert.NilError(t, k8sClient.Get(ctx, types.NamespacedName{Name: "a"}, &node))
+	delete(node.Labels, common.VolumeTypeLabel)
+	assert.NilError(t, k8sClient.Update(ctx, &node))
+
+	// The controller marks the node, and waits for the driver to release the
+	// cache.
+	err := wait.PollUntilContextTimeout(ctx, WaitInterval, WaitTimeout, true, func(ctx context.Context) (bool, error) {
+		if err := k8sClient.Get(ctx, types.NamespacedName{Name: "a"}, &node); err != nil {
+			return false, err
+		}
+		_, removing := node.GetLabels()[common.RemovingLabel]
+		return removing, nil
+	})
+	assert.NilError(t, err, "node not marked for removal")
+	waitForNodeMapping(ctx, t, "a")
+
+	node.Annotations = map[string]string{common.MaintenanceStateAnnotation: common.MaintenanceReleased}
+	assert.NilError(t, k8sClient.Update(ctx, &node))
+	err = wait.PollUntilContextTimeout(ctx, WaitInterval, WaitTimeout, true, func(ctx context.Context) (bool, error) {
+		if err := k8sClient.Get(ctx, types.NamespacedName{Name: "a"}, &node); err != nil {
+			return false, err
+		}
+		_, removing := node.GetLabels()[common.RemovingLabel]
+		_, state := node.GetAnnotations()[common.MaintenanceStateAnnotation]
+		return !removing && !state, nil
+	})
+	assert.NilError(t, err, "removal not finished")
+	assertNoMapping(ctx, t, "a")
+
+	cleanup(ctx)
+}
+
+func TestPdNodeStorageClass(t *testing.T) {
+	if skipControllerTests {
+		t.Skip("Skipping controller test")
+	}
+
+	ctx, cleanup := mustSetupCluster()
+
+	for _, class := range []storagev1.StorageClass{
+		{ObjectMeta: metav1.ObjectMeta{Name: "hyperdisk"}, Provisioner: pdProvisioner},
+		{ObjectMeta: metav1.ObjectMeta{Name: "filestore"}, Provisioner: "filestore.csi.storage.gke.io"},
+	} {
+		assert.NilError(t, k8sClient.Create(ctx, &class))
+	}
+	for node, class := range map[string]string{"a": "hyperdisk", "b": "filestore", "c": "missing"} {
+		assert.NilError(t, k8sClient.Create(ctx, &corev1.Node{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        node,
+				Labels:      map[string]string{common.VolumeTypeLabel: "pd", common.SizeLabel: "50Gi"},
+				Annotations: map[string]string{common.StorageClassAnnotation: class},
+			},
+		}))
+	}
+
+	err := wait.PollUntilContextTimeout(ctx, WaitInterval, WaitTimeout, true, func(ctx context.Context) (bool, error) {
+		var pvc corev1.PersistentVolumeClaim
+		err := k8sClient.Get(ctx, types.NamespacedName{Namespace: controllerNamespace, Name: "a"}, &pvc)
+		if apierrors.IsNotFound(err) {
+			return false, nil // retry
+		} else if err != nil {
+			return false, err
+		}
+		if pvc.Spec.StorageClassName == nil || *pvc.Spec.StorageClassName != "hyperdisk" {
+			return false, fmt.Errorf("Unexpected storageclass %v", pvc.Spec.StorageClassName)
+		}
+		return true, nil
+	})
+	assert.NilError(t, err, "pvc not created for node a")
+
+	info := waitForNodeMapping(ctx, t, "b")
+	assert.Assert(t, strings.Contains(info.Invalid, "has provisioner filestore.csi.storage.gke.io"), info.Invalid)
+	info = waitForNodeMapping(ctx, t, "c")
+	assert.Assert(t, strings.Contains(info.Invalid, "missing not found"), info.Invalid)
+
+	cleanup(ctx)
+}
+
+func TestExistingDiskNode(t *testing.T) {
+	if skipControllerTests {
+		t.Skip("Skipping controller test")
+	}
+
+	ctx, cleanup := mustSetupCluster()
+
+	// Our fake attacher records attachment on a PV named for the disk.
+	pv := corev1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{Name: "prewarmed"},
+		Spec: corev1.PersistentVolumeSpec{
+			AccessModes: []corev1.PersistentVolumeAccessMode{corev1.ReadWriteOnce},
+			Capacity:    corev1.ResourceList{corev1.ResourceStorage: resource.MustParse("10Gi")},
+			PersistentVolumeSource: corev1.PersistentVolumeSource{
+				CSI: &corev1.CSIPersistentVolumeSource{Driver: "dont-care", VolumeHandle: "prewarmed"},
+			},
+		},
+	}
+	assert.NilError(t, k8sClient.Create(ctx, &pv))
+
+	node := corev1.Node{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "a",
+			Labels:      map[string]string{common.VolumeTypeLabel: "pd"},
+			Annotations: map[string]string{common.ExistingDiskAnnotation: "projects/p/zones/z/disks/prewarmed"},
+		},
+	}
+	assert.NilError(t, k8sClient.Create(ctx, &node))
+
+	err := wait.PollUntilContextTimeout(ctx, WaitInterval, WaitTimeout, true, func(ctx context.Context) (bool, error) {
+		info, err := fetchNodeMapping(ctx, t, "a")
+		if err != nil || info.Disk != "prewarmed" {
+			return false, nil // retry
+		}
+		if err := k8sClient.Get(ctx, types.NamespacedName{Name: "prewarmed"}, &pv); err != nil {
+			return false, err
+		}
+		_, found := pv.GetLabels()[attachLabel]
+		return found, nil
+	})
+	assert.NilError(t, err, "existing disk not mapped & attached to node a")
+
+	var pvcs corev1.PersistentVolumeClaimList
+	assert.NilError(t, k8sClient.List(ctx, &pvcs, client.InNamespace(controllerNamespace)))
+	assert.Equal(t, len(pvcs.Items), 0)
+
+	cleanup(ctx)
+}
+
+func TestRebuildMapping(t *testing.T) {
+	if skipControllerTests {
+		t.Skip("Skipping controller test")
+	}
+
+	ctx, cleanup := mustSetupCluster()
+
+	createNode(ctx, t, "a", map[string]string{common.VolumeTypeLabel: "lssd"})
+	node := corev1.Node{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "b",
+			Labels:      map[string]string{common.VolumeTypeLabel: "pd"},
+			Annotations: map[string]string{common.ExistingDiskAnnotation: "projects/p/zones/z/disks/prewarmed"},
+		},
+	}
+	assert.NilError(t, k8sClient.Create(ctx, &node))
+	createNode(ctx, t, "c", map[string]string{"someOtherlabel": "bar"})
+	waitForNodeMapping(ctx, t, "a")
+
+	var configMap corev1.ConfigMap
+	assert.NilError(t, k8sClient.Get(ctx, types.NamespacedName{Name: mappingConfigMap, Namespace: controllerNamespace}, &configMap))
+	configMap.Data[volumeTypeInfoKey] = "a,type=lssd,bogus"
+	assert.NilError(t, k8sClient.Update(ctx, &configMap))
+
+	nodes, err := RebuildMapping(ctx, testCfg, ManagerOptions{Namespace: controllerNamespace, VolumeTypeConfigMap: mappingConfigMap})
+	assert.NilError(t, err)
+	assert.Equal(t, nodes, 2)
+	assert.Equal(t, waitForNodeMapping(ctx, t, "a").VolumeType, "lssd")
+	assert.Equal(t, waitForNodeMapping(ctx, t, "b").Disk, "prewarmed")
+
+	cleanup(ctx)
+}
+
+func TestReadiness(t *testing.T) {
+	if skipControllerTests {
+		t.Skip("Skipping controller test")
+	}
+
+	ctx, cleanup := mustSetupCluster()
+
+	clientset, err := kubernetes.NewForConfig(testCfg)
+	assert.NilError(t, err)
+	mapName := types.NamespacedName{Namespace: controllerNamespace, Name: mappingConfigMap}
+	ready := &readinessChecker{client: clientset, volumeTypeMap: mapName, attacher: &fakeAttacher{k8sClient}}
+	// The map is created when the manager starts, even without cache nodes.
+	err = wait.PollUntilContextTimeout(ctx, WaitInterval, WaitTimeout, true, func(ctx context.Context) (bool, error) {
+		return ready.checkNow(ctx) == nil, nil
+	})
+	assert.NilError(t, err)
+
+	denied := &readinessChecker{client: clientset, volumeTypeMap: mapName, attacher: &deniedAttacher{}}
+	assert.ErrorContains(t, denied.checkNow(ctx), "permission denied")
+
+	missing := &readinessChecker{client: clientset, volumeTypeMap: types.NamespacedName{Namespace: controllerNamespace, Name: "missing"}}
+	assert.ErrorContains(t, missing.checkNow(ctx), "not found")
+
+	var configMap corev1.ConfigMap
+	assert.NilError(t, k8sClient.Get(ctx, mapName, &configMap))
+	configMap.Data = map[string]string{volumeTypeInfoKey: "a,type=lssd,bogus"}
+	assert.NilError(t, k8sClient.Update(ctx, &configMap))
+	assert.ErrorContains(t, ready.checkNow(ctx), "Bad volume type map")
+
 	cleanup(ctx)
 }
+
+func TestCacheNodePredicate(t *testing.T) {
+	node := func(nodeLabels map[string]string) *corev1.Node {
+		return &corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "n", Labels: nodeLabels}}
+	}
+	cache := node(map[string]string{common.VolumeTypeLabel: "lssd", "pool": "cache"})
+	other := node(map[string]string{"pool": "cache"})
+
+	pred := cacheNodePredicate(nil)
+	assert.Assert(t, pred.Create(event.CreateEvent{Object: cache}))
+	assert.Assert(t, !pred.Create(event.CreateEvent{Object: other}))
+	assert.Assert(t, pred.Update(event.UpdateEvent{ObjectOld: cache, ObjectNew: other}))
+	assert.Assert(t, !pred.Update(event.UpdateEvent{ObjectOld: other, ObjectNew: other}))
+	assert.Assert(t, pred.Delete(event.DeleteEvent{Object: cache}))
+	removing := node(map[string]string{common.RemovingLabel: "true", "pool": "cache"})
+	assert.Assert(t, pred.Update(event.UpdateEvent{ObjectOld: removing, ObjectNew: removing}))
+
+	selector, err := labels.Parse("pool=cache")
+	assert.NilError(t, err)
+	pred = cacheNodePredicate(selector)
+	assert.Assert(t, pred.Create(event.CreateEvent{Object: cache}))
+	assert.Assert(t, !pred.Create(event.CreateEvent{Object: node(map[string]string{common.VolumeTypeLabel: "lssd"})}))
+}
+
+func TestIsManagedPVC(t *testing.T) {
+	var pvc corev1.PersistentVolumeClaim
+	assert.Assert(t, !isManagedPVC(&pvc))
+	pvc.SetLabels(map[string]string{managedByLabel: "someone-else"})
+	assert.Assert(t, !isManagedPVC(&pvc))
+	pvc.SetLabels(map[string]string{managedByLabel: managedByValue})
+	assert.Assert(t, isManagedPVC(&pvc))
+}
+
+func TestManagedPVCPredicate(t *testing.T) {
+	pvc := &corev1.PersistentVolumeClaim{}
+	pvc.SetLabels(map[string]string{managedByLabel: managedByValue})
+	pvc.SetResourceVersion("1")
+	pred := managedPVCPredicate()
+	assert.Assert(t, pred.Create(event.CreateEvent{Object: pvc}))
+	assert.Assert(t, !pred.Create(event.CreateEvent{Object: &corev1.PersistentVolumeClaim{}}))
+
+	// The reconciler recording a retry does not trigger another reconcile.
+	retried := pvc.DeepCopy()
+	updateAttachAnnotations(retried, common.AttachAttaching, errors.New("quota exceeded"))
+	retried.SetResourceVersion("2")
+	assert.Assert(t, !pred.Update(event.UpdateEvent{ObjectOld: pvc, ObjectNew: retried}))
+
+	bound := retried.DeepCopy()
+	bound.Status.Phase = corev1.ClaimBound
+	bound.SetResourceVersion("3")
+	assert.Assert(t, pred.Update(event.UpdateEvent{ObjectOld: retried, ObjectNew: bound}))
+	labeled := bound.DeepCopy()
+	labeled.Labels[cacheNodeLabel] = "a"
+	assert.Assert(t, pred.Update(event.UpdateEvent{ObjectOld: bound, ObjectNew: labeled}))
+}
+
+func TestPvcNode(t *testing.T) {
+	var pvc corev1.PersistentVolumeClaim
+	pvc.SetName("a")
+	assert.Equal(t, pvcNode(&pvc), "a")
+	pvc.SetLabels(map[string]string{cacheNodeLabel: "b"})
+	assert.Equal(t, pvcNode(&pvc), "b")
+}
+
+func TestUpdateAttachAnnotations(t *testing.T) {
+	var pvc corev1.PersistentVolumeClaim
+	assert.Assert(t, updateAttachAnnotations(&pvc, common.AttachAttaching, errors.New("quota exceeded")))
+	assert.Equal(t, pvc.GetAnnotations()[common.AttachStateAnnotation], common.AttachAttaching)
+	assert.Equal(t, pvc.GetAnnotations()[common.AttachErrorAnnotation], "quota exceeded")
+	assert.Assert(t, !updateAttachAnnotations(&pvc, common.AttachAttaching, errors.New("quota exceeded")))
+	assert.Assert(t, updateAttachAnnotations(&pvc, common.AttachAttaching, errors.New("timeout")))
+	assert.Equal(t, pvc.GetAnnotations()[common.AttachErrorAnnotation], "timeout")
+	assert.Assert(t, updateAttachAnnotations(&pvc, common.AttachAttached, nil))
+	assert.Equal(t, pvc.GetAnnotations()[common.AttachStateAnnotation], common.AttachAttached)
+	_, found := pvc.GetAnnotations()[common.AttachErrorAnnotation]
+	assert.Assert(t, !found)
+	assert.Assert(t, !updateAttachAnnotations(&pvc, common.AttachAttached, nil))
+}
+
+func TestCheckPVZone(t *testing.T) {
+	pv := func(handle string, affinityZones ...string) *corev1.PersistentVolume {
+		pv := &corev1.PersistentVolume{}
+		pv.Spec.CSI = &corev1.CSIPersistentVolumeSource{VolumeHandle: handle}
+		if len(affinityZones) > 0 {
+			pv.Spec.NodeAffinity = &corev1.VolumeNodeAffinity{
+				Required: &corev1.NodeSelector{
+					NodeSelectorTerms: []corev1.NodeSelectorTerm{{
+						MatchExpressions: []corev1.NodeSelectorRequirement{{
+							Key:      zoneLabel,
+							Operator: corev1.NodeSelectorOpIn,
+							Values:   affinityZones,
+						}},
+					}},
+				},
+			}
+		}
+		return pv
+	}
+	handle := "projects/p/zones/us-central1-b/disks/d"
+
+	assert.NilError(t, checkPVZone(pv(handle), "us-central1-b"))
+	assert.NilError(t, checkPVZone(pv(handle), ""))
+	assert.ErrorContains(t, checkPVZone(pv(handle), "us-central1-c"), "disk is in zone us-central1-b but node is in us-central1-c")
+	assert.NilError(t, checkPVZone(pv(handle, "us-central1-b", "us-central1-c"), "us-central1-c"))
+	assert.ErrorContains(t, checkPVZone(pv(handle, "us-central1-a"), "us-central1-b"), "zone us-central1-a")
+	assert.NilError(t, checkPVZone(pv("bad-handle"), "us-central1-b"))
+	assert.NilError(t, checkPVZone(pv("projects/p/regions/us-central1/disks/d"), "us-central1-b"))
+	assert.ErrorContains(t, checkPVZone(pv("projects/p/regions/us-central1/disks/d", "us-central1-a", "us-central1-c"), "us-central1-b"), "zone us-central1-a,us-central1-c")
+}
+
+func TestWaitForOperation(t *testing.T) {
+	var status string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || !strings.HasSuffix(r.URL.Path, "/projects/p/zones/z/operations/op/wait") {
+			http.Error(w, "bad request "+r.URL.String(), http.StatusBadRequest)
+			return
+		}
+		if status == "" {
+			// A wait that outlasts the timeout.
+			<-r.Context().Done()
+			return
+		}
+		fmt.Fprintf(w, `{"name": "op", "status": %q}`, status)
+	}))
+	defer server.Close()
+
+	ctx := context.Background()
+	svc, err := compute.NewService(ctx, option.WithEndpoint(server.URL), option.WithoutAuthentication())
+	assert.NilError(t, err)
+	a := &attacher{computeSvc: svc, opts: AttachOptions{PollInterval: 10 * time.Millisecond}}
+	op := &compute.Operation{Name: "op"}
+
+	status = "DONE"
+	assert.NilError(t, a.waitForOperation(ctx, "p", "z", op, time.Second, ErrAttachTimeout))
+
+	status = "RUNNING"
+	err = a.waitForOperation(ctx, "p", "z", op, 50*time.Millisecond, ErrDetachTimeout)
+	assert.ErrorIs(t, err, ErrDetachTimeout)
+	assert.Assert(t, !errors.Is(err, ErrAttachTimeout))
+
+	status = ""
+	err = a.waitForOperation(ctx, "p", "z", op, 50*time.Millisecond, ErrAttachTimeout)
+	assert.ErrorIs(t, err, ErrAttachTimeout)
+
+	// A cancelled caller is not a timeout of the operation.
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	err = a.waitForOperation(cancelled, "p", "z", op, time.Second, ErrAttachTimeout)
+	assert.Assert(t, err != nil)
+	assert.Assert(t, !errors.Is(err, ErrAttachTimeout))
+}
+
+func TestNodeZone(t *testing.T) {
+	node := func(providerID string, labels map[string]string) *corev1.Node {
+		node := &corev1.Node{}
+		node.SetLabels(labels)
+		node.Spec.ProviderID = providerID
+		return node
+	}
+	assert.Equal(t, nodeZone(node("", map[string]string{zoneLabel: "us-central1-b"}), DefaultZoneLabels), "us-central1-b")
+	assert.Equal(t, nodeZone(node("", map[string]string{corev1.LabelTopologyZone: "us-central1-c"}), DefaultZoneLabels), "us-central1-c")
+	assert.Equal(t, nodeZone(node("", map[string]string{zoneLabel: "us-central1-b", corev1.LabelTopologyZone: "us-central1-c"}), DefaultZoneLabels), "us-central1-b")
+	assert.Equal(t, nodeZone(node("", map[string]string{"example.com/zone": "z"}), []string{"example.com/zone"}), "z")
+	assert.Equal(t, nodeZone(node("gce://p/us-east1-d/n", nil), DefaultZoneLabels), "us-east1-d")
+	assert.Equal(t, nodeZone(node("aws:///us-east-1a/i-0123", nil), DefaultZoneLabels), "")
+	assert.Equal(t, nodeZone(node("", nil), DefaultZoneLabels), "")
+}
+
+func TestParseVolumeHandle(t *testing.T) {
+	tests := []struct {
+		handle string
+		want   volumeHandle
+		source string
+	}{
+		{
+			handle: "projects/p/zones/us-central1-b/disks/d",
+			want:   volumeHandle{project: "p", zone: "us-central1-b", name: "d"},
+			source: "https://www.googleapis.com/compute/v1/projects/p/zones/us-central1-b/disks/d",
+		},
+		{
+			handle: "projects/p/regions/us-central1/disks/d",
+			want:   volumeHandle{project: "p", region: "us-central1", name: "d"},
+			source: "https://www.googleapis.com/compute/v1/projects/p/regions/us-central1/disks/d",
+		},
+		{
+			handle: "https://www.googleapis.com/compute/v1/projects/p/zones/us-central1-b/disks/d",
+			want:   volumeHandle{project: "p", zone: "us-central1-b", name: "d"},
+			source: "https://www.googleapis.com/compute/v1/projects/p/zones/us-central1-b/disks/d",
+		},
+		{
+			handle: "https://compute.googleapis.com/compute/beta/projects/p/regions/us-central1/disks/d",
+			want:   volumeHandle{project: "p", region: "us-central1", name: "d"},
+			source: "https://www.googleapis.com/compute/v1/projects/p/regions/us-central1/disks/d",
+		},
+	}
+	for _, tc := range tests {
+		vol, err := parseVolumeHandle(tc.handle)
+		assert.NilError(t, err, tc.handle)
+		assert.Equal(t, vol, tc.want, tc.handle)
+		assert.Equal(t, vol.sourceURL(), tc.source, tc.handle)
+	}
+
+	for _, handle := range []string{
+		"",
+		"bad-handle",
+		"projects/p/zones/z/disks",
+		"projects/p/zones/z/disks/",
+		"projects/p/global/z/disks/d",
+		"projects/p/zones/z/snapshots/d",
+		"folders/p/zones/z/disks/d",
+		"https://www.googleapis.com/compute/v1/zones/z/disks/d",
+		"projects/p/zones/z/disks/d/extra",
+	} {
+		_, err := parseVolumeHandle(handle)
+		assert.ErrorContains(t, err, "bad volume handle", handle)
+	}
+}
+
+func TestCacheDisks(t *testing.T) {
+	instance := &compute.Instance{
+		Disks: []*compute.AttachedDisk{
+			{Boot: true, Type: "PERSISTENT", DeviceName: "persistent-disk-0", Source: "https://www.googleapis.com/compute/v1/projects/p/zones/z/disks/node"},
+			{Type: "SCRATCH", DeviceName: "local-ssd-0"},
+			{Type: "PERSISTENT", DeviceName: "pvc-a", Source: "https://www.googleapis.com/compute/v1/projects/p/zones/z/disks/pvc-a"},
+			{Type: "PERSISTENT", DeviceName: "regional", Source: "https://www.googleapis.com/compute/v1/projects/p/regions/r/disks/regional"},
+			// Attached under another name, not by attachDisk.
+			{Type: "PERSISTENT", DeviceName: "data", Source: "https://www.googleapis.com/compute/v1/projects/p/zones/z/disks/pvc-b"},
+		},
+	}
+	assert.DeepEqual(t, cacheDisks(instance), []string{"projects/p/zones/z/disks/pvc-a", "projects/p/regions/r/disks/regional"})
+	assert.Assert(t, cacheDisks(&compute.Instance{}) == nil)
+}
+
+func TestStaleCacheDisks(t *testing.T) {
+	pvc := &corev1.PersistentVolumeClaim{ObjectMeta: metav1.ObjectMeta{Namespace: controllerNamespace, Name: "a", UID: "new"}}
+	pv := func(name string, claim *corev1.ObjectReference) corev1.PersistentVolume {
+		return corev1.PersistentVolume{
+			ObjectMeta: metav1.ObjectMeta{Name: name},
+			Spec: corev1.PersistentVolumeSpec{
+				ClaimRef: claim,
+				PersistentVolumeSource: corev1.PersistentVolumeSource{
+					CSI: &corev1.CSIPersistentVolumeSource{VolumeHandle: "projects/p/zones/z/disks/" + name},
+				},
+			},
+		}
+	}
+	pvs := []corev1.PersistentVolume{
+		pv("current", &corev1.ObjectReference{Namespace: controllerNamespace, Name: "a", UID: "new"}),
+		pv("old", &corev1.ObjectReference{Namespace: controllerNamespace, Name: "a", UID: "old"}),
+		pv("detached", &corev1.ObjectReference{Namespace: controllerNamespace, Name: "a", UID: "older"}),
+		pv("other-node", &corev1.ObjectReference{Namespace: controllerNamespace, Name: "b", UID: "b"}),
+		pv("workload", &corev1.ObjectReference{Namespace: "default", Name: "a", UID: "data"}),
+		pv("unclaimed", nil),
+	}
+	attached := []string{
+		"projects/p/zones/z/disks/current",
+		"projects/p/zones/z/disks/old",
+		"projects/p/zones/z/disks/other-node",
+		"projects/p/zones/z/disks/workload",
+		"projects/p/zones/z/disks/unclaimed",
+	}
+	assert.DeepEqual(t, staleCacheDisks(pvc, attached, pvs), []string{"projects/p/zones/z/disks/old"})
+	assert.Assert(t, staleCacheDisks(pvc, nil, pvs) == nil)
+}
@@ -0,0 +1,133 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package csi
+
+import (
+	"context"
+	"fmt"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/selection"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	"github.com/GoogleCloudPlatform/csi-node-cache/pkg/common"
+)
+
+// daemonSetReconciler keeps the required node affinity of the driver
+// DaemonSet matching the nodes the controller treats as cache nodes, so that
+// driver pods don't run on other nodes.
+type daemonSetReconciler struct {
+	client.Client
+	affinity *corev1.NodeSelector
+}
+
+// cacheNodeAffinity returns the node selector matching cache nodes: those with
+// the volume type label, or whose cache is being removed, that also match
+// selector.
+func cacheNodeAffinity(selector labels.Selector) (*corev1.NodeSelector, error) {
+	var extra []corev1.NodeSelectorRequirement
+	if selector != nil {
+		requirements, selectable := selector.Requirements()
+		if !selectable {
+			return nil, fmt.Errorf("node selector %s selects no nodes", selector)
+		}
+		for _, r := range requirements {
+			requirement, err := nodeSelectorRequirement(r)
+			if err != nil {
+				return nil, err
+			}
+			extra = append(extra, requirement)
+		}
+	}
+	affinity := &corev1.NodeSelector{}
+	for _, key := range []string{common.VolumeTypeLabel, common.RemovingLabel} {
+		term := corev1.NodeSelectorTerm{
+			MatchExpressions: []corev1.NodeSelectorRequirement{{Key: key, Operator: corev1.NodeSelectorOpExists}},
+		}
+		term.MatchExpressions = append(term.MatchExpressions, extra...)
+		affinity.NodeSelectorTerms = append(affinity.NodeSelectorTerms, term)
+	}
+	return affinity, nil
+}
+
+// nodeSelectorRequirement converts a label selector requirement to its node
+// affinity form.
+func nodeSelectorRequirement(r labels.Requirement) (corev1.NodeSelectorRequirement, error) {
+	requirement := corev1.NodeSelectorRequirement{Key: r.Key()}
+	if values := r.Values(); values.Len() > 0 {
+		requirement.Values = values.List()
+	}
+	switch r.Operator() {
+	case selection.Equals, selection.DoubleEquals, selection.In:
+		requirement.Operator = corev1.NodeSelectorOpIn
+	case selection.NotEquals, selection.NotIn:
+		requirement.Operator = corev1.NodeSelectorOpNotIn
+	case selection.Exists:
+		requirement.Operator = corev1.NodeSelectorOpExists
+	case selection.DoesNotExist:
+		requirement.Operator = corev1.NodeSelectorOpDoesNotExist
+	case selection.GreaterThan:
+		requirement.Operator = corev1.NodeSelectorOpGt
+	case selection.LessThan:
+		requirement.Operator = corev1.NodeSelectorOpLt
+	default:
+		return corev1.NodeSelectorRequirement{}, fmt.Errorf("unsupported node selector operator %s in %s", r.Operator(), r.String())
+	}
+	return requirement, nil
+}
+
+func (r *daemonSetReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	var ds appsv1.DaemonSet
+	if err := r.Get(ctx, req.NamespacedName, &ds); err != nil {
+		if apierrors.IsNotFound(err) {
+			return ctrl.Result{}, nil
+		}
+		return ctrl.Result{}, err
+	}
+	// Only the node affinity is patched, leaving the rest of the DaemonSet to
+	// its owner. A change rolls out new driver pods.
+	patched := ds.DeepCopy()
+	if !setRequiredAffinity(&patched.Spec.Template.Spec, r.affinity) {
+		return ctrl.Result{}, nil
+	}
+	if err := r.Patch(ctx, patched, client.MergeFrom(&ds)); err != nil {
+		return ctrl.Result{}, fmt.Errorf("Could not update node affinity of %s: %w", req.NamespacedName, err)
+	}
+	log.FromContext(ctx).Info("synced driver node affinity", "daemonset", req.NamespacedName, "affinity", r.affinity)
+	return ctrl.Result{}, nil
+}
+
+// setRequiredAffinity sets the required node affinity of spec, returning true
+// if it changed. Other affinities are kept.
+func setRequiredAffinity(spec *corev1.PodSpec, affinity *corev1.NodeSelector) bool {
+	if spec.Affinity != nil && spec.Affinity.NodeAffinity != nil &&
+		equality.Semantic.DeepEqual(spec.Affinity.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution, affinity) {
+		return false
+	}
+	if spec.Affinity == nil {
+		spec.Affinity = &corev1.Affinity{}
+	}
+	if spec.Affinity.NodeAffinity == nil {
+		spec.Affinity.NodeAffinity = &corev1.NodeAffinity{}
+	}
+	spec.Affinity.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution = affinity.DeepCopy()
+	return true
+}
@@ -0,0 +1,61 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package csi
+
+import (
+	"testing"
+
+	"gotest.tools/v3/assert"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+func TestCacheNodeAffinity(t *testing.T) {
+	selector, err := labels.Parse("cloud.google.com/gke-nodepool=cache,spot!=true")
+	assert.NilError(t, err)
+	affinity, err := cacheNodeAffinity(selector)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, affinity, &corev1.NodeSelector{NodeSelectorTerms: []corev1.NodeSelectorTerm{{
+		MatchExpressions: []corev1.NodeSelectorRequirement{
+			{Key: "node-cache.gke.io", Operator: corev1.NodeSelectorOpExists},
+			{Key: "cloud.google.com/gke-nodepool", Operator: corev1.NodeSelectorOpIn, Values: []string{"cache"}},
+			{Key: "spot", Operator: corev1.NodeSelectorOpNotIn, Values: []string{"true"}},
+		},
+	}, {
+		MatchExpressions: []corev1.NodeSelectorRequirement{
+			{Key: "node-cache.gke.io/removing", Operator: corev1.NodeSelectorOpExists},
+			{Key: "cloud.google.com/gke-nodepool", Operator: corev1.NodeSelectorOpIn, Values: []string{"cache"}},
+			{Key: "spot", Operator: corev1.NodeSelectorOpNotIn, Values: []string{"true"}},
+		},
+	}}})
+
+	spec := corev1.PodSpec{Affinity: &corev1.Affinity{
+		PodAntiAffinity: &corev1.PodAntiAffinity{},
+		NodeAffinity: &corev1.NodeAffinity{
+			PreferredDuringSchedulingIgnoredDuringExecution: []corev1.PreferredSchedulingTerm{{Weight: 1}},
+		},
+	}}
+	assert.Assert(t, setRequiredAffinity(&spec, affinity))
+	assert.DeepEqual(t, spec.Affinity.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution, affinity)
+	assert.Assert(t, spec.Affinity.PodAntiAffinity != nil)
+	assert.Equal(t, len(spec.Affinity.NodeAffinity.PreferredDuringSchedulingIgnoredDuringExecution), 1)
+	assert.Assert(t, !setRequiredAffinity(&spec, affinity), "unchanged affinity was set again")
+
+	affinity, err = cacheNodeAffinity(nil)
+	assert.NilError(t, err)
+	spec = corev1.PodSpec{}
+	assert.Assert(t, setRequiredAffinity(&spec, affinity))
+	assert.Equal(t, len(spec.Affinity.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution.NodeSelectorTerms[0].MatchExpressions), 1)
+}
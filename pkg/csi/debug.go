@@ -0,0 +1,153 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package csi
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/klog/v2"
+
+	"github.com/GoogleCloudPlatform/csi-node-cache/pkg/util"
+)
+
+// DebugPublishesPath lists the published volumes of the driver.
+const DebugPublishesPath = "/debug/publishes"
+
+// DebugPublishes is the state of the publishes of the driver, as the driver
+// sees it, for comparing with what kubelet believes.
+type DebugPublishes struct {
+	// VolumeType and CachePath are those of the current cache, if any.
+	VolumeType string `json:"volumeType,omitempty"`
+	CachePath  string `json:"cachePath,omitempty"`
+	// Publishes are the published targets recorded by the driver, followed
+	// by any other mounts of the cache in pod volumes.
+	Publishes []DebugPublish `json:"publishes"`
+	// Errors are problems found collecting the publishes.
+	Errors []string `json:"errors,omitempty"`
+}
+
+// DebugPublish is a target the cache is published to.
+type DebugPublish struct {
+	TargetPath string    `json:"targetPath"`
+	VolumeID   string    `json:"volumeID,omitempty"`
+	ReadOnly   bool      `json:"readOnly"`
+	PodUID     types.UID `json:"podUID,omitempty"`
+	// Tracked is set if the driver has recorded the publish. Untracked
+	// targets are mounts of the cache the driver doesn't know of.
+	Tracked bool `json:"tracked"`
+	// Mounted is set if the target is a mount point.
+	Mounted bool `json:"mounted"`
+	// Stale is set for mounted targets bound to a replaced cache.
+	Stale bool `json:"stale,omitempty"`
+}
+
+// ServeDebug serves debugging endpoints on addr, such as DebugPublishesPath.
+// The endpoints are not authenticated, so addr must be a loopback address.
+// Normally this will run forever; an error will be returned otherwise.
+func (d *Driver) ServeDebug(addr string) error {
+	if err := checkLoopback(addr); err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET "+DebugPublishesPath, func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, d.debugPublishes())
+	})
+	return http.ListenAndServe(addr, mux)
+}
+
+// checkLoopback returns an error unless addr only listens on loopback
+// interfaces, where only processes on the node can reach it.
+func checkLoopback(addr string) error {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return fmt.Errorf("bad debug address %s: %w", addr, err)
+	}
+	if host == "localhost" {
+		return nil
+	}
+	if ip := net.ParseIP(host); ip == nil || !ip.IsLoopback() {
+		return fmt.Errorf("debug address %s is not a loopback address", addr)
+	}
+	return nil
+}
+
+// debugPublishes returns the publishes recorded by the driver, with the actual
+// state of their targets.
+func (d *Driver) debugPublishes() DebugPublishes {
+	var debug DebugPublishes
+	d.volMutex.Lock()
+	vol := d.vol
+	d.volMutex.Unlock()
+
+	d.checkpointMutex.Lock()
+	debug.VolumeType = d.checkpoint.VolumeType
+	tracked := make(map[string]publishedTarget, len(d.checkpoint.Targets))
+	for target, published := range d.checkpoint.Targets {
+		tracked[target] = published
+	}
+	d.checkpointMutex.Unlock()
+
+	debug.Publishes = []DebugPublish{}
+	for target, published := range tracked {
+		publish := DebugPublish{
+			TargetPath: target,
+			VolumeID:   published.VolumeID,
+			ReadOnly:   published.ReadOnly,
+			PodUID:     targetPodUID(target),
+			Tracked:    true,
+		}
+		notMnt, err := util.Mounter().IsLikelyNotMountPoint(target)
+		if err != nil && !os.IsNotExist(err) {
+			debug.Errors = append(debug.Errors, err.Error())
+		}
+		publish.Mounted = err == nil && !notMnt
+		if publish.Mounted && vol != nil {
+			publish.Stale = isStaleTarget(target, vol)
+		}
+		debug.Publishes = append(debug.Publishes, publish)
+	}
+	slices.SortFunc(debug.Publishes, func(a, b DebugPublish) int {
+		return strings.Compare(a.TargetPath, b.TargetPath)
+	})
+
+	if vol == nil {
+		return debug
+	}
+	debug.CachePath = vol.Path()
+	mounts, err := cacheConsumers(vol.Path())
+	if err != nil {
+		klog.Warningf("Could not find mounts of the cache for debugging: %v", err)
+		debug.Errors = append(debug.Errors, err.Error())
+		return debug
+	}
+	slices.Sort(mounts)
+	for _, target := range mounts {
+		if _, found := tracked[target]; found || targetPodUID(target) == "" {
+			continue
+		}
+		debug.Publishes = append(debug.Publishes, DebugPublish{
+			TargetPath: target,
+			PodUID:     targetPodUID(target),
+			Mounted:    true,
+		})
+	}
+	return debug
+}
@@ -0,0 +1,64 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package csi
+
+import (
+	"path/filepath"
+	"testing"
+
+	"gotest.tools/v3/assert"
+
+	"github.com/GoogleCloudPlatform/csi-node-cache/pkg/localvolume"
+)
+
+func TestDebugPublishes(t *testing.T) {
+	d := &Driver{checkpoint: checkpoint{Targets: map[string]publishedTarget{}}}
+	debug := d.debugPublishes()
+	assert.DeepEqual(t, debug, DebugPublishes{Publishes: []DebugPublish{}})
+
+	vol, err := localvolume.NewFromPath(t.TempDir())
+	assert.NilError(t, err)
+	unmounted := filepath.Join(t.TempDir(), "pods", "uid-a", "volumes", "kubernetes.io~csi", "pv", "mount")
+	missing := filepath.Join(t.TempDir(), "missing")
+	d.vol = vol
+	d.checkpointVolumeType("tmpfs")
+	d.checkpointPublish(unmounted, "vol-a", true)
+	d.checkpointPublish(missing, "vol-b", false)
+	// procfs is mounted, but not the cache.
+	d.checkpointPublish("/proc", "vol-c", false)
+
+	debug = d.debugPublishes()
+	assert.Equal(t, debug.VolumeType, "tmpfs")
+	assert.Equal(t, debug.CachePath, vol.Path())
+	assert.Equal(t, len(debug.Errors), 0, "%v", debug.Errors)
+	want := map[string]DebugPublish{
+		unmounted: {TargetPath: unmounted, VolumeID: "vol-a", ReadOnly: true, PodUID: "uid-a", Tracked: true},
+		missing:   {TargetPath: missing, VolumeID: "vol-b", Tracked: true},
+		"/proc":   {TargetPath: "/proc", VolumeID: "vol-c", Tracked: true, Mounted: true, Stale: true},
+	}
+	assert.Equal(t, len(debug.Publishes), len(want))
+	for _, publish := range debug.Publishes {
+		assert.DeepEqual(t, publish, want[publish.TargetPath])
+	}
+}
+
+func TestCheckLoopback(t *testing.T) {
+	for _, addr := range []string{"localhost:9092", "127.0.0.1:9092", "[::1]:9092"} {
+		assert.NilError(t, checkLoopback(addr), addr)
+	}
+	for _, addr := range []string{":9092", "0.0.0.0:9092", "10.0.0.2:9092", "[::]:9092", "node:9092", "localhost"} {
+		assert.Assert(t, checkLoopback(addr) != nil, addr)
+	}
+}
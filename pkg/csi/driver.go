@@ -16,102 +16,551 @@ package csi
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"net"
 	"net/url"
 	"os"
 	"path/filepath"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
 	"google.golang.org/grpc"
+	storagev1 "k8s.io/api/storage/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/record"
 	"k8s.io/klog/v2"
 
+	"github.com/GoogleCloudPlatform/csi-node-cache/pkg/budget"
+	"github.com/GoogleCloudPlatform/csi-node-cache/pkg/gcs"
 	"github.com/GoogleCloudPlatform/csi-node-cache/pkg/localvolume"
+	"github.com/GoogleCloudPlatform/csi-node-cache/pkg/util"
 )
 
 type VolumeCreatorFunc func() (localvolume.LocalVolume, error)
 
+// DriverOptions configures the driver created by NewDriver.
+type DriverOptions struct {
+	// Endpoint is the csi socket.
+	Endpoint string
+	// NodeId is the id to use for csi registration.
+	NodeId string
+	// VolumeTypeMap locates the volume type config map written by the controller.
+	VolumeTypeMap types.NamespacedName
+	// MissingMappingGrace is how long the node is waited for in the volume
+	// type map when creating the cache, before warning that it is missing.
+	MissingMappingGrace time.Duration
+	DriverName          string
+	DriverVersion       string
+	// GitCommit and BuildDate describe the driver build. If unset, they are
+	// taken from the version control information in the binary, if any.
+	GitCommit string
+	BuildDate string
+	// AliasDriverName, if set, is a second driver name served on
+	// AliasEndpoint, for example the old name while migrating pods to a new
+	// one. Volumes of both names share the cache.
+	AliasDriverName string
+	AliasEndpoint   string
+	// DisableTopology stops the node from reporting its cache type and size
+	// as CSI topology, and the capability from being advertised.
+	DisableTopology bool
+	// MaxInflightMounts limits concurrent mount and format operations. Zero means no limit.
+	MaxInflightMounts int
+	// MkfsOptions are extra mkfs.ext4 arguments used when formatting lssd,
+	// pd and mirrored caches.
+	MkfsOptions []string
+	// LocalSSDDiscard mounts local SSD caches with the discard option.
+	LocalSSDDiscard bool
+	// MirroredDegradedStart allows a mirrored cache to start from local SSD
+	// only, adding the PD once it is attached.
+	MirroredDegradedStart bool
+	// MirrorSpareDevices are hot spares for mirrored caches. Local SSDs
+	// listed here are not used in the local SSD array.
+	MirrorSpareDevices []string
+	// ScaleDownUtilization, if positive, protects the node from cluster
+	// autoscaler scale down while the cache is at least this fraction full.
+	ScaleDownUtilization float64
+	// ScaleDownActivity, if positive, protects the node from scale down for
+	// this long after the cache was last published.
+	ScaleDownActivity time.Duration
+	// FlushURL, if set, is a gs://bucket/prefix location the cache is
+	// uploaded to when a flush is requested. See common.FlushAnnotation.
+	FlushURL string
+	// FlushPaths are the directories in the cache to flush. If empty the
+	// whole cache is flushed.
+	FlushPaths []string
+	// FlushOnDrain also flushes the cache when the node is cordoned.
+	FlushOnDrain bool
+	// PrewarmURL, if set, is a gs://bucket/prefix location downloaded into
+	// each new cache. PrewarmConcurrency and PrewarmChunkSize tune the
+	// download; zero uses the prewarm package defaults.
+	PrewarmURL         string
+	PrewarmConcurrency int
+	PrewarmChunkSize   int64
+	// PeerAddress, if set, is the host:port on the pod network the cache is
+	// served to other nodes on, so that they may be seeded from it. New
+	// caches are seeded from the donor chosen by the controller, if any.
+	PeerAddress string
+	// PeerTokenFile is a service account token for transfer.Audience sent to
+	// peers, which only serve PeerServiceAccount in the driver's namespace.
+	PeerTokenFile      string
+	PeerServiceAccount string
+	// PeerCertDir holds the certificate peers are served with, and the CA
+	// that peers' certificates are checked against, as described by
+	// transfer.ServerTLSConfig and transfer.ClientTLSConfig.
+	PeerCertDir string
+	// PeerBytesPerSecond, if positive, limits the rate the cache is served
+	// to peers at.
+	PeerBytesPerSecond int64
+	// BackgroundBytesPerSecond and BackgroundIOPS, if positive, limit the
+	// I/O of background work: prewarms, seeding and flushes.
+	// BackgroundMaxLatency, if positive, is the mean latency of the cache
+	// device above which background work is paused.
+	BackgroundBytesPerSecond int64
+	BackgroundIOPS           int64
+	BackgroundMaxLatency     time.Duration
+	// PublishLatencySLO, if positive, is the p99 latency of publishes over
+	// PublishLatencyWindow above which a warning event is made on the node.
+	PublishLatencySLO    time.Duration
+	PublishLatencyWindow time.Duration
+	// SandboxRuntimeHandlers are the RuntimeClass handlers of sandboxed
+	// runtimes, such as runsc for gVisor. Publishes to their pods are checked
+	// to work from the sandbox.
+	SandboxRuntimeHandlers []string
+	// VolumeLifecycleModes are the lifecycle modes of volumes that may be
+	// published, Ephemeral and Persistent, as in the volumeLifecycleModes of
+	// the CSIDriver. If empty, both are.
+	VolumeLifecycleModes []string
+	// AllowedNamespaces and AllowedServiceAccounts, if either is set, restrict
+	// the pods that may mount the cache to those in one of the namespaces or
+	// running as one of the service accounts, given as namespace/name.
+	AllowedNamespaces      []string
+	AllowedServiceAccounts []string
+	// ReportConsumers writes the audit log of pods that have mounted the
+	// cache to the node with usage reports.
+	ReportConsumers bool
+	// ReportScore writes the cache score of the node, see
+	// common.CacheScoreAnnotation, with usage reports.
+	ReportScore bool
+	// ImageCachePath, if set, is where the container image store of lssd
+	// caches with common.ImageCacheSizeAnnotation is mounted, for containerd's
+	// snapshotter to use.
+	ImageCachePath string
+	// BootDiskPath, if set, is a directory on the node's boot disk holding
+	// the files of bootdisk and loop caches.
+	BootDiskPath string
+	// CacheRoot is the directory caches are mounted under. If empty,
+	// DefaultCacheRoot is used.
+	CacheRoot string
+	// CheckpointFile, if set, is where published targets are recorded so
+	// that they can be reconciled after a restart.
+	CheckpointFile string
+	// StateDir, if set, is a directory only the driver can read, where
+	// credentials from publish secrets are written while they are used. If
+	// empty, a private directory under the system temporary directory is
+	// made for them.
+	StateDir string
+	// ConfigFile, if set, is a YAML Config whose settings override these
+	// options, and which is reloaded when it changes.
+	ConfigFile string
+	// MemoryPressureShrink, if positive, is the fraction of its size a tmpfs
+	// cache is shrunk to while the node is under memory pressure.
+	MemoryPressureShrink float64
+	// HighPriorityReserve is the fraction of the cache reserved for high
+	// priority consumers; see common.PriorityAttribute.
+	HighPriorityReserve float64
+	// TmpfsMinFreeMemory is the memory of the node, out of its allocatable
+	// memory, that tmpfs caches are capped to leave free.
+	TmpfsMinFreeMemory resource.Quantity
+}
+
 // Driver is the object backing the CSI driver. It also implements identity and node services, q.v.
 type Driver struct {
-	client        *kubernetes.Clientset
-	endpoint      string
-	vol           localvolume.LocalVolume
+	client   *kubernetes.Clientset
+	endpoint string
+
+	// volMutex guards vol and the maintenance state. It is held while
+	// publishing, so that the volume can't be released from under a new bind
+	// mount.
+	volMutex sync.Mutex
+	vol      localvolume.LocalVolume
+	// createErr is the last failure to create vol, at createErrTime. It is
+	// returned by cacheVolume until createRetryInterval has passed.
+	createErr     error
+	createErrTime time.Time
+	// publishSecrets are the most recent secrets given to a publish, used to
+	// create vol for cache types needing credentials.
+	publishSecrets map[string]string
+	// volType is the type vol was created as.
+	volType string
+	// imageStore is the container image store in vol, if any.
+	imageStore localvolume.LocalVolume
+	// shrunkFrom is the size to restore vol to once memory pressure clears,
+	// while it is shrunk.
+	shrunkFrom resource.Quantity
+
+	inMaintenance bool
+	released      bool
+	// lastError is the most recent publish error, for usage reports.
+	lastError string
+	// lastPublish is the time of the most recent successful publish.
+	lastPublish time.Time
+	// consumers is the audit log of publishes.
+	consumers consumerLog
+
+	// opts are the options from flags, which a config file is applied to.
+	// current holds the resulting settings.
+	opts    DriverOptions
+	current atomic.Pointer[settings]
+
+	// checkpointMutex guards checkpoint, which is written to checkpointFile
+	// if it is set.
+	checkpointMutex sync.Mutex
+	checkpoint      checkpoint
+	checkpointFile  string
+
+	// stateDir is as in DriverOptions. If unset it is made on first use,
+	// with volMutex held.
+	stateDir string
+
 	nodeId        string
+	cacheRoot     string
 	volumeTypeMap types.NamespacedName
-	driverName    string
-	driverVersion string
+	// missingMappingGrace is as in DriverOptions.
+	missingMappingGrace time.Duration
+	driverName          string
+	driverVersion       string
+	gitCommit           string
+	buildDate           string
+	aliasName           string
+	aliasEndpoint       string
+	mountLimiter        *inflightLimiter
+	// disableTopology is set when topology is not reported.
+	disableTopology bool
+
+	// cachedMachineType is set once by machineType.
+	machineTypeOnce   sync.Once
+	cachedMachineType string
+
+	mirroredDegradedStart bool
+	localSSDDiscard       bool
+	mirrorSpares          []string
+	imageCachePath        string
+	bootDiskPath          string
+
+	gcs           *gcs.Client
+	flushLocation gcs.Location
+	flushPaths    []string
+	flushOnDrain  bool
+
+	memoryPressureShrink float64
+	tmpfsMinFree         resource.Quantity
+
+	highPriorityReserve float64
+	// lowPriorityOver is set when low priority data was last found over its
+	// share of the cache. It is guarded by volMutex.
+	lowPriorityOver bool
+
+	prewarmLocation gcs.Location
+	// prewarmShard is the shard of the prewarm location assigned to this
+	// node when vol was created, if it is in a shard group.
+	prewarmShard string
+	// prewarmCancel stops the prewarm of vol, if one is running, which closes
+	// prewarmDone. They are guarded by volMutex.
+	prewarmCancel context.CancelFunc
+	prewarmDone   chan struct{}
+
+	peerAddress        string
+	peerTokenFile      string
+	peerServiceAccount string
+	peerCertDir        string
+	peerBytesPerSecond int64
+
+	// background is the budget of background work, nil if unlimited.
+	background               *budget.Budget
+	backgroundBytesPerSecond int64
+	backgroundIOPS           int64
+	backgroundMaxLatency     time.Duration
+
+	// publishSLO tracks publish latency, nil if there is no SLO. Burns, and
+	// stale mounts, are reported as events by recorder.
+	publishSLO *publishSLO
+	recorder   record.EventRecorder
+
+	sandboxHandlers []string
+	lifecycleModes  []storagev1.VolumeLifecycleMode
+	// runtimeHandlers caches the handler of each RuntimeClass by name.
+	runtimeHandlers sync.Map
 }
 
 var _ csi.IdentityServer = &Driver{}
 var _ csi.NodeServer = &Driver{}
 
-// NewDriver creates a new local volume CSI driver using the given LocalVolumeCreator.
-// endpoint is the csi socket, and nodeId is the id to use for csi registration.
-func NewDriver(client *kubernetes.Clientset, endpoint, nodeId string, volumeTypeMap types.NamespacedName, driverName, driverVersion string) (*Driver, error) {
-	klog.V(4).Infof("Driver: %v version: %v running on %s", driverName, driverVersion, nodeId)
+// NewDriver creates a new local volume CSI driver.
+func NewDriver(client *kubernetes.Clientset, opts DriverOptions) (*Driver, error) {
+	klog.V(4).Infof("Driver: %v version: %v running on %s", opts.DriverName, opts.DriverVersion, opts.NodeId)
 
 	d := &Driver{
 		client:        client,
-		endpoint:      endpoint,
-		nodeId:        nodeId,
-		volumeTypeMap: volumeTypeMap,
-		driverName:    driverName,
-		driverVersion: driverVersion,
+		endpoint:      opts.Endpoint,
+		nodeId:        opts.NodeId,
+		cacheRoot:     opts.CacheRoot,
+		checkpoint:    checkpoint{Targets: map[string]publishedTarget{}},
+		volumeTypeMap: opts.VolumeTypeMap,
+
+		missingMappingGrace: opts.MissingMappingGrace,
+		driverName:          opts.DriverName,
+		driverVersion:       opts.DriverVersion,
+		gitCommit:           opts.GitCommit,
+		buildDate:           opts.BuildDate,
+		aliasName:           opts.AliasDriverName,
+		aliasEndpoint:       opts.AliasEndpoint,
+		mountLimiter:        newInflightLimiter(opts.MaxInflightMounts),
+
+		disableTopology: opts.DisableTopology,
+
+		mirroredDegradedStart: opts.MirroredDegradedStart,
+		localSSDDiscard:       opts.LocalSSDDiscard,
+		mirrorSpares:          opts.MirrorSpareDevices,
+		imageCachePath:        opts.ImageCachePath,
+		bootDiskPath:          opts.BootDiskPath,
+		flushPaths:            opts.FlushPaths,
+		flushOnDrain:          opts.FlushOnDrain,
+		checkpointFile:        opts.CheckpointFile,
+		stateDir:              opts.StateDir,
+		memoryPressureShrink:  opts.MemoryPressureShrink,
+		highPriorityReserve:   opts.HighPriorityReserve,
+		tmpfsMinFree:          opts.TmpfsMinFreeMemory,
+		peerAddress:           opts.PeerAddress,
+		peerTokenFile:         opts.PeerTokenFile,
+		peerServiceAccount:    opts.PeerServiceAccount,
+		peerCertDir:           opts.PeerCertDir,
+		peerBytesPerSecond:    opts.PeerBytesPerSecond,
+		sandboxHandlers:       opts.SandboxRuntimeHandlers,
+
+		backgroundBytesPerSecond: opts.BackgroundBytesPerSecond,
+		backgroundIOPS:           opts.BackgroundIOPS,
+		backgroundMaxLatency:     opts.BackgroundMaxLatency,
+		opts:                     opts,
+	}
+
+	if d.cacheRoot == "" {
+		d.cacheRoot = DefaultCacheRoot
+	}
+	d.fillBuildInfo()
+	buildInfo.WithLabelValues(d.driverVersion, d.gitCommit, d.buildDate, runtime.Version()).Set(1)
+
+	if opts.ConfigFile != "" {
+		if err := d.reloadConfig(); err != nil {
+			return nil, err
+		}
+	} else {
+		s, err := newSettings(opts)
+		if err != nil {
+			return nil, err
+		}
+		d.current.Store(s)
+	}
+
+	if (d.aliasName == "") != (d.aliasEndpoint == "") {
+		return nil, fmt.Errorf("an alias driver name and endpoint must be given together")
+	}
+	if d.aliasName != "" && (d.aliasName == d.driverName || d.aliasEndpoint == d.endpoint) {
+		return nil, fmt.Errorf("the alias driver name and endpoint must differ from the driver's")
+	}
+
+	lifecycleModes, err := parseLifecycleModes(opts.VolumeLifecycleModes)
+	if err != nil {
+		return nil, err
+	}
+	d.lifecycleModes = lifecycleModes
+
+	if opts.MemoryPressureShrink < 0 || opts.MemoryPressureShrink >= 1 {
+		return nil, fmt.Errorf("the memory pressure shrink must be a fraction less than 1, got %v", opts.MemoryPressureShrink)
+	}
+
+	if opts.HighPriorityReserve < 0 || opts.HighPriorityReserve >= 1 {
+		return nil, fmt.Errorf("the high priority reserve must be a fraction less than 1, got %v", opts.HighPriorityReserve)
+	}
+
+	if opts.BackgroundBytesPerSecond > 0 || opts.BackgroundIOPS > 0 || opts.BackgroundMaxLatency > 0 {
+		d.background = budget.New(opts.BackgroundBytesPerSecond, opts.BackgroundIOPS)
+	}
+
+	if opts.PublishLatencySLO > 0 {
+		if opts.PublishLatencyWindow <= 0 {
+			return nil, fmt.Errorf("a publish latency window is required with a publish latency SLO")
+		}
+		d.publishSLO = newPublishSLO(opts.PublishLatencySLO, opts.PublishLatencyWindow)
+	}
+	if client != nil {
+		d.recorder = newEventRecorder(client, d.driverName, d.nodeId)
+	}
+
+	if opts.PeerAddress != "" {
+		if host, _, err := net.SplitHostPort(opts.PeerAddress); err != nil || host == "" {
+			return nil, fmt.Errorf("the peer address must be a host:port reachable by other nodes, got %q", opts.PeerAddress)
+		}
+		if opts.PeerTokenFile == "" || opts.PeerServiceAccount == "" {
+			return nil, fmt.Errorf("a token file and service account are required to serve peers")
+		}
+		if opts.PeerCertDir == "" {
+			return nil, fmt.Errorf("a certificate directory is required to serve peers")
+		}
+	}
+
+	if opts.FlushURL != "" {
+		var err error
+		if d.flushLocation, err = gcs.ParseURL(opts.FlushURL); err != nil {
+			return nil, err
+		}
+		for _, p := range d.flushPaths {
+			if !filepath.IsLocal(p) {
+				return nil, fmt.Errorf("flush path %s is not within the cache", p)
+			}
+		}
+		if len(d.flushPaths) == 0 {
+			d.flushPaths = []string{"."}
+		}
+	}
+	if opts.PrewarmURL != "" {
+		var err error
+		if d.prewarmLocation, err = gcs.ParseURL(opts.PrewarmURL); err != nil {
+			return nil, err
+		}
+	}
+	if opts.FlushURL != "" || opts.PrewarmURL != "" {
+		var err error
+		if d.gcs, err = gcs.NewClient(context.Background()); err != nil {
+			return nil, err
+		}
+		d.gcs.SetBudget(d.background)
 	}
 
 	return d, nil
 }
 
 // Run will serve the CSI driver. Normally this will run forever; an error will be returned otherwise.
+// Mounts left by a previous run are cleaned up before serving. If an alias
+// driver name is configured, it is served as well, on its own endpoint.
 func (d *Driver) Run() error {
-	opts := []grpc.ServerOption{
-		grpc.UnaryInterceptor(logGRPC),
+	d.cleanupPreviousRun(context.Background())
+	d.reportCapacity(context.Background())
+	stop := make(chan struct{})
+	defer close(stop)
+	go grpcErrors.run(stop)
+
+	listener, err := listen(d.endpoint)
+	if err != nil {
+		return err
+	}
+	if d.aliasName == "" {
+		return d.serve(listener, d)
+	}
+
+	aliasListener, err := listen(d.aliasEndpoint)
+	if err != nil {
+		listener.Close()
+		return err
+	}
+	klog.V(2).Infof("Also serving as %s on %s", d.aliasName, d.aliasEndpoint)
+	errs := make(chan error, 2)
+	go func() { errs <- d.serve(listener, d) }()
+	go func() { errs <- d.serve(aliasListener, aliasIdentity{Driver: d, name: d.aliasName}) }()
+	return <-errs
+}
+
+// serve runs a CSI server with the given identity and the driver's node
+// service.
+func (d *Driver) serve(listener net.Listener, identity csi.IdentityServer) error {
+	server := grpc.NewServer(grpc.UnaryInterceptor(logGRPC))
+	csi.RegisterIdentityServer(server, identity)
+	csi.RegisterNodeServer(server, d)
+	if err := server.Serve(listener); err != nil {
+		return fmt.Errorf("serving failed: %w", err)
 	}
-	u, err := url.Parse(d.endpoint)
+	return nil
+}
+
+// listen creates a listener for a unix:/path or tcp://host:port endpoint.
+func listen(endpoint string) (net.Listener, error) {
+	u, err := url.Parse(endpoint)
 	if err != nil {
-		return fmt.Errorf("cannot parse endpoint %s: %w", d.endpoint, err)
+		return nil, fmt.Errorf("cannot parse endpoint %s: %w", endpoint, err)
 	}
 	var addr string
 	if u.Scheme == "unix" {
 		addr = u.Path
 		if err := os.Remove(addr); err != nil && !os.IsNotExist(err) {
-			return fmt.Errorf("failed to remove %s: %w", addr, err)
+			return nil, fmt.Errorf("failed to remove %s: %w", addr, err)
 		}
 
 		listenDir := filepath.Dir(addr)
 		if _, err := os.Stat(listenDir); err != nil {
 			if os.IsNotExist(err) {
-				return fmt.Errorf("expected Kubelet plugin watcher to create parent dir %s but did not find such a dir", listenDir)
+				return nil, fmt.Errorf("expected Kubelet plugin watcher to create parent dir %s but did not find such a dir", listenDir)
 			} else {
-				return fmt.Errorf("failed to stat %s: %w", listenDir, err)
+				return nil, fmt.Errorf("failed to stat %s: %w", listenDir, err)
 			}
 		}
 	} else if u.Scheme == "tcp" {
 		addr = u.Host
 	} else {
-		return fmt.Errorf("%v endpoint scheme not supported", u.Scheme)
+		return nil, fmt.Errorf("%v endpoint scheme not supported", u.Scheme)
 	}
 
 	listener, err := net.Listen(u.Scheme, addr)
 	if err != nil {
-		return fmt.Errorf("failed to listen: %w", err)
+		return nil, fmt.Errorf("failed to listen: %w", err)
 	}
-	server := grpc.NewServer(opts...)
-	csi.RegisterIdentityServer(server, d)
-	csi.RegisterNodeServer(server, d)
-	if err := server.Serve(listener); err != nil {
-		return fmt.Errorf("serving failed: %w", err)
+	return listener, nil
+}
+
+// cleanupPreviousRun removes bind mounts orphaned by pods deleted while the
+// driver was not running, and restores any checkpoint.
+func (d *Driver) cleanupPreviousRun(ctx context.Context) {
+	pods, err := d.podsOnNode(ctx)
+	if err != nil {
+		klog.Errorf("Could not list pods, stale mounts of deleted pods won't be cleaned up: %v", err)
+	} else if cleaned := cleanupOrphanMounts(d.cacheRoot, pods, util.Mounter()); cleaned > 0 {
+		klog.Infof("Cleaned up %d orphaned mounts", cleaned)
 	}
-	return nil
+	if d.checkpointFile != "" {
+		d.restoreCheckpoint(pods)
+	}
+}
+
+// setNodeAnnotation sets an annotation on the driver's node.
+func (d *Driver) setNodeAnnotation(ctx context.Context, key, value string) error {
+	return d.patchNodeAnnotations(ctx, map[string]*string{key: &value})
+}
+
+// patchNodeAnnotations sets annotations on the driver's node. Annotations with
+// a nil value are removed.
+func (d *Driver) patchNodeAnnotations(ctx context.Context, annotations map[string]*string) error {
+	patch, err := json.Marshal(map[string]any{
+		"metadata": map[string]any{
+			"annotations": annotations,
+		},
+	})
+	if err != nil {
+		return err
+	}
+	_, err = d.client.CoreV1().Nodes().Patch(ctx, d.nodeId, types.MergePatchType, patch, metav1.PatchOptions{})
+	return err
 }
 
 func logGRPC(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
-	klog.V(4).Infof("%s called with request: %+v", info.FullMethod, req)
+	klog.V(4).Infof("%s called with request: %+v", info.FullMethod, redactSecrets(req))
 	resp, err := handler(ctx, req)
 	if err != nil {
-		klog.Errorf("%s returned with error: %v", info.FullMethod, err)
+		grpcErrors.log(info.FullMethod, err, time.Now())
 	} else {
 		klog.V(4).Infof("%s returned with response: %+v", info.FullMethod, resp)
 	}
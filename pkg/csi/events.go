@@ -0,0 +1,267 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package csi
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// cacheEventWindow is how often hot directories are recomputed, and the
+	// cache is checked for a new or released volume to watch.
+	cacheEventWindow = time.Minute
+
+	// hotDirDepth is how many levels of directories under the cache root
+	// events are aggregated to, and hotDirCount how many of the busiest are
+	// reported, which bounds the cardinality of the hot directory metric.
+	hotDirDepth = 2
+	hotDirCount = 10
+)
+
+// RunCacheEventWatch watches the files of the cache until ctx is done,
+// counting files created and removed, and reporting the directories with the
+// most changes in each cacheEventWindow. At most maxWatches directories are
+// watched; changes in the rest are missed.
+func (d *Driver) RunCacheEventWatch(ctx context.Context, maxWatches int) {
+	var w *cacheWatcher
+	defer func() {
+		if w != nil {
+			w.close()
+		}
+	}()
+	wait.UntilWithContext(ctx, func(ctx context.Context) {
+		d.volMutex.Lock()
+		root := ""
+		if d.vol != nil && !d.released {
+			root = d.vol.Path()
+		}
+		d.volMutex.Unlock()
+
+		if w != nil && w.root == root {
+			reportHotDirs(w.takeCounts())
+			return
+		}
+		if w != nil {
+			w.close()
+			w = nil
+			reportHotDirs(nil)
+		}
+		if root == "" {
+			return
+		}
+		var err error
+		if w, err = newCacheWatcher(root, maxWatches); err != nil {
+			klog.Errorf("Could not watch cache events of %s: %v", root, err)
+		}
+	}, cacheEventWindow)
+}
+
+// cacheWatcher watches a tree of directories with inotify, which has no
+// recursive watches, so that new directories are added as they are created.
+type cacheWatcher struct {
+	root       string
+	maxWatches int
+	watcher    *fsnotify.Watcher
+	done       chan struct{}
+
+	mutex sync.Mutex
+	// watched are the directories watched. inotify drops the watch of a
+	// directory when it is removed.
+	watched map[string]bool
+	// full is set once the limit of watches has been reached.
+	full bool
+	// counts are the changes in each hot directory since the last takeCounts.
+	counts map[string]int
+}
+
+func newCacheWatcher(root string, maxWatches int) (*cacheWatcher, error) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	w := &cacheWatcher{
+		root:       root,
+		maxWatches: maxWatches,
+		watcher:    watcher,
+		done:       make(chan struct{}),
+		watched:    map[string]bool{},
+		counts:     map[string]int{},
+	}
+	if err := w.addTree(root); err != nil {
+		watcher.Close()
+		return nil, err
+	}
+	go w.run()
+	return w, nil
+}
+
+// addTree watches dir and the directories under it, other than the private
+// directory.
+func (w *cacheWatcher) addTree(dir string) error {
+	return filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if !entry.IsDir() {
+			return nil
+		}
+		if isPrivateDir(w.root, path) {
+			return filepath.SkipDir
+		}
+		w.mutex.Lock()
+		full := len(w.watched) >= w.maxWatches
+		warn := full && !w.full
+		if full {
+			w.full = true
+		} else {
+			w.watched[path] = true
+		}
+		w.mutex.Unlock()
+		if warn {
+			klog.Warningf("Watching the limit of %d directories, changes under %s and other new directories are not counted", w.maxWatches, path)
+		}
+		if full {
+			return filepath.SkipAll
+		}
+		if err := w.watcher.Add(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		return nil
+	})
+}
+
+func (w *cacheWatcher) run() {
+	defer close(w.done)
+	for {
+		select {
+		case event, ok := <-w.watcher.Events:
+			if !ok {
+				return
+			}
+			w.handle(event)
+		case err, ok := <-w.watcher.Errors:
+			if !ok {
+				return
+			}
+			// This includes queue overflows, when events have been lost.
+			klog.Warningf("Cache event watch of %s: %v", w.root, err)
+		}
+	}
+}
+
+func (w *cacheWatcher) handle(event fsnotify.Event) {
+	if isBookkeepingFile(filepath.Base(event.Name)) || isPrivateDir(w.root, event.Name) {
+		return
+	}
+	switch {
+	case event.Has(fsnotify.Create):
+		cacheFilesCreated.Inc()
+		if info, err := os.Lstat(event.Name); err == nil && info.IsDir() {
+			if err := w.addTree(event.Name); err != nil {
+				klog.Warningf("Could not watch new directory %s: %v", event.Name, err)
+			}
+		}
+	case event.Has(fsnotify.Remove):
+		cacheFilesRemoved.Inc()
+		w.mutex.Lock()
+		delete(w.watched, event.Name)
+		w.mutex.Unlock()
+		if event.Name == w.root {
+			return
+		}
+	case !event.Has(fsnotify.Write) && !event.Has(fsnotify.Rename):
+		return
+	}
+	dir := hotDir(w.root, event.Name)
+	w.mutex.Lock()
+	w.counts[dir]++
+	w.mutex.Unlock()
+}
+
+// takeCounts returns the changes in each hot directory since it was last
+// called.
+func (w *cacheWatcher) takeCounts() map[string]int {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	counts := w.counts
+	w.counts = map[string]int{}
+	return counts
+}
+
+func (w *cacheWatcher) isWatched(dir string) bool {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	return w.watched[dir]
+}
+
+func (w *cacheWatcher) close() {
+	w.watcher.Close()
+	<-w.done
+}
+
+// hotDir returns the directory, relative to root, that a change to path is
+// counted in: the directory holding it, cut to hotDirDepth levels.
+func hotDir(root, path string) string {
+	rel, err := filepath.Rel(root, filepath.Dir(path))
+	if err != nil || rel == "." || strings.HasPrefix(rel, "..") {
+		return "."
+	}
+	parts := strings.Split(rel, string(filepath.Separator))
+	if len(parts) > hotDirDepth {
+		parts = parts[:hotDirDepth]
+	}
+	return strings.Join(parts, "/")
+}
+
+// topDirs returns the n directories with the most changes, most first.
+func topDirs(counts map[string]int, n int) []string {
+	dirs := make([]string, 0, len(counts))
+	for dir := range counts {
+		dirs = append(dirs, dir)
+	}
+	slices.SortFunc(dirs, func(a, b string) int {
+		if counts[a] != counts[b] {
+			return counts[b] - counts[a]
+		}
+		return strings.Compare(a, b)
+	})
+	if len(dirs) > n {
+		dirs = dirs[:n]
+	}
+	return dirs
+}
+
+// reportHotDirs replaces the hot directory metric with the busiest of counts.
+func reportHotDirs(counts map[string]int) {
+	cacheHotDirChanges.Reset()
+	for _, dir := range topDirs(counts, hotDirCount) {
+		cacheHotDirChanges.WithLabelValues(dir).Set(float64(counts[dir]))
+	}
+}
@@ -0,0 +1,73 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package csi
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"gotest.tools/v3/assert"
+)
+
+func TestHotDir(t *testing.T) {
+	for path, expected := range map[string]string{
+		"/local/lssd/a":                     ".",
+		"/local/lssd/models/a":              "models",
+		"/local/lssd/models/llm/a":          "models/llm",
+		"/local/lssd/models/llm/v1/shard/a": "models/llm",
+		"/elsewhere/a":                      ".",
+	} {
+		assert.Equal(t, hotDir("/local/lssd", path), expected, path)
+	}
+}
+
+func TestTopDirs(t *testing.T) {
+	counts := map[string]int{"a": 3, "b": 10, "c": 3, "d": 1}
+	assert.DeepEqual(t, topDirs(counts, 3), []string{"b", "a", "c"})
+	assert.DeepEqual(t, topDirs(counts, 10), []string{"b", "a", "c", "d"})
+	assert.DeepEqual(t, topDirs(nil, 10), []string{})
+}
+
+func TestCacheWatcher(t *testing.T) {
+	root := t.TempDir()
+	assert.NilError(t, os.MkdirAll(filepath.Join(root, "models"), 0750))
+	w, err := newCacheWatcher(root, 3)
+	assert.NilError(t, err)
+	defer w.close()
+
+	// A new directory is watched, so the file created in it is counted.
+	assert.NilError(t, os.MkdirAll(filepath.Join(root, "models", "llm"), 0750))
+	deadline := time.Now().Add(10 * time.Second)
+	for !w.isWatched(filepath.Join(root, "models", "llm")) {
+		assert.Assert(t, time.Now().Before(deadline), "new directory not watched")
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.NilError(t, os.WriteFile(filepath.Join(root, "models", "llm", "weights"), []byte("w"), 0640))
+	// Over the limit of watches.
+	assert.NilError(t, os.MkdirAll(filepath.Join(root, "other"), 0750))
+
+	counts := map[string]int{}
+	for counts["models/llm"] == 0 {
+		assert.Assert(t, time.Now().Before(deadline), "file not counted, got %v", counts)
+		time.Sleep(10 * time.Millisecond)
+		for dir, n := range w.takeCounts() {
+			counts[dir] += n
+		}
+	}
+	assert.Assert(t, counts["models"] > 0)
+	assert.Assert(t, !w.isWatched(filepath.Join(root, "other")))
+}
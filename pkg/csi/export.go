@@ -0,0 +1,209 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package csi
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/client-go/util/retry"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	"github.com/GoogleCloudPlatform/csi-node-cache/pkg/gcs"
+)
+
+// FleetReport is the cache configuration and state of a cluster, exported so
+// that caches can be seen across a fleet of clusters.
+type FleetReport struct {
+	Cluster string            `json:"cluster"`
+	Time    metav1.Time       `json:"time"`
+	Nodes   []NodeCacheStatus `json:"nodes"`
+}
+
+// ExportOptions configures the export of fleet reports.
+type ExportOptions struct {
+	// Cluster names the cluster in the fleet. It is required to export.
+	Cluster string
+	// Interval is how often the report is exported.
+	Interval time.Duration
+	// URL, if set, is a gs:// location the report is written to as
+	// <cluster>.json.
+	URL string
+	// Kubeconfig and ConfigMap, if set, are the kubeconfig of a fleet cluster
+	// and the namespace/name of a ConfigMap there the report is written to,
+	// keyed by the cluster.
+	Kubeconfig string
+	ConfigMap  string
+}
+
+// enabled returns true if the report is exported anywhere.
+func (o ExportOptions) enabled() bool {
+	return o.URL != "" || o.ConfigMap != ""
+}
+
+// reportSink is somewhere reports are exported to.
+type reportSink interface {
+	publish(ctx context.Context, cluster string, report []byte) error
+	String() string
+}
+
+// gcsSink writes reports as objects in a bucket.
+type gcsSink struct {
+	client   *gcs.Client
+	location gcs.Location
+}
+
+func (s *gcsSink) publish(ctx context.Context, cluster string, report []byte) error {
+	return s.client.Put(ctx, report, s.location.Join(cluster+".json"), "application/json")
+}
+
+func (s *gcsSink) String() string {
+	return s.location.String()
+}
+
+// configMapSink writes reports to a ConfigMap, usually in another cluster,
+// with a key for each cluster.
+type configMapSink struct {
+	client kubernetes.Interface
+	name   types.NamespacedName
+}
+
+func (s *configMapSink) publish(ctx context.Context, cluster string, report []byte) error {
+	// Several clusters write to the ConfigMap, so conflicts are expected.
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		configMaps := s.client.CoreV1().ConfigMaps(s.name.Namespace)
+		configMap, err := configMaps.Get(ctx, s.name.Name, metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			configMap = &corev1.ConfigMap{
+				ObjectMeta: metav1.ObjectMeta{Namespace: s.name.Namespace, Name: s.name.Name},
+				Data:       map[string]string{cluster: string(report)},
+			}
+			_, err = configMaps.Create(ctx, configMap, metav1.CreateOptions{})
+			if apierrors.IsAlreadyExists(err) {
+				// Treated as a conflict so that the update is retried.
+				return apierrors.NewConflict(corev1.Resource("configmaps"), s.name.Name, err)
+			}
+			return err
+		} else if err != nil {
+			return err
+		}
+		if configMap.Data == nil {
+			configMap.Data = map[string]string{}
+		}
+		configMap.Data[cluster] = string(report)
+		_, err = configMaps.Update(ctx, configMap, metav1.UpdateOptions{})
+		return err
+	})
+}
+
+func (s *configMapSink) String() string {
+	return "configmap " + s.name.String()
+}
+
+// fleetExporter periodically exports a report of the caches in the cluster.
+type fleetExporter struct {
+	cluster  string
+	interval time.Duration
+	inspect  func(ctx context.Context) ([]NodeCacheStatus, error)
+	sinks    []reportSink
+}
+
+// newFleetExporter creates an exporter of the caches in the volume type map
+// and on nodes to the sinks given by opts.
+func newFleetExporter(ctx context.Context, client kubernetes.Interface, volumeTypeMap types.NamespacedName, opts ExportOptions) (*fleetExporter, error) {
+	if opts.Cluster == "" {
+		return nil, fmt.Errorf("a cluster name is required to export reports")
+	}
+	if opts.Interval <= 0 {
+		return nil, fmt.Errorf("the export interval must be positive, got %v", opts.Interval)
+	}
+	e := &fleetExporter{
+		cluster:  opts.Cluster,
+		interval: opts.Interval,
+		inspect: func(ctx context.Context) ([]NodeCacheStatus, error) {
+			return InspectNodeCaches(ctx, client, volumeTypeMap)
+		},
+	}
+	if opts.URL != "" {
+		location, err := gcs.ParseURL(opts.URL)
+		if err != nil {
+			return nil, err
+		}
+		gcsClient, err := gcs.NewClient(ctx)
+		if err != nil {
+			return nil, err
+		}
+		e.sinks = append(e.sinks, &gcsSink{client: gcsClient, location: location})
+	}
+	if opts.ConfigMap != "" {
+		namespace, name, found := strings.Cut(opts.ConfigMap, "/")
+		if !found || namespace == "" || name == "" {
+			return nil, fmt.Errorf("the export ConfigMap must be given as namespace/name, got %q", opts.ConfigMap)
+		}
+		fleetClient := client
+		if opts.Kubeconfig != "" {
+			cfg, err := clientcmd.BuildConfigFromFlags("", opts.Kubeconfig)
+			if err != nil {
+				return nil, fmt.Errorf("Could not load fleet kubeconfig: %w", err)
+			}
+			if fleetClient, err = kubernetes.NewForConfig(cfg); err != nil {
+				return nil, fmt.Errorf("Could not create fleet client: %w", err)
+			}
+		}
+		e.sinks = append(e.sinks, &configMapSink{client: fleetClient, name: types.NamespacedName{Namespace: namespace, Name: name}})
+	}
+	return e, nil
+}
+
+// Start implements manager.Runnable, exporting reports until ctx is done.
+func (e *fleetExporter) Start(ctx context.Context) error {
+	wait.UntilWithContext(ctx, func(ctx context.Context) {
+		if err := e.export(ctx, time.Now()); err != nil {
+			log.FromContext(ctx).Error(err, "fleet export")
+		}
+	}, e.interval)
+	return nil
+}
+
+// export publishes a report to every sink. A failing sink doesn't stop the
+// others.
+func (e *fleetExporter) export(ctx context.Context, now time.Time) error {
+	nodes, err := e.inspect(ctx)
+	if err != nil {
+		return err
+	}
+	report, err := json.Marshal(FleetReport{Cluster: e.cluster, Time: metav1.NewTime(now), Nodes: nodes})
+	if err != nil {
+		return err
+	}
+	var errs []error
+	for _, sink := range e.sinks {
+		if err := sink.publish(ctx, e.cluster, report); err != nil {
+			errs = append(errs, fmt.Errorf("export to %s: %w", sink, err))
+		}
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,79 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package csi
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"gotest.tools/v3/assert"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+type recordingSink struct {
+	name    string
+	reports map[string][]byte
+	err     error
+}
+
+func (s *recordingSink) publish(ctx context.Context, cluster string, report []byte) error {
+	if s.err != nil {
+		return s.err
+	}
+	s.reports[cluster] = report
+	return nil
+}
+
+func (s *recordingSink) String() string {
+	return s.name
+}
+
+func TestFleetExport(t *testing.T) {
+	good := &recordingSink{name: "good", reports: map[string][]byte{}}
+	bad := &recordingSink{name: "bad", err: errors.New("unavailable")}
+	e := &fleetExporter{
+		cluster: "prod-us",
+		inspect: func(ctx context.Context) ([]NodeCacheStatus, error) {
+			return []NodeCacheStatus{{Node: "node-1", VolumeType: "lssd", Size: "375Gi"}}, nil
+		},
+		sinks: []reportSink{bad, good},
+	}
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	err := e.export(context.Background(), now)
+	assert.ErrorContains(t, err, "export to bad: unavailable")
+
+	var report FleetReport
+	assert.NilError(t, json.Unmarshal(good.reports["prod-us"], &report))
+	assert.Equal(t, report.Cluster, "prod-us")
+	assert.Assert(t, report.Time.Time.Equal(now))
+	assert.DeepEqual(t, report.Nodes, []NodeCacheStatus{{Node: "node-1", VolumeType: "lssd", Size: "375Gi"}})
+}
+
+func TestNewFleetExporter(t *testing.T) {
+	name := types.NamespacedName{Namespace: "node-cache", Name: "volume-type-map"}
+	ctx := context.Background()
+	_, err := newFleetExporter(ctx, nil, name, ExportOptions{Interval: time.Minute, ConfigMap: "fleet/caches"})
+	assert.ErrorContains(t, err, "cluster name is required")
+	_, err = newFleetExporter(ctx, nil, name, ExportOptions{Cluster: "c", Interval: time.Minute, ConfigMap: "caches"})
+	assert.ErrorContains(t, err, "namespace/name")
+
+	e, err := newFleetExporter(ctx, nil, name, ExportOptions{Cluster: "c", Interval: time.Minute, ConfigMap: "fleet/caches"})
+	assert.NilError(t, err)
+	assert.Equal(t, len(e.sinks), 1)
+	assert.Equal(t, e.sinks[0].String(), "configmap fleet/caches")
+}
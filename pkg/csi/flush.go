@@ -0,0 +1,104 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package csi
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path/filepath"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/klog/v2"
+
+	"github.com/GoogleCloudPlatform/csi-node-cache/pkg/common"
+)
+
+// flushRequested returns true if the cache on node should be flushed to GCS,
+// either by request or because the node is being drained.
+func flushRequested(node *corev1.Node, onDrain bool) bool {
+	if node.GetAnnotations()[common.FlushAnnotation] == common.FlushRequested {
+		return true
+	}
+	return onDrain && node.Spec.Unschedulable
+}
+
+// checkFlush uploads the cache to the flush location when requested. The
+// flush is done once per request; the state is cleared when the request is
+// withdrawn, or the node is uncordoned.
+func (d *Driver) checkFlush(ctx context.Context, node *corev1.Node) {
+	if d.gcs == nil {
+		return
+	}
+	state, found := node.GetAnnotations()[common.FlushStateAnnotation]
+	if !flushRequested(node, d.flushOnDrain) {
+		if found {
+			if err := d.patchNodeAnnotations(ctx, map[string]*string{common.FlushStateAnnotation: nil}); err != nil {
+				klog.Errorf("Could not clear flush state: %v", err)
+			}
+		}
+		return
+	}
+	if state == common.FlushDone || state == common.FlushFailed {
+		return
+	}
+
+	d.volMutex.Lock()
+	if d.vol == nil && !d.released {
+		_, err := d.cacheVolume(ctx)
+		var pending *common.VolumePendingError
+		if err != nil && !errors.As(err, &pending) {
+			d.volMutex.Unlock()
+			klog.Errorf("Could not find cache volume to flush, will retry: %v", err)
+			return
+		}
+	}
+	vol := d.vol
+	d.volMutex.Unlock()
+
+	state = common.FlushDone
+	if vol == nil {
+		klog.Infof("No cache volume to flush")
+	} else {
+		if err := d.setNodeAnnotation(ctx, common.FlushStateAnnotation, common.FlushRunning); err != nil {
+			klog.Errorf("Could not mark node flushing: %v", err)
+		}
+		if err := d.flush(ctx, vol.Path()); err != nil {
+			klog.Errorf("Cache flush failed: %v", err)
+			state = common.FlushFailed
+		}
+	}
+	if err := d.setNodeAnnotation(ctx, common.FlushStateAnnotation, state); err != nil {
+		klog.Errorf("Could not set flush state to %s: %v", state, err)
+	}
+}
+
+// flush uploads the flush paths under root, other than the driver's own files.
+func (d *Driver) flush(ctx context.Context, root string) error {
+	total := 0
+	for _, p := range d.flushPaths {
+		dst := d.flushLocation.Join(filepath.ToSlash(p))
+		count, err := d.gcs.UploadDir(ctx, filepath.Join(root, p), dst, func(rel string, entry fs.DirEntry) bool {
+			return isPrivatePath(filepath.Join(p, rel)) || !entry.IsDir() && isBookkeepingFile(entry.Name())
+		})
+		total += count
+		if err != nil {
+			return fmt.Errorf("Could not flush %s to %s: %w", p, dst, err)
+		}
+	}
+	klog.Infof("Flushed %d files to %s", total, d.flushLocation)
+	return nil
+}
@@ -0,0 +1,37 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package csi
+
+import (
+	"testing"
+
+	"gotest.tools/v3/assert"
+	corev1 "k8s.io/api/core/v1"
+
+	"github.com/GoogleCloudPlatform/csi-node-cache/pkg/common"
+)
+
+func TestFlushRequested(t *testing.T) {
+	var node corev1.Node
+	assert.Assert(t, !flushRequested(&node, true))
+
+	node.Spec.Unschedulable = true
+	assert.Assert(t, flushRequested(&node, true))
+	assert.Assert(t, !flushRequested(&node, false))
+
+	node.Spec.Unschedulable = false
+	node.SetAnnotations(map[string]string{common.FlushAnnotation: common.FlushRequested})
+	assert.Assert(t, flushRequested(&node, false))
+}
@@ -15,23 +15,95 @@
 package csi
 
 import (
+	"runtime/debug"
+
 	"github.com/container-storage-interface/spec/lib/go/csi"
 	"golang.org/x/net/context"
 )
 
+// Keys of the build information in the plugin info manifest.
+const (
+	manifestGitCommit = "git-commit"
+	manifestBuildDate = "build-date"
+)
+
 func (d *Driver) GetPluginInfo(ctx context.Context, req *csi.GetPluginInfoRequest) (*csi.GetPluginInfoResponse, error) {
-	return &csi.GetPluginInfoResponse{
+	resp := &csi.GetPluginInfoResponse{
 		Name:          d.driverName,
 		VendorVersion: d.driverVersion,
-	}, nil
+	}
+	if d.gitCommit != "" || d.buildDate != "" {
+		resp.Manifest = map[string]string{}
+		if d.gitCommit != "" {
+			resp.Manifest[manifestGitCommit] = d.gitCommit
+		}
+		if d.buildDate != "" {
+			resp.Manifest[manifestBuildDate] = d.buildDate
+		}
+	}
+	return resp, nil
 }
 
-func (*Driver) GetPluginCapabilities(ctx context.Context, req *csi.GetPluginCapabilitiesRequest) (*csi.GetPluginCapabilitiesResponse, error) {
+// fillBuildInfo sets the commit and build date from the version control
+// information that go build embeds, if they weren't given at build time.
+func (d *Driver) fillBuildInfo() {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return
+	}
+	for _, setting := range info.Settings {
+		switch {
+		case setting.Key == "vcs.revision" && d.gitCommit == "":
+			d.gitCommit = setting.Value
+		case setting.Key == "vcs.time" && d.buildDate == "":
+			d.buildDate = setting.Value
+		}
+	}
+}
+
+func (d *Driver) GetPluginCapabilities(ctx context.Context, req *csi.GetPluginCapabilitiesRequest) (*csi.GetPluginCapabilitiesResponse, error) {
 	return &csi.GetPluginCapabilitiesResponse{
-		// No capabilities are advertised.
+		Capabilities: d.pluginCapabilities(),
 	}, nil
 }
 
+// pluginCapabilities are the capabilities of the features enabled on the
+// driver, which sidecars such as the node-driver-registrar use to decide what
+// to call. There is no controller service, so only node features appear.
+func (d *Driver) pluginCapabilities() []*csi.PluginCapability {
+	caps := []*csi.PluginCapability{}
+	if !d.disableTopology {
+		// The node reports its cache type and size as topology.
+		caps = append(caps, serviceCapability(csi.PluginCapability_Service_VOLUME_ACCESSIBILITY_CONSTRAINTS))
+	}
+	return caps
+}
+
+func serviceCapability(t csi.PluginCapability_Service_Type) *csi.PluginCapability {
+	return &csi.PluginCapability{
+		Type: &csi.PluginCapability_Service_{
+			Service: &csi.PluginCapability_Service{Type: t},
+		},
+	}
+}
+
 func (*Driver) Probe(ctx context.Context, req *csi.ProbeRequest) (*csi.ProbeResponse, error) {
 	return &csi.ProbeResponse{}, nil
 }
+
+// aliasIdentity is the identity service of the driver under an alternate
+// driver name. The driver's node service is served alongside it, so that pods
+// using either name share the same cache.
+type aliasIdentity struct {
+	*Driver
+	name string
+}
+
+func (a aliasIdentity) GetPluginInfo(ctx context.Context, req *csi.GetPluginInfoRequest) (*csi.GetPluginInfoResponse, error) {
+	resp, err := a.Driver.GetPluginInfo(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Name = a.name
+	return resp, nil
+}
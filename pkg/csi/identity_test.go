@@ -0,0 +1,80 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package csi
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"gotest.tools/v3/assert"
+)
+
+func TestAliasDriverName(t *testing.T) {
+	d := &Driver{driverName: "new.csi.example.com", driverVersion: "v1"}
+	for _, testCase := range []struct {
+		identity csi.IdentityServer
+		expected string
+	}{
+		{d, "new.csi.example.com"},
+		{aliasIdentity{Driver: d, name: "old.csi.example.com"}, "old.csi.example.com"},
+	} {
+		listener, err := listen("unix:" + filepath.Join(t.TempDir(), "csi.sock"))
+		assert.NilError(t, err)
+		go d.serve(listener, testCase.identity)
+
+		conn, err := grpc.Dial("unix:"+listener.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+		assert.NilError(t, err)
+		resp, err := csi.NewIdentityClient(conn).GetPluginInfo(context.Background(), &csi.GetPluginInfoRequest{})
+		assert.NilError(t, err)
+		assert.Equal(t, resp.GetName(), testCase.expected)
+		assert.Equal(t, resp.GetVendorVersion(), "v1")
+		conn.Close()
+		listener.Close()
+	}
+}
+
+func TestPluginCapabilities(t *testing.T) {
+	d := &Driver{}
+	resp, err := d.GetPluginCapabilities(context.Background(), &csi.GetPluginCapabilitiesRequest{})
+	assert.NilError(t, err)
+	assert.Equal(t, len(resp.GetCapabilities()), 1)
+	assert.Equal(t, resp.GetCapabilities()[0].GetService().GetType(), csi.PluginCapability_Service_VOLUME_ACCESSIBILITY_CONSTRAINTS)
+
+	d.disableTopology = true
+	resp, err = d.GetPluginCapabilities(context.Background(), &csi.GetPluginCapabilitiesRequest{})
+	assert.NilError(t, err)
+	assert.Equal(t, len(resp.GetCapabilities()), 0)
+
+	info, err := d.NodeGetInfo(context.Background(), &csi.NodeGetInfoRequest{})
+	assert.NilError(t, err)
+	assert.Assert(t, info.GetAccessibleTopology() == nil)
+}
+
+func TestPluginInfoManifest(t *testing.T) {
+	d := &Driver{driverName: "node-cache.csi.storage.gke.io", driverVersion: "v1"}
+	resp, err := d.GetPluginInfo(context.Background(), &csi.GetPluginInfoRequest{})
+	assert.NilError(t, err)
+	assert.Assert(t, resp.GetManifest() == nil)
+
+	d.gitCommit = "0123abc"
+	d.buildDate = "2024-06-01T12:00:00Z"
+	resp, err = d.GetPluginInfo(context.Background(), &csi.GetPluginInfoRequest{})
+	assert.NilError(t, err)
+	assert.DeepEqual(t, resp.GetManifest(), map[string]string{"git-commit": "0123abc", "build-date": "2024-06-01T12:00:00Z"})
+}
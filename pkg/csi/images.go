@@ -0,0 +1,95 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package csi
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/klog/v2"
+
+	"github.com/GoogleCloudPlatform/csi-node-cache/pkg/localvolume"
+	"github.com/GoogleCloudPlatform/csi-node-cache/pkg/util"
+)
+
+// imageStoreFile is the file in the private directory of an lssd cache
+// holding the container image store filesystem. Its space is allocated when
+// it is created, so that it is dedicated to images rather than shared with the
+// rest of the cache.
+const imageStoreFile = "images.img"
+
+// legacyImageStoreFile is where the image store was kept at the top of the
+// cache, in reach of pods, before it moved to the private directory.
+const legacyImageStoreFile = ".images.img"
+
+// imageStorePath returns the path of the image store file in the cache at
+// cachePath, moving a store from its legacy location if there is one.
+func imageStorePath(cachePath string) (string, error) {
+	if err := makePrivateDir(cachePath); err != nil {
+		return "", err
+	}
+	file := privatePath(cachePath, imageStoreFile)
+	// Only a regular file is moved, as a pod could have put anything at the
+	// legacy location.
+	if info, err := os.Lstat(filepath.Join(cachePath, legacyImageStoreFile)); err != nil || !info.Mode().IsRegular() {
+		return file, nil
+	}
+	if _, err := os.Lstat(file); !os.IsNotExist(err) {
+		return file, nil
+	}
+	if err := util.RenameBeneath(cachePath, legacyImageStoreFile, filepath.Join(privateDir, imageStoreFile)); err != nil {
+		return "", err
+	}
+	klog.Infof("Moved the image store to %s", file)
+	return file, nil
+}
+
+// setupImageCache mounts the image store of size from the cache vol at the
+// image cache path, creating it if needed. volMutex must be held.
+func (d *Driver) setupImageCache(ctx context.Context, vol localvolume.LocalVolume, size resource.Quantity) error {
+	if d.imageCachePath == "" {
+		klog.Warningf("An image cache of %s is set for the node, but the driver has no image cache path", size.String())
+		return nil
+	}
+	file, err := imageStorePath(vol.Path())
+	if err != nil {
+		return fmt.Errorf("Could not set up image cache at %s: %w", d.imageCachePath, err)
+	}
+	store, err := localvolume.NewLoopFileVolume(ctx, file, d.imageCachePath, size)
+	if err != nil {
+		return fmt.Errorf("Could not set up image cache at %s: %w", d.imageCachePath, err)
+	}
+	klog.Infof("Image cache of %s mounted at %s", size.String(), d.imageCachePath)
+	d.imageStore = store
+	return nil
+}
+
+// releaseImageCache unmounts the image store, if any, so that the cache
+// holding it can be released. volMutex must be held.
+func (d *Driver) releaseImageCache(ctx context.Context) error {
+	if d.imageStore == nil {
+		return nil
+	}
+	if r, ok := d.imageStore.(localvolume.Releaser); ok {
+		if err := r.Release(ctx); err != nil {
+			return fmt.Errorf("Could not release image cache: %w", err)
+		}
+	}
+	d.imageStore = nil
+	return nil
+}
@@ -0,0 +1,59 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package csi
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"gotest.tools/v3/assert"
+)
+
+func TestImageStorePath(t *testing.T) {
+	root := t.TempDir()
+	writeFiles(t, root, map[string]string{legacyImageStoreFile: "images", "a": "1"})
+
+	file, err := imageStorePath(root)
+	assert.NilError(t, err)
+	rel, err := filepath.Rel(root, file)
+	assert.NilError(t, err)
+	assert.Assert(t, isPrivatePath(rel), rel)
+	data, err := os.ReadFile(file)
+	assert.NilError(t, err)
+	assert.Equal(t, string(data), "images")
+	_, err = os.Lstat(filepath.Join(root, legacyImageStoreFile))
+	assert.Assert(t, os.IsNotExist(err))
+
+	// The store is not listed with the cache contents.
+	manifest, err := buildManifest(context.Background(), root, time.Now())
+	assert.NilError(t, err)
+	assert.Equal(t, len(manifest.Files), 1)
+	assert.Equal(t, manifest.Files[0].Path, "a")
+}
+
+func TestImageStorePathLegacySymlink(t *testing.T) {
+	root := t.TempDir()
+	target := filepath.Join(t.TempDir(), "host")
+	writeFiles(t, filepath.Dir(target), map[string]string{"host": "host"})
+	assert.NilError(t, os.Symlink(target, filepath.Join(root, legacyImageStoreFile)))
+
+	file, err := imageStorePath(root)
+	assert.NilError(t, err)
+	_, err = os.Lstat(file)
+	assert.Assert(t, os.IsNotExist(err))
+}
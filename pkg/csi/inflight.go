@@ -0,0 +1,52 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package csi
+
+import (
+	"context"
+	"time"
+)
+
+// inflightLimiter bounds the number of concurrent mount and format
+// operations. Operations beyond the limit wait in a queue.
+type inflightLimiter struct {
+	// slots is nil if there is no limit.
+	slots chan struct{}
+}
+
+func newInflightLimiter(max int) *inflightLimiter {
+	if max <= 0 {
+		return &inflightLimiter{}
+	}
+	return &inflightLimiter{slots: make(chan struct{}, max)}
+}
+
+// acquire waits for an inflight slot. The returned function must be called to
+// release the slot. An error is returned if ctx is done before a slot is free.
+func (l *inflightLimiter) acquire(ctx context.Context) (func(), error) {
+	if l.slots == nil {
+		return func() {}, nil
+	}
+	start := time.Now()
+	mountQueueDepth.Inc()
+	defer mountQueueDepth.Dec()
+	select {
+	case l.slots <- struct{}{}:
+		mountWaitSeconds.Observe(time.Since(start).Seconds())
+		return func() { <-l.slots }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
@@ -0,0 +1,47 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package csi
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"gotest.tools/v3/assert"
+)
+
+func TestInflightLimiter(t *testing.T) {
+	l := newInflightLimiter(1)
+	release, err := l.acquire(context.Background())
+	assert.NilError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err = l.acquire(ctx)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+
+	release()
+	release, err = l.acquire(context.Background())
+	assert.NilError(t, err)
+	release()
+}
+
+func TestInflightLimiterUnlimited(t *testing.T) {
+	l := newInflightLimiter(0)
+	for i := 0; i < 10; i++ {
+		_, err := l.acquire(context.Background())
+		assert.NilError(t, err)
+	}
+}
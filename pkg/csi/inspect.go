@@ -0,0 +1,152 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package csi
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+
+	"github.com/GoogleCloudPlatform/csi-node-cache/pkg/common"
+)
+
+// NodeCacheStatus summarizes the cache on a node, for inspection tools.
+type NodeCacheStatus struct {
+	Node       string `json:"node"`
+	VolumeType string `json:"volumeType"`
+	Size       string `json:"size,omitempty"`
+	// Disk is the PV of a PD cache, once provisioned.
+	Disk string `json:"disk,omitempty"`
+	// ClaimPhase is the phase of the PVC provisioning a PD cache.
+	ClaimPhase string `json:"claimPhase,omitempty"`
+	// AttachState and AttachError are the progress of attaching a PD cache,
+	// from the annotations of its PVC.
+	AttachState      string      `json:"attachState,omitempty"`
+	AttachError      string      `json:"attachError,omitempty"`
+	MaintenanceState string      `json:"maintenanceState,omitempty"`
+	Usage            *CacheUsage `json:"usage,omitempty"`
+	// Problems lists inconsistencies and errors found for the node.
+	Problems []string `json:"problems,omitempty"`
+}
+
+// InspectNodeCaches gathers the status of the cache on every node that is in
+// the volume type map or labeled for a cache.
+func InspectNodeCaches(ctx context.Context, client kubernetes.Interface, volumeTypeMap types.NamespacedName) ([]NodeCacheStatus, error) {
+	configMap, err := client.CoreV1().ConfigMaps(volumeTypeMap.Namespace).Get(ctx, volumeTypeMap.Name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		configMap = &corev1.ConfigMap{}
+	} else if err != nil {
+		return nil, fmt.Errorf("Could not get volume type map %s: %w", volumeTypeMap, err)
+	}
+	nodes, err := client.CoreV1().Nodes().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("Could not list nodes: %w", err)
+	}
+	pvcs, err := client.CoreV1().PersistentVolumeClaims(volumeTypeMap.Namespace).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("Could not list pvcs: %w", err)
+	}
+	return summarizeNodeCaches(configMap.Data, nodes.Items, pvcs.Items), nil
+}
+
+func summarizeNodeCaches(configMapData map[string]string, nodes []corev1.Node, pvcs []corev1.PersistentVolumeClaim) []NodeCacheStatus {
+	statuses := map[string]*NodeCacheStatus{}
+	status := func(node string) *NodeCacheStatus {
+		if _, found := statuses[node]; !found {
+			statuses[node] = &NodeCacheStatus{Node: node}
+		}
+		return statuses[node]
+	}
+
+	mapping := map[string]volumeTypeInfo{}
+	if len(configMapData) > 0 {
+		var err error
+		if mapping, err = getVolumeTypeMapping(configMapData); err != nil {
+			// There's no node to attach this to, so it is reported on a placeholder.
+			status("").Problems = append(status("").Problems, fmt.Sprintf("bad volume type map: %v", err))
+			mapping = map[string]volumeTypeInfo{}
+		}
+	}
+	for node, info := range mapping {
+		s := status(node)
+		s.VolumeType = info.VolumeType
+		s.Size = info.sizeString()
+		s.Disk = info.Disk
+		if info.Invalid != "" {
+			s.Problems = append(s.Problems, "invalid: "+info.Invalid)
+		}
+	}
+
+	for _, node := range nodes {
+		annotations := node.GetAnnotations()
+		volumeType, labeled := node.GetLabels()[common.VolumeTypeLabel]
+		_, mapped := mapping[node.GetName()]
+		if !labeled && !mapped {
+			continue
+		}
+		s := status(node.GetName())
+		if !mapped {
+			s.VolumeType = volumeType
+			s.Problems = append(s.Problems, "not in volume type map")
+		} else if !labeled {
+			s.Problems = append(s.Problems, "in volume type map but not labeled")
+		}
+		s.MaintenanceState = annotations[common.MaintenanceStateAnnotation]
+		if report, found := annotations[common.UsageAnnotation]; found {
+			var usage CacheUsage
+			if err := json.Unmarshal([]byte(report), &usage); err != nil {
+				s.Problems = append(s.Problems, fmt.Sprintf("bad usage report: %v", err))
+			} else {
+				s.Usage = &usage
+				if usage.LastError != "" {
+					s.Problems = append(s.Problems, usage.LastError)
+				}
+			}
+		}
+	}
+	for node := range mapping {
+		if !slices.ContainsFunc(nodes, func(n corev1.Node) bool { return n.GetName() == node }) {
+			status(node).Problems = append(status(node).Problems, "node not found")
+		}
+	}
+
+	for _, pvc := range pvcs {
+		s, found := statuses[pvcNode(&pvc)]
+		if !found || !usesPD(s.VolumeType) {
+			continue
+		}
+		s.ClaimPhase = string(pvc.Status.Phase)
+		s.AttachState = pvc.GetAnnotations()[common.AttachStateAnnotation]
+		s.AttachError = pvc.GetAnnotations()[common.AttachErrorAnnotation]
+		if pvc.Status.Phase == corev1.ClaimBound && s.Disk != pvc.Spec.VolumeName {
+			s.Problems = append(s.Problems, fmt.Sprintf("pvc bound to %s but mapping has %q", pvc.Spec.VolumeName, s.Disk))
+		}
+	}
+
+	result := make([]NodeCacheStatus, 0, len(statuses))
+	for _, s := range statuses {
+		result = append(result, *s)
+	}
+	slices.SortFunc(result, func(a, b NodeCacheStatus) int { return strings.Compare(a.Node, b.Node) })
+	return result
+}
@@ -0,0 +1,83 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package csi
+
+import (
+	"testing"
+
+	"gotest.tools/v3/assert"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/GoogleCloudPlatform/csi-node-cache/pkg/common"
+)
+
+func TestSummarizeNodeCaches(t *testing.T) {
+	data := map[string]string{
+		volumeTypeInfoKey: "node-a,type=tmpfs,size=1Gi\nnode-b,type=pd,size=10Gi,disk=pv-b\nnode-gone,type=lssd",
+	}
+	nodes := []corev1.Node{
+		{ObjectMeta: metav1.ObjectMeta{
+			Name:   "node-a",
+			Labels: map[string]string{common.VolumeTypeLabel: "tmpfs"},
+			Annotations: map[string]string{
+				common.UsageAnnotation: `{"bytesTotal":100,"bytesUsed":40,"lastError":"mount failed"}`,
+			},
+		}},
+		{ObjectMeta: metav1.ObjectMeta{
+			Name:        "node-b",
+			Labels:      map[string]string{common.VolumeTypeLabel: "pd"},
+			Annotations: map[string]string{common.MaintenanceStateAnnotation: common.MaintenanceDetached},
+		}},
+		{ObjectMeta: metav1.ObjectMeta{
+			Name:   "node-c",
+			Labels: map[string]string{common.VolumeTypeLabel: "lssd"},
+		}},
+		{ObjectMeta: metav1.ObjectMeta{Name: "not-cache"}},
+	}
+	pvcs := []corev1.PersistentVolumeClaim{
+		{
+			ObjectMeta: metav1.ObjectMeta{Name: "node-b"},
+			Spec:       corev1.PersistentVolumeClaimSpec{VolumeName: "pv-other"},
+			Status:     corev1.PersistentVolumeClaimStatus{Phase: corev1.ClaimBound},
+		},
+	}
+
+	statuses := summarizeNodeCaches(data, nodes, pvcs)
+	assert.Equal(t, len(statuses), 4)
+
+	a := statuses[0]
+	assert.Equal(t, a.Node, "node-a")
+	assert.Equal(t, a.VolumeType, "tmpfs")
+	assert.Equal(t, a.Size, "1Gi")
+	assert.Equal(t, a.Usage.BytesUsed, int64(40))
+	assert.DeepEqual(t, a.Problems, []string{"mount failed"})
+
+	b := statuses[1]
+	assert.Equal(t, b.Node, "node-b")
+	assert.Equal(t, b.Disk, "pv-b")
+	assert.Equal(t, b.ClaimPhase, "Bound")
+	assert.Equal(t, b.MaintenanceState, common.MaintenanceDetached)
+	assert.DeepEqual(t, b.Problems, []string{`pvc bound to pv-other but mapping has "pv-b"`})
+
+	c := statuses[2]
+	assert.Equal(t, c.Node, "node-c")
+	assert.Equal(t, c.VolumeType, "lssd")
+	assert.DeepEqual(t, c.Problems, []string{"not in volume type map"})
+
+	gone := statuses[3]
+	assert.Equal(t, gone.Node, "node-gone")
+	assert.DeepEqual(t, gone.Problems, []string{"node not found"})
+}
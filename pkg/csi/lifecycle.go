@@ -0,0 +1,73 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package csi
+
+import (
+	"fmt"
+	"slices"
+
+	storagev1 "k8s.io/api/storage/v1"
+
+	"github.com/GoogleCloudPlatform/csi-node-cache/pkg/common"
+)
+
+// ephemeralKey is added to the volume context by kubelet, as the CSIDriver has
+// podInfoOnMount. It is "true" for inline volumes in the pod spec and "false"
+// for persistent volumes.
+const ephemeralKey = common.KubeletAttributePrefix + "ephemeral"
+
+// parseLifecycleModes parses the volume lifecycle modes the driver accepts,
+// which should match the volumeLifecycleModes of the CSIDriver. No modes
+// means both.
+func parseLifecycleModes(modes []string) ([]storagev1.VolumeLifecycleMode, error) {
+	if len(modes) == 0 {
+		return []storagev1.VolumeLifecycleMode{storagev1.VolumeLifecycleEphemeral, storagev1.VolumeLifecyclePersistent}, nil
+	}
+	var parsed []storagev1.VolumeLifecycleMode
+	for _, mode := range modes {
+		switch m := storagev1.VolumeLifecycleMode(mode); m {
+		case storagev1.VolumeLifecycleEphemeral, storagev1.VolumeLifecyclePersistent:
+			parsed = append(parsed, m)
+		default:
+			return nil, fmt.Errorf("unknown volume lifecycle mode %q, expected %s or %s", mode, storagev1.VolumeLifecycleEphemeral, storagev1.VolumeLifecyclePersistent)
+		}
+	}
+	return parsed, nil
+}
+
+// checkLifecycle checks that a publish of volumeID is in a lifecycle mode the
+// driver accepts. There is no controller service to provision persistent
+// volumes, so the only persistent volume that can be published on a node is
+// the one the controller creates for it with --provisioner-storage-class,
+// whose handle is the node name. If kubelet didn't say whether the volume is
+// ephemeral, as when the CSIDriver lacks podInfoOnMount, it is allowed.
+func (d *Driver) checkLifecycle(volumeID string, volumeContext map[string]string) error {
+	var mode storagev1.VolumeLifecycleMode
+	switch volumeContext[ephemeralKey] {
+	case "true":
+		mode = storagev1.VolumeLifecycleEphemeral
+	case "false":
+		mode = storagev1.VolumeLifecyclePersistent
+	default:
+		return nil
+	}
+	if !slices.Contains(d.lifecycleModes, mode) {
+		return fmt.Errorf("%s volumes are not accepted by this driver, which takes %v", mode, d.lifecycleModes)
+	}
+	if mode == storagev1.VolumeLifecyclePersistent && volumeID != d.nodeId {
+		return fmt.Errorf("persistent volume %s is not the provisioned volume of node %s; persistent volumes can only be created by the node cache controller, or use an inline csi volume", volumeID, d.nodeId)
+	}
+	return nil
+}
@@ -0,0 +1,55 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package csi
+
+import (
+	"testing"
+
+	"gotest.tools/v3/assert"
+)
+
+func TestCheckLifecycle(t *testing.T) {
+	all, err := parseLifecycleModes(nil)
+	assert.NilError(t, err)
+	ephemeralOnly, err := parseLifecycleModes([]string{"Ephemeral"})
+	assert.NilError(t, err)
+	_, err = parseLifecycleModes([]string{"Generic"})
+	assert.ErrorContains(t, err, "unknown volume lifecycle mode")
+
+	inline := map[string]string{ephemeralKey: "true"}
+	persistent := map[string]string{ephemeralKey: "false"}
+	for _, testCase := range []struct {
+		name          string
+		driver        *Driver
+		volumeID      string
+		volumeContext map[string]string
+		expectedError string
+	}{
+		{name: "inline", driver: &Driver{nodeId: "node-1", lifecycleModes: all}, volumeID: "csi-1234", volumeContext: inline},
+		{name: "provisioned", driver: &Driver{nodeId: "node-1", lifecycleModes: all}, volumeID: "node-1", volumeContext: persistent},
+		{name: "other persistent", driver: &Driver{nodeId: "node-1", lifecycleModes: all}, volumeID: "my-pv", volumeContext: persistent, expectedError: "can only be created by the node cache controller"},
+		{name: "persistent not accepted", driver: &Driver{nodeId: "node-1", lifecycleModes: ephemeralOnly}, volumeID: "node-1", volumeContext: persistent, expectedError: "Persistent volumes are not accepted"},
+		{name: "unknown", driver: &Driver{nodeId: "node-1", lifecycleModes: ephemeralOnly}, volumeID: "my-pv"},
+	} {
+		t.Run(testCase.name, func(t *testing.T) {
+			err := testCase.driver.checkLifecycle(testCase.volumeID, testCase.volumeContext)
+			if testCase.expectedError != "" {
+				assert.ErrorContains(t, err, testCase.expectedError)
+			} else {
+				assert.NilError(t, err)
+			}
+		})
+	}
+}
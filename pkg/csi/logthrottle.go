@@ -0,0 +1,98 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package csi
+
+import (
+	"sync"
+	"time"
+
+	"k8s.io/klog/v2"
+)
+
+// errorLogWindow is how long repeats of an error are suppressed after it is
+// logged.
+const errorLogWindow = time.Minute
+
+// grpcErrors throttles the errors returned by the driver's RPCs, as kubelet
+// retries a failing publish every few seconds.
+var grpcErrors = newErrorThrottle(errorLogWindow, klog.Errorf)
+
+// errorThrottle logs each distinct error once per window. Repeats within the
+// window are counted, and a summary is logged once the window has passed.
+type errorThrottle struct {
+	window time.Duration
+	logf   func(format string, args ...any)
+
+	mutex   sync.Mutex
+	entries map[string]*throttledError
+}
+
+type throttledError struct {
+	method, msg string
+	logged      time.Time
+	suppressed  int
+}
+
+func newErrorThrottle(window time.Duration, logf func(format string, args ...any)) *errorThrottle {
+	return &errorThrottle{window: window, logf: logf, entries: map[string]*throttledError{}}
+}
+
+// log logs the error of method unless it was logged within the window.
+func (t *errorThrottle) log(method string, err error, now time.Time) {
+	msg := err.Error()
+	key := method + "\x00" + msg
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if entry, found := t.entries[key]; found && now.Sub(entry.logged) < t.window {
+		entry.suppressed++
+		return
+	} else if found {
+		t.summarize(entry)
+	}
+	t.entries[key] = &throttledError{method: method, msg: msg, logged: now}
+	t.logf("%s returned with error: %s", method, msg)
+}
+
+// flush summarizes and forgets errors whose window has passed.
+func (t *errorThrottle) flush(now time.Time) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	for key, entry := range t.entries {
+		if now.Sub(entry.logged) >= t.window {
+			t.summarize(entry)
+			delete(t.entries, key)
+		}
+	}
+}
+
+// run flushes the throttle every window until stop is closed.
+func (t *errorThrottle) run(stop <-chan struct{}) {
+	ticker := time.NewTicker(t.window)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-ticker.C:
+			t.flush(now)
+		}
+	}
+}
+
+func (t *errorThrottle) summarize(entry *throttledError) {
+	if entry.suppressed > 0 {
+		t.logf("%s returned the same error %d more times in %v: %s", entry.method, entry.suppressed, t.window, entry.msg)
+	}
+}
@@ -0,0 +1,61 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package csi
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"gotest.tools/v3/assert"
+)
+
+func TestErrorThrottle(t *testing.T) {
+	var lines []string
+	throttle := newErrorThrottle(time.Minute, func(format string, args ...any) {
+		lines = append(lines, fmt.Sprintf(format, args...))
+	})
+	start := time.Unix(1000, 0)
+	busy := errors.New("device busy")
+
+	throttle.log("Publish", busy, start)
+	throttle.log("Publish", busy, start.Add(10*time.Second))
+	throttle.log("Publish", busy, start.Add(20*time.Second))
+	throttle.log("Unpublish", busy, start.Add(20*time.Second))
+	throttle.log("Publish", errors.New("not found"), start.Add(30*time.Second))
+	assert.DeepEqual(t, lines, []string{
+		"Publish returned with error: device busy",
+		"Unpublish returned with error: device busy",
+		"Publish returned with error: not found",
+	})
+
+	// A repeat after the window summarizes and logs again.
+	lines = nil
+	throttle.log("Publish", busy, start.Add(time.Minute))
+	assert.DeepEqual(t, lines, []string{
+		"Publish returned the same error 2 more times in 1m0s: device busy",
+		"Publish returned with error: device busy",
+	})
+
+	// Flushing forgets expired errors, summarizing any repeats.
+	lines = nil
+	throttle.log("Publish", busy, start.Add(70*time.Second))
+	throttle.flush(start.Add(2 * time.Minute))
+	assert.DeepEqual(t, lines, []string{
+		"Publish returned the same error 1 more times in 1m0s: device busy",
+	})
+	assert.Equal(t, len(throttle.entries), 0)
+}
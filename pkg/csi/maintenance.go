@@ -0,0 +1,228 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package csi
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/klog/v2"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	"github.com/GoogleCloudPlatform/csi-node-cache/pkg/common"
+	"github.com/GoogleCloudPlatform/csi-node-cache/pkg/localvolume"
+)
+
+const (
+	maintenancePollInterval = 10 * time.Second
+)
+
+// RunMaintenanceWatch polls the node for maintenance requests until ctx is
+// done. When maintenance is requested, new publishes are refused and, once
+// all existing consumers have unpublished, the cache is released. See
+// common.MaintenanceAnnotation.
+//
+// Cache flushes to GCS are also triggered from the watch, before any release.
+func (d *Driver) RunMaintenanceWatch(ctx context.Context) {
+	wait.UntilWithContext(ctx, func(ctx context.Context) {
+		node, err := d.client.CoreV1().Nodes().Get(ctx, d.nodeId, metav1.GetOptions{})
+		if err != nil {
+			klog.Errorf("Could not get node %s for maintenance check: %v", d.nodeId, err)
+			return
+		}
+		d.checkFlush(ctx, node)
+		d.checkMaintenance(ctx, node)
+	}, maintenancePollInterval)
+}
+
+func (d *Driver) checkMaintenance(ctx context.Context, node *corev1.Node) {
+	var err error
+	requested := inMaintenance(node)
+	state := node.GetAnnotations()[common.MaintenanceStateAnnotation]
+
+	d.volMutex.Lock()
+	defer d.volMutex.Unlock()
+
+	if !requested {
+		if d.inMaintenance {
+			klog.Infof("Maintenance no longer requested, cache will be recreated on the next publish")
+			d.inMaintenance = false
+			d.released = false
+		}
+		return
+	}
+	if state == common.MaintenanceReleased || state == common.MaintenanceDetached {
+		// Already released, perhaps by a previous instance of the driver.
+		d.inMaintenance = true
+		d.released = true
+		return
+	}
+	if !d.inMaintenance {
+		klog.Infof("Maintenance requested, refusing new publishes")
+		d.inMaintenance = true
+		if err := d.setMaintenanceState(ctx, common.MaintenanceDraining); err != nil {
+			klog.Errorf("Could not mark node draining: %v", err)
+		}
+	}
+
+	if d.vol == nil && !d.released {
+		// The cache may have been set up by a previous instance of the driver, in
+		// which case this finds the existing mount and arrays.
+		if _, err = d.cacheVolume(ctx); err != nil {
+			var pending *common.VolumePendingError
+			if !errors.As(err, &pending) {
+				klog.Errorf("Could not find cache volume to release, will retry: %v", err)
+				return
+			}
+			klog.Infof("No cache volume to release: %v", err)
+		}
+	}
+	if d.vol != nil {
+		consumers, err := cacheConsumers(d.vol.Path())
+		if err != nil {
+			klog.Errorf("Could not find consumers of %s, will retry: %v", d.vol.Path(), err)
+			return
+		}
+		if len(consumers) > 0 {
+			klog.Infof("Waiting for %d consumers to unpublish before releasing: %v", len(consumers), consumers)
+			return
+		}
+		d.stopPrewarm()
+		if err := d.releaseImageCache(ctx); err != nil {
+			klog.Errorf("%v, will retry", err)
+			return
+		}
+		if r, ok := d.vol.(localvolume.Releaser); ok {
+			if err := r.Release(ctx); err != nil {
+				klog.Errorf("Could not release cache volume, will retry: %v", err)
+				return
+			}
+		}
+		d.vol = nil
+	}
+	d.released = true
+	if err := d.setMaintenanceState(ctx, common.MaintenanceReleased); err != nil {
+		klog.Errorf("Could not mark node released, will retry: %v", err)
+		return
+	}
+	klog.Infof("Cache released for maintenance")
+}
+
+func (d *Driver) setMaintenanceState(ctx context.Context, state string) error {
+	return d.setNodeAnnotation(ctx, common.MaintenanceStateAnnotation, state)
+}
+
+// reconcileMaintenance detaches the PD of a cache that the driver has released
+// for maintenance. Once maintenance is no longer requested the PD is
+// reattached, and the maintenance state cleared.
+func (r *reconciler) reconcileMaintenance(ctx context.Context, node *corev1.Node, info volumeTypeInfo) error {
+	log := log.FromContext(ctx)
+
+	requested := inMaintenance(node)
+	state, found := node.GetAnnotations()[common.MaintenanceStateAnnotation]
+	hasPD := usesPD(info.VolumeType) && r.attacher != nil && info.Disk != ""
+
+	if requested {
+		if state != common.MaintenanceReleased || !hasPD {
+			return nil
+		}
+		volume, err := r.pdVolumeHandle(ctx, node, info.Disk)
+		if err != nil {
+			return err
+		}
+		attached, err := r.attacher.diskIsAttached(ctx, volume, node.GetName())
+		if err != nil {
+			return fmt.Errorf("Could not check attachment of %s for maintenance: %w", info.Disk, err)
+		}
+		if attached {
+			if err := r.attacher.detachDisk(ctx, volume, node.GetName()); err != nil {
+				return err
+			}
+			log.Info("detached for maintenance", "node", node.GetName(), "pv", info.Disk)
+		}
+		return r.setMaintenanceState(ctx, node, common.MaintenanceDetached)
+	}
+
+	if !found {
+		return nil
+	}
+	if state == common.MaintenanceDetached && hasPD {
+		volume, err := r.pdVolumeHandle(ctx, node, info.Disk)
+		if err != nil {
+			return err
+		}
+		attached, err := r.attacher.diskIsAttached(ctx, volume, node.GetName())
+		if err != nil {
+			return fmt.Errorf("Could not check attachment of %s after maintenance: %w", info.Disk, err)
+		}
+		if !attached {
+			if err := r.attacher.attachDisk(ctx, volume, node.GetName()); err != nil {
+				return err
+			}
+			log.Info("reattached after maintenance", "node", node.GetName(), "pv", info.Disk)
+		}
+	}
+	return r.setMaintenanceState(ctx, node, "")
+}
+
+// setMaintenanceState sets the maintenance state annotation on node, or
+// removes it if state is empty.
+func (r *reconciler) setMaintenanceState(ctx context.Context, node *corev1.Node, state string) error {
+	patch := client.MergeFrom(node.DeepCopy())
+	annotations := node.GetAnnotations()
+	if state == "" {
+		delete(annotations, common.MaintenanceStateAnnotation)
+	} else {
+		if annotations == nil {
+			annotations = map[string]string{}
+		}
+		annotations[common.MaintenanceStateAnnotation] = state
+	}
+	node.SetAnnotations(annotations)
+	if err := r.Patch(ctx, node, patch); err != nil {
+		return fmt.Errorf("Could not set maintenance state of %s to %q: %w", node.GetName(), state, err)
+	}
+	return nil
+}
+
+// pdVolumeHandle returns the volume handle of the PD cache of node, which is
+// either an existing disk or the provisioned PV pvName.
+func (r *reconciler) pdVolumeHandle(ctx context.Context, node *corev1.Node, pvName string) (string, error) {
+	if handle, found := node.GetAnnotations()[common.ExistingDiskAnnotation]; found {
+		return handle, nil
+	}
+	var pv corev1.PersistentVolume
+	if err := r.getPV(ctx, pvName, &pv); err != nil {
+		return "", fmt.Errorf("Can't get volume %s: %w", pvName, err)
+	}
+	if pv.Spec.CSI == nil {
+		return "", fmt.Errorf("Volume %s is not a CSI volume", pvName)
+	}
+	return pv.Spec.CSI.VolumeHandle, nil
+}
+
+// inMaintenance returns true if maintenance has been requested for node.
+func inMaintenance(node *corev1.Node) bool {
+	if _, removing := node.GetLabels()[common.RemovingLabel]; removing {
+		return true
+	}
+	return node.GetAnnotations()[common.MaintenanceAnnotation] == common.MaintenanceRequested
+}
@@ -0,0 +1,143 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package csi
+
+import (
+	"context"
+	"encoding/json"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/klog/v2"
+
+	"github.com/GoogleCloudPlatform/csi-node-cache/pkg/prewarm"
+)
+
+// ManifestFile is written at the root of the cache with a Manifest of its
+// contents, so that workloads can see what is cached without scanning it.
+const ManifestFile = ".node-cache-manifest.json"
+
+// Manifest lists the files in the cache.
+type Manifest struct {
+	Generated  metav1.Time     `json:"generated"`
+	TotalBytes int64           `json:"totalBytes"`
+	Files      []ManifestEntry `json:"files"`
+}
+
+// ManifestEntry is a regular file in the cache.
+type ManifestEntry struct {
+	// Path is relative to the cache root, with / separators.
+	Path     string      `json:"path"`
+	Size     int64       `json:"size"`
+	Modified metav1.Time `json:"modified"`
+}
+
+// RunManifestWriter writes the cache manifest every interval until ctx is
+// done.
+func (d *Driver) RunManifestWriter(ctx context.Context, interval time.Duration) {
+	wait.UntilWithContext(ctx, d.writeManifest, interval)
+}
+
+func (d *Driver) writeManifest(ctx context.Context) {
+	d.volMutex.Lock()
+	vol := d.vol
+	d.volMutex.Unlock()
+	if vol == nil {
+		return
+	}
+	// As with trims, the lock isn't held during the walk. If the cache is
+	// released meanwhile, the write fails and is retried next time.
+	manifest, err := buildManifest(ctx, vol.Path(), time.Now())
+	if err != nil {
+		klog.Errorf("Could not list %s for manifest: %v", vol.Path(), err)
+		return
+	}
+	if err := writeManifestFile(vol.Path(), manifest); err != nil {
+		klog.Errorf("Could not write manifest to %s: %v", vol.Path(), err)
+		return
+	}
+	klog.V(4).Infof("Wrote manifest of %d files to %s", len(manifest.Files), vol.Path())
+}
+
+// buildManifest lists the regular files under root, skipping the driver's own
+// bookkeeping files and private directory.
+func buildManifest(ctx context.Context, root string, now time.Time) (Manifest, error) {
+	manifest := Manifest{Generated: metav1.NewTime(now), Files: []ManifestEntry{}}
+	err := filepath.WalkDir(root, func(file string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		name := entry.Name()
+		if entry.IsDir() {
+			if file != root && name == "lost+found" || isPrivateDir(root, file) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !entry.Type().IsRegular() || isBookkeepingFile(name) {
+			return nil
+		}
+		info, err := entry.Info()
+		if os.IsNotExist(err) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(root, file)
+		if err != nil {
+			return err
+		}
+		manifest.Files = append(manifest.Files, ManifestEntry{
+			Path:     filepath.ToSlash(rel),
+			Size:     info.Size(),
+			Modified: metav1.NewTime(info.ModTime()),
+		})
+		manifest.TotalBytes += info.Size()
+		return nil
+	})
+	return manifest, err
+}
+
+// isBookkeepingFile returns true for files written by the driver rather than
+// cached content.
+func isBookkeepingFile(name string) bool {
+	return strings.HasPrefix(name, ManifestFile) || name == prewarm.StateFile || strings.HasSuffix(name, prewarm.PartialSuffix)
+}
+
+// writeManifestFile replaces the manifest atomically, so that readers never
+// see a partial one.
+func writeManifestFile(root string, manifest Manifest) error {
+	data, err := json.Marshal(manifest)
+	if err != nil {
+		return err
+	}
+	file := filepath.Join(root, ManifestFile)
+	tmp := file + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, file)
+}
@@ -0,0 +1,63 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package csi
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"gotest.tools/v3/assert"
+)
+
+func TestManifest(t *testing.T) {
+	root := t.TempDir()
+	modified := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	for name, contents := range map[string]string{
+		"a":                         "1",
+		"models/llm/weights":        "22",
+		"lost+found/x":              "lost",
+		".prewarm-state.json":       "{}",
+		"models/b.prewarm-partial":  "partial",
+		".node-cache-manifest.json": "old",
+		privateDir + "/clones/x/y":  "clone",
+	} {
+		file := filepath.Join(root, name)
+		assert.NilError(t, os.MkdirAll(filepath.Dir(file), 0755))
+		assert.NilError(t, os.WriteFile(file, []byte(contents), 0644))
+		assert.NilError(t, os.Chtimes(file, modified, modified))
+	}
+
+	now := time.Date(2024, 6, 2, 0, 0, 0, 0, time.UTC)
+	manifest, err := buildManifest(context.Background(), root, now)
+	assert.NilError(t, err)
+	assert.Equal(t, manifest.TotalBytes, int64(3))
+	assert.Equal(t, len(manifest.Files), 2)
+	assert.Equal(t, manifest.Files[0].Path, "a")
+	assert.Equal(t, manifest.Files[1].Path, "models/llm/weights")
+	assert.Equal(t, manifest.Files[1].Size, int64(2))
+	assert.Assert(t, manifest.Files[1].Modified.Time.Equal(modified))
+
+	assert.NilError(t, writeManifestFile(root, manifest))
+	data, err := os.ReadFile(filepath.Join(root, ManifestFile))
+	assert.NilError(t, err)
+	var read Manifest
+	assert.NilError(t, json.Unmarshal(data, &read))
+	assert.Equal(t, len(read.Files), 2)
+	assert.Assert(t, read.Generated.Time.Equal(now))
+}
@@ -0,0 +1,225 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package csi
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/util/retry"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	"github.com/GoogleCloudPlatform/csi-node-cache/pkg/prewarm"
+)
+
+// mappingWriteBackoff is used to retry a failed write of the volume type map.
+// The jitter spreads out writes from controllers racing for the map.
+var mappingWriteBackoff = wait.Backoff{
+	Duration: 100 * time.Millisecond,
+	Factor:   2,
+	Jitter:   0.5,
+	Steps:    6,
+	Cap:      10 * time.Second,
+}
+
+// mappingMutation changes the volume type mapping in place.
+type mappingMutation func(mapping map[string]volumeTypeInfo)
+
+// mappingWriter coalesces changes to the volume type map. Changes made within
+// the write window are applied together in a single update, so that a node
+// pool rollout doesn't cause a write (and a conflict) per node event.
+type mappingWriter struct {
+	client client.Client
+	name   types.NamespacedName
+	window time.Duration
+
+	mutex   sync.Mutex
+	pending []mappingMutation
+	// kick is signalled when pending becomes non-empty.
+	kick chan struct{}
+}
+
+func newMappingWriter(c client.Client, name types.NamespacedName, window time.Duration) *mappingWriter {
+	return &mappingWriter{
+		client: c,
+		name:   name,
+		window: window,
+		kick:   make(chan struct{}, 1),
+	}
+}
+
+// update queues a change to the mapping. It is written asynchronously.
+func (w *mappingWriter) update(m mappingMutation) {
+	w.mutex.Lock()
+	w.pending = append(w.pending, m)
+	w.mutex.Unlock()
+	select {
+	case w.kick <- struct{}{}:
+	default:
+	}
+}
+
+// setNode queues setting the info for node.
+func (w *mappingWriter) setNode(node string, info volumeTypeInfo) {
+	w.update(func(mapping map[string]volumeTypeInfo) {
+		mapping[node] = info
+	})
+}
+
+// removeNode queues removing the entry of node.
+func (w *mappingWriter) removeNode(node string) {
+	w.update(func(mapping map[string]volumeTypeInfo) {
+		delete(mapping, node)
+	})
+}
+
+// setDisk queues setting the disk of node, if node is in the mapping.
+func (w *mappingWriter) setDisk(node, disk string) {
+	w.update(func(mapping map[string]volumeTypeInfo) {
+		if info, found := mapping[node]; found {
+			info.Disk = disk
+			mapping[node] = info
+		}
+	})
+}
+
+// Start implements manager.Runnable, writing queued changes until ctx is done.
+// The map is created if it doesn't exist, as readiness depends on it.
+func (w *mappingWriter) Start(ctx context.Context) error {
+	w.update(func(map[string]volumeTypeInfo) {})
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-w.kick:
+		}
+		// Let further changes accumulate before writing.
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(w.window):
+		}
+		w.flush(ctx)
+	}
+}
+
+// flush writes all pending changes. If the write fails, they are requeued.
+func (w *mappingWriter) flush(ctx context.Context) {
+	w.mutex.Lock()
+	mutations := w.pending
+	w.pending = nil
+	w.mutex.Unlock()
+	if len(mutations) == 0 {
+		return
+	}
+
+	// A map from a newer controller is left alone until it has rolled out.
+	var newer *newerMappingError
+	err := retry.OnError(mappingWriteBackoff, func(err error) bool { return ctx.Err() == nil && !errors.As(err, &newer) }, func() error {
+		return w.write(ctx, mutations)
+	})
+	if err != nil {
+		log.FromContext(ctx).Error(err, "mapping write failed, will retry", "changes", len(mutations))
+		w.mutex.Lock()
+		w.pending = append(mutations, w.pending...)
+		w.mutex.Unlock()
+		select {
+		case w.kick <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (w *mappingWriter) write(ctx context.Context, mutations []mappingMutation) error {
+	var configMap corev1.ConfigMap
+	create := false
+	if err := w.client.Get(ctx, w.name, &configMap); apierrors.IsNotFound(err) {
+		create = true
+		configMap.SetNamespace(w.name.Namespace)
+		configMap.SetName(w.name.Name)
+	} else if err != nil {
+		return err
+	}
+	changed, err := mutateMapping(ctx, &configMap, mutations)
+	if err != nil {
+		return err
+	}
+	if create {
+		return w.client.Create(ctx, &configMap)
+	}
+	if !changed {
+		return nil
+	}
+	log.FromContext(ctx).Info("mapping update", "changes", len(mutations))
+	return w.client.Update(ctx, &configMap)
+}
+
+// assignShards gives each node in a shard group its part of the hash ring.
+// Shards are recomputed from the whole mapping, so nodes joining or leaving a
+// group move the boundaries of their neighbours.
+func assignShards(mapping map[string]volumeTypeInfo) {
+	groups := map[string][]string{}
+	for node, info := range mapping {
+		if info.ShardGroup != "" {
+			groups[info.ShardGroup] = append(groups[info.ShardGroup], node)
+		} else if info.Shard != "" {
+			info.Shard = ""
+			mapping[node] = info
+		}
+	}
+	for _, nodes := range groups {
+		for node, shard := range prewarm.AssignShards(nodes) {
+			info := mapping[node]
+			info.Shard = shard.String()
+			mapping[node] = info
+		}
+	}
+}
+
+// mutateMapping applies mutations to the mapping in configMap, returning true
+// if it changed. A bad mapping is replaced.
+func mutateMapping(ctx context.Context, configMap *corev1.ConfigMap, mutations []mappingMutation) (bool, error) {
+	if configMap.Data == nil {
+		configMap.Data = map[string]string{}
+	}
+	original, found := configMap.Data[volumeTypeInfoKey]
+	originalVersion := configMap.Data[volumeTypeVersionKey]
+	if version, err := mappingVersion(configMap.Data); err == nil && version > mappingSchemaVersion {
+		return false, &newerMappingError{version: version}
+	}
+	mapping := map[string]volumeTypeInfo{}
+	if found {
+		var err error
+		if mapping, err = getVolumeTypeMapping(configMap.Data); err != nil {
+			log.FromContext(ctx).Error(err, "bad mapping (ignored, mapping recreated)")
+			mapping = map[string]volumeTypeInfo{}
+		}
+	}
+	for _, m := range mutations {
+		m(mapping)
+	}
+	assignShards(mapping)
+	if err := writeVolumeTypeMapping(configMap.Data, mapping); err != nil {
+		return false, err
+	}
+	return !found || configMap.Data[volumeTypeInfoKey] != original || configMap.Data[volumeTypeVersionKey] != originalVersion, nil
+}
@@ -0,0 +1,84 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package csi
+
+import (
+	"context"
+	"testing"
+
+	"gotest.tools/v3/assert"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/apimachinery/pkg/types"
+
+	"github.com/GoogleCloudPlatform/csi-node-cache/pkg/prewarm"
+)
+
+func TestMutateMapping(t *testing.T) {
+	ctx := context.Background()
+	w := newMappingWriter(nil, types.NamespacedName{}, 0)
+	w.setNode("a", volumeTypeInfo{VolumeType: "tmpfs", Size: resource.MustParse("1Gi")})
+	w.setNode("b", volumeTypeInfo{VolumeType: "pd", Size: resource.MustParse("10Gi")})
+	w.setDisk("b", "pv-b")
+	w.setDisk("c", "pv-c")
+	w.setNode("a", volumeTypeInfo{VolumeType: "lssd"})
+
+	var configMap corev1.ConfigMap
+	changed, err := mutateMapping(ctx, &configMap, w.pending)
+	assert.NilError(t, err)
+	assert.Assert(t, changed)
+	mapping, err := getVolumeTypeMapping(configMap.Data)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, mapping, map[string]volumeTypeInfo{
+		"a": {VolumeType: "lssd"},
+		"b": {VolumeType: "pd", Size: resource.MustParse("10Gi"), Disk: "pv-b"},
+	})
+
+	changed, err = mutateMapping(ctx, &configMap, w.pending)
+	assert.NilError(t, err)
+	assert.Assert(t, !changed)
+
+	configMap.Data[volumeTypeInfoKey] = "bad line"
+	changed, err = mutateMapping(ctx, &configMap, w.pending[:1])
+	assert.NilError(t, err)
+	assert.Assert(t, changed)
+	assert.Equal(t, configMap.Data[volumeTypeInfoKey], "{\n  \"a\": {\n    \"type\": \"tmpfs\",\n    \"size\": \"1Gi\"\n  }\n}")
+}
+
+func TestAssignShards(t *testing.T) {
+	mapping := map[string]volumeTypeInfo{
+		"a": {VolumeType: "lssd", ShardGroup: "train"},
+		"b": {VolumeType: "lssd", ShardGroup: "train"},
+		"c": {VolumeType: "lssd", ShardGroup: "eval"},
+		"d": {VolumeType: "lssd", Shard: "00000000-00000001"},
+	}
+	assignShards(mapping)
+	assert.Assert(t, mapping["a"].Shard != "")
+	assert.Assert(t, mapping["b"].Shard != "")
+	assert.Assert(t, mapping["a"].Shard != mapping["b"].Shard)
+	// A node alone in its group prewarms everything.
+	shard, err := prewarm.ParseShard(mapping["c"].Shard)
+	assert.NilError(t, err)
+	assert.Equal(t, len(shard), 1)
+	assert.Equal(t, shard[0].Start, shard[0].End)
+	// Nodes that leave a group lose their shard.
+	assert.Equal(t, mapping["d"].Shard, "")
+
+	output := map[string]string{}
+	assert.NilError(t, writeVolumeTypeMapping(output, mapping))
+	parsed, err := getVolumeTypeMapping(output)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, parsed, mapping)
+}
@@ -0,0 +1,117 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package csi
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/klog/v2"
+)
+
+// sizePercentSuffix marks a size label value that is a percentage of the
+// node's memory, such as 30pct, as '%' is not allowed in label values.
+const sizePercentSuffix = "pct"
+
+// procMeminfo is read for the node's memory if kubelet hasn't reported its
+// allocatable memory. It is a variable for testing.
+var procMeminfo = "/proc/meminfo"
+
+// sizeString formats the size of the cache as given in the size label, or ""
+// if it has none.
+func (i volumeTypeInfo) sizeString() string {
+	if i.SizePercent > 0 {
+		return fmt.Sprintf("%d%s", i.SizePercent, sizePercentSuffix)
+	}
+	if i.Size.IsZero() {
+		return ""
+	}
+	return i.Size.String()
+}
+
+// tmpfsSize returns the size of a tmpfs cache for info. A percentage is of the
+// node's allocatable memory, and the size is capped so that the minimum free
+// memory is left outside the cache.
+func (d *Driver) tmpfsSize(ctx context.Context, info volumeTypeInfo) (resource.Quantity, error) {
+	if info.SizePercent == 0 && d.tmpfsMinFree.IsZero() {
+		return info.Size, nil
+	}
+	memory, err := d.nodeMemory(ctx)
+	if err != nil {
+		return resource.Quantity{}, err
+	}
+	size := info.Size.Value()
+	if info.SizePercent > 0 {
+		size = memory * int64(info.SizePercent) / 100
+	}
+	if limit := memory - d.tmpfsMinFree.Value(); size > limit {
+		klog.V(4).Infof("Capping tmpfs cache at %d bytes to leave %s of %d bytes of memory free", limit, d.tmpfsMinFree.String(), memory)
+		size = limit
+	}
+	if size <= 0 {
+		return resource.Quantity{}, fmt.Errorf("no memory left for a tmpfs cache after reserving %s of %d bytes", d.tmpfsMinFree.String(), memory)
+	}
+	return *resource.NewQuantity(size, resource.BinarySI), nil
+}
+
+// nodeMemory returns the memory of the node available to pods, as reported by
+// kubelet, or the total memory if that isn't known.
+func (d *Driver) nodeMemory(ctx context.Context) (int64, error) {
+	total, err := memTotal(procMeminfo)
+	if err != nil {
+		return 0, err
+	}
+	node, err := d.client.CoreV1().Nodes().Get(ctx, d.nodeId, metav1.GetOptions{})
+	if err != nil {
+		return 0, fmt.Errorf("could not get node %s for its memory: %w", d.nodeId, err)
+	}
+	if allocatable, found := node.Status.Allocatable[corev1.ResourceMemory]; found && !allocatable.IsZero() {
+		return min(allocatable.Value(), total), nil
+	}
+	return total, nil
+}
+
+// memTotal reads MemTotal, in bytes, from a meminfo file.
+func memTotal(path string) (int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// MemTotal:       16374584 kB
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 3 || fields[0] != "MemTotal:" || fields[2] != "kB" {
+			continue
+		}
+		kb, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("bad MemTotal in %s: %w", path, err)
+		}
+		return kb * 1024, nil
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, err
+	}
+	return 0, fmt.Errorf("no MemTotal in %s", path)
+}
@@ -0,0 +1,42 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package csi
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"gotest.tools/v3/assert"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+func TestMemTotal(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "meminfo")
+	assert.NilError(t, os.WriteFile(file, []byte("MemTotal:       16374584 kB\nMemFree:         1204048 kB\n"), 0644))
+	total, err := memTotal(file)
+	assert.NilError(t, err)
+	assert.Equal(t, total, int64(16374584*1024))
+
+	assert.NilError(t, os.WriteFile(file, []byte("MemFree:         1204048 kB\n"), 0644))
+	_, err = memTotal(file)
+	assert.ErrorContains(t, err, "no MemTotal")
+}
+
+func TestSizeString(t *testing.T) {
+	assert.Equal(t, volumeTypeInfo{}.sizeString(), "")
+	assert.Equal(t, volumeTypeInfo{Size: resource.MustParse("1Gi")}.sizeString(), "1Gi")
+	assert.Equal(t, volumeTypeInfo{SizePercent: 30}.sizeString(), "30pct")
+}
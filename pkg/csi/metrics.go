@@ -0,0 +1,112 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package csi
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const (
+	metricsNamespace = "node_cache"
+)
+
+var (
+	// driverRegistry holds the node driver metrics. The controller uses the
+	// controller-runtime registry instead.
+	driverRegistry = prometheus.NewRegistry()
+
+	mountQueueDepth = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "mount_queue_depth",
+		Help:      "Number of mount operations waiting for an inflight slot.",
+	})
+	mountWaitSeconds = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "mount_wait_seconds",
+		Help:      "Time mount operations waited for an inflight slot.",
+		Buckets:   prometheus.ExponentialBuckets(0.01, 4, 8),
+	})
+	publishDurationSeconds = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "publish_duration_seconds",
+		Help:      "Time successful NodePublishVolume calls took, including waiting for an inflight slot.",
+		Buckets:   prometheus.ExponentialBuckets(0.01, 4, 8),
+	})
+	lastTrimTimestamp = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "last_trim_timestamp_seconds",
+		Help:      "Unix time of the last successful fstrim of the cache.",
+	})
+	trimmedBytes = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "trimmed_bytes_total",
+		Help:      "Bytes discarded by fstrim of the cache.",
+	})
+	trimErrors = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "trim_errors_total",
+		Help:      "Failed fstrim runs of the cache.",
+	})
+	cacheSizeBytes = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "cache_size_bytes",
+		Help:      "Configured size of the cache, for cache types given a size.",
+	})
+	lowPriorityBytes = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "low_priority_bytes",
+		Help:      "Bytes of low priority data in the cache, when a high priority reserve is set.",
+	})
+	cacheFilesCreated = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "cache_files_created_total",
+		Help:      "Files and directories created in the cache, when cache events are watched.",
+	})
+	cacheFilesRemoved = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "cache_files_removed_total",
+		Help:      "Files and directories removed from the cache, when cache events are watched.",
+	})
+	cacheHotDirChanges = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "cache_hot_directory_changes",
+		Help:      "Changes in the last minute to the directories of the cache with the most, when cache events are watched.",
+	}, []string{"directory"})
+	backgroundPaused = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "background_paused",
+		Help:      "1 while background work such as prewarms is paused because the cache is slow.",
+	})
+	buildInfo = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "build_info",
+		Help:      "Always 1, labeled with the version and build of the running driver.",
+	}, []string{"version", "git_commit", "build_date", "go_version"})
+)
+
+func init() {
+	driverRegistry.MustRegister(mountQueueDepth, mountWaitSeconds, publishDurationSeconds, lastTrimTimestamp, trimmedBytes, trimErrors, cacheSizeBytes, lowPriorityBytes, cacheFilesCreated, cacheFilesRemoved, cacheHotDirChanges, backgroundPaused, buildInfo)
+}
+
+// ServeMetrics serves the driver metrics on addr at /metrics. Normally this
+// will run forever; an error will be returned otherwise.
+func ServeMetrics(addr string) error {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(driverRegistry, promhttp.HandlerOpts{}))
+	return http.ListenAndServe(addr, mux)
+}
@@ -0,0 +1,123 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package csi
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/klog/v2"
+
+	"github.com/GoogleCloudPlatform/csi-node-cache/pkg/common"
+)
+
+// missingMappingReason is the reason of events about a cache that can't be
+// created because the node isn't in the volume type map.
+const missingMappingReason = "MissingVolumeType"
+
+// missingMappingError is returned when the volume type map can't be read, or
+// doesn't include the node after the grace period.
+type missingMappingError struct {
+	volumeTypeMap types.NamespacedName
+	// node is set if the map was read but is missing node, with how long it
+	// was waited for. Otherwise err is why the map couldn't be read.
+	node   string
+	waited time.Duration
+	err    error
+}
+
+func (e *missingMappingError) Error() string {
+	if e.node == "" {
+		return e.err.Error()
+	}
+	return fmt.Sprintf("No volume type information for %s found in %s after %v", e.node, e.volumeTypeMap, e.waited.Round(time.Second))
+}
+
+func (e *missingMappingError) Unwrap() error {
+	return e.err
+}
+
+// explain returns what is missing for the node to have a cache, for people
+// rather than logs. node is the node of the driver, if it could be read.
+func (e *missingMappingError) explain(node *corev1.Node) string {
+	if e.node == "" {
+		return fmt.Sprintf("the volume type map %s can't be read (%v); check the controller is running in %s", e.volumeTypeMap, e.err, e.volumeTypeMap.Namespace)
+	}
+	if node == nil {
+		return fmt.Sprintf("node %s is not in the volume type map %s", e.node, e.volumeTypeMap)
+	}
+	volumeType, found := node.GetLabels()[common.VolumeTypeLabel]
+	if !found {
+		return fmt.Sprintf("node %s has no %s label; label it with the cache type, such as %s=tmpfs", e.node, common.VolumeTypeLabel, common.VolumeTypeLabel)
+	}
+	return fmt.Sprintf("node %s is labeled %s=%s but the controller has not added it to the volume type map %s after %v; check the controller logs and that --node-selector matches the node", e.node, common.VolumeTypeLabel, volumeType, e.volumeTypeMap, e.waited.Round(time.Second))
+}
+
+// missingMappingEvent reports why the cache can't be created as a warning
+// event on obj, which is the node or a pod waiting for the cache.
+func (d *Driver) missingMappingEvent(ctx context.Context, obj *corev1.ObjectReference, missing *missingMappingError) {
+	msg := missing.explain(getNode(ctx, d.client, d.nodeId))
+	klog.Warningf("Cache can't be created: %s", msg)
+	if d.recorder == nil {
+		return
+	}
+	d.recorder.Eventf(obj, corev1.EventTypeWarning, missingMappingReason, "Cache can't be created: %s", msg)
+}
+
+// podWaitingEvent tells the pod of a publish that failed with err what is
+// missing, if the node is not in the volume type map.
+func (d *Driver) podWaitingEvent(ctx context.Context, volumeContext map[string]string, err error) {
+	var missing *missingMappingError
+	pod := podRef(volumeContext)
+	if !errors.As(err, &missing) || pod == nil || d.recorder == nil {
+		return
+	}
+	d.recorder.Eventf(pod, corev1.EventTypeWarning, missingMappingReason, "Waiting for the node cache: %s", missing.explain(getNode(ctx, d.client, d.nodeId)))
+}
+
+// nodeRef returns a reference to the node of the driver for events. Nodes are
+// referred to by name, as kubelet does.
+func (d *Driver) nodeRef() *corev1.ObjectReference {
+	return &corev1.ObjectReference{Kind: "Node", Name: d.nodeId, UID: types.UID(d.nodeId)}
+}
+
+// podRef returns a reference to the pod of a publish from its volume context,
+// or nil if the CSIDriver lacks podInfoOnMount.
+func podRef(volumeContext map[string]string) *corev1.ObjectReference {
+	name, namespace := volumeContext[podNameKey], volumeContext[podNamespaceKey]
+	if name == "" || namespace == "" {
+		return nil
+	}
+	return &corev1.ObjectReference{Kind: "Pod", Name: name, Namespace: namespace, UID: types.UID(volumeContext[podUIDKey])}
+}
+
+// getNode returns the node called name, or nil if it can't be read.
+func getNode(ctx context.Context, client *kubernetes.Clientset, name string) *corev1.Node {
+	if client == nil {
+		return nil
+	}
+	node, err := client.CoreV1().Nodes().Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		klog.Warningf("Could not get node %s: %v", name, err)
+		return nil
+	}
+	return node
+}
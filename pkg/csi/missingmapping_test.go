@@ -0,0 +1,59 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package csi
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"gotest.tools/v3/assert"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+
+	"github.com/GoogleCloudPlatform/csi-node-cache/pkg/common"
+)
+
+func TestMissingMappingError(t *testing.T) {
+	mapName := types.NamespacedName{Namespace: "node-cache", Name: "volume-type-map"}
+	unreadable := &missingMappingError{volumeTypeMap: mapName, err: errors.New("configmaps \"volume-type-map\" not found")}
+	missing := &missingMappingError{volumeTypeMap: mapName, node: "a", waited: 30 * time.Second}
+
+	var found *missingMappingError
+	assert.Assert(t, errors.As(common.NewVolumePendingError(missing), &found))
+	assert.Equal(t, found, missing)
+	assert.Equal(t, missing.Error(), "No volume type information for a found in node-cache/volume-type-map after 30s")
+	assert.ErrorContains(t, unreadable, "not found")
+
+	assert.Assert(t, strings.Contains(unreadable.explain(nil), "can't be read"))
+	assert.Assert(t, strings.Contains(unreadable.explain(nil), "check the controller is running in node-cache"))
+	assert.Assert(t, strings.Contains(missing.explain(nil), "node a is not in the volume type map node-cache/volume-type-map"))
+
+	node := &corev1.Node{}
+	node.SetName("a")
+	assert.Assert(t, strings.Contains(missing.explain(node), "has no node-cache.gke.io label"))
+	node.SetLabels(map[string]string{common.VolumeTypeLabel: "lssd"})
+	assert.Assert(t, strings.Contains(missing.explain(node), "labeled node-cache.gke.io=lssd"))
+	assert.Assert(t, strings.Contains(missing.explain(node), "after 30s"))
+	assert.Assert(t, strings.Contains(missing.explain(node), "--node-selector"))
+}
+
+func TestPodRef(t *testing.T) {
+	assert.Assert(t, podRef(map[string]string{}) == nil)
+	assert.Assert(t, podRef(map[string]string{podNameKey: "p"}) == nil)
+	assert.DeepEqual(t, podRef(map[string]string{podNameKey: "p", podNamespaceKey: "ns", podUIDKey: "uid"}),
+		&corev1.ObjectReference{Kind: "Pod", Name: "p", Namespace: "ns", UID: "uid"})
+}
@@ -19,15 +19,25 @@ import (
 	"errors"
 	"fmt"
 	"os"
+	"time"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/klog/v2"
 	"k8s.io/mount-utils"
-	"k8s.io/utils/exec"
 
 	"github.com/GoogleCloudPlatform/csi-node-cache/pkg/common"
+	"github.com/GoogleCloudPlatform/csi-node-cache/pkg/localvolume"
+	"github.com/GoogleCloudPlatform/csi-node-cache/pkg/util"
+)
+
+const (
+	// fallbackUnmountTimeout bounds force and lazy unmounts, as a force
+	// unmount of an unreachable network filesystem may hang.
+	fallbackUnmountTimeout = 30 * time.Second
 )
 
 func (*Driver) NodeGetCapabilities(ctx context.Context, req *csi.NodeGetCapabilitiesRequest) (*csi.NodeGetCapabilitiesResponse, error) {
@@ -36,23 +46,104 @@ func (*Driver) NodeGetCapabilities(ctx context.Context, req *csi.NodeGetCapabili
 	}, nil
 }
 
-func (d *Driver) NodePublishVolume(ctx context.Context, req *csi.NodePublishVolumeRequest) (*csi.NodePublishVolumeResponse, error) {
+func (d *Driver) NodePublishVolume(ctx context.Context, req *csi.NodePublishVolumeRequest) (_ *csi.NodePublishVolumeResponse, err error) {
+	start := time.Now()
+	// This is deferred first so that it runs after volMutex is released.
+	defer func() {
+		if err != nil {
+			d.recordError(err)
+		} else {
+			d.observePublish(time.Since(start))
+		}
+	}()
+
 	if len(req.GetTargetPath()) == 0 {
 		return nil, status.Error(codes.InvalidArgument, "Target path missing in request")
 	}
 
-	if d.vol == nil {
-		var err error
-		if d.vol, err = createCacheVolume(ctx, d.client, d.nodeId, d.volumeTypeMap); err != nil {
-			if errors.Is(err, &common.VolumePendingError{}) {
-				return nil, status.Errorf(codes.Aborted, "local volume not ready: %v", err)
-			}
-			return nil, status.Error(codes.Internal, fmt.Sprintf("local volume creation failed: %v", err))
+	if err := d.settings().policy.check(req.GetVolumeContext()); err != nil {
+		return nil, status.Error(codes.PermissionDenied, err.Error())
+	}
+
+	if err := d.checkLifecycle(req.GetVolumeId(), req.GetVolumeContext()); err != nil {
+		return nil, status.Error(codes.FailedPrecondition, err.Error())
+	}
+
+	sandboxed, err := d.sandboxed(ctx, req.GetVolumeContext())
+	if err != nil {
+		return nil, status.Errorf(codes.Unavailable, "could not tell if the pod is sandboxed: %v", err)
+	}
+
+	release, err := d.mountLimiter.acquire(ctx)
+	if err != nil {
+		return nil, status.Errorf(codes.Aborted, "waiting for inflight mount operations: %v", err)
+	}
+	defer release()
+
+	d.volMutex.Lock()
+	defer d.volMutex.Unlock()
+
+	if d.inMaintenance {
+		return nil, status.Error(codes.Unavailable, "node cache is released for maintenance")
+	}
+
+	if _, err := d.publishCacheVolume(ctx, req.GetSecrets()); err != nil {
+		if errors.Is(err, errInvalidSecrets) {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+		d.podWaitingEvent(ctx, req.GetVolumeContext(), err)
+		var pending *common.VolumePendingError
+		if errors.As(err, &pending) {
+			return nil, status.Errorf(codes.Aborted, "local volume not ready: %v", err)
+		}
+		return nil, status.Error(codes.Internal, fmt.Sprintf("local volume creation failed: %v", err))
+	}
+
+	if volumeType, found := req.GetVolumeContext()[common.VolumeTypeAttribute]; found && volumeType != d.volType {
+		return nil, status.Errorf(codes.FailedPrecondition, "volume requires a %s cache but the node has %s", volumeType, d.volType)
+	}
+
+	if sandboxed {
+		if err := checkSandboxSupport(d.volType); err != nil {
+			return nil, status.Error(codes.FailedPrecondition, err.Error())
+		}
+	}
+
+	if hc, ok := d.vol.(localvolume.HealthChecker); ok {
+		if err := hc.Healthy(); err != nil {
+			return nil, status.Errorf(codes.Unavailable, "local volume unhealthy: %v", err)
+		}
+	}
+
+	if err := d.checkPrewarmed(req.GetVolumeContext()); err != nil {
+		return nil, status.Error(codes.Unavailable, err.Error())
+	}
+
+	subPath, hasSubPath := req.GetVolumeContext()[common.PathAttribute]
+	if hasSubPath {
+		if err := validateSubPath(subPath); err != nil {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+	}
+	lowPriority := req.GetVolumeContext()[common.PriorityAttribute] == common.PriorityLow
+	if err := validatePriority(req.GetVolumeContext()); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if lowPriority && d.lowPriorityOver {
+		return nil, status.Error(codes.ResourceExhausted, "low priority data is over its share of the cache, waiting for eviction")
+	}
+	golden, hasClone := req.GetVolumeContext()[common.CloneAttribute]
+	if hasClone {
+		if err := validateCloneAttributes(req.GetVolumeContext()); err != nil {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+		if rv, ok := d.vol.(localvolume.ReflinkVolume); !ok || !rv.Reflink() {
+			return nil, status.Errorf(codes.FailedPrecondition, "clone publishes need a cache formatted with %s", common.ReflinkAnnotation)
 		}
 	}
 
 	targetPath := req.GetTargetPath()
-	notMnt, err := mount.New("").IsLikelyNotMountPoint(targetPath)
+	notMnt, err := util.Mounter().IsLikelyNotMountPoint(targetPath)
 	if err != nil {
 		if os.IsNotExist(err) {
 			if err = os.MkdirAll(targetPath, 0750); err != nil {
@@ -64,7 +155,39 @@ func (d *Driver) NodePublishVolume(ctx context.Context, req *csi.NodePublishVolu
 		}
 	}
 
+	if !notMnt && isStaleTarget(targetPath, d.vol) {
+		d.staleTargetEvent(targetPath, "is bound to a previous instance of the cache, remounting")
+		if err := unmountTarget(ctx, util.Mounter(), targetPath); err != nil {
+			return nil, status.Errorf(codes.Internal, "could not unmount stale target %s: %v", targetPath, err)
+		}
+		if err := os.MkdirAll(targetPath, 0750); err != nil {
+			return nil, status.Errorf(codes.Internal, "Target mount point creation failed: %v", err)
+		}
+		notMnt = true
+	}
+
 	if !notMnt {
+		// A sandbox only sees the target if it is still the cache.
+		if sandboxed {
+			source, err := publishSource(d.vol.Path(), subPath)
+			if err != nil {
+				return nil, status.Errorf(codes.Internal, "could not find %q in the cache: %v", subPath, err)
+			}
+			if hasClone {
+				source = clonePath(d.vol.Path(), targetPath)
+			}
+			if err := checkSandboxBind(source, targetPath); err != nil {
+				return nil, status.Error(codes.FailedPrecondition, err.Error())
+			}
+		}
+		// A publish interrupted before the private directory was hidden
+		// finishes hiding it.
+		if !hasClone && isCacheRoot(targetPath, d.vol.Path()) {
+			if err := hidePrivateDir(util.Mounter(), targetPath); err != nil {
+				return nil, status.Error(codes.Internal, err.Error())
+			}
+		}
+		d.checkpointPublish(targetPath, req.GetVolumeId(), req.GetReadonly())
 		return &csi.NodePublishVolumeResponse{}, nil
 	}
 
@@ -74,13 +197,50 @@ func (d *Driver) NodePublishVolume(ctx context.Context, req *csi.NodePublishVolu
 		mount_options = append(mount_options, "ro")
 	}
 	mounter := &mount.SafeFormatAndMount{
-		Interface: mount.New(""),
-		Exec:      exec.New(),
+		Interface: util.Mounter(),
+		Exec:      util.Exec(),
+	}
+	var source string
+	if hasClone {
+		source, err = cloneSource(d.vol.Path(), golden, targetPath)
+		if err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+	} else {
+		source, err = publishSource(d.vol.Path(), subPath)
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "could not find %q in the cache: %v", subPath, err)
+		}
+		if lowPriority {
+			d.checkpointLowPriority(subPath)
+		}
 	}
-	if err := mounter.Interface.Mount(d.vol.Path(), targetPath, "", mount_options); err != nil {
+	if err := mounter.Interface.Mount(source, targetPath, "", mount_options); err != nil {
+		d.cleanupClone(hasClone, targetPath)
 		return nil, err
 	}
-	klog.Infof("Mounted %s to %s", d.vol.Path(), targetPath)
+	if !hasClone && isCacheRoot(source, d.vol.Path()) {
+		if err := hidePrivateDir(mounter.Interface, targetPath); err != nil {
+			if cleanupErr := unmountTarget(ctx, mounter.Interface, targetPath); cleanupErr != nil {
+				klog.Errorf("Could not clean up %s: %v", targetPath, cleanupErr)
+			}
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+	}
+	if sandboxed {
+		if err := checkSandboxBind(source, targetPath); err != nil {
+			if cleanupErr := unmountTarget(ctx, mounter.Interface, targetPath); cleanupErr != nil {
+				klog.Errorf("Could not clean up %s: %v", targetPath, cleanupErr)
+			} else {
+				d.cleanupClone(hasClone, targetPath)
+			}
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+	}
+	klog.Infof("Mounted %s to %s", source, targetPath)
+	d.lastPublish = time.Now()
+	d.consumers.published(targetPath, req.GetVolumeContext(), readOnly, d.lastPublish)
+	d.checkpointPublish(targetPath, req.GetVolumeId(), readOnly)
 
 	return &csi.NodePublishVolumeResponse{}, nil
 }
@@ -90,22 +250,120 @@ func (d *Driver) NodeUnpublishVolume(ctx context.Context, req *csi.NodeUnpublish
 		return nil, status.Error(codes.InvalidArgument, "Target path missing in request")
 	}
 
-	mounter := &mount.SafeFormatAndMount{
-		Interface: mount.New(""),
-		Exec:      exec.New(),
-	}
-	err := mounter.Interface.Unmount(req.GetTargetPath())
+	release, err := d.mountLimiter.acquire(ctx)
 	if err != nil {
+		return nil, status.Errorf(codes.Aborted, "waiting for inflight mount operations: %v", err)
+	}
+	defer release()
+
+	if err := unmountTarget(ctx, util.Mounter(), req.GetTargetPath()); err != nil {
 		return nil, status.Errorf(codes.Internal, "Unmount of bind mount at %s failed: %v", req.GetTargetPath(), err)
 	}
 
 	klog.Infof("Unmounted %s", req.GetTargetPath())
+	d.volMutex.Lock()
+	vol := d.vol
+	d.volMutex.Unlock()
+	if vol != nil {
+		if err := removeClone(vol.Path(), req.GetTargetPath()); err != nil {
+			// The clone is left behind, but the unpublish has succeeded.
+			klog.Errorf("Could not remove clone for %s: %v", req.GetTargetPath(), err)
+		}
+	}
+	d.checkpointUnpublish(req.GetTargetPath())
+	d.consumers.unpublished(req.GetTargetPath(), time.Now())
 
 	return &csi.NodeUnpublishVolumeResponse{}, nil
 }
 
-func (d *Driver) NodeGetInfo(context.Context, *csi.NodeGetInfoRequest) (*csi.NodeGetInfoResponse, error) {
+// cleanupClone removes the clone made for a failed publish to targetPath, if
+// it was a clone publish. volMutex must be held.
+func (d *Driver) cleanupClone(hasClone bool, targetPath string) {
+	if !hasClone {
+		return
+	}
+	if err := removeClone(d.vol.Path(), targetPath); err != nil {
+		klog.Errorf("Could not remove clone for %s: %v", targetPath, err)
+	}
+}
+
+// unmountTarget unmounts and removes a published target. A target that is
+// already gone or not mounted is success, so that unpublish is idempotent. If
+// unmounting fails, as it may for a stale mount, force and then lazy unmounts
+// are tried.
+func unmountTarget(ctx context.Context, mounter mount.Interface, target string) error {
+	if err := unhidePrivateDir(mounter, target); err != nil {
+		klog.Warningf("Could not unmount the private directory of %s: %v", target, err)
+	}
+	err := mount.CleanupMountPoint(target, mounter, true)
+	if err == nil {
+		return nil
+	}
+	for _, flag := range []string{"-f", "-l"} {
+		klog.Warningf("Unmount of %s failed, retrying with umount %s: %v", target, flag, err)
+		if _, fallbackErr := util.RunCommandContext(ctx, util.CommandOptions{Timeout: fallbackUnmountTimeout}, "umount", flag, target); fallbackErr != nil {
+			err = fmt.Errorf("%w; umount %s: %v", err, flag, fallbackErr)
+			continue
+		}
+		if err := os.Remove(target); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("Unmounted %s but could not remove it: %w", target, err)
+		}
+		return nil
+	}
+	return err
+}
+
+func (d *Driver) NodeGetInfo(ctx context.Context, req *csi.NodeGetInfoRequest) (*csi.NodeGetInfoResponse, error) {
+	if d.disableTopology {
+		return &csi.NodeGetInfoResponse{NodeId: d.nodeId}, nil
+	}
+	info, err := d.nodeVolumeTypeInfo(ctx)
+	if err != nil {
+		return nil, status.Errorf(codes.Unavailable, "cannot find cache type for topology: %v", err)
+	}
 	return &csi.NodeGetInfoResponse{
 		NodeId: d.nodeId,
+		AccessibleTopology: &csi.Topology{
+			Segments: topologySegments(info),
+		},
 	}, nil
 }
+
+// nodeVolumeTypeInfo returns the cache info for this node from the volume type
+// map or, if the controller has not yet added the node, from its labels. This
+// doesn't wait for the map, as the registrar uses a short timeout.
+func (d *Driver) nodeVolumeTypeInfo(ctx context.Context) (volumeTypeInfo, error) {
+	configMap, err := d.client.CoreV1().ConfigMaps(d.volumeTypeMap.Namespace).Get(ctx, d.volumeTypeMap.Name, metav1.GetOptions{})
+	if err == nil {
+		if mapping, err := getVolumeTypeMapping(configMap.Data); err == nil {
+			if info, found := mapping[d.nodeId]; found {
+				return info, nil
+			}
+		}
+	}
+	klog.Infof("%s not found in volume type map, using node labels for cache type", d.nodeId)
+	node, err := d.client.CoreV1().Nodes().Get(ctx, d.nodeId, metav1.GetOptions{})
+	if err != nil {
+		return volumeTypeInfo{}, err
+	}
+	volumeType, found := node.GetLabels()[common.VolumeTypeLabel]
+	if !found {
+		return volumeTypeInfo{}, fmt.Errorf("%s label not found on node %s", common.VolumeTypeLabel, d.nodeId)
+	}
+	info := volumeTypeInfo{VolumeType: volumeType}
+	if size, err := resource.ParseQuantity(node.GetLabels()[common.SizeLabel]); err == nil {
+		info.Size = size
+	}
+	return info, nil
+}
+
+// topologySegments describes the cache for node affinity.
+func topologySegments(info volumeTypeInfo) map[string]string {
+	segments := map[string]string{
+		common.TopologyTypeKey: info.VolumeType,
+	}
+	if size := info.sizeString(); size != "" {
+		segments[common.TopologySizeKey] = size
+	}
+	return segments
+}
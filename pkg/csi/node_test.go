@@ -0,0 +1,47 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package csi
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"gotest.tools/v3/assert"
+	"k8s.io/mount-utils"
+)
+
+func TestUnmountTarget(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	mounted := filepath.Join(dir, "mounted")
+	unmounted := filepath.Join(dir, "unmounted")
+	assert.NilError(t, os.Mkdir(mounted, 0750))
+	assert.NilError(t, os.Mkdir(unmounted, 0750))
+	mounter := mount.NewFakeMounter([]mount.MountPoint{{Device: "/local/lssd", Path: mounted}})
+
+	for _, target := range []string{mounted, unmounted, filepath.Join(dir, "missing")} {
+		assert.NilError(t, unmountTarget(ctx, mounter, target))
+		_, err := os.Stat(target)
+		assert.Assert(t, os.IsNotExist(err), target)
+	}
+	mounts, err := mounter.List()
+	assert.NilError(t, err)
+	assert.Equal(t, len(mounts), 0)
+
+	// Unpublish may be retried after success.
+	assert.NilError(t, unmountTarget(ctx, mounter, mounted))
+}
@@ -0,0 +1,111 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package csi
+
+import (
+	"context"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/selection"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
+
+	"github.com/GoogleCloudPlatform/csi-node-cache/pkg/common"
+)
+
+// nodeCacheOptions returns how nodes are cached by the manager. Nodes are
+// always stripped of the fields the controller doesn't use, such as their
+// image lists. If scoped, only cache nodes matching selector are cached at
+// all; other nodes are read from the API server when needed.
+func nodeCacheOptions(selector labels.Selector, scoped bool) (cache.ByObject, error) {
+	options := cache.ByObject{Transform: stripNode}
+	if !scoped {
+		return options, nil
+	}
+	hasType, err := labels.NewRequirement(common.VolumeTypeLabel, selection.Exists, nil)
+	if err != nil {
+		return cache.ByObject{}, err
+	}
+	if selector == nil {
+		selector = labels.Everything()
+	}
+	options.Label = selector.Add(*hasType)
+	return options, nil
+}
+
+// stripNode drops the parts of a node that are large in big clusters but not
+// used by the controller. Labels, annotations, allocatable resources and
+// conditions are kept.
+func stripNode(obj any) (any, error) {
+	node, ok := obj.(*corev1.Node)
+	if !ok {
+		return obj, nil
+	}
+	node.SetManagedFields(nil)
+	node.Status.Images = nil
+	node.Status.VolumesInUse = nil
+	node.Status.VolumesAttached = nil
+	return node, nil
+}
+
+// volumeCacheOptions returns how PVCs and PVs are cached by the manager. Only
+// those created by the controller are cached, so that unrelated claims and
+// volumes don't take memory: PD cache PVCs by their managed-by label, and
+// provisioned PVs by their node label. Other PVs, such as those of PD caches,
+// are read from the API server.
+func volumeCacheOptions() (pvcs, pvs cache.ByObject, err error) {
+	managed, err := labels.NewRequirement(managedByLabel, selection.Equals, []string{managedByValue})
+	if err != nil {
+		return cache.ByObject{}, cache.ByObject{}, err
+	}
+	provisioned, err := labels.NewRequirement(provisionedForLabel, selection.Exists, nil)
+	if err != nil {
+		return cache.ByObject{}, cache.ByObject{}, err
+	}
+	return cache.ByObject{Label: labels.NewSelector().Add(*managed)}, cache.ByObject{Label: labels.NewSelector().Add(*provisioned)}, nil
+}
+
+// getNode reads a node from the cache. When the cache is scoped to cache
+// nodes, a node missing from it is read from the API server, as it may just
+// have lost its volume type label.
+func (r *reconciler) getNode(ctx context.Context, name string, node *corev1.Node) error {
+	err := r.Get(ctx, types.NamespacedName{Name: name}, node)
+	if apierrors.IsNotFound(err) && r.scopedNodes {
+		return r.apiReader.Get(ctx, types.NamespacedName{Name: name}, node)
+	}
+	return err
+}
+
+// getPVC reads the PD cache PVC of node. PVCs made before the managed-by label
+// are not cached, so a PVC missing from the cache is read from the API server;
+// it is labeled when the node is reconciled.
+func (r *reconciler) getPVC(ctx context.Context, node string, pvc *corev1.PersistentVolumeClaim) error {
+	key := types.NamespacedName{Namespace: r.namespace, Name: node}
+	err := r.Get(ctx, key, pvc)
+	if apierrors.IsNotFound(err) && r.apiReader != nil {
+		return r.apiReader.Get(ctx, key, pvc)
+	}
+	return err
+}
+
+// getPV reads the PV of a PD cache, which is not cached.
+func (r *reconciler) getPV(ctx context.Context, name string, pv *corev1.PersistentVolume) error {
+	if r.apiReader == nil {
+		return r.Get(ctx, types.NamespacedName{Name: name}, pv)
+	}
+	return r.apiReader.Get(ctx, types.NamespacedName{Name: name}, pv)
+}
@@ -0,0 +1,81 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package csi
+
+import (
+	"testing"
+
+	"gotest.tools/v3/assert"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+func TestNodeCacheOptions(t *testing.T) {
+	options, err := nodeCacheOptions(nil, false)
+	assert.NilError(t, err)
+	assert.Assert(t, options.Label == nil)
+	assert.Assert(t, options.Transform != nil)
+
+	selector, err := labels.Parse("pool=cache")
+	assert.NilError(t, err)
+	options, err = nodeCacheOptions(selector, true)
+	assert.NilError(t, err)
+	assert.Equal(t, options.Label.String(), "node-cache.gke.io,pool=cache")
+	assert.Assert(t, options.Label.Matches(labels.Set{"node-cache.gke.io": "lssd", "pool": "cache"}))
+	assert.Assert(t, !options.Label.Matches(labels.Set{"pool": "cache"}))
+
+	options, err = nodeCacheOptions(nil, true)
+	assert.NilError(t, err)
+	assert.Equal(t, options.Label.String(), "node-cache.gke.io")
+}
+
+func TestVolumeCacheOptions(t *testing.T) {
+	pvcs, pvs, err := volumeCacheOptions()
+	assert.NilError(t, err)
+	assert.Assert(t, pvcs.Label.Matches(labels.Set{managedByLabel: managedByValue}))
+	assert.Assert(t, !pvcs.Label.Matches(labels.Set{}))
+	assert.Assert(t, pvs.Label.Matches(labels.Set{provisionedForLabel: "n"}))
+	assert.Assert(t, !pvs.Label.Matches(labels.Set{}))
+}
+
+func TestStripNode(t *testing.T) {
+	node := &corev1.Node{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:          "n",
+			Labels:        map[string]string{"node-cache.gke.io": "lssd"},
+			ManagedFields: []metav1.ManagedFieldsEntry{{Manager: "kubelet"}},
+		},
+		Status: corev1.NodeStatus{
+			Allocatable: corev1.ResourceList{corev1.ResourceMemory: resource.MustParse("16Gi")},
+			Conditions:  []corev1.NodeCondition{{Type: corev1.NodeReady, Status: corev1.ConditionTrue}},
+			Images:      []corev1.ContainerImage{{Names: []string{"busybox"}}},
+		},
+	}
+	obj, err := stripNode(node)
+	assert.NilError(t, err)
+	stripped := obj.(*corev1.Node)
+	assert.Equal(t, len(stripped.ManagedFields), 0)
+	assert.Equal(t, len(stripped.Status.Images), 0)
+	assert.Equal(t, stripped.Labels["node-cache.gke.io"], "lssd")
+	assert.Equal(t, len(stripped.Status.Conditions), 1)
+	assert.Assert(t, stripped.Status.Allocatable.Memory().Equal(resource.MustParse("16Gi")))
+
+	other := &corev1.Pod{}
+	obj, err = stripNode(other)
+	assert.NilError(t, err)
+	assert.Equal(t, obj, any(other))
+}
@@ -0,0 +1,62 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package csi
+
+import (
+	"os"
+	"path/filepath"
+
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/klog/v2"
+	"k8s.io/mount-utils"
+)
+
+// cleanupOrphanMounts unmounts bind mounts of the caches under cacheRoot into
+// the kubelet directories of pods that no longer exist, as can be left after
+// a node crash. It returns the number of mounts cleaned up.
+func cleanupOrphanMounts(cacheRoot string, pods map[types.UID]bool, mounter mount.Interface) int {
+	entries, err := os.ReadDir(cacheRoot)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			klog.Errorf("Could not scan %s for orphaned mounts: %v", cacheRoot, err)
+		}
+		return 0
+	}
+	cleaned := 0
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		cachePath := filepath.Join(cacheRoot, entry.Name())
+		if notMnt, err := mounter.IsLikelyNotMountPoint(cachePath); err != nil || notMnt {
+			continue
+		}
+		refs, err := mounter.GetMountRefs(cachePath)
+		if err != nil {
+			klog.Errorf("Could not find mounts of %s: %v", cachePath, err)
+			continue
+		}
+		for _, ref := range refs {
+			uid := targetPodUID(ref)
+			if uid == "" || pods[uid] {
+				continue
+			}
+			if cleanupStaleTarget(mounter, ref, "orphaned") {
+				cleaned++
+			}
+		}
+	}
+	return cleaned
+}
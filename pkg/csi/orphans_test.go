@@ -0,0 +1,59 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package csi
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"gotest.tools/v3/assert"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/mount-utils"
+)
+
+func TestCleanupOrphanMounts(t *testing.T) {
+	dir := t.TempDir()
+	mkdir := func(parts ...string) string {
+		path := filepath.Join(append([]string{dir}, parts...)...)
+		assert.NilError(t, os.MkdirAll(path, 0750))
+		return path
+	}
+	cacheRoot := mkdir("local")
+	lssd := mkdir("local", "lssd")
+	mkdir("local", "tmpfs")
+	running := mkdir("pods", "running", "volumes", "kubernetes.io~csi", "cache", "mount")
+	orphaned := mkdir("pods", "orphaned", "volumes", "kubernetes.io~csi", "cache", "mount")
+	other := mkdir("pods", "orphaned", "volumes", "kubernetes.io~csi", "other", "mount")
+
+	mounter := mount.NewFakeMounter([]mount.MountPoint{
+		{Device: "/dev/md/lssd", Path: lssd},
+		{Device: "/dev/md/lssd", Path: running},
+		{Device: "/dev/md/lssd", Path: orphaned},
+		{Device: "/dev/sdb", Path: other},
+	})
+	cleaned := cleanupOrphanMounts(cacheRoot, map[types.UID]bool{"running": true}, mounter)
+	assert.Equal(t, cleaned, 1)
+
+	mounts, err := mounter.List()
+	assert.NilError(t, err)
+	assert.DeepEqual(t, mounts, []mount.MountPoint{
+		{Device: "/dev/md/lssd", Path: lssd},
+		{Device: "/dev/md/lssd", Path: running},
+		{Device: "/dev/sdb", Path: other},
+	})
+
+	assert.Equal(t, cleanupOrphanMounts(filepath.Join(dir, "missing"), nil, mounter), 0)
+}
@@ -0,0 +1,313 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package csi
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"golang.org/x/sys/unix"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/klog/v2"
+
+	"github.com/GoogleCloudPlatform/csi-node-cache/pkg/common"
+	"github.com/GoogleCloudPlatform/csi-node-cache/pkg/gcs"
+	"github.com/GoogleCloudPlatform/csi-node-cache/pkg/prewarm"
+	"github.com/GoogleCloudPlatform/csi-node-cache/pkg/transfer"
+	"github.com/GoogleCloudPlatform/csi-node-cache/pkg/util"
+)
+
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
+// peerChecksum is a file checksum, valid while its size and modification time
+// are unchanged.
+type peerChecksum struct {
+	size     int64
+	modified time.Time
+	crc32c   uint32
+}
+
+// peerStore is the cache served to the drivers of other nodes seeding their
+// own caches. File generations are those of the prewarm objects the files
+// were downloaded from, if any, so that a cache seeded from a peer is not
+// downloaded again by its own prewarm.
+type peerStore struct {
+	// root returns the cache directory, or "" if there is no cache to serve.
+	root func() string
+	// prefix is the prefix of the prewarm location, used to name files.
+	prefix string
+
+	mutex sync.Mutex
+	sums  map[string]peerChecksum
+}
+
+var _ transfer.Store = &peerStore{}
+
+func newPeerStore(root func() string, prefix string) *peerStore {
+	return &peerStore{root: root, prefix: prefix, sums: map[string]peerChecksum{}}
+}
+
+// List lists the cache contents with their checksums, which are only computed
+// for files that have changed since the last list.
+func (s *peerStore) List(ctx context.Context) ([]transfer.File, error) {
+	root := s.root()
+	if root == "" {
+		return nil, transfer.ErrUnavailable
+	}
+	manifest, err := buildManifest(ctx, root, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	done, err := prewarm.Completed(root)
+	if err != nil {
+		return nil, err
+	}
+	files := []transfer.File{}
+	seen := map[string]bool{}
+	for _, entry := range manifest.Files {
+		sum, err := s.checksum(root, entry)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		files = append(files, transfer.File{
+			Path:       entry.Path,
+			Generation: done[objectName(s.prefix, entry.Path)],
+			Size:       entry.Size,
+			CRC32C:     sum,
+		})
+		seen[entry.Path] = true
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for p := range s.sums {
+		if !seen[p] {
+			delete(s.sums, p)
+		}
+	}
+	return files, nil
+}
+
+func (s *peerStore) checksum(root string, entry ManifestEntry) (uint32, error) {
+	s.mutex.Lock()
+	sum, found := s.sums[entry.Path]
+	s.mutex.Unlock()
+	if found && sum.size == entry.Size && sum.modified.Equal(entry.Modified.Time) {
+		return sum.crc32c, nil
+	}
+	file, err := openCacheFile(root, entry.Path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	hash := crc32.New(crc32cTable)
+	if _, err := io.Copy(hash, file); err != nil {
+		return 0, err
+	}
+	sum = peerChecksum{size: entry.Size, modified: entry.Modified.Time, crc32c: hash.Sum32()}
+	s.mutex.Lock()
+	s.sums[entry.Path] = sum
+	s.mutex.Unlock()
+	return sum.crc32c, nil
+}
+
+// Open opens a regular file of the cache that is not one of the driver's
+// bookkeeping files or in its private directory.
+func (s *peerStore) Open(rel string) (io.ReadSeekCloser, error) {
+	root := s.root()
+	if root == "" {
+		return nil, transfer.ErrUnavailable
+	}
+	if isBookkeepingFile(path.Base(rel)) || isPrivatePath(rel) {
+		return nil, os.ErrNotExist
+	}
+	return openCacheFile(root, rel)
+}
+
+// openCacheFile opens the regular file at rel, a slash-separated path under
+// root. Pods may replace cache files with symlinks at any time, so the path is
+// opened without following symlinks and anything other than a regular file
+// under root is reported as not existing.
+func openCacheFile(root, rel string) (*os.File, error) {
+	// O_NONBLOCK keeps a planted FIFO from blocking the open.
+	file, err := util.OpenBeneath(root, filepath.FromSlash(rel), os.O_RDONLY|unix.O_NONBLOCK, 0)
+	if errors.Is(err, unix.ELOOP) || errors.Is(err, unix.EXDEV) {
+		return nil, os.ErrNotExist
+	} else if err != nil {
+		return nil, err
+	}
+	if info, err := file.Stat(); err != nil || !info.Mode().IsRegular() {
+		file.Close()
+		return nil, os.ErrNotExist
+	}
+	return file, nil
+}
+
+// ServePeer serves the cache to other nodes on the peer address, which is
+// advertised in the common.PeerAddressAnnotation of the node so that the
+// controller may choose it as a seed donor. Only peers with the driver's
+// service account are served.
+func (d *Driver) ServePeer(ctx context.Context) error {
+	auth, err := transfer.NewTokenReviewAuthenticator(d.client, []string{d.volumeTypeMap.Namespace + "/" + d.peerServiceAccount})
+	if err != nil {
+		return err
+	}
+	serverTLS, err := transfer.ServerTLSConfig(d.peerCertDir)
+	if err != nil {
+		return err
+	}
+	server, err := transfer.NewServer(newPeerStore(d.peerRoot, d.prewarmLocation.Prefix), transfer.ServerOptions{
+		Authenticator:  auth,
+		TLS:            serverTLS,
+		BytesPerSecond: d.peerBytesPerSecond,
+	})
+	if err != nil {
+		return err
+	}
+	listener, err := net.Listen("tcp", d.peerAddress)
+	if err != nil {
+		return err
+	}
+	if err := d.setNodeAnnotation(ctx, common.PeerAddressAnnotation, d.peerAddress); err != nil {
+		klog.Errorf("Could not advertise peer address %s, the cache won't be used to seed other nodes: %v", d.peerAddress, err)
+	}
+	klog.V(2).Infof("Serving the cache to peers on %s", d.peerAddress)
+	return server.Serve(listener)
+}
+
+// peerRoot returns the path of the cache if it may be served to peers.
+func (d *Driver) peerRoot() string {
+	d.volMutex.Lock()
+	defer d.volMutex.Unlock()
+	if d.vol == nil || d.inMaintenance || d.released || !seedable(d.volType) {
+		return ""
+	}
+	return d.vol.Path()
+}
+
+// seedable returns true for cache types that may be seeded from, or used to
+// seed, another node. Caches on remote storage are shared already, and
+// hugetlbfs can't be written by copying files.
+func seedable(volumeType string) bool {
+	switch volumeType {
+	case "tmpfs", "lssd", "pd", mirroredVolumeType, bootdiskVolumeType, loopVolumeType:
+		return true
+	}
+	return false
+}
+
+// objectName is the name of the prewarm object for a path in the cache.
+func objectName(prefix, rel string) string {
+	if prefix == "" {
+		return rel
+	}
+	return prefix + "/" + rel
+}
+
+// peerSource reads files from a peer. It implements prewarm.Source, naming
+// files as the objects of the prewarm location they would be downloaded from.
+type peerSource struct {
+	client *transfer.Client
+	prefix string
+
+	// paths maps object names to peer paths, filled by List.
+	paths map[string]string
+}
+
+func newPeerSource(client *transfer.Client, prefix string) *peerSource {
+	return &peerSource{client: client, prefix: prefix, paths: map[string]string{}}
+}
+
+// List returns the files of the peer. The location is ignored.
+func (p *peerSource) List(ctx context.Context, _ gcs.Location) ([]gcs.Object, error) {
+	files, err := p.client.List(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	objects := make([]gcs.Object, 0, len(files))
+	for _, f := range files {
+		name := objectName(p.prefix, f.Path)
+		p.paths[name] = f.Path
+		objects = append(objects, gcs.Object{Name: name, Size: f.Size, Generation: f.Generation, CRC32C: f.CRC32C})
+	}
+	return objects, nil
+}
+
+// ReadRange reads part of a file listed by the peer.
+func (p *peerSource) ReadRange(ctx context.Context, _ string, obj gcs.Object, offset, length int64) (io.ReadCloser, error) {
+	rel, found := p.paths[obj.Name]
+	if !found {
+		return nil, fmt.Errorf("%s was not listed by the peer", obj.Name)
+	}
+	return p.client.Read(ctx, rel, offset, length)
+}
+
+// seedFromPeer fills a new cache from the donor chosen by the controller, if
+// any. It returns false if there is no usable donor, and otherwise the result
+// of the copy. Files are checked against the donor's checksums as with a
+// prewarm, and recorded in the prewarm state.
+func (d *Driver) seedFromPeer(ctx context.Context, dir string, opts prewarm.Options) (bool, error) {
+	node, err := d.client.CoreV1().Nodes().Get(ctx, d.nodeId, metav1.GetOptions{})
+	if err != nil {
+		klog.Errorf("Could not get node to find a seed donor: %v", err)
+		return false, nil
+	}
+	donor := node.GetAnnotations()[common.SeedDonorAnnotation]
+	if donor == "" {
+		return false, nil
+	}
+	donorNode, err := d.client.CoreV1().Nodes().Get(ctx, donor, metav1.GetOptions{})
+	if err != nil {
+		klog.Errorf("Could not get seed donor %s: %v", donor, err)
+		return false, nil
+	}
+	address := donorNode.GetAnnotations()[common.PeerAddressAnnotation]
+	if address == "" {
+		klog.Warningf("Not seeding from %s, which has no peer address", donor)
+		return false, nil
+	}
+
+	if err := d.setNodeAnnotation(ctx, common.PrewarmStateAnnotation, common.PrewarmSeeding); err != nil {
+		klog.Errorf("Could not mark node seeding: %v", err)
+	}
+	clientTLS, err := transfer.ClientTLSConfig(d.peerCertDir)
+	if err != nil {
+		return true, err
+	}
+	client, err := transfer.NewClient(address, d.peerTokenFile, clientTLS)
+	if err != nil {
+		return true, err
+	}
+	defer client.Close()
+	klog.Infof("Seeding cache from %s at %s", donor, address)
+	stats, err := prewarm.Run(ctx, newPeerSource(client, d.prewarmLocation.Prefix), gcs.Location{Prefix: d.prewarmLocation.Prefix}, dir, opts)
+	if err != nil {
+		klog.Errorf("Seeding from %s failed after %d files: %v", donor, stats.Objects, err)
+		return true, err
+	}
+	klog.Infof("Seeded %d files (%d bytes) from %s, %d already present", stats.Objects, stats.Bytes, donor, stats.Skipped)
+	return true, nil
+}
@@ -0,0 +1,166 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package csi
+
+import (
+	"context"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"gotest.tools/v3/assert"
+	certutil "k8s.io/client-go/util/cert"
+
+	"github.com/GoogleCloudPlatform/csi-node-cache/pkg/gcs"
+	"github.com/GoogleCloudPlatform/csi-node-cache/pkg/prewarm"
+	"github.com/GoogleCloudPlatform/csi-node-cache/pkg/transfer"
+)
+
+func writeFiles(t *testing.T, root string, files map[string]string) {
+	t.Helper()
+	for name, contents := range files {
+		path := filepath.Join(root, filepath.FromSlash(name))
+		assert.NilError(t, os.MkdirAll(filepath.Dir(path), 0750))
+		assert.NilError(t, os.WriteFile(path, []byte(contents), 0640))
+	}
+}
+
+type allowPeers struct{}
+
+func (allowPeers) Authenticate(ctx context.Context, token string) error {
+	return nil
+}
+
+// servePeer serves root to a client.
+func servePeer(t *testing.T, root func() string) *transfer.Client {
+	t.Helper()
+	cert, key, err := certutil.GenerateSelfSignedCertKey(transfer.ServerName, nil, nil)
+	assert.NilError(t, err)
+	certDir := t.TempDir()
+	for name, data := range map[string][]byte{"tls.crt": cert, "tls.key": key, "ca.crt": cert} {
+		assert.NilError(t, os.WriteFile(filepath.Join(certDir, name), data, 0600))
+	}
+	serverTLS, err := transfer.ServerTLSConfig(certDir)
+	assert.NilError(t, err)
+	server, err := transfer.NewServer(newPeerStore(root, "data"), transfer.ServerOptions{Authenticator: allowPeers{}, TLS: serverTLS})
+	assert.NilError(t, err)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NilError(t, err)
+	go server.Serve(listener)
+	t.Cleanup(server.Stop)
+
+	token := filepath.Join(t.TempDir(), "token")
+	assert.NilError(t, os.WriteFile(token, []byte("token"), 0600))
+	clientTLS, err := transfer.ClientTLSConfig(certDir)
+	assert.NilError(t, err)
+	client, err := transfer.NewClient(listener.Addr().String(), token, clientTLS)
+	assert.NilError(t, err)
+	t.Cleanup(func() { client.Close() })
+	return client
+}
+
+func TestPeerSeed(t *testing.T) {
+	donor := t.TempDir()
+	writeFiles(t, donor, map[string]string{
+		"models/llm/weights": strings.Repeat("w", 1000),
+		"models/dir name/a":  "a",
+		"empty":              "",
+		ManifestFile:         "{}",
+	})
+	// The donor prewarmed the weights from data/models/llm/weights.
+	assert.NilError(t, os.WriteFile(filepath.Join(donor, prewarm.StateFile), []byte(`{"done":{"data/models/llm/weights":7}}`), 0640))
+
+	client := servePeer(t, func() string { return donor })
+	dir := t.TempDir()
+	stats, err := prewarm.Run(context.Background(), newPeerSource(client, "data"), gcs.Location{Prefix: "data"}, dir, prewarm.Options{ChunkSize: 300})
+	assert.NilError(t, err)
+	assert.Equal(t, stats.Objects, 3)
+	assert.Equal(t, stats.Bytes, int64(1001))
+
+	data, err := os.ReadFile(filepath.Join(dir, "models", "llm", "weights"))
+	assert.NilError(t, err)
+	assert.Equal(t, string(data), strings.Repeat("w", 1000))
+	data, err = os.ReadFile(filepath.Join(dir, "models", "dir name", "a"))
+	assert.NilError(t, err)
+	assert.Equal(t, string(data), "a")
+	_, err = os.Stat(filepath.Join(dir, ManifestFile))
+	assert.Assert(t, os.IsNotExist(err), "bookkeeping files should not be copied")
+
+	// The generation from the donor's prewarm is kept, so a prewarm from GCS
+	// skips the file.
+	done, err := prewarm.Completed(dir)
+	assert.NilError(t, err)
+	assert.Equal(t, done["data/models/llm/weights"], int64(7))
+}
+
+func TestPeerStore(t *testing.T) {
+	root := t.TempDir()
+	writeFiles(t, root, map[string]string{"a": "hello", privateDir + "/clones/x/y": "clone"})
+	var current atomic.Value
+	current.Store(root)
+	client := servePeer(t, func() string { return current.Load().(string) })
+	ctx := context.Background()
+
+	files, err := client.List(ctx, nil)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, files, []transfer.File{{Path: "a", Size: 5, CRC32C: 0x9a71bb4c}})
+
+	// Errors are returned once the stream is read.
+	r, err := client.Read(ctx, prewarm.StateFile, 0, 1)
+	assert.NilError(t, err)
+	_, err = io.ReadAll(r)
+	r.Close()
+	assert.ErrorContains(t, err, "NotFound")
+
+	r, err = client.Read(ctx, privateDir+"/clones/x/y", 0, 1)
+	assert.NilError(t, err)
+	_, err = io.ReadAll(r)
+	r.Close()
+	assert.ErrorContains(t, err, "NotFound")
+
+	current.Store("")
+	_, err = client.List(ctx, nil)
+	assert.ErrorContains(t, err, "Unavailable")
+}
+
+func TestPeerStoreSymlink(t *testing.T) {
+	root := t.TempDir()
+	outside := t.TempDir()
+	writeFiles(t, root, map[string]string{"a": "hello"})
+	writeFiles(t, outside, map[string]string{"secret": "token"})
+	assert.NilError(t, os.Symlink(filepath.Join(outside, "secret"), filepath.Join(root, "link")))
+	client := servePeer(t, func() string { return root })
+	ctx := context.Background()
+
+	files, err := client.List(ctx, nil)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, files, []transfer.File{{Path: "a", Size: 5, CRC32C: 0x9a71bb4c}})
+
+	// A pod swaps the listed file for a symlink out of the cache.
+	assert.NilError(t, os.Remove(filepath.Join(root, "a")))
+	assert.NilError(t, os.Symlink(filepath.Join(outside, "secret"), filepath.Join(root, "a")))
+	for _, name := range []string{"a", "link"} {
+		r, err := client.Read(ctx, name, 0, 5)
+		assert.NilError(t, err)
+		data, err := io.ReadAll(r)
+		r.Close()
+		assert.ErrorContains(t, err, "NotFound")
+		assert.Assert(t, !strings.Contains(string(data), "token"), "read %q through %s", data, name)
+	}
+}
@@ -0,0 +1,67 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package csi
+
+import (
+	"fmt"
+	"strings"
+)
+
+// consumerPolicy restricts the pods that may mount the cache to those in
+// allowed namespaces, or running as allowed service accounts. An empty policy
+// allows all pods.
+type consumerPolicy struct {
+	namespaces map[string]bool
+	// serviceAccounts are keyed by namespace/name.
+	serviceAccounts map[string]bool
+}
+
+// newConsumerPolicy creates a policy from lists of namespaces and service
+// accounts, the latter given as namespace/name.
+func newConsumerPolicy(namespaces, serviceAccounts []string) (consumerPolicy, error) {
+	p := consumerPolicy{namespaces: map[string]bool{}, serviceAccounts: map[string]bool{}}
+	for _, ns := range namespaces {
+		p.namespaces[ns] = true
+	}
+	for _, sa := range serviceAccounts {
+		ns, name, found := strings.Cut(sa, "/")
+		if !found || ns == "" || name == "" || strings.Contains(name, "/") {
+			return consumerPolicy{}, fmt.Errorf("bad service account %q, expected namespace/name", sa)
+		}
+		p.serviceAccounts[sa] = true
+	}
+	return p, nil
+}
+
+// check returns an error if the pod described by a publish volume context is
+// not allowed. Pod information is only present if the CSIDriver has
+// podInfoOnMount, so a restricted policy refuses volumes without it.
+func (p consumerPolicy) check(volumeContext map[string]string) error {
+	if len(p.namespaces) == 0 && len(p.serviceAccounts) == 0 {
+		return nil
+	}
+	ns, found := volumeContext[podNamespaceKey]
+	if !found {
+		return fmt.Errorf("no pod information in the volume context, is podInfoOnMount set on the CSIDriver?")
+	}
+	if p.namespaces[ns] {
+		return nil
+	}
+	sa := volumeContext[podServiceAccountKey]
+	if sa != "" && p.serviceAccounts[ns+"/"+sa] {
+		return nil
+	}
+	return fmt.Errorf("pod %s/%s with service account %q may not use the cache", ns, volumeContext[podNameKey], sa)
+}
@@ -0,0 +1,63 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package csi
+
+import (
+	"testing"
+
+	"gotest.tools/v3/assert"
+)
+
+func TestConsumerPolicy(t *testing.T) {
+	pod := func(namespace, serviceAccount string) map[string]string {
+		return map[string]string{
+			"csi.storage.k8s.io/pod.name":            "pod",
+			"csi.storage.k8s.io/pod.namespace":       namespace,
+			"csi.storage.k8s.io/serviceAccount.name": serviceAccount,
+		}
+	}
+
+	for _, tc := range []struct {
+		name            string
+		namespaces      []string
+		serviceAccounts []string
+		volumeContext   map[string]string
+		allowed         bool
+	}{
+		{name: "unrestricted", volumeContext: map[string]string{}, allowed: true},
+		{name: "namespace", namespaces: []string{"ml"}, volumeContext: pod("ml", "default"), allowed: true},
+		{name: "other namespace", namespaces: []string{"ml"}, volumeContext: pod("web", "default")},
+		{name: "service account", serviceAccounts: []string{"web/loader"}, volumeContext: pod("web", "loader"), allowed: true},
+		{name: "service account in other namespace", serviceAccounts: []string{"web/loader"}, volumeContext: pod("ml", "loader")},
+		{name: "either list", namespaces: []string{"ml"}, serviceAccounts: []string{"web/loader"}, volumeContext: pod("web", "loader"), allowed: true},
+		{name: "no pod info", namespaces: []string{"ml"}, volumeContext: map[string]string{}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			p, err := newConsumerPolicy(tc.namespaces, tc.serviceAccounts)
+			assert.NilError(t, err)
+			err = p.check(tc.volumeContext)
+			if tc.allowed {
+				assert.NilError(t, err)
+			} else {
+				assert.Assert(t, err != nil)
+			}
+		})
+	}
+
+	for _, sa := range []string{"loader", "/loader", "web/", "web/loader/x"} {
+		_, err := newConsumerPolicy(nil, []string{sa})
+		assert.Assert(t, err != nil, sa)
+	}
+}
@@ -0,0 +1,55 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package csi
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/klog/v2"
+
+	"github.com/GoogleCloudPlatform/csi-node-cache/pkg/common"
+)
+
+// RunCachePreparation creates the cache in the background, every interval
+// until ctx is done, so that devices are assembled and formatted as soon as
+// they are available rather than on the first publish. A publish while the
+// cache is being prepared waits for it to finish.
+func (d *Driver) RunCachePreparation(ctx context.Context, interval time.Duration) {
+	wait.UntilWithContext(ctx, d.prepareCache, interval)
+}
+
+func (d *Driver) prepareCache(ctx context.Context) {
+	d.volMutex.Lock()
+	defer d.volMutex.Unlock()
+
+	if d.vol != nil || d.inMaintenance {
+		return
+	}
+	start := time.Now()
+	if _, err := d.cacheVolume(ctx); err != nil {
+		var pending *common.VolumePendingError
+		if errors.As(err, &pending) {
+			klog.V(4).Infof("Cache not ready to prepare: %v", err)
+		} else {
+			klog.Errorf("Could not prepare cache, will retry: %v", err)
+			d.lastError = err.Error()
+		}
+		return
+	}
+	klog.Infof("Prepared %s cache in %v", d.volType, time.Since(start).Round(time.Millisecond))
+}
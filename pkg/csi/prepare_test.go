@@ -0,0 +1,164 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package csi
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"gotest.tools/v3/assert"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	utilexec "k8s.io/utils/exec"
+
+	"github.com/GoogleCloudPlatform/csi-node-cache/pkg/localvolume"
+	"github.com/GoogleCloudPlatform/csi-node-cache/pkg/util"
+)
+
+// prepareRunner fakes the commands creating a loop cache. The device is
+// always unformatted, and mkfs fails while mkfsErr is set.
+type prepareRunner struct {
+	mkfsErr  error
+	commands []string
+}
+
+func (r *prepareRunner) RunCommand(ctx context.Context, opts util.CommandOptions, cmd string, args ...string) (util.CommandResult, error) {
+	r.commands = append(r.commands, cmd)
+	switch cmd {
+	case "losetup":
+		if args[0] == "--find" {
+			return util.CommandResult{Stdout: []byte("/dev/null\n")}, nil
+		}
+		return util.CommandResult{}, nil
+	case "blkid":
+		return util.CommandResult{}, utilexec.CodeExitError{Err: errors.New("exit status 2"), Code: 2}
+	case "mkfs.ext4":
+		return util.CommandResult{}, r.mkfsErr
+	case "mount":
+		return util.CommandResult{}, nil
+	}
+	return util.CommandResult{}, errors.New("unexpected " + cmd)
+}
+
+func (r *prepareRunner) count(cmd string) int {
+	n := 0
+	for _, c := range r.commands {
+		if c == cmd {
+			n++
+		}
+	}
+	return n
+}
+
+// prepareDriver returns a driver whose volume type map, served by a fake API
+// server, gives the node a loop cache.
+func prepareDriver(t *testing.T) *Driver {
+	data := map[string]string{}
+	assert.NilError(t, writeVolumeTypeMapping(data, map[string]volumeTypeInfo{
+		"node": {VolumeType: loopVolumeType, Size: resource.MustParse("1Gi")},
+	}))
+	volumeTypeMap := types.NamespacedName{Namespace: "kube-system", Name: "node-cache"}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasSuffix(r.URL.Path, "/namespaces/kube-system/configmaps/node-cache") {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(&corev1.ConfigMap{
+			TypeMeta:   metav1.TypeMeta{APIVersion: "v1", Kind: "ConfigMap"},
+			ObjectMeta: metav1.ObjectMeta{Namespace: volumeTypeMap.Namespace, Name: volumeTypeMap.Name},
+			Data:       data,
+		})
+	}))
+	t.Cleanup(server.Close)
+	client, err := kubernetes.NewForConfig(&rest.Config{Host: server.URL})
+	assert.NilError(t, err)
+
+	d := &Driver{
+		client:        client,
+		nodeId:        "node",
+		volumeTypeMap: volumeTypeMap,
+		cacheRoot:     t.TempDir(),
+		bootDiskPath:  t.TempDir(),
+	}
+	s, err := newSettings(DriverOptions{})
+	assert.NilError(t, err)
+	d.current.Store(s)
+	return d
+}
+
+func TestPrepareCacheFormatsOnce(t *testing.T) {
+	runner := &prepareRunner{}
+	util.SetCommandRunner(runner)
+	defer util.SetCommandRunner(nil)
+
+	d := prepareDriver(t)
+	ctx := context.Background()
+	d.prepareCache(ctx)
+	assert.Assert(t, d.vol != nil)
+	assert.Equal(t, d.vol.Path(), filepath.Join(d.cacheRoot, loopPath))
+	d.prepareCache(ctx)
+	assert.Equal(t, runner.count("mkfs.ext4"), 1)
+	assert.Equal(t, runner.count("mount"), 1)
+}
+
+func TestPrepareCacheRetriesFailure(t *testing.T) {
+	runner := &prepareRunner{mkfsErr: utilexec.CodeExitError{Err: errors.New("exit status 1"), Code: 1}}
+	util.SetCommandRunner(runner)
+	defer util.SetCommandRunner(nil)
+
+	d := prepareDriver(t)
+	ctx := context.Background()
+	d.prepareCache(ctx)
+	assert.Assert(t, d.vol == nil)
+	assert.Assert(t, d.lastError != "")
+	assert.Equal(t, runner.count("mkfs.ext4"), 1)
+
+	// The failure is kept until the retry interval has passed.
+	runner.mkfsErr = nil
+	d.prepareCache(ctx)
+	assert.Assert(t, d.vol == nil)
+	assert.Equal(t, runner.count("mkfs.ext4"), 1)
+
+	d.createErrTime = time.Now().Add(-createRetryInterval)
+	d.prepareCache(ctx)
+	assert.Assert(t, d.vol != nil)
+	assert.Equal(t, runner.count("mkfs.ext4"), 2)
+}
+
+func TestPrepareCacheKeepsPrepared(t *testing.T) {
+	runner := &prepareRunner{}
+	util.SetCommandRunner(runner)
+	defer util.SetCommandRunner(nil)
+
+	d := prepareDriver(t)
+	vol, err := localvolume.NewFromPath(d.cacheRoot)
+	assert.NilError(t, err)
+	d.vol = vol
+	d.prepareCache(context.Background())
+	assert.Equal(t, d.vol, vol)
+	assert.Equal(t, len(runner.commands), 0)
+}
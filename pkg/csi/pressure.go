@@ -0,0 +1,200 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package csi
+
+import (
+	"context"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+
+	"golang.org/x/sys/unix"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/klog/v2"
+
+	"github.com/GoogleCloudPlatform/csi-node-cache/pkg/localvolume"
+	"github.com/GoogleCloudPlatform/csi-node-cache/pkg/util"
+)
+
+// RunMemoryPressureWatch checks the node's MemoryPressure condition every
+// interval until ctx is done. While the node is under memory pressure, a tmpfs
+// cache is shrunk to the configured fraction of its size, evicting the least
+// recently used files to fit, so that the cache doesn't cause workloads to be
+// OOM killed. The size is restored when the pressure clears; evicted files are
+// not.
+func (d *Driver) RunMemoryPressureWatch(ctx context.Context, interval time.Duration) {
+	wait.UntilWithContext(ctx, d.checkMemoryPressure, interval)
+}
+
+func (d *Driver) checkMemoryPressure(ctx context.Context) {
+	node, err := d.client.CoreV1().Nodes().Get(ctx, d.nodeId, metav1.GetOptions{})
+	if err != nil {
+		klog.Errorf("Could not get node %s for memory pressure check: %v", d.nodeId, err)
+		return
+	}
+	pressure := hasMemoryPressure(node)
+
+	d.volMutex.Lock()
+	defer d.volMutex.Unlock()
+	r, ok := d.vol.(localvolume.Resizer)
+	if !ok || d.inMaintenance {
+		return
+	}
+	switch {
+	case pressure && d.shrunkFrom.IsZero():
+		d.shrinkCache(ctx, r)
+	case !pressure && !d.shrunkFrom.IsZero():
+		size := d.shrunkFrom
+		if err := r.Resize(ctx, size); err != nil {
+			klog.Errorf("Could not restore %s cache to %s after memory pressure, will retry: %v", d.volType, size.String(), err)
+			return
+		}
+		d.shrunkFrom = resource.Quantity{}
+		cacheSizeBytes.Set(size.AsApproximateFloat64())
+		klog.Infof("Memory pressure cleared, restored %s cache to %s", d.volType, size.String())
+	}
+}
+
+// shrinkCache evicts files from the cache and shrinks it to the memory
+// pressure fraction of its size. volMutex must be held.
+func (d *Driver) shrinkCache(ctx context.Context, r localvolume.Resizer) {
+	size := r.Size()
+	target := resource.NewQuantity(int64(size.AsApproximateFloat64()*d.memoryPressureShrink), resource.BinarySI)
+	// A prewarm would refill the cache.
+	d.stopPrewarm()
+
+	usage, err := usageOf(d.vol.Path())
+	if err != nil {
+		klog.Errorf("Could not get cache usage for memory pressure: %v", err)
+		return
+	}
+	if excess := usage.BytesUsed - target.Value(); excess > 0 {
+		files, freed, err := evictFiles(d.vol.Path(), excess, ".")
+		if err != nil {
+			klog.Errorf("Could not evict files under memory pressure: %v", err)
+			return
+		}
+		klog.Infof("Evicted %d files (%d bytes) from the %s cache under memory pressure", files, freed, d.volType)
+	}
+	if err := r.Resize(ctx, *target); err != nil {
+		klog.Errorf("Could not shrink %s cache to %s under memory pressure, will retry: %v", d.volType, target.String(), err)
+		return
+	}
+	d.shrunkFrom = size
+	cacheSizeBytes.Set(target.AsApproximateFloat64())
+	klog.Infof("Node under memory pressure, shrunk %s cache from %s to %s", d.volType, size.String(), target.String())
+}
+
+func hasMemoryPressure(node *corev1.Node) bool {
+	for _, c := range node.Status.Conditions {
+		if c.Type == corev1.NodeMemoryPressure {
+			return c.Status == corev1.ConditionTrue
+		}
+	}
+	return false
+}
+
+// evictFiles removes the least recently used files under dirs, local paths in
+// the cache at cachePath, until at least bytes have been freed, returning the
+// number of files removed and the bytes freed. Files written by the driver
+// itself, and its private directory, are kept.
+func evictFiles(cachePath string, bytes int64, dirs ...string) (int, int64, error) {
+	type candidate struct {
+		rel     string
+		size    int64
+		lastUse time.Time
+	}
+	var candidates []candidate
+	walk := func(file string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if entry.IsDir() && isPrivateDir(cachePath, file) {
+			return filepath.SkipDir
+		}
+		if entry.IsDir() || !entry.Type().IsRegular() || isBookkeepingFile(entry.Name()) {
+			return nil
+		}
+		info, err := entry.Info()
+		if os.IsNotExist(err) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(cachePath, file)
+		if err != nil {
+			return err
+		}
+		candidates = append(candidates, candidate{rel: rel, size: info.Size(), lastUse: lastUse(info)})
+		return nil
+	}
+	for _, dir := range dirs {
+		if err := walkCacheDir(cachePath, dir, walk); err != nil {
+			return 0, 0, err
+		}
+	}
+	slices.SortFunc(candidates, func(a, b candidate) int { return a.lastUse.Compare(b.lastUse) })
+
+	files := 0
+	freed := int64(0)
+	for _, c := range candidates {
+		if freed >= bytes {
+			break
+		}
+		// Pods may have replaced a directory with a symlink since the walk,
+		// which is refused rather than followed.
+		if err := util.RemoveBeneath(cachePath, c.rel); err != nil && !os.IsNotExist(err) {
+			return files, freed, err
+		}
+		files++
+		freed += c.size
+	}
+	return files, freed, nil
+}
+
+// walkCacheDir walks dir, a local path in the cache at cachePath, unless it is
+// missing or reached through a symlink, which pods may plant to point the
+// walk elsewhere on the host.
+func walkCacheDir(cachePath, dir string, fn fs.WalkDirFunc) error {
+	f, err := util.OpenBeneath(cachePath, dir, unix.O_DIRECTORY|unix.O_RDONLY, 0)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		klog.Warningf("Skipping %s: %v", filepath.Join(cachePath, dir), err)
+		return nil
+	}
+	f.Close()
+	return filepath.WalkDir(filepath.Join(cachePath, dir), fn)
+}
+
+// lastUse is the later of the access and modification times of a file.
+func lastUse(info fs.FileInfo) time.Time {
+	st, ok := info.Sys().(*unix.Stat_t)
+	if !ok {
+		return info.ModTime()
+	}
+	if atime := time.Unix(st.Atim.Unix()); atime.After(info.ModTime()) {
+		return atime
+	}
+	return info.ModTime()
+}
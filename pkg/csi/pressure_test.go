@@ -0,0 +1,73 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package csi
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"gotest.tools/v3/assert"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+
+	"github.com/GoogleCloudPlatform/csi-node-cache/pkg/prewarm"
+)
+
+func TestEvictFiles(t *testing.T) {
+	root := t.TempDir()
+	old := time.Now().Add(-time.Hour)
+	for i, name := range []string{privateDir + "/clones/x/y", "a", "dir/b", "c", prewarm.StateFile} {
+		file := filepath.Join(root, name)
+		assert.NilError(t, os.MkdirAll(filepath.Dir(file), 0750))
+		assert.NilError(t, os.WriteFile(file, make([]byte, 100), 0640))
+		// Older files first.
+		when := old.Add(time.Duration(i) * time.Minute)
+		assert.NilError(t, os.Chtimes(file, when, when))
+	}
+
+	files, freed, err := evictFiles(root, 150, ".")
+	assert.NilError(t, err)
+	assert.Equal(t, files, 2)
+	assert.Equal(t, freed, int64(200))
+	for name, exists := range map[string]bool{privateDir + "/clones/x/y": true, "a": false, "dir/b": false, "c": true, prewarm.StateFile: true} {
+		_, err := os.Stat(filepath.Join(root, name))
+		assert.Equal(t, err == nil, exists, name)
+	}
+}
+
+func TestHasMemoryPressure(t *testing.T) {
+	node := &corev1.Node{}
+	assert.Assert(t, !hasMemoryPressure(node))
+	node.Status.Conditions = []corev1.NodeCondition{
+		{Type: corev1.NodeDiskPressure, Status: corev1.ConditionTrue},
+		{Type: corev1.NodeMemoryPressure, Status: corev1.ConditionFalse},
+	}
+	assert.Assert(t, !hasMemoryPressure(node))
+	node.Status.Conditions[1].Status = corev1.ConditionTrue
+	assert.Assert(t, hasMemoryPressure(node))
+}
+
+func TestResizeWhileShrunk(t *testing.T) {
+	vol := &fakeResizer{size: resource.MustParse("512Mi")}
+	d := &Driver{vol: vol, volType: "tmpfs", shrunkFrom: resource.MustParse("1Gi")}
+
+	// A new size is kept for when the pressure clears.
+	d.resizeCache(context.Background(), volumeTypeInfo{VolumeType: "tmpfs", Size: resource.MustParse("2Gi")})
+	assert.Equal(t, vol.resizes, 0)
+	assert.Equal(t, d.shrunkFrom.String(), "2Gi")
+}
@@ -0,0 +1,152 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package csi
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"k8s.io/klog/v2"
+
+	"github.com/GoogleCloudPlatform/csi-node-cache/pkg/common"
+	"github.com/GoogleCloudPlatform/csi-node-cache/pkg/localvolume"
+	"github.com/GoogleCloudPlatform/csi-node-cache/pkg/prewarm"
+)
+
+// startPrewarm fills a newly created cache in the background, first from a
+// peer if the controller has chosen a seed donor, then from the prewarm
+// location if there is one. Objects copied from the peer are not downloaded
+// again. volMutex must be held.
+func (d *Driver) startPrewarm(vol localvolume.LocalVolume) {
+	seed := d.seeds()
+	if !seed && (d.gcs == nil || d.prewarmLocation.Bucket == "") {
+		return
+	}
+	if d.volType == hugetlbfsVolumeType {
+		klog.Warningf("Not prewarming, files can't be written to a hugetlbfs cache")
+		return
+	}
+	opts := d.settings().prewarmOptions
+	shard, err := prewarm.ParseShard(d.prewarmShard)
+	if err != nil {
+		klog.Errorf("Not prewarming, bad shard in volume type map: %v", err)
+		return
+	}
+	opts.Shard = shard
+	opts.Budget = d.background
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	d.prewarmCancel = cancel
+	d.prewarmDone = done
+	go func() {
+		defer close(done)
+		tried, seedErr := false, error(nil)
+		if seed {
+			tried, seedErr = d.seedFromPeer(ctx, vol.Path(), opts)
+		}
+		if tried && ctx.Err() != nil {
+			klog.Infof("Seeding from peer stopped, will resume with the next cache")
+			return
+		}
+		if d.gcs == nil || d.prewarmLocation.Bucket == "" {
+			if tried && seedErr != nil {
+				d.setPrewarmState(common.PrewarmFailed)
+			} else if tried {
+				d.markPrewarmComplete(vol.Path())
+				d.setPrewarmState(common.PrewarmDone)
+			}
+			return
+		}
+		if err := d.setNodeAnnotation(ctx, common.PrewarmStateAnnotation, common.PrewarmRunning); err != nil {
+			klog.Errorf("Could not mark node prewarming: %v", err)
+		}
+		stats, err := prewarm.Run(ctx, d.gcs, d.prewarmLocation, vol.Path(), opts)
+		if errors.Is(err, context.Canceled) {
+			klog.Infof("Prewarm from %s stopped after %d objects, will resume with the next cache", d.prewarmLocation, stats.Objects)
+			return
+		}
+		state := common.PrewarmDone
+		if err != nil {
+			klog.Errorf("Prewarm from %s failed after %d objects: %v", d.prewarmLocation, stats.Objects, err)
+			state = common.PrewarmFailed
+		} else {
+			klog.Infof("Prewarmed %d objects (%d bytes) from %s, %d already present", stats.Objects, stats.Bytes, d.prewarmLocation, stats.Skipped)
+			d.markPrewarmComplete(vol.Path())
+		}
+		d.setPrewarmState(state)
+	}()
+}
+
+// seeds returns true if new caches are seeded from a peer chosen by the
+// controller.
+func (d *Driver) seeds() bool {
+	return d.peerAddress != "" && seedable(d.volType) && d.prewarmShard == ""
+}
+
+// prewarms returns true if new caches are filled in the background, from a
+// peer or the prewarm location.
+func (d *Driver) prewarms() bool {
+	return (d.seeds() || d.gcs != nil && d.prewarmLocation.Bucket != "") && d.volType != hugetlbfsVolumeType
+}
+
+// markPrewarmComplete records in the prewarm state of the cache at dir that it
+// has been filled, for strict publishes.
+func (d *Driver) markPrewarmComplete(dir string) {
+	if err := prewarm.MarkComplete(dir); err != nil {
+		klog.Errorf("Could not mark prewarm complete, strict publishes will wait for the next cache: %v", err)
+	}
+}
+
+// checkPrewarmed returns an error if a volume with attributes must wait for
+// the cache to be filled. volMutex must be held.
+func (d *Driver) checkPrewarmed(attributes map[string]string) error {
+	if attributes[common.PrewarmAttribute] != common.PrewarmStrict || !d.prewarms() {
+		return nil
+	}
+	if d.prewarmDone != nil {
+		select {
+		case <-d.prewarmDone:
+		default:
+			return errors.New("the cache is still being prewarmed")
+		}
+	}
+	complete, err := prewarm.IsComplete(d.vol.Path())
+	if err != nil {
+		return fmt.Errorf("could not read prewarm state: %w", err)
+	}
+	if !complete {
+		return fmt.Errorf("the cache prewarm did not complete, see the %s node annotation", common.PrewarmStateAnnotation)
+	}
+	return nil
+}
+
+func (d *Driver) setPrewarmState(state string) {
+	if err := d.setNodeAnnotation(context.Background(), common.PrewarmStateAnnotation, state); err != nil {
+		klog.Errorf("Could not set prewarm state to %s: %v", state, err)
+	}
+}
+
+// stopPrewarm cancels any running prewarm and waits for it to stop, so that
+// the cache can be released. volMutex must be held.
+func (d *Driver) stopPrewarm() {
+	if d.prewarmCancel == nil {
+		return
+	}
+	d.prewarmCancel()
+	<-d.prewarmDone
+	d.prewarmCancel = nil
+	d.prewarmDone = nil
+}
@@ -0,0 +1,50 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package csi
+
+import (
+	"testing"
+
+	"gotest.tools/v3/assert"
+
+	"github.com/GoogleCloudPlatform/csi-node-cache/pkg/common"
+	"github.com/GoogleCloudPlatform/csi-node-cache/pkg/gcs"
+	"github.com/GoogleCloudPlatform/csi-node-cache/pkg/localvolume"
+	"github.com/GoogleCloudPlatform/csi-node-cache/pkg/prewarm"
+)
+
+func TestCheckPrewarmed(t *testing.T) {
+	vol, err := localvolume.NewFromPath(t.TempDir())
+	assert.NilError(t, err)
+	d := &Driver{vol: vol, volType: "lssd", gcs: &gcs.Client{}, prewarmLocation: gcs.Location{Bucket: "bucket"}}
+	strict := map[string]string{common.PrewarmAttribute: common.PrewarmStrict}
+
+	// Eager publishes don't wait.
+	d.prewarmDone = make(chan struct{})
+	assert.NilError(t, d.checkPrewarmed(map[string]string{}))
+	assert.NilError(t, d.checkPrewarmed(map[string]string{common.PrewarmAttribute: common.PrewarmEager}))
+	assert.ErrorContains(t, d.checkPrewarmed(strict), "still being prewarmed")
+
+	close(d.prewarmDone)
+	assert.ErrorContains(t, d.checkPrewarmed(strict), "did not complete")
+	assert.NilError(t, prewarm.MarkComplete(vol.Path()))
+	assert.NilError(t, d.checkPrewarmed(strict))
+
+	// There is nothing to wait for without a prewarm.
+	empty, err := localvolume.NewFromPath(t.TempDir())
+	assert.NilError(t, err)
+	d = &Driver{vol: empty, volType: "lssd"}
+	assert.NilError(t, d.checkPrewarmed(strict))
+}
@@ -0,0 +1,131 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package csi
+
+import (
+	"context"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/klog/v2"
+)
+
+// RunPriorityQuota accounts the low priority data in the cache every interval
+// until ctx is done. When it is over the share of the cache not reserved for
+// high priority consumers, the least recently used low priority files are
+// evicted to fit, and new low priority publishes are refused until they are.
+func (d *Driver) RunPriorityQuota(ctx context.Context, interval time.Duration) {
+	wait.UntilWithContext(ctx, d.checkPriorityQuota, interval)
+}
+
+func (d *Driver) checkPriorityQuota(ctx context.Context) {
+	d.volMutex.Lock()
+	vol := d.vol
+	d.volMutex.Unlock()
+	if vol == nil {
+		return
+	}
+
+	// The cache is walked without volMutex, so that publishes aren't held up.
+	usage, err := usageOf(vol.Path())
+	if err != nil {
+		klog.Errorf("Could not get cache usage for priority quota: %v", err)
+		return
+	}
+	limit := lowPriorityLimit(usage.BytesTotal, d.highPriorityReserve)
+	roots := lowPriorityRoots(d.lowPriorityDirs())
+	used, err := filesBytes(vol.Path(), roots)
+	if err != nil {
+		klog.Errorf("Could not account low priority data: %v", err)
+		return
+	}
+	lowPriorityBytes.Set(float64(used))
+
+	d.volMutex.Lock()
+	defer d.volMutex.Unlock()
+	if d.vol != vol {
+		// Released while accounting.
+		return
+	}
+	d.lowPriorityOver = used > limit
+	if !d.lowPriorityOver {
+		return
+	}
+	files, freed, err := evictFiles(vol.Path(), used-limit, roots...)
+	if err != nil {
+		klog.Errorf("Could not evict low priority files: %v", err)
+		return
+	}
+	klog.Infof("Evicted %d low priority files (%d bytes) to keep within %d bytes of the cache", files, freed, limit)
+	d.lowPriorityOver = used-freed > limit
+	lowPriorityBytes.Set(float64(used - freed))
+}
+
+// lowPriorityLimit is the bytes of a cache of total bytes that low priority
+// data may use, when reserve of it is kept for high priority consumers.
+func lowPriorityLimit(total int64, reserve float64) int64 {
+	return int64(float64(total) * (1 - reserve))
+}
+
+// lowPriorityRoots returns the sorted low priority dirs without those within
+// another, so that their data isn't counted twice.
+func lowPriorityRoots(dirs []string) []string {
+	var roots []string
+	for _, dir := range dirs {
+		within := slices.ContainsFunc(roots, func(root string) bool {
+			return strings.HasPrefix(dir, root+string(filepath.Separator))
+		})
+		if !within {
+			roots = append(roots, dir)
+		}
+	}
+	return roots
+}
+
+// filesBytes returns the size of the cached files under dirs, local paths in
+// the cache at cachePath.
+func filesBytes(cachePath string, dirs []string) (int64, error) {
+	var total int64
+	for _, dir := range dirs {
+		err := walkCacheDir(cachePath, dir, func(file string, entry fs.DirEntry, err error) error {
+			if err != nil {
+				if os.IsNotExist(err) {
+					return nil
+				}
+				return err
+			}
+			if !entry.Type().IsRegular() || isBookkeepingFile(entry.Name()) {
+				return nil
+			}
+			info, err := entry.Info()
+			if os.IsNotExist(err) {
+				return nil
+			} else if err != nil {
+				return err
+			}
+			total += info.Size()
+			return nil
+		})
+		if err != nil {
+			return 0, err
+		}
+	}
+	return total, nil
+}
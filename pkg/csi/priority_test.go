@@ -0,0 +1,88 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package csi
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"gotest.tools/v3/assert"
+
+	"github.com/GoogleCloudPlatform/csi-node-cache/pkg/common"
+)
+
+func TestLowPriorityRoots(t *testing.T) {
+	d := &Driver{checkpoint: checkpoint{Targets: map[string]publishedTarget{}}}
+	for _, dir := range []string{"batch/nested", "batch-2", "jobs/a", "batch", "./batch"} {
+		d.checkpointLowPriority(dir)
+	}
+	assert.DeepEqual(t, d.lowPriorityDirs(), []string{"batch", "batch-2", "batch/nested", "jobs/a"})
+	assert.DeepEqual(t, lowPriorityRoots(d.lowPriorityDirs()), []string{"batch", "batch-2", "jobs/a"})
+}
+
+func TestValidateLowPriority(t *testing.T) {
+	low := map[string]string{common.PriorityAttribute: common.PriorityLow}
+	assert.ErrorContains(t, validatePriority(low), "path")
+	for _, path := range []string{".", "./", "a/.."} {
+		low[common.PathAttribute] = path
+		assert.ErrorContains(t, validatePriority(low), "root", path)
+	}
+	low[common.PathAttribute] = "batch"
+	assert.NilError(t, validatePriority(low))
+}
+
+func TestFilesBytes(t *testing.T) {
+	root := t.TempDir()
+	for name, size := range map[string]int{"batch/a": 100, "batch/dir/b": 50, "service/c": 1000} {
+		file := filepath.Join(root, name)
+		assert.NilError(t, os.MkdirAll(filepath.Dir(file), 0750))
+		assert.NilError(t, os.WriteFile(file, make([]byte, size), 0640))
+	}
+
+	total, err := filesBytes(root, []string{"batch"})
+	assert.NilError(t, err)
+	assert.Equal(t, total, int64(150))
+
+	files, freed, err := evictFiles(root, 1000, "batch")
+	assert.NilError(t, err)
+	assert.Equal(t, files, 2)
+	assert.Equal(t, freed, int64(150))
+	_, err = os.Stat(filepath.Join(root, "service/c"))
+	assert.NilError(t, err)
+}
+
+func TestFilesBytesSymlink(t *testing.T) {
+	// A pod replaced a low priority directory with a link to the host.
+	root := t.TempDir()
+	host := t.TempDir()
+	assert.NilError(t, os.WriteFile(filepath.Join(host, "a"), make([]byte, 100), 0640))
+	assert.NilError(t, os.MkdirAll(filepath.Join(root, "jobs"), 0750))
+	assert.NilError(t, os.Symlink(host, filepath.Join(root, "jobs/batch")))
+
+	total, err := filesBytes(root, []string{"jobs/batch"})
+	assert.NilError(t, err)
+	assert.Equal(t, total, int64(0))
+	files, _, err := evictFiles(root, 1000, "jobs/batch")
+	assert.NilError(t, err)
+	assert.Equal(t, files, 0)
+	_, err = os.Stat(filepath.Join(host, "a"))
+	assert.NilError(t, err)
+}
+
+func TestLowPriorityLimit(t *testing.T) {
+	assert.Equal(t, lowPriorityLimit(1000, 0), int64(1000))
+	assert.Equal(t, lowPriorityLimit(1000, 0.25), int64(750))
+}
@@ -0,0 +1,106 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package csi
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"k8s.io/mount-utils"
+
+	"github.com/GoogleCloudPlatform/csi-node-cache/pkg/util"
+)
+
+// privateDir is the directory at the root of a cache holding the driver's own
+// data, such as clones. It is on the cache filesystem, as clones are reflinks,
+// but pods must not reach it: it is hidden from publishes of the cache root by
+// an empty read-only mount, can't be published by path, and is skipped by
+// everything that lists or serves the cache.
+const privateDir = ".node-cache-private"
+
+// hiddenSource is the source of the mounts hiding the private directory, so
+// that they can be told apart in the mount table.
+const hiddenSource = "node-cache-hidden"
+
+// privatePath returns the path of elem in the private directory of the cache
+// at cachePath.
+func privatePath(cachePath string, elem ...string) string {
+	return filepath.Join(append([]string{cachePath, privateDir}, elem...)...)
+}
+
+// isPrivatePath returns true if rel, a path relative to the cache root, is in
+// the private directory.
+func isPrivatePath(rel string) bool {
+	first, _, _ := strings.Cut(filepath.ToSlash(filepath.Clean(rel)), "/")
+	return first == privateDir
+}
+
+// isPrivateDir returns true if path is the private directory of the cache at
+// root, for skipping it when walking the cache.
+func isPrivateDir(root, path string) bool {
+	return path == filepath.Join(root, privateDir)
+}
+
+// makePrivateDir creates elem in the private directory of the cache at
+// cachePath. Nothing is followed, so that a symlink planted by a pod can't
+// redirect the driver's writes.
+func makePrivateDir(cachePath string, elem ...string) error {
+	return util.MkdirAllBeneath(cachePath, filepath.Join(append([]string{privateDir}, elem...)...), 0700)
+}
+
+// hidePrivateDir mounts an empty read-only tmpfs over the private directory of
+// target, a publish of the cache root, unless it is already hidden. Once it
+// is, pods can't rename or replace the directory, as it is a mount point in
+// their mount namespace.
+func hidePrivateDir(mounter mount.Interface, target string) error {
+	if err := makePrivateDir(target); err != nil {
+		return fmt.Errorf("could not create %s in %s: %w", privateDir, target, err)
+	}
+	dir := filepath.Join(target, privateDir)
+	if notMnt, err := mounter.IsLikelyNotMountPoint(dir); err != nil {
+		return err
+	} else if !notMnt {
+		return nil
+	}
+	if err := mounter.Mount(hiddenSource, dir, "tmpfs", []string{"ro", "mode=000", "size=4k"}); err != nil {
+		return fmt.Errorf("could not hide %s: %w", dir, err)
+	}
+	return nil
+}
+
+// unhidePrivateDir unmounts the mount hiding the private directory of target,
+// if there is one, so that target itself can be unmounted.
+func unhidePrivateDir(mounter mount.Interface, target string) error {
+	dir := filepath.Join(target, privateDir)
+	notMnt, err := mounter.IsLikelyNotMountPoint(dir)
+	if err != nil || notMnt {
+		// A target that can't be checked is left to the fallbacks of
+		// unmountTarget.
+		return nil
+	}
+	return mounter.Unmount(dir)
+}
+
+// isCacheRoot returns true if path is the root of the cache at cachePath.
+func isCacheRoot(path, cachePath string) bool {
+	a, err := os.Stat(path)
+	if err != nil {
+		return false
+	}
+	b, err := os.Stat(cachePath)
+	return err == nil && os.SameFile(a, b)
+}
@@ -0,0 +1,74 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package csi
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"gotest.tools/v3/assert"
+	"k8s.io/mount-utils"
+)
+
+func TestIsPrivatePath(t *testing.T) {
+	for rel, private := range map[string]bool{
+		privateDir:                 true,
+		privateDir + "/clones/abc": true,
+		"./" + privateDir + "/x":   true,
+		"models/" + privateDir:     false,
+		privateDir + "-not":        false,
+		".":                        false,
+	} {
+		assert.Equal(t, isPrivatePath(rel), private, rel)
+	}
+	assert.ErrorContains(t, validateSubPath(privateDir+"/clones"), "private")
+}
+
+func TestHidePrivateDir(t *testing.T) {
+	// The target stands in for a publish of the cache root, holding the
+	// clone of another pod.
+	target := t.TempDir()
+	clone := privatePath(target, clonesDir, "abc")
+	assert.NilError(t, os.MkdirAll(clone, 0700))
+	mounter := mount.NewFakeMounter([]mount.MountPoint{{Device: "/local/lssd", Path: target}})
+
+	assert.NilError(t, hidePrivateDir(mounter, target))
+	// Hiding again is a no-op.
+	assert.NilError(t, hidePrivateDir(mounter, target))
+	mounts, err := mounter.List()
+	assert.NilError(t, err)
+	assert.Equal(t, len(mounts), 2)
+	assert.Equal(t, mounts[1].Device, hiddenSource)
+	assert.Equal(t, mounts[1].Path, filepath.Join(target, privateDir))
+	assert.Equal(t, mounts[1].Type, "tmpfs")
+	assert.DeepEqual(t, mounts[1].Opts, []string{"ro", "mode=000", "size=4k"})
+
+	assert.NilError(t, unhidePrivateDir(mounter, target))
+	mounts, err = mounter.List()
+	assert.NilError(t, err)
+	assert.Equal(t, len(mounts), 1)
+	assert.Equal(t, mounts[0].Path, target)
+}
+
+func TestHidePrivateDirSymlink(t *testing.T) {
+	target := t.TempDir()
+	assert.NilError(t, os.Symlink(t.TempDir(), filepath.Join(target, privateDir)))
+	mounter := mount.NewFakeMounter(nil)
+	assert.Assert(t, hidePrivateDir(mounter, target) != nil)
+	mounts, err := mounter.List()
+	assert.NilError(t, err)
+	assert.Equal(t, len(mounts), 0)
+}
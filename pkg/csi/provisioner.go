@@ -0,0 +1,150 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package csi
+
+import (
+	"context"
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+const (
+	provisionedPVPrefix = "node-cache-"
+	provisionedForLabel = "node-cache.gke.io/provisioned-for"
+	hostnameLabel       = "kubernetes.io/hostname"
+)
+
+var (
+	// The cache isn't partitioned between claims, so when the node doesn't give
+	// a size the PV capacity is only nominal and used for binding.
+	defaultProvisionedCapacity = resource.MustParse("1Ti")
+)
+
+func provisionedPVName(node string) string {
+	return provisionedPVPrefix + node
+}
+
+// buildProvisionedPV returns a PV that refers to the cache on node. The PV can
+// only be used on that node, and is shared by any pod using the claim bound to
+// it.
+func buildProvisionedPV(node, storageClass, driverName string, info volumeTypeInfo) *corev1.PersistentVolume {
+	capacity := info.Size
+	if capacity.IsZero() {
+		capacity = defaultProvisionedCapacity
+	}
+	var pv corev1.PersistentVolume
+	pv.SetName(provisionedPVName(node))
+	pv.SetLabels(map[string]string{provisionedForLabel: node})
+	pv.Spec = corev1.PersistentVolumeSpec{
+		StorageClassName:              storageClass,
+		AccessModes:                   []corev1.PersistentVolumeAccessMode{corev1.ReadWriteMany},
+		PersistentVolumeReclaimPolicy: corev1.PersistentVolumeReclaimRetain,
+		Capacity: corev1.ResourceList{
+			corev1.ResourceStorage: capacity,
+		},
+		PersistentVolumeSource: corev1.PersistentVolumeSource{
+			CSI: &corev1.CSIPersistentVolumeSource{
+				Driver:       driverName,
+				VolumeHandle: node,
+			},
+		},
+		NodeAffinity: &corev1.VolumeNodeAffinity{
+			Required: &corev1.NodeSelector{
+				NodeSelectorTerms: []corev1.NodeSelectorTerm{
+					{
+						MatchExpressions: []corev1.NodeSelectorRequirement{
+							{
+								Key:      hostnameLabel,
+								Operator: corev1.NodeSelectorOpIn,
+								Values:   []string{node},
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+	return &pv
+}
+
+// ensureProvisionedPV creates the provisioned PV for a node if it does not
+// exist. A released PV has its claim reference cleared so that it can be bound
+// again; the cache contents are kept, as they are for inline volumes.
+func (r *reconciler) ensureProvisionedPV(ctx context.Context, node string, info volumeTypeInfo) error {
+	if r.provisionerStorageClass == "" {
+		return nil
+	}
+	log := log.FromContext(ctx)
+
+	var pv corev1.PersistentVolume
+	err := r.Get(ctx, types.NamespacedName{Name: provisionedPVName(node)}, &pv)
+	if apierrors.IsNotFound(err) {
+		if err := r.Create(ctx, buildProvisionedPV(node, r.provisionerStorageClass, r.driverName, info)); err != nil {
+			return fmt.Errorf("could not create provisioned pv for %s: %w", node, err)
+		}
+		log.Info("provisioned pv", "node", node, "pv", provisionedPVName(node))
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	if pv.Status.Phase == corev1.VolumeReleased {
+		pv.Spec.ClaimRef = nil
+		if err := r.Update(ctx, &pv); err != nil {
+			return fmt.Errorf("could not reclaim pv %s: %w", pv.GetName(), err)
+		}
+		log.Info("reclaimed pv", "node", node, "pv", pv.GetName())
+	}
+	return nil
+}
+
+// deleteProvisionedPV removes the provisioned PV for a node that has gone
+// away. A PV still bound to a claim is left alone; it will be removed when the
+// claim is deleted and the node is reconciled again.
+func (r *reconciler) deleteProvisionedPV(ctx context.Context, node string) error {
+	if r.provisionerStorageClass == "" {
+		return nil
+	}
+	var pv corev1.PersistentVolume
+	err := r.Get(ctx, types.NamespacedName{Name: provisionedPVName(node)}, &pv)
+	if apierrors.IsNotFound(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if pv.Status.Phase == corev1.VolumeBound {
+		return nil
+	}
+	if err := r.Delete(ctx, &pv); err != nil && !apierrors.IsNotFound(err) {
+		return fmt.Errorf("could not delete provisioned pv %s: %w", pv.GetName(), err)
+	}
+	return nil
+}
+
+// provisionedPVToNode maps a provisioned PV to a reconcile of its node.
+func provisionedPVToNode(ctx context.Context, obj client.Object) []ctrl.Request {
+	node, found := obj.GetLabels()[provisionedForLabel]
+	if !found {
+		return nil
+	}
+	return []ctrl.Request{{NamespacedName: types.NamespacedName{Name: node}}}
+}
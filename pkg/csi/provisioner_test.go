@@ -0,0 +1,40 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package csi
+
+import (
+	"testing"
+
+	"gotest.tools/v3/assert"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+func TestBuildProvisionedPV(t *testing.T) {
+	pv := buildProvisionedPV("node-a", "shared", "driver", volumeTypeInfo{VolumeType: "tmpfs", Size: resource.MustParse("10Gi")})
+	assert.Equal(t, pv.GetName(), "node-cache-node-a")
+	assert.Equal(t, pv.GetLabels()[provisionedForLabel], "node-a")
+	assert.Equal(t, pv.Spec.StorageClassName, "shared")
+	assert.Equal(t, pv.Spec.CSI.Driver, "driver")
+	assert.Equal(t, pv.Spec.CSI.VolumeHandle, "node-a")
+	assert.Equal(t, pv.Spec.PersistentVolumeReclaimPolicy, corev1.PersistentVolumeReclaimRetain)
+	assert.DeepEqual(t, pv.Spec.NodeAffinity.Required.NodeSelectorTerms[0].MatchExpressions[0].Values, []string{"node-a"})
+	size := pv.Spec.Capacity[corev1.ResourceStorage]
+	assert.Equal(t, size.String(), "10Gi")
+
+	pv = buildProvisionedPV("node-b", "shared", "driver", volumeTypeInfo{VolumeType: "lssd"})
+	size = pv.Spec.Capacity[corev1.ResourceStorage]
+	assert.Equal(t, size.String(), defaultProvisionedCapacity.String())
+}
@@ -0,0 +1,77 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package csi
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	// readinessCacheTime is how long a readiness result is reused, so that
+	// frequent probes don't each call the compute API.
+	readinessCacheTime = time.Minute
+	readinessTimeout   = 10 * time.Second
+)
+
+// readinessChecker is the readyz check of the controller. It is ready once the
+// volume type map exists and can be parsed, and the attacher, if any, can
+// reach the compute API.
+type readinessChecker struct {
+	client        kubernetes.Interface
+	volumeTypeMap types.NamespacedName
+	attacher      Attacher
+
+	mutex   sync.Mutex
+	checked time.Time
+	err     error
+}
+
+// check implements healthz.Checker.
+func (c *readinessChecker) check(req *http.Request) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if !c.checked.IsZero() && time.Since(c.checked) < readinessCacheTime {
+		return c.err
+	}
+	ctx, cancel := context.WithTimeout(req.Context(), readinessTimeout)
+	defer cancel()
+	c.err = c.checkNow(ctx)
+	c.checked = time.Now()
+	return c.err
+}
+
+func (c *readinessChecker) checkNow(ctx context.Context) error {
+	configMap, err := c.client.CoreV1().ConfigMaps(c.volumeTypeMap.Namespace).Get(ctx, c.volumeTypeMap.Name, metav1.GetOptions{})
+	if err != nil {
+		return fmt.Errorf("Could not get volume type map %s: %w", c.volumeTypeMap, err)
+	}
+	if _, err := getVolumeTypeMapping(configMap.Data); err != nil {
+		return fmt.Errorf("Bad volume type map %s: %w", c.volumeTypeMap, err)
+	}
+	if c.attacher != nil {
+		if err := c.attacher.checkAccess(ctx); err != nil {
+			return fmt.Errorf("Compute API check failed: %w", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,152 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package csi
+
+import (
+	"context"
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/selection"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/util/retry"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	"github.com/GoogleCloudPlatform/csi-node-cache/pkg/common"
+)
+
+// RebuildMapping regenerates the volume type map from the cache nodes in the
+// cluster, replacing whatever is stored. It is used to recover a map that has
+// been corrupted, for example by a manual edit. Nothing is provisioned or
+// attached: the disks of PD caches are taken from their existing PVCs or
+// annotations. It returns the number of nodes in the new map.
+func RebuildMapping(ctx context.Context, cfg *rest.Config, opts ManagerOptions) (int, error) {
+	c, err := client.New(cfg, client.Options{Scheme: scheme.Scheme})
+	if err != nil {
+		return 0, err
+	}
+	mapping, err := buildMapping(ctx, c, opts.Namespace, opts.NodeSelector)
+	if err != nil {
+		return 0, err
+	}
+	name := types.NamespacedName{Namespace: opts.Namespace, Name: opts.VolumeTypeConfigMap}
+	if err := replaceMapping(ctx, c, name, mapping); err != nil {
+		return 0, err
+	}
+	return len(mapping), nil
+}
+
+// buildMapping creates a mapping from the cache nodes matching selector. Nodes
+// with bad labels are left out, as they would be by the controller.
+func buildMapping(ctx context.Context, c client.Client, namespace string, selector labels.Selector) (map[string]volumeTypeInfo, error) {
+	hasType, err := labels.NewRequirement(common.VolumeTypeLabel, selection.Exists, nil)
+	if err != nil {
+		return nil, err
+	}
+	if selector == nil {
+		selector = labels.Everything()
+	}
+	var nodes corev1.NodeList
+	if err := c.List(ctx, &nodes, client.MatchingLabelsSelector{Selector: selector.Add(*hasType)}); err != nil {
+		return nil, fmt.Errorf("could not list nodes: %w", err)
+	}
+
+	mapping := map[string]volumeTypeInfo{}
+	for i := range nodes.Items {
+		node := &nodes.Items[i]
+		if node.DeletionTimestamp != nil {
+			continue
+		}
+		info, err := getVolumeTypeFromNode(node)
+		if err != nil {
+			log.FromContext(ctx).Error(err, "skipping node with bad labels", "node", node.GetName())
+			continue
+		}
+		if usesPD(info.VolumeType) {
+			if info.Disk, err = existingPDDisk(ctx, c, namespace, node); err != nil {
+				return nil, err
+			}
+		}
+		mapping[node.GetName()] = info
+	}
+	assignShards(mapping)
+	return mapping, nil
+}
+
+// existingPDDisk returns the disk of the PD cache of node, as the controller
+// would record it, or "" if it has not been provisioned yet.
+func existingPDDisk(ctx context.Context, c client.Client, namespace string, node *corev1.Node) (string, error) {
+	if volume, found := node.GetAnnotations()[common.ExistingDiskAnnotation]; found {
+		vol, err := parseVolumeHandle(volume)
+		if err != nil {
+			// getVolumeTypeFromNode doesn't check the annotation, and the
+			// controller reports it when reconciling the node.
+			log.FromContext(ctx).Error(err, "bad existing disk", "node", node.GetName())
+			return "", nil
+		}
+		return vol.name, nil
+	}
+	var pvc corev1.PersistentVolumeClaim
+	err := c.Get(ctx, types.NamespacedName{Namespace: namespace, Name: node.GetName()}, &pvc)
+	if apierrors.IsNotFound(err) {
+		return "", nil
+	} else if err != nil {
+		return "", fmt.Errorf("could not get PVC of %s: %w", node.GetName(), err)
+	}
+	if pvc.Status.Phase != corev1.ClaimBound {
+		return "", nil
+	}
+	return pvc.Spec.VolumeName, nil
+}
+
+// replaceMapping validates mapping and stores it in the config map name. The
+// update is conditional on the config map being unchanged since it was read,
+// so a concurrent write by the controller is retried rather than lost.
+func replaceMapping(ctx context.Context, c client.Client, name types.NamespacedName, mapping map[string]volumeTypeInfo) error {
+	data := map[string]string{}
+	if err := writeVolumeTypeMapping(data, mapping); err != nil {
+		return err
+	}
+	if parsed, err := getVolumeTypeMapping(data); err != nil {
+		return fmt.Errorf("rebuilt mapping is invalid: %w", err)
+	} else if len(parsed) != len(mapping) {
+		return fmt.Errorf("rebuilt mapping is invalid: %d nodes written, %d read back", len(mapping), len(parsed))
+	}
+
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		var configMap corev1.ConfigMap
+		err := c.Get(ctx, name, &configMap)
+		if apierrors.IsNotFound(err) {
+			configMap.SetNamespace(name.Namespace)
+			configMap.SetName(name.Name)
+			configMap.Data = data
+			return c.Create(ctx, &configMap)
+		} else if err != nil {
+			return err
+		}
+		if configMap.Data == nil {
+			configMap.Data = map[string]string{}
+		}
+		for key, value := range data {
+			configMap.Data[key] = value
+		}
+		return c.Update(ctx, &configMap)
+	})
+}
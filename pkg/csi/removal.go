@@ -0,0 +1,150 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package csi
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	"github.com/GoogleCloudPlatform/csi-node-cache/pkg/common"
+)
+
+// What happens to the PD of a cache whose node label is removed. Existing
+// disks are never deleted.
+const (
+	RemovedPDDelete = "Delete"
+	RemovedPDRetain = "Retain"
+)
+
+// removalRequeueInterval is how often a node is reconciled while its cache is
+// removed.
+const removalRequeueInterval = 5 * time.Second
+
+// reconcileRemoval cleans up the cache of a node whose volume type label has
+// been removed. The node is marked with common.RemovingLabel, which keeps the
+// driver on it and asks it to release the cache as for maintenance. Once it
+// has, any PD is detached, and deleted or retained according to the removed
+// PD policy. Then the mapping entry is removed, and finally the label.
+func (r *reconciler) reconcileRemoval(ctx context.Context, node *corev1.Node) (ctrl.Result, error) {
+	log := log.FromContext(ctx)
+	_, removing := node.GetLabels()[common.RemovingLabel]
+
+	info, found, err := r.nodeMapping(ctx, node.GetName())
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+	if !found {
+		if removing {
+			log.Info("cache removed", "node", node.GetName())
+			if err := r.setRemoving(ctx, node, false); err != nil {
+				return ctrl.Result{}, err
+			}
+			return ctrl.Result{}, r.setMaintenanceState(ctx, node, "")
+		}
+		log.Info("skipping non-cache node", "node", node.GetName())
+		return ctrl.Result{}, nil
+	}
+	// The node is polled while its cache is removed, as a cache scoped to
+	// cache nodes no longer sees its updates.
+	if !removing {
+		log.Info("cache label removed, releasing cache", "node", node.GetName())
+		return ctrl.Result{RequeueAfter: removalRequeueInterval}, r.setRemoving(ctx, node, true)
+	}
+
+	hasPD := usesPD(info.VolumeType) && r.attacher != nil && info.Disk != ""
+	switch state := node.GetAnnotations()[common.MaintenanceStateAnnotation]; {
+	case state == common.MaintenanceReleased && hasPD:
+		// Detaches the PD and marks the node detached.
+		return ctrl.Result{RequeueAfter: removalRequeueInterval}, r.reconcileMaintenance(ctx, node, info)
+	case state == common.MaintenanceReleased, state == common.MaintenanceDetached:
+	default:
+		log.Info("waiting for driver to release cache", "node", node.GetName(), "state", state)
+		return ctrl.Result{RequeueAfter: removalRequeueInterval}, nil
+	}
+
+	if usesPD(info.VolumeType) {
+		if err := r.removePD(ctx, node); err != nil {
+			return ctrl.Result{}, err
+		}
+	}
+	if err := r.deleteProvisionedPV(ctx, node.GetName()); err != nil {
+		return ctrl.Result{}, err
+	}
+	r.mappings.removeNode(node.GetName())
+	return ctrl.Result{RequeueAfter: removalRequeueInterval}, nil
+}
+
+// removePD deletes the PVC of the PD cache of node, unless the policy is to
+// retain it. A retained PVC is reattached if the node is labeled again.
+func (r *reconciler) removePD(ctx context.Context, node *corev1.Node) error {
+	if _, found := node.GetAnnotations()[common.ExistingDiskAnnotation]; found || r.removedPDPolicy == RemovedPDRetain {
+		return nil
+	}
+	var pvc corev1.PersistentVolumeClaim
+	if err := r.getPVC(ctx, node.GetName(), &pvc); apierrors.IsNotFound(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if !isManagedPVC(&pvc) && !slices.Contains(pvc.Finalizers, finalizerLabel) {
+		return nil
+	}
+	log.FromContext(ctx).Info("deleting pd of removed cache", "node", node.GetName(), "pvc", pvc.GetName())
+	return r.deletePVC(ctx, &pvc)
+}
+
+// nodeMapping returns the entry of node in the volume type map, if any.
+func (r *reconciler) nodeMapping(ctx context.Context, node string) (volumeTypeInfo, bool, error) {
+	var configMap corev1.ConfigMap
+	if err := r.Get(ctx, types.NamespacedName{Namespace: r.namespace, Name: r.volumeTypeConfigMap}, &configMap); apierrors.IsNotFound(err) {
+		return volumeTypeInfo{}, false, nil
+	} else if err != nil {
+		return volumeTypeInfo{}, false, err
+	}
+	mapping, err := getVolumeTypeMapping(configMap.Data)
+	if err != nil {
+		return volumeTypeInfo{}, false, err
+	}
+	info, found := mapping[node]
+	return info, found, nil
+}
+
+// setRemoving adds or removes common.RemovingLabel on node.
+func (r *reconciler) setRemoving(ctx context.Context, node *corev1.Node, removing bool) error {
+	patch := client.MergeFrom(node.DeepCopy())
+	nodeLabels := node.GetLabels()
+	if removing {
+		if nodeLabels == nil {
+			nodeLabels = map[string]string{}
+		}
+		nodeLabels[common.RemovingLabel] = "true"
+	} else {
+		delete(nodeLabels, common.RemovingLabel)
+	}
+	node.SetLabels(nodeLabels)
+	if err := r.Patch(ctx, node, patch); err != nil {
+		return fmt.Errorf("Could not set removal of %s to %t: %w", node.GetName(), removing, err)
+	}
+	return nil
+}
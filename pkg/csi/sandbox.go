@@ -0,0 +1,100 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package csi
+
+import (
+	"context"
+	"fmt"
+	"slices"
+
+	"golang.org/x/sys/unix"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/klog/v2"
+
+	"github.com/GoogleCloudPlatform/csi-node-cache/pkg/common"
+)
+
+// sandboxed returns true if the pod publishing a volume runs in a sandboxed
+// runtime such as gVisor. The sandbox attribute of the volume is used if
+// set. Otherwise the handler of the pod's RuntimeClass is looked up, if there
+// is pod information in the volume context.
+func (d *Driver) sandboxed(ctx context.Context, volumeContext map[string]string) (bool, error) {
+	switch volumeContext[common.SandboxAttribute] {
+	case common.SandboxGVisor:
+		return true, nil
+	case common.SandboxNone:
+		return false, nil
+	}
+	name, namespace := volumeContext[podNameKey], volumeContext[podNamespaceKey]
+	if len(d.sandboxHandlers) == 0 || d.client == nil || name == "" || namespace == "" {
+		return false, nil
+	}
+	pod, err := d.client.CoreV1().Pods(namespace).Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return false, fmt.Errorf("could not get pod %s/%s for its runtime class: %w", namespace, name, err)
+	}
+	className := pod.Spec.RuntimeClassName
+	if className == nil || *className == "" {
+		return false, nil
+	}
+	handler, err := d.runtimeHandler(ctx, *className)
+	if err != nil {
+		return false, err
+	}
+	return slices.Contains(d.sandboxHandlers, handler), nil
+}
+
+// runtimeHandler returns the handler of a RuntimeClass. The handler of a
+// RuntimeClass can't be changed, so it is only looked up once.
+func (d *Driver) runtimeHandler(ctx context.Context, className string) (string, error) {
+	if handler, found := d.runtimeHandlers.Load(className); found {
+		return handler.(string), nil
+	}
+	class, err := d.client.NodeV1().RuntimeClasses().Get(ctx, className, metav1.GetOptions{})
+	if err != nil {
+		return "", fmt.Errorf("could not get runtime class %s: %w", className, err)
+	}
+	d.runtimeHandlers.Store(className, class.Handler)
+	return class.Handler, nil
+}
+
+// checkSandboxSupport returns an error if a cache type can't be used from a
+// sandbox. The gVisor gofer reads and writes cache files on behalf of the
+// sandbox, so caches that can only be mapped don't work.
+func checkSandboxSupport(volumeType string) error {
+	if volumeType == hugetlbfsVolumeType {
+		return fmt.Errorf("a %s cache can only be mapped, which is not supported from a sandboxed runtime", volumeType)
+	}
+	return nil
+}
+
+// checkSandboxBind checks that target is a bind mount of source that a sandbox
+// will see. The gofer opens the target once when the pod starts, and doesn't
+// follow mounts made on it afterwards, so the target must already be the
+// cache and not another mount stacked on it.
+func checkSandboxBind(source, target string) error {
+	var src, dst unix.Stat_t
+	if err := unix.Stat(source, &src); err != nil {
+		return fmt.Errorf("could not stat %s: %w", source, err)
+	}
+	if err := unix.Stat(target, &dst); err != nil {
+		return fmt.Errorf("could not stat %s: %w", target, err)
+	}
+	if src.Dev != dst.Dev || src.Ino != dst.Ino {
+		return fmt.Errorf("%s does not show %s after the bind mount, another mount may be stacked on it", target, source)
+	}
+	klog.V(4).Infof("Bind mount of %s to %s is usable from a sandbox", source, target)
+	return nil
+}
@@ -0,0 +1,61 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package csi
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"gotest.tools/v3/assert"
+)
+
+func TestSandboxed(t *testing.T) {
+	d := &Driver{sandboxHandlers: []string{"runsc"}}
+	ctx := context.Background()
+
+	for _, testCase := range []struct {
+		name          string
+		volumeContext map[string]string
+		expected      bool
+	}{
+		{name: "gvisor attribute", volumeContext: map[string]string{"sandbox": "gvisor"}, expected: true},
+		{name: "none attribute", volumeContext: map[string]string{"sandbox": "none", podNameKey: "pod", podNamespaceKey: "default"}},
+		// Without pod information the runtime class can't be looked up.
+		{name: "no pod information"},
+	} {
+		t.Run(testCase.name, func(t *testing.T) {
+			sandboxed, err := d.sandboxed(ctx, testCase.volumeContext)
+			assert.NilError(t, err)
+			assert.Equal(t, sandboxed, testCase.expected)
+		})
+	}
+}
+
+func TestCheckSandboxBind(t *testing.T) {
+	dir := t.TempDir()
+	source := filepath.Join(dir, "cache")
+	other := filepath.Join(dir, "other")
+	assert.NilError(t, os.Mkdir(source, 0750))
+	assert.NilError(t, os.Mkdir(other, 0750))
+
+	assert.NilError(t, checkSandboxBind(source, source))
+	assert.ErrorContains(t, checkSandboxBind(source, other), "does not show")
+	assert.ErrorContains(t, checkSandboxBind(source, filepath.Join(dir, "missing")), "could not stat")
+
+	assert.ErrorContains(t, checkSandboxSupport(hugetlbfsVolumeType), "only be mapped")
+	assert.NilError(t, checkSandboxSupport("tmpfs"))
+}
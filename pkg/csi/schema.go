@@ -0,0 +1,203 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package csi
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+// mappingSchemaVersion is the version of the volume type map format written
+// by this build. It is stored under volumeTypeVersionKey, and must be bumped,
+// with a migration added, whenever the format changes incompatibly.
+const mappingSchemaVersion = 9
+
+// jsonMappingVersion is the first version encoding the mapping as JSON,
+// rather than the comma-separated lines read by parseLegacyMapping. New
+// settings are added as fields of volumeTypeInfo.
+const jsonMappingVersion = 2
+
+// mappingMigrations[i] upgrades a mapping read at version i to version i+1.
+// Maps written before the version key was added are version 0.
+var mappingMigrations = []func(mapping map[string]volumeTypeInfo) error{
+	// Version 1 only added the version key.
+	func(map[string]volumeTypeInfo) error { return nil },
+	// Version 2 only changed the encoding.
+	func(map[string]volumeTypeInfo) error { return nil },
+	// Version 3 added size-percent.
+	func(map[string]volumeTypeInfo) error { return nil },
+	// Version 4 added hugepage-kib.
+	func(map[string]volumeTypeInfo) error { return nil },
+	// Version 5 added max-size.
+	func(map[string]volumeTypeInfo) error { return nil },
+	// Version 6 added invalid.
+	func(map[string]volumeTypeInfo) error { return nil },
+	// Version 7 added reflink.
+	func(map[string]volumeTypeInfo) error { return nil },
+	// Version 8 added image-cache-size.
+	func(map[string]volumeTypeInfo) error { return nil },
+	// Version 9 added storage-class.
+	func(map[string]volumeTypeInfo) error { return nil },
+}
+
+// newerMappingError is returned when writing a mapping stored by a newer
+// controller, which would lose the settings this build doesn't know.
+type newerMappingError struct {
+	version int
+}
+
+func (e *newerMappingError) Error() string {
+	return fmt.Sprintf("volume type map has schema version %d, newer than the supported %d", e.version, mappingSchemaVersion)
+}
+
+// mappingVersion returns the schema version of the map in configMapData.
+func mappingVersion(configMapData map[string]string) (int, error) {
+	value, found := configMapData[volumeTypeVersionKey]
+	if !found {
+		return 0, nil
+	}
+	version, err := strconv.Atoi(strings.TrimSpace(value))
+	if err != nil || version < 0 {
+		return 0, fmt.Errorf("bad %s %q in volume type config map", volumeTypeVersionKey, value)
+	}
+	return version, nil
+}
+
+// migrateMapping upgrades a mapping read at version to mappingSchemaVersion.
+// Mappings from newer versions are left as they are: they have been read
+// leniently, ignoring settings this build doesn't know.
+func migrateMapping(mapping map[string]volumeTypeInfo, version int) error {
+	for v := version; v < mappingSchemaVersion; v++ {
+		if err := mappingMigrations[v](mapping); err != nil {
+			return fmt.Errorf("could not migrate volume type map from version %d: %w", v, err)
+		}
+	}
+	return nil
+}
+
+// parseMapping parses the JSON encoding of the mapping, an object keyed by
+// node. Unknown fields are an error unless the mapping is from a newer
+// version, when they are settings this build doesn't know.
+func parseMapping(nodes string, version int) (map[string]volumeTypeInfo, error) {
+	typeMap := map[string]volumeTypeInfo{}
+	if strings.TrimSpace(nodes) == "" {
+		return typeMap, nil
+	}
+	decoder := json.NewDecoder(strings.NewReader(nodes))
+	if version <= mappingSchemaVersion {
+		decoder.DisallowUnknownFields()
+	}
+	if err := decoder.Decode(&typeMap); err != nil {
+		return nil, fmt.Errorf("bad volume type config map: %w", err)
+	}
+	return typeMap, nil
+}
+
+// parseLegacyMapping parses the comma-separated format of schema versions
+// before jsonMappingVersion, with a line per node such as
+// node-a,type=pd,size=10Gi,disk=pv-a.
+func parseLegacyMapping(nodes string) (map[string]volumeTypeInfo, error) {
+	typeMap := map[string]volumeTypeInfo{}
+	for _, line := range strings.Split(nodes, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		items := strings.Split(line, ",")
+		if len(items) < 2 {
+			return nil, fmt.Errorf("Bad line in volume type config map: %s", line)
+		}
+		node := strings.TrimSpace(items[0])
+		if _, found := typeMap[node]; found {
+			return nil, fmt.Errorf("node %s duplicated in volume type config map: %s", node, line)
+		}
+		var info volumeTypeInfo
+		for _, item := range items[1:] {
+			parts := strings.SplitN(item, "=", 2)
+			trimmed := strings.TrimSpace(parts[0])
+			switch trimmed {
+			case "type":
+				info.VolumeType = strings.TrimSpace(parts[1])
+			case "size":
+				szStr := strings.TrimSpace(parts[1])
+				q, err := resource.ParseQuantity(szStr)
+				if err != nil {
+					return nil, fmt.Errorf("bad size in volume type config map: %s", line)
+				}
+				info.Size = q
+			case "disk":
+				info.Disk = strings.TrimSpace(parts[1])
+			case "address":
+				info.Address = strings.TrimSpace(parts[1])
+			case "nqn":
+				info.NQN = strings.TrimSpace(parts[1])
+			case "portal":
+				info.Portal = strings.TrimSpace(parts[1])
+			case "iqn":
+				info.IQN = strings.TrimSpace(parts[1])
+			case "lun":
+				lun, err := strconv.Atoi(strings.TrimSpace(parts[1]))
+				if err != nil {
+					return nil, fmt.Errorf("bad lun in volume type config map: %s", line)
+				}
+				info.LUN = lun
+			case "chap-secret":
+				info.ChapSecret = strings.TrimSpace(parts[1])
+			case "multipath":
+				mp, err := strconv.ParseBool(strings.TrimSpace(parts[1]))
+				if err != nil {
+					return nil, fmt.Errorf("bad multipath in volume type config map: %s", line)
+				}
+				info.Multipath = mp
+			case "server":
+				info.Server = strings.TrimSpace(parts[1])
+			case "export":
+				info.Export = strings.TrimSpace(parts[1])
+			case "mount-options":
+				info.MountOptions = strings.TrimSpace(parts[1])
+			case "bucket":
+				info.Bucket = strings.TrimSpace(parts[1])
+			case "compression":
+				info.Compression = strings.TrimSpace(parts[1])
+			case "raid-chunk-kib":
+				chunk, err := strconv.Atoi(strings.TrimSpace(parts[1]))
+				if err != nil {
+					return nil, fmt.Errorf("bad raid chunk size in volume type config map: %s", line)
+				}
+				info.RaidChunkKiB = chunk
+			case "shard-group":
+				info.ShardGroup = strings.TrimSpace(parts[1])
+			case "shard":
+				info.Shard = strings.TrimSpace(parts[1])
+			case "dedup":
+				info.Dedup = strings.TrimSpace(parts[1])
+			case "dedup-ratio":
+				ratio, err := strconv.ParseFloat(strings.TrimSpace(parts[1]), 64)
+				if err != nil {
+					return nil, fmt.Errorf("bad dedup ratio in volume type config map: %s", line)
+				}
+				info.DedupRatio = ratio
+			default:
+				return nil, fmt.Errorf("bad key %s in volume type config map: %s", trimmed, line)
+			}
+		}
+		typeMap[node] = info
+	}
+	return typeMap, nil
+}
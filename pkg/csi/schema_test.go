@@ -0,0 +1,65 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package csi
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"testing"
+
+	"gotest.tools/v3/assert"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+func TestMappingVersion(t *testing.T) {
+	// Unversioned maps are upgraded in place.
+	configMap := corev1.ConfigMap{Data: map[string]string{volumeTypeInfoKey: "a,type=lssd"}}
+	mapping, err := getVolumeTypeMapping(configMap.Data)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, mapping, map[string]volumeTypeInfo{"a": {VolumeType: "lssd"}})
+	changed, err := mutateMapping(context.Background(), &configMap, nil)
+	assert.NilError(t, err)
+	assert.Assert(t, changed)
+	assert.Equal(t, configMap.Data[volumeTypeVersionKey], strconv.Itoa(mappingSchemaVersion))
+
+	_, err = getVolumeTypeMapping(map[string]string{volumeTypeInfoKey: "a,type=lssd", volumeTypeVersionKey: "x"})
+	assert.ErrorContains(t, err, "bad schema-version")
+
+	// Settings added by a newer version are ignored when reading, and the map
+	// isn't overwritten.
+	newer := strconv.Itoa(mappingSchemaVersion + 1)
+	configMap = corev1.ConfigMap{Data: map[string]string{volumeTypeInfoKey: `{"a": {"type": "lssd", "fstype": "xfs"}}`, volumeTypeVersionKey: newer}}
+	mapping, err = getVolumeTypeMapping(configMap.Data)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, mapping, map[string]volumeTypeInfo{"a": {VolumeType: "lssd"}})
+	_, err = mutateMapping(context.Background(), &configMap, nil)
+	var newerErr *newerMappingError
+	assert.Assert(t, errors.As(err, &newerErr))
+	assert.Equal(t, configMap.Data[volumeTypeInfoKey], `{"a": {"type": "lssd", "fstype": "xfs"}}`)
+
+	// The same field is still rejected at the current version.
+	configMap.Data[volumeTypeVersionKey] = strconv.Itoa(mappingSchemaVersion)
+	_, err = getVolumeTypeMapping(configMap.Data)
+	assert.ErrorContains(t, err, `unknown field "fstype"`)
+	_, err = getVolumeTypeMapping(map[string]string{volumeTypeInfoKey: "a,type=lssd,fstype=xfs"})
+	assert.ErrorContains(t, err, "bad key fstype")
+
+	// Legacy maps are read at their version.
+	mapping, err = getVolumeTypeMapping(map[string]string{volumeTypeInfoKey: "a,type=pd,size=10Gi,disk=pv-a", volumeTypeVersionKey: "1"})
+	assert.NilError(t, err)
+	assert.DeepEqual(t, mapping, map[string]volumeTypeInfo{"a": {VolumeType: "pd", Size: resource.MustParse("10Gi"), Disk: "pv-a"}})
+}
@@ -0,0 +1,129 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package csi
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/golang/protobuf/proto"
+)
+
+const (
+	// gcsKeyFileKey is the publish secret holding a service account key for
+	// gcsfuse caches, used instead of the node's credentials.
+	gcsKeyFileKey = "key.json"
+
+	redactedSecret = "***redacted***"
+)
+
+// errInvalidSecrets wraps the errors of publish secrets that don't suit the
+// cache type.
+var errInvalidSecrets = errors.New("invalid publish secrets")
+
+// secretKeys are the publish secret keys accepted for each cache type. All of
+// the keys for a type must be given together. NFS caches have no credentials
+// to give, as Filestore shares trust the node, and prewarm credentials are
+// the driver's own, as the prewarm location is shared by all publishes.
+var secretKeys = map[string][]string{
+	iscsiVolumeType:   {chapUsernameKey, chapPasswordKey},
+	gcsfuseVolumeType: {gcsKeyFileKey},
+}
+
+// validateSecrets checks that publish secrets are valid for a cache type. No
+// secrets are always valid.
+func validateSecrets(volumeType string, secrets map[string]string) error {
+	if len(secrets) == 0 {
+		return nil
+	}
+	keys, found := secretKeys[volumeType]
+	if !found {
+		return fmt.Errorf("%s caches don't take secrets", volumeType)
+	}
+	for key := range secrets {
+		if !slices.Contains(keys, key) {
+			return fmt.Errorf("unknown secret key %s for %s caches, expected %s", key, volumeType, strings.Join(keys, ", "))
+		}
+	}
+	for _, key := range keys {
+		if secrets[key] == "" {
+			return fmt.Errorf("secret key %s is required for %s caches", key, volumeType)
+		}
+	}
+	return nil
+}
+
+// writeKeyFile writes a gcsfuse key from secrets to a new file in the state
+// directory, only readable by the driver, returning its path, or "" if there is
+// no key. The caller removes the file once the key has been read. volMutex must
+// be held.
+func (d *Driver) writeKeyFile(secrets map[string]string) (string, error) {
+	key, found := secrets[gcsKeyFileKey]
+	if !found {
+		return "", nil
+	}
+	dir, err := d.secretsDir()
+	if err != nil {
+		return "", err
+	}
+	f, err := os.CreateTemp(dir, "gcsfuse-key-*.json")
+	if err != nil {
+		return "", fmt.Errorf("could not create gcsfuse key file: %w", err)
+	}
+	_, err = f.WriteString(key)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return "", fmt.Errorf("could not write gcsfuse key: %w", err)
+	}
+	return f.Name(), nil
+}
+
+// secretsDir returns the state directory, creating it if necessary. volMutex
+// must be held.
+func (d *Driver) secretsDir() (string, error) {
+	if d.stateDir == "" {
+		dir, err := os.MkdirTemp("", "node-cache-")
+		if err != nil {
+			return "", fmt.Errorf("could not create state directory: %w", err)
+		}
+		d.stateDir = dir
+		return dir, nil
+	}
+	if err := os.MkdirAll(d.stateDir, 0700); err != nil {
+		return "", fmt.Errorf("could not create state directory: %w", err)
+	}
+	return d.stateDir, nil
+}
+
+// redactSecrets returns a copy of a request for logging, with the values of
+// any secrets replaced.
+func redactSecrets(req interface{}) interface{} {
+	publish, ok := req.(*csi.NodePublishVolumeRequest)
+	if !ok || len(publish.GetSecrets()) == 0 {
+		return req
+	}
+	redacted := proto.Clone(publish).(*csi.NodePublishVolumeRequest)
+	for key := range redacted.Secrets {
+		redacted.Secrets[key] = redactedSecret
+	}
+	return redacted
+}
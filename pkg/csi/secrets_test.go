@@ -0,0 +1,100 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package csi
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"gotest.tools/v3/assert"
+)
+
+func TestValidateSecrets(t *testing.T) {
+	for _, tc := range []struct {
+		volumeType string
+		secrets    map[string]string
+		valid      bool
+	}{
+		{volumeType: "lssd", valid: true},
+		{volumeType: "lssd", secrets: map[string]string{"password": "x"}},
+		{volumeType: "iscsi", secrets: map[string]string{"username": "u", "password": "p"}, valid: true},
+		{volumeType: "iscsi", secrets: map[string]string{"username": "u"}},
+		{volumeType: "iscsi", secrets: map[string]string{"username": "u", "password": "p", "extra": "x"}},
+		{volumeType: "gcsfuse", secrets: map[string]string{"key.json": "{}"}, valid: true},
+		{volumeType: "gcsfuse", secrets: map[string]string{"key.json": ""}},
+	} {
+		t.Run(fmt.Sprintf("%s %v", tc.volumeType, tc.secrets), func(t *testing.T) {
+			err := validateSecrets(tc.volumeType, tc.secrets)
+			if tc.valid {
+				assert.NilError(t, err)
+			} else {
+				assert.Assert(t, err != nil)
+			}
+		})
+	}
+}
+
+func TestRedactSecrets(t *testing.T) {
+	req := &csi.NodePublishVolumeRequest{
+		TargetPath: "/target",
+		Secrets:    map[string]string{"password": "hunter2"},
+	}
+	redacted := redactSecrets(req).(*csi.NodePublishVolumeRequest)
+	assert.Equal(t, redacted.TargetPath, "/target")
+	assert.Equal(t, redacted.Secrets["password"], redactedSecret)
+	assert.Equal(t, req.Secrets["password"], "hunter2")
+
+	unpublish := &csi.NodeUnpublishVolumeRequest{TargetPath: "/target"}
+	assert.Equal(t, redactSecrets(unpublish), interface{}(unpublish))
+}
+
+func TestWriteKeyFile(t *testing.T) {
+	d := &Driver{stateDir: filepath.Join(t.TempDir(), "state")}
+	path, err := d.writeKeyFile(nil)
+	assert.NilError(t, err)
+	assert.Equal(t, path, "")
+
+	secrets := map[string]string{"key.json": "{}"}
+	a, err := d.writeKeyFile(secrets)
+	assert.NilError(t, err)
+	b, err := d.writeKeyFile(secrets)
+	assert.NilError(t, err)
+	assert.Assert(t, a != b)
+	for _, path := range []string{a, b} {
+		assert.Equal(t, filepath.Dir(path), d.stateDir)
+		info, err := os.Stat(path)
+		assert.NilError(t, err)
+		assert.Equal(t, info.Mode().Perm(), os.FileMode(0600))
+		data, err := os.ReadFile(path)
+		assert.NilError(t, err)
+		assert.Equal(t, string(data), "{}")
+	}
+	info, err := os.Stat(d.stateDir)
+	assert.NilError(t, err)
+	assert.Equal(t, info.Mode().Perm(), os.FileMode(0700))
+
+	// Without a state directory, a private one is made.
+	d = &Driver{}
+	path, err = d.writeKeyFile(secrets)
+	assert.NilError(t, err)
+	defer os.RemoveAll(d.stateDir)
+	assert.Equal(t, filepath.Dir(path), d.stateDir)
+	info, err = os.Stat(d.stateDir)
+	assert.NilError(t, err)
+	assert.Equal(t, info.Mode().Perm(), os.FileMode(0700))
+}
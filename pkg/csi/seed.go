@@ -0,0 +1,160 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package csi
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	"github.com/GoogleCloudPlatform/csi-node-cache/pkg/common"
+)
+
+// nodeUsage returns the usage reported by the driver on node, or nil.
+func nodeUsage(node *corev1.Node) *CacheUsage {
+	report, found := node.GetAnnotations()[common.UsageAnnotation]
+	if !found {
+		return nil
+	}
+	var usage CacheUsage
+	if err := json.Unmarshal([]byte(report), &usage); err != nil {
+		return nil
+	}
+	return &usage
+}
+
+func nodeIsReady(node *corev1.Node) bool {
+	for _, c := range node.Status.Conditions {
+		if c.Type == corev1.NodeReady {
+			return c.Status == corev1.ConditionTrue
+		}
+	}
+	return false
+}
+
+// canDonate returns true if candidate has a warm, healthy cache that can seed
+// node. The caches must have the same type and size, and neither may be in a
+// shard group, as shards hold different data.
+func canDonate(node, candidate *corev1.Node) bool {
+	if candidate.GetName() == node.GetName() || !nodeIsReady(candidate) {
+		return false
+	}
+	for _, label := range []string{common.VolumeTypeLabel, common.SizeLabel} {
+		if candidate.GetLabels()[label] != node.GetLabels()[label] {
+			return false
+		}
+	}
+	annotations := candidate.GetAnnotations()
+	if annotations[common.PeerAddressAnnotation] == "" || annotations[common.ShardGroupAnnotation] != "" ||
+		annotations[common.SeedDonorAnnotation] != "" || inMaintenance(candidate) || annotations[common.MaintenanceStateAnnotation] != "" {
+		return false
+	}
+	switch annotations[common.PrewarmStateAnnotation] {
+	case common.PrewarmRunning, common.PrewarmSeeding, common.PrewarmFailed:
+		return false
+	}
+	usage := nodeUsage(candidate)
+	return usage != nil && usage.Mounted && usage.HealthError == "" && usage.BytesUsed > 0
+}
+
+// chooseDonor picks the node to seed node from, or "" if none can. The donor
+// with the fewest nodes already seeding from it is chosen, then the fullest,
+// so that a group of new nodes is spread over the warm ones.
+func chooseDonor(node *corev1.Node, nodes []corev1.Node) string {
+	recipients := map[string]int{}
+	for i := range nodes {
+		if donor := nodes[i].GetAnnotations()[common.SeedDonorAnnotation]; donor != "" {
+			recipients[donor]++
+		}
+	}
+	var best *corev1.Node
+	var bestUsed int64
+	for i := range nodes {
+		candidate := &nodes[i]
+		if !canDonate(node, candidate) {
+			continue
+		}
+		used := nodeUsage(candidate).BytesUsed
+		if best != nil {
+			if n, bestN := recipients[candidate.GetName()], recipients[best.GetName()]; n > bestN {
+				continue
+			} else if n == bestN && (used < bestUsed || used == bestUsed && candidate.GetName() > best.GetName()) {
+				continue
+			}
+		}
+		best, bestUsed = candidate, used
+	}
+	if best == nil {
+		return ""
+	}
+	return best.GetName()
+}
+
+// reconcileSeedDonor chooses a donor for a node whose cache is not yet set up,
+// and removes it once the node has finished filling its cache.
+func (r *reconciler) reconcileSeedDonor(ctx context.Context, node *corev1.Node, info volumeTypeInfo) error {
+	if !seedable(info.VolumeType) || info.ShardGroup != "" {
+		return nil
+	}
+	donor, found := node.GetAnnotations()[common.SeedDonorAnnotation]
+	usage := nodeUsage(node)
+	if found {
+		switch node.GetAnnotations()[common.PrewarmStateAnnotation] {
+		case common.PrewarmDone, common.PrewarmFailed:
+			if usage != nil && usage.Mounted {
+				log.FromContext(ctx).Info("seeded", "node", node.GetName(), "donor", donor)
+				return r.setSeedDonor(ctx, node, nil)
+			}
+		}
+		return nil
+	}
+	if usage != nil && usage.Mounted {
+		return nil
+	}
+
+	var nodes corev1.NodeList
+	if err := r.List(ctx, &nodes, client.HasLabels{common.VolumeTypeLabel}); err != nil {
+		return fmt.Errorf("Could not list cache nodes for a seed donor: %w", err)
+	}
+	donor = chooseDonor(node, nodes.Items)
+	if donor == "" {
+		return nil
+	}
+	log.FromContext(ctx).Info("seed donor", "node", node.GetName(), "donor", donor)
+	return r.setSeedDonor(ctx, node, &donor)
+}
+
+// setSeedDonor sets the donor of node, or removes it if donor is nil.
+func (r *reconciler) setSeedDonor(ctx context.Context, node *corev1.Node, donor *string) error {
+	patch := client.MergeFrom(node.DeepCopy())
+	annotations := node.GetAnnotations()
+	if donor == nil {
+		delete(annotations, common.SeedDonorAnnotation)
+	} else {
+		if annotations == nil {
+			annotations = map[string]string{}
+		}
+		annotations[common.SeedDonorAnnotation] = *donor
+	}
+	node.SetAnnotations(annotations)
+	if err := r.Patch(ctx, node, patch); err != nil {
+		return fmt.Errorf("Could not set seed donor of %s: %w", node.GetName(), err)
+	}
+	return nil
+}
@@ -0,0 +1,78 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package csi
+
+import (
+	"fmt"
+	"testing"
+
+	"gotest.tools/v3/assert"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/GoogleCloudPlatform/csi-node-cache/pkg/common"
+)
+
+func cacheNode(name, volumeType string, annotations map[string]string) corev1.Node {
+	return corev1.Node{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        name,
+			Labels:      map[string]string{common.VolumeTypeLabel: volumeType},
+			Annotations: annotations,
+		},
+		Status: corev1.NodeStatus{
+			Conditions: []corev1.NodeCondition{{Type: corev1.NodeReady, Status: corev1.ConditionTrue}},
+		},
+	}
+}
+
+func warmAnnotations(used int64) map[string]string {
+	return map[string]string{
+		common.PeerAddressAnnotation: "10.0.0.1:9096",
+		common.UsageAnnotation:       fmt.Sprintf(`{"mounted":true,"bytesUsed":%d}`, used),
+	}
+}
+
+func TestChooseDonor(t *testing.T) {
+	node := cacheNode("new", "lssd", nil)
+
+	unready := cacheNode("unready", "lssd", warmAnnotations(100))
+	unready.Status.Conditions[0].Status = corev1.ConditionFalse
+	unhealthy := cacheNode("unhealthy", "lssd", warmAnnotations(100))
+	unhealthy.Annotations[common.UsageAnnotation] = `{"mounted":true,"bytesUsed":100,"healthError":"degraded"}`
+	noAddress := cacheNode("no-address", "lssd", warmAnnotations(100))
+	delete(noAddress.Annotations, common.PeerAddressAnnotation)
+	prewarming := cacheNode("prewarming", "lssd", warmAnnotations(100))
+	prewarming.Annotations[common.PrewarmStateAnnotation] = common.PrewarmRunning
+	sharded := cacheNode("sharded", "lssd", warmAnnotations(100))
+	sharded.Annotations[common.ShardGroupAnnotation] = "group"
+	empty := cacheNode("empty", "lssd", warmAnnotations(0))
+	tmpfs := cacheNode("tmpfs", "tmpfs", warmAnnotations(100))
+
+	ineligible := []corev1.Node{node, unready, unhealthy, noAddress, prewarming, sharded, empty, tmpfs}
+	assert.Equal(t, chooseDonor(&node, ineligible), "")
+
+	small := cacheNode("small", "lssd", warmAnnotations(10))
+	large := cacheNode("large", "lssd", warmAnnotations(100))
+	assert.Equal(t, chooseDonor(&node, append(ineligible, small, large)), "large")
+
+	// A donor already seeding another node is used only if it is the only
+	// one.
+	seeding := cacheNode("seeding", "lssd", map[string]string{common.SeedDonorAnnotation: "large"})
+	assert.Equal(t, chooseDonor(&node, []corev1.Node{node, small, large, seeding}), "small")
+	assert.Equal(t, chooseDonor(&node, []corev1.Node{node, large, seeding}), "large")
+	// A node being seeded is not a donor itself.
+	assert.Equal(t, chooseDonor(&node, []corev1.Node{node, seeding}), "")
+}
@@ -0,0 +1,120 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package csi
+
+import (
+	"slices"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/klog/v2"
+)
+
+// publishLatencySLOReason is the reason of the warning event on the node when
+// publishes are slow.
+const publishLatencySLOReason = "PublishLatencySLO"
+
+type latencySample struct {
+	at      time.Time
+	latency time.Duration
+}
+
+// publishSLO tracks the latency of publishes over a window, and reports when
+// its p99 is above a threshold. A report is made at most once a window, so
+// that a sustained burn gives one event per window.
+type publishSLO struct {
+	threshold time.Duration
+	window    time.Duration
+
+	mutex   sync.Mutex
+	samples []latencySample
+	// lastReport is when the burn was last reported.
+	lastReport time.Time
+}
+
+func newPublishSLO(threshold, window time.Duration) *publishSLO {
+	return &publishSLO{threshold: threshold, window: window}
+}
+
+// observe records a publish latency at now. If the p99 latency over the
+// window is above the threshold and hasn't been reported within the window,
+// it returns true with the p99 and number of publishes in the window.
+func (s *publishSLO) observe(now time.Time, latency time.Duration) (bool, time.Duration, int) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.samples = append(s.samples, latencySample{at: now, latency: latency})
+	cutoff := now.Add(-s.window)
+	first := 0
+	for first < len(s.samples) && !s.samples[first].at.After(cutoff) {
+		first++
+	}
+	s.samples = s.samples[first:]
+
+	p99 := s.percentile(0.99)
+	if p99 <= s.threshold || (!s.lastReport.IsZero() && now.Sub(s.lastReport) < s.window) {
+		return false, p99, len(s.samples)
+	}
+	s.lastReport = now
+	return true, p99, len(s.samples)
+}
+
+// percentile returns the latency below which fraction q of the samples fall,
+// by the nearest rank. s.mutex must be held.
+func (s *publishSLO) percentile(q float64) time.Duration {
+	if len(s.samples) == 0 {
+		return 0
+	}
+	latencies := make([]time.Duration, len(s.samples))
+	for i, sample := range s.samples {
+		latencies[i] = sample.latency
+	}
+	slices.Sort(latencies)
+	rank := int(q*float64(len(latencies)) + 0.999999)
+	return latencies[max(rank, 1)-1]
+}
+
+// newEventRecorder creates a recorder for events about the driver's node.
+func newEventRecorder(client kubernetes.Interface, component, nodeName string) record.EventRecorder {
+	broadcaster := record.NewBroadcaster()
+	broadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: client.CoreV1().Events("")})
+	return broadcaster.NewRecorder(scheme.Scheme, corev1.EventSource{Component: component, Host: nodeName})
+}
+
+// observePublish records the latency of a successful publish, warning on the
+// node if the SLO is burning.
+func (d *Driver) observePublish(latency time.Duration) {
+	publishDurationSeconds.Observe(latency.Seconds())
+	if d.publishSLO == nil {
+		return
+	}
+	burning, p99, count := d.publishSLO.observe(time.Now(), latency)
+	if !burning {
+		return
+	}
+	klog.Warningf("p99 publish latency %v over %d publishes in the last %v is above %v", p99.Round(time.Millisecond), count, d.publishSLO.window, d.publishSLO.threshold)
+	if d.recorder != nil {
+		// Nodes are referred to by name, as kubelet does.
+		node := &corev1.ObjectReference{Kind: "Node", Name: d.nodeId, UID: types.UID(d.nodeId)}
+		d.recorder.Eventf(node, corev1.EventTypeWarning, publishLatencySLOReason,
+			"p99 cache publish latency %v over %d publishes in the last %v is above %v, delaying pod startup",
+			p99.Round(time.Millisecond), count, d.publishSLO.window, d.publishSLO.threshold)
+	}
+}
@@ -0,0 +1,61 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package csi
+
+import (
+	"testing"
+	"time"
+
+	"gotest.tools/v3/assert"
+)
+
+func TestPublishSLO(t *testing.T) {
+	s := newPublishSLO(10*time.Second, time.Minute)
+	start := time.Now()
+
+	// 99 fast publishes and one slow one keep the p99 within the SLO.
+	for i := 0; i < 99; i++ {
+		burning, _, _ := s.observe(start, time.Second)
+		assert.Assert(t, !burning)
+	}
+	burning, p99, count := s.observe(start, 20*time.Second)
+	assert.Assert(t, !burning)
+	assert.Equal(t, p99, time.Second)
+	assert.Equal(t, count, 100)
+
+	// A second slow publish puts the p99 over the SLO.
+	burning, p99, count = s.observe(start.Add(time.Second), 20*time.Second)
+	assert.Assert(t, burning)
+	assert.Equal(t, p99, 20*time.Second)
+	assert.Equal(t, count, 101)
+
+	// The burn is reported once a window.
+	burning, _, _ = s.observe(start.Add(30*time.Second), 20*time.Second)
+	assert.Assert(t, !burning)
+
+	// Once the window passes, the earlier publishes are dropped and a
+	// continued burn is reported again.
+	burning, p99, count = s.observe(start.Add(61*time.Second), time.Second)
+	assert.Assert(t, burning)
+	assert.Equal(t, p99, 20*time.Second)
+	assert.Equal(t, count, 2)
+
+	// Fast publishes end the burn.
+	for i := 0; i < 200; i++ {
+		burning, p99, _ = s.observe(start.Add(100*time.Second), time.Second)
+	}
+	assert.Assert(t, !burning)
+	assert.Equal(t, p99, time.Second)
+}
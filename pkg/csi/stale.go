@@ -0,0 +1,97 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package csi
+
+import (
+	"fmt"
+
+	"golang.org/x/sys/unix"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/klog/v2"
+
+	"github.com/GoogleCloudPlatform/csi-node-cache/pkg/localvolume"
+	"github.com/GoogleCloudPlatform/csi-node-cache/pkg/util"
+)
+
+// staleMountReason is the reason of events about targets still bound to a
+// cache that has been replaced.
+const staleMountReason = "StaleCacheMount"
+
+// sameFilesystem returns true if a and b are on the same mounted filesystem.
+// A recreated tmpfs or array is a new filesystem with a new device number,
+// even when it is mounted at the same place, so a bind mount of the old one
+// is on a different device than the cache.
+func sameFilesystem(a, b string) (bool, error) {
+	var sa, sb unix.Stat_t
+	if err := unix.Stat(a, &sa); err != nil {
+		return false, fmt.Errorf("could not stat %s: %w", a, err)
+	}
+	if err := unix.Stat(b, &sb); err != nil {
+		return false, fmt.Errorf("could not stat %s: %w", b, err)
+	}
+	return sa.Dev == sb.Dev, nil
+}
+
+// isStaleTarget returns true if target is a mount of another filesystem than
+// the cache vol. Targets that can't be checked are not stale.
+func isStaleTarget(target string, vol localvolume.LocalVolume) bool {
+	notMnt, err := util.Mounter().IsLikelyNotMountPoint(target)
+	if err != nil || notMnt {
+		return false
+	}
+	same, err := sameFilesystem(target, vol.Path())
+	if err != nil {
+		klog.Warningf("Could not check %s for a stale mount: %v", target, err)
+		return false
+	}
+	return !same
+}
+
+// warnStaleTargets reports the published targets that are not bound to vol,
+// which happens when the cache was replaced while they were mounted. Their
+// pods keep using the previous cache, which is no longer visible to anyone
+// else, until they are restarted. A stale target is remounted when it is next
+// published. volMutex must be held.
+func (d *Driver) warnStaleTargets(vol localvolume.LocalVolume) {
+	d.checkpointMutex.Lock()
+	var targets []string
+	for target := range d.checkpoint.Targets {
+		targets = append(targets, target)
+	}
+	d.checkpointMutex.Unlock()
+
+	for _, target := range targets {
+		if isStaleTarget(target, vol) {
+			d.staleTargetEvent(target, "is bound to a previous instance of the cache, restart the pod to use the current one")
+		}
+	}
+}
+
+// staleTargetEvent logs msg about the stale target, and reports it as an
+// event on the node.
+func (d *Driver) staleTargetEvent(target, msg string) {
+	klog.Warningf("Target %s %s", target, msg)
+	if d.recorder == nil {
+		return
+	}
+	// Nodes are referred to by name, as kubelet does.
+	node := &corev1.ObjectReference{Kind: "Node", Name: d.nodeId, UID: types.UID(d.nodeId)}
+	if uid := targetPodUID(target); uid != "" {
+		d.recorder.Eventf(node, corev1.EventTypeWarning, staleMountReason, "Cache mount of pod %s %s", uid, msg)
+	} else {
+		d.recorder.Eventf(node, corev1.EventTypeWarning, staleMountReason, "Cache mount %s %s", target, msg)
+	}
+}
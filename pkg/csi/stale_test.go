@@ -0,0 +1,49 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package csi
+
+import (
+	"path/filepath"
+	"testing"
+
+	"gotest.tools/v3/assert"
+
+	"github.com/GoogleCloudPlatform/csi-node-cache/pkg/localvolume"
+)
+
+func TestSameFilesystem(t *testing.T) {
+	a, b := t.TempDir(), t.TempDir()
+	same, err := sameFilesystem(a, b)
+	assert.NilError(t, err)
+	assert.Assert(t, same)
+
+	// procfs is always its own filesystem.
+	same, err = sameFilesystem(a, "/proc")
+	assert.NilError(t, err)
+	assert.Assert(t, !same)
+
+	_, err = sameFilesystem(filepath.Join(a, "missing"), b)
+	assert.ErrorContains(t, err, "could not stat")
+}
+
+func TestIsStaleTarget(t *testing.T) {
+	vol, err := localvolume.NewFromPath(t.TempDir())
+	assert.NilError(t, err)
+	// Directories that aren't mount points are never stale.
+	assert.Assert(t, !isStaleTarget(t.TempDir(), vol))
+	assert.Assert(t, !isStaleTarget(filepath.Join(t.TempDir(), "missing"), vol))
+	// A mount of another filesystem is.
+	assert.Assert(t, isStaleTarget("/proc", vol))
+}
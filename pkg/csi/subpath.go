@@ -0,0 +1,118 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package csi
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"k8s.io/mount-utils"
+)
+
+const procMountInfo = "/proc/self/mountinfo"
+
+// publishSource returns the directory to bind mount for a volume: the cache
+// at cachePath or, if subPath is set, that directory under it, which is
+// created if necessary. subPath must be valid; see validateSubPath.
+func publishSource(cachePath, subPath string) (string, error) {
+	if subPath == "" {
+		return cachePath, nil
+	}
+	realCache, err := filepath.EvalSymlinks(cachePath)
+	if err != nil {
+		return "", err
+	}
+	source := filepath.Join(realCache, subPath)
+	// A symlink in the cache could point outside of it, so the existing part
+	// of the path is checked before anything is created.
+	existing := source
+	for {
+		if _, err := os.Lstat(existing); err == nil {
+			break
+		} else if !errors.Is(err, os.ErrNotExist) {
+			return "", err
+		}
+		existing = filepath.Dir(existing)
+	}
+	if err := checkWithinCache(existing, realCache); err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(source, 0750); err != nil {
+		return "", fmt.Errorf("could not create %s in the cache: %w", subPath, err)
+	}
+	if err := checkWithinCache(source, realCache); err != nil {
+		return "", err
+	}
+	return filepath.EvalSymlinks(source)
+}
+
+// checkWithinCache returns an error if path resolves to somewhere outside of
+// realCache.
+func checkWithinCache(path, realCache string) error {
+	resolved, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return err
+	}
+	if resolved != realCache && !mount.PathWithinBase(resolved, realCache) {
+		return fmt.Errorf("%s resolves to %s, outside of the cache", path, resolved)
+	}
+	return nil
+}
+
+// cacheConsumers returns the bind mounts of the cache at cachePath. Unlike
+// GetMountRefs, this includes mounts of directories in the cache made with the
+// path attribute.
+func cacheConsumers(cachePath string) ([]string, error) {
+	realPath, err := filepath.EvalSymlinks(cachePath)
+	if err != nil {
+		return nil, err
+	}
+	infos, err := mount.ParseMountInfo(procMountInfo)
+	if err != nil {
+		return nil, err
+	}
+	return subtreeMountRefs(realPath, infos)
+}
+
+// subtreeMountRefs finds the mounts of path, or of any directory under it, in
+// infos other than the mount of path itself.
+func subtreeMountRefs(path string, infos []mount.MountInfo) ([]string, error) {
+	// Later mounts may cover earlier ones, so search backwards.
+	var source *mount.MountInfo
+	root := ""
+	for i := len(infos) - 1; i >= 0; i-- {
+		if path == infos[i].MountPoint || mount.PathWithinBase(path, infos[i].MountPoint) {
+			source = &infos[i]
+			root = filepath.Join(infos[i].Root, strings.TrimPrefix(path, infos[i].MountPoint))
+			break
+		}
+	}
+	if source == nil {
+		return nil, fmt.Errorf("no mount found for %s", path)
+	}
+	refs := []string{}
+	for _, info := range infos {
+		if info.ID == source.ID || info.Major != source.Major || info.Minor != source.Minor {
+			continue
+		}
+		if info.Root == root || mount.PathWithinBase(info.Root, root) {
+			refs = append(refs, info.MountPoint)
+		}
+	}
+	return refs, nil
+}
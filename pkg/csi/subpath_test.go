@@ -0,0 +1,70 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package csi
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"gotest.tools/v3/assert"
+	"k8s.io/mount-utils"
+)
+
+func TestPublishSource(t *testing.T) {
+	cache, err := filepath.EvalSymlinks(t.TempDir())
+	assert.NilError(t, err)
+	outside := t.TempDir()
+
+	source, err := publishSource(cache, "")
+	assert.NilError(t, err)
+	assert.Equal(t, source, cache)
+
+	source, err = publishSource(cache, "models/llm")
+	assert.NilError(t, err)
+	assert.Equal(t, source, filepath.Join(cache, "models/llm"))
+	info, err := os.Stat(source)
+	assert.NilError(t, err)
+	assert.Assert(t, info.IsDir())
+
+	assert.NilError(t, os.Symlink(outside, filepath.Join(cache, "escape")))
+	_, err = publishSource(cache, "escape/data")
+	assert.ErrorContains(t, err, "outside of the cache")
+	_, err = os.Stat(filepath.Join(outside, "data"))
+	assert.Assert(t, os.IsNotExist(err), "directory created outside of the cache")
+
+	assert.NilError(t, os.Symlink("models", filepath.Join(cache, "alias")))
+	source, err = publishSource(cache, "alias/llm")
+	assert.NilError(t, err)
+	assert.Equal(t, source, filepath.Join(cache, "models/llm"))
+}
+
+func TestSubtreeMountRefs(t *testing.T) {
+	infos := []mount.MountInfo{
+		{ID: 1, Major: 8, Minor: 1, Root: "/", MountPoint: "/"},
+		{ID: 2, Major: 9, Minor: 127, Root: "/", MountPoint: "/local/lssd"},
+		{ID: 3, Major: 9, Minor: 127, Root: "/", MountPoint: "/pods/a/volumes/cache"},
+		{ID: 4, Major: 9, Minor: 127, Root: "/models/llm", MountPoint: "/pods/b/volumes/cache"},
+		{ID: 5, Major: 9, Minor: 126, Root: "/models", MountPoint: "/pods/c/volumes/other"},
+		{ID: 6, Major: 9, Minor: 127, Root: "/modelsx", MountPoint: "/pods/d/volumes/cache"},
+	}
+	refs, err := subtreeMountRefs("/local/lssd", infos)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, refs, []string{"/pods/a/volumes/cache", "/pods/b/volumes/cache", "/pods/d/volumes/cache"})
+
+	refs, err = subtreeMountRefs("/local/lssd/models", infos)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, refs, []string{"/pods/b/volumes/cache"})
+}
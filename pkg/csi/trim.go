@@ -0,0 +1,105 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package csi
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strconv"
+	"time"
+
+	"k8s.io/klog/v2"
+
+	"github.com/GoogleCloudPlatform/csi-node-cache/pkg/util"
+)
+
+const (
+	fstrimCmd = "fstrim"
+	// fstrimTimeout bounds a trim, which can take minutes on a large array.
+	fstrimTimeout = 30 * time.Minute
+)
+
+// fstrimOutput matches the fstrim -v report, eg "/local/lssd: 1.2 GiB (1288490188 bytes) trimmed".
+var fstrimOutput = regexp.MustCompile(`\((\d+) bytes\) trimmed`)
+
+// RunTrimLoop trims the local SSD of the cache every interval, until ctx is
+// done. Caches not on local SSD are skipped.
+func (d *Driver) RunTrimLoop(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			d.trimCache(ctx)
+		}
+	}
+}
+
+func (d *Driver) trimCache(ctx context.Context) {
+	path := d.trimPath()
+	if path == "" {
+		return
+	}
+	// The volume lock isn't held, as a trim can take a long time. If the
+	// cache is released meanwhile the trim fails and is retried next time.
+	trimmed, err := fstrim(ctx, path)
+	if err != nil {
+		trimErrors.Inc()
+		klog.Errorf("Could not trim %s: %v", path, err)
+		return
+	}
+	lastTrimTimestamp.SetToCurrentTime()
+	trimmedBytes.Add(float64(trimmed))
+	klog.V(2).Infof("Trimmed %d bytes from %s", trimmed, path)
+}
+
+// trimPath returns the mount point of the cache's local SSD, or "" if there
+// is none.
+func (d *Driver) trimPath() string {
+	d.volMutex.Lock()
+	defer d.volMutex.Unlock()
+	if d.vol == nil {
+		return ""
+	}
+	switch d.volType {
+	case "lssd", mirroredVolumeType:
+		return d.vol.Path()
+	case gcsfuseVolumeType:
+		// The local SSD holds the gcsfuse file cache.
+		return d.cachePath(lssdPath)
+	}
+	return ""
+}
+
+// fstrim discards unused blocks of the filesystem at path, returning the
+// number of bytes trimmed.
+func fstrim(ctx context.Context, path string) (int64, error) {
+	result, err := util.RunCommandContext(ctx, util.CommandOptions{Timeout: fstrimTimeout}, fstrimCmd, "-v", path)
+	if err != nil {
+		return 0, err
+	}
+	return parseTrimmedBytes(string(result.Stdout))
+}
+
+func parseTrimmedBytes(output string) (int64, error) {
+	matches := fstrimOutput.FindStringSubmatch(output)
+	if matches == nil {
+		return 0, fmt.Errorf("unexpected fstrim output %q", output)
+	}
+	return strconv.ParseInt(matches[1], 10, 64)
+}
@@ -0,0 +1,57 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package csi
+
+import (
+	"testing"
+
+	"gotest.tools/v3/assert"
+
+	"github.com/GoogleCloudPlatform/csi-node-cache/pkg/localvolume"
+)
+
+func TestParseTrimmedBytes(t *testing.T) {
+	trimmed, err := parseTrimmedBytes("/local/lssd: 1.2 GiB (1288490188 bytes) trimmed\n")
+	assert.NilError(t, err)
+	assert.Equal(t, trimmed, int64(1288490188))
+
+	trimmed, err = parseTrimmedBytes("/local/lssd: 0 B (0 bytes) trimmed\n")
+	assert.NilError(t, err)
+	assert.Equal(t, trimmed, int64(0))
+
+	_, err = parseTrimmedBytes("fstrim: /local/lssd: the discard operation is not supported\n")
+	assert.ErrorContains(t, err, "unexpected fstrim output")
+}
+
+func TestTrimPath(t *testing.T) {
+	d := &Driver{cacheRoot: "/local"}
+	assert.Equal(t, d.trimPath(), "")
+
+	dir := t.TempDir()
+	vol, err := localvolume.NewFromPath(dir)
+	assert.NilError(t, err)
+
+	for volType, expected := range map[string]string{
+		"lssd":     dir,
+		"mirrored": dir,
+		"gcsfuse":  "/local/lssd",
+		"pd":       "",
+		"tmpfs":    "",
+	} {
+		d.vol = vol
+		d.volType = volType
+		assert.Equal(t, d.trimPath(), expected, volType)
+	}
+}
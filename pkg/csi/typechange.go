@@ -0,0 +1,134 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package csi
+
+import (
+	"context"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/klog/v2"
+
+	"github.com/GoogleCloudPlatform/csi-node-cache/pkg/common"
+	"github.com/GoogleCloudPlatform/csi-node-cache/pkg/localvolume"
+)
+
+// RunTypeChangeWatch re-reads the node's cache type label every interval
+// until ctx is done. When the label no longer matches the cache, the old
+// cache is released once it is unused, and the new one is built from the
+// volume type map once the controller has updated it. Size changes of caches
+// that can be resized in place, such as tmpfs, are applied live.
+func (d *Driver) RunTypeChangeWatch(ctx context.Context, interval time.Duration) {
+	wait.UntilWithContext(ctx, d.checkTypeChange, interval)
+}
+
+func (d *Driver) checkTypeChange(ctx context.Context) {
+	node, err := d.client.CoreV1().Nodes().Get(ctx, d.nodeId, metav1.GetOptions{})
+	if err != nil {
+		klog.Errorf("Could not get node %s for type check: %v", d.nodeId, err)
+		return
+	}
+	labelType := node.GetLabels()[common.VolumeTypeLabel]
+
+	d.volMutex.Lock()
+	defer d.volMutex.Unlock()
+
+	if d.vol == nil || d.inMaintenance || labelType == "" {
+		return
+	}
+	_, resizable := d.vol.(localvolume.Resizer)
+	if labelType == d.volType && !resizable {
+		return
+	}
+	configMap, err := d.client.CoreV1().ConfigMaps(d.volumeTypeMap.Namespace).Get(ctx, d.volumeTypeMap.Name, metav1.GetOptions{})
+	if err != nil {
+		klog.Errorf("Could not get volume type map for type change: %v", err)
+		return
+	}
+	mapping, err := getVolumeTypeMapping(configMap.Data)
+	if err != nil {
+		klog.Errorf("Bad volume type map, not changing type: %v", err)
+		return
+	}
+	if labelType == d.volType {
+		d.resizeCache(ctx, mapping[d.nodeId])
+		return
+	}
+	if mapping[d.nodeId].VolumeType != labelType {
+		klog.Infof("Cache type changed from %s to %s, waiting for the controller to update the volume type map", d.volType, labelType)
+		return
+	}
+
+	consumers, err := cacheConsumers(d.vol.Path())
+	if err != nil {
+		klog.Errorf("Could not find consumers of %s, will retry: %v", d.vol.Path(), err)
+		return
+	}
+	if len(consumers) > 0 {
+		klog.Infof("Cache type changed from %s to %s, waiting for %d consumers to unpublish: %v", d.volType, labelType, len(consumers), consumers)
+		return
+	}
+	d.stopPrewarm()
+	if err := d.releaseImageCache(ctx); err != nil {
+		klog.Errorf("%v, will retry", err)
+		return
+	}
+	if r, ok := d.vol.(localvolume.Releaser); ok {
+		if err := r.Release(ctx); err != nil {
+			klog.Errorf("Could not release %s cache for type change, will retry: %v", d.volType, err)
+			return
+		}
+	}
+	klog.Infof("Released %s cache for change to %s", d.volType, labelType)
+	d.vol = nil
+	d.volType = ""
+
+	if _, err = d.cacheVolume(ctx); err != nil {
+		// The next publish will try again.
+		klog.Errorf("Could not create %s cache after type change: %v", labelType, err)
+		return
+	}
+	klog.Infof("Created %s cache after type change", labelType)
+}
+
+// resizeCache resizes the cache to the size in info, if it can be resized in
+// place and info is for the current cache type. volMutex must be held.
+func (d *Driver) resizeCache(ctx context.Context, info volumeTypeInfo) {
+	r, ok := d.vol.(localvolume.Resizer)
+	if !ok || info.VolumeType != d.volType || (info.Size.IsZero() && info.SizePercent == 0) {
+		return
+	}
+	size, err := d.tmpfsSize(ctx, info)
+	if err != nil {
+		klog.Errorf("Could not size %s cache, will retry: %v", d.volType, err)
+		return
+	}
+	if !d.shrunkFrom.IsZero() {
+		// Applied when memory pressure clears.
+		d.shrunkFrom = size
+		return
+	}
+	if size.Cmp(r.Size()) == 0 {
+		return
+	}
+	old := r.Size()
+	if err := r.Resize(ctx, size); err != nil {
+		klog.Errorf("Could not resize %s cache from %s to %s, will retry: %v", d.volType, old.String(), size.String(), err)
+		return
+	}
+	cacheSizeBytes.Set(size.AsApproximateFloat64())
+	klog.Infof("Resized %s cache from %s to %s", d.volType, old.String(), size.String())
+}
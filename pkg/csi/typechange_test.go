@@ -0,0 +1,65 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package csi
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"gotest.tools/v3/assert"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+type fakeResizer struct {
+	size    resource.Quantity
+	resizes int
+	err     error
+}
+
+func (v *fakeResizer) Path() string            { return "/cache" }
+func (v *fakeResizer) Size() resource.Quantity { return v.size }
+
+func (v *fakeResizer) Resize(_ context.Context, size resource.Quantity) error {
+	v.resizes++
+	if v.err != nil {
+		return v.err
+	}
+	v.size = size
+	return nil
+}
+
+func TestResizeCache(t *testing.T) {
+	ctx := context.Background()
+	vol := &fakeResizer{size: resource.MustParse("1Gi")}
+	d := &Driver{vol: vol, volType: "tmpfs"}
+
+	d.resizeCache(ctx, volumeTypeInfo{VolumeType: "tmpfs", Size: resource.MustParse("1024Mi")})
+	assert.Equal(t, vol.resizes, 0)
+	// A size for another type waits for the type change.
+	d.resizeCache(ctx, volumeTypeInfo{VolumeType: "lssd", Size: resource.MustParse("2Gi")})
+	assert.Equal(t, vol.resizes, 0)
+
+	d.resizeCache(ctx, volumeTypeInfo{VolumeType: "tmpfs", Size: resource.MustParse("2Gi")})
+	assert.Equal(t, vol.resizes, 1)
+	assert.Equal(t, vol.size.String(), "2Gi")
+
+	// A failed shrink keeps the old size, and is retried.
+	vol.err = errors.New("device busy")
+	d.resizeCache(ctx, volumeTypeInfo{VolumeType: "tmpfs", Size: resource.MustParse("1Gi")})
+	d.resizeCache(ctx, volumeTypeInfo{VolumeType: "tmpfs", Size: resource.MustParse("1Gi")})
+	assert.Equal(t, vol.resizes, 3)
+	assert.Equal(t, vol.size.String(), "2Gi")
+}
@@ -0,0 +1,232 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package csi
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"math"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"golang.org/x/sys/unix"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/klog/v2"
+
+	"github.com/GoogleCloudPlatform/csi-node-cache/pkg/common"
+	"github.com/GoogleCloudPlatform/csi-node-cache/pkg/localvolume"
+)
+
+const (
+	scaleDownDisabledAnnotation = "cluster-autoscaler.kubernetes.io/scale-down-disabled"
+)
+
+// CacheUsage is the usage of a node's cache, reported by the driver as JSON in
+// the common.UsageAnnotation annotation.
+type CacheUsage struct {
+	BytesTotal     int64 `json:"bytesTotal"`
+	BytesUsed      int64 `json:"bytesUsed"`
+	BytesAvailable int64 `json:"bytesAvailable"`
+	InodesTotal    int64 `json:"inodesTotal"`
+	InodesUsed     int64 `json:"inodesUsed"`
+	// Compression is the compression of the cache, if any. BytesUsed is then
+	// the compressed size on disk, and BytesLogical the uncompressed size of
+	// the files in the cache.
+	Compression  string `json:"compression,omitempty"`
+	BytesLogical int64  `json:"bytesLogical,omitempty"`
+	// Mounted is true once the cache has been set up on the node.
+	Mounted bool `json:"mounted"`
+	// HealthError is set if a mounted cache fails its health check.
+	HealthError string `json:"healthError,omitempty"`
+	// LastError is the most recent publish error, if any.
+	LastError string      `json:"lastError,omitempty"`
+	Updated   metav1.Time `json:"updated"`
+}
+
+// RunUsageReporter reports cache usage to the node every interval until ctx
+// is done.
+func (d *Driver) RunUsageReporter(ctx context.Context, interval time.Duration) {
+	wait.UntilWithContext(ctx, d.reportUsage, interval)
+}
+
+func (d *Driver) reportUsage(ctx context.Context) {
+	d.volMutex.Lock()
+	vol := d.vol
+	lastError := d.lastError
+	lastPublish := d.lastPublish
+	d.volMutex.Unlock()
+
+	var usage CacheUsage
+	if vol != nil {
+		var err error
+		if usage, err = usageOf(vol.Path()); err != nil {
+			lastError = err.Error()
+		}
+		usage.Mounted = true
+		if cv, ok := vol.(localvolume.CompressedVolume); ok && cv.Compression() != "" {
+			usage.Compression = cv.Compression()
+			if usage.BytesLogical, err = logicalBytes(vol.Path()); err != nil {
+				klog.Errorf("Could not find logical size of %s: %v", vol.Path(), err)
+			}
+		}
+		if hc, ok := vol.(localvolume.HealthChecker); ok {
+			if err := hc.Healthy(); err != nil {
+				usage.HealthError = err.Error()
+			}
+		}
+	}
+	d.updateScaleDownProtection(ctx, usage, lastPublish)
+	if vol == nil && lastError == "" {
+		// Nothing to report until the cache is first used.
+		return
+	}
+	usage.LastError = lastError
+	usage.Updated = metav1.Now()
+
+	value, err := json.Marshal(usage)
+	if err != nil {
+		klog.Errorf("Could not encode usage %+v: %v", usage, err)
+		return
+	}
+	report := string(value)
+	annotations := map[string]*string{common.UsageAnnotation: &report}
+	if d.settings().scoreAnnotation && usage.Mounted {
+		score := strconv.Itoa(cacheScore(usage))
+		annotations[common.CacheScoreAnnotation] = &score
+	}
+	if err := d.patchNodeAnnotations(ctx, annotations); err != nil {
+		klog.Errorf("Could not report usage: %v", err)
+	}
+	if d.settings().auditAnnotation {
+		d.reportConsumers(ctx)
+	}
+}
+
+// updateScaleDownProtection disables cluster autoscaler scale down of the
+// node while its cache is hot, and enables it again once it is not. A
+// scale-down-disabled annotation set by someone else is left alone.
+func (d *Driver) updateScaleDownProtection(ctx context.Context, usage CacheUsage, lastPublish time.Time) {
+	s := d.settings()
+	if s.scaleDownUtilization <= 0 && s.scaleDownActivity <= 0 {
+		return
+	}
+	node, err := d.client.CoreV1().Nodes().Get(ctx, d.nodeId, metav1.GetOptions{})
+	if err != nil {
+		klog.Errorf("Could not get node for scale down protection: %v", err)
+		return
+	}
+	_, ours := node.GetAnnotations()[common.ScaleDownProtectedAnnotation]
+	_, disabled := node.GetAnnotations()[scaleDownDisabledAnnotation]
+
+	protect := isCacheHot(usage, lastPublish, time.Now(), s.scaleDownUtilization, s.scaleDownActivity)
+	var annotations map[string]*string
+	if protect && !disabled {
+		value := "true"
+		annotations = map[string]*string{scaleDownDisabledAnnotation: &value, common.ScaleDownProtectedAnnotation: &value}
+	} else if !protect && ours {
+		annotations = map[string]*string{scaleDownDisabledAnnotation: nil, common.ScaleDownProtectedAnnotation: nil}
+	} else {
+		return
+	}
+	if err := d.patchNodeAnnotations(ctx, annotations); err != nil {
+		klog.Errorf("Could not update scale down protection: %v", err)
+		return
+	}
+	klog.Infof("Scale down protection for hot cache set to %t", protect)
+}
+
+// isCacheHot returns true if the cache is at least utilization full, or was
+// published within activity of now. Zero thresholds are not used.
+func isCacheHot(usage CacheUsage, lastPublish, now time.Time, utilization float64, activity time.Duration) bool {
+	if utilization > 0 && usage.BytesTotal > 0 && float64(usage.BytesUsed)/float64(usage.BytesTotal) >= utilization {
+		return true
+	}
+	return activity > 0 && !lastPublish.IsZero() && now.Sub(lastPublish) < activity
+}
+
+// cacheScore returns how saturated a mounted cache is, from 0 to 100: the
+// larger of the fractions of bytes and inodes used, as a percentage. An
+// unhealthy cache scores 100, so that workloads are moved off it.
+func cacheScore(usage CacheUsage) int {
+	if usage.HealthError != "" {
+		return 100
+	}
+	var used float64
+	if usage.BytesTotal > 0 {
+		used = float64(usage.BytesUsed) / float64(usage.BytesTotal)
+	}
+	if usage.InodesTotal > 0 {
+		used = max(used, float64(usage.InodesUsed)/float64(usage.InodesTotal))
+	}
+	return int(math.Round(min(used, 1) * 100))
+}
+
+// recordError notes a publish error for usage reports.
+func (d *Driver) recordError(err error) {
+	d.volMutex.Lock()
+	defer d.volMutex.Unlock()
+	d.lastError = err.Error()
+}
+
+func usageOf(path string) (CacheUsage, error) {
+	var st unix.Statfs_t
+	if err := unix.Statfs(path, &st); err != nil {
+		return CacheUsage{}, fmt.Errorf("Could not stat filesystem at %s: %w", path, err)
+	}
+	return usageFromStatfs(&st), nil
+}
+
+// logicalBytes is the total apparent size of the regular files under path.
+// Files removed during the walk are skipped.
+func logicalBytes(path string) (int64, error) {
+	var total int64
+	err := filepath.WalkDir(path, func(_ string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if !entry.Type().IsRegular() {
+			return nil
+		}
+		info, err := entry.Info()
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		total += info.Size()
+		return nil
+	})
+	return total, err
+}
+
+func usageFromStatfs(st *unix.Statfs_t) CacheUsage {
+	bsize := int64(st.Bsize)
+	return CacheUsage{
+		BytesTotal:     int64(st.Blocks) * bsize,
+		BytesUsed:      int64(st.Blocks-st.Bfree) * bsize,
+		BytesAvailable: int64(st.Bavail) * bsize,
+		InodesTotal:    int64(st.Files),
+		InodesUsed:     int64(st.Files - st.Ffree),
+	}
+}
@@ -0,0 +1,108 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package csi
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+	"gotest.tools/v3/assert"
+)
+
+func TestUsageFromStatfs(t *testing.T) {
+	usage := usageFromStatfs(&unix.Statfs_t{
+		Bsize:  4096,
+		Blocks: 100,
+		Bfree:  40,
+		Bavail: 30,
+		Files:  50,
+		Ffree:  20,
+	})
+	assert.Equal(t, usage.BytesTotal, int64(409600))
+	assert.Equal(t, usage.BytesUsed, int64(245760))
+	assert.Equal(t, usage.BytesAvailable, int64(122880))
+	assert.Equal(t, usage.InodesTotal, int64(50))
+	assert.Equal(t, usage.InodesUsed, int64(30))
+}
+
+func TestUsageOf(t *testing.T) {
+	usage, err := usageOf(t.TempDir())
+	assert.NilError(t, err)
+	assert.Assert(t, usage.BytesTotal > 0)
+
+	_, err = usageOf("/does/not/exist")
+	assert.ErrorContains(t, err, "/does/not/exist")
+}
+
+func TestLogicalBytes(t *testing.T) {
+	dir := t.TempDir()
+	assert.NilError(t, os.WriteFile(filepath.Join(dir, "a"), make([]byte, 100), 0644))
+	assert.NilError(t, os.Mkdir(filepath.Join(dir, "sub"), 0755))
+	assert.NilError(t, os.WriteFile(filepath.Join(dir, "sub", "b"), make([]byte, 50), 0644))
+	assert.NilError(t, os.Symlink("a", filepath.Join(dir, "link")))
+
+	total, err := logicalBytes(dir)
+	assert.NilError(t, err)
+	assert.Equal(t, total, int64(150))
+}
+
+func TestIsCacheHot(t *testing.T) {
+	now := time.Now()
+	half := CacheUsage{BytesTotal: 100, BytesUsed: 50}
+	tests := []struct {
+		name        string
+		usage       CacheUsage
+		lastPublish time.Time
+		utilization float64
+		activity    time.Duration
+		expected    bool
+	}{
+		{name: "disabled", usage: half, lastPublish: now, expected: false},
+		{name: "full enough", usage: half, utilization: 0.5, expected: true},
+		{name: "not full enough", usage: half, utilization: 0.6, expected: false},
+		{name: "no usage", utilization: 0.5, expected: false},
+		{name: "recent", lastPublish: now.Add(-time.Minute), activity: time.Hour, expected: true},
+		{name: "stale", lastPublish: now.Add(-2 * time.Hour), activity: time.Hour, expected: false},
+		{name: "never published", activity: time.Hour, expected: false},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, isCacheHot(tc.usage, tc.lastPublish, now, tc.utilization, tc.activity), tc.expected)
+		})
+	}
+}
+
+func TestCacheScore(t *testing.T) {
+	tests := []struct {
+		name     string
+		usage    CacheUsage
+		expected int
+	}{
+		{name: "empty", expected: 0},
+		{name: "bytes", usage: CacheUsage{BytesTotal: 200, BytesUsed: 50, InodesTotal: 100, InodesUsed: 10}, expected: 25},
+		{name: "inodes", usage: CacheUsage{BytesTotal: 200, BytesUsed: 50, InodesTotal: 100, InodesUsed: 60}, expected: 60},
+		{name: "rounded", usage: CacheUsage{BytesTotal: 3, BytesUsed: 2}, expected: 67},
+		{name: "full", usage: CacheUsage{BytesTotal: 100, BytesUsed: 100}, expected: 100},
+		{name: "unhealthy", usage: CacheUsage{BytesTotal: 100, HealthError: "bad"}, expected: 100},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, cacheScore(tc.usage), tc.expected)
+		})
+	}
+}
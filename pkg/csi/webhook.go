@@ -0,0 +1,87 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package csi
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+
+	"github.com/GoogleCloudPlatform/csi-node-cache/pkg/common"
+)
+
+const (
+	// PodValidationPath is the webhook path of the pod validator.
+	PodValidationPath = "/validate-pod"
+)
+
+// podValidator rejects pods with inline node cache volumes that can't be
+// published, because of bad attributes or a cache type no node has.
+type podValidator struct {
+	client     client.Reader
+	decoder    *admission.Decoder
+	driverName string
+}
+
+var _ admission.Handler = &podValidator{}
+
+func (v *podValidator) Handle(ctx context.Context, req admission.Request) admission.Response {
+	var pod corev1.Pod
+	if err := v.decoder.Decode(req, &pod); err != nil {
+		return admission.Errored(http.StatusBadRequest, err)
+	}
+	var volumes []corev1.Volume
+	for _, vol := range pod.Spec.Volumes {
+		if vol.CSI != nil && vol.CSI.Driver == v.driverName {
+			volumes = append(volumes, vol)
+		}
+	}
+	if len(volumes) == 0 {
+		return admission.Allowed("")
+	}
+
+	available, err := v.availableTypes(ctx)
+	if err != nil {
+		log.FromContext(ctx).Error(err, "list cache nodes for pod validation")
+		return admission.Errored(http.StatusInternalServerError, err)
+	}
+	for _, vol := range volumes {
+		if err := validateVolumeAttributes(vol.CSI.VolumeAttributes, available); err != nil {
+			return admission.Denied(fmt.Sprintf("node cache volume %s: %v", vol.Name, err))
+		}
+	}
+	if volumeType, found := pod.Spec.NodeSelector[common.VolumeTypeLabel]; found && !available[volumeType] {
+		return admission.Denied(fmt.Sprintf("node selector %s=%s: no node has a %s cache", common.VolumeTypeLabel, volumeType, volumeType))
+	}
+	return admission.Allowed("")
+}
+
+// availableTypes returns the cache types of the cache nodes.
+func (v *podValidator) availableTypes(ctx context.Context) (map[string]bool, error) {
+	var nodes corev1.NodeList
+	if err := v.client.List(ctx, &nodes, client.HasLabels{common.VolumeTypeLabel}); err != nil {
+		return nil, err
+	}
+	available := map[string]bool{}
+	for _, node := range nodes.Items {
+		available[node.GetLabels()[common.VolumeTypeLabel]] = true
+	}
+	return available, nil
+}
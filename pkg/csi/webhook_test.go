@@ -0,0 +1,126 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package csi
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"gotest.tools/v3/assert"
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+)
+
+// nodeLister is a client.Reader that lists fixed nodes.
+type nodeLister struct {
+	client.Reader
+	nodes []corev1.Node
+}
+
+func (l nodeLister) List(ctx context.Context, list client.ObjectList, opts ...client.ListOption) error {
+	list.(*corev1.NodeList).Items = l.nodes
+	return nil
+}
+
+func TestValidateVolumeAttributes(t *testing.T) {
+	available := map[string]bool{"lssd": true}
+	for _, testCase := range []struct {
+		name          string
+		attributes    map[string]string
+		available     map[string]bool
+		expectedError string
+	}{
+		{name: "none"},
+		{name: "available type", attributes: map[string]string{"type": "lssd"}, available: available},
+		{name: "kubelet", attributes: map[string]string{"csi.storage.k8s.io/ephemeral": "true"}, available: available},
+		{name: "unavailable type", attributes: map[string]string{"type": "tmpfs"}, available: available, expectedError: "no node has a tmpfs cache"},
+		{name: "unchecked type", attributes: map[string]string{"type": "tmpfs"}},
+		{name: "unknown type", attributes: map[string]string{"type": "floppy"}, expectedError: "unknown cache type"},
+		{name: "unknown attribute", attributes: map[string]string{"size": "10Gi"}, expectedError: "unknown volume attribute"},
+		{name: "path", attributes: map[string]string{"path": "models/llm"}},
+		{name: "absolute path", attributes: map[string]string{"path": "/etc"}, expectedError: "must be relative"},
+		{name: "escaping path", attributes: map[string]string{"path": "models/../../etc"}, expectedError: "must not contain .."},
+		{name: "empty path", attributes: map[string]string{"path": ""}, expectedError: "empty cache path"},
+		{name: "clone", attributes: map[string]string{"clone": "golden"}},
+		{name: "clone and path", attributes: map[string]string{"clone": "golden", "path": "models"}, expectedError: "can't both be set"},
+		{name: "escaping clone", attributes: map[string]string{"clone": "../golden"}, expectedError: "must not contain .."},
+		{name: "sandbox", attributes: map[string]string{"sandbox": "gvisor"}},
+		{name: "unknown sandbox", attributes: map[string]string{"sandbox": "kata"}, expectedError: "sandbox must be"},
+		{name: "high priority", attributes: map[string]string{"priority": "high"}},
+		{name: "low priority", attributes: map[string]string{"priority": "low", "path": "batch"}},
+		{name: "low priority without path", attributes: map[string]string{"priority": "low"}, expectedError: "need the path attribute"},
+		{name: "unknown priority", attributes: map[string]string{"priority": "urgent"}, expectedError: "priority must be"},
+		{name: "strict prewarm", attributes: map[string]string{"prewarm": "strict"}},
+		{name: "unknown prewarm", attributes: map[string]string{"prewarm": "lazy"}, expectedError: "prewarm must be"},
+	} {
+		t.Run(testCase.name, func(t *testing.T) {
+			err := validateVolumeAttributes(testCase.attributes, testCase.available)
+			if testCase.expectedError != "" {
+				assert.ErrorContains(t, err, testCase.expectedError)
+			} else {
+				assert.NilError(t, err)
+			}
+		})
+	}
+}
+
+func TestPodValidator(t *testing.T) {
+	lssdNode := corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "a", Labels: map[string]string{"node-cache.gke.io": "lssd"}}}
+	validator := &podValidator{
+		client:     nodeLister{nodes: []corev1.Node{lssdNode}},
+		decoder:    admission.NewDecoder(scheme.Scheme),
+		driverName: "node-cache.csi.storage.gke.io",
+	}
+	podWith := func(driver string, attributes map[string]string, nodeSelector map[string]string) admission.Request {
+		pod := corev1.Pod{
+			Spec: corev1.PodSpec{
+				NodeSelector: nodeSelector,
+				Volumes: []corev1.Volume{{
+					Name: "cache",
+					VolumeSource: corev1.VolumeSource{
+						CSI: &corev1.CSIVolumeSource{Driver: driver, VolumeAttributes: attributes},
+					},
+				}},
+			},
+		}
+		raw, err := json.Marshal(pod)
+		assert.NilError(t, err)
+		return admission.Request{AdmissionRequest: admissionv1.AdmissionRequest{Object: runtime.RawExtension{Raw: raw}}}
+	}
+
+	for _, testCase := range []struct {
+		name    string
+		req     admission.Request
+		allowed bool
+	}{
+		{"other driver", podWith("other", map[string]string{"foo": "bar"}, nil), true},
+		{"no attributes", podWith(validator.driverName, nil, nil), true},
+		{"available type", podWith(validator.driverName, map[string]string{"type": "lssd"}, map[string]string{"node-cache.gke.io": "lssd"}), true},
+		{"unavailable type", podWith(validator.driverName, map[string]string{"type": "pd"}, nil), false},
+		{"unavailable selector", podWith(validator.driverName, nil, map[string]string{"node-cache.gke.io": "tmpfs"}), false},
+		{"bad attribute", podWith(validator.driverName, map[string]string{"foo": "bar"}, nil), false},
+	} {
+		t.Run(testCase.name, func(t *testing.T) {
+			resp := validator.Handle(context.Background(), testCase.req)
+			assert.Equal(t, resp.Allowed, testCase.allowed, resp.Result)
+		})
+	}
+}
@@ -0,0 +1,257 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package deploygen
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	generatedHeader = "# Generated by deploygen from the driver and controller flags. Do not edit.\n"
+
+	// Placeholders replaced by templates after a manifest is marshaled.
+	argsPlaceholder      = "__ARGS__"
+	imagePlaceholder     = "__IMAGE__"
+	namespacePlaceholder = "__NAMESPACE__"
+)
+
+var documentSeparator = regexp.MustCompile(`(?m)^---\s*$`)
+
+// Component is a workload of the chart whose container args are set from the
+// chart values.
+type Component struct {
+	// Name is the key of the component in the chart values, such as driver.
+	Name string
+	// Manifest is the kustomize manifest of the workload, a DaemonSet or
+	// Deployment. Its args become the defaults of the chart values.
+	Manifest []byte
+	// Container is the container of the workload that takes the options.
+	Container string
+	Options   []Option
+}
+
+// Chart returns the files of a Helm chart by their path in the chart. The
+// cluster manifest holds the other resources, such as RBAC, which are copied
+// into the chart with the namespace of their subjects set to the release
+// namespace.
+func Chart(name, version string, components []Component, cluster []byte) (map[string][]byte, error) {
+	files := map[string][]byte{
+		"Chart.yaml": []byte(fmt.Sprintf("apiVersion: v2\nname: %s\ndescription: A CSI driver for a cache volume shared by the pods on a node.\nversion: %s\nappVersion: %q\n",
+			name, strings.TrimPrefix(version, "v"), version)),
+	}
+	var values bytes.Buffer
+	values.WriteString(generatedHeader)
+	schema := map[string]any{}
+	for _, c := range components {
+		template, image, flags, err := c.template()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", c.Name, err)
+		}
+		files["templates/"+c.Name+".yaml"] = template
+		c.writeValues(&values, image, flags)
+		schema[c.Name] = c.schema()
+	}
+	files["values.yaml"] = values.Bytes()
+	schemaJSON, err := json.MarshalIndent(map[string]any{
+		"$schema":    "https://json-schema.org/draft-07/schema#",
+		"type":       "object",
+		"properties": schema,
+	}, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	files["values.schema.json"] = append(schemaJSON, '\n')
+
+	clusterTemplate, err := clusterTemplate(cluster)
+	if err != nil {
+		return nil, fmt.Errorf("cluster: %w", err)
+	}
+	files["templates/cluster.yaml"] = clusterTemplate
+	return files, nil
+}
+
+// template returns the template of the component's workload, and the image and
+// flags of its container in the manifest.
+func (c Component) template() ([]byte, string, map[string]string, error) {
+	var manifest map[string]any
+	if err := yaml.Unmarshal(c.Manifest, &manifest); err != nil {
+		return nil, "", nil, err
+	}
+	container, err := findContainer(manifest, c.Container)
+	if err != nil {
+		return nil, "", nil, err
+	}
+	image, _ := container["image"].(string)
+	flags, err := c.parseArgs(container["args"])
+	if err != nil {
+		return nil, "", nil, err
+	}
+	container["image"] = imagePlaceholder
+	container["args"] = []string{argsPlaceholder}
+	data, err := yaml.Marshal(manifest)
+	if err != nil {
+		return nil, "", nil, err
+	}
+
+	var out bytes.Buffer
+	out.WriteString(generatedHeader)
+	for _, line := range strings.SplitAfter(string(data), "\n") {
+		switch {
+		case strings.Contains(line, "- "+argsPlaceholder):
+			indent := line[:strings.Index(line, "- ")]
+			fmt.Fprintf(&out, "%s{{- range $name, $value := .Values.%s.flags }}\n", indent, c.Name)
+			fmt.Fprintf(&out, "%s- {{ printf \"--%%s=%%v\" $name $value | quote }}\n", indent)
+			fmt.Fprintf(&out, "%s{{- end }}\n", indent)
+		case strings.Contains(line, imagePlaceholder):
+			out.WriteString(strings.Replace(line, imagePlaceholder, fmt.Sprintf("{{ .Values.%s.image | quote }}", c.Name), 1))
+		default:
+			out.WriteString(line)
+		}
+	}
+	return out.Bytes(), image, flags, nil
+}
+
+// findContainer returns the named container of the pod template of a workload.
+func findContainer(manifest map[string]any, name string) (map[string]any, error) {
+	spec, _ := manifest["spec"].(map[string]any)
+	template, _ := spec["template"].(map[string]any)
+	podSpec, _ := template["spec"].(map[string]any)
+	containers, _ := podSpec["containers"].([]any)
+	for _, c := range containers {
+		if container, ok := c.(map[string]any); ok && container["name"] == name {
+			return container, nil
+		}
+	}
+	return nil, fmt.Errorf("no container %s in the pod template", name)
+}
+
+// parseArgs returns the flags given by args, which must all be options of the
+// component.
+func (c Component) parseArgs(args any) (map[string]string, error) {
+	list, _ := args.([]any)
+	flags := map[string]string{}
+	for _, arg := range list {
+		s, _ := arg.(string)
+		flagArg, found := strings.CutPrefix(s, "--")
+		if !found {
+			return nil, fmt.Errorf("arg %q is not a --flag", s)
+		}
+		name, value, found := strings.Cut(flagArg, "=")
+		if !found {
+			value = "true"
+		}
+		if c.option(name) == nil {
+			return nil, fmt.Errorf("the manifest sets unknown flag --%s", name)
+		}
+		flags[name] = value
+	}
+	return flags, nil
+}
+
+func (c Component) option(name string) *Option {
+	for i := range c.Options {
+		if c.Options[i].Name == name {
+			return &c.Options[i]
+		}
+	}
+	return nil
+}
+
+// writeValues writes the values of the component, listing every option with
+// its usage. Options not set by the manifest are commented out with their
+// defaults.
+func (c Component) writeValues(w *bytes.Buffer, image string, flags map[string]string) {
+	fmt.Fprintf(w, "\n%s:\n", c.Name)
+	fmt.Fprintf(w, "  image: %q\n", image)
+	fmt.Fprintf(w, "  # Flags of the %s container, passed as --name=value. Flags that are\n", c.Container)
+	fmt.Fprintf(w, "  # commented out take the default shown.\n")
+	fmt.Fprintf(w, "  flags:\n")
+	for _, o := range c.Options {
+		fmt.Fprintf(w, "    # %s (%s)\n", strings.ReplaceAll(o.Usage, "\n", " "), o.Type)
+		if value, found := flags[o.Name]; found {
+			fmt.Fprintf(w, "    %s: %q\n", o.Name, value)
+		} else {
+			fmt.Fprintf(w, "    # %s: %q\n", o.Name, o.Default)
+		}
+	}
+}
+
+// schema returns the JSON schema of the component values. Unknown flags are
+// refused, so a chart can't set flags the binaries don't have.
+func (c Component) schema() map[string]any {
+	properties := map[string]any{}
+	for _, o := range c.Options {
+		property := map[string]any{"description": o.Usage}
+		switch o.Type {
+		case "bool":
+			property["type"] = []string{"boolean", "string"}
+		case "int":
+			property["type"] = []string{"integer", "string"}
+		case "float":
+			property["type"] = []string{"number", "string"}
+		default:
+			property["type"] = "string"
+		}
+		properties[o.Name] = property
+	}
+	return map[string]any{
+		"type": "object",
+		"properties": map[string]any{
+			"image": map[string]any{"type": "string"},
+			"flags": map[string]any{
+				"type":                 "object",
+				"properties":           properties,
+				"additionalProperties": false,
+			},
+		},
+	}
+}
+
+// clusterTemplate returns the template of the cluster resources. The
+// namespace is left to the release, so it isn't created, and service account
+// subjects of bindings are in the release namespace.
+func clusterTemplate(cluster []byte) ([]byte, error) {
+	var out bytes.Buffer
+	out.WriteString(generatedHeader)
+	for _, doc := range documentSeparator.Split(string(cluster), -1) {
+		var object map[string]any
+		if err := yaml.Unmarshal([]byte(doc), &object); err != nil {
+			return nil, err
+		}
+		if object == nil || object["kind"] == "Namespace" {
+			continue
+		}
+		if subjects, ok := object["subjects"].([]any); ok {
+			for _, s := range subjects {
+				if subject, ok := s.(map[string]any); ok && subject["kind"] == "ServiceAccount" {
+					subject["namespace"] = namespacePlaceholder
+				}
+			}
+		}
+		data, err := yaml.Marshal(object)
+		if err != nil {
+			return nil, err
+		}
+		out.WriteString("---\n")
+		out.Write(bytes.ReplaceAll(data, []byte(namespacePlaceholder), []byte("{{ .Release.Namespace }}")))
+	}
+	return out.Bytes(), nil
+}
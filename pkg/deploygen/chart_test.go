@@ -0,0 +1,160 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package deploygen
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testDaemonSet = `
+kind: DaemonSet
+apiVersion: apps/v1
+metadata:
+  name: driver
+spec:
+  template:
+    spec:
+      containers:
+        - name: registrar
+          image: registrar
+          args:
+            - --csi-address=/csi/csi.sock
+        - name: csi
+          image: imagetag/driver
+          args:
+            - --endpoint=unix:/csi/csi.sock
+            - --flush-on-drain
+`
+
+const testCluster = `# License header.
+apiVersion: v1
+kind: Namespace
+metadata:
+  name: node-cache
+---
+apiVersion: rbac.authorization.k8s.io/v1
+kind: RoleBinding
+metadata:
+  name: binding
+subjects:
+  - kind: ServiceAccount
+    name: node-cache-driver
+`
+
+func testOptions() []Option {
+	fs := flag.NewFlagSet("driver", flag.ContinueOnError)
+	fs.Bool(DescribeFlag, false, "Describe.")
+	fs.String("endpoint", "unix:/tmp/csi.sock", "CSI endpoint")
+	fs.Bool("flush-on-drain", false, "Flush on drain.")
+	fs.Duration("trim-interval", time.Hour, "Trim interval.")
+	fs.Int("max-inflight-mounts", 0, "Mount limit.")
+	return Describe(fs)
+}
+
+func TestDescribe(t *testing.T) {
+	expected := []Option{
+		{Name: "endpoint", Type: "string", Default: "unix:/tmp/csi.sock", Usage: "CSI endpoint"},
+		{Name: "flush-on-drain", Type: "bool", Default: "false", Usage: "Flush on drain."},
+		{Name: "max-inflight-mounts", Type: "int", Default: "0", Usage: "Mount limit."},
+		{Name: "trim-interval", Type: "duration", Default: "1h0m0s", Usage: "Trim interval."},
+	}
+	options := testOptions()
+	if !reflect.DeepEqual(options, expected) {
+		t.Errorf("Got %+v, expected %+v", options, expected)
+	}
+
+	fs := flag.NewFlagSet("driver", flag.ContinueOnError)
+	fs.String("endpoint", "unix:/tmp/csi.sock", "CSI endpoint")
+	var buf bytes.Buffer
+	if err := WriteOptions(&buf, fs); err != nil {
+		t.Fatal(err)
+	}
+	read, err := ReadOptions(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(read, expected[:1]) {
+		t.Errorf("Read %+v, expected %+v", read, expected[:1])
+	}
+}
+
+func TestChart(t *testing.T) {
+	components := []Component{{Name: "driver", Manifest: []byte(testDaemonSet), Container: "csi", Options: testOptions()}}
+	files, err := Chart("node-cache", "v1.2.0", components, []byte(testCluster))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if chart := string(files["Chart.yaml"]); !strings.Contains(chart, "version: 1.2.0\n") || !strings.Contains(chart, `appVersion: "v1.2.0"`) {
+		t.Errorf("Bad Chart.yaml:\n%s", chart)
+	}
+
+	template := string(files["templates/driver.yaml"])
+	for _, expected := range []string{
+		"        {{- range $name, $value := .Values.driver.flags }}\n        - {{ printf \"--%s=%v\" $name $value | quote }}\n        {{- end }}\n",
+		"image: {{ .Values.driver.image | quote }}",
+		"- --csi-address=/csi/csi.sock",
+	} {
+		if !strings.Contains(template, expected) {
+			t.Errorf("Template missing %q:\n%s", expected, template)
+		}
+	}
+
+	values := string(files["values.yaml"])
+	for _, expected := range []string{
+		"  image: \"imagetag/driver\"\n",
+		"    endpoint: \"unix:/csi/csi.sock\"\n",
+		"    flush-on-drain: \"true\"\n",
+		"    # Trim interval. (duration)\n    # trim-interval: \"1h0m0s\"\n",
+	} {
+		if !strings.Contains(values, expected) {
+			t.Errorf("Values missing %q:\n%s", expected, values)
+		}
+	}
+
+	var schema struct {
+		Properties map[string]struct {
+			Properties struct {
+				Flags struct {
+					Properties           map[string]json.RawMessage `json:"properties"`
+					AdditionalProperties bool                       `json:"additionalProperties"`
+				} `json:"flags"`
+			} `json:"properties"`
+		} `json:"properties"`
+	}
+	if err := json.Unmarshal(files["values.schema.json"], &schema); err != nil {
+		t.Fatal(err)
+	}
+	flags := schema.Properties["driver"].Properties.Flags
+	if len(flags.Properties) != 4 || flags.AdditionalProperties {
+		t.Errorf("Schema allows %d flags and others %v, expected 4 and no others", len(flags.Properties), flags.AdditionalProperties)
+	}
+
+	cluster := string(files["templates/cluster.yaml"])
+	if strings.Contains(cluster, "kind: Namespace") || !strings.Contains(cluster, "namespace: {{ .Release.Namespace }}") {
+		t.Errorf("Bad cluster template:\n%s", cluster)
+	}
+
+	components[0].Manifest = []byte(strings.Replace(testDaemonSet, "--flush-on-drain", "--flush-on-drian", 1))
+	if _, err := Chart("node-cache", "v1.2.0", components, []byte(testCluster)); err == nil || !strings.Contains(err.Error(), "unknown flag --flush-on-drian") {
+		t.Errorf("Expected an unknown flag to fail, got %v", err)
+	}
+}
@@ -0,0 +1,88 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package deploygen generates deployment manifests from the command line
+// flags of the driver and controller, so that the options a deployment can set
+// always match those of the code. Each binary describes its flags with
+// --describe-flags, and Chart turns those descriptions and the kustomize
+// manifests into a Helm chart.
+package deploygen
+
+import (
+	"encoding/json"
+	"flag"
+	"io"
+	"time"
+)
+
+// DescribeFlag is the name of the flag that makes a binary print its options
+// and exit.
+const DescribeFlag = "describe-flags"
+
+// Option describes a command line flag.
+type Option struct {
+	Name string `json:"name"`
+	// Type is bool, int, float, duration or string. Flags of other types
+	// are strings.
+	Type    string `json:"type"`
+	Default string `json:"default,omitempty"`
+	Usage   string `json:"usage"`
+}
+
+// Describe returns the options of the flags in fs, in lexical order, other
+// than DescribeFlag itself.
+func Describe(fs *flag.FlagSet) []Option {
+	var options []Option
+	fs.VisitAll(func(f *flag.Flag) {
+		if f.Name == DescribeFlag {
+			return
+		}
+		options = append(options, Option{Name: f.Name, Type: flagType(f), Default: f.DefValue, Usage: f.Usage})
+	})
+	return options
+}
+
+// WriteOptions writes the options of fs as JSON.
+func WriteOptions(w io.Writer, fs *flag.FlagSet) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(Describe(fs))
+}
+
+// ReadOptions reads options written by WriteOptions.
+func ReadOptions(r io.Reader) ([]Option, error) {
+	var options []Option
+	if err := json.NewDecoder(r).Decode(&options); err != nil {
+		return nil, err
+	}
+	return options, nil
+}
+
+func flagType(f *flag.Flag) string {
+	getter, ok := f.Value.(flag.Getter)
+	if !ok {
+		return "string"
+	}
+	switch getter.Get().(type) {
+	case bool:
+		return "bool"
+	case int, int64, uint, uint64:
+		return "int"
+	case float64:
+		return "float"
+	case time.Duration:
+		return "duration"
+	}
+	return "string"
+}
@@ -0,0 +1,117 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package fault injects failures at named points in the driver and
+// controller, so that tests can exercise retry and error paths
+// deterministically. No faults are injected unless they are configured with
+// Set, normally from the --inject-faults flag.
+package fault
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// The points at which faults can be injected.
+const (
+	// Attach fails a PD attach as if the GCE operation timed out.
+	Attach = "attach"
+	// Mkfs fails formatting a cache device.
+	Mkfs = "mkfs"
+	// Mdadm fails mdadm commands.
+	Mdadm = "mdadm"
+)
+
+// EnvVar is the environment variable giving the default fault spec.
+const EnvVar = "NODE_CACHE_FAULTS"
+
+// ErrInjected is wrapped by all injected faults.
+var ErrInjected = errors.New("injected fault")
+
+var (
+	mutex sync.Mutex
+	// faults maps points to the number of remaining failures, or -1 to
+	// always fail.
+	faults = map[string]int{}
+)
+
+// Set replaces the configured faults with spec, a comma-separated list of
+// point or point=count entries. A point alone always fails; with a count it
+// fails that many times and then succeeds. An empty spec clears all faults.
+func Set(spec string) error {
+	parsed := map[string]int{}
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		point, countStr, hasCount := strings.Cut(entry, "=")
+		if !isPoint(point) {
+			return fmt.Errorf("unknown fault point %q", point)
+		}
+		count := -1
+		if hasCount {
+			var err error
+			if count, err = strconv.Atoi(countStr); err != nil || count < 0 {
+				return fmt.Errorf("bad fault count in %q", entry)
+			}
+		}
+		parsed[point] = count
+	}
+	mutex.Lock()
+	defer mutex.Unlock()
+	faults = parsed
+	return nil
+}
+
+// Check returns an error wrapping ErrInjected if a fault is configured at
+// point, and nil otherwise.
+func Check(point string) error {
+	mutex.Lock()
+	defer mutex.Unlock()
+	count, found := faults[point]
+	if !found || count == 0 {
+		return nil
+	}
+	if count > 0 {
+		faults[point] = count - 1
+	}
+	return fmt.Errorf("%w at %s", ErrInjected, point)
+}
+
+// Active returns the points with faults configured, for logging.
+func Active() []string {
+	mutex.Lock()
+	defer mutex.Unlock()
+	var points []string
+	for point, count := range faults {
+		if count != 0 {
+			points = append(points, point)
+		}
+	}
+	sort.Strings(points)
+	return points
+}
+
+func isPoint(point string) bool {
+	switch point {
+	case Attach, Mkfs, Mdadm:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,57 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fault
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestFaults(t *testing.T) {
+	t.Cleanup(func() { Set("") })
+
+	if err := Set("mkfs, mdadm=2"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		if err := Check(Mkfs); !errors.Is(err, ErrInjected) {
+			t.Errorf("mkfs %d: expected injected fault, got %v", i, err)
+		}
+	}
+	for i, expectFault := range []bool{true, true, false} {
+		if err := Check(Mdadm); (err != nil) != expectFault {
+			t.Errorf("mdadm %d: expected fault %t, got %v", i, expectFault, err)
+		}
+	}
+	if err := Check(Attach); err != nil {
+		t.Errorf("unexpected attach fault: %v", err)
+	}
+	if active := Active(); len(active) != 1 || active[0] != Mkfs {
+		t.Errorf("unexpected active faults %v", active)
+	}
+
+	if err := Set(""); err != nil || len(Active()) != 0 {
+		t.Errorf("faults not cleared: %v, %v", Active(), err)
+	}
+}
+
+func TestBadSpec(t *testing.T) {
+	t.Cleanup(func() { Set("") })
+	for _, spec := range []string{"floppy", "mkfs=x", "mkfs=-1"} {
+		if err := Set(spec); err == nil {
+			t.Errorf("expected error for %q", spec)
+		}
+	}
+}
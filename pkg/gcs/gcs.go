@@ -0,0 +1,290 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package gcs copies cache contents to and from a GCS bucket using the JSON
+// API.
+package gcs
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"golang.org/x/oauth2/google"
+	"k8s.io/klog/v2"
+
+	"github.com/GoogleCloudPlatform/csi-node-cache/pkg/budget"
+)
+
+const (
+	defaultEndpoint = "https://storage.googleapis.com"
+	readWriteScope  = "https://www.googleapis.com/auth/devstorage.read_write"
+)
+
+// Location is a bucket and an object prefix, which may be empty.
+type Location struct {
+	Bucket string
+	Prefix string
+}
+
+// ParseURL parses a location of the form gs://bucket[/prefix].
+func ParseURL(u string) (Location, error) {
+	rest, found := strings.CutPrefix(u, "gs://")
+	if !found {
+		return Location{}, fmt.Errorf("%s is not a gs:// url", u)
+	}
+	bucket, prefix, _ := strings.Cut(rest, "/")
+	if bucket == "" {
+		return Location{}, fmt.Errorf("no bucket in %s", u)
+	}
+	return Location{Bucket: bucket, Prefix: strings.Trim(prefix, "/")}, nil
+}
+
+// Join returns the location of elem under l.
+func (l Location) Join(elem ...string) Location {
+	return Location{Bucket: l.Bucket, Prefix: path.Join(append([]string{l.Prefix}, elem...)...)}
+}
+
+func (l Location) String() string {
+	return fmt.Sprintf("gs://%s/%s", l.Bucket, l.Prefix)
+}
+
+// Client talks to GCS.
+type Client struct {
+	http     *http.Client
+	endpoint string
+	// budget, if set, limits uploads.
+	budget *budget.Budget
+}
+
+// NewClient returns a client using the default credentials, which for the
+// driver is its workload identity.
+func NewClient(ctx context.Context) (*Client, error) {
+	httpClient, err := google.DefaultClient(ctx, readWriteScope)
+	if err != nil {
+		return nil, fmt.Errorf("Could not get GCS credentials: %w", err)
+	}
+	return &Client{http: httpClient, endpoint: defaultEndpoint}, nil
+}
+
+// SetBudget limits the rate of uploads by b, which is shared with other
+// background work.
+func (c *Client) SetBudget(b *budget.Budget) {
+	c.budget = b
+}
+
+// UploadDir uploads all regular files under dir to dst, with object names
+// given by their path relative to dir. It returns the number of files
+// uploaded. Files that disappear during the upload are skipped, as are files
+// and directories for which skip, if set, returns true.
+func (c *Client) UploadDir(ctx context.Context, dir string, dst Location, skip func(rel string, entry fs.DirEntry) bool) (int, error) {
+	count := 0
+	err := filepath.WalkDir(dir, func(file string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		rel, err := filepath.Rel(dir, file)
+		if err != nil {
+			return err
+		}
+		if skip != nil && file != dir && skip(rel, entry) {
+			if entry.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !entry.Type().IsRegular() {
+			return nil
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := c.uploadFile(ctx, file, dst.Join(filepath.ToSlash(rel))); err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		count++
+		return nil
+	})
+	return count, err
+}
+
+func (c *Client) uploadFile(ctx context.Context, file string, dst Location) error {
+	if err := c.budget.Wait(ctx, 0); err != nil {
+		return err
+	}
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	if err := c.upload(ctx, c.budget.Reader(ctx, f), info.Size(), dst, "application/octet-stream"); err != nil {
+		return fmt.Errorf("Upload of %s to %s failed: %w", file, dst, err)
+	}
+	klog.V(4).Infof("Uploaded %s to %s", file, dst)
+	return nil
+}
+
+// Put writes data to the object at dst, replacing any existing object. It is
+// for small reports, and is not limited by the budget.
+func (c *Client) Put(ctx context.Context, data []byte, dst Location, contentType string) error {
+	if err := c.upload(ctx, bytes.NewReader(data), int64(len(data)), dst, contentType); err != nil {
+		return fmt.Errorf("Write of %s failed: %w", dst, err)
+	}
+	return nil
+}
+
+func (c *Client) upload(ctx context.Context, body io.Reader, size int64, dst Location, contentType string) error {
+	u := fmt.Sprintf("%s/upload/storage/v1/b/%s/o?uploadType=media&name=%s", c.endpoint, url.PathEscape(dst.Bucket), url.QueryEscape(dst.Prefix))
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u, body)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+	req.Header.Set("Content-Type", contentType)
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
+
+// Object is an object in a bucket.
+type Object struct {
+	Name       string
+	Size       int64
+	Generation int64
+	// CRC32C is the Castagnoli checksum of the object contents.
+	CRC32C uint32
+}
+
+type objectList struct {
+	Items []struct {
+		Name       string `json:"name"`
+		Size       string `json:"size"`
+		Generation string `json:"generation"`
+		CRC32C     string `json:"crc32c"`
+	} `json:"items"`
+	NextPageToken string `json:"nextPageToken"`
+}
+
+// List returns the objects under the location prefix.
+func (c *Client) List(ctx context.Context, loc Location) ([]Object, error) {
+	prefix := loc.Prefix
+	if prefix != "" {
+		prefix += "/"
+	}
+	var objects []Object
+	pageToken := ""
+	for {
+		query := url.Values{"prefix": {prefix}, "fields": {"items(name,size,generation,crc32c),nextPageToken"}}
+		if pageToken != "" {
+			query.Set("pageToken", pageToken)
+		}
+		u := fmt.Sprintf("%s/storage/v1/b/%s/o?%s", c.endpoint, url.PathEscape(loc.Bucket), query.Encode())
+		var list objectList
+		if err := c.getJSON(ctx, u, &list); err != nil {
+			return nil, fmt.Errorf("List of %s failed: %w", loc, err)
+		}
+		for _, item := range list.Items {
+			obj := Object{Name: item.Name}
+			var err error
+			if obj.Size, err = strconv.ParseInt(item.Size, 10, 64); err != nil {
+				return nil, fmt.Errorf("bad size %q for %s: %w", item.Size, item.Name, err)
+			}
+			if obj.Generation, err = strconv.ParseInt(item.Generation, 10, 64); err != nil {
+				return nil, fmt.Errorf("bad generation %q for %s: %w", item.Generation, item.Name, err)
+			}
+			crc, err := base64.StdEncoding.DecodeString(item.CRC32C)
+			if err != nil || len(crc) != 4 {
+				return nil, fmt.Errorf("bad crc32c %q for %s", item.CRC32C, item.Name)
+			}
+			obj.CRC32C = binary.BigEndian.Uint32(crc)
+			objects = append(objects, obj)
+		}
+		if list.NextPageToken == "" {
+			return objects, nil
+		}
+		pageToken = list.NextPageToken
+	}
+}
+
+func (c *Client) getJSON(ctx context.Context, u string, v any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// ReadRange reads length bytes from offset of a generation of an object.
+// The caller must close the reader.
+func (c *Client) ReadRange(ctx context.Context, bucket string, obj Object, offset, length int64) (io.ReadCloser, error) {
+	u := fmt.Sprintf("%s/storage/v1/b/%s/o/%s?alt=media&generation=%d", c.endpoint, url.PathEscape(bucket), url.PathEscape(obj.Name), obj.Generation)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, offset+length-1))
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("Read of gs://%s/%s failed: %w", bucket, obj.Name, err)
+	}
+	if resp.StatusCode != http.StatusPartialContent && resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, fmt.Errorf("Read of gs://%s/%s failed: %s: %s", bucket, obj.Name, resp.Status, strings.TrimSpace(string(body)))
+	}
+	if resp.StatusCode == http.StatusOK && (offset != 0 || length != obj.Size) {
+		resp.Body.Close()
+		return nil, fmt.Errorf("Read of gs://%s/%s ignored range %d+%d", bucket, obj.Name, offset, length)
+	}
+	return resp.Body, nil
+}
@@ -0,0 +1,181 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcs
+
+import (
+	"context"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestParseURL(t *testing.T) {
+	tests := []struct {
+		url      string
+		expected Location
+		err      bool
+	}{
+		{url: "gs://bucket", expected: Location{Bucket: "bucket"}},
+		{url: "gs://bucket/", expected: Location{Bucket: "bucket"}},
+		{url: "gs://bucket/a/b/", expected: Location{Bucket: "bucket", Prefix: "a/b"}},
+		{url: "gs:///a", err: true},
+		{url: "bucket/a", err: true},
+	}
+	for _, test := range tests {
+		loc, err := ParseURL(test.url)
+		if test.err {
+			if err == nil {
+				t.Errorf("Expected error for %s, got %v", test.url, loc)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Unexpected error for %s: %v", test.url, err)
+		} else if loc != test.expected {
+			t.Errorf("Got %v expected %v for %s", loc, test.expected, test.url)
+		}
+	}
+}
+
+func TestUploadDir(t *testing.T) {
+	dir := t.TempDir()
+	for name, contents := range map[string]string{"a": "1", "sub/b": "22", "sub/deeper/c": "333", "skipped/d": "4"} {
+		file := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(file, []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var mutex sync.Mutex
+	uploaded := map[string]string{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/upload/storage/v1/b/bucket/o" || r.URL.Query().Get("uploadType") != "media" {
+			http.Error(w, "bad request "+r.URL.String(), http.StatusBadRequest)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		mutex.Lock()
+		uploaded[r.URL.Query().Get("name")] = string(body)
+		mutex.Unlock()
+	}))
+	defer server.Close()
+
+	c := &Client{http: server.Client(), endpoint: server.URL}
+	count, err := c.UploadDir(context.Background(), dir, Location{Bucket: "bucket", Prefix: "cache"}, func(rel string, entry fs.DirEntry) bool {
+		return rel == "skipped"
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 3 {
+		t.Errorf("Expected 3 uploads, got %d", count)
+	}
+	expected := map[string]string{"cache/a": "1", "cache/sub/b": "22", "cache/sub/deeper/c": "333"}
+	if !reflect.DeepEqual(uploaded, expected) {
+		t.Errorf("Got %v expected %v", uploaded, expected)
+	}
+}
+
+func TestList(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/storage/v1/b/bucket/o" || r.URL.Query().Get("prefix") != "cache/" {
+			http.Error(w, "bad request "+r.URL.String(), http.StatusBadRequest)
+			return
+		}
+		// The crc32c of "hello" is 0x9a71bb4c.
+		if r.URL.Query().Get("pageToken") == "" {
+			io.WriteString(w, `{"items": [{"name": "cache/a", "size": "5", "generation": "7", "crc32c": "mnG7TA=="}], "nextPageToken": "next"}`)
+		} else {
+			io.WriteString(w, `{"items": [{"name": "cache/b", "size": "0", "generation": "8", "crc32c": "AAAAAA=="}]}`)
+		}
+	}))
+	defer server.Close()
+
+	c := &Client{http: server.Client(), endpoint: server.URL}
+	objects, err := c.List(context.Background(), Location{Bucket: "bucket", Prefix: "cache"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []Object{
+		{Name: "cache/a", Size: 5, Generation: 7, CRC32C: 0x9a71bb4c},
+		{Name: "cache/b", Size: 0, Generation: 8},
+	}
+	if !reflect.DeepEqual(objects, expected) {
+		t.Errorf("Got %v expected %v", objects, expected)
+	}
+}
+
+func TestReadRange(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/storage/v1/b/bucket/o/cache/a" || r.URL.Query().Get("alt") != "media" || r.URL.Query().Get("generation") != "7" {
+			http.Error(w, "bad request "+r.URL.String(), http.StatusBadRequest)
+			return
+		}
+		if r.Header.Get("Range") != "bytes=1-3" {
+			http.Error(w, "bad range "+r.Header.Get("Range"), http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusPartialContent)
+		io.WriteString(w, "ell")
+	}))
+	defer server.Close()
+
+	c := &Client{http: server.Client(), endpoint: server.URL}
+	r, err := c.ReadRange(context.Background(), "bucket", Object{Name: "cache/a", Size: 5, Generation: 7}, 1, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	data, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "ell" {
+		t.Errorf("Got %q expected ell", data)
+	}
+}
+
+func TestPut(t *testing.T) {
+	var name, contentType, body string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, _ := io.ReadAll(r.Body)
+		name, contentType, body = r.URL.Query().Get("name"), r.Header.Get("Content-Type"), string(data)
+		if r.URL.Query().Get("name") == "denied" {
+			http.Error(w, "no access", http.StatusForbidden)
+		}
+	}))
+	defer server.Close()
+
+	c := &Client{http: server.Client(), endpoint: server.URL}
+	if err := c.Put(context.Background(), []byte(`{"a":1}`), Location{Bucket: "bucket", Prefix: "fleet/cluster.json"}, "application/json"); err != nil {
+		t.Fatal(err)
+	}
+	if name != "fleet/cluster.json" || contentType != "application/json" || body != `{"a":1}` {
+		t.Errorf("Got %s of %s: %s", name, contentType, body)
+	}
+	if err := c.Put(context.Background(), nil, Location{Bucket: "bucket", Prefix: "denied"}, "application/json"); err == nil || !strings.Contains(err.Error(), "no access") {
+		t.Errorf("Expected a denied write to fail, got %v", err)
+	}
+}
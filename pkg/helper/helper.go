@@ -0,0 +1,247 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package helper runs the privileged commands of the driver, such as mount and
+// mdadm, in a small daemon on the host. The driver talks to it over a unix
+// socket, so that the driver container need not be privileged.
+package helper
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"k8s.io/klog/v2"
+	utilexec "k8s.io/utils/exec"
+
+	"github.com/GoogleCloudPlatform/csi-node-cache/pkg/util"
+)
+
+const (
+	runPath = "/run"
+
+	// maxRequestBytes bounds the size of a run request.
+	maxRequestBytes = 1 << 20
+)
+
+// DefaultCommands are the commands the driver may run through the helper.
+var DefaultCommands = []string{
+	"mount", "umount",
+	"blkid", "blockdev", "dumpe2fs", "e2fsck", "fsck", "fsck.ext4", "resize2fs", "fstrim",
+	"mkfs.ext4", "mkfs.btrfs", "mkfs.xfs", "xfs_repair", "xfs_growfs",
+	"mdadm", "lvm", "nvme", "iscsiadm",
+}
+
+// RunRequest is the body of a request to run a command.
+type RunRequest struct {
+	Command string        `json:"command"`
+	Args    []string      `json:"args,omitempty"`
+	Env     []string      `json:"env,omitempty"`
+	Timeout time.Duration `json:"timeout,omitempty"`
+}
+
+// RunResponse is the result of a command. ExitCode is set if the command ran
+// and failed, and Error describes any failure.
+type RunResponse struct {
+	Stdout   []byte `json:"stdout,omitempty"`
+	Stderr   []byte `json:"stderr,omitempty"`
+	ExitCode int    `json:"exitCode,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+// allowedEnv are the environment variables a client may set for a command.
+// Others, such as PATH or LD_PRELOAD, could change what the command runs.
+var allowedEnv = []string{"LC_ALL"}
+
+// Server runs allowed commands for clients of a unix socket.
+type Server struct {
+	// allowed maps command names to the absolute paths they are run from.
+	allowed map[string]string
+}
+
+// NewServer creates a server that runs the named commands. Commands are found
+// in the helper's PATH when the server is created, and are requested by name
+// only, so that a client cannot choose what is run. Commands that are not
+// found are not allowed.
+func NewServer(commands []string) *Server {
+	s := &Server{allowed: map[string]string{}}
+	for _, c := range commands {
+		if c == "" {
+			continue
+		}
+		if c != filepath.Base(c) {
+			klog.Warningf("Not allowing %q, commands are given by name", c)
+			continue
+		}
+		path, err := exec.LookPath(c)
+		if err == nil {
+			path, err = filepath.Abs(path)
+		}
+		if err != nil {
+			klog.Warningf("Not allowing %s, which was not found: %v", c, err)
+			continue
+		}
+		s.allowed[c] = path
+	}
+	return s
+}
+
+// Serve listens on socketPath until ctx is done. Any existing socket is
+// replaced, and the new one is only accessible by its owner.
+func (s *Server) Serve(ctx context.Context, socketPath string) error {
+	if err := os.MkdirAll(filepath.Dir(socketPath), 0750); err != nil {
+		return fmt.Errorf("Could not create socket directory: %w", err)
+	}
+	if err := os.Remove(socketPath); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove %s: %w", socketPath, err)
+	}
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		return fmt.Errorf("failed to listen: %w", err)
+	}
+	if err := os.Chmod(socketPath, 0600); err != nil {
+		listener.Close()
+		return fmt.Errorf("Could not restrict %s: %w", socketPath, err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(runPath, s.handleRun)
+	server := &http.Server{Handler: mux}
+	go func() {
+		<-ctx.Done()
+		server.Close()
+	}()
+	klog.Infof("Helper serving on %s", socketPath)
+	if err := server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return fmt.Errorf("serving failed: %w", err)
+	}
+	return nil
+}
+
+func (s *Server) handleRun(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "run requires POST", http.StatusMethodNotAllowed)
+		return
+	}
+	var req RunRequest
+	if err := json.NewDecoder(io.LimitReader(r.Body, maxRequestBytes)).Decode(&req); err != nil {
+		http.Error(w, fmt.Sprintf("bad request: %v", err), http.StatusBadRequest)
+		return
+	}
+	path, found := s.allowed[req.Command]
+	if !found {
+		klog.Warningf("Refusing to run %q", req.Command)
+		http.Error(w, fmt.Sprintf("command %q is not allowed", req.Command), http.StatusForbidden)
+		return
+	}
+	if err := checkEnv(req.Env); err != nil {
+		klog.Warningf("Refusing to run %s: %v", req.Command, err)
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	// Arguments may include sensitive mount options, so only the command is logged.
+	klog.V(4).Infof("Running %s", path)
+	result, err := util.RunCommandContext(r.Context(), util.CommandOptions{Timeout: req.Timeout, Env: req.Env}, path, req.Args...)
+	resp := RunResponse{Stdout: result.Stdout, Stderr: result.Stderr}
+	if err != nil {
+		resp.Error = err.Error()
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			resp.ExitCode = exitErr.ExitCode()
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		klog.Errorf("Could not send result of %s: %v", req.Command, err)
+	}
+}
+
+// checkEnv returns an error if env sets a variable other than allowedEnv.
+func checkEnv(env []string) error {
+	for _, e := range env {
+		name, _, _ := strings.Cut(e, "=")
+		if !slices.Contains(allowedEnv, name) {
+			return fmt.Errorf("environment variable %q is not allowed", name)
+		}
+	}
+	return nil
+}
+
+// Client runs commands through a helper. It implements util.CommandRunner.
+type Client struct {
+	http *http.Client
+}
+
+var _ util.CommandRunner = &Client{}
+
+// NewClient creates a client for the helper listening on socketPath.
+func NewClient(socketPath string) *Client {
+	return &Client{
+		http: &http.Client{
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					var d net.Dialer
+					return d.DialContext(ctx, "unix", socketPath)
+				},
+			},
+		},
+	}
+}
+
+// RunCommand runs cmd in the helper. If ctx is done the command is killed.
+// The helper chooses where the command is run from, so only its name is sent.
+func (c *Client) RunCommand(ctx context.Context, opts util.CommandOptions, cmd string, args ...string) (util.CommandResult, error) {
+	body, err := json.Marshal(RunRequest{Command: filepath.Base(cmd), Args: args, Env: opts.Env, Timeout: opts.Timeout})
+	if err != nil {
+		return util.CommandResult{}, err
+	}
+	// The host is ignored, as the transport always dials the socket.
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, "http://helper"+runPath, bytes.NewReader(body))
+	if err != nil {
+		return util.CommandResult{}, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	httpResp, err := c.http.Do(req)
+	if err != nil {
+		return util.CommandResult{}, fmt.Errorf("Could not reach helper to run %s: %w", cmd, err)
+	}
+	defer httpResp.Body.Close()
+	if httpResp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(httpResp.Body)
+		return util.CommandResult{}, fmt.Errorf("helper refused %s: %s", cmd, strings.TrimSpace(string(msg)))
+	}
+	var resp RunResponse
+	if err := json.NewDecoder(httpResp.Body).Decode(&resp); err != nil {
+		return util.CommandResult{}, fmt.Errorf("bad helper response for %s: %w", cmd, err)
+	}
+	result := util.CommandResult{Stdout: resp.Stdout, Stderr: resp.Stderr}
+	if resp.ExitCode != 0 {
+		return result, utilexec.CodeExitError{Err: errors.New(resp.Error), Code: resp.ExitCode}
+	}
+	if resp.Error != "" {
+		return result, errors.New(resp.Error)
+	}
+	return result, nil
+}
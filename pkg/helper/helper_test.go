@@ -0,0 +1,105 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package helper
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	utilexec "k8s.io/utils/exec"
+
+	"github.com/GoogleCloudPlatform/csi-node-cache/pkg/util"
+)
+
+func startServer(t *testing.T, commands ...string) *Client {
+	socket := filepath.Join(t.TempDir(), "helper.sock")
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- NewServer(commands).Serve(ctx, socket)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		if err := <-done; err != nil {
+			t.Errorf("serve failed: %v", err)
+		}
+	})
+	for i := 0; i < 100; i++ {
+		if _, err := os.Stat(socket); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return NewClient(socket)
+}
+
+func TestRunCommand(t *testing.T) {
+	client := startServer(t, "sh")
+	ctx := context.Background()
+
+	// The helper finds sh itself, wherever the driver expects it to be.
+	result, err := client.RunCommand(ctx, util.CommandOptions{Env: []string{"LC_ALL=C"}}, "/not/bin/sh", "-c", "echo out $LC_ALL; echo err >&2")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if string(result.Stdout) != "out C\n" || string(result.Stderr) != "err\n" {
+		t.Errorf("bad output %q, %q", result.Stdout, result.Stderr)
+	}
+
+	_, err = client.RunCommand(ctx, util.CommandOptions{}, "sh", "-c", "echo oops >&2; exit 3")
+	var exitErr utilexec.CodeExitError
+	if !errors.As(err, &exitErr) || exitErr.Code != 3 || !strings.Contains(err.Error(), "oops") {
+		t.Errorf("expected exit status 3 with stderr, got %v", err)
+	}
+
+	_, err = client.RunCommand(ctx, util.CommandOptions{Timeout: 100 * time.Millisecond}, "sh", "-c", "exec sleep 10")
+	if err == nil || !strings.Contains(err.Error(), "deadline exceeded") {
+		t.Errorf("expected timeout, got %v", err)
+	}
+}
+
+func TestRunCommandRefused(t *testing.T) {
+	client := startServer(t, "sh", "/bin/echo", "not-a-command")
+	for _, cmd := range []string{"/bin/echo", "echo", "not-a-command"} {
+		_, err := client.RunCommand(context.Background(), util.CommandOptions{}, cmd, "hi")
+		if err == nil || !strings.Contains(err.Error(), "not allowed") {
+			t.Errorf("expected %s to be refused, got %v", cmd, err)
+		}
+	}
+	for _, env := range []string{"LD_PRELOAD=/tmp/evil.so", "PATH=/tmp"} {
+		_, err := client.RunCommand(context.Background(), util.CommandOptions{Env: []string{env}}, "sh", "-c", "true")
+		if err == nil || !strings.Contains(err.Error(), "not allowed") {
+			t.Errorf("expected %s to be refused, got %v", env, err)
+		}
+	}
+}
+
+func TestServerPaths(t *testing.T) {
+	s := NewServer([]string{"sh", "bin/sh", "../sh", "/bin/sh"})
+	if len(s.allowed) != 1 || !filepath.IsAbs(s.allowed["sh"]) {
+		t.Errorf("expected sh at an absolute path only, got %v", s.allowed)
+	}
+	// A path from a client is never run, even if its base name is allowed.
+	for _, cmd := range []string{"/tmp/sh", "/var/lib/kubelet/pods/x/sh", "../sh"} {
+		if _, found := s.allowed[cmd]; found {
+			t.Errorf("%s is allowed", cmd)
+		}
+	}
+}
@@ -0,0 +1,192 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iscsi
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/klog/v2"
+
+	"github.com/GoogleCloudPlatform/csi-node-cache/pkg/util"
+)
+
+const (
+	iscsiadmCmd = "/bin/iscsiadm"
+	byPathDir   = "/dev/disk/by-path"
+	sysBlockDir = "/sys/block"
+
+	defaultPort = "3260"
+)
+
+// ChapCredentials are the session CHAP credentials for a target.
+type ChapCredentials struct {
+	Username string
+	Password string
+}
+
+// Target is an iSCSI LUN, reachable through one or more portals. If Multipath
+// is set, the LUN is used through the device-mapper multipath device that
+// combines the sessions to each portal.
+type Target struct {
+	Portals   []string
+	IQN       string
+	LUN       int
+	Chap      *ChapCredentials
+	Multipath bool
+}
+
+// NewTarget creates a target. Portals are host[:port], with the standard iSCSI
+// port used if none is given.
+func NewTarget(portals []string, iqn string, lun int) (Target, error) {
+	if len(portals) == 0 || iqn == "" {
+		return Target{}, fmt.Errorf("both portal and iqn are required for an iscsi target, got %v and %q", portals, iqn)
+	}
+	t := Target{IQN: iqn, LUN: lun}
+	for _, p := range portals {
+		p = strings.TrimSpace(p)
+		if !strings.Contains(p, ":") {
+			p = p + ":" + defaultPort
+		}
+		t.Portals = append(t.Portals, p)
+	}
+	return t, nil
+}
+
+// Login logs in to the target on each portal if necessary, and returns the
+// block device for the LUN.
+func (t Target) Login(ctx context.Context) (string, error) {
+	if len(t.Portals) > 1 && !t.Multipath {
+		return "", fmt.Errorf("multiple portals given for %s without multipath", t.IQN)
+	}
+	for _, portal := range t.Portals {
+		if err := t.loginPortal(ctx, portal); err != nil {
+			_ = t.Logout(context.WithoutCancel(ctx))
+			return "", err
+		}
+	}
+
+	var device string
+	if err := wait.PollUntilContextTimeout(ctx, 500*time.Millisecond, time.Minute, true, func(ctx context.Context) (bool, error) {
+		var err error
+		device, err = t.findDevice()
+		return err == nil && device != "", nil
+	}); err != nil {
+		_ = t.Logout(context.WithoutCancel(ctx))
+		return "", fmt.Errorf("Logged in to %s but lun %d did not appear: %w", t.IQN, t.LUN, err)
+	}
+	return device, nil
+}
+
+// Logout logs out of all sessions to the target.
+func (t Target) Logout(ctx context.Context) error {
+	var errs []error
+	for _, portal := range t.Portals {
+		if output, err := runIscsiadm(ctx, "-m", "node", "-T", t.IQN, "-p", portal, "--logout"); err != nil && !strings.Contains(output, "No matching sessions") {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (t Target) loginPortal(ctx context.Context, portal string) error {
+	if output, err := runIscsiadm(ctx, "-m", "node", "-T", t.IQN, "-p", portal, "-o", "new"); err != nil {
+		return fmt.Errorf("Could not create node record for %s at %s: %w (%s)", t.IQN, portal, err, output)
+	}
+	if t.Chap != nil {
+		settings := [][2]string{
+			{"node.session.auth.authmethod", "CHAP"},
+			{"node.session.auth.username", t.Chap.Username},
+			{"node.session.auth.password", t.Chap.Password},
+		}
+		for _, s := range settings {
+			// The error is not wrapped, as it would include the command line and so the password.
+			if _, err := runIscsiadm(ctx, "-m", "node", "-T", t.IQN, "-p", portal, "-o", "update", "-n", s[0], "-v", s[1]); err != nil {
+				return fmt.Errorf("Could not set %s for %s at %s", s[0], t.IQN, portal)
+			}
+		}
+	}
+	output, err := runIscsiadm(ctx, "-m", "node", "-T", t.IQN, "-p", portal, "--login")
+	if err != nil && !strings.Contains(output, "already present") {
+		return fmt.Errorf("Could not log in to %s at %s: %w (%s)", t.IQN, portal, err, output)
+	}
+	klog.Infof("Logged in to %s at %s", t.IQN, portal)
+	return nil
+}
+
+// findDevice returns the device for the LUN, or empty if it is not yet present.
+func (t Target) findDevice() (string, error) {
+	var devices []string
+	for _, portal := range t.Portals {
+		link := filepath.Join(byPathDir, byPathName(portal, t.IQN, t.LUN))
+		dev, err := filepath.EvalSymlinks(link)
+		if os.IsNotExist(err) {
+			return "", nil
+		} else if err != nil {
+			return "", err
+		}
+		devices = append(devices, dev)
+	}
+	if !t.Multipath {
+		return devices[0], nil
+	}
+	return multipathHolder(sysBlockDir, devices)
+}
+
+func byPathName(portal, iqn string, lun int) string {
+	return fmt.Sprintf("ip-%s-iscsi-%s-lun-%d", portal, iqn, lun)
+}
+
+// multipathHolder returns the device-mapper device holding all the given
+// devices, or empty if there is none yet.
+func multipathHolder(sysBlock string, devices []string) (string, error) {
+	var holder string
+	for _, dev := range devices {
+		entries, err := os.ReadDir(filepath.Join(sysBlock, filepath.Base(dev), "holders"))
+		if os.IsNotExist(err) {
+			return "", nil
+		} else if err != nil {
+			return "", err
+		}
+		found := ""
+		for _, e := range entries {
+			if strings.HasPrefix(e.Name(), "dm-") {
+				found = e.Name()
+				break
+			}
+		}
+		if found == "" {
+			return "", nil
+		}
+		if holder != "" && holder != found {
+			return "", fmt.Errorf("paths %v are held by different multipath devices", devices)
+		}
+		holder = found
+	}
+	return filepath.Join("/dev", holder), nil
+}
+
+// runIscsiadm returns the combined stdout and stderr, as iscsiadm reports some
+// benign conditions on stderr.
+func runIscsiadm(ctx context.Context, args ...string) (string, error) {
+	result, err := util.RunCommandContext(ctx, util.CommandOptions{}, iscsiadmCmd, args...)
+	return string(result.Stdout) + string(result.Stderr), err
+}
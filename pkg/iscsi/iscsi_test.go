@@ -0,0 +1,86 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iscsi
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestNewTarget(t *testing.T) {
+	tgt, err := NewTarget([]string{"10.0.0.1", "10.0.0.2:3261"}, "iqn.2024-01.io.example:cache", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(tgt.Portals, []string{"10.0.0.1:3260", "10.0.0.2:3261"}) {
+		t.Errorf("unexpected portals %v", tgt.Portals)
+	}
+	if _, err := NewTarget(nil, "iqn.x", 0); err == nil {
+		t.Errorf("expected error with no portals")
+	}
+}
+
+func TestByPathName(t *testing.T) {
+	got := byPathName("10.0.0.1:3260", "iqn.x:y", 2)
+	if got != "ip-10.0.0.1:3260-iscsi-iqn.x:y-lun-2" {
+		t.Errorf("unexpected by-path name %s", got)
+	}
+}
+
+func TestMultipathHolder(t *testing.T) {
+	root := t.TempDir()
+	mkHolder := func(dev, holder string) {
+		dir := filepath.Join(root, dev, "holders")
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+		if holder != "" {
+			if err := os.Mkdir(filepath.Join(dir, holder), 0755); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	mkHolder("sdb", "dm-1")
+	mkHolder("sdc", "dm-1")
+	mkHolder("sdd", "dm-2")
+	mkHolder("sde", "")
+
+	for _, tc := range []struct {
+		devices       []string
+		expected      string
+		expectedError bool
+	}{
+		{devices: []string{"/dev/sdb", "/dev/sdc"}, expected: "/dev/dm-1"},
+		{devices: []string{"/dev/sdb", "/dev/sdd"}, expectedError: true},
+		{devices: []string{"/dev/sdb", "/dev/sde"}, expected: ""},
+		{devices: []string{"/dev/sdx"}, expected: ""},
+	} {
+		holder, err := multipathHolder(root, tc.devices)
+		if tc.expectedError {
+			if err == nil {
+				t.Errorf("%v: expected error", tc.devices)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%v: unexpected error %v", tc.devices, err)
+		}
+		if holder != tc.expected {
+			t.Errorf("%v: got %q, expected %q", tc.devices, holder, tc.expected)
+		}
+	}
+}
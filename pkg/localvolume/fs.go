@@ -0,0 +1,94 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package localvolume
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+	"k8s.io/mount-utils"
+)
+
+// filesystem is the read-only view of the host used to find devices and
+// existing mounts.
+type filesystem interface {
+	ReadFile(name string) ([]byte, error)
+	Stat(name string) (fs.FileInfo, error)
+	EvalSymlinks(path string) (string, error)
+	ReadDir(name string) ([]fs.DirEntry, error)
+}
+
+// osFS is the filesystem of this process.
+type osFS struct{}
+
+var _ filesystem = osFS{}
+
+func (osFS) ReadFile(name string) ([]byte, error)       { return os.ReadFile(name) }
+func (osFS) Stat(name string) (fs.FileInfo, error)      { return os.Stat(name) }
+func (osFS) EvalSymlinks(path string) (string, error)   { return filepath.EvalSymlinks(path) }
+func (osFS) ReadDir(name string) ([]fs.DirEntry, error) { return os.ReadDir(name) }
+
+// hostFS and hostMountInfo are variables for testing.
+var (
+	hostFS        filesystem = osFS{}
+	hostMountInfo            = func() ([]mount.MountInfo, error) { return mount.ParseMountInfo(procMountInfo) }
+)
+
+// deviceNumber returns the major and minor number of the device file path.
+func deviceNumber(path string) (uint32, uint32, error) {
+	info, err := hostFS.Stat(path)
+	if err != nil {
+		return 0, 0, err
+	}
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok || info.Mode()&fs.ModeDevice == 0 {
+		return 0, 0, fmt.Errorf("%s is not a device", path)
+	}
+	return unix.Major(uint64(st.Rdev)), unix.Minor(uint64(st.Rdev)), nil
+}
+
+// unescapeMountPath undoes the octal escapes of spaces, tabs, newlines and
+// backslashes in mount points from the mount table.
+func unescapeMountPath(path string) string {
+	if !strings.Contains(path, `\`) {
+		return path
+	}
+	var b strings.Builder
+	for i := 0; i < len(path); i++ {
+		if path[i] == '\\' && i+3 < len(path) && isOctal(path[i+1:i+4]) {
+			n, _ := strconv.ParseUint(path[i+1:i+4], 8, 8)
+			b.WriteByte(byte(n))
+			i += 3
+			continue
+		}
+		b.WriteByte(path[i])
+	}
+	return b.String()
+}
+
+func isOctal(s string) bool {
+	for _, c := range s {
+		if c < '0' || c > '7' {
+			return false
+		}
+	}
+	return true
+}
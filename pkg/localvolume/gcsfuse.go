@@ -0,0 +1,152 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package localvolume
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"sync"
+	"time"
+
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/klog/v2"
+	"k8s.io/mount-utils"
+
+	"github.com/GoogleCloudPlatform/csi-node-cache/pkg/common"
+	"github.com/GoogleCloudPlatform/csi-node-cache/pkg/util"
+)
+
+const (
+	gcsfuseCmd = "/bin/gcsfuse"
+)
+
+// gcsfuseVolume is a read-through cache of a GCS bucket. The bucket is mounted
+// by a gcsfuse process owned by the driver, with its file cache on local
+// storage.
+type gcsfuseVolume struct {
+	bucket    string
+	mountPath string
+	cmd       *exec.Cmd
+
+	mutex   sync.Mutex
+	exited  bool
+	exitErr error
+}
+
+var _ LocalVolume = &gcsfuseVolume{}
+var _ HealthChecker = &gcsfuseVolume{}
+var _ Releaser = &gcsfuseVolume{}
+
+// NewGCSFuseVolume mounts bucket at mountPath with gcsfuse, using cacheDir for
+// the file cache. cacheSize limits the file cache; if zero the cache is limited
+// only by the space available in cacheDir. If keyFile is set, it is a service
+// account key used instead of the node's credentials.
+//
+// The gcsfuse process does not survive a driver restart, so a mount left over
+// from a previous driver is cleaned up and replaced.
+func NewGCSFuseVolume(ctx context.Context, bucket, mountPath, cacheDir string, cacheSize resource.Quantity, keyFile string) (LocalVolume, error) {
+	if bucket == "" {
+		return nil, common.NewVolumePendingError(fmt.Errorf("no bucket given for gcsfuse volume"))
+	}
+	for _, dir := range []string{mountPath, cacheDir} {
+		if err := os.MkdirAll(dir, 0750); err != nil {
+			return nil, fmt.Errorf("Could not use or create %s: %w", dir, err)
+		}
+	}
+	if err := mount.CleanupMountPoint(mountPath, util.Mounter(), true); err != nil {
+		return nil, fmt.Errorf("Could not clean up previous mount at %s: %w", mountPath, err)
+	}
+	if err := os.MkdirAll(mountPath, 0750); err != nil {
+		return nil, fmt.Errorf("Could not recreate %s: %w", mountPath, err)
+	}
+
+	cacheMB := int64(-1)
+	if !cacheSize.IsZero() {
+		cacheMB = cacheSize.Value() / 1024 / 1024
+	}
+	args := []string{
+		"--foreground",
+		"--implicit-dirs",
+		"--cache-dir", cacheDir,
+		"--file-cache-max-size-mb", fmt.Sprintf("%d", cacheMB),
+		"-o", "allow_other",
+	}
+	if keyFile != "" {
+		args = append(args, "--key-file", keyFile)
+	}
+	args = append(args, bucket, mountPath)
+	cmd := exec.Command(gcsfuseCmd, args...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("Could not start gcsfuse for %s: %w", bucket, err)
+	}
+	v := &gcsfuseVolume{bucket: bucket, mountPath: mountPath, cmd: cmd}
+	go v.wait()
+
+	if err := wait.PollUntilContextTimeout(ctx, 250*time.Millisecond, time.Minute, true, func(ctx context.Context) (bool, error) {
+		if err := v.processError(); err != nil {
+			return false, err
+		}
+		notMnt, err := util.Mounter().IsLikelyNotMountPoint(mountPath)
+		return err == nil && !notMnt, nil
+	}); err != nil {
+		_ = v.Release(ctx)
+		return nil, fmt.Errorf("gcsfuse mount of %s did not come up: %w", bucket, err)
+	}
+	klog.Infof("Mounted bucket %s at %s with cache in %s", bucket, mountPath, cacheDir)
+	return v, nil
+}
+
+func (v *gcsfuseVolume) wait() {
+	err := v.cmd.Wait()
+	klog.Errorf("gcsfuse for %s exited: %v", v.bucket, err)
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	v.exited = true
+	v.exitErr = err
+}
+
+// processError returns an error if the gcsfuse process has exited.
+func (v *gcsfuseVolume) processError() error {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	if v.exited {
+		return fmt.Errorf("gcsfuse process for %s exited: %v", v.bucket, v.exitErr)
+	}
+	return nil
+}
+
+func (v *gcsfuseVolume) Path() string {
+	return v.mountPath
+}
+
+// Healthy checks that the gcsfuse process is still running.
+func (v *gcsfuseVolume) Healthy() error {
+	return v.processError()
+}
+
+// Release unmounts the bucket, which causes gcsfuse to exit. The process is
+// killed if it has not already exited.
+func (v *gcsfuseVolume) Release(context.Context) error {
+	err := mount.CleanupMountPoint(v.mountPath, util.Mounter(), true)
+	if v.processError() == nil {
+		_ = v.cmd.Process.Kill()
+	}
+	return err
+}
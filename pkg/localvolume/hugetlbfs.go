@@ -0,0 +1,106 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package localvolume
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"k8s.io/klog/v2"
+
+	"github.com/GoogleCloudPlatform/csi-node-cache/pkg/util"
+)
+
+// hugepagesDir holds the node's hugepage pools. It is a variable for testing.
+var hugepagesDir = "/sys/kernel/mm/hugepages"
+
+type hugetlbfsVolume struct {
+	path string
+}
+
+var _ LocalVolume = &hugetlbfsVolume{}
+var _ Releaser = &hugetlbfsVolume{}
+
+// NewHugetlbfsVolume mounts a hugetlbfs of pages pages of pageSize bytes at
+// path. The pages are reserved from the node's pool when it is mounted, and an
+// error is returned if the pool doesn't have enough free. Files in a hugetlbfs
+// can be mapped and read but not written. If path is already a mount point it
+// is assumed to be the hugetlbfs, left by a previous driver, and is reused.
+func NewHugetlbfsVolume(ctx context.Context, path string, pageSize, pages int64) (LocalVolume, error) {
+	if pageSize <= 0 || pages <= 0 {
+		return nil, fmt.Errorf("Bad hugetlbfs of %d pages of %d bytes", pages, pageSize)
+	}
+	if err := os.MkdirAll(path, 0750); err != nil {
+		return nil, fmt.Errorf("Could not use or create %s: %w", path, err)
+	}
+	mounter := util.Mounter()
+	notMnt, err := mounter.IsLikelyNotMountPoint(path)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot check mount point %s: %w", path, err)
+	}
+	if !notMnt {
+		klog.Infof("Found hugetlbfs already mounted at %s", path)
+		return &hugetlbfsVolume{path: path}, nil
+	}
+
+	free, err := freeHugepages(pageSize)
+	if err != nil {
+		return nil, err
+	}
+	if free < pages {
+		return nil, fmt.Errorf("Only %d of the %d hugepages of %d KiB needed are free", free, pages, pageSize/1024)
+	}
+	size := pageSize * pages
+	mountOpts := []string{
+		fmt.Sprintf("pagesize=%dK", pageSize/1024),
+		fmt.Sprintf("size=%d", size),
+		// Reserve all the pages now rather than failing on a later mmap.
+		fmt.Sprintf("min_size=%d", size),
+	}
+	if err := mounter.Mount("nodev", path, "hugetlbfs", mountOpts); err != nil {
+		return nil, fmt.Errorf("Could not mount hugetlbfs at %s with %v: %w", path, mountOpts, err)
+	}
+	return &hugetlbfsVolume{path: path}, nil
+}
+
+func (v *hugetlbfsVolume) Path() string {
+	return v.path
+}
+
+// Release unmounts the hugetlbfs, returning its pages to the pool.
+func (v *hugetlbfsVolume) Release(context.Context) error {
+	return util.Mounter().Unmount(v.path)
+}
+
+// freeHugepages returns the number of free pages in the node's pool of
+// pageSize pages.
+func freeHugepages(pageSize int64) (int64, error) {
+	file := filepath.Join(hugepagesDir, fmt.Sprintf("hugepages-%dkB", pageSize/1024), "free_hugepages")
+	data, err := hostFS.ReadFile(file)
+	if os.IsNotExist(err) {
+		return 0, fmt.Errorf("The node has no pool of %d KiB hugepages", pageSize/1024)
+	} else if err != nil {
+		return 0, err
+	}
+	free, err := strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("Bad free hugepages in %s: %w", file, err)
+	}
+	return free, nil
+}
@@ -0,0 +1,55 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package localvolume
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/GoogleCloudPlatform/csi-node-cache/pkg/iscsi"
+	"github.com/GoogleCloudPlatform/csi-node-cache/pkg/util"
+)
+
+type iscsiVolume struct {
+	LocalVolume
+	target iscsi.Target
+}
+
+var _ Releaser = &iscsiVolume{}
+
+// NewISCSIVolume logs in to an iSCSI target and formats and mounts its LUN at
+// mountPath. The sessions are logged out if the mount fails.
+func NewISCSIVolume(ctx context.Context, target iscsi.Target, mountPath string) (LocalVolume, error) {
+	device, err := target.Login(ctx)
+	if err != nil {
+		return nil, err
+	}
+	vol, err := NewFromDevice(ctx, device, mountPath)
+	if err != nil {
+		if lErr := target.Logout(context.WithoutCancel(ctx)); lErr != nil {
+			return nil, fmt.Errorf("%w; cleanup also failed: %v", err, lErr)
+		}
+		return nil, err
+	}
+	return &iscsiVolume{LocalVolume: vol, target: target}, nil
+}
+
+// Release unmounts the volume and logs out of the target.
+func (v *iscsiVolume) Release(ctx context.Context) error {
+	if err := util.Mounter().Unmount(v.Path()); err != nil {
+		return fmt.Errorf("Could not unmount %s: %w", v.Path(), err)
+	}
+	return v.target.Logout(ctx)
+}
@@ -15,19 +15,34 @@
 package localvolume
 
 import (
+	"context"
 	"fmt"
 	"os"
 	"path/filepath"
 	"strings"
 
+	"k8s.io/apimachinery/pkg/api/resource"
 	"k8s.io/klog/v2"
 	"k8s.io/mount-utils"
 	"k8s.io/utils/exec"
+
+	"github.com/GoogleCloudPlatform/csi-node-cache/pkg/fault"
+	"github.com/GoogleCloudPlatform/csi-node-cache/pkg/util"
+	"github.com/GoogleCloudPlatform/csi-node-cache/pkg/vdo"
 )
 
 const (
-	fsType     = "ext4"
-	procMounts = "/proc/mounts"
+	fsType        = "ext4"
+	procMountInfo = "/proc/self/mountinfo"
+
+	// ext4BlockSize is the block size mkfs.ext4 uses for cache devices.
+	ext4BlockSize = 4096
+
+	// compressedFsType is used for compressed volumes.
+	compressedFsType = "btrfs"
+
+	// reflinkFsType is used for volumes whose files can be cloned by reflink.
+	reflinkFsType = "xfs"
 )
 
 // LocalVolume represents a local volume to the CSI node driver. It should have a
@@ -36,37 +51,248 @@ type LocalVolume interface {
 	Path() string
 }
 
+// Releaser is implemented by local volumes that hold resources beyond their
+// mount, such as a network connection, that must be released on teardown.
+type Releaser interface {
+	Release(ctx context.Context) error
+}
+
+// HealthChecker is implemented by local volumes that can fail after creation,
+// such as network filesystems. Healthy returns an error describing any problem.
+type HealthChecker interface {
+	Healthy() error
+}
+
+// Resizer is implemented by local volumes whose size can be changed in place
+// without losing their contents.
+type Resizer interface {
+	Size() resource.Quantity
+	Resize(ctx context.Context, size resource.Quantity) error
+}
+
+// CompressedVolume is implemented by local volumes that may have a
+// compressed filesystem. Compression returns the algorithm, or "" if the
+// volume is not compressed.
+type CompressedVolume interface {
+	Compression() string
+}
+
+// ReflinkVolume is implemented by local volumes that may have a filesystem
+// supporting reflinks, so that files can be cloned without copying their
+// data. Reflink returns true if it does.
+type ReflinkVolume interface {
+	Reflink() bool
+}
+
+// blockLayer is a device built on other devices, such as a raid array.
+type blockLayer interface {
+	Device() string
+	Stop(ctx context.Context) error
+}
+
+// plainDevice is a block device with nothing to stop.
+type plainDevice string
+
+func (d plainDevice) Device() string { return string(d) }
+
+func (d plainDevice) Stop(ctx context.Context) error { return nil }
+
+// Option configures a device volume.
+type Option func(*options)
+
+type options struct {
+	dedup       *vdo.Volume
+	compression string
+	reflink     bool
+	// machineType and raidChunkKiB size the stripes of local SSD arrays.
+	machineType  string
+	raidChunkKiB int
+	discard      bool
+	// formatOptions are extra mkfs.ext4 arguments.
+	formatOptions []string
+	// mirrorSpares are hot spares for mirrors, which are not used in local
+	// SSD arrays.
+	mirrorSpares []string
+	// stripe is the geometry of any array under the filesystem, passed to
+	// mkfs.ext4.
+	stripe stripeGeometry
+}
+
+// stripeGeometry describes a striped array for the filesystem.
+type stripeGeometry struct {
+	chunkKiB int
+	members  int
+}
+
+// ext4Options are the mkfs.ext4 options for the stripe, if any.
+func (g stripeGeometry) ext4Options() []string {
+	if g.chunkKiB == 0 || g.members < 2 {
+		return nil
+	}
+	stride := g.chunkKiB * 1024 / ext4BlockSize
+	return []string{"-E", fmt.Sprintf("stride=%d,stripe_width=%d", stride, stride*g.members)}
+}
+
+// xfsOptions are the mkfs.xfs options for the stripe, if any.
+func (g stripeGeometry) xfsOptions() []string {
+	if g.chunkKiB == 0 || g.members < 2 {
+		return nil
+	}
+	return []string{"-d", fmt.Sprintf("su=%dk,sw=%d", g.chunkKiB, g.members)}
+}
+
+// WithDedup puts a deduplicating VDO volume in volume group group on the
+// device before formatting, with a logical size of ratio times the device
+// size. Enabling dedup on an existing cache discards its contents.
+func WithDedup(group string, ratio float64) Option {
+	return func(o *options) {
+		o.dedup = vdo.New(group, ratio)
+	}
+}
+
+// WithCompression formats the device with btrfs, mounted with the given
+// compress option such as zstd or zstd:3. The filesystem of an existing cache
+// can't be changed, so the mount fails if it doesn't match.
+func WithCompression(compression string) Option {
+	return func(o *options) {
+		o.compression = compression
+	}
+}
+
+// WithReflink formats the device with xfs with reflinks enabled, so that
+// directories in the cache can be cloned cheaply. As with compression, the
+// filesystem of an existing cache can't be changed.
+func WithReflink() Option {
+	return func(o *options) {
+		o.reflink = true
+	}
+}
+
+// WithMachineType gives the machine type, such as c3-standard-8-lssd, used to
+// choose the chunk size of local SSD arrays.
+func WithMachineType(machineType string) Option {
+	return func(o *options) {
+		o.machineType = machineType
+	}
+}
+
+// WithRaidChunkSize sets the chunk size of local SSD arrays in KiB, rather
+// than choosing it from the machine type. It only applies when the array is
+// created.
+func WithRaidChunkSize(kib int) Option {
+	return func(o *options) {
+		o.raidChunkKiB = kib
+	}
+}
+
+// WithDiscard mounts the filesystem with the discard option, so that freed
+// blocks are trimmed as they are freed rather than by a periodic fstrim.
+func WithDiscard() Option {
+	return func(o *options) {
+		o.discard = true
+	}
+}
+
+// WithFormatOptions passes extra arguments to mkfs.ext4 when the device is
+// formatted, such as -E lazy_itable_init=0. They are not used for btrfs or
+// xfs.
+func WithFormatOptions(args []string) Option {
+	return func(o *options) {
+		o.formatOptions = args
+	}
+}
+
+// WithMirrorSpares adds hot-spare devices to mirrored caches, which replace a
+// failed member without intervention. Spares that are local SSDs are left out
+// of the local SSD array.
+func WithMirrorSpares(devices []string) Option {
+	return func(o *options) {
+		o.mirrorSpares = devices
+	}
+}
+
 // deviceVolume is a local volume from a device.
 type deviceVolume struct {
-	devicePath string
-	mountPath  string
+	devicePath  string
+	mountPath   string
+	compression string
+	reflink     bool
+	// layers are the devices under the mount, such as raid arrays, stopped in
+	// order on release.
+	layers []blockLayer
+	// stopBackground, if set, stops any background work on the arrays on release.
+	stopBackground context.CancelFunc
 }
 
 var _ LocalVolume = &deviceVolume{}
+var _ Releaser = &deviceVolume{}
+var _ CompressedVolume = &deviceVolume{}
+var _ ReflinkVolume = &deviceVolume{}
 
 // NewDeviceVolume creates a local volume from a device. The device will be
 // formatted if necessary and mounted at the specified location. If the device
-// is already mounted to mountPath, the existing mount is returned.
-func NewFromDevice(devicePath, mountPath string) (LocalVolume, error) {
-	actualDevice, err := filepath.EvalSymlinks(devicePath)
+// is already mounted to mountPath, the existing mount is returned. Formatting
+// is killed if ctx is done.
+func NewFromDevice(ctx context.Context, devicePath, mountPath string) (LocalVolume, error) {
+	vol, err := newDeviceVolume(ctx, devicePath, mountPath, options{})
+	if err != nil {
+		return nil, err
+	}
+	return vol, nil
+}
+
+// newLayeredVolume is like NewFromDevice for the first of layers. All layers
+// are stopped on release, so a mirror must come before the arrays under it.
+// Any dedup volume goes on top of the layers.
+func newLayeredVolume(ctx context.Context, mountPath string, opts []Option, layers ...blockLayer) (*deviceVolume, error) {
+	var o options
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if o.dedup != nil {
+		if err := o.dedup.Init(ctx, layers[0].Device()); err != nil {
+			return nil, err
+		}
+		layers = append([]blockLayer{o.dedup}, layers...)
+	}
+	vol, err := newDeviceVolume(ctx, layers[0].Device(), mountPath, o)
+	if err != nil {
+		return nil, err
+	}
+	vol.layers = layers
+	return vol, nil
+}
+
+func newDeviceVolume(ctx context.Context, devicePath, mountPath string, o options) (*deviceVolume, error) {
+	actualDevice, err := hostFS.EvalSymlinks(devicePath)
 	if err != nil {
 		return nil, fmt.Errorf("Cannot resolve %s: %w", devicePath, err)
 	}
-	mounts, err := os.ReadFile(procMounts)
+	major, minor, err := deviceNumber(actualDevice)
 	if err != nil {
-		return nil, fmt.Errorf("Cannot read %s: %w", procMounts, err)
+		return nil, fmt.Errorf("Cannot get device number of %s: %w", actualDevice, err)
 	}
-	for _, line := range strings.Split(string(mounts), "\n") {
-		if strings.Contains(line, mountPath) {
-			if !strings.Contains(line, actualDevice) {
-				return nil, fmt.Errorf("Already mounted, but not to expected device %s: %s", actualDevice, line)
-			}
-			klog.Infof("Found %s already mounted at %s", devicePath, mountPath)
-			return &deviceVolume{
-				devicePath,
-				mountPath,
-			}, nil
+	mounts, err := hostMountInfo()
+	if err != nil {
+		return nil, fmt.Errorf("Cannot read %s: %w", procMountInfo, err)
+	}
+	target := filepath.Clean(mountPath)
+	for _, mi := range mounts {
+		if unescapeMountPath(mi.MountPoint) != target {
+			continue
+		}
+		// Filesystems like btrfs report an anonymous device number, so fall
+		// back to the mount source.
+		if (mi.Major != int(major) || mi.Minor != int(minor)) && !sameDevice(mi.Source, actualDevice) {
+			return nil, fmt.Errorf("Already mounted, but not to expected device %s (%d:%d): %s (%d:%d)", actualDevice, major, minor, mi.Source, mi.Major, mi.Minor)
 		}
+		klog.Infof("Found %s already mounted at %s", devicePath, mountPath)
+		return &deviceVolume{
+			devicePath:  devicePath,
+			mountPath:   mountPath,
+			compression: o.compression,
+			reflink:     o.reflink,
+		}, nil
 	}
 
 	if err := os.MkdirAll(mountPath, 0750); err != nil {
@@ -74,22 +300,126 @@ func NewFromDevice(devicePath, mountPath string) (LocalVolume, error) {
 	}
 
 	mounter := &mount.SafeFormatAndMount{
-		Interface: mount.New(""),
-		Exec:      exec.New(),
+		Interface: util.Mounter(),
+		Exec:      contextExec{Interface: util.Exec(), ctx: ctx},
+	}
+	fs := fsType
+	var mountOptions []string
+	formatOptions := ext4FormatOptions(o.stripe, o.formatOptions)
+	if o.compression != "" {
+		fs = compressedFsType
+		mountOptions = []string{"compress=" + o.compression}
+		formatOptions = nil
+	} else if o.reflink {
+		fs = reflinkFsType
+		formatOptions = append([]string{"-m", "reflink=1"}, o.stripe.xfsOptions()...)
+	}
+	if o.discard {
+		mountOptions = append(mountOptions, "discard")
+	}
+	if err := fault.Check(fault.Mkfs); err != nil {
+		return nil, fmt.Errorf("cannot format %s to %s: %w", devicePath, mountPath, err)
 	}
-	if err := mounter.FormatAndMount(devicePath, mountPath, fsType, nil); err != nil {
+	if err := mounter.FormatAndMountSensitiveWithFormatOptions(devicePath, mountPath, fs, mountOptions, nil, formatOptions); err != nil {
 		return nil, fmt.Errorf("cannot format %s to %s: %w", devicePath, mountPath, err)
 	}
 	return &deviceVolume{
-		devicePath,
-		mountPath,
+		devicePath:  devicePath,
+		mountPath:   mountPath,
+		compression: o.compression,
+		reflink:     o.reflink,
 	}, nil
 }
 
+// ext4FormatOptions builds the mkfs.ext4 arguments for a filesystem on stripe
+// with the extra arguments configured for the driver. mkfs.ext4 only uses the
+// last -E, so all extended options are combined into one, where a configured
+// option replaces the one of the same name chosen for the stripe.
+func ext4FormatOptions(stripe stripeGeometry, extra []string) []string {
+	var args, names []string
+	extended := map[string]string{}
+	for _, list := range [][]string{stripe.ext4Options(), extra} {
+		for i := 0; i < len(list); i++ {
+			var value string
+			switch {
+			case list[i] == "-E" && i+1 < len(list):
+				value = list[i+1]
+				i++
+			case strings.HasPrefix(list[i], "-E") && len(list[i]) > 2:
+				value = list[i][2:]
+			default:
+				args = append(args, list[i])
+				continue
+			}
+			for _, opt := range strings.Split(value, ",") {
+				if opt == "" {
+					continue
+				}
+				name, _, _ := strings.Cut(opt, "=")
+				if _, found := extended[name]; !found {
+					names = append(names, name)
+				}
+				extended[name] = opt
+			}
+		}
+	}
+	if len(names) > 0 {
+		opts := make([]string, len(names))
+		for i, name := range names {
+			opts[i] = extended[name]
+		}
+		args = append(args, "-E", strings.Join(opts, ","))
+	}
+	return args
+}
+
+// sameDevice returns true if mounted, a device from the mount table, resolves to
+// device. Device mapper devices appear as /dev/mapper links there.
+func sameDevice(mounted, device string) bool {
+	resolved, err := hostFS.EvalSymlinks(mounted)
+	return err == nil && resolved == device
+}
+
 func (v *deviceVolume) Path() string {
 	return v.mountPath
 }
 
+func (v *deviceVolume) Compression() string {
+	return v.compression
+}
+
+func (v *deviceVolume) Reflink() bool {
+	return v.reflink
+}
+
+// Release unmounts the volume and stops any raid arrays or dedup volume under
+// it. Contents are kept, so the volume can be reassembled later.
+func (v *deviceVolume) Release(ctx context.Context) error {
+	if v.stopBackground != nil {
+		v.stopBackground()
+	}
+	if err := util.Mounter().Unmount(v.mountPath); err != nil {
+		return fmt.Errorf("Could not unmount %s: %w", v.mountPath, err)
+	}
+	for _, layer := range v.layers {
+		if err := layer.Stop(ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// contextExec runs every command with ctx, so that mkfs and friends run by
+// SafeFormatAndMount are killed when ctx is done.
+type contextExec struct {
+	exec.Interface
+	ctx context.Context
+}
+
+func (e contextExec) Command(cmd string, args ...string) exec.Cmd {
+	return e.Interface.CommandContext(e.ctx, cmd, args...)
+}
+
 // pathVolume is a local volume from a path.
 type pathVolume struct {
 	path string
@@ -99,7 +429,7 @@ var _ LocalVolume = &pathVolume{}
 
 // NewFromPath creates a local volume at a path.
 func NewFromPath(path string) (LocalVolume, error) {
-	if _, err := os.Stat(path); err != nil {
+	if _, err := hostFS.Stat(path); err != nil {
 		return nil, err
 	}
 	return &pathVolume{path: path}, nil
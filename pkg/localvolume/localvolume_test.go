@@ -0,0 +1,286 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package localvolume
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"syscall"
+	"testing"
+
+	"golang.org/x/sys/unix"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/mount-utils"
+
+	"github.com/GoogleCloudPlatform/csi-node-cache/pkg/util"
+)
+
+func TestStripeExt4Options(t *testing.T) {
+	for _, tc := range []struct {
+		stripe   stripeGeometry
+		expected []string
+	}{
+		{stripeGeometry{}, nil},
+		{stripeGeometry{chunkKiB: 512, members: 1}, nil},
+		{stripeGeometry{chunkKiB: 256, members: 4}, []string{"-E", "stride=64,stripe_width=256"}},
+		{stripeGeometry{chunkKiB: 64, members: 24}, []string{"-E", "stride=16,stripe_width=384"}},
+	} {
+		if opts := tc.stripe.ext4Options(); !slices.Equal(opts, tc.expected) {
+			t.Errorf("%+v: expected %v, got %v", tc.stripe, tc.expected, opts)
+		}
+	}
+}
+
+func TestStripeXfsOptions(t *testing.T) {
+	for _, tc := range []struct {
+		stripe   stripeGeometry
+		expected []string
+	}{
+		{stripeGeometry{}, nil},
+		{stripeGeometry{chunkKiB: 512, members: 1}, nil},
+		{stripeGeometry{chunkKiB: 256, members: 4}, []string{"-d", "su=256k,sw=4"}},
+	} {
+		if opts := tc.stripe.xfsOptions(); !slices.Equal(opts, tc.expected) {
+			t.Errorf("%+v: expected %v, got %v", tc.stripe, tc.expected, opts)
+		}
+	}
+}
+
+func TestExt4FormatOptions(t *testing.T) {
+	stripe := stripeGeometry{chunkKiB: 256, members: 4}
+	for _, tc := range []struct {
+		stripe   stripeGeometry
+		extra    []string
+		expected []string
+	}{
+		{stripeGeometry{}, nil, nil},
+		{stripeGeometry{}, []string{"-b", "4096"}, []string{"-b", "4096"}},
+		{stripe, nil, []string{"-E", "stride=64,stripe_width=256"}},
+		{
+			stripe,
+			[]string{"-E", "lazy_itable_init=0,lazy_journal_init=0", "-J", "size=64"},
+			[]string{"-J", "size=64", "-E", "stride=64,stripe_width=256,lazy_itable_init=0,lazy_journal_init=0"},
+		},
+		// Configured options replace those for the stripe, and repeats are
+		// dropped.
+		{
+			stripe,
+			[]string{"-Estride=32", "-E", "lazy_itable_init=1,lazy_itable_init=0"},
+			[]string{"-E", "stride=32,stripe_width=256,lazy_itable_init=0"},
+		},
+	} {
+		if args := ext4FormatOptions(tc.stripe, tc.extra); !slices.Equal(args, tc.expected) {
+			t.Errorf("%+v %v: expected %v, got %v", tc.stripe, tc.extra, tc.expected, args)
+		}
+	}
+}
+
+func TestTmpfsSizeOption(t *testing.T) {
+	for _, tc := range []struct {
+		size     string
+		expected string
+	}{
+		{"1Gi", "size=1024M"},
+		{"1536Mi", "size=1536M"},
+		{"1G", "size=953M"},
+	} {
+		if opt := tmpfsSizeOption(resource.MustParse(tc.size)); opt != tc.expected {
+			t.Errorf("%s: expected %s, got %s", tc.size, tc.expected, opt)
+		}
+	}
+}
+
+func TestFreeHugepages(t *testing.T) {
+	hugepagesDir = t.TempDir()
+	pool := filepath.Join(hugepagesDir, "hugepages-2048kB")
+	if err := os.MkdirAll(pool, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(pool, "free_hugepages"), []byte("512\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if free, err := freeHugepages(2 << 20); err != nil || free != 512 {
+		t.Errorf("expected 512 free 2Mi pages, got %d, %v", free, err)
+	}
+	if _, err := freeHugepages(1 << 30); err == nil {
+		t.Errorf("expected an error for a missing 1Gi pool")
+	}
+}
+
+func TestAllocateFile(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "store", "images.img")
+	if err := allocateFile(file, 1<<20); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() != 1<<20 {
+		t.Errorf("expected a 1MiB file, got %d bytes", info.Size())
+	}
+	// An existing file is kept at its size.
+	if err := allocateFile(file, 2<<20); err != nil {
+		t.Fatal(err)
+	}
+	if info, err := os.Stat(file); err != nil || info.Size() != 1<<20 {
+		t.Errorf("existing file changed: %v, %v", info, err)
+	}
+}
+
+// fakeFS resolves symlinks and stats devices from maps, and otherwise uses
+// the real filesystem.
+type fakeFS struct {
+	osFS
+	links   map[string]string
+	devices map[string]uint64
+}
+
+func (f fakeFS) EvalSymlinks(path string) (string, error) {
+	if target, found := f.links[path]; found {
+		return target, nil
+	}
+	return path, nil
+}
+
+func (f fakeFS) Stat(name string) (fs.FileInfo, error) {
+	if rdev, found := f.devices[name]; found {
+		return fakeDevice{name: name, rdev: rdev}, nil
+	}
+	return nil, fs.ErrNotExist
+}
+
+type fakeDevice struct {
+	fs.FileInfo
+	name string
+	rdev uint64
+}
+
+func (d fakeDevice) Name() string      { return filepath.Base(d.name) }
+func (d fakeDevice) Mode() fs.FileMode { return fs.ModeDevice }
+func (d fakeDevice) Sys() any          { return &syscall.Stat_t{Rdev: d.rdev} }
+
+func TestExistingDeviceMount(t *testing.T) {
+	defer func(fs filesystem, m func() ([]mount.MountInfo, error)) { hostFS, hostMountInfo = fs, m }(hostFS, hostMountInfo)
+	hostFS = fakeFS{
+		links: map[string]string{
+			"/dev/disk/by-id/google-cache": "/dev/sdb",
+			"/dev/mapper/cache":            "/dev/dm-0",
+		},
+		devices: map[string]uint64{
+			"/dev/sdb":  unix.Mkdev(8, 16),
+			"/dev/sdc":  unix.Mkdev(8, 32),
+			"/dev/dm-0": unix.Mkdev(253, 0),
+		},
+	}
+	hostMountInfo = func() ([]mount.MountInfo, error) {
+		return []mount.MountInfo{
+			{Major: 8, Minor: 16, Source: "/dev/sdb", MountPoint: `/mnt/node\040cache`},
+			{Major: 0, Minor: 52, Source: "/dev/mapper/cache", MountPoint: "/mnt/mapped"},
+			{Major: 8, Minor: 32, Source: "/dev/sdc", MountPoint: "/local/pd2"},
+		}, nil
+	}
+
+	ctx := context.Background()
+	vol, err := newDeviceVolume(ctx, "/dev/disk/by-id/google-cache", "/mnt/node cache", options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if vol.Path() != "/mnt/node cache" {
+		t.Errorf("unexpected path %s", vol.Path())
+	}
+	// An anonymous device number, as used by btrfs, falls back to the source.
+	if _, err := newDeviceVolume(ctx, "/dev/dm-0", "/mnt/mapped", options{}); err != nil {
+		t.Errorf("expected a device mapper link to match: %v", err)
+	}
+	if _, err := newDeviceVolume(ctx, "/dev/sdc", "/mnt/node cache", options{}); err == nil {
+		t.Errorf("expected an error for a mount of another device")
+	}
+}
+
+func TestUnescapeMountPath(t *testing.T) {
+	for path, expected := range map[string]string{
+		"/mnt/cache":         "/mnt/cache",
+		`/mnt/node\040cache`: "/mnt/node cache",
+		`/mnt/a\011b\134c`:   "/mnt/a\tb\\c",
+		`/mnt/trailing\04`:   `/mnt/trailing\04`,
+		`/mnt/not\999octal`:  `/mnt/not\999octal`,
+	} {
+		if actual := unescapeMountPath(path); actual != expected {
+			t.Errorf("%q: expected %q, got %q", path, expected, actual)
+		}
+	}
+}
+
+func TestCreateSparseFile(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "loop.img")
+	if err := createSparseFile(file, 1<<30); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() != 1<<30 {
+		t.Errorf("expected a 1GiB file, got %d bytes", info.Size())
+	}
+	if blocks := info.Sys().(*syscall.Stat_t).Blocks; blocks != 0 {
+		t.Errorf("expected no blocks allocated, got %d", blocks)
+	}
+}
+
+// losetupRunner answers losetup with a loop device for associated files.
+type losetupRunner struct {
+	associated map[string]string
+	commands   []string
+}
+
+func (r *losetupRunner) RunCommand(ctx context.Context, opts util.CommandOptions, cmd string, args ...string) (util.CommandResult, error) {
+	r.commands = append(r.commands, strings.Join(append([]string{cmd}, args...), " "))
+	switch args[0] {
+	case "--associated":
+		if device, found := r.associated[args[1]]; found {
+			return util.CommandResult{Stdout: []byte(device + "\n")}, nil
+		}
+		return util.CommandResult{}, nil
+	case "--find":
+		return util.CommandResult{Stdout: []byte("/dev/loop7\n")}, nil
+	}
+	return util.CommandResult{}, fmt.Errorf("unexpected %s %v", cmd, args)
+}
+
+func TestAttachLoopDevice(t *testing.T) {
+	runner := &losetupRunner{associated: map[string]string{"/var/lib/a.img": "/dev/loop3"}}
+	util.SetCommandRunner(runner)
+	defer util.SetCommandRunner(nil)
+
+	ctx := context.Background()
+	loop, err := attachLoopDevice(ctx, "/var/lib/a.img")
+	if err != nil || loop.Device() != "/dev/loop3" {
+		t.Errorf("expected the existing /dev/loop3, got %v, %v", loop, err)
+	}
+	loop, err = attachLoopDevice(ctx, "/var/lib/b.img")
+	if err != nil || loop.Device() != "/dev/loop7" {
+		t.Errorf("expected a new /dev/loop7, got %v, %v", loop, err)
+	}
+	if len(runner.commands) != 3 || runner.commands[2] != "losetup --find --show /var/lib/b.img" {
+		t.Errorf("unexpected commands %v", runner.commands)
+	}
+}
@@ -0,0 +1,113 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package localvolume
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/klog/v2"
+
+	"github.com/GoogleCloudPlatform/csi-node-cache/pkg/util"
+)
+
+const losetupCmd = "losetup"
+
+// loopDevice is a loop device backed by a file.
+type loopDevice struct {
+	file   string
+	device string
+}
+
+var _ blockLayer = &loopDevice{}
+
+func (l *loopDevice) Device() string { return l.device }
+
+// Stop detaches the loop device. The file is kept.
+func (l *loopDevice) Stop(ctx context.Context) error {
+	if _, err := util.RunCommandContext(ctx, util.CommandOptions{}, losetupCmd, "--detach", l.device); err != nil {
+		return fmt.Errorf("Could not detach %s from %s: %w", l.device, l.file, err)
+	}
+	return nil
+}
+
+// NewLoopVolume creates a volume on a loop device backed by a sparse file of
+// size, which is formatted and mounted at mountPath like any other device.
+// It is meant for testing the device path on machines without spare disks,
+// such as kind clusters. An existing file is used at its current size, and
+// an existing loop device of the file is reused.
+func NewLoopVolume(ctx context.Context, file, mountPath string, size resource.Quantity, opts ...Option) (LocalVolume, error) {
+	if size.Value() <= 0 {
+		return nil, fmt.Errorf("Bad size %v", size)
+	}
+	if err := createSparseFile(file, size.Value()); err != nil {
+		return nil, err
+	}
+	loop, err := attachLoopDevice(ctx, file)
+	if err != nil {
+		return nil, err
+	}
+	return newLayeredVolume(ctx, mountPath, opts, loop)
+}
+
+// createSparseFile creates file with a size of size bytes but no space
+// allocated, if it doesn't exist.
+func createSparseFile(file string, size int64) error {
+	if _, err := os.Stat(file); err == nil {
+		return nil
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(file), 0750); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(file, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	if err := f.Truncate(size); err != nil {
+		f.Close()
+		os.Remove(file)
+		return fmt.Errorf("Could not size %s to %d bytes: %w", file, size, err)
+	}
+	return f.Close()
+}
+
+// attachLoopDevice returns the loop device of file, setting one up if there
+// is none.
+func attachLoopDevice(ctx context.Context, file string) (*loopDevice, error) {
+	result, err := util.RunCommandContext(ctx, util.CommandOptions{}, losetupCmd, "--associated", file, "--noheadings", "--output", "NAME")
+	if err != nil {
+		return nil, fmt.Errorf("Could not find loop devices of %s: %w", file, err)
+	}
+	if fields := strings.Fields(string(result.Stdout)); len(fields) > 0 {
+		klog.Infof("Found loop device %s for %s", fields[0], file)
+		return &loopDevice{file: file, device: fields[0]}, nil
+	}
+	result, err = util.RunCommandContext(ctx, util.CommandOptions{}, losetupCmd, "--find", "--show", file)
+	if err != nil {
+		return nil, fmt.Errorf("Could not set up loop device for %s: %w", file, err)
+	}
+	device := strings.TrimSpace(string(result.Stdout))
+	if device == "" {
+		return nil, fmt.Errorf("losetup gave no loop device for %s", file)
+	}
+	klog.Infof("Set up loop device %s for %s", device, file)
+	return &loopDevice{file: file, device: device}, nil
+}
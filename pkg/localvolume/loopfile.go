@@ -0,0 +1,105 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package localvolume
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/sys/unix"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/klog/v2"
+	"k8s.io/mount-utils"
+
+	"github.com/GoogleCloudPlatform/csi-node-cache/pkg/util"
+)
+
+// loopFileVolume is a filesystem in a file, mounted through a loop device.
+type loopFileVolume struct {
+	file      string
+	mountPath string
+}
+
+var _ LocalVolume = &loopFileVolume{}
+var _ Releaser = &loopFileVolume{}
+
+// NewLoopFileVolume mounts an ext4 filesystem in file at mountPath, creating
+// and formatting the file if it doesn't exist. The space for the file is
+// allocated up front, so that it is reserved on the filesystem holding it. An
+// existing file is used at its current size.
+func NewLoopFileVolume(ctx context.Context, file, mountPath string, size resource.Quantity) (LocalVolume, error) {
+	if size.Value() <= 0 {
+		return nil, fmt.Errorf("Bad size %v", size)
+	}
+	if err := os.MkdirAll(mountPath, 0750); err != nil {
+		return nil, fmt.Errorf("Could not use or create %s: %w", mountPath, err)
+	}
+	notMnt, err := util.Mounter().IsLikelyNotMountPoint(mountPath)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot check mount at %s: %w", mountPath, err)
+	}
+	if !notMnt {
+		klog.Infof("Found %s already mounted at %s", file, mountPath)
+		return &loopFileVolume{file: file, mountPath: mountPath}, nil
+	}
+	if err := allocateFile(file, size.Value()); err != nil {
+		return nil, err
+	}
+	mounter := &mount.SafeFormatAndMount{
+		Interface: util.Mounter(),
+		Exec:      contextExec{Interface: util.Exec(), ctx: ctx},
+	}
+	if err := mounter.FormatAndMount(file, mountPath, fsType, []string{"loop"}); err != nil {
+		return nil, fmt.Errorf("cannot format %s to %s: %w", file, mountPath, err)
+	}
+	return &loopFileVolume{file: file, mountPath: mountPath}, nil
+}
+
+// allocateFile creates file with size bytes allocated, if it doesn't exist.
+func allocateFile(file string, size int64) error {
+	if _, err := os.Stat(file); err == nil {
+		return nil
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(file), 0750); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(file, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	if err := unix.Fallocate(int(f.Fd()), 0, 0, size); err != nil {
+		f.Close()
+		os.Remove(file)
+		return fmt.Errorf("Could not allocate %d bytes for %s: %w", size, file, err)
+	}
+	return f.Close()
+}
+
+func (v *loopFileVolume) Path() string {
+	return v.mountPath
+}
+
+// Release unmounts the filesystem, which frees its loop device. The file and
+// its contents are kept.
+func (v *loopFileVolume) Release(context.Context) error {
+	if err := util.Mounter().Unmount(v.mountPath); err != nil {
+		return fmt.Errorf("Could not unmount %s: %w", v.mountPath, err)
+	}
+	return nil
+}
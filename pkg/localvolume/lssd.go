@@ -15,25 +15,93 @@
 package localvolume
 
 import (
-	"io/fs"
-	"os"
+	"context"
+	"fmt"
 	"path/filepath"
+	"slices"
+	"strconv"
 	"strings"
 
+	"k8s.io/klog/v2"
+	"k8s.io/mount-utils"
+
 	"github.com/GoogleCloudPlatform/csi-node-cache/pkg/raid"
+	"github.com/GoogleCloudPlatform/csi-node-cache/pkg/util"
 )
 
 // NewLocalSSDVolume raids up all local ssd volumes and returns the formatted device.
-func NewLocalSSDVolume(raidDevice, mountPath string) (LocalVolume, error) {
-	devices, err := getLocalSSDs()
+//
+// If there are more local SSDs than members of an existing array, such as
+// after a node is recreated on a larger machine shape, the array is grown onto
+// them and the filesystem resized in the background once the reshape is done.
+func NewLocalSSDVolume(ctx context.Context, raidDevice, mountPath string, opts ...Option) (LocalVolume, error) {
+	array, stripe, err := newLocalSSDArray(ctx, raidDevice, opts)
 	if err != nil {
 		return nil, err
 	}
-	array := raid.NewStripedArray(raidDevice, devices...)
-	if err := array.Init(); err != nil {
+	vol, err := newLayeredVolume(ctx, mountPath, append(opts, withStripe(stripe)), array)
+	if err != nil {
 		return nil, err
 	}
-	return NewFromDevice(raidDevice, mountPath)
+	if len(vol.layers) > 1 {
+		// A dedup volume on the array would also need to be grown.
+		klog.V(2).Infof("Not growing %s under a dedup volume", raidDevice)
+		return vol, nil
+	}
+	grown, err := array.Grow(ctx)
+	if err != nil {
+		klog.Errorf("Could not grow %s onto new local SSDs, continuing at the current size: %v", raidDevice, err)
+	} else if grown {
+		// The reshape outlives the request creating the volume.
+		bgCtx, cancel := context.WithCancel(context.Background())
+		vol.stopBackground = cancel
+		go resizeWhenReshaped(bgCtx, array, vol)
+	}
+	return vol, nil
+}
+
+// resizeWhenReshaped resizes the filesystem of vol to fill array once it has
+// been reshaped, unless ctx is done first.
+func resizeWhenReshaped(ctx context.Context, array raid.StripedArray, vol *deviceVolume) {
+	if err := array.WaitForReshape(ctx); err != nil {
+		klog.Errorf("Gave up waiting for %s to reshape: %v", array.Device(), err)
+		return
+	}
+	if _, err := mount.NewResizeFs(util.Exec()).Resize(vol.devicePath, vol.mountPath); err != nil {
+		klog.Errorf("Could not resize %s after growing %s: %v", vol.mountPath, array.Device(), err)
+		return
+	}
+	klog.Infof("Resized %s after growing %s", vol.mountPath, array.Device())
+}
+
+// newLocalSSDArray stripes all local SSDs, with a chunk size from opts.
+func newLocalSSDArray(ctx context.Context, raidDevice string, opts []Option) (raid.StripedArray, stripeGeometry, error) {
+	var o options
+	for _, opt := range opts {
+		opt(&o)
+	}
+	devices, err := getLocalSSDs()
+	if err != nil {
+		return nil, stripeGeometry{}, err
+	}
+	devices = slices.DeleteFunc(devices, func(d string) bool { return slices.Contains(o.mirrorSpares, d) })
+	stripe := stripeGeometry{chunkKiB: o.raidChunkKiB, members: len(devices)}
+	if stripe.chunkKiB == 0 {
+		stripe.chunkKiB = raid.StripeChunkKiB(o.machineType, len(devices))
+	}
+	klog.V(2).Infof("Striping %d local SSDs on %q with %dKiB chunks", len(devices), o.machineType, stripe.chunkKiB)
+	array := raid.NewStripedArray(raidDevice, devices, raid.ChunkSize(stripe.chunkKiB))
+	if err := array.Init(ctx); err != nil {
+		return nil, stripeGeometry{}, err
+	}
+	return array, stripe, nil
+}
+
+// withStripe sets the geometry used when formatting.
+func withStripe(stripe stripeGeometry) Option {
+	return func(o *options) {
+		o.stripe = stripe
+	}
 }
 
 func getLocalSSDs() ([]string, error) {
@@ -84,7 +152,7 @@ func getLocalSSDs() ([]string, error) {
 	//
 	// So we'll use /dev/disk/by-id/google-local-ssd-block*
 
-	entries, err := fs.ReadDir(os.DirFS("/dev/disk"), "by-id")
+	entries, err := hostFS.ReadDir("/dev/disk/by-id")
 	if err != nil {
 		return nil, err
 	}
@@ -96,3 +164,39 @@ func getLocalSSDs() ([]string, error) {
 	}
 	return devices, nil
 }
+
+// LocalSSDCapacity returns the number of local SSDs on the node and their
+// total size in bytes.
+func LocalSSDCapacity() (int, int64, error) {
+	devices, err := getLocalSSDs()
+	if err != nil {
+		return 0, 0, err
+	}
+	var total int64
+	for _, device := range devices {
+		size, err := blockDeviceSize(device)
+		if err != nil {
+			return 0, 0, err
+		}
+		total += size
+	}
+	return len(devices), total, nil
+}
+
+// blockDeviceSize returns the size of a block device in bytes, from the
+// count of 512-byte sectors in sysfs.
+func blockDeviceSize(device string) (int64, error) {
+	resolved, err := hostFS.EvalSymlinks(device)
+	if err != nil {
+		return 0, fmt.Errorf("Cannot resolve %s: %w", device, err)
+	}
+	data, err := hostFS.ReadFile(filepath.Join("/sys/class/block", filepath.Base(resolved), "size"))
+	if err != nil {
+		return 0, err
+	}
+	sectors, err := strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("bad size of %s: %w", device, err)
+	}
+	return sectors * 512, nil
+}
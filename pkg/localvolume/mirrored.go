@@ -0,0 +1,146 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package localvolume
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/klog/v2"
+
+	"github.com/GoogleCloudPlatform/csi-node-cache/pkg/common"
+	"github.com/GoogleCloudPlatform/csi-node-cache/pkg/raid"
+)
+
+const (
+	pdAttachPollInterval = 5 * time.Second
+	mirrorHealthTimeout  = 30 * time.Second
+)
+
+// mirroredVolume is a device volume on a mirror, which checks the health of
+// the mirror.
+type mirroredVolume struct {
+	*deviceVolume
+	mirror raid.MirrorArray
+}
+
+var _ HealthChecker = &mirroredVolume{}
+
+// NewMirroredVolume mirrors an attached PD with the raided local SSDs. The PD
+// is write-mostly, so reads are served from local SSD while every write also
+// goes to the PD.
+//
+// Local SSD contents are lost when a node is recreated, but the PD keeps its
+// raid superblock, so the mirror is reassembled from the PD and rebuilt onto
+// the new local SSD array.
+//
+// pdDevice returns the PD device, or a pending error if it is not yet
+// attached. If degradedStart is set and the PD is pending, the mirror is
+// started from local SSD alone and the PD is added in the background once it
+// appears. Any previous PD contents are discarded in that case, as the PD is
+// rebuilt from the new local SSD array.
+func NewMirroredVolume(ctx context.Context, pdDevice func() (string, error), lssdDevice, mirrorDevice, mountPath string, degradedStart bool, opts ...Option) (LocalVolume, error) {
+	var o options
+	for _, opt := range opts {
+		opt(&o)
+	}
+	pd, err := pdDevice()
+	var pending *common.VolumePendingError
+	if err != nil && !(degradedStart && errors.As(err, &pending)) {
+		return nil, err
+	}
+	lssd, stripe, err := newLocalSSDArray(ctx, lssdDevice, opts)
+	if err != nil {
+		return nil, err
+	}
+	opts = append(opts, withStripe(stripe))
+
+	if pd == "" {
+		mirror := raid.NewMirrorArray(mirrorDevice, lssdDevice, nil, raid.Spares(o.mirrorSpares...))
+		if err := mirror.InitDegraded(ctx, 1); err != nil {
+			return nil, err
+		}
+		vol, err := newLayeredVolume(ctx, mountPath, opts, mirror, lssd)
+		if err != nil {
+			return nil, err
+		}
+		klog.Warningf("PD for %s not yet attached, starting degraded from local SSD", mirrorDevice)
+		// The hot-add outlives the request creating the volume.
+		bgCtx, cancel := context.WithCancel(context.Background())
+		vol.stopBackground = cancel
+		go addPDWhenAttached(bgCtx, mirrorDevice, pdDevice)
+		return &mirroredVolume{vol, mirror}, nil
+	}
+
+	mirror := raid.NewMirrorArray(mirrorDevice, pd, []string{lssdDevice}, raid.WriteMostly(pd), raid.Spares(o.mirrorSpares...))
+	if err := mirror.Init(ctx); err != nil {
+		return nil, err
+	}
+	// A previous degraded start may have been interrupted before the PD was
+	// added, in which case the running array was assembled without it.
+	if err := mirror.AddMember(ctx, pd); err != nil {
+		return nil, err
+	}
+	vol, err := newLayeredVolume(ctx, mountPath, opts, mirror, lssd)
+	if err != nil {
+		return nil, err
+	}
+	return &mirroredVolume{vol, mirror}, nil
+}
+
+// Healthy removes failed members from the mirror once a spare has replaced
+// them. A failed member with no spare to rebuild onto means the cache has lost
+// its redundancy, which is an error.
+func (v *mirroredVolume) Healthy() error {
+	ctx, cancel := context.WithTimeout(context.Background(), mirrorHealthTimeout)
+	defer cancel()
+	health, err := v.mirror.Health(ctx)
+	if err != nil {
+		return err
+	}
+	if len(health.Failed) == 0 {
+		return nil
+	}
+	if health.Degraded && !health.Rebuilding {
+		return fmt.Errorf("mirror %s has failed members %v and no spare", v.mirror.Device(), health.Failed)
+	}
+	if _, err := v.mirror.RemoveFailed(ctx); err != nil {
+		return err
+	}
+	return nil
+}
+
+// addPDWhenAttached polls for the PD and hot-adds it to the degraded mirror
+// as a write-mostly member, until ctx is done.
+func addPDWhenAttached(ctx context.Context, mirrorDevice string, pdDevice func() (string, error)) {
+	err := wait.PollUntilContextCancel(ctx, pdAttachPollInterval, true, func(ctx context.Context) (bool, error) {
+		pd, err := pdDevice()
+		if err != nil {
+			klog.V(6).Infof("PD for %s not yet available: %v", mirrorDevice, err)
+			return false, nil
+		}
+		if err := raid.NewMirrorArray(mirrorDevice, pd, nil, raid.WriteMostly(pd)).AddMember(ctx, pd); err != nil {
+			klog.Errorf("Could not add PD %s to %s, retrying: %v", pd, mirrorDevice, err)
+			return false, nil
+		}
+		return true, nil
+	})
+	if err != nil {
+		klog.Errorf("Gave up adding PD to %s: %v", mirrorDevice, err)
+	}
+}
@@ -0,0 +1,96 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package localvolume
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"k8s.io/klog/v2"
+
+	"github.com/GoogleCloudPlatform/csi-node-cache/pkg/common"
+	"github.com/GoogleCloudPlatform/csi-node-cache/pkg/util"
+)
+
+const (
+	nfsHealthTimeout = 5 * time.Second
+)
+
+// nfsVolume is a local volume from an NFS export, such as a Filestore share.
+type nfsVolume struct {
+	source    string
+	mountPath string
+}
+
+var _ LocalVolume = &nfsVolume{}
+var _ HealthChecker = &nfsVolume{}
+var _ Releaser = &nfsVolume{}
+
+// NewNFSVolume mounts server:export at mountPath with the given mount
+// options. If mountPath is already a mount point it is assumed to be the
+// export and is reused.
+func NewNFSVolume(server, export, mountPath string, options []string) (LocalVolume, error) {
+	if server == "" || export == "" {
+		return nil, common.NewVolumePendingError(fmt.Errorf("both server and export are required for an nfs volume, got %q and %q", server, export))
+	}
+	source := fmt.Sprintf("%s:%s", server, export)
+
+	if err := os.MkdirAll(mountPath, 0750); err != nil {
+		return nil, fmt.Errorf("Couldn't create mount point: %w", err)
+	}
+	mounter := util.Mounter()
+	notMnt, err := mounter.IsLikelyNotMountPoint(mountPath)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot check mount point %s: %w", mountPath, err)
+	}
+	if !notMnt {
+		klog.Infof("Found %s already mounted at %s", source, mountPath)
+		return &nfsVolume{source: source, mountPath: mountPath}, nil
+	}
+	if err := mounter.Mount(source, mountPath, "nfs", options); err != nil {
+		return nil, fmt.Errorf("Could not mount %s at %s with %v: %w", source, mountPath, options, err)
+	}
+	return &nfsVolume{source: source, mountPath: mountPath}, nil
+}
+
+func (v *nfsVolume) Path() string {
+	return v.mountPath
+}
+
+// Healthy checks that the export responds. A hung NFS server will block a
+// stat indefinitely, so the check is abandoned after a timeout.
+func (v *nfsVolume) Healthy() error {
+	done := make(chan error, 1)
+	go func() {
+		_, err := os.Stat(v.mountPath)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			return fmt.Errorf("nfs volume %s unhealthy: %w", v.source, err)
+		}
+		return nil
+	case <-time.After(nfsHealthTimeout):
+		return fmt.Errorf("nfs volume %s did not respond within %v", v.source, nfsHealthTimeout)
+	}
+}
+
+// Release unmounts the export.
+func (v *nfsVolume) Release(context.Context) error {
+	return util.Mounter().Unmount(v.mountPath)
+}
@@ -0,0 +1,61 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package localvolume
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/GoogleCloudPlatform/csi-node-cache/pkg/common"
+	"github.com/GoogleCloudPlatform/csi-node-cache/pkg/nvmeof"
+	"github.com/GoogleCloudPlatform/csi-node-cache/pkg/util"
+)
+
+type nvmeofVolume struct {
+	LocalVolume
+	target nvmeof.Target
+}
+
+var _ Releaser = &nvmeofVolume{}
+
+// NewNVMeoFVolume connects to an NVMe over fabrics target and formats and
+// mounts its first namespace at mountPath. The connection is dropped if the
+// mount fails.
+func NewNVMeoFVolume(ctx context.Context, address, nqn, mountPath string) (LocalVolume, error) {
+	target, err := nvmeof.NewTarget(address, nqn)
+	if err != nil {
+		return nil, common.NewVolumePendingError(err)
+	}
+	device, err := target.Connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	vol, err := NewFromDevice(ctx, device, mountPath)
+	if err != nil {
+		if dErr := target.Disconnect(context.WithoutCancel(ctx)); dErr != nil {
+			return nil, fmt.Errorf("%w; cleanup also failed: %v", err, dErr)
+		}
+		return nil, err
+	}
+	return &nvmeofVolume{LocalVolume: vol, target: target}, nil
+}
+
+// Release unmounts the volume and disconnects from the target.
+func (v *nvmeofVolume) Release(ctx context.Context) error {
+	if err := util.Mounter().Unmount(v.Path()); err != nil {
+		return fmt.Errorf("Could not unmount %s: %w", v.Path(), err)
+	}
+	return v.target.Disconnect(ctx)
+}
@@ -15,6 +15,7 @@
 package localvolume
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"os"
@@ -22,14 +23,28 @@ import (
 	"github.com/GoogleCloudPlatform/csi-node-cache/pkg/common"
 )
 
-func NewPDVolume(diskName, mountPath string) (LocalVolume, error) {
+func NewPDVolume(ctx context.Context, diskName, mountPath string, opts ...Option) (LocalVolume, error) {
+	device, err := AttachedPDDevice(diskName)
+	if err != nil {
+		return nil, err
+	}
+	vol, err := newLayeredVolume(ctx, mountPath, opts, plainDevice(device))
+	if err != nil {
+		return nil, err
+	}
+	return vol, nil
+}
+
+// AttachedPDDevice returns the device for an attached PD, or a pending error
+// if it is not yet attached.
+func AttachedPDDevice(diskName string) (string, error) {
 	if diskName == "" {
-		return nil, common.NewVolumePendingError(fmt.Errorf("empty disk name"))
+		return "", common.NewVolumePendingError(fmt.Errorf("empty disk name"))
 	}
 	// This assumes the disk has been attached to the node with the device name that's the same as the disk name.
 	device := fmt.Sprintf("/dev/disk/by-id/google-%s", diskName)
-	if _, err := os.Stat(device); errors.Is(err, os.ErrNotExist) {
-		return nil, common.NewVolumePendingError(fmt.Errorf("Waiting for attach, %s does not yet exist", device))
+	if _, err := hostFS.Stat(device); errors.Is(err, os.ErrNotExist) {
+		return "", common.NewVolumePendingError(fmt.Errorf("Waiting for attach, %s does not yet exist", device))
 	}
-	return NewFromDevice(device, mountPath)
+	return device, nil
 }
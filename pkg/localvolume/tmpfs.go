@@ -21,14 +21,18 @@ import (
 
 	"k8s.io/apimachinery/pkg/api/resource"
 	"k8s.io/mount-utils"
-	"k8s.io/utils/exec"
+
+	"github.com/GoogleCloudPlatform/csi-node-cache/pkg/util"
 )
 
 type tmpfsVolume struct {
 	path string
+	size resource.Quantity
 }
 
 var _ LocalVolume = &tmpfsVolume{}
+var _ Releaser = &tmpfsVolume{}
+var _ Resizer = &tmpfsVolume{}
 
 // NewTmpfsVolume makes a new ram volume based on a tmpfs mounted to path.  The
 // tmpfs creation happens at the time of this call, and an error will be
@@ -44,13 +48,13 @@ func NewTmpfsVolume(ctx context.Context, path string, size resource.Quantity) (L
 	}
 
 	mountOpts := []string{
-		fmt.Sprintf("size=%dM", int64(size.AsApproximateFloat64()/1024/1024)),
+		tmpfsSizeOption(size),
 		fmt.Sprintf("huge=always"),
 	}
 
 	mounter := &mount.SafeFormatAndMount{
-		Interface: mount.New(""),
-		Exec:      exec.New(),
+		Interface: util.Mounter(),
+		Exec:      util.Exec(),
 	}
 	if err := mounter.Mount("tmpfs", path, "tmpfs", mountOpts); err != nil {
 		return nil, fmt.Errorf("Could not mount at %s with %v: %w", path, mountOpts, err)
@@ -58,6 +62,7 @@ func NewTmpfsVolume(ctx context.Context, path string, size resource.Quantity) (L
 
 	return &tmpfsVolume{
 		path: path,
+		size: size,
 	}, nil
 
 }
@@ -65,3 +70,31 @@ func NewTmpfsVolume(ctx context.Context, path string, size resource.Quantity) (L
 func (v *tmpfsVolume) Path() string {
 	return v.path
 }
+
+func (v *tmpfsVolume) Size() resource.Quantity {
+	return v.size
+}
+
+// Resize remounts the tmpfs with a new size, keeping its contents. The kernel
+// refuses to shrink it below the space in use.
+func (v *tmpfsVolume) Resize(ctx context.Context, size resource.Quantity) error {
+	if size.IsZero() {
+		return fmt.Errorf("Bad size %v", size)
+	}
+	mountOpts := []string{"remount", tmpfsSizeOption(size)}
+	if err := util.Mounter().Mount("tmpfs", v.path, "tmpfs", mountOpts); err != nil {
+		return fmt.Errorf("Could not remount %s with %v: %w", v.path, mountOpts, err)
+	}
+	v.size = size
+	return nil
+}
+
+// tmpfsSizeOption is the mount option for a tmpfs of size, in MiB.
+func tmpfsSizeOption(size resource.Quantity) string {
+	return fmt.Sprintf("size=%dM", int64(size.AsApproximateFloat64()/1024/1024))
+}
+
+// Release unmounts the tmpfs, discarding its contents.
+func (v *tmpfsVolume) Release(context.Context) error {
+	return util.Mounter().Unmount(v.path)
+}
@@ -0,0 +1,131 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nvmeof
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/klog/v2"
+
+	"github.com/GoogleCloudPlatform/csi-node-cache/pkg/util"
+)
+
+const (
+	nvmeCmd       = "/bin/nvme"
+	subsystemRoot = "/sys/class/nvme-subsystem"
+
+	defaultTransport = "tcp"
+	defaultPort      = "4420"
+)
+
+var (
+	namespaceName = regexp.MustCompile(`^nvme[0-9]+n[0-9]+$`)
+)
+
+// Target is an NVMe over fabrics target.
+type Target struct {
+	Transport string
+	Host      string
+	Port      string
+	NQN       string
+}
+
+// NewTarget creates a tcp target from an address of the form host[:port] and
+// a subsystem NQN.
+func NewTarget(address, nqn string) (Target, error) {
+	if address == "" || nqn == "" {
+		return Target{}, fmt.Errorf("both address and nqn are required for an nvme-of target, got %q and %q", address, nqn)
+	}
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		host = address
+		port = defaultPort
+	}
+	return Target{
+		Transport: defaultTransport,
+		Host:      host,
+		Port:      port,
+		NQN:       nqn,
+	}, nil
+}
+
+// Connect connects to the target if necessary, and returns the block device
+// for its first namespace.
+func (t Target) Connect(ctx context.Context) (string, error) {
+	if device, err := findDevice(subsystemRoot, t.NQN); err == nil && device != "" {
+		klog.Infof("Found %s already connected at %s", t.NQN, device)
+		return device, nil
+	}
+	if _, err := util.RunCommandContext(ctx, util.CommandOptions{}, nvmeCmd, "connect", "-t", t.Transport, "-a", t.Host, "-s", t.Port, "-n", t.NQN); err != nil {
+		return "", fmt.Errorf("Could not connect to %s at %s:%s: %w", t.NQN, t.Host, t.Port, err)
+	}
+	var device string
+	if err := wait.PollUntilContextTimeout(ctx, 500*time.Millisecond, time.Minute, true, func(ctx context.Context) (bool, error) {
+		var err error
+		device, err = findDevice(subsystemRoot, t.NQN)
+		if err != nil {
+			return false, err
+		}
+		return device != "", nil
+	}); err != nil {
+		_ = t.Disconnect(context.WithoutCancel(ctx))
+		return "", fmt.Errorf("Connected to %s but no namespace appeared: %w", t.NQN, err)
+	}
+	return device, nil
+}
+
+// Disconnect disconnects all controllers for the target.
+func (t Target) Disconnect(ctx context.Context) error {
+	if _, err := util.RunCommandContext(ctx, util.CommandOptions{}, nvmeCmd, "disconnect", "-n", t.NQN); err != nil {
+		return fmt.Errorf("Could not disconnect %s: %w", t.NQN, err)
+	}
+	return nil
+}
+
+// findDevice looks through the nvme subsystems in sysfs for one with the given
+// NQN, and returns the device for its first namespace. An empty device is
+// returned if the subsystem or namespace is not (yet) present.
+func findDevice(root, nqn string) (string, error) {
+	subsystems, err := os.ReadDir(root)
+	if os.IsNotExist(err) {
+		return "", nil
+	} else if err != nil {
+		return "", err
+	}
+	for _, s := range subsystems {
+		data, err := os.ReadFile(filepath.Join(root, s.Name(), "subsysnqn"))
+		if err != nil || strings.TrimSpace(string(data)) != nqn {
+			continue
+		}
+		entries, err := os.ReadDir(filepath.Join(root, s.Name()))
+		if err != nil {
+			return "", err
+		}
+		for _, e := range entries {
+			if namespaceName.MatchString(e.Name()) {
+				return filepath.Join("/dev", e.Name()), nil
+			}
+		}
+	}
+	return "", nil
+}
@@ -0,0 +1,79 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nvmeof
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestNewTarget(t *testing.T) {
+	tgt, err := NewTarget("10.0.0.1:4421", "nqn.a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tgt.Host != "10.0.0.1" || tgt.Port != "4421" || tgt.Transport != "tcp" || tgt.NQN != "nqn.a" {
+		t.Errorf("unexpected target %+v", tgt)
+	}
+	tgt, err = NewTarget("10.0.0.1", "nqn.a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tgt.Port != "4420" {
+		t.Errorf("expected default port, got %+v", tgt)
+	}
+	if _, err := NewTarget("", "nqn.a"); err == nil {
+		t.Errorf("expected error on empty address")
+	}
+}
+
+func TestFindDevice(t *testing.T) {
+	root := t.TempDir()
+	mkSubsys := func(name, nqn string, entries ...string) {
+		dir := filepath.Join(root, name)
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, "subsysnqn"), []byte(nqn+"\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		for _, e := range entries {
+			if err := os.Mkdir(filepath.Join(dir, e), 0755); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	mkSubsys("nvme-subsys0", "nqn.boot", "nvme0", "nvme0n1")
+	mkSubsys("nvme-subsys1", "nqn.cache", "nvme1", "nvme1n1")
+	mkSubsys("nvme-subsys2", "nqn.pending", "nvme2")
+
+	for _, tc := range []struct {
+		nqn      string
+		expected string
+	}{
+		{"nqn.cache", "/dev/nvme1n1"},
+		{"nqn.pending", ""},
+		{"nqn.unknown", ""},
+	} {
+		device, err := findDevice(root, tc.nqn)
+		if err != nil {
+			t.Errorf("%s: unexpected error %v", tc.nqn, err)
+		}
+		if device != tc.expected {
+			t.Errorf("%s: got %q, expected %q", tc.nqn, device, tc.expected)
+		}
+	}
+}
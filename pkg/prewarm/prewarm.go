@@ -0,0 +1,404 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package prewarm fills a cache from GCS. Objects are downloaded as chunks by
+// parallel streams, so that many small objects or a few large ones can both
+// saturate local SSD, and are checked against their CRC32C before being moved
+// into place. Completed objects are recorded in the cache, so a prewarm
+// interrupted by a driver restart resumes where it left off.
+package prewarm
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"k8s.io/klog/v2"
+
+	"github.com/GoogleCloudPlatform/csi-node-cache/pkg/budget"
+	"github.com/GoogleCloudPlatform/csi-node-cache/pkg/gcs"
+	"github.com/GoogleCloudPlatform/csi-node-cache/pkg/util"
+)
+
+const (
+	DefaultConcurrency = 16
+	DefaultChunkSize   = 16 << 20
+
+	// StateFile records the objects already downloaded, relative to the
+	// prewarmed directory.
+	StateFile = ".prewarm-state.json"
+	// PartialSuffix marks files being downloaded.
+	PartialSuffix = ".prewarm-partial"
+)
+
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
+// Source lists and reads objects. It is implemented by gcs.Client.
+type Source interface {
+	List(ctx context.Context, loc gcs.Location) ([]gcs.Object, error)
+	ReadRange(ctx context.Context, bucket string, obj gcs.Object, offset, length int64) (io.ReadCloser, error)
+}
+
+// Options tune a prewarm. Zero values use the defaults.
+type Options struct {
+	// Concurrency is the number of chunks downloaded at once.
+	Concurrency int
+	// ChunkSize is the size of each ranged read.
+	ChunkSize int64
+	// Shard, if set, limits the prewarm to the objects in the shard, by
+	// their path relative to the location prefix.
+	Shard Shard
+	// Budget, if set, limits the rate chunks are read at.
+	Budget *budget.Budget
+}
+
+// Stats summarize a prewarm.
+type Stats struct {
+	// Downloaded objects and their total size.
+	Objects int
+	Bytes   int64
+	// Skipped objects were already downloaded by a previous prewarm.
+	Skipped int
+}
+
+// state is persisted in StateFile.
+type state struct {
+	// Done maps object names to the generation downloaded.
+	Done map[string]int64 `json:"done"`
+	// Complete is set by MarkComplete, and cleared when a prewarm starts.
+	Complete bool `json:"complete,omitempty"`
+}
+
+// download is an object being downloaded.
+type download struct {
+	obj gcs.Object
+	// rel is the path of the object relative to the prewarmed directory.
+	rel  string
+	file *os.File
+
+	// remaining is the number of chunks not yet written, guarded by the
+	// prewarmer mutex.
+	remaining int
+}
+
+type chunk struct {
+	dl     *download
+	offset int64
+	length int64
+}
+
+type prewarmer struct {
+	src       Source
+	bucket    string
+	dir       string
+	chunkSize int64
+	shard     Shard
+	budget    *budget.Budget
+
+	mutex sync.Mutex
+	state state
+	stats Stats
+	err   error
+}
+
+// Run downloads the objects under from into dir, with object names relative
+// to the location prefix as paths. Objects already downloaded at the same
+// generation are skipped.
+func Run(ctx context.Context, src Source, from gcs.Location, dir string, opts Options) (Stats, error) {
+	if opts.Concurrency <= 0 {
+		opts.Concurrency = DefaultConcurrency
+	}
+	if opts.ChunkSize <= 0 {
+		opts.ChunkSize = DefaultChunkSize
+	}
+	objects, err := src.List(ctx, from)
+	if err != nil {
+		return Stats{}, err
+	}
+	p := &prewarmer{src: src, bucket: from.Bucket, dir: dir, chunkSize: opts.ChunkSize, shard: opts.Shard, budget: opts.Budget}
+	if p.state, err = loadState(dir); err != nil {
+		return Stats{}, err
+	}
+	if p.state.Complete {
+		p.state.Complete = false
+		if err := saveState(dir, p.state); err != nil {
+			return Stats{}, err
+		}
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	chunks := make(chan chunk)
+	var wg sync.WaitGroup
+	for i := 0; i < opts.Concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for c := range chunks {
+				if err := p.fetch(ctx, c); err != nil {
+					p.fail(fmt.Errorf("prewarm of %s failed: %w", c.dl.obj.Name, err))
+					cancel()
+				}
+			}
+		}()
+	}
+
+	var started []*download
+	for _, obj := range objects {
+		if ctx.Err() != nil {
+			break
+		}
+		dl, err := p.start(obj, from.Prefix)
+		if err != nil {
+			p.fail(fmt.Errorf("prewarm of %s failed: %w", obj.Name, err))
+			break
+		}
+		if dl == nil {
+			continue
+		}
+		started = append(started, dl)
+		if dl.remaining == 0 {
+			// Empty objects have no chunks to fetch.
+			if err := p.finish(dl); err != nil {
+				p.fail(fmt.Errorf("prewarm of %s failed: %w", obj.Name, err))
+				break
+			}
+			continue
+		}
+		for offset := int64(0); offset < obj.Size; offset += p.chunkSize {
+			select {
+			case chunks <- chunk{dl: dl, offset: offset, length: min(p.chunkSize, obj.Size-offset)}:
+			case <-ctx.Done():
+			}
+		}
+	}
+	close(chunks)
+	wg.Wait()
+
+	// Downloads cut short by an error are left for the next prewarm.
+	for _, dl := range started {
+		if dl.remaining > 0 {
+			dl.file.Close()
+		}
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.err == nil && ctx.Err() != nil {
+		p.err = ctx.Err()
+	}
+	return p.stats, p.err
+}
+
+// start prepares a download of obj, returning nil if it should be skipped.
+func (p *prewarmer) start(obj gcs.Object, prefix string) (*download, error) {
+	rel := obj.Name
+	if prefix != "" {
+		rel = strings.TrimPrefix(rel, prefix+"/")
+	}
+	if rel == "" || strings.HasSuffix(rel, "/") {
+		// Directory placeholders.
+		return nil, nil
+	}
+	if !filepath.IsLocal(rel) {
+		klog.Warningf("Skipping prewarm of %s, which is not a local path", obj.Name)
+		return nil, nil
+	}
+	if !p.shard.Contains(rel) {
+		return nil, nil
+	}
+	rel = filepath.FromSlash(rel)
+
+	p.mutex.Lock()
+	generation, done := p.state.Done[obj.Name]
+	p.mutex.Unlock()
+	if done && generation == obj.Generation && p.present(rel, obj.Size) {
+		p.mutex.Lock()
+		p.stats.Skipped++
+		p.mutex.Unlock()
+		return nil, nil
+	}
+
+	// Pods using the cache can write to it, so paths are opened without
+	// following symlinks, which could otherwise lead outside of the cache.
+	if err := util.MkdirAllBeneath(p.dir, filepath.Dir(rel), 0750); err != nil {
+		return nil, err
+	}
+	file, err := util.OpenBeneath(p.dir, rel+PartialSuffix, os.O_CREATE|os.O_TRUNC|os.O_RDWR, 0640)
+	if err != nil {
+		return nil, err
+	}
+	if err := file.Truncate(obj.Size); err != nil {
+		file.Close()
+		return nil, err
+	}
+	remaining := int((obj.Size + p.chunkSize - 1) / p.chunkSize)
+	return &download{obj: obj, rel: rel, file: file, remaining: remaining}, nil
+}
+
+// present returns true if rel is a regular file of the given size.
+func (p *prewarmer) present(rel string, size int64) bool {
+	file, err := util.OpenBeneath(p.dir, rel, os.O_RDONLY, 0)
+	if err != nil {
+		return false
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	return err == nil && info.Mode().IsRegular() && info.Size() == size
+}
+
+// fetch downloads a chunk, finishing the download if it is the last.
+func (p *prewarmer) fetch(ctx context.Context, c chunk) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if err := p.budget.Wait(ctx, c.length); err != nil {
+		return err
+	}
+	r, err := p.src.ReadRange(ctx, p.bucket, c.dl.obj, c.offset, c.length)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	n, err := io.Copy(io.NewOffsetWriter(c.dl.file, c.offset), io.LimitReader(r, c.length))
+	if err != nil {
+		return err
+	}
+	if n != c.length {
+		return fmt.Errorf("short read at %d, got %d of %d bytes", c.offset, n, c.length)
+	}
+
+	p.mutex.Lock()
+	c.dl.remaining--
+	last := c.dl.remaining == 0
+	p.mutex.Unlock()
+	if last {
+		return p.finish(c.dl)
+	}
+	return nil
+}
+
+// finish verifies a complete download, moves it into place and records it.
+func (p *prewarmer) finish(dl *download) error {
+	defer dl.file.Close()
+	if _, err := dl.file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	hash := crc32.New(crc32cTable)
+	if _, err := io.Copy(hash, dl.file); err != nil {
+		return err
+	}
+	if sum := hash.Sum32(); sum != dl.obj.CRC32C {
+		return fmt.Errorf("checksum mismatch, got %08x expected %08x", sum, dl.obj.CRC32C)
+	}
+	if err := util.RenameBeneath(p.dir, dl.rel+PartialSuffix, dl.rel); err != nil {
+		return err
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.state.Done[dl.obj.Name] = dl.obj.Generation
+	p.stats.Objects++
+	p.stats.Bytes += dl.obj.Size
+	return saveState(p.dir, p.state)
+}
+
+// fail records the first error.
+func (p *prewarmer) fail(err error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.err == nil {
+		p.err = err
+	}
+}
+
+// Completed returns the objects recorded as downloaded into dir by previous
+// prewarms, mapped to their generation.
+func Completed(dir string) (map[string]int64, error) {
+	s, err := loadState(dir)
+	if err != nil {
+		return nil, err
+	}
+	return s.Done, nil
+}
+
+// MarkComplete records that dir has been filled by all the prewarms it needs,
+// until the next one starts.
+func MarkComplete(dir string) error {
+	s, err := loadState(dir)
+	if err != nil {
+		return err
+	}
+	s.Complete = true
+	return saveState(dir, s)
+}
+
+// IsComplete returns true if dir was marked complete by MarkComplete, and no
+// prewarm has started since.
+func IsComplete(dir string) (bool, error) {
+	s, err := loadState(dir)
+	if err != nil {
+		return false, err
+	}
+	return s.Complete, nil
+}
+
+func loadState(dir string) (state, error) {
+	s := state{Done: map[string]int64{}}
+	file, err := util.OpenBeneath(dir, StateFile, os.O_RDONLY, 0)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	} else if err != nil {
+		return state{}, err
+	}
+	defer file.Close()
+	data, err := io.ReadAll(file)
+	if err != nil {
+		return state{}, err
+	}
+	if err := json.Unmarshal(data, &s); err != nil {
+		klog.Warningf("Ignoring corrupt prewarm state in %s: %v", dir, err)
+		return state{Done: map[string]int64{}}, nil
+	}
+	if s.Done == nil {
+		s.Done = map[string]int64{}
+	}
+	return s, nil
+}
+
+// saveState writes the state atomically, so that it is intact after a crash.
+func saveState(dir string, s state) error {
+	data, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	file, err := util.OpenBeneath(dir, StateFile+PartialSuffix, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0640)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return util.RenameBeneath(dir, StateFile+PartialSuffix, StateFile)
+}
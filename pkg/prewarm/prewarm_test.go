@@ -0,0 +1,204 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package prewarm
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/GoogleCloudPlatform/csi-node-cache/pkg/gcs"
+)
+
+type fakeSource struct {
+	objects map[string][]byte
+	// corrupt objects return bad data.
+	corrupt map[string]bool
+
+	mutex sync.Mutex
+	reads map[string]int
+}
+
+func newFakeSource(objects map[string]string) *fakeSource {
+	s := &fakeSource{objects: map[string][]byte{}, corrupt: map[string]bool{}, reads: map[string]int{}}
+	for name, contents := range objects {
+		s.objects[name] = []byte(contents)
+	}
+	return s
+}
+
+func (s *fakeSource) List(ctx context.Context, loc gcs.Location) ([]gcs.Object, error) {
+	var objs []gcs.Object
+	for name, data := range s.objects {
+		if strings.HasPrefix(name, loc.Prefix+"/") {
+			objs = append(objs, gcs.Object{Name: name, Size: int64(len(data)), Generation: 1, CRC32C: crc32.Checksum(data, crc32cTable)})
+		}
+	}
+	return objs, nil
+}
+
+func (s *fakeSource) ReadRange(ctx context.Context, bucket string, obj gcs.Object, offset, length int64) (io.ReadCloser, error) {
+	s.mutex.Lock()
+	s.reads[obj.Name]++
+	s.mutex.Unlock()
+	data := s.objects[obj.Name][offset : offset+length]
+	if s.corrupt[obj.Name] {
+		data = bytes.Repeat([]byte("x"), len(data))
+	}
+	return io.NopCloser(bytes.NewReader(data)), nil
+}
+
+func TestRun(t *testing.T) {
+	dir := t.TempDir()
+	src := newFakeSource(map[string]string{
+		"data/a":           "hello",
+		"data/sub/b":       strings.Repeat("0123456789", 10),
+		"data/empty":       "",
+		"data/dir/":        "",
+		"other/not-loaded": "x",
+	})
+	from := gcs.Location{Bucket: "bucket", Prefix: "data"}
+
+	stats, err := Run(context.Background(), src, from, dir, Options{Concurrency: 3, ChunkSize: 7})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Objects != 3 || stats.Bytes != 105 || stats.Skipped != 0 {
+		t.Errorf("Unexpected stats %+v", stats)
+	}
+	for name, expected := range map[string]string{"a": "hello", "sub/b": strings.Repeat("0123456789", 10), "empty": ""} {
+		data, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			t.Errorf("Could not read %s: %v", name, err)
+		} else if string(data) != expected {
+			t.Errorf("Got %q for %s, expected %q", data, name, expected)
+		}
+	}
+	if src.reads["data/sub/b"] != 15 {
+		t.Errorf("Expected 15 chunk reads of data/sub/b, got %d", src.reads["data/sub/b"])
+	}
+	if _, err := os.Stat(filepath.Join(dir, "not-loaded")); err == nil {
+		t.Errorf("Object outside the prefix was loaded")
+	}
+
+	if complete, err := IsComplete(dir); err != nil || complete {
+		t.Errorf("Expected an unmarked prewarm not to be complete, got %v, %v", complete, err)
+	}
+	if err := MarkComplete(dir); err != nil {
+		t.Fatal(err)
+	}
+	if complete, err := IsComplete(dir); err != nil || !complete {
+		t.Errorf("Expected a marked prewarm to be complete, got %v, %v", complete, err)
+	}
+
+	// A second run resumes, skipping everything, and is complete only once
+	// marked again.
+	stats, err = Run(context.Background(), src, from, dir, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Objects != 0 || stats.Skipped != 3 {
+		t.Errorf("Unexpected stats on resume %+v", stats)
+	}
+	if complete, err := IsComplete(dir); err != nil || complete {
+		t.Errorf("Expected a new prewarm to clear completion, got %v, %v", complete, err)
+	}
+	if done, err := Completed(dir); err != nil || len(done) != 3 {
+		t.Errorf("Expected 3 completed objects, got %v, %v", done, err)
+	}
+}
+
+func TestRunChecksum(t *testing.T) {
+	dir := t.TempDir()
+	src := newFakeSource(map[string]string{"data/a": "hello"})
+	src.corrupt["data/a"] = true
+
+	_, err := Run(context.Background(), src, gcs.Location{Bucket: "bucket", Prefix: "data"}, dir, Options{})
+	if err == nil || !strings.Contains(err.Error(), "checksum") {
+		t.Errorf("Expected checksum error, got %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "a")); err == nil {
+		t.Errorf("Corrupt object was moved into place")
+	}
+
+	// The state is not updated, so a retry downloads it again.
+	src.corrupt["data/a"] = false
+	stats, err := Run(context.Background(), src, gcs.Location{Bucket: "bucket", Prefix: "data"}, dir, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Objects != 1 {
+		t.Errorf("Expected a retried download, got %+v", stats)
+	}
+}
+
+func TestRunShard(t *testing.T) {
+	objects := map[string]string{}
+	for i := 0; i < 100; i++ {
+		objects[fmt.Sprintf("data/%d", i)] = "x"
+	}
+	src := newFakeSource(objects)
+	shards := AssignShards([]string{"node-a", "node-b"})
+
+	total := 0
+	for _, node := range []string{"node-a", "node-b"} {
+		stats, err := Run(context.Background(), src, gcs.Location{Bucket: "bucket", Prefix: "data"}, t.TempDir(), Options{Shard: shards[node]})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stats.Objects == 0 || stats.Objects == 100 {
+			t.Errorf("Expected %s to load part of the dataset, got %d objects", node, stats.Objects)
+		}
+		total += stats.Objects
+	}
+	if total != 100 {
+		t.Errorf("Expected the shards to load all 100 objects once, got %d", total)
+	}
+}
+
+func TestRunSymlink(t *testing.T) {
+	dir := t.TempDir()
+	outside := t.TempDir()
+	target := filepath.Join(outside, "target")
+	if err := os.WriteFile(target, []byte("host"), 0640); err != nil {
+		t.Fatal(err)
+	}
+	// A pod using the cache plants symlinks to outside of it.
+	if err := os.Symlink(outside, filepath.Join(dir, "sub")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(target, filepath.Join(dir, "a"+PartialSuffix)); err != nil {
+		t.Fatal(err)
+	}
+	src := newFakeSource(map[string]string{"data/a": "hello", "data/sub/b": "world"})
+
+	_, err := Run(context.Background(), src, gcs.Location{Bucket: "bucket", Prefix: "data"}, dir, Options{Concurrency: 1})
+	if err == nil {
+		t.Errorf("Expected an error from the symlinks")
+	}
+	if data, err := os.ReadFile(target); err != nil || string(data) != "host" {
+		t.Errorf("File outside of the cache was changed: %q, %v", data, err)
+	}
+	if _, err := os.Stat(filepath.Join(outside, "b")); err == nil {
+		t.Errorf("File created outside of the cache")
+	}
+}
@@ -0,0 +1,150 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package prewarm
+
+import (
+	"cmp"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// shardReplicas is the number of points each node has on the hash ring, which
+// evens out the share of the ring each node gets.
+const shardReplicas = 16
+
+// Range is the part of the hash ring after Start, up to and including End. It
+// wraps around if Start > End, and is the whole ring if Start == End.
+type Range struct {
+	Start, End uint32
+}
+
+// Shard is the part of a dataset loaded by one node, the objects whose names
+// hash into one of its ranges. A nil Shard is the whole dataset.
+type Shard []Range
+
+// Contains returns true if the object name is in the shard.
+func (s Shard) Contains(name string) bool {
+	if s == nil {
+		return true
+	}
+	h := hash(name)
+	for _, r := range s {
+		switch {
+		case r.Start == r.End:
+			return true
+		case r.Start < r.End:
+			if h > r.Start && h <= r.End {
+				return true
+			}
+		default:
+			if h > r.Start || h <= r.End {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// String formats the shard as ';'-separated hex ranges, as in
+// 0000ffff-7fffffff;c0000000-e0000000.
+func (s Shard) String() string {
+	ranges := make([]string, len(s))
+	for i, r := range s {
+		ranges[i] = fmt.Sprintf("%08x-%08x", r.Start, r.End)
+	}
+	return strings.Join(ranges, ";")
+}
+
+// ParseShard parses the format of Shard.String. An empty string is a nil
+// Shard.
+func ParseShard(s string) (Shard, error) {
+	if s == "" {
+		return nil, nil
+	}
+	var shard Shard
+	for _, item := range strings.Split(s, ";") {
+		start, end, found := strings.Cut(item, "-")
+		if !found {
+			return nil, fmt.Errorf("bad shard range %q", item)
+		}
+		startVal, err := strconv.ParseUint(start, 16, 32)
+		if err != nil {
+			return nil, fmt.Errorf("bad shard range %q: %w", item, err)
+		}
+		endVal, err := strconv.ParseUint(end, 16, 32)
+		if err != nil {
+			return nil, fmt.Errorf("bad shard range %q: %w", item, err)
+		}
+		shard = append(shard, Range{Start: uint32(startVal), End: uint32(endVal)})
+	}
+	return shard, nil
+}
+
+// AssignShards divides the hash ring between nodes by consistent hashing, so
+// that adding or removing a node only moves the objects in its shard.
+func AssignShards(nodes []string) map[string]Shard {
+	type point struct {
+		pos  uint32
+		node string
+	}
+	var points []point
+	for _, node := range nodes {
+		for i := 0; i < shardReplicas; i++ {
+			points = append(points, point{pos: hash(fmt.Sprintf("%s#%d", node, i)), node: node})
+		}
+	}
+	slices.SortFunc(points, func(a, b point) int {
+		if a.pos != b.pos {
+			return cmp.Compare(a.pos, b.pos)
+		}
+		return strings.Compare(a.node, b.node)
+	})
+
+	// Each point owns the ring from the previous point. Adjacent ranges with
+	// the same owner are merged.
+	shards := map[string]Shard{}
+	var current *Range
+	owner := ""
+	for i, p := range points {
+		prev := points[(i+len(points)-1)%len(points)].pos
+		if current != nil && owner == p.node {
+			current.End = p.pos
+			continue
+		}
+		if current != nil {
+			shards[owner] = append(shards[owner], *current)
+		}
+		current = &Range{Start: prev, End: p.pos}
+		owner = p.node
+	}
+	if current != nil {
+		// The last range may continue the first, across the wrap.
+		if first := shards[owner]; len(first) > 0 && first[0].Start == current.End {
+			first[0].Start = current.Start
+		} else {
+			shards[owner] = append(shards[owner], *current)
+		}
+	}
+	return shards
+}
+
+func hash(s string) uint32 {
+	sum := sha256.Sum256([]byte(s))
+	return binary.BigEndian.Uint32(sum[:4])
+}
@@ -0,0 +1,87 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package prewarm
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func TestAssignShards(t *testing.T) {
+	nodes := []string{"node-a", "node-b", "node-c", "node-d"}
+	shards := AssignShards(nodes)
+	owners := map[string]string{}
+	for i := 0; i < 10000; i++ {
+		name := fmt.Sprintf("file-%d", i)
+		var owner []string
+		for _, node := range nodes {
+			if shards[node].Contains(name) {
+				owner = append(owner, node)
+			}
+		}
+		if len(owner) != 1 {
+			t.Fatalf("Expected %s to have one owner, got %v", name, owner)
+		}
+		owners[name] = owner[0]
+	}
+	counts := map[string]int{}
+	for _, owner := range owners {
+		counts[owner]++
+	}
+	for _, node := range nodes {
+		if counts[node] < 1000 || counts[node] > 4000 {
+			t.Errorf("Unbalanced shards: %v", counts)
+			break
+		}
+	}
+
+	// Adding a node only moves objects to it.
+	grown := AssignShards(append(nodes, "node-e"))
+	for name, owner := range owners {
+		if !grown[owner].Contains(name) && !grown["node-e"].Contains(name) {
+			t.Errorf("%s moved from %s to an existing node", name, owner)
+		}
+	}
+}
+
+func TestShardSingleNode(t *testing.T) {
+	shard := AssignShards([]string{"only"})["only"]
+	if len(shard) != 1 || shard[0].Start != shard[0].End {
+		t.Errorf("Expected the whole ring, got %v", shard)
+	}
+	if !shard.Contains("anything") {
+		t.Errorf("Whole ring shard doesn't contain an object")
+	}
+}
+
+func TestParseShard(t *testing.T) {
+	shard := Shard{{Start: 0x10, End: 0x7fffffff}, {Start: 0xf0000000, End: 0x5}}
+	parsed, err := ParseShard(shard.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(parsed, shard) {
+		t.Errorf("Got %v expected %v", parsed, shard)
+	}
+	if parsed, err := ParseShard(""); err != nil || parsed != nil {
+		t.Errorf("Expected nil shard for empty string, got %v, %v", parsed, err)
+	}
+	for _, bad := range []string{"10", "10-zz", "100000000-1"} {
+		if _, err := ParseShard(bad); err == nil {
+			t.Errorf("Expected error parsing %q", bad)
+		}
+	}
+}
@@ -15,21 +15,32 @@
 package raid
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"os"
+	"path/filepath"
 	"regexp"
 	"slices"
 	"strings"
+	"time"
 
+	"k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/klog/v2"
 
+	"github.com/GoogleCloudPlatform/csi-node-cache/pkg/fault"
 	"github.com/GoogleCloudPlatform/csi-node-cache/pkg/util"
 )
 
 const (
 	mdadmCmd   = "/bin/mdadm"
 	mdstatFile = "/proc/mdstat"
+
+	// mdadmTimeout stops a hung mdadm, for example on a failing device, from
+	// wedging the driver. Array operations return before any resync.
+	mdadmTimeout = 2 * time.Minute
+
+	reshapePollInterval = 10 * time.Second
 )
 
 var (
@@ -37,33 +48,135 @@ var (
 )
 
 type RaidArray interface {
-	Init() error
+	Init(ctx context.Context) error
 	Device() string
-	Stop() error
+	Stop(ctx context.Context) error
+	// SetSyncSpeedLimits limits the resync and rebuild rate of the array. It
+	// must be called after Init.
+	SetSyncSpeedLimits(limits SyncSpeedLimits) error
+}
+
+// MirrorArray is a raid1 array whose members can be changed while it is
+// running.
+type MirrorArray interface {
+	RaidArray
+	// InitDegraded starts the array from the primary alone, with missing
+	// free slots that can be filled by AddMember. Replicas are not used.
+	InitDegraded(ctx context.Context, missing int) error
+	// AddMember hot-adds a device to the running array, which is then rebuilt
+	// onto it. Adding a device that is already a member does nothing.
+	AddMember(ctx context.Context, device string) error
+	// RemoveMember fails and removes a device from the running array.
+	RemoveMember(ctx context.Context, device string) error
+	// Health reports failed members and spares of the running array.
+	Health(ctx context.Context) (MirrorHealth, error)
+	// RemoveFailed removes any faulty members from the running array,
+	// returning them. The kernel rebuilds onto a spare when a member fails, so
+	// this only clears the failed device from the array.
+	RemoveFailed(ctx context.Context) ([]string, error)
+}
+
+// MirrorHealth is the state of a running mirror, from mdadm --detail.
+type MirrorHealth struct {
+	// Failed are the faulty members.
+	Failed []string
+	// Spares are the idle spare devices.
+	Spares []string
+	// Degraded is true if the array is missing a member.
+	Degraded bool
+	// Rebuilding is true if a member, such as a spare replacing a failed
+	// member, is being recovered.
+	Rebuilding bool
 }
 
 type mirrorArray struct {
-	target   string
-	primary  string
-	replicas []string
+	target      string
+	primary     string
+	replicas    []string
+	spares      []string
+	writeMostly map[string]bool
 }
 
-var _ RaidArray = &mirrorArray{}
+// MirrorOption configures a mirror array.
+type MirrorOption func(*mirrorArray)
+
+// WriteMostly marks devices as write-mostly: reads will be served from the
+// other devices in the mirror whenever possible.
+func WriteMostly(devices ...string) MirrorOption {
+	return func(m *mirrorArray) {
+		for _, d := range devices {
+			m.writeMostly[d] = true
+		}
+	}
+}
+
+// Spares adds hot-spare devices to the mirror. When a member fails, the
+// kernel rebuilds onto a spare without any intervention.
+func Spares(devices ...string) MirrorOption {
+	return func(m *mirrorArray) {
+		m.spares = append(m.spares, devices...)
+	}
+}
+
+var _ MirrorArray = &mirrorArray{}
+
+// StripedArray is a raid0 array that can be grown onto new devices.
+type StripedArray interface {
+	RaidArray
+	// Grow adds any of its devices that are not members to the running
+	// array, returning true if the array is being reshaped onto them. The
+	// array only gets larger once the reshape completes; see WaitForReshape.
+	Grow(ctx context.Context) (bool, error)
+	// WaitForReshape polls until any reshape of the array has finished.
+	WaitForReshape(ctx context.Context) error
+}
+
+var _ StripedArray = &stripedArray{}
 
 type stripedArray struct {
 	target  string
 	devices []string
+	// chunkKiB is the chunk size of a new array, or 0 for the mdadm default.
+	chunkKiB int
+}
+
+// StripedOption configures a striped array.
+type StripedOption func(*stripedArray)
+
+// ChunkSize sets the chunk size of the array in KiB, if it is created. The
+// chunk size of an existing array is unchanged.
+func ChunkSize(kib int) StripedOption {
+	return func(s *stripedArray) {
+		s.chunkKiB = kib
+	}
 }
 
-func NewMirrorArray(target, primary string, replicas ...string) RaidArray {
-	return &mirrorArray{target: target, primary: primary, replicas: replicas}
+// NewMirrorArray creates a mirror of primary and replicas. When an existing
+// array is reassembled, the primary is preferred as the source of data.
+func NewMirrorArray(target, primary string, replicas []string, opts ...MirrorOption) MirrorArray {
+	m := &mirrorArray{target: target, primary: primary, replicas: replicas, writeMostly: map[string]bool{}}
+	for _, opt := range opts {
+		opt(m)
+	}
+	return m
 }
 
 func (m *mirrorArray) Device() string {
 	return m.target
 }
 
-func (m *mirrorArray) Init() error {
+func (m *mirrorArray) Init(ctx context.Context) error {
+	if err := m.init(ctx); err != nil {
+		return err
+	}
+	return m.addSpares(ctx)
+}
+
+func (m *mirrorArray) init(ctx context.Context) error {
+	if err := isRaidDevice(ctx, m.target); err == nil {
+		return nil
+	}
+
 	if err := validateDevice(m.primary); err != nil {
 		return err
 	}
@@ -73,43 +186,162 @@ func (m *mirrorArray) Init() error {
 		}
 	}
 
-	if err := stopAllInactive(); err != nil {
+	if err := stopAllInactive(ctx); err != nil {
 		return err
 	}
 
-	primaryIsRaid, err := isExistingRaidVolume(m.target, m.primary)
+	primaryIsRaid, err := isExistingRaidVolume(ctx, m.target, m.primary)
 	if err != nil {
 		return fmt.Errorf("Error when checking if %s is already a raid disk: %w", m.primary, err)
 	}
 	if primaryIsRaid {
-		return assembleExistingMirror(m.target, m.primary, m.replicas...)
+		return assembleExistingMirror(ctx, m.target, m.primary, m.writeMostly, m.replicas...)
 	}
 	for _, repl := range m.replicas {
-		replIsRaid, err := isExistingRaidVolume(m.target, repl)
+		replIsRaid, err := isExistingRaidVolume(ctx, m.target, repl)
 		if err != nil {
 			return fmt.Errorf("Error when checking if replica %s is aleady a raid disk: %s", repl, err)
 		}
 		if replIsRaid {
-			return assembleExistingMirror(m.target, repl, slices.Concat([]string{m.primary}, m.replicas)...)
+			others := slices.DeleteFunc(slices.Concat([]string{m.primary}, m.replicas), func(d string) bool { return d == repl })
+			return assembleExistingMirror(ctx, m.target, repl, m.writeMostly, others...)
 		}
 	}
-	return createNewMirror(m.target, slices.Concat([]string{m.primary}, m.replicas)...)
+	return createNewMirror(ctx, m.target, m.writeMostly, slices.Concat([]string{m.primary}, m.replicas)...)
+}
+
+func (m *mirrorArray) InitDegraded(ctx context.Context, missing int) error {
+	if err := m.initDegraded(ctx, missing); err != nil {
+		return err
+	}
+	return m.addSpares(ctx)
+}
+
+func (m *mirrorArray) initDegraded(ctx context.Context, missing int) error {
+	if err := isRaidDevice(ctx, m.target); err == nil {
+		return nil
+	}
+	if err := validateDevice(m.primary); err != nil {
+		return err
+	}
+	if err := stopAllInactive(ctx); err != nil {
+		return err
+	}
+
+	primaryIsRaid, err := isExistingRaidVolume(ctx, m.target, m.primary)
+	if err != nil {
+		return fmt.Errorf("Error when checking if %s is already a raid disk: %w", m.primary, err)
+	}
+	if primaryIsRaid {
+		return assembleExistingMirror(ctx, m.target, m.primary, m.writeMostly)
+	}
+	output, err := runMdadm(ctx, degradedMirrorArgs(m.target, m.primary, missing)...)
+	if err != nil {
+		return fmt.Errorf("Degraded mirror creation for %s from %s failed (%w): %s", m.target, m.primary, err, output)
+	}
+	klog.Infof("Started %s degraded from %s", m.target, m.primary)
+	return nil
+}
+
+func (m *mirrorArray) AddMember(ctx context.Context, device string) error {
+	if err := validateDevice(device); err != nil {
+		return err
+	}
+	detail, err := runMdadm(ctx, "--detail", m.target)
+	if err != nil {
+		return fmt.Errorf("Could not get details of %s (%w): %s", m.target, err, detail)
+	}
+	if isMirrorMember(detail, device) {
+		return nil
+	}
+	_ = wipeDevice(ctx, device) // Any old superblock would stop the add; errors will show up there.
+	output, err := runMdadm(ctx, slices.Concat([]string{"--add", m.target}, mirrorDeviceArgs([]string{device}, m.writeMostly))...)
+	if err != nil {
+		return fmt.Errorf("Could not add %s to %s (%w): %s", device, m.target, err, output)
+	}
+	klog.Infof("Added %s to %s, rebuilding", device, m.target)
+	return nil
 }
 
-func (m *mirrorArray) Stop() error {
-	return stopRaidDevice(m.Device())
+func (m *mirrorArray) RemoveMember(ctx context.Context, device string) error {
+	output, err := runMdadm(ctx, "--manage", m.target, "--fail", device, "--remove", device)
+	if err != nil {
+		return fmt.Errorf("Could not remove %s from %s (%w): %s", device, m.target, err, output)
+	}
+	return nil
 }
 
-func NewStripedArray(target string, devices ...string) RaidArray {
-	return &stripedArray{target: target, devices: devices}
+func (m *mirrorArray) Health(ctx context.Context) (MirrorHealth, error) {
+	detail, err := runMdadm(ctx, "--detail", m.target)
+	if err != nil {
+		return MirrorHealth{}, fmt.Errorf("Could not get details of %s (%w): %s", m.target, err, detail)
+	}
+	return parseMirrorHealth(detail), nil
+}
+
+func (m *mirrorArray) RemoveFailed(ctx context.Context) ([]string, error) {
+	health, err := m.Health(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, device := range health.Failed {
+		output, err := runMdadm(ctx, "--manage", m.target, "--remove", device)
+		if err != nil {
+			return nil, fmt.Errorf("Could not remove failed %s from %s (%w): %s", device, m.target, err, output)
+		}
+		klog.Warningf("Removed failed member %s from %s", device, m.target)
+	}
+	return health.Failed, nil
+}
+
+// addSpares adds any spares that are not already in the running array.
+func (m *mirrorArray) addSpares(ctx context.Context) error {
+	if len(m.spares) == 0 {
+		return nil
+	}
+	detail, err := runMdadm(ctx, "--detail", m.target)
+	if err != nil {
+		return fmt.Errorf("Could not get details of %s (%w): %s", m.target, err, detail)
+	}
+	for _, spare := range m.spares {
+		if isMirrorMember(detail, spare) {
+			continue
+		}
+		if err := validateDevice(spare); err != nil {
+			return err
+		}
+		_ = wipeDevice(ctx, spare) // Any old superblock would stop the add; errors will show up there.
+		output, err := runMdadm(ctx, "--manage", m.target, "--add-spare", spare)
+		if err != nil {
+			return fmt.Errorf("Could not add spare %s to %s (%w): %s", spare, m.target, err, output)
+		}
+		klog.Infof("Added spare %s to %s", spare, m.target)
+	}
+	return nil
+}
+
+func (m *mirrorArray) Stop(ctx context.Context) error {
+	return stopRaidDevice(ctx, m.Device())
+}
+
+func (m *mirrorArray) SetSyncSpeedLimits(limits SyncSpeedLimits) error {
+	return setArraySyncSpeedLimits(m.Device(), limits)
+}
+
+func NewStripedArray(target string, devices []string, opts ...StripedOption) StripedArray {
+	s := &stripedArray{target: target, devices: devices}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
 }
 
 func (s *stripedArray) Device() string {
 	return s.target
 }
 
-func (s *stripedArray) Init() error {
-	if err := isRaidDevice(s.target); err == nil {
+func (s *stripedArray) Init(ctx context.Context) error {
+	if err := isRaidDevice(ctx, s.target); err == nil {
 		return nil
 	}
 
@@ -119,70 +351,237 @@ func (s *stripedArray) Init() error {
 		}
 	}
 
-	if err := stopAllInactive(); err != nil {
+	if err := stopAllInactive(ctx); err != nil {
 		return err
 	}
 
+	// Only existing members are assembled, as new devices without a superblock
+	// would stop the assembly. They can be added with Grow.
+	existing := []string{}
 	for _, dev := range s.devices {
-		isRaid, err := isExistingRaidVolume(s.target, dev)
+		isRaid, err := isExistingRaidVolume(ctx, s.target, dev)
 		if err != nil {
 			return fmt.Errorf("Error when checking if devicce %s is already a raid disk: %s", dev, err)
 		}
 		if isRaid {
-			return assembleExistingStriped(s.target, s.devices...)
+			existing = append(existing, dev)
+		}
+	}
+	if len(existing) > 0 {
+		return assembleExistingStriped(ctx, s.target, existing...)
+	}
+	return createNewStriped(ctx, s.target, s.devices, s.chunkKiB)
+}
+
+func (s *stripedArray) Grow(ctx context.Context) (bool, error) {
+	detail, err := runMdadm(ctx, "--detail", s.target)
+	if err != nil {
+		return false, fmt.Errorf("Could not get details of %s (%w): %s", s.target, err, detail)
+	}
+	newDevices := []string{}
+	for _, dev := range s.devices {
+		if !isMirrorMember(detail, dev) {
+			newDevices = append(newDevices, dev)
 		}
 	}
-	return createNewStriped(s.target, s.devices...)
+	if len(newDevices) == 0 {
+		return false, nil
+	}
+	for _, dev := range newDevices {
+		if err := validateDevice(dev); err != nil {
+			return false, err
+		}
+		_ = wipeDevice(ctx, dev) // Any old superblock would stop the add; errors will show up there.
+	}
+	output, err := runMdadm(ctx, stripedGrowArgs(s.target, len(s.devices), newDevices)...)
+	if err != nil {
+		return false, fmt.Errorf("Could not grow %s onto %v (%w): %s", s.target, newDevices, err, output)
+	}
+	klog.Infof("Growing %s onto %v, reshaping", s.target, newDevices)
+	return true, nil
+}
+
+func (s *stripedArray) WaitForReshape(ctx context.Context) error {
+	return wait.PollUntilContextCancel(ctx, reshapePollInterval, true, func(ctx context.Context) (bool, error) {
+		detail, err := runMdadm(ctx, "--detail", s.target)
+		if err != nil {
+			return false, fmt.Errorf("Could not get details of %s (%w): %s", s.target, err, detail)
+		}
+		return !isReshaping(detail), nil
+	})
+}
+
+func (s *stripedArray) Stop(ctx context.Context) error {
+	return stopRaidDevice(ctx, s.Device())
 }
 
-func (s *stripedArray) Stop() error {
-	return stopRaidDevice(s.Device())
+func (s *stripedArray) SetSyncSpeedLimits(limits SyncSpeedLimits) error {
+	return setArraySyncSpeedLimits(s.Device(), limits)
 }
 
-func createNewMirror(target string, devices ...string) error {
-	output, err := runMdadm(slices.Concat([]string{"--create", target, "--level", "1", "--run", "--raid-devices", fmt.Sprintf("%d", len(devices))}, devices)...)
+// mirrorDeviceArgs lists devices for mdadm, with the write-mostly devices
+// last as --write-mostly applies to all devices after it.
+func mirrorDeviceArgs(devices []string, writeMostly map[string]bool) []string {
+	args := []string{}
+	wm := []string{}
+	for _, d := range devices {
+		if writeMostly[d] {
+			wm = append(wm, d)
+		} else {
+			args = append(args, d)
+		}
+	}
+	if len(wm) > 0 {
+		args = append(args, "--write-mostly")
+		args = append(args, wm...)
+	}
+	return args
+}
+
+func createNewMirror(ctx context.Context, target string, writeMostly map[string]bool, devices ...string) error {
+	// The internal bitmap means only changed regions are resynced after an unclean stop.
+	output, err := runMdadm(ctx, slices.Concat([]string{"--create", target, "--level", "1", "--run", "--bitmap", "internal", "--raid-devices", fmt.Sprintf("%d", len(devices))}, mirrorDeviceArgs(devices, writeMostly))...)
 	if err != nil {
 		return fmt.Errorf("Mirror raid creation for %s={%v} failed (%w): %s", target, devices, err, output)
 	}
 	return nil
 }
 
-func assembleExistingMirror(target, existing string, devices ...string) error {
+// degradedMirrorArgs are the mdadm arguments to create a mirror from device
+// alone, with missing free slots.
+func degradedMirrorArgs(target, device string, missing int) []string {
+	args := []string{"--create", target, "--level", "1", "--run", "--bitmap", "internal", "--raid-devices", fmt.Sprintf("%d", missing+1), device}
+	for range missing {
+		args = append(args, "missing")
+	}
+	return args
+}
+
+// isMirrorMember returns true if device is listed in the mdadm --detail
+// output. Symlinks such as /dev/disk/by-id are resolved as mdadm reports the
+// kernel device name.
+func isMirrorMember(detail, device string) bool {
+	if resolved, err := filepath.EvalSymlinks(device); err == nil {
+		device = resolved
+	}
+	for _, line := range strings.Split(detail, "\n") {
+		fields := strings.Fields(line)
+		// Member lines end with the device; skip header lines such as "Raid Level : raid1".
+		if len(fields) > 0 && strings.HasPrefix(fields[len(fields)-1], "/dev/") && fields[len(fields)-1] == device {
+			return true
+		}
+	}
+	return false
+}
+
+// parseMirrorHealth reads mdadm --detail output. The state of the array is
+// on a line such as "State : clean, degraded, recovering", and members are
+// listed at the end with their state before the device, for example
+//
+//	1       8       32        -      faulty   /dev/sdc
+//	2       8       48        -      spare   /dev/sdd
+func parseMirrorHealth(detail string) MirrorHealth {
+	var health MirrorHealth
+	for _, line := range strings.Split(detail, "\n") {
+		if key, value, found := strings.Cut(line, ":"); found && strings.TrimSpace(key) == "State" {
+			for _, state := range strings.Split(value, ",") {
+				switch strings.TrimSpace(state) {
+				case "degraded":
+					health.Degraded = true
+				case "recovering", "resyncing":
+					health.Rebuilding = true
+				}
+			}
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 2 || !strings.HasPrefix(fields[len(fields)-1], "/dev/") {
+			continue
+		}
+		device := fields[len(fields)-1]
+		switch {
+		case slices.Contains(fields, "faulty"):
+			health.Failed = append(health.Failed, device)
+		case fields[len(fields)-2] == "spare":
+			// A spare being rebuilt is listed as "spare rebuilding".
+			health.Spares = append(health.Spares, device)
+		}
+	}
+	return health
+}
+
+func assembleExistingMirror(ctx context.Context, target, existing string, writeMostly map[string]bool, devices ...string) error {
 	for _, d := range devices {
 		if d != existing {
-			_ = wipeDevice(d) // Ignore any error, if there's a problem it will fail in the assemble
+			_ = wipeDevice(ctx, d) // Ignore any error, if there's a problem it will fail in the assemble
 		}
 	}
-	output, err := runMdadm("--assemble", target, existing, "--run")
+	output, err := runMdadm(ctx, "--assemble", target, existing, "--run")
 	if err != nil {
 		return fmt.Errorf("Could not bootstrap assemble from %s (%w): %s", existing, err, output)
 	}
-	output, err = runMdadm(slices.Concat([]string{"--add", target}, devices)...)
+	if len(devices) == 0 {
+		return nil
+	}
+	output, err = runMdadm(ctx, slices.Concat([]string{"--add", target}, mirrorDeviceArgs(devices, writeMostly))...)
 	if err != nil {
-		_, _ = runMdadm("--stop", target) // Try to clean up as best we can
+		_, _ = runMdadm(context.WithoutCancel(ctx), "--stop", target) // Try to clean up as best we can, even if ctx is done
 		return fmt.Errorf("Could not add other devices to existing primary %s/%v (%w): %s", existing, devices, err, output)
 	}
+	klog.Infof("Assembled %s from %s, rebuilding onto %v", target, existing, devices)
 	return nil
 }
 
-func createNewStriped(target string, devices ...string) error {
-	// Force is needed if the number of devices is 1.
-	output, err := runMdadm(slices.Concat([]string{"--create", target, "--force", "--level", "0", "--run", "--raid-devices", fmt.Sprintf("%d", len(devices))}, devices)...)
+func createNewStriped(ctx context.Context, target string, devices []string, chunkKiB int) error {
+	output, err := runMdadm(ctx, stripedCreateArgs(target, devices, chunkKiB)...)
 	if err != nil {
 		return fmt.Errorf("Striped raid creation for %s={%v} failed (%w): %s", target, devices, err, output)
 	}
 	return nil
 }
 
-func assembleExistingStriped(target string, devices ...string) error {
-	output, err := runMdadm(slices.Concat([]string{"--assemble", target}, devices, []string{"--run"})...)
+// stripedCreateArgs are the mdadm arguments to create a striped array, with
+// the mdadm default chunk size if chunkKiB is 0.
+func stripedCreateArgs(target string, devices []string, chunkKiB int) []string {
+	// Force is needed if the number of devices is 1.
+	args := []string{"--create", target, "--force", "--level", "0", "--run", "--raid-devices", fmt.Sprintf("%d", len(devices))}
+	if chunkKiB > 0 {
+		args = append(args, "--chunk", fmt.Sprintf("%dK", chunkKiB))
+	}
+	return append(args, devices...)
+}
+
+// stripedGrowArgs are the mdadm arguments to grow a striped array to total
+// devices by adding newDevices. mdadm reshapes a raid0 array through raid4,
+// returning it to raid0 when done.
+func stripedGrowArgs(target string, total int, newDevices []string) []string {
+	return slices.Concat([]string{"--grow", target, "--level", "0", "--raid-devices", fmt.Sprintf("%d", total), "--add"}, newDevices)
+}
+
+// isReshaping returns true if the mdadm --detail state of an array includes
+// reshaping.
+func isReshaping(detail string) bool {
+	for _, line := range strings.Split(detail, "\n") {
+		if key, value, found := strings.Cut(line, ":"); found && strings.TrimSpace(key) == "State" {
+			for _, state := range strings.Split(value, ",") {
+				if strings.TrimSpace(state) == "reshaping" {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+func assembleExistingStriped(ctx context.Context, target string, devices ...string) error {
+	output, err := runMdadm(ctx, slices.Concat([]string{"--assemble", target}, devices, []string{"--run"})...)
 	if err != nil {
 		return fmt.Errorf("Existing assemble failed on %v (%w): %s", devices, err, output)
 	}
 	return nil
 }
 
-func stopAllInactive() error {
+func stopAllInactive(ctx context.Context) error {
 	statBytes, err := os.ReadFile(mdstatFile)
 	if err != nil {
 		return fmt.Errorf("Cannot open %s for stopping inactive: %w", mdstatFile, err)
@@ -190,7 +589,7 @@ func stopAllInactive() error {
 	inactive_devices := getInactiveDevices(string(statBytes))
 	for _, device := range inactive_devices {
 		klog.Infof("Stopping inactive device %s", device)
-		err := stopRaidDevice(device)
+		err := stopRaidDevice(ctx, device)
 		if err != nil {
 			klog.Warningf("Could not stop inactive device %s, continuing anyway: %v", device, err)
 		}
@@ -198,8 +597,8 @@ func stopAllInactive() error {
 	return nil
 }
 
-func stopRaidDevice(device string) error {
-	if output, err := runMdadm("--stop", device); err != nil {
+func stopRaidDevice(ctx context.Context, device string) error {
+	if output, err := runMdadm(ctx, "--stop", device); err != nil {
 		return fmt.Errorf("Could not stop %s (%v): %s", device, err, output)
 	}
 	return nil
@@ -218,17 +617,17 @@ func getInactiveDevices(mdstats string) []string {
 	return devices
 }
 
-func wipeDevice(device string) error {
+func wipeDevice(ctx context.Context, device string) error {
 	if _, err := os.Stat(device); errors.Is(err, os.ErrNotExist) {
 		return fmt.Errorf("Device %s to be wiped does not exist", device)
 	}
-	_, _ = runMdadm("--zero-superblock", device)
+	_, _ = runMdadm(ctx, "--zero-superblock", device)
 	// There's nothing to recover on errors. If the device was not already an array element, the command will fail.
 	return nil
 }
 
-func isRaidDevice(device string) error {
-	_, err := runMdadm("--detail", device)
+func isRaidDevice(ctx context.Context, device string) error {
+	_, err := runMdadm(ctx, "--detail", device)
 	return err // Maybe there's more information to extract from the output?
 }
 
@@ -243,12 +642,16 @@ func validateDevice(device string) error {
 	return nil
 }
 
-func isExistingRaidVolume(target, device string) (bool, error) {
-	_, err := runMdadm("--examine", device)
+func isExistingRaidVolume(ctx context.Context, target, device string) (bool, error) {
+	_, err := runMdadm(ctx, "--examine", device)
 	return err == nil, nil
 }
 
-func runMdadm(args ...string) (string, error) {
-	output, err := util.RunCommand(mdadmCmd, args...)
-	return string(output), err
+// runMdadm runs mdadm, returning its stdout. Any error includes stderr.
+func runMdadm(ctx context.Context, args ...string) (string, error) {
+	if err := fault.Check(fault.Mdadm); err != nil {
+		return "", fmt.Errorf("%s %s failed: %w", mdadmCmd, strings.Join(args, " "), err)
+	}
+	result, err := util.RunCommandContext(ctx, util.CommandOptions{Timeout: mdadmTimeout}, mdadmCmd, args...)
+	return string(result.Stdout), err
 }
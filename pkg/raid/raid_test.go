@@ -79,3 +79,140 @@ md126 : inactive ram0[3](S)
 		}
 	}
 }
+
+func TestMirrorDeviceArgs(t *testing.T) {
+	tests := []struct {
+		devices     []string
+		writeMostly map[string]bool
+		expected    []string
+	}{
+		{
+			devices:  []string{"a", "b"},
+			expected: []string{"a", "b"},
+		},
+		{
+			devices:     []string{"a", "b", "c"},
+			writeMostly: map[string]bool{"a": true},
+			expected:    []string{"b", "c", "--write-mostly", "a"},
+		},
+		{
+			devices:     []string{"a"},
+			writeMostly: map[string]bool{"a": true},
+			expected:    []string{"--write-mostly", "a"},
+		},
+	}
+	for _, test := range tests {
+		args := mirrorDeviceArgs(test.devices, test.writeMostly)
+		if !reflect.DeepEqual(args, test.expected) {
+			t.Errorf("Got %v expected %v for %v / %v", args, test.expected, test.devices, test.writeMostly)
+		}
+	}
+}
+
+func TestDegradedMirrorArgs(t *testing.T) {
+	args := degradedMirrorArgs("/dev/md/m", "/dev/md/lssd", 1)
+	expected := []string{"--create", "/dev/md/m", "--level", "1", "--run", "--bitmap", "internal", "--raid-devices", "2", "/dev/md/lssd", "missing"}
+	if !reflect.DeepEqual(args, expected) {
+		t.Errorf("Got %v expected %v", args, expected)
+	}
+}
+
+func TestIsMirrorMember(t *testing.T) {
+	detail := `/dev/md/mirrored:
+           Version : 1.2
+        Raid Level : raid1
+      Raid Devices : 2
+
+    Number   Major   Minor   RaidDevice State
+       0       9      127        0      active sync   /dev/md127
+       1       8       16        1      spare rebuilding   /dev/sdb
+`
+	tests := []struct {
+		device   string
+		expected bool
+	}{
+		{device: "/dev/md127", expected: true},
+		{device: "/dev/sdb", expected: true},
+		{device: "/dev/sdc", expected: false},
+		{device: "raid1", expected: false},
+	}
+	for _, test := range tests {
+		if got := isMirrorMember(detail, test.device); got != test.expected {
+			t.Errorf("Got %t expected %t for %s", got, test.expected, test.device)
+		}
+	}
+}
+
+func TestParseMirrorHealth(t *testing.T) {
+	tests := []struct {
+		detail   string
+		expected MirrorHealth
+	}{
+		{
+			detail: `/dev/md/mirrored:
+        Raid Level : raid1
+             State : clean
+
+    Number   Major   Minor   RaidDevice State
+       0       9      127        0      active sync   /dev/md127
+       1       8       16        1      active sync writemostly   /dev/sdb
+       2       8       32        -      spare   /dev/sdc
+`,
+			expected: MirrorHealth{Spares: []string{"/dev/sdc"}},
+		},
+		{
+			detail: `/dev/md/mirrored:
+        Raid Level : raid1
+             State : clean, degraded, recovering
+
+    Number   Major   Minor   RaidDevice State
+       0       9      127        0      active sync   /dev/md127
+       2       8       32        1      spare rebuilding   /dev/sdc
+
+       1       8       16        -      faulty   /dev/sdb
+`,
+			expected: MirrorHealth{Failed: []string{"/dev/sdb"}, Degraded: true, Rebuilding: true},
+		},
+		{
+			detail: `/dev/md/mirrored:
+        Raid Level : raid1
+             State : clean, degraded
+
+    Number   Major   Minor   RaidDevice State
+       0       9      127        0      active sync   /dev/md127
+       -       0        0        1      removed
+`,
+			expected: MirrorHealth{Degraded: true},
+		},
+	}
+	for _, test := range tests {
+		health := parseMirrorHealth(test.detail)
+		if !reflect.DeepEqual(health, test.expected) {
+			t.Errorf("Got %+v expected %+v for %s", health, test.expected, test.detail)
+		}
+	}
+}
+
+func TestStripedGrowArgs(t *testing.T) {
+	args := stripedGrowArgs("/dev/md/lssd", 4, []string{"/dev/c", "/dev/d"})
+	expected := []string{"--grow", "/dev/md/lssd", "--level", "0", "--raid-devices", "4", "--add", "/dev/c", "/dev/d"}
+	if !reflect.DeepEqual(args, expected) {
+		t.Errorf("Got %v expected %v", args, expected)
+	}
+}
+
+func TestIsReshaping(t *testing.T) {
+	tests := []struct {
+		detail   string
+		expected bool
+	}{
+		{detail: "        Raid Level : raid4\n             State : clean, reshaping\n", expected: true},
+		{detail: "        Raid Level : raid0\n             State : clean\n", expected: false},
+		{detail: "    Reshape Status : 12% complete\n", expected: false},
+	}
+	for _, test := range tests {
+		if got := isReshaping(test.detail); got != test.expected {
+			t.Errorf("Got %t expected %t for %s", got, test.expected, test.detail)
+		}
+	}
+}
@@ -0,0 +1,64 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package raid
+
+import (
+	"strings"
+)
+
+const (
+	// minChunkKiB and maxChunkKiB bound the chosen chunk size. Smaller chunks
+	// split ordinary I/O across devices, and larger ones leave devices idle.
+	minChunkKiB = 64
+	maxChunkKiB = 512
+
+	// defaultFullStripeKiB is the full stripe size aimed for, so that a
+	// typical large read or write keeps every device busy.
+	defaultFullStripeKiB = 1024
+)
+
+// fullStripeKiB is the full stripe size aimed for by machine family. Families
+// not listed use defaultFullStripeKiB.
+var fullStripeKiB = map[string]int{
+	// z3 local SSDs are large and throughput optimized, and do better with
+	// larger I/O per device.
+	"z3": 2048,
+}
+
+// StripeChunkKiB chooses the chunk size for a striped array of members local
+// SSDs on a machine type such as c3-standard-8-lssd, so that the full stripe
+// is about the target size for the machine family. It returns 0 for a single
+// device, where there's nothing to stripe and the mdadm default is used.
+func StripeChunkKiB(machineType string, members int) int {
+	if members < 2 {
+		return 0
+	}
+	family, _, _ := strings.Cut(machineType, "-")
+	target, found := fullStripeKiB[family]
+	if !found {
+		target = defaultFullStripeKiB
+	}
+	chunk := maxChunkKiB
+	for chunk > minChunkKiB && chunk*members > target {
+		chunk /= 2
+	}
+	return chunk
+}
+
+// ValidChunkKiB returns true if kib is a chunk size mdadm accepts: a power of
+// two of at least 4KiB.
+func ValidChunkKiB(kib int) bool {
+	return kib >= 4 && kib&(kib-1) == 0
+}
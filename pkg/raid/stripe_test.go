@@ -0,0 +1,64 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package raid
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestStripeChunkKiB(t *testing.T) {
+	for _, tc := range []struct {
+		machineType string
+		members     int
+		expected    int
+	}{
+		{"c3-standard-8-lssd", 1, 0},
+		{"c3-standard-44-lssd", 2, 512},
+		{"n2-standard-16", 4, 256},
+		{"c3d-standard-180-lssd", 6, 128},
+		{"n2-standard-80", 24, 64},
+		{"z3-highmem-88", 8, 256},
+		{"z3-highmem-176", 12, 128},
+		{"", 4, 256},
+	} {
+		if chunk := StripeChunkKiB(tc.machineType, tc.members); chunk != tc.expected {
+			t.Errorf("%s with %d: expected %d, got %d", tc.machineType, tc.members, tc.expected, chunk)
+		}
+	}
+}
+
+func TestStripedArgs(t *testing.T) {
+	devices := []string{"/dev/a", "/dev/b"}
+	args := stripedCreateArgs("/dev/md0", devices, 0)
+	if slices.Contains(args, "--chunk") {
+		t.Errorf("unexpected chunk in %v", args)
+	}
+	args = stripedCreateArgs("/dev/md0", devices, 256)
+	if i := slices.Index(args, "--chunk"); i < 0 || args[i+1] != "256K" {
+		t.Errorf("expected chunk in %v", args)
+	}
+	if !slices.Equal(args[len(args)-2:], devices) {
+		t.Errorf("devices not last in %v", args)
+	}
+}
+
+func TestValidChunkKiB(t *testing.T) {
+	for kib, valid := range map[int]bool{0: false, 2: false, 4: true, 64: true, 96: false, 512: true} {
+		if ValidChunkKiB(kib) != valid {
+			t.Errorf("%d: expected %t", kib, valid)
+		}
+	}
+}
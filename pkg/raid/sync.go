@@ -0,0 +1,74 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package raid
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+const (
+	raidSysctlDir = "/proc/sys/dev/raid"
+	sysBlockDir   = "/sys/block"
+)
+
+// SyncSpeedLimits bound the rate of resync and rebuild of arrays, in KiB/s.
+// The kernel keeps resync at least at the minimum even when there is other
+// I/O, and never exceeds the maximum. A zero value leaves that limit as is.
+type SyncSpeedLimits struct {
+	MinKBps int
+	MaxKBps int
+}
+
+// SetGlobalSyncSpeedLimits sets the dev.raid.speed_limit_{min,max} sysctls,
+// which apply to all arrays without their own limit.
+func SetGlobalSyncSpeedLimits(limits SyncSpeedLimits) error {
+	return writeSyncSpeedLimits(raidSysctlDir, "speed_limit_min", "speed_limit_max", limits)
+}
+
+// setArraySyncSpeedLimits sets the sync_speed_{min,max} of a single array.
+func setArraySyncSpeedLimits(device string, limits SyncSpeedLimits) error {
+	actual, err := filepath.EvalSymlinks(device)
+	if err != nil {
+		return fmt.Errorf("Cannot resolve %s: %w", device, err)
+	}
+	mdDir := filepath.Join(sysBlockDir, filepath.Base(actual), "md")
+	return writeSyncSpeedLimits(mdDir, "sync_speed_min", "sync_speed_max", limits)
+}
+
+func writeSyncSpeedLimits(dir, minFile, maxFile string, limits SyncSpeedLimits) error {
+	if limits.MinKBps < 0 || limits.MaxKBps < 0 {
+		return fmt.Errorf("Bad sync speed limits %+v", limits)
+	}
+	if limits.MinKBps > 0 && limits.MaxKBps > 0 && limits.MinKBps > limits.MaxKBps {
+		return fmt.Errorf("Sync speed minimum %d is above maximum %d", limits.MinKBps, limits.MaxKBps)
+	}
+	// Write the maximum first, as the kernel rejects a minimum above the current maximum.
+	for _, item := range []struct {
+		file  string
+		value int
+	}{{maxFile, limits.MaxKBps}, {minFile, limits.MinKBps}} {
+		if item.value == 0 {
+			continue
+		}
+		path := filepath.Join(dir, item.file)
+		if err := os.WriteFile(path, []byte(strconv.Itoa(item.value)), 0644); err != nil {
+			return fmt.Errorf("Could not set %s: %w", path, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,64 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package raid
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWriteSyncSpeedLimits(t *testing.T) {
+	tests := []struct {
+		limits      SyncSpeedLimits
+		expectedMin string
+		expectedMax string
+		expectError bool
+	}{
+		{limits: SyncSpeedLimits{MinKBps: 1000, MaxKBps: 50000}, expectedMin: "1000", expectedMax: "50000"},
+		{limits: SyncSpeedLimits{MaxKBps: 50000}, expectedMin: "orig", expectedMax: "50000"},
+		{limits: SyncSpeedLimits{}, expectedMin: "orig", expectedMax: "orig"},
+		{limits: SyncSpeedLimits{MinKBps: 50000, MaxKBps: 1000}, expectError: true},
+		{limits: SyncSpeedLimits{MinKBps: -1}, expectError: true},
+	}
+	for _, test := range tests {
+		dir := t.TempDir()
+		for _, f := range []string{"min", "max"} {
+			if err := os.WriteFile(filepath.Join(dir, f), []byte("orig"), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		err := writeSyncSpeedLimits(dir, "min", "max", test.limits)
+		if test.expectError {
+			if err == nil {
+				t.Errorf("%+v: expected error", test.limits)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%+v: unexpected error %v", test.limits, err)
+			continue
+		}
+		for f, expected := range map[string]string{"min": test.expectedMin, "max": test.expectedMax} {
+			data, err := os.ReadFile(filepath.Join(dir, f))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(data) != expected {
+				t.Errorf("%+v: %s is %s, expected %s", test.limits, f, data, expected)
+			}
+		}
+	}
+}
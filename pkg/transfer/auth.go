@@ -0,0 +1,125 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package transfer
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	authenticationv1 "k8s.io/api/authentication/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	authorizationKey = "authorization"
+	bearerPrefix     = "Bearer "
+
+	// reviewCacheTTL is how long a successful token review is reused, as
+	// seeding makes a call for each chunk of each file.
+	reviewCacheTTL = time.Minute
+)
+
+// Authenticator checks the token of a call.
+type Authenticator interface {
+	Authenticate(ctx context.Context, token string) error
+}
+
+// tokenReviewer authenticates service account tokens with TokenReviews.
+type tokenReviewer struct {
+	review   func(ctx context.Context, token string) (authenticationv1.TokenReviewStatus, error)
+	allowed  map[string]bool
+	now      func() time.Time
+	mutex    sync.Mutex
+	reviewed map[[sha256.Size]byte]time.Time
+}
+
+// NewTokenReviewAuthenticator accepts tokens for Audience of the given service
+// accounts, as namespace/name.
+func NewTokenReviewAuthenticator(client kubernetes.Interface, serviceAccounts []string) (Authenticator, error) {
+	review := func(ctx context.Context, token string) (authenticationv1.TokenReviewStatus, error) {
+		review, err := client.AuthenticationV1().TokenReviews().Create(ctx, &authenticationv1.TokenReview{
+			Spec: authenticationv1.TokenReviewSpec{Token: token, Audiences: []string{Audience}},
+		}, metav1.CreateOptions{})
+		if err != nil {
+			return authenticationv1.TokenReviewStatus{}, err
+		}
+		return review.Status, nil
+	}
+	r := &tokenReviewer{review: review, allowed: map[string]bool{}, now: time.Now, reviewed: map[[sha256.Size]byte]time.Time{}}
+	for _, sa := range serviceAccounts {
+		ns, name, found := strings.Cut(sa, "/")
+		if !found || ns == "" || name == "" || strings.Contains(name, "/") {
+			return nil, fmt.Errorf("bad service account %q, expected namespace/name", sa)
+		}
+		r.allowed[fmt.Sprintf("system:serviceaccount:%s:%s", ns, name)] = true
+	}
+	return r, nil
+}
+
+func (r *tokenReviewer) Authenticate(ctx context.Context, token string) error {
+	key := sha256.Sum256([]byte(token))
+	r.mutex.Lock()
+	expiry, found := r.reviewed[key]
+	r.mutex.Unlock()
+	if found && r.now().Before(expiry) {
+		return nil
+	}
+
+	review, err := r.review(ctx, token)
+	if err != nil {
+		return fmt.Errorf("could not review token: %w", err)
+	}
+	if !review.Authenticated {
+		return fmt.Errorf("token not authenticated: %s", review.Error)
+	}
+	if user := review.User.Username; !r.allowed[user] {
+		return fmt.Errorf("%s may not transfer cache contents", user)
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	now := r.now()
+	for k, e := range r.reviewed {
+		if !now.Before(e) {
+			delete(r.reviewed, k)
+		}
+	}
+	r.reviewed[key] = now.Add(reviewCacheTTL)
+	return nil
+}
+
+// tokenFile sends the token in a file, such as a projected service account
+// token, with each call. The file is read each time, as it is rotated.
+type tokenFile string
+
+func (f tokenFile) GetRequestMetadata(ctx context.Context, uri ...string) (map[string]string, error) {
+	token, err := os.ReadFile(string(f))
+	if err != nil {
+		return nil, fmt.Errorf("could not read transfer token: %w", err)
+	}
+	return map[string]string{authorizationKey: bearerPrefix + strings.TrimSpace(string(token))}, nil
+}
+
+// RequireTransportSecurity is true, so that tokens are never sent in the
+// clear.
+func (tokenFile) RequireTransportSecurity() bool {
+	return true
+}
@@ -0,0 +1,129 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package transfer
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+)
+
+// Client calls the transfer service of a peer.
+type Client struct {
+	address string
+	conn    *grpc.ClientConn
+}
+
+// NewClient creates a client for the server at address, connecting with
+// tlsConfig, such as from ClientTLSConfig, and authenticating with the service
+// account token in tokenPath. No connection is made until the first call.
+func NewClient(address, tokenPath string, tlsConfig *tls.Config) (*Client, error) {
+	conn, err := grpc.NewClient(address,
+		grpc.WithTransportCredentials(credentials.NewTLS(tlsConfig)),
+		grpc.WithPerRPCCredentials(tokenFile(tokenPath)),
+		grpc.WithDefaultCallOptions(grpc.ForceCodec(codec{})))
+	if err != nil {
+		return nil, fmt.Errorf("could not create transfer client for %s: %w", address, err)
+	}
+	return &Client{address: address, conn: conn}, nil
+}
+
+// Close closes the connection to the server.
+func (c *Client) Close() error {
+	return c.conn.Close()
+}
+
+// List returns the files of the server under paths, or all files if paths is
+// empty.
+func (c *Client) List(ctx context.Context, paths []string) ([]File, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	stream, err := c.call(ctx, 0, listMethod, &ListRequest{Paths: paths})
+	if err != nil {
+		return nil, err
+	}
+	var files []File
+	for {
+		var file File
+		err := stream.RecvMsg(&file)
+		if errors.Is(err, io.EOF) {
+			return files, nil
+		} else if err != nil {
+			return nil, fmt.Errorf("List of %s failed: %w", c.address, err)
+		}
+		files = append(files, file)
+	}
+}
+
+// Read reads length bytes at offset of a file. The caller must close the
+// reader, which ends the call.
+func (c *Client) Read(ctx context.Context, path string, offset, length int64) (io.ReadCloser, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	stream, err := c.call(ctx, 1, readMethod, &ReadRequest{Path: path, Offset: offset, Length: length})
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	return &chunkReader{stream: stream, cancel: cancel, name: fmt.Sprintf("%s from %s", path, c.address)}, nil
+}
+
+// call starts a server streaming call of the method with the given index in
+// the service description.
+func (c *Client) call(ctx context.Context, index int, method string, req any) (grpc.ClientStream, error) {
+	stream, err := c.conn.NewStream(ctx, &serviceDesc.Streams[index], method)
+	if err != nil {
+		return nil, fmt.Errorf("Call to %s failed: %w", c.address, err)
+	}
+	if err := stream.SendMsg(req); err != nil {
+		return nil, fmt.Errorf("Call to %s failed: %w", c.address, err)
+	}
+	if err := stream.CloseSend(); err != nil {
+		return nil, fmt.Errorf("Call to %s failed: %w", c.address, err)
+	}
+	return stream, nil
+}
+
+// chunkReader reads the chunks of a Read call.
+type chunkReader struct {
+	stream grpc.ClientStream
+	cancel context.CancelFunc
+	name   string
+	buf    bytes.Reader
+}
+
+func (r *chunkReader) Read(p []byte) (int, error) {
+	for r.buf.Len() == 0 {
+		var chunk Chunk
+		err := r.stream.RecvMsg(&chunk)
+		if errors.Is(err, io.EOF) {
+			return 0, io.EOF
+		} else if err != nil {
+			return 0, fmt.Errorf("Read of %s failed: %w", r.name, err)
+		}
+		r.buf.Reset(chunk.Data)
+	}
+	return r.buf.Read(p)
+}
+
+func (r *chunkReader) Close() error {
+	r.cancel()
+	return nil
+}
@@ -0,0 +1,201 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package transfer
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/time/rate"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"k8s.io/klog/v2"
+)
+
+// ErrUnavailable is returned by a Store with nothing to serve, such as a
+// cache that has not been set up.
+var ErrUnavailable = errors.New("no cache to serve")
+
+// Store is the cache served by a Server.
+type Store interface {
+	// List returns the regular files of the cache.
+	List(ctx context.Context) ([]File, error)
+	// Open opens a file listed by List.
+	Open(path string) (io.ReadSeekCloser, error)
+}
+
+// ServerOptions configure a Server.
+type ServerOptions struct {
+	// Authenticator checks the token of each call. It is required.
+	Authenticator Authenticator
+	// TLS, such as from ServerTLSConfig, secures the tokens sent by clients.
+	// It is required.
+	TLS *tls.Config
+	// BytesPerSecond, if positive, limits the rate file data is sent at,
+	// over all calls.
+	BytesPerSecond int64
+}
+
+// Server serves a Store to authenticated clients.
+type Server struct {
+	store   Store
+	auth    Authenticator
+	limiter *rate.Limiter
+	grpc    *grpc.Server
+}
+
+// NewServer creates a server for store.
+func NewServer(store Store, opts ServerOptions) (*Server, error) {
+	if opts.Authenticator == nil {
+		return nil, errors.New("an authenticator is required")
+	}
+	if opts.TLS == nil {
+		return nil, errors.New("a TLS config is required")
+	}
+	limit := rate.Inf
+	if opts.BytesPerSecond > 0 {
+		limit = rate.Limit(opts.BytesPerSecond)
+	}
+	s := &Server{
+		store:   store,
+		auth:    opts.Authenticator,
+		limiter: rate.NewLimiter(limit, ChunkSize),
+	}
+	s.grpc = grpc.NewServer(grpc.Creds(credentials.NewTLS(opts.TLS)), grpc.ForceServerCodec(codec{}), grpc.StreamInterceptor(s.authenticate))
+	s.grpc.RegisterService(&serviceDesc, s)
+	return s, nil
+}
+
+// Serve accepts connections on listener until Stop is called.
+func (s *Server) Serve(listener net.Listener) error {
+	return s.grpc.Serve(listener)
+}
+
+// Stop closes the listener and all connections.
+func (s *Server) Stop() {
+	s.grpc.Stop()
+}
+
+func (s *Server) authenticate(srv any, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	md, _ := metadata.FromIncomingContext(stream.Context())
+	values := md.Get(authorizationKey)
+	if len(values) != 1 {
+		return status.Error(codes.Unauthenticated, "missing bearer token")
+	}
+	token, found := strings.CutPrefix(values[0], bearerPrefix)
+	if !found || token == "" {
+		return status.Error(codes.Unauthenticated, "missing bearer token")
+	}
+	if err := s.auth.Authenticate(stream.Context(), token); err != nil {
+		klog.Warningf("Refused %s: %v", info.FullMethod, err)
+		return status.Error(codes.PermissionDenied, err.Error())
+	}
+	return handler(srv, stream)
+}
+
+func (s *Server) list(req *ListRequest, stream grpc.ServerStream) error {
+	for _, p := range req.Paths {
+		if !validPath(p) {
+			return status.Errorf(codes.InvalidArgument, "bad path %q", p)
+		}
+	}
+	files, err := s.store.List(stream.Context())
+	if errors.Is(err, ErrUnavailable) {
+		return status.Error(codes.Unavailable, err.Error())
+	} else if err != nil {
+		return status.Errorf(codes.Internal, "could not list cache: %v", err)
+	}
+	for i := range files {
+		if !selected(files[i].Path, req.Paths) {
+			continue
+		}
+		if err := stream.SendMsg(&files[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Server) read(req *ReadRequest, stream grpc.ServerStream) error {
+	if !validPath(req.Path) {
+		return status.Errorf(codes.InvalidArgument, "bad path %q", req.Path)
+	}
+	if req.Offset < 0 || req.Length < 0 {
+		return status.Errorf(codes.InvalidArgument, "bad range %d+%d", req.Offset, req.Length)
+	}
+	file, err := s.store.Open(req.Path)
+	switch {
+	case errors.Is(err, ErrUnavailable):
+		return status.Error(codes.Unavailable, err.Error())
+	case errors.Is(err, os.ErrNotExist):
+		return status.Errorf(codes.NotFound, "%s not found", req.Path)
+	case err != nil:
+		return status.Errorf(codes.Internal, "could not open %s: %v", req.Path, err)
+	}
+	defer file.Close()
+	if _, err := file.Seek(req.Offset, io.SeekStart); err != nil {
+		return status.Errorf(codes.Internal, "could not seek %s: %v", req.Path, err)
+	}
+
+	ctx := stream.Context()
+	buf := make([]byte, min(ChunkSize, req.Length))
+	for remaining := req.Length; remaining > 0; {
+		n, err := io.ReadFull(file, buf[:min(int64(len(buf)), remaining)])
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			if n == 0 {
+				return status.Errorf(codes.OutOfRange, "%s ends before %d", req.Path, req.Offset+req.Length)
+			}
+		} else if err != nil {
+			return status.Errorf(codes.Internal, "could not read %s: %v", req.Path, err)
+		}
+		if err := s.limiter.WaitN(ctx, n); err != nil {
+			return status.FromContextError(err).Err()
+		}
+		if err := stream.SendMsg(&Chunk{Data: buf[:n]}); err != nil {
+			return err
+		}
+		remaining -= int64(n)
+	}
+	return nil
+}
+
+// validPath returns true if p is a relative path within the cache.
+func validPath(p string) bool {
+	return p != "" && filepath.IsLocal(filepath.FromSlash(p))
+}
+
+// selected returns true if path is one of paths, or under one of them. Any
+// path is selected if there are none.
+func selected(path string, paths []string) bool {
+	if len(paths) == 0 {
+		return true
+	}
+	for _, p := range paths {
+		p = strings.TrimSuffix(p, "/")
+		if p == "." || path == p || strings.HasPrefix(path, p+"/") {
+			return true
+		}
+	}
+	return false
+}
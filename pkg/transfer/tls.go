@@ -0,0 +1,75 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package transfer
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// ServerName is the name the certificate of servers must be issued for, which
+// clients check. Peers are addressed by pod IP, so all servers share one
+// certificate for this name rather than one for each address.
+const ServerName = "node-cache-transfer"
+
+// The files of a certificate directory, laid out as a kubernetes.io/tls
+// secret such as those issued by cert-manager.
+const (
+	certFile = "tls.crt"
+	keyFile  = "tls.key"
+	caFile   = "ca.crt"
+)
+
+// ServerTLSConfig returns the TLS config of a server with the certificate and
+// key in certDir. They are read for each connection, so that a rotated
+// certificate is used without a restart.
+func ServerTLSConfig(certDir string) (*tls.Config, error) {
+	// A missing or bad certificate is reported now rather than to peers.
+	if _, err := loadCertificate(certDir); err != nil {
+		return nil, err
+	}
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return loadCertificate(certDir)
+		},
+	}, nil
+}
+
+func loadCertificate(certDir string) (*tls.Certificate, error) {
+	cert, err := tls.LoadX509KeyPair(filepath.Join(certDir, certFile), filepath.Join(certDir, keyFile))
+	if err != nil {
+		return nil, fmt.Errorf("could not load transfer certificate: %w", err)
+	}
+	return &cert, nil
+}
+
+// ClientTLSConfig returns the TLS config of a client that only trusts servers
+// with a certificate for ServerName issued by the CA in certDir.
+func ClientTLSConfig(certDir string) (*tls.Config, error) {
+	file := filepath.Join(certDir, caFile)
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("could not read transfer CA: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificates in %s", file)
+	}
+	return &tls.Config{MinVersion: tls.VersionTLS12, RootCAs: pool, ServerName: ServerName}, nil
+}
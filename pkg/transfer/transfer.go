@@ -0,0 +1,125 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package transfer is the protocol drivers use to copy cache contents between
+// nodes. It is a gRPC service with two server streaming calls: List
+// enumerates the files under selected paths with their checksums, and Read
+// streams a range of a file. Messages are JSON encoded, so that the service
+// needs no generated code.
+//
+// Calls are authenticated by a Kubernetes service account token bound to
+// Audience, which the server checks with a TokenReview.
+package transfer
+
+import (
+	"encoding/json"
+
+	"google.golang.org/grpc"
+)
+
+const (
+	// ServiceName is the full name of the gRPC service.
+	ServiceName = "nodecache.transfer.v1.Transfer"
+
+	// Audience is the audience of the service account tokens sent by clients.
+	Audience = "node-cache.gke.io/transfer"
+
+	// ChunkSize is the most file data sent in one message.
+	ChunkSize = 1 << 20
+
+	listMethod = "/" + ServiceName + "/List"
+	readMethod = "/" + ServiceName + "/Read"
+)
+
+// ListRequest selects the files to list.
+type ListRequest struct {
+	// Paths are files or directories, relative to the cache root with /
+	// separators. If empty, all files are listed.
+	Paths []string `json:"paths,omitempty"`
+}
+
+// File is a regular file in the cache, sent in response to a ListRequest.
+type File struct {
+	// Path is relative to the cache root, with / separators.
+	Path string `json:"path"`
+	Size int64  `json:"size"`
+	// Generation identifies the version of the file's contents, such as the
+	// GCS generation it was downloaded at. It is zero if unknown.
+	Generation int64 `json:"generation,omitempty"`
+	// CRC32C is the Castagnoli checksum of the contents.
+	CRC32C uint32 `json:"crc32c"`
+}
+
+// ReadRequest reads length bytes at offset of a file.
+type ReadRequest struct {
+	Path   string `json:"path"`
+	Offset int64  `json:"offset"`
+	Length int64  `json:"length"`
+}
+
+// Chunk is part of the data of a ReadRequest. Chunks are sent in order.
+type Chunk struct {
+	Data []byte `json:"data"`
+}
+
+// codec encodes messages as JSON.
+type codec struct{}
+
+func (codec) Marshal(v any) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (codec) Unmarshal(data []byte, v any) error {
+	return json.Unmarshal(data, v)
+}
+
+func (codec) Name() string {
+	return "json"
+}
+
+// service is the interface implemented by Server for the service
+// description.
+type service interface {
+	list(req *ListRequest, stream grpc.ServerStream) error
+	read(req *ReadRequest, stream grpc.ServerStream) error
+}
+
+var serviceDesc = grpc.ServiceDesc{
+	ServiceName: ServiceName,
+	HandlerType: (*service)(nil),
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "List",
+			ServerStreams: true,
+			Handler: func(srv any, stream grpc.ServerStream) error {
+				var req ListRequest
+				if err := stream.RecvMsg(&req); err != nil {
+					return err
+				}
+				return srv.(service).list(&req, stream)
+			},
+		},
+		{
+			StreamName:    "Read",
+			ServerStreams: true,
+			Handler: func(srv any, stream grpc.ServerStream) error {
+				var req ReadRequest
+				if err := stream.RecvMsg(&req); err != nil {
+					return err
+				}
+				return srv.(service).read(&req, stream)
+			},
+		},
+	},
+}
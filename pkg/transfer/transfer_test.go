@@ -0,0 +1,289 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package transfer
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	certutil "k8s.io/client-go/util/cert"
+)
+
+type memStore map[string]string
+
+func (m memStore) List(ctx context.Context) ([]File, error) {
+	var files []File
+	for _, p := range []string{"a", "dir/b", "dir/sub/c", "other/d"} {
+		if data, found := m[p]; found {
+			files = append(files, File{Path: p, Size: int64(len(data))})
+		}
+	}
+	return files, nil
+}
+
+type memFile struct {
+	*bytes.Reader
+}
+
+func (memFile) Close() error { return nil }
+
+func (m memStore) Open(path string) (io.ReadSeekCloser, error) {
+	data, found := m[path]
+	if !found {
+		return nil, os.ErrNotExist
+	}
+	return memFile{bytes.NewReader([]byte(data))}, nil
+}
+
+type tokenAuth string
+
+func (a tokenAuth) Authenticate(ctx context.Context, token string) error {
+	if token != string(a) {
+		return errors.New("bad token")
+	}
+	return nil
+}
+
+// writeCerts writes a certificate for ServerName, with its CA, to a new
+// certificate directory.
+func writeCerts(t *testing.T) string {
+	t.Helper()
+	cert, key, err := certutil.GenerateSelfSignedCertKey(ServerName, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	for name, data := range map[string][]byte{certFile: cert, keyFile: key, caFile: cert} {
+		if err := os.WriteFile(filepath.Join(dir, name), data, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+// startServer serves store, returning a client using token.
+func startServer(t *testing.T, store Store, opts ServerOptions, token string) *Client {
+	t.Helper()
+	if opts.Authenticator == nil {
+		opts.Authenticator = tokenAuth("secret")
+	}
+	certDir := writeCerts(t)
+	serverTLS, err := ServerTLSConfig(certDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts.TLS = serverTLS
+	server, err := NewServer(store, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Serve(listener)
+	t.Cleanup(server.Stop)
+
+	tokenPath := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(tokenPath, []byte(token+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	clientTLS, err := ClientTLSConfig(certDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := NewClient(listener.Addr().String(), tokenPath, clientTLS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+	return client
+}
+
+func readAll(ctx context.Context, c *Client, path string, offset, length int64) (string, error) {
+	r, err := c.Read(ctx, path, offset, length)
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+	data, err := io.ReadAll(r)
+	return string(data), err
+}
+
+func TestTransfer(t *testing.T) {
+	large := strings.Repeat("0123456789", ChunkSize/4)
+	store := memStore{"a": "hello", "dir/b": large, "dir/sub/c": "c", "other/d": "d"}
+	client := startServer(t, store, ServerOptions{}, "secret")
+	ctx := context.Background()
+
+	tests := []struct {
+		paths []string
+		want  []string
+	}{
+		{nil, []string{"a", "dir/b", "dir/sub/c", "other/d"}},
+		{[]string{"dir/"}, []string{"dir/b", "dir/sub/c"}},
+		{[]string{"a", "other"}, []string{"a", "other/d"}},
+		{[]string{"di"}, nil},
+	}
+	for _, tc := range tests {
+		files, err := client.List(ctx, tc.paths)
+		if err != nil {
+			t.Fatalf("List(%v): %v", tc.paths, err)
+		}
+		var got []string
+		for _, f := range files {
+			got = append(got, f.Path)
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("List(%v) = %v, want %v", tc.paths, got, tc.want)
+		}
+	}
+
+	if data, err := readAll(ctx, client, "a", 1, 3); err != nil || data != "ell" {
+		t.Errorf("Read of a = %q, %v", data, err)
+	}
+	// Reads larger than a chunk are streamed in several messages.
+	if data, err := readAll(ctx, client, "dir/b", 5, int64(len(large))-5); err != nil || data != large[5:] {
+		t.Errorf("Read of dir/b got %d bytes, %v", len(data), err)
+	}
+	if _, err := readAll(ctx, client, "a", 3, 10); status.Code(errors.Unwrap(err)) != codes.OutOfRange {
+		t.Errorf("Read past the end got %v, expected OutOfRange", err)
+	}
+	if _, err := readAll(ctx, client, "missing", 0, 1); status.Code(errors.Unwrap(err)) != codes.NotFound {
+		t.Errorf("Read of a missing file got %v, expected NotFound", err)
+	}
+	if _, err := readAll(ctx, client, "../a", 0, 1); status.Code(errors.Unwrap(err)) != codes.InvalidArgument {
+		t.Errorf("Read outside the cache got %v, expected InvalidArgument", err)
+	}
+	if _, err := client.List(ctx, []string{"/etc"}); status.Code(errors.Unwrap(err)) != codes.InvalidArgument {
+		t.Errorf("List outside the cache got %v, expected InvalidArgument", err)
+	}
+}
+
+func TestTransferUnauthenticated(t *testing.T) {
+	client := startServer(t, memStore{"a": "hello"}, ServerOptions{}, "wrong")
+	if _, err := client.List(context.Background(), nil); status.Code(errors.Unwrap(err)) != codes.PermissionDenied {
+		t.Errorf("List with a bad token got %v, expected PermissionDenied", err)
+	}
+	if _, err := readAll(context.Background(), client, "a", 0, 5); status.Code(errors.Unwrap(err)) != codes.PermissionDenied {
+		t.Errorf("Read with a bad token got %v, expected PermissionDenied", err)
+	}
+}
+
+func TestTransferUntrustedServer(t *testing.T) {
+	serverTLS, err := ServerTLSConfig(writeCerts(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewServer(memStore{}, ServerOptions{Authenticator: tokenAuth("secret")}); err == nil {
+		t.Errorf("Expected a server without TLS to be refused")
+	}
+	server, err := NewServer(memStore{"a": "hello"}, ServerOptions{Authenticator: tokenAuth("secret"), TLS: serverTLS})
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Serve(listener)
+	t.Cleanup(server.Stop)
+
+	tokenPath := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(tokenPath, []byte("secret"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	// The client trusts a different CA, so the token is never sent.
+	clientTLS, err := ClientTLSConfig(writeCerts(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := NewClient(listener.Addr().String(), tokenPath, clientTLS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	if _, err := client.List(context.Background(), nil); status.Code(errors.Unwrap(err)) != codes.Unavailable {
+		t.Errorf("List from an untrusted server got %v, expected Unavailable", err)
+	}
+}
+
+func TestTransferRateLimit(t *testing.T) {
+	data := strings.Repeat("x", 3*ChunkSize)
+	// The burst allows one chunk at once, so the other two take a second
+	// each.
+	client := startServer(t, memStore{"a": data}, ServerOptions{BytesPerSecond: ChunkSize}, "secret")
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	got, err := readAll(ctx, client, "a", 0, int64(len(data)))
+	if err == nil {
+		t.Fatalf("Read of %d bytes was not limited", len(got))
+	}
+	if len(got) >= len(data) {
+		t.Errorf("Read got all %d bytes before the deadline", len(got))
+	}
+}
+
+func TestTokenReviewer(t *testing.T) {
+	auth, err := NewTokenReviewAuthenticator(nil, []string{"node-cache/node-cache-driver"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := auth.(*tokenReviewer)
+	now := time.Now()
+	r.now = func() time.Time { return now }
+	reviews := 0
+	r.review = func(ctx context.Context, token string) (authenticationv1.TokenReviewStatus, error) {
+		reviews++
+		status := authenticationv1.TokenReviewStatus{Authenticated: token != "forged"}
+		status.User.Username = fmt.Sprintf("system:serviceaccount:node-cache:%s", token)
+		return status, nil
+	}
+
+	ctx := context.Background()
+	if err := r.Authenticate(ctx, "node-cache-driver"); err != nil {
+		t.Errorf("driver token refused: %v", err)
+	}
+	if err := r.Authenticate(ctx, "node-cache-driver"); err != nil || reviews != 1 {
+		t.Errorf("cached token got %v after %d reviews, expected 1", err, reviews)
+	}
+	now = now.Add(reviewCacheTTL)
+	if err := r.Authenticate(ctx, "node-cache-driver"); err != nil || reviews != 2 {
+		t.Errorf("expired token got %v after %d reviews, expected 2", err, reviews)
+	}
+	if err := r.Authenticate(ctx, "default"); err == nil {
+		t.Errorf("other service account allowed")
+	}
+	if err := r.Authenticate(ctx, "forged"); err == nil {
+		t.Errorf("unauthenticated token allowed")
+	}
+
+	if _, err := NewTokenReviewAuthenticator(nil, []string{"node-cache-driver"}); err == nil {
+		t.Errorf("service account without a namespace allowed")
+	}
+}
@@ -0,0 +1,134 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package util
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// The functions below operate on paths inside a cache that pods can write to.
+// Paths are resolved by the kernel relative to the cache root and may not
+// contain symlinks, so a planted symlink cannot redirect the driver's reads
+// or writes to elsewhere on the host.
+
+// resolveBeneath keeps resolution under the starting directory and refuses
+// symlinks in any component.
+const resolveBeneath = unix.RESOLVE_BENEATH | unix.RESOLVE_NO_SYMLINKS | unix.RESOLVE_NO_MAGICLINKS
+
+// OpenBeneath opens rel, a local path under root, like os.OpenFile.
+func OpenBeneath(root, rel string, flag int, perm os.FileMode) (*os.File, error) {
+	path := filepath.Join(root, rel)
+	if !filepath.IsLocal(rel) {
+		return nil, &os.PathError{Op: "open", Path: path, Err: errors.New("not a local path")}
+	}
+	dir, err := openRoot(root)
+	if err != nil {
+		return nil, err
+	}
+	defer unix.Close(dir)
+	fd, err := openat2(dir, rel, flag, perm)
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: path, Err: err}
+	}
+	return os.NewFile(uintptr(fd), path), nil
+}
+
+// MkdirAllBeneath creates the directory rel under root, along with any
+// missing parents.
+func MkdirAllBeneath(root, rel string, perm os.FileMode) error {
+	if !filepath.IsLocal(rel) {
+		return &os.PathError{Op: "mkdir", Path: filepath.Join(root, rel), Err: errors.New("not a local path")}
+	}
+	dir, err := openRoot(root)
+	if err != nil {
+		return err
+	}
+	// Each component is created and then opened relative to its parent, so
+	// that a component replaced by a symlink is refused rather than followed.
+	current := root
+	for _, name := range strings.Split(filepath.Clean(rel), string(filepath.Separator)) {
+		if name == "." {
+			continue
+		}
+		current = filepath.Join(current, name)
+		if err := unix.Mkdirat(dir, name, uint32(perm.Perm())); err != nil && !errors.Is(err, unix.EEXIST) {
+			unix.Close(dir)
+			return &os.PathError{Op: "mkdir", Path: current, Err: err}
+		}
+		next, err := openat2(dir, name, unix.O_DIRECTORY|unix.O_RDONLY, 0)
+		unix.Close(dir)
+		if err != nil {
+			return &os.PathError{Op: "mkdir", Path: current, Err: err}
+		}
+		dir = next
+	}
+	return unix.Close(dir)
+}
+
+// RenameBeneath renames from to to, both local paths under root. Like
+// rename(2), a symlink at to is replaced rather than followed.
+func RenameBeneath(root, from, to string) error {
+	fromDir, err := OpenBeneath(root, filepath.Dir(from), unix.O_DIRECTORY|unix.O_RDONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer fromDir.Close()
+	toDir, err := OpenBeneath(root, filepath.Dir(to), unix.O_DIRECTORY|unix.O_RDONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer toDir.Close()
+	if err := unix.Renameat(int(fromDir.Fd()), filepath.Base(from), int(toDir.Fd()), filepath.Base(to)); err != nil {
+		return &os.LinkError{Op: "rename", Old: filepath.Join(root, from), New: filepath.Join(root, to), Err: err}
+	}
+	return nil
+}
+
+// RemoveBeneath removes the file rel, a local path under root. Like
+// unlink(2), a symlink at rel is removed rather than followed.
+func RemoveBeneath(root, rel string) error {
+	dir, err := OpenBeneath(root, filepath.Dir(rel), unix.O_DIRECTORY|unix.O_RDONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	if err := unix.Unlinkat(int(dir.Fd()), filepath.Base(rel), 0); err != nil {
+		return &os.PathError{Op: "remove", Path: filepath.Join(root, rel), Err: err}
+	}
+	return nil
+}
+
+// openRoot opens root, which is trusted and may itself be reached through
+// symlinks.
+func openRoot(root string) (int, error) {
+	fd, err := unix.Open(root, unix.O_DIRECTORY|unix.O_RDONLY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return -1, &os.PathError{Op: "open", Path: root, Err: err}
+	}
+	return fd, nil
+}
+
+func openat2(dir int, rel string, flag int, perm os.FileMode) (int, error) {
+	how := unix.OpenHow{Flags: uint64(flag | unix.O_CLOEXEC), Resolve: resolveBeneath}
+	if flag&unix.O_CREAT != 0 {
+		how.Mode = uint64(perm.Perm())
+	}
+	return unix.Openat2(dir, rel, &how)
+}
@@ -0,0 +1,85 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package util
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestBeneath(t *testing.T) {
+	root := t.TempDir()
+	outside := t.TempDir()
+	if err := os.Symlink(outside, filepath.Join(root, "link")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(filepath.Join(outside, "target"), filepath.Join(root, "file")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := MkdirAllBeneath(root, "a/b", 0750); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	f, err := OpenBeneath(root, "a/b/c", os.O_CREATE|os.O_WRONLY, 0640)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	f.Close()
+	if err := RenameBeneath(root, "a/b/c", "a/d"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(root, "a/d")); err != nil {
+		t.Errorf("renamed file missing: %v", err)
+	}
+
+	if err := MkdirAllBeneath(root, "link/x", 0750); err == nil {
+		t.Errorf("expected error creating a directory through a symlink")
+	}
+	if _, err := OpenBeneath(root, "file", os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0640); err == nil {
+		t.Errorf("expected error opening a symlink")
+	}
+	if _, err := OpenBeneath(root, "../escape", os.O_CREATE|os.O_WRONLY, 0640); err == nil {
+		t.Errorf("expected error opening a non-local path")
+	}
+	if err := RenameBeneath(root, "a/d", "link/d"); err == nil {
+		t.Errorf("expected error renaming through a symlink")
+	}
+	if err := os.WriteFile(filepath.Join(outside, "keep"), nil, 0640); err != nil {
+		t.Fatal(err)
+	}
+	if err := RemoveBeneath(root, "link/keep"); err == nil {
+		t.Errorf("expected error removing through a symlink")
+	}
+	if err := os.Remove(filepath.Join(outside, "keep")); err != nil {
+		t.Errorf("file outside of the root was removed: %v", err)
+	}
+	if err := RemoveBeneath(root, "file"); err != nil {
+		t.Errorf("unexpected error removing a symlink: %v", err)
+	}
+	if err := RemoveBeneath(root, "a/d"); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if err := RemoveBeneath(root, "a/d"); !os.IsNotExist(err) {
+		t.Errorf("expected a missing file, got %v", err)
+	}
+	entries, err := os.ReadDir(outside)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Errorf("files created outside of the root: %v", entries)
+	}
+}
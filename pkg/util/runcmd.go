@@ -15,31 +15,105 @@
 package util
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
 	"fmt"
+	"os"
 	"os/exec"
 	"strings"
+	"time"
 )
 
 const (
 	// Error thrown by exec cmd.Run() when process spawned by cmd.Start() completes before cmd.Wait() is called (see - k/k issue #103753)
 	errNoChildProcesses = "wait: no child processes"
+
+	// waitDelay bounds how long output is read after a cancelled command is
+	// killed, in case a child it started still holds its stdout or stderr.
+	waitDelay = 5 * time.Second
 )
 
+// CommandOptions configures RunCommandContext.
+type CommandOptions struct {
+	// Timeout, if non-zero, kills the command if it has not finished in time.
+	Timeout time.Duration
+	// Env is added to the environment of the command, as KEY=value.
+	Env []string
+}
+
+// CommandResult is the output of a command run by RunCommandContext.
+type CommandResult struct {
+	Stdout []byte
+	Stderr []byte
+}
+
 // RunCommand wraps a k8s exec to deal with the no child process error. Same as exec.CombinedOutput.
 // On error, the output is included so callers don't need to echo it again.
 func RunCommand(cmd string, args ...string) ([]byte, error) {
 	execCmd := exec.Command(cmd, args...)
 	output, err := execCmd.CombinedOutput()
-	if err != nil {
-		if err.Error() == errNoChildProcesses {
-			if execCmd.ProcessState.Success() {
-				// If the process succeeded, this can be ignored, see k/k issue #103753
-				return output, nil
-			}
-			// Get actual error
-			err = &exec.ExitError{ProcessState: execCmd.ProcessState}
-		}
+	if err = checkNoChildProcesses(execCmd, err); err != nil {
 		return output, fmt.Errorf("%s %s failed: %w; output: %s", cmd, strings.Join(args, " "), err, string(output))
 	}
 	return output, nil
 }
+
+// RunCommandContext runs a command, killing it if ctx is done or the timeout
+// in opts expires. Stdout and stderr are captured separately; on error, stderr
+// is included so callers don't need to echo it again. The command is run by
+// any runner set with SetCommandRunner.
+func RunCommandContext(ctx context.Context, opts CommandOptions, cmd string, args ...string) (CommandResult, error) {
+	if commandRunner != nil {
+		return commandRunner.RunCommand(ctx, opts, cmd, args...)
+	}
+	if opts.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, opts.Timeout)
+		defer cancel()
+	}
+	execCmd := exec.CommandContext(ctx, cmd, args...)
+	execCmd.WaitDelay = waitDelay
+	if len(opts.Env) > 0 {
+		execCmd.Env = append(os.Environ(), opts.Env...)
+	}
+	var stdout, stderr bytes.Buffer
+	execCmd.Stdout = &stdout
+	execCmd.Stderr = &stderr
+	err := checkNoChildProcesses(execCmd, execCmd.Run())
+	result := CommandResult{Stdout: stdout.Bytes(), Stderr: stderr.Bytes()}
+	if err != nil {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			err = fmt.Errorf("%w (%v)", ctxErr, err)
+		}
+		return result, fmt.Errorf("%s %s failed: %w; stderr: %s", cmd, strings.Join(args, " "), err, string(result.Stderr))
+	}
+	return result, nil
+}
+
+// RunCommandJSON runs a command as RunCommandContext, decoding its stdout as
+// JSON into v.
+func RunCommandJSON(ctx context.Context, opts CommandOptions, v any, cmd string, args ...string) error {
+	result, err := RunCommandContext(ctx, opts, cmd, args...)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(result.Stdout, v); err != nil {
+		return fmt.Errorf("could not decode output of %s %s: %w", cmd, strings.Join(args, " "), err)
+	}
+	return nil
+}
+
+// checkNoChildProcesses returns err, unless it is the spurious no child
+// processes error for a command that succeeded.
+func checkNoChildProcesses(execCmd *exec.Cmd, err error) error {
+	if err == nil || err.Error() != errNoChildProcesses {
+		return err
+	}
+	if execCmd.ProcessState.Success() {
+		// If the process succeeded, this can be ignored, see k/k issue #103753
+		return nil
+	}
+	// Get actual error
+	return &exec.ExitError{ProcessState: execCmd.ProcessState}
+}
@@ -0,0 +1,73 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package util
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRunCommandContext(t *testing.T) {
+	result, err := RunCommandContext(context.Background(), CommandOptions{Env: []string{"NODE_CACHE_TEST=value"}}, "/bin/sh", "-c", "echo out $NODE_CACHE_TEST; echo err >&2")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if string(result.Stdout) != "out value\n" {
+		t.Errorf("bad stdout %q", result.Stdout)
+	}
+	if string(result.Stderr) != "err\n" {
+		t.Errorf("bad stderr %q", result.Stderr)
+	}
+
+	_, err = RunCommandContext(context.Background(), CommandOptions{}, "/bin/sh", "-c", "echo oops >&2; exit 3")
+	if err == nil || !strings.Contains(err.Error(), "oops") {
+		t.Errorf("expected error with stderr, got %v", err)
+	}
+}
+
+func TestRunCommandContextTimeout(t *testing.T) {
+	start := time.Now()
+	_, err := RunCommandContext(context.Background(), CommandOptions{Timeout: 100 * time.Millisecond}, "/bin/sleep", "10")
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected deadline exceeded, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("command not killed promptly, took %v", elapsed)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := RunCommandContext(ctx, CommandOptions{}, "/bin/sleep", "10"); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected cancelled, got %v", err)
+	}
+}
+
+func TestRunCommandJSON(t *testing.T) {
+	var v struct {
+		Name string `json:"name"`
+	}
+	if err := RunCommandJSON(context.Background(), CommandOptions{}, &v, "/bin/echo", `{"name": "md127"}`); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if v.Name != "md127" {
+		t.Errorf("bad decode: %+v", v)
+	}
+	if err := RunCommandJSON(context.Background(), CommandOptions{}, &v, "/bin/echo", "not json"); err == nil {
+		t.Errorf("expected decode error")
+	}
+}
@@ -0,0 +1,207 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package util
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+
+	"k8s.io/klog/v2"
+	"k8s.io/mount-utils"
+	"k8s.io/utils/exec"
+)
+
+// CommandRunner runs commands somewhere other than this process, such as in a
+// privileged helper on the host. A command that runs but fails returns an
+// exec.CodeExitError with its exit status.
+type CommandRunner interface {
+	RunCommand(ctx context.Context, opts CommandOptions, cmd string, args ...string) (CommandResult, error)
+}
+
+// commandRunner, if set, runs all commands. It is only set at startup.
+var commandRunner CommandRunner
+
+// SetCommandRunner sends the commands run by RunCommandContext, and by the
+// mounter and exec returned from Mounter and Exec, to runner. It must be
+// called before any commands are run.
+func SetCommandRunner(runner CommandRunner) {
+	commandRunner = runner
+}
+
+// Mounter returns the mounter to use for local volumes, which mounts through
+// any command runner.
+func Mounter() mount.Interface {
+	if commandRunner == nil {
+		return mount.New("")
+	}
+	return &runnerMounter{Interface: mount.New(""), runner: commandRunner}
+}
+
+// Exec returns the exec to use for formatting, which runs commands through
+// any command runner.
+func Exec() exec.Interface {
+	if commandRunner == nil {
+		return exec.New()
+	}
+	return runnerExec{runner: commandRunner}
+}
+
+// runnerMounter mounts and unmounts with a command runner. Mount points are
+// still read from this process, so mounts made by the runner must propagate
+// to it.
+type runnerMounter struct {
+	mount.Interface
+	runner CommandRunner
+}
+
+var _ mount.Interface = &runnerMounter{}
+
+func (m *runnerMounter) Mount(source string, target string, fstype string, options []string) error {
+	return m.MountSensitive(source, target, fstype, options, nil)
+}
+
+func (m *runnerMounter) MountSensitive(source string, target string, fstype string, options []string, sensitiveOptions []string) error {
+	return m.MountSensitiveWithoutSystemdWithMountFlags(source, target, fstype, options, sensitiveOptions, nil)
+}
+
+func (m *runnerMounter) MountSensitiveWithoutSystemd(source string, target string, fstype string, options []string, sensitiveOptions []string) error {
+	return m.MountSensitiveWithoutSystemdWithMountFlags(source, target, fstype, options, sensitiveOptions, nil)
+}
+
+// MountSensitiveWithoutSystemdWithMountFlags mounts as mount.Mounter does,
+// with a bind mount followed by a remount if options apply to a bind.
+func (m *runnerMounter) MountSensitiveWithoutSystemdWithMountFlags(source string, target string, fstype string, options []string, sensitiveOptions []string, mountFlags []string) error {
+	bind, bindOpts, bindRemountOpts, bindRemountOptsSensitive := mount.MakeBindOptsSensitive(options, sensitiveOptions)
+	if bind {
+		if err := m.mount(source, target, fstype, bindOpts, bindRemountOptsSensitive, mountFlags); err != nil {
+			return err
+		}
+		return m.mount(source, target, fstype, bindRemountOpts, bindRemountOptsSensitive, mountFlags)
+	}
+	return m.mount(source, target, fstype, options, sensitiveOptions, mountFlags)
+}
+
+func (m *runnerMounter) mount(source string, target string, fstype string, options []string, sensitiveOptions []string, mountFlags []string) error {
+	args, logStr := mount.MakeMountArgsSensitiveWithMountFlags(source, target, fstype, options, sensitiveOptions, mountFlags)
+	klog.V(4).Infof("Mounting with runner (%s)", logStr)
+	if _, err := m.runner.RunCommand(context.Background(), CommandOptions{}, "mount", args...); err != nil {
+		// The runner error would include sensitive options.
+		var exitErr exec.CodeExitError
+		if errors.As(err, &exitErr) {
+			return fmt.Errorf("mount failed with status %d, arguments (%s)", exitErr.Code, logStr)
+		}
+		return fmt.Errorf("mount failed, arguments (%s): %w", logStr, err)
+	}
+	return nil
+}
+
+func (m *runnerMounter) Unmount(target string) error {
+	klog.V(4).Infof("Unmounting %s with runner", target)
+	_, err := m.runner.RunCommand(context.Background(), CommandOptions{}, "umount", target)
+	return err
+}
+
+// runnerExec is an exec.Interface for a command runner. Commands can only be
+// run to completion; pipes and Start are not supported.
+type runnerExec struct {
+	runner CommandRunner
+}
+
+var _ exec.Interface = runnerExec{}
+
+func (e runnerExec) Command(cmd string, args ...string) exec.Cmd {
+	return e.CommandContext(context.Background(), cmd, args...)
+}
+
+func (e runnerExec) CommandContext(ctx context.Context, cmd string, args ...string) exec.Cmd {
+	return &runnerCmd{runner: e.runner, ctx: ctx, cmd: cmd, args: args}
+}
+
+// LookPath returns file unchanged, as the runner finds commands itself.
+func (e runnerExec) LookPath(file string) (string, error) {
+	return file, nil
+}
+
+type runnerCmd struct {
+	runner CommandRunner
+	ctx    context.Context
+	cmd    string
+	args   []string
+	env    []string
+	stdout io.Writer
+	stderr io.Writer
+}
+
+var _ exec.Cmd = &runnerCmd{}
+
+var errUnsupported = errors.New("not supported by command runner")
+
+// run runs the command, returning any exec.CodeExitError unwrapped so callers
+// can check it with a type assertion as they do for local commands.
+func (c *runnerCmd) run() (CommandResult, error) {
+	result, err := c.runner.RunCommand(c.ctx, CommandOptions{Env: c.env}, c.cmd, c.args...)
+	var exitErr exec.CodeExitError
+	if errors.As(err, &exitErr) {
+		return result, exitErr
+	}
+	return result, err
+}
+
+func (c *runnerCmd) Run() error {
+	result, err := c.run()
+	if c.stdout != nil {
+		c.stdout.Write(result.Stdout)
+	}
+	if c.stderr != nil {
+		c.stderr.Write(result.Stderr)
+	}
+	return err
+}
+
+// CombinedOutput returns stdout followed by stderr, as the runner doesn't
+// interleave them.
+func (c *runnerCmd) CombinedOutput() ([]byte, error) {
+	result, err := c.run()
+	return append(result.Stdout, result.Stderr...), err
+}
+
+func (c *runnerCmd) Output() ([]byte, error) {
+	result, err := c.run()
+	return result.Stdout, err
+}
+
+// SetDir is ignored; commands run in the runner's directory.
+func (c *runnerCmd) SetDir(dir string) {}
+
+// SetStdin is ignored; commands run without input.
+func (c *runnerCmd) SetStdin(in io.Reader) {}
+
+func (c *runnerCmd) SetStdout(out io.Writer) { c.stdout = out }
+
+func (c *runnerCmd) SetStderr(out io.Writer) { c.stderr = out }
+
+func (c *runnerCmd) SetEnv(env []string) { c.env = env }
+
+func (c *runnerCmd) StdoutPipe() (io.ReadCloser, error) { return nil, errUnsupported }
+
+func (c *runnerCmd) StderrPipe() (io.ReadCloser, error) { return nil, errUnsupported }
+
+func (c *runnerCmd) Start() error { return errUnsupported }
+
+func (c *runnerCmd) Wait() error { return errUnsupported }
+
+func (c *runnerCmd) Stop() {}
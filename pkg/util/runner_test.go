@@ -0,0 +1,90 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package util
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	"k8s.io/utils/exec"
+)
+
+type fakeRunner struct {
+	commands [][]string
+	exitCode int
+}
+
+func (f *fakeRunner) RunCommand(ctx context.Context, opts CommandOptions, cmd string, args ...string) (CommandResult, error) {
+	f.commands = append(f.commands, append([]string{cmd}, args...))
+	result := CommandResult{Stdout: []byte("out"), Stderr: []byte("err")}
+	if f.exitCode != 0 {
+		return result, exec.CodeExitError{Err: fmt.Errorf("%s failed", cmd), Code: f.exitCode}
+	}
+	return result, nil
+}
+
+func TestRunnerMounter(t *testing.T) {
+	runner := &fakeRunner{}
+	SetCommandRunner(runner)
+	defer SetCommandRunner(nil)
+
+	mounter := Mounter()
+	if err := mounter.Mount("/src", "/dst", "", []string{"bind", "ro"}); err != nil {
+		t.Fatalf("mount failed: %v", err)
+	}
+	if err := mounter.Unmount("/dst"); err != nil {
+		t.Fatalf("unmount failed: %v", err)
+	}
+	expected := [][]string{
+		{"mount", "-o", "bind", "/src", "/dst"},
+		{"mount", "-o", "bind,remount,ro", "/src", "/dst"},
+		{"umount", "/dst"},
+	}
+	if !reflect.DeepEqual(runner.commands, expected) {
+		t.Errorf("got commands %v, expected %v", runner.commands, expected)
+	}
+
+	runner.exitCode = 32
+	err := mounter.MountSensitive("/src", "/dst", "nfs", nil, []string{"password=secret"})
+	if err == nil || strings.Contains(err.Error(), "secret") {
+		t.Errorf("expected error without sensitive options, got %v", err)
+	}
+}
+
+func TestRunnerExec(t *testing.T) {
+	runner := &fakeRunner{exitCode: 2}
+	SetCommandRunner(runner)
+	defer SetCommandRunner(nil)
+
+	output, err := Exec().Command("blkid", "/dev/sda").CombinedOutput()
+	if string(output) != "outerr" {
+		t.Errorf("bad output %q", output)
+	}
+	// mount-utils checks for exit codes with a type assertion.
+	exitErr, ok := err.(exec.ExitError)
+	if !ok || exitErr.ExitStatus() != 2 {
+		t.Errorf("expected exit status 2, got %v", err)
+	}
+
+	if _, err := RunCommandContext(context.Background(), CommandOptions{}, "mdadm", "--detail"); err == nil {
+		t.Errorf("expected runner error")
+	}
+	if len(runner.commands) != 2 || runner.commands[1][0] != "mdadm" {
+		t.Errorf("command not sent to runner: %v", runner.commands)
+	}
+}
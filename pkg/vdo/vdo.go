@@ -0,0 +1,119 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package vdo manages deduplicating VDO volumes through LVM.
+package vdo
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"k8s.io/klog/v2"
+
+	"github.com/GoogleCloudPlatform/csi-node-cache/pkg/util"
+)
+
+const (
+	lvmCmd = "/sbin/lvm"
+	// lvmConfig lets lvm run in a container without udev; lvm creates the
+	// device nodes itself.
+	lvmConfig = "devices { obtain_device_list_from_udev = 0 } activation { udev_sync = 0 udev_rules = 0 }"
+
+	// lvmTimeout is generous as creating a VDO volume formats its index.
+	lvmTimeout = 10 * time.Minute
+
+	volumeName = "cache"
+)
+
+// Volume is a VDO logical volume filling a volume group on a single device.
+type Volume struct {
+	group string
+	// ratio is the logical size of the volume as a multiple of the physical
+	// size. Above 1, the filesystem can use the space saved by deduplication,
+	// but writes fail if the data doesn't deduplicate as well as expected.
+	ratio float64
+}
+
+// New returns a volume in volume group group.
+func New(group string, ratio float64) *Volume {
+	if ratio < 1 {
+		ratio = 1
+	}
+	return &Volume{group: group, ratio: ratio}
+}
+
+// Device returns the block device of the volume.
+func (v *Volume) Device() string {
+	return fmt.Sprintf("/dev/%s/%s", v.group, volumeName)
+}
+
+// Init activates the volume, creating it on device if its volume group
+// doesn't exist. Creating the volume wipes device.
+func (v *Volume) Init(ctx context.Context, device string) error {
+	if _, err := runLvm(ctx, "vgs", "--noheadings", "-o", "vg_name", v.group); err == nil {
+		klog.Infof("Activating existing VDO volume group %s", v.group)
+		if _, err := runLvm(ctx, "vgchange", "-ay", v.group); err != nil {
+			return fmt.Errorf("Could not activate %s: %w", v.group, err)
+		}
+		return nil
+	}
+
+	klog.Infof("Creating VDO volume on %s in %s", device, v.group)
+	if _, err := runLvm(ctx, "pvcreate", "-y", device); err != nil {
+		return fmt.Errorf("Could not create physical volume on %s: %w", device, err)
+	}
+	if _, err := runLvm(ctx, "vgcreate", v.group, device); err != nil {
+		return fmt.Errorf("Could not create volume group %s: %w", v.group, err)
+	}
+	out, err := runLvm(ctx, "vgs", "--noheadings", "--nosuffix", "--units", "b", "-o", "vg_free", v.group)
+	if err != nil {
+		return fmt.Errorf("Could not get size of %s: %w", v.group, err)
+	}
+	logical, err := logicalSize(out, v.ratio)
+	if err != nil {
+		return err
+	}
+	if _, err := runLvm(ctx, "lvcreate", "-y", "--type", "vdo", "-l", "100%FREE", "-V", logical, "-n", volumeName, v.group); err != nil {
+		return fmt.Errorf("Could not create VDO volume in %s: %w", v.group, err)
+	}
+	return nil
+}
+
+// Stop deactivates the volume. Its contents are kept.
+func (v *Volume) Stop(ctx context.Context) error {
+	if _, err := runLvm(ctx, "vgchange", "-an", v.group); err != nil {
+		return fmt.Errorf("Could not deactivate %s: %w", v.group, err)
+	}
+	return nil
+}
+
+// logicalSize computes the lvcreate size argument from the free bytes
+// reported by vgs.
+func logicalSize(vgFree string, ratio float64) (string, error) {
+	free, err := strconv.ParseInt(strings.TrimSpace(vgFree), 10, 64)
+	if err != nil {
+		return "", fmt.Errorf("Bad volume group size %q: %w", vgFree, err)
+	}
+	// lvm rounds to extents, so MiB granularity is plenty.
+	return fmt.Sprintf("%dm", int64(float64(free)*ratio)>>20), nil
+}
+
+func runLvm(ctx context.Context, args ...string) (string, error) {
+	args = append([]string{args[0], "--config", lvmConfig}, args[1:]...)
+	result, err := util.RunCommandContext(ctx, util.CommandOptions{Timeout: lvmTimeout}, lvmCmd, args...)
+	return string(result.Stdout), err
+}
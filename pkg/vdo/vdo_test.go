@@ -0,0 +1,55 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vdo
+
+import (
+	"testing"
+)
+
+func TestLogicalSize(t *testing.T) {
+	tests := []struct {
+		vgFree   string
+		ratio    float64
+		expected string
+		err      bool
+	}{
+		{vgFree: "  10737418240\n", ratio: 1, expected: "10240m"},
+		{vgFree: "10737418240", ratio: 2.5, expected: "25600m"},
+		{vgFree: "10737418241", ratio: 1, expected: "10240m"},
+		{vgFree: "lots", ratio: 1, err: true},
+	}
+	for _, test := range tests {
+		size, err := logicalSize(test.vgFree, test.ratio)
+		if test.err {
+			if err == nil {
+				t.Errorf("Expected error for %q, got %s", test.vgFree, size)
+			}
+		} else if err != nil {
+			t.Errorf("Unexpected error for %q: %v", test.vgFree, err)
+		} else if size != test.expected {
+			t.Errorf("Got %s expected %s for %q x %f", size, test.expected, test.vgFree, test.ratio)
+		}
+	}
+}
+
+func TestNew(t *testing.T) {
+	v := New("node-cache-lssd", 0)
+	if v.ratio != 1 {
+		t.Errorf("Expected ratio clamped to 1, got %f", v.ratio)
+	}
+	if v.Device() != "/dev/node-cache-lssd/cache" {
+		t.Errorf("Unexpected device %s", v.Device())
+	}
+}